@@ -0,0 +1,176 @@
+package codanet
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	lmdbbs "github.com/georgeee/go-bs-lmdb"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+// BitswapArchive is a cold storage of historical blocks, e.g. block bodies
+// of past epochs served by archive nodes. It's an LMDB storage built
+// beforehand (by a helper or copied from its state directory), memory
+// mapped and never written to by the helper.
+type BitswapArchive struct {
+	storage *BitswapStorageCompressed
+	path    string
+}
+
+// OpenBitswapArchive opens the LMDB storage located in the directory.
+// A read-only archive is opened with MDB_RDONLY, so that it may reside
+// on a read-only filesystem; otherwise the storage is opened as the live
+// one is and may still be built by another process meanwhile.
+func OpenBitswapArchive(path string, readOnly bool) (*BitswapArchive, error) {
+	// Unlike the live storage, missing archives aren't created
+	if st, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if !st.IsDir() {
+		return nil, fmt.Errorf("archive blockstore %s is not a directory", path)
+	}
+	opt := lmdbbs.Options{
+		Path:           path,
+		ReadOnly:       readOnly,
+		CidToKeyMapper: cidToKeyMapper,
+		KeyToCidMapper: keyToCidMapper,
+	}
+	lmdb, err := lmdbbs.Open(&opt)
+	if err != nil {
+		return nil, err
+	}
+	bs := (*BitswapStorageLmdb)(lmdb)
+	format, err := bs.storageFormat()
+	if err == nil && format == storageFormatMigrating {
+		err = errors.New("block compression migration of the archive is incomplete")
+	}
+	if err != nil {
+		lmdb.Close()
+		return nil, err
+	}
+	// Storage format is only read, unlike NewBitswapStorageCompressed
+	// the archive isn't switched to tagged blocks
+	storage := &BitswapStorageCompressed{
+		BitswapStorageLmdb: bs,
+		tagged:             format == storageFormatTagged,
+		cache:              NewBlockCache(0),
+	}
+	return &BitswapArchive{storage: storage, path: path}, nil
+}
+
+func (a *BitswapArchive) Path() string {
+	return a.path
+}
+
+func (a *BitswapArchive) Close() error {
+	return a.storage.Close()
+}
+
+func (a *BitswapArchive) ViewBlock(key [32]byte, callback func([]byte) error) error {
+	return a.storage.ViewBlock(key, callback)
+}
+
+// ArchivedBlockstore is the blockstore used by Bitswap, blocks missing
+// from the live blockstore are looked up in the archive mounted, if any.
+// Blocks are only ever written to the live blockstore.
+type ArchivedBlockstore struct {
+	blockstore.Blockstore
+	archive *BitswapArchive
+	mutex   sync.RWMutex
+}
+
+func NewArchivedBlockstore(live blockstore.Blockstore) *ArchivedBlockstore {
+	return &ArchivedBlockstore{Blockstore: live}
+}
+
+// Mount replaces the archive (nil unmounts it), the archive replaced is
+// returned and may be closed as soon as Mount returns
+func (bs *ArchivedBlockstore) Mount(archive *BitswapArchive) *BitswapArchive {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	prev := bs.archive
+	bs.archive = archive
+	return prev
+}
+
+// Archive returns the archive mounted, nil if there's none
+func (bs *ArchivedBlockstore) Archive() *BitswapArchive {
+	bs.mutex.RLock()
+	defer bs.mutex.RUnlock()
+	return bs.archive
+}
+
+// withArchive runs f on the archive mounted, the archive
+// isn't unmounted until f returns
+func (bs *ArchivedBlockstore) withArchive(f func(*BitswapStorageCompressed) error) error {
+	bs.mutex.RLock()
+	defer bs.mutex.RUnlock()
+	if bs.archive == nil {
+		return blockstore.ErrNotFound
+	}
+	return f(bs.archive.storage)
+}
+
+func (bs *ArchivedBlockstore) Has(id cid.Cid) (bool, error) {
+	has, err := bs.Blockstore.Has(id)
+	if has || err != nil {
+		return has, err
+	}
+	err = bs.withArchive(func(archive *BitswapStorageCompressed) (err error) {
+		has, err = archive.Has(id)
+		return
+	})
+	if err == blockstore.ErrNotFound {
+		return false, nil
+	}
+	return has, err
+}
+
+func (bs *ArchivedBlockstore) Get(id cid.Cid) (blocks.Block, error) {
+	block, err := bs.Blockstore.Get(id)
+	if err != blockstore.ErrNotFound {
+		return block, err
+	}
+	err = bs.withArchive(func(archive *BitswapStorageCompressed) (err error) {
+		block, err = archive.Get(id)
+		return
+	})
+	return block, err
+}
+
+func (bs *ArchivedBlockstore) GetSize(id cid.Cid) (int, error) {
+	size, err := bs.Blockstore.GetSize(id)
+	if err != blockstore.ErrNotFound {
+		return size, err
+	}
+	err = bs.withArchive(func(archive *BitswapStorageCompressed) (err error) {
+		size, err = archive.GetSize(id)
+		return
+	})
+	if err != nil {
+		return -1, err
+	}
+	return size, nil
+}
+
+// View falls back to Get for live blockstores that can't view blocks
+func (bs *ArchivedBlockstore) View(id cid.Cid, callback func([]byte) error) error {
+	viewer, ok := bs.Blockstore.(blockstore.Viewer)
+	if !ok {
+		block, err := bs.Get(id)
+		if err != nil {
+			return err
+		}
+		return callback(block.RawData())
+	}
+	err := viewer.View(id, callback)
+	if err != blockstore.ErrNotFound {
+		return err
+	}
+	return bs.withArchive(func(archive *BitswapStorageCompressed) error {
+		return archive.View(id, callback)
+	})
+}
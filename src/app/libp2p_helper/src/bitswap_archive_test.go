@@ -0,0 +1,67 @@
+package codanet
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchivedBlockstore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Archive is built by a helper with compressed blocks
+	r := rand.New(rand.NewSource(0))
+	lmdb := openTestStorageLmdb(t, dir)
+	built, err := NewBitswapStorageCompressed(context.Background(), lmdb)
+	require.NoError(t, err)
+	require.NoError(t, built.SetCodec(BlockCodecZstd))
+	archivedKey, archivedBlock := mkCompressibleTestBlock(t, r)
+	require.NoError(t, built.Put(archivedBlock))
+	require.NoError(t, lmdb.Close())
+
+	_, err = OpenBitswapArchive(path.Join(dir, "missing"), true)
+	require.Error(t, err)
+	archive, err := OpenBitswapArchive(path.Join(dir, "block-db"), true)
+	require.NoError(t, err)
+
+	live := NewBitswapStorageMemory(1 << 20)
+	bs := NewArchivedBlockstore(live)
+	_, liveBlock := mkCompressibleTestBlock(t, r)
+	require.NoError(t, bs.Put(liveBlock))
+	has, err := bs.Has(archivedBlock.Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+
+	require.Nil(t, bs.Mount(archive))
+	for _, block := range []blocks.Block{archivedBlock, liveBlock} {
+		has, err := bs.Has(block.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+		got, err := bs.Get(block.Cid())
+		require.NoError(t, err)
+		require.Equal(t, block.RawData(), got.RawData())
+		size, err := bs.GetSize(block.Cid())
+		require.NoError(t, err)
+		require.Equal(t, len(block.RawData()), size)
+		require.NoError(t, bs.View(block.Cid(), func(data []byte) error {
+			require.Equal(t, block.RawData(), data)
+			return nil
+		}))
+	}
+	// Blocks of the archive aren't imported to the live blockstore
+	require.Equal(t, blockstore.ErrNotFound, live.ViewBlock(archivedKey, func([]byte) error { return nil }))
+
+	require.Equal(t, archive, bs.Mount(nil))
+	require.NoError(t, archive.Close())
+	_, err = bs.Get(archivedBlock.Cid())
+	require.Equal(t, blockstore.ErrNotFound, err)
+}
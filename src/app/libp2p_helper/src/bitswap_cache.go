@@ -0,0 +1,110 @@
+package codanet
+
+import (
+	"container/list"
+	"sync"
+)
+
+// BlockCache is an in-memory LRU cache of blocks read from a storage,
+// bounded by total size of cached blocks. Blocks are addressed by their
+// content, so a cached block never gets stale; deleted blocks are to be
+// removed from the cache though. Zero size disables the cache.
+type BlockCache struct {
+	maxSize int
+	size    int
+	// most recently used blocks are at the front
+	lru    *list.List
+	blocks map[[32]byte]*list.Element
+	hits   uint64
+	misses uint64
+	mutex  sync.Mutex
+}
+
+func NewBlockCache(maxSize int) *BlockCache {
+	return &BlockCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		blocks:  make(map[[32]byte]*list.Element),
+	}
+}
+
+// Enabled tells whether blocks are cached, callers may skip
+// preparing blocks for Add otherwise
+func (c *BlockCache) Enabled() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.maxSize > 0
+}
+
+// Get returns data of the cached block, it must not be modified
+func (c *BlockCache) Get(key [32]byte) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	el, has := c.blocks[key]
+	if !has {
+		if c.maxSize > 0 {
+			c.misses++
+		}
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(el)
+	return el.Value.(*memoryBlock).data, true
+}
+
+// Add caches the block, data is kept as is and must not be modified
+// afterwards. Blocks larger than the cache aren't cached.
+func (c *BlockCache) Add(key [32]byte, data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(data) > c.maxSize {
+		return
+	}
+	if el, has := c.blocks[key]; has {
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.blocks[key] = c.lru.PushFront(&memoryBlock{key: key, data: data})
+	c.size += len(data)
+	c.evict()
+}
+
+// Remove drops the blocks from the cache
+func (c *BlockCache) Remove(keys [][32]byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, key := range keys {
+		if el, has := c.blocks[key]; has {
+			c.remove(el)
+		}
+	}
+}
+
+// Resize changes the bound of the cache, evicting least
+// recently used blocks if the cache shrinks
+func (c *BlockCache) Resize(maxSize int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.maxSize = maxSize
+	c.evict()
+}
+
+// Stats returns total size of cached blocks, along with the number
+// of lookups that found a block and those that didn't
+func (c *BlockCache) Stats() (size int, hits uint64, misses uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.size, c.hits, c.misses
+}
+
+func (c *BlockCache) remove(el *list.Element) {
+	b := c.lru.Remove(el).(*memoryBlock)
+	delete(c.blocks, b.key)
+	c.size -= len(b.data)
+}
+
+func (c *BlockCache) evict() {
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
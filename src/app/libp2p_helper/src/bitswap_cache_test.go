@@ -0,0 +1,40 @@
+package codanet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockCache(t *testing.T) {
+	c := NewBlockCache(0)
+	c.Add([32]byte{1}, []byte("aaaa"))
+	_, has := c.Get([32]byte{1})
+	require.False(t, has)
+
+	c.Resize(10)
+	c.Add([32]byte{1}, []byte("aaaa"))
+	c.Add([32]byte{2}, []byte("bbbb"))
+	// Reading the first block makes the second one the least recently used
+	data, has := c.Get([32]byte{1})
+	require.True(t, has)
+	require.Equal(t, []byte("aaaa"), data)
+	c.Add([32]byte{3}, []byte("cccc"))
+	_, has = c.Get([32]byte{2})
+	require.False(t, has)
+	// Blocks larger than the cache aren't cached
+	c.Add([32]byte{4}, make([]byte, 11))
+	_, has = c.Get([32]byte{4})
+	require.False(t, has)
+	size, hits, misses := c.Stats()
+	require.Equal(t, 8, size)
+	require.Equal(t, uint64(1), hits)
+	require.Equal(t, uint64(2), misses)
+
+	c.Remove([][32]byte{{1}})
+	_, has = c.Get([32]byte{1})
+	require.False(t, has)
+	c.Resize(0)
+	size, _, _ = c.Stats()
+	require.Equal(t, 0, size)
+}
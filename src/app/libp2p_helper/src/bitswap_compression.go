@@ -0,0 +1,628 @@
+package codanet
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+	"sync/atomic"
+
+	lmdbbs "github.com/georgeee/go-bs-lmdb"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/blake2b"
+)
+
+// BlockCodecId tags every block stored by BitswapStorageCompressed,
+// ids are persisted, so an id must never be reused for another codec
+type BlockCodecId byte
+
+const (
+	BlockCodecNone BlockCodecId = iota
+	BlockCodecSnappy
+	BlockCodecZstd
+)
+
+// BlockCodec compresses payloads of blocks, both functions
+// may be called concurrently and append to dst
+type BlockCodec interface {
+	Compress(dst, src []byte) ([]byte, error)
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+var blockCodecs = map[BlockCodecId]BlockCodec{
+	BlockCodecSnappy: snappyCodec{},
+	BlockCodecZstd:   &zstdCodec{},
+}
+
+// RegisterBlockCodec makes the codec available under the id,
+// it's to be called before storages are opened
+func RegisterBlockCodec(id BlockCodecId, codec BlockCodec) {
+	if id == BlockCodecNone {
+		panic("codec id is reserved for uncompressed blocks")
+	}
+	if id&blockChecksumFlag != 0 {
+		panic("codec id overlaps the checksum flag")
+	}
+	blockCodecs[id] = codec
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Compress(dst, src []byte) ([]byte, error) {
+	return append(dst, snappy.Encode(nil, src)...), nil
+}
+
+func (snappyCodec) Decompress(dst, src []byte) ([]byte, error) {
+	res, err := snappy.Decode(nil, src)
+	return append(dst, res...), err
+}
+
+// zstdCodec starts its encoder and decoder on first use
+type zstdCodec struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func (c *zstdCodec) init() error {
+	c.once.Do(func() {
+		c.encoder, c.err = zstd.NewWriter(nil)
+		if c.err == nil {
+			c.decoder, c.err = zstd.NewReader(nil)
+		}
+	})
+	return c.err
+}
+
+func (c *zstdCodec) Compress(dst, src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.encoder.EncodeAll(src, dst), nil
+}
+
+func (c *zstdCodec) Decompress(dst, src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.decoder.DecodeAll(src, dst)
+}
+
+// Decoded sizes of blocks above the bound are taken for corruption
+const maxDecodedBlockSize = 1 << 24
+
+// Bit of the codec tag of blocks stored with the CRC32C checksum of
+// their data, the checksum follows the tag. Blocks written before
+// checksums were introduced have no checksum until they're rewritten
+// by MigrateBlockCompression.
+const blockChecksumFlag = 0x80
+
+const blockChecksumSize = 4
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrBlockChecksum is returned when data of a stored block doesn't match
+// its checksum, i.e. the block was corrupted after it was written. Hashes
+// of blocks are only verified by the network layer and by audits, while
+// checksums are verified on every read from disk.
+var ErrBlockChecksum = errors.New("block doesn't match its checksum")
+
+// BitswapChecksumFailures is implemented by storages verifying
+// checksums of blocks on read
+type BitswapChecksumFailures interface {
+	// ChecksumFailures returns blocks that failed their
+	// checksums on read and weren't deleted since
+	ChecksumFailures() [][32]byte
+}
+
+// encodeBlockValue tags the block with the codec, the checksum of data
+// follows the tag, then the uncompressed size of compressed blocks; blocks
+// that don't shrink (or fail to compress) are stored uncompressed
+func encodeBlockValue(codecId BlockCodecId, data []byte) []byte {
+	header := make([]byte, 1+blockChecksumSize+binary.MaxVarintLen64)
+	binary.BigEndian.PutUint32(header[1:], crc32.Checksum(data, crc32c))
+	if codec, has := blockCodecs[codecId]; has && codecId != BlockCodecNone {
+		header[0] = byte(codecId) | blockChecksumFlag
+		n := 1 + blockChecksumSize + binary.PutUvarint(header[1+blockChecksumSize:], uint64(len(data)))
+		res, err := codec.Compress(header[:n], data)
+		if err == nil && len(res) < len(data)+1+blockChecksumSize {
+			return res
+		}
+	}
+	header[0] = byte(BlockCodecNone) | blockChecksumFlag
+	return append(header[:1+blockChecksumSize], data...)
+}
+
+// blockValueHeader returns codec of the stored block, its uncompressed
+// size and the stored payload
+func blockValueHeader(value []byte) (BlockCodecId, int, []byte, error) {
+	if len(value) == 0 {
+		return 0, 0, nil, errors.New("block without codec tag")
+	}
+	codecId := BlockCodecId(value[0] &^ blockChecksumFlag)
+	offset := 1
+	if value[0]&blockChecksumFlag != 0 {
+		offset += blockChecksumSize
+		if len(value) < offset {
+			return 0, 0, nil, errors.New("truncated checksum of block")
+		}
+	}
+	if codecId == BlockCodecNone {
+		return codecId, len(value) - offset, value[offset:], nil
+	}
+	size, n := binary.Uvarint(value[offset:])
+	if n <= 0 || size > maxDecodedBlockSize {
+		return 0, 0, nil, errors.New("malformed size of compressed block")
+	}
+	return codecId, int(size), value[offset+n:], nil
+}
+
+// blockValueChecksum returns the checksum the block was stored
+// with, the value is expected to have a valid header
+func blockValueChecksum(value []byte) (uint32, bool) {
+	if value[0]&blockChecksumFlag == 0 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(value[1:]), true
+}
+
+// decodeBlockValue returns data of the stored block, verifying its
+// checksum; the result aliases the value for uncompressed blocks
+func decodeBlockValue(value []byte) ([]byte, error) {
+	codecId, size, payload, err := blockValueHeader(value)
+	if err != nil {
+		return nil, err
+	}
+	res := payload
+	if codecId != BlockCodecNone {
+		codec, has := blockCodecs[codecId]
+		if !has {
+			return nil, fmt.Errorf("unknown block codec %d", codecId)
+		}
+		res, err = codec.Decompress(make([]byte, 0, size), payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(res) != size {
+			return nil, fmt.Errorf("decompressed %d bytes of block of %d bytes", len(res), size)
+		}
+	}
+	if sum, has := blockValueChecksum(value); has && crc32.Checksum(res, crc32c) != sum {
+		return nil, ErrBlockChecksum
+	}
+	return res, nil
+}
+
+// Formats of values of blocks in the LMDB storage
+const (
+	// blocks are stored as is, the format of storages
+	// created before compression was introduced
+	storageFormatUntagged byte = iota
+	// blocks are being tagged by MigrateBlockCompression,
+	// untagged blocks are told apart by their hash
+	storageFormatMigrating
+	// every block is tagged with its codec
+	storageFormatTagged
+)
+
+var storageFormatKey = []byte{BS_FORMAT_PREFIX}
+
+func (bs_ *BitswapStorageLmdb) storageFormat() (byte, error) {
+	r, err := (*lmdbbs.Blockstore)(bs_).GetData(storageFormatKey)
+	if err == blockstore.ErrNotFound {
+		return storageFormatUntagged, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(r) != 1 || r[0] > storageFormatTagged {
+		return 0, fmt.Errorf("wrong storage format retrieved: %v", r)
+	}
+	return r[0], nil
+}
+
+func (bs_ *BitswapStorageLmdb) setStorageFormat(format byte) error {
+	return (*lmdbbs.Blockstore)(bs_).PutData(storageFormatKey, func(_ []byte, _ bool) ([]byte, bool, error) {
+		return []byte{format}, true, nil
+	})
+}
+
+// hasBlocks tells whether any block is stored
+func (bs_ *BitswapStorageLmdb) hasBlocks(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch, err := (*lmdbbs.Blockstore)(bs_).AllKeysChan(ctx)
+	if err != nil {
+		return false, err
+	}
+	for id := range ch {
+		if id.Defined() && id.Prefix().Codec == cid.Raw {
+			return true, nil
+		}
+	}
+	return false, ctx.Err()
+}
+
+// BitswapStorageCompressed is the LMDB storage with blocks tagged with
+// their codec, so that blocks written with different codecs (or
+// uncompressed) are read alike. Storages created before compression was
+// introduced keep blocks untagged until MigrateBlockCompression is run on
+// them, meanwhile blocks are stored as is. Sizes of blocks used for
+// garbage collection and deduplication stats are the stored sizes.
+// Decoded blocks are kept in a read cache, disabled until SetCacheSize.
+// Tagged blocks are written with checksums, blocks failing them on read
+// are remembered until they're deleted.
+type BitswapStorageCompressed struct {
+	*BitswapStorageLmdb
+	tagged bool
+	// BlockCodecId of written blocks
+	codec uint32
+	cache *BlockCache
+	// blocks that failed their checksums
+	checksumFailures map[[32]byte]bool
+	failuresMutex    sync.Mutex
+}
+
+// NewBitswapStorageCompressed wraps the storage, empty storages are
+// switched to tagged blocks. Storages in the middle of a migration
+// are refused, the migration is to be completed first.
+func NewBitswapStorageCompressed(ctx context.Context, bs *BitswapStorageLmdb) (*BitswapStorageCompressed, error) {
+	format, err := bs.storageFormat()
+	if err != nil {
+		return nil, err
+	}
+	if format == storageFormatMigrating {
+		return nil, errors.New("block compression migration of the storage is incomplete, rerun `blockstore migrate`")
+	}
+	if format == storageFormatUntagged {
+		nonEmpty, err := bs.hasBlocks(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !nonEmpty {
+			if err := bs.setStorageFormat(storageFormatTagged); err != nil {
+				return nil, err
+			}
+			format = storageFormatTagged
+		}
+	}
+	return &BitswapStorageCompressed{
+		BitswapStorageLmdb: bs,
+		tagged:             format == storageFormatTagged,
+		cache:              NewBlockCache(0),
+		checksumFailures:   make(map[[32]byte]bool),
+	}, nil
+}
+
+// Tagged tells whether blocks are tagged with their codec,
+// otherwise they're written uncompressed regardless of the codec
+func (bs *BitswapStorageCompressed) Tagged() bool {
+	return bs.tagged
+}
+
+// SetCodec sets the codec of blocks written from now on,
+// it fails for storages that weren't migrated
+func (bs *BitswapStorageCompressed) SetCodec(codecId BlockCodecId) error {
+	if _, has := blockCodecs[codecId]; !has && codecId != BlockCodecNone {
+		return fmt.Errorf("unknown block codec %d", codecId)
+	}
+	if !bs.tagged && codecId != BlockCodecNone {
+		return errors.New("blocks of the storage aren't tagged with codecs, run `blockstore migrate` to compress them")
+	}
+	atomic.StoreUint32(&bs.codec, uint32(codecId))
+	return nil
+}
+
+// SetCacheSize bounds total size of blocks kept in the read cache,
+// zero disables the cache
+func (bs *BitswapStorageCompressed) SetCacheSize(size int) {
+	bs.cache.Resize(size)
+}
+
+// Cache returns the read cache of the storage
+func (bs *BitswapStorageCompressed) Cache() *BlockCache {
+	return bs.cache
+}
+
+func (bs *BitswapStorageCompressed) lmdb() *lmdbbs.Blockstore {
+	return (*lmdbbs.Blockstore)(bs.BitswapStorageLmdb)
+}
+
+func (bs *BitswapStorageCompressed) encode(block blocks.Block) (blocks.Block, error) {
+	if !bs.tagged {
+		return block, nil
+	}
+	value := encodeBlockValue(BlockCodecId(atomic.LoadUint32(&bs.codec)), block.RawData())
+	return blocks.NewBlockWithCid(value, block.Cid())
+}
+
+func (bs *BitswapStorageCompressed) decode(id cid.Cid, value []byte) ([]byte, error) {
+	if !bs.tagged {
+		return value, nil
+	}
+	data, err := decodeBlockValue(value)
+	if err == ErrBlockChecksum {
+		if key, ok := CidToBlockHash(id); ok {
+			bs.failuresMutex.Lock()
+			bs.checksumFailures[key] = true
+			bs.failuresMutex.Unlock()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("block %s: %w", id, err)
+	}
+	return data, nil
+}
+
+func (bs *BitswapStorageCompressed) ChecksumFailures() [][32]byte {
+	bs.failuresMutex.Lock()
+	defer bs.failuresMutex.Unlock()
+	res := make([][32]byte, 0, len(bs.checksumFailures))
+	for key := range bs.checksumFailures {
+		res = append(res, key)
+	}
+	return res
+}
+
+func (bs *BitswapStorageCompressed) forgetChecksumFailures(keys [][32]byte) {
+	bs.failuresMutex.Lock()
+	defer bs.failuresMutex.Unlock()
+	for _, key := range keys {
+		delete(bs.checksumFailures, key)
+	}
+}
+
+func (bs *BitswapStorageCompressed) ViewBlock(key [32]byte, callback func([]byte) error) error {
+	return bs.View(BlockHashToCid(key), callback)
+}
+
+func (bs *BitswapStorageCompressed) DeleteBlocks(keys [][32]byte) error {
+	bs.cache.Remove(keys)
+	if err := bs.BitswapStorageLmdb.DeleteBlocks(keys); err != nil {
+		return err
+	}
+	bs.forgetChecksumFailures(keys)
+	return nil
+}
+
+func (bs *BitswapStorageCompressed) PutBlocks(blockMap map[[32]byte][]byte) error {
+	blocks_, err := blocksOfMap(blockMap)
+	if err != nil {
+		return err
+	}
+	return bs.PutMany(blocks_)
+}
+
+// GetBlocks copies data of blocks read from LMDB once, the copy
+// returned is the one kept in the cache
+func (bs *BitswapStorageCompressed) GetBlocks(keys [][32]byte) (map[[32]byte][]byte, error) {
+	res := make(map[[32]byte][]byte, len(keys))
+	for _, key := range keys {
+		if data, has := bs.cache.Get(key); has {
+			res[key] = data
+			continue
+		}
+		data, err := bs.readBlock(key)
+		if err == blockstore.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res[key] = data
+	}
+	return res, nil
+}
+
+// readBlock reads the block from LMDB and caches it, the returned
+// data is owned by the cache if it's enabled
+func (bs *BitswapStorageCompressed) readBlock(key [32]byte) ([]byte, error) {
+	id := BlockHashToCid(key)
+	var data []byte
+	err := bs.lmdb().View(id, func(value []byte) error {
+		b, err := bs.decode(id, value)
+		if err != nil {
+			return err
+		}
+		data = make([]byte, len(b))
+		copy(data, b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	bs.cache.Add(key, data)
+	return data, nil
+}
+
+// Blockstore interface, used by Bitswap
+
+func (bs *BitswapStorageCompressed) DeleteBlock(id cid.Cid) error {
+	key, ok := CidToBlockHash(id)
+	if ok {
+		bs.cache.Remove([][32]byte{key})
+	}
+	if err := bs.lmdb().DeleteBlock(id); err != nil {
+		return err
+	}
+	if ok {
+		bs.forgetChecksumFailures([][32]byte{key})
+	}
+	return nil
+}
+
+func (bs *BitswapStorageCompressed) Has(id cid.Cid) (bool, error) {
+	return bs.lmdb().Has(id)
+}
+
+func (bs *BitswapStorageCompressed) View(id cid.Cid, callback func([]byte) error) error {
+	if key, ok := CidToBlockHash(id); ok {
+		if data, has := bs.cache.Get(key); has {
+			return callback(data)
+		}
+		if bs.cache.Enabled() {
+			data, err := bs.readBlock(key)
+			if err != nil {
+				return err
+			}
+			return callback(data)
+		}
+	}
+	return bs.lmdb().View(id, func(value []byte) error {
+		data, err := bs.decode(id, value)
+		if err != nil {
+			return err
+		}
+		return callback(data)
+	})
+}
+
+func (bs *BitswapStorageCompressed) Get(id cid.Cid) (blocks.Block, error) {
+	var data []byte
+	var err error
+	if key, ok := CidToBlockHash(id); ok {
+		if cached, has := bs.cache.Get(key); has {
+			data = cached
+		} else {
+			data, err = bs.readBlock(key)
+		}
+	} else {
+		err = bs.View(id, func(b []byte) error {
+			data = make([]byte, len(b))
+			copy(data, b)
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithCid(data, id)
+}
+
+// GetSize returns the uncompressed size of the block
+func (bs *BitswapStorageCompressed) GetSize(id cid.Cid) (int, error) {
+	if key, ok := CidToBlockHash(id); ok {
+		if data, has := bs.cache.Get(key); has {
+			return len(data), nil
+		}
+	}
+	size := -1
+	err := bs.lmdb().View(id, func(value []byte) error {
+		if !bs.tagged {
+			size = len(value)
+			return nil
+		}
+		_, size_, _, err := blockValueHeader(value)
+		size = size_
+		return err
+	})
+	return size, err
+}
+
+func (bs *BitswapStorageCompressed) Put(block blocks.Block) error {
+	return bs.PutMany([]blocks.Block{block})
+}
+
+func (bs *BitswapStorageCompressed) PutMany(blocks_ []blocks.Block) error {
+	encoded := make([]blocks.Block, len(blocks_))
+	for i, block := range blocks_ {
+		b, err := bs.encode(block)
+		if err != nil {
+			return err
+		}
+		encoded[i] = b
+	}
+	return bs.lmdb().PutMany(encoded)
+}
+
+func (bs *BitswapStorageCompressed) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	return bs.lmdb().AllKeysChan(ctx)
+}
+
+// HashOnRead is a no-op, hashes are checked by `blockstore fsck`
+func (bs *BitswapStorageCompressed) HashOnRead(bool) {}
+
+// BlockCompressionStats describes blocks rewritten by MigrateBlockCompression
+type BlockCompressionStats struct {
+	Blocks int `json:"blocks"`
+	// Blocks tagged with a codec for the first time
+	Tagged int `json:"tagged"`
+	// Blocks compressed with another codec before
+	Recompressed int `json:"recompressed"`
+	// Total size of rewritten blocks before and after
+	BytesBefore int `json:"bytes_before"`
+	BytesAfter  int `json:"bytes_after"`
+	// Blocks failing their checksums, left as they are
+	Corrupted int `json:"corrupted"`
+}
+
+// MigrateBlockCompression rewrites blocks of the storage with the codec
+// and tags blocks of a storage created before compression was introduced.
+// Rewritten blocks are stored with checksums, including blocks already
+// compressed with the codec if they were stored without one.
+// An interrupted migration may be rerun, storages in the middle of a
+// migration aren't opened for Bitswap.
+func (bs_ *BitswapStorageLmdb) MigrateBlockCompression(ctx context.Context, codecId BlockCodecId) (BlockCompressionStats, error) {
+	var stats BlockCompressionStats
+	if _, has := blockCodecs[codecId]; !has && codecId != BlockCodecNone {
+		return stats, fmt.Errorf("unknown block codec %d", codecId)
+	}
+	format, err := bs_.storageFormat()
+	if err != nil {
+		return stats, err
+	}
+	if format == storageFormatUntagged {
+		if err := bs_.setStorageFormat(storageFormatMigrating); err != nil {
+			return stats, err
+		}
+		format = storageFormatMigrating
+	}
+	blocks_, _, err := bs_.Scan(ctx)
+	if err != nil {
+		return stats, err
+	}
+	bs := (*lmdbbs.Blockstore)(bs_)
+	for _, key := range blocks_ {
+		err := bs.PutData(blockKey(key[:]), func(value []byte, exists bool) ([]byte, bool, error) {
+			if !exists {
+				return nil, false, nil
+			}
+			stats.Blocks++
+			// Blocks of a migrating storage are tagged once they decode
+			// to their hash, corrupted blocks are tagged as they are
+			// for `blockstore fsck` to report them
+			data, err := decodeBlockValue(value)
+			if err == ErrBlockChecksum && format == storageFormatTagged {
+				stats.Corrupted++
+				return nil, false, nil
+			}
+			tagged := err == nil && (format == storageFormatTagged || blake2b.Sum256(data) == key)
+			switch {
+			case !tagged && format == storageFormatTagged:
+				return nil, false, err
+			case !tagged:
+				data = value
+				stats.Tagged++
+			case value[0] == byte(codecId)|blockChecksumFlag:
+				return append([]byte{}, value...), true, nil
+			default:
+				stats.Recompressed++
+			}
+			res := encodeBlockValue(codecId, data)
+			stats.BytesBefore += len(value)
+			stats.BytesAfter += len(res)
+			return res, true, nil
+		})
+		if err != nil {
+			return stats, fmt.Errorf("block %s: %w", BlockHashToCid(key), err)
+		}
+	}
+	return stats, bs_.setStorageFormat(storageFormatTagged)
+}
@@ -0,0 +1,245 @@
+package codanet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	lmdbbs "github.com/georgeee/go-bs-lmdb"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+)
+
+func mkCompressibleTestBlock(t *testing.T, r *rand.Rand) ([32]byte, blocks.Block) {
+	word := make([]byte, 16)
+	_, err := r.Read(word)
+	require.NoError(t, err)
+	return mkMemoryTestBlock(t, bytes.Repeat(word, 256))
+}
+
+func TestBlockValueEncoding(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	_, compressible := mkCompressibleTestBlock(t, r)
+	random := make([]byte, 4096)
+	_, err := r.Read(random)
+	require.NoError(t, err)
+	for _, codec := range []BlockCodecId{BlockCodecNone, BlockCodecSnappy, BlockCodecZstd} {
+		value := encodeBlockValue(codec, compressible.RawData())
+		require.Equal(t, byte(codec)|blockChecksumFlag, value[0])
+		if codec != BlockCodecNone {
+			require.Less(t, len(value), len(compressible.RawData()))
+		}
+		data, err := decodeBlockValue(value)
+		require.NoError(t, err)
+		require.Equal(t, compressible.RawData(), data)
+
+		// Blocks that don't shrink are stored uncompressed
+		value = encodeBlockValue(codec, random)
+		require.Equal(t, byte(BlockCodecNone)|blockChecksumFlag, value[0])
+		data, err = decodeBlockValue(value)
+		require.NoError(t, err)
+		require.Equal(t, random, data)
+	}
+	_, err = decodeBlockValue([]byte{byte(BlockCodecZstd), 10, 1, 2, 3})
+	require.Error(t, err)
+	_, err = decodeBlockValue([]byte{42, 1, 0})
+	require.Error(t, err)
+}
+
+func TestBlockValueChecksum(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	_, compressible := mkCompressibleTestBlock(t, r)
+	for _, codec := range []BlockCodecId{BlockCodecNone, BlockCodecSnappy, BlockCodecZstd} {
+		value := encodeBlockValue(codec, compressible.RawData())
+		value[1] ^= 1
+		_, err := decodeBlockValue(value)
+		require.Equal(t, ErrBlockChecksum, err)
+	}
+	// Data of uncompressed blocks is only checked by the checksum
+	value := encodeBlockValue(BlockCodecNone, compressible.RawData())
+	value[len(value)-1] ^= 1
+	_, err := decodeBlockValue(value)
+	require.Equal(t, ErrBlockChecksum, err)
+	// Blocks written before checksums were introduced are read as they are
+	data, err := decodeBlockValue(append([]byte{byte(BlockCodecNone)}, compressible.RawData()...))
+	require.NoError(t, err)
+	require.Equal(t, compressible.RawData(), data)
+	_, err = decodeBlockValue([]byte{byte(BlockCodecNone) | blockChecksumFlag, 1, 2})
+	require.Error(t, err)
+}
+
+func TestBitswapStorageChecksumFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	lmdb := openTestStorageLmdb(t, dir)
+	defer lmdb.Close()
+	bs, err := NewBitswapStorageCompressed(context.Background(), lmdb)
+	require.NoError(t, err)
+	r := rand.New(rand.NewSource(0))
+	key, block := mkCompressibleTestBlock(t, r)
+	require.NoError(t, bs.Put(block))
+
+	// Corrupt the stored data of the block
+	require.NoError(t, (*lmdbbs.Blockstore)(lmdb).PutData(blockKey(key[:]), func(value []byte, _ bool) ([]byte, bool, error) {
+		res := append([]byte{}, value...)
+		res[len(res)-1] ^= 1
+		return res, true, nil
+	}))
+	_, err = bs.Get(block.Cid())
+	require.True(t, errors.Is(err, ErrBlockChecksum))
+	err = bs.ViewBlock(key, func([]byte) error { return nil })
+	require.True(t, errors.Is(err, ErrBlockChecksum))
+	require.Equal(t, [][32]byte{key}, bs.ChecksumFailures())
+
+	// Failures are forgotten with deleted blocks
+	require.NoError(t, bs.DeleteBlocks([][32]byte{key}))
+	require.Empty(t, bs.ChecksumFailures())
+}
+
+func openTestStorageLmdb(t *testing.T, dir string) *BitswapStorageLmdb {
+	bs, err := OpenBitswapStorageLmdbForScan(dir)
+	require.NoError(t, err)
+	return bs
+}
+
+func TestBitswapStorageCompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	lmdb := openTestStorageLmdb(t, dir)
+	defer lmdb.Close()
+	bs, err := NewBitswapStorageCompressed(context.Background(), lmdb)
+	require.NoError(t, err)
+	require.True(t, bs.Tagged())
+
+	r := rand.New(rand.NewSource(0))
+	var keys [][32]byte
+	var blks []blocks.Block
+	for _, codec := range []BlockCodecId{BlockCodecNone, BlockCodecSnappy, BlockCodecZstd} {
+		require.NoError(t, bs.SetCodec(codec))
+		key, block := mkCompressibleTestBlock(t, r)
+		require.NoError(t, bs.Put(block))
+		keys, blks = append(keys, key), append(blks, block)
+	}
+	require.Error(t, bs.SetCodec(42))
+	for i, block := range blks {
+		b, err := bs.Get(block.Cid())
+		require.NoError(t, err)
+		require.Equal(t, block.RawData(), b.RawData())
+		size, err := bs.GetSize(block.Cid())
+		require.NoError(t, err)
+		require.Equal(t, len(block.RawData()), size)
+		require.NoError(t, bs.ViewBlock(keys[i], func(data []byte) error {
+			require.Equal(t, block.RawData(), data)
+			return nil
+		}))
+	}
+	// Compressed blocks take less space than the uncompressed one
+	_, _, total, err := bs.UnreferencedBlocks(context.Background())
+	require.NoError(t, err)
+	require.Less(t, total, 3*len(blks[0].RawData()))
+}
+
+func TestMigrateBlockCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	lmdb := openTestStorageLmdb(t, dir)
+	defer lmdb.Close()
+
+	// Blocks of a storage created before compression are untagged
+	r := rand.New(rand.NewSource(0))
+	var blks []blocks.Block
+	for i := 0; i < 10; i++ {
+		_, block := mkCompressibleTestBlock(t, r)
+		require.NoError(t, (*lmdbbs.Blockstore)(lmdb).Put(block))
+		blks = append(blks, block)
+	}
+	bs, err := NewBitswapStorageCompressed(context.Background(), lmdb)
+	require.NoError(t, err)
+	require.False(t, bs.Tagged())
+	require.Error(t, bs.SetCodec(BlockCodecZstd))
+	b, err := bs.Get(blks[0].Cid())
+	require.NoError(t, err)
+	require.Equal(t, blks[0].RawData(), b.RawData())
+
+	// An interrupted migration leaves some blocks tagged
+	require.NoError(t, lmdb.setStorageFormat(storageFormatMigrating))
+	key, _ := CidToBlockHash(blks[0].Cid())
+	require.NoError(t, (*lmdbbs.Blockstore)(lmdb).PutData(blockKey(key[:]), func([]byte, bool) ([]byte, bool, error) {
+		return encodeBlockValue(BlockCodecSnappy, blks[0].RawData()), true, nil
+	}))
+	_, err = NewBitswapStorageCompressed(context.Background(), lmdb)
+	require.Error(t, err)
+
+	stats, err := lmdb.MigrateBlockCompression(context.Background(), BlockCodecZstd)
+	require.NoError(t, err)
+	require.Equal(t, BlockCompressionStats{
+		Blocks:       10,
+		Tagged:       9,
+		Recompressed: 1,
+		BytesBefore:  stats.BytesBefore,
+		BytesAfter:   stats.BytesAfter,
+	}, stats)
+	require.Less(t, stats.BytesAfter, stats.BytesBefore)
+
+	bs, err = NewBitswapStorageCompressed(context.Background(), lmdb)
+	require.NoError(t, err)
+	require.True(t, bs.Tagged())
+	for _, block := range blks {
+		b, err := bs.Get(block.Cid())
+		require.NoError(t, err)
+		require.Equal(t, block.RawData(), b.RawData())
+	}
+
+	// Rerunning the migration with the same codec leaves blocks as they are
+	stats, err = lmdb.MigrateBlockCompression(context.Background(), BlockCodecZstd)
+	require.NoError(t, err)
+	require.Equal(t, BlockCompressionStats{Blocks: 10}, stats)
+}
+
+func TestBitswapStorageCompressedBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	lmdb := openTestStorageLmdb(t, dir)
+	defer lmdb.Close()
+	bs, err := NewBitswapStorageCompressed(context.Background(), lmdb)
+	require.NoError(t, err)
+	require.NoError(t, bs.SetCodec(BlockCodecZstd))
+
+	r := rand.New(rand.NewSource(0))
+	blockMap := make(map[[32]byte][]byte)
+	var keys [][32]byte
+	for i := 0; i < 3; i++ {
+		key, block := mkCompressibleTestBlock(t, r)
+		blockMap[key] = block.RawData()
+		keys = append(keys, key)
+	}
+	require.NoError(t, bs.PutBlocks(blockMap))
+	absent := [32]byte{1}
+	for _, cacheSize := range []int{0, 1 << 20} {
+		bs.SetCacheSize(cacheSize)
+		// Blocks are read from the cache the second time
+		for i := 0; i < 2; i++ {
+			res, err := bs.GetBlocks(append(keys, absent))
+			require.NoError(t, err)
+			require.Equal(t, blockMap, res)
+		}
+	}
+	size, hits, _ := bs.Cache().Stats()
+	require.Equal(t, 3*len(blockMap[keys[0]]), size)
+	require.Equal(t, uint64(3), hits)
+
+	// Deleted blocks are dropped from the cache
+	require.NoError(t, bs.DeleteBlocks(keys[:1]))
+	res, err := bs.GetBlocks(keys)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	require.NotContains(t, res, keys[0])
+}
@@ -1,4 +1,4 @@
-package main
+package bitswap_downloader
 
 import (
 	"bytes"
@@ -22,7 +22,7 @@ func SplitDataToBitswapBlocks(maxBlockSize int, data []byte) (map[BitswapBlockLi
 }
 
 type BitswapBlockSchema struct {
-	totalBlocks              int
+	TotalBlocks              int
 	fullLinkBlocks           int
 	nonMaxLinkBlockLinkCount int
 	lastBlockDataSize        int
@@ -32,22 +32,54 @@ type BitswapBlockSchema struct {
 
 func (s BitswapBlockSchema) String() string {
 	return fmt.Sprintf("{total: %d, fullLink: %d, lastLinkCount: %d, lastBlockDataSize: %d, maxBlockSize: %d, linksPerBlock: %d}",
-		s.totalBlocks, s.fullLinkBlocks, s.nonMaxLinkBlockLinkCount, s.lastBlockDataSize, s.maxBlockSize, s.maxLinksPerBlock)
+		s.TotalBlocks, s.fullLinkBlocks, s.nonMaxLinkBlockLinkCount, s.lastBlockDataSize, s.maxBlockSize, s.maxLinksPerBlock)
 }
 
 // NodeIndex is an index of a node within a specific block tree
 type NodeIndex int
 
+// Flag of the length prefix telling that the max block size of the tree
+// follows the length (as 4 bytes). Trees of the default max block size
+// omit it, so that their roots are the same as before the flag was
+// introduced; lengths of data are hence less than the flag.
+const RootBlockSizeFlag = 1 << 31
+
+// Bounds of max block sizes encoded in root blocks, the lower bound
+// keeps the number of blocks of a tree proportional to its data size
+const (
+	minEncodedBlockSize = 1 << 12 // 4 KiB
+	maxEncodedBlockSize = 1 << 21 // 2 MiB
+)
+
 // ExtractLengthFromRootBlockData tries to extract length from root block bytes
 // It assumes data section to be at least 4 bytes long and interprets first 4 bytes of data as
 // length of the whole data blob encoded into block tree associated with the given root block.
+// Max block size encoded in the root block is skipped.
 func ExtractLengthFromRootBlockData(data_ []byte) (data []byte, length int, err error) {
+	data, length, _, err = ExtractRootBlockMeta(data_)
+	return
+}
+
+// ExtractRootBlockMeta is ExtractLengthFromRootBlockData also returning
+// max block size of the tree if it's encoded in the root block, zero otherwise
+func ExtractRootBlockMeta(data_ []byte) (data []byte, length int, maxBlockSize int, err error) {
 	if len(data_) < 4 {
 		err = errors.New("data less than 4 bytes long")
 		return
 	}
-	length = int(binary.LittleEndian.Uint32(data_))
+	l := binary.LittleEndian.Uint32(data_)
 	data = data_[4:]
+	if l&RootBlockSizeFlag == 0 {
+		length = int(l)
+		return
+	}
+	if len(data) < 4 {
+		err = errors.New("data less than 8 bytes long")
+		return
+	}
+	length = int(l &^ RootBlockSizeFlag)
+	maxBlockSize = int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
 	return
 }
 
@@ -55,6 +87,26 @@ func SplitDataToBitswapBlocksLengthPrefixedWithTag(maxBlockSize int, data []byte
 	return SplitDataToBitswapBlocksLengthPrefixed(maxBlockSize, append([]byte{byte(tag)}, data...))
 }
 
+// SplitDataToBitswapBlocksWithBlockSize is SplitDataToBitswapBlocksLengthPrefixedWithTag
+// encoding the max block size in the root block, for trees built with a max
+// block size other than the default one
+func SplitDataToBitswapBlocksWithBlockSize(maxBlockSize int, data []byte, tag BitswapDataTag) (map[BitswapBlockLink][]byte, BitswapBlockLink) {
+	if maxBlockSize < 2+BITSWAP_BLOCK_LINK_SIZE+8 {
+		panic("Max block size too small")
+	}
+	if len(data)+1 >= RootBlockSizeFlag {
+		panic("data too large")
+	}
+	dataWL := make([]byte, len(data)+9)
+	binary.LittleEndian.PutUint32(dataWL, uint32(len(data)+1)|RootBlockSizeFlag)
+	binary.LittleEndian.PutUint32(dataWL[4:], uint32(maxBlockSize))
+	dataWL[8] = byte(tag)
+	copy(dataWL[9:], data)
+	return SplitDataToBitswapBlocksWithHashF(maxBlockSize, func(b []byte) BitswapBlockLink {
+		return blake2b.Sum256(b)
+	}, dataWL)
+}
+
 func SplitDataToBitswapBlocksLengthPrefixed(maxBlockSize int, data []byte) (map[BitswapBlockLink][]byte, BitswapBlockLink) {
 	return SplitDataToBitswapBlocksLengthPrefixedWithHashF(maxBlockSize, func(b []byte) BitswapBlockLink {
 		return blake2b.Sum256(b)
@@ -106,9 +158,29 @@ func MkDepthIndices(linksPerBlock, maxTotalBlocks int) DepthIndices {
 	return DepthIndices{indices: res, linksPerBlock: linksPerBlock}
 }
 
+// Depth returns the number of levels of the tree, including the root
+func (di *DepthIndices) Depth() int {
+	return len(di.indices)
+}
+
+// treeDepth returns the number of levels of the tree of the schema
+func treeDepth(schema *BitswapBlockSchema) int {
+	di := MkDepthIndices(schema.maxLinksPerBlock, schema.TotalBlocks)
+	return di.Depth()
+}
+
 func MkBitswapBlockSchemaLengthPrefixed(maxBlockSize int, dataLength int) BitswapBlockSchema {
 	return MkBitswapBlockSchema(maxBlockSize, dataLength+4)
 }
+
+// DepthIndicesOf returns di if it's computed for the links per block
+// of the schema, computing depth indices of the schema otherwise
+func DepthIndicesOf(di DepthIndices, schema *BitswapBlockSchema) DepthIndices {
+	if di.linksPerBlock == schema.maxLinksPerBlock {
+		return di
+	}
+	return MkDepthIndices(schema.maxLinksPerBlock, schema.TotalBlocks)
+}
 func MkBitswapBlockSchema(maxBlockSize int, dataLength int) BitswapBlockSchema {
 	// `n` is the total number of bitswap blocks
 	//   formula for `n` is derived as follows
@@ -144,7 +216,7 @@ func MkBitswapBlockSchema(maxBlockSize int, dataLength int) BitswapBlockSchema {
 	// `linksPerBlock` links
 	fullLinkBlocks := (n - 1) / linksPerBlock
 	return BitswapBlockSchema{
-		totalBlocks:              n,
+		TotalBlocks:              n,
 		lastBlockDataSize:        lastBlockDataSz,
 		fullLinkBlocks:           fullLinkBlocks,
 		nonMaxLinkBlockLinkCount: (n - 1) % linksPerBlock,
@@ -167,7 +239,7 @@ func (di *DepthIndices) FirstChildId(id NodeIndex) NodeIndex {
 }
 
 func (schema *BitswapBlockSchema) BlockSize(id NodeIndex) int {
-	if id == NodeIndex(schema.totalBlocks-1) {
+	if id == NodeIndex(schema.TotalBlocks-1) {
 		return schema.lastBlockDataSize + 2
 	}
 	return schema.maxBlockSize
@@ -211,7 +283,7 @@ func SplitDataToBitswapBlocksWithHashF(maxBlockSize int, hashF func([]byte) Bits
 	// Maximum number of links that can fit in a single Bitswap block
 	schema := MkBitswapBlockSchema(maxBlockSize, len(data))
 	linksPerBlock := schema.maxLinksPerBlock
-	n := schema.totalBlocks
+	n := schema.TotalBlocks
 	fullLinkBlocks := schema.fullLinkBlocks
 	lRem := schema.nonMaxLinkBlockLinkCount
 
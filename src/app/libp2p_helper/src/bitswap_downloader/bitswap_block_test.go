@@ -1,4 +1,4 @@
-package main
+package bitswap_downloader
 
 import (
 	"bytes"
@@ -76,10 +76,10 @@ func testSplitJoinPrefix(maxBlockSize int, data []byte) error {
 	schema := MkBitswapBlockSchemaLengthPrefixed(maxBlockSize, len(data))
 	// len(blocks) < schema.totalBlocks is an ok case because some blocks and block subtrees
 	// may appear more than once in the tree (in case of data containing repeative subranges)
-	if len(blocks) > schema.totalBlocks {
-		return fmt.Errorf("mismatch of block count: %d > %d", len(blocks), schema.totalBlocks)
+	if len(blocks) > schema.TotalBlocks {
+		return fmt.Errorf("mismatch of block count: %d > %d", len(blocks), schema.TotalBlocks)
 	}
-	di := MkDepthIndices(schema.maxLinksPerBlock, schema.totalBlocks)
+	di := MkDepthIndices(schema.maxLinksPerBlock, schema.TotalBlocks)
 	for q := []linkIxPair{{id: root}}; len(q) > 0; q = q[1:] {
 		id := q[0].id
 		ix := q[0].ix
@@ -126,8 +126,8 @@ func testSplitJoin(maxBlockSize int, data []byte) error {
 	schema := MkBitswapBlockSchema(maxBlockSize, len(data))
 	// len(blocks) < schema.totalBlocks is an ok case because some blocks and block subtrees
 	// may appear more than once in the tree (in case of data containing repeative subranges)
-	if len(blocks) > schema.totalBlocks {
-		return fmt.Errorf("mismatch of block count: %d > %d", len(blocks), schema.totalBlocks)
+	if len(blocks) > schema.TotalBlocks {
+		return fmt.Errorf("mismatch of block count: %d > %d", len(blocks), schema.TotalBlocks)
 	}
 	res, err := JoinBitswapBlocks(blocks, root)
 	if err != nil {
@@ -214,6 +214,31 @@ func TestBitswapBlockSplitJoinPrefixQC(t *testing.T) {
 	require.NoError(t, quick.Check(f, nil))
 }
 
+func TestBitswapBlockSplitJoinWithBlockSize(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(0)).Read(data)
+	blocks, root := SplitDataToBitswapBlocksWithBlockSize(1<<12, data, EpochLedgerTag)
+	for _, b := range blocks {
+		require.LessOrEqual(t, len(b), 1<<12)
+	}
+	res, err := JoinBitswapBlocks(blocks, root)
+	require.NoError(t, err)
+	rest, length, maxBlockSize, err := ExtractRootBlockMeta(res)
+	require.NoError(t, err)
+	require.Equal(t, 1<<12, maxBlockSize)
+	require.Equal(t, len(data)+1, length)
+	require.Equal(t, byte(EpochLedgerTag), rest[0])
+	require.Equal(t, data, rest[1:])
+	// Roots of the default max block size are read as before
+	blocks, root = SplitDataToBitswapBlocksLengthPrefixedWithTag(1<<12, data, EpochLedgerTag)
+	res, err = JoinBitswapBlocks(blocks, root)
+	require.NoError(t, err)
+	_, length, maxBlockSize, err = ExtractRootBlockMeta(res)
+	require.NoError(t, err)
+	require.Equal(t, 0, maxBlockSize)
+	require.Equal(t, len(data)+1, length)
+}
+
 func TestDepthIndicesSequence(t *testing.T) {
 	lpb := LinksPerBlock(1 << 18)
 	di := MkDepthIndices(lpb, math.MaxInt32)
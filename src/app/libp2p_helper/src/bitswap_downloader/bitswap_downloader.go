@@ -0,0 +1,753 @@
+// Package bitswap_downloader is the state machine of downloads of block
+// trees over Bitswap. It's driven by BitswapState, which provides the
+// storage, the network sessions and the clock, so that the state machine
+// runs deterministically in tests.
+package bitswap_downloader
+
+import (
+	"codanet"
+	"context"
+	"errors"
+	"fmt"
+	ipc "libp2p_ipc"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var bitswapLogger = logging.Logger("mina.helper.bitswap")
+
+// Root is the link of the root block of a tree
+type Root BitswapBlockLink
+
+// IsValidMaxBlockSize checks that maxBlobSize is not too short
+// and has padding that allows to store at least 5 bytes of data in root
+// block even in case of root block being full occupied with links
+// P.S. all multiples of 32b are valid
+func IsValidMaxBlockSize(maxBlobSize int) bool {
+	return maxBlobSize >= 7+BITSWAP_BLOCK_LINK_SIZE && (maxBlobSize-2)%BITSWAP_BLOCK_LINK_SIZE >= 5
+}
+
+type BitswapDataTag byte
+
+const (
+	BlockBodyTag BitswapDataTag = iota
+	EpochLedgerTag
+	StakingLedgerTag
+)
+
+type BitswapDataConfig struct {
+	MaxSize int
+	// MaxBlocks caps the number of blocks in the tree, as declared by
+	// the root block, zero means no cap
+	MaxBlocks       int
+	DownloadTimeout time.Duration
+	// max block size of trees of resources of the tag added by
+	// the node, zero means the default max block size
+	BlockSize int
+	// MaxDepth caps the depth of the tree, as declared by
+	// the root block, zero means no cap
+	MaxDepth int
+	// budget added to the deadline per block and per MiB of
+	// the tree, once the root block is received
+	TimeoutPerBlock time.Duration
+	TimeoutPerMib   time.Duration
+	// deadline is kept at least that far after the latest
+	// fetched block, zero disables the extension
+	StallTimeout time.Duration
+	// deadline since the start at most, zero means no cap
+	MaxDownloadTimeout time.Duration
+}
+
+// scalesDeadline tells whether deadlines of downloads depend on the size
+// of the tree or progress, rather than being downloadTimeout after start
+func (c BitswapDataConfig) scalesDeadline() bool {
+	return c.TimeoutPerBlock > 0 || c.TimeoutPerMib > 0 || c.StallTimeout > 0
+}
+
+// sessionTimeout bounds the Bitswap session of a download, zero means
+// no bound (the session ends when the deadline tracked by the loop passes)
+func (c BitswapDataConfig) sessionTimeout() time.Duration {
+	if !c.scalesDeadline() {
+		return c.DownloadTimeout
+	}
+	return c.MaxDownloadTimeout
+}
+
+// NewBitswapDataConfig derives the cap on the number of blocks from the
+// maximum size, so that over-sized trees are rejected by their root block.
+// Caps on both the number of blocks and the depth are those of the largest
+// tree of the smallest blocks a root may declare, larger or deeper trees
+// can't be of a valid root.
+func NewBitswapDataConfig(maxBlockSize, maxSize int, downloadTimeout time.Duration) BitswapDataConfig {
+	minBlockSize := minEncodedBlockSize
+	if maxBlockSize < minBlockSize {
+		minBlockSize = maxBlockSize
+	}
+	deepest := MkBitswapBlockSchema(minBlockSize, maxSize+9)
+	return BitswapDataConfig{
+		MaxSize:         maxSize,
+		MaxBlocks:       deepest.TotalBlocks,
+		DownloadTimeout: downloadTimeout,
+		MaxDepth:        treeDepth(&deepest),
+	}
+}
+
+// errTreeTooLarge is reported for roots that declare more blocks than
+// allowed for their tag, their download is aborted right after
+// the root block is received
+var errTreeTooLarge = errors.New("tree is too large")
+
+// errTreeTooDeep is reported for roots that declare trees deeper than
+// allowed for their tag, such trees fit limits of size (e.g. of the
+// smallest blocks) yet make the downloader walk many levels
+var errTreeTooDeep = errors.New("tree is too deep")
+
+type BlockRequester interface {
+	RequestBlocks(keys []cid.Cid) error
+}
+
+// RootDownloadState doesn't keep CIDs of the tree: blocks awaited for the
+// root are found in node download params, so that memory used by a download
+// is bounded by its blocks in flight rather than by the size of the tree
+type RootDownloadState struct {
+	session              BlockRequester
+	CancelF              context.CancelFunc
+	Schema               *BitswapBlockSchema
+	Tag                  BitswapDataTag
+	Priority             ipc.DownloadPriority
+	RemainingNodeCounter int
+	// nodes of the tree discovered so far, including the root
+	DiscoveredNodes int
+	// nodes of the tree fetched so far (a block
+	// referenced by many nodes is counted for each)
+	FetchedNodes int
+	FetchedBytes int
+	// blocks received again by the session, e.g. from another
+	// peer, while the first copy was remembered
+	DuplicateBlocks int
+	DuplicateBytes  int
+	StartedAt       time.Time
+	lastProgress    time.Time
+	// download times out once the deadline passes
+	Deadline time.Time
+}
+
+// Minimal interval between progress updates of a root
+const downloadProgressInterval = time.Second
+
+type DownloadProgress struct {
+	DescendantsDiscovered int
+	BlocksFetched         int
+	BytesFetched          int
+	BlocksRemaining       int
+	BytesRemaining        int
+}
+
+// ExtendDeadline moves the deadline of the download, adding budget of the
+// tree once its schema is known and keeping the deadline at least
+// StallTimeout after now, within MaxDownloadTimeout since the start.
+// The deadline is never moved earlier, true is returned if it's moved.
+func (s *RootDownloadState) ExtendDeadline(conf BitswapDataConfig, now time.Time) bool {
+	deadline := s.StartedAt.Add(conf.DownloadTimeout)
+	if s.Schema != nil {
+		mibs := float64(s.TotalBytes()) / (1 << 20)
+		deadline = deadline.Add(time.Duration(s.Schema.TotalBlocks) * conf.TimeoutPerBlock)
+		deadline = deadline.Add(time.Duration(mibs * float64(conf.TimeoutPerMib)))
+	}
+	if conf.StallTimeout > 0 && now.Add(conf.StallTimeout).After(deadline) {
+		deadline = now.Add(conf.StallTimeout)
+	}
+	if conf.MaxDownloadTimeout > 0 && deadline.After(s.StartedAt.Add(conf.MaxDownloadTimeout)) {
+		deadline = s.StartedAt.Add(conf.MaxDownloadTimeout)
+	}
+	if deadline.After(s.Deadline) {
+		s.Deadline = deadline
+		return true
+	}
+	return false
+}
+
+func (s *RootDownloadState) Progress() DownloadProgress {
+	res := DownloadProgress{
+		DescendantsDiscovered: s.DiscoveredNodes,
+		BlocksFetched:         s.FetchedNodes,
+		BytesFetched:          s.FetchedBytes,
+	}
+	if s.Schema != nil {
+		res.BlocksRemaining = s.Schema.TotalBlocks - s.FetchedNodes
+		res.BytesRemaining = s.TotalBytes() - s.FetchedBytes
+	}
+	return res
+}
+
+// TotalBytes is the size of all blocks of the tree, schema must be known
+func (s *RootDownloadState) TotalBytes() int {
+	last := NodeIndex(s.Schema.TotalBlocks - 1)
+	return int(last)*s.Schema.maxBlockSize + s.Schema.BlockSize(last)
+}
+
+type RootParams interface {
+	getSchema() *BitswapBlockSchema
+	setSchema(*BitswapBlockSchema)
+	getTag() BitswapDataTag
+}
+
+func (s *RootDownloadState) getSchema() *BitswapBlockSchema {
+	return s.Schema
+}
+
+func (s *RootDownloadState) setSchema(schema *BitswapBlockSchema) {
+	if s.Schema != nil {
+		bitswapLogger.Warn("Double set schema for RootDownloadState")
+	}
+	s.Schema = schema
+}
+
+func (s *RootDownloadState) getTag() BitswapDataTag {
+	return s.Tag
+}
+
+// Bounds of EarlyBlocks: total size of blocks kept
+// and time for which a block is kept
+const (
+	maxEarlyBlocksSize = 16 << 20 // 16 MiB
+	earlyBlockTTL      = time.Minute
+)
+
+type earlyBlock struct {
+	block blocks.Block
+	at    time.Time
+}
+
+// EarlyBlocks keeps blocks that arrived before any download awaited them,
+// e.g. a child received ahead of its parent because of a prefetch hint
+// or another session requesting it, until they're discovered from their
+// parents. The oldest blocks are evicted once the total size exceeds the
+// bound, and blocks are dropped after the TTL.
+type EarlyBlocks struct {
+	blocks map[cid.Cid]earlyBlock
+	// ids of blocks in the order of arrival, may include ids
+	// of blocks already taken
+	order   []cid.Cid
+	size    int
+	maxSize int
+	ttl     time.Duration
+}
+
+func NewEarlyBlocks() *EarlyBlocks {
+	return &EarlyBlocks{
+		blocks:  make(map[cid.Cid]earlyBlock),
+		maxSize: maxEarlyBlocksSize,
+		ttl:     earlyBlockTTL,
+	}
+}
+
+// Put keeps the block, unless it's kept already
+func (eb *EarlyBlocks) Put(block blocks.Block, now time.Time) {
+	id := block.Cid()
+	if _, has := eb.blocks[id]; has {
+		return
+	}
+	eb.blocks[id] = earlyBlock{block: block, at: now}
+	eb.order = append(eb.order, id)
+	eb.size += len(block.RawData())
+	for len(eb.order) > 0 {
+		e, has := eb.blocks[eb.order[0]]
+		if has && eb.size <= eb.maxSize && now.Sub(e.at) <= eb.ttl {
+			break
+		}
+		if has {
+			eb.remove(eb.order[0])
+		}
+		eb.order = eb.order[1:]
+	}
+	// Ids of taken blocks are dropped once they outnumber kept ones
+	if len(eb.order) > 2*len(eb.blocks)+16 {
+		order := make([]cid.Cid, 0, len(eb.blocks))
+		for _, id := range eb.order {
+			if _, has := eb.blocks[id]; has {
+				order = append(order, id)
+			}
+		}
+		eb.order = order
+	}
+}
+
+// Take returns the block if it's kept and not expired, removing it
+func (eb *EarlyBlocks) Take(id cid.Cid, now time.Time) (blocks.Block, bool) {
+	e, has := eb.blocks[id]
+	if !has {
+		return nil, false
+	}
+	eb.remove(id)
+	if now.Sub(e.at) > eb.ttl {
+		return nil, false
+	}
+	return e.block, true
+}
+
+// Len returns the number of blocks kept
+func (eb *EarlyBlocks) Len() int {
+	return len(eb.blocks)
+}
+
+func (eb *EarlyBlocks) remove(id cid.Cid) {
+	eb.size -= len(eb.blocks[id].block.RawData())
+	delete(eb.blocks, id)
+}
+
+type BitswapState interface {
+	codanet.BitswapStorage
+	NodeDownloadParams() map[cid.Cid]map[Root][]NodeIndex
+	RootDownloadStates() map[Root]*RootDownloadState
+	MaxBlockSize() int
+	DataConfig() map[BitswapDataTag]BitswapDataConfig
+	DepthIndices() DepthIndices
+	NewSession(downloadTimeout time.Duration, root Root) (BlockRequester, context.CancelFunc)
+	// SetDeadline times the root download out after the timeout,
+	// replacing its previous deadline
+	SetDeadline(root Root, timeout time.Duration)
+	CancelDeadline(root Root)
+	SendResourceUpdate(type_ ipc.ResourceUpdateType, root Root)
+	SendDownloadProgress(root Root, progress DownloadProgress)
+	// VerifyRoot requests verification of a downloaded root, returns
+	// false if the root may be marked full right away
+	VerifyRoot(root Root, tag BitswapDataTag) bool
+	// ReportMalformedBlock attributes a malformed block of the root to its sender
+	ReportMalformedBlock(root Root, id cid.Cid)
+	// ObserveDownload records an attempt of downloading the root
+	// that ended with the outcome
+	ObserveDownload(state *RootDownloadState, outcome string)
+	// Now is the clock the state machine times downloads with
+	Now() time.Time
+	// EarlyBlocks keeps blocks received before they were awaited
+	EarlyBlocks() *EarlyBlocks
+	CheckInvariants()
+}
+
+// KickStartRootDownload initiates downloading of root block
+func KickStartRootDownload(root_ BitswapBlockLink, tag BitswapDataTag, bs BitswapState) {
+	bs.CheckInvariants()
+	rootCid := codanet.BlockHashToCid(root_)
+	nodeDownloadParams := bs.NodeDownloadParams()
+	rootDownloadStates := bs.RootDownloadStates()
+	_, has := nodeDownloadParams[rootCid]
+	if has {
+		bitswapLogger.Debugf("Skipping download request for %s (downloading already in progress)", codanet.BlockHashToCidSuffix(root_))
+		return // downloading already in progress
+	}
+	dataConf, hasDC := bs.DataConfig()[tag]
+	if !hasDC {
+		bitswapLogger.Errorf("Skipping download request for %s (tag %d is not supported by Bitswap downloader)",
+			codanet.BlockHashToCidSuffix(root_), tag)
+		return
+	}
+	if err := bs.SetStatus(root_, codanet.Partial); err != nil {
+		bitswapLogger.Debugf("Skipping download request for %s due to status: %w", codanet.BlockHashToCidSuffix(root_), err)
+		status, err := bs.GetStatus(root_)
+		if err == nil && status == codanet.Full {
+			bs.SendResourceUpdate(ipc.ResourceUpdateType_added, root_)
+		}
+		return
+	}
+	downloadTimeout := dataConf.DownloadTimeout
+	session, cancelF := bs.NewSession(dataConf.sessionTimeout(), root_)
+	np, hasNP := nodeDownloadParams[rootCid]
+	if !hasNP {
+		np = map[Root][]NodeIndex{}
+		nodeDownloadParams[rootCid] = np
+	}
+	np[root_] = append(np[root_], 0)
+	startedAt := bs.Now()
+	rootDownloadStates[root_] = &RootDownloadState{
+		session:              session,
+		CancelF:              cancelF,
+		Tag:                  tag,
+		RemainingNodeCounter: 1,
+		DiscoveredNodes:      1,
+		StartedAt:            startedAt,
+		Deadline:             startedAt.Add(downloadTimeout),
+	}
+	ActiveDownloadsMetric.Set(float64(len(rootDownloadStates)))
+	handleError := func(err error) {
+		bitswapLogger.Errorf("Error initializing block download: %w", err)
+		ClearRootDownloadState(bs, root_)
+	}
+	var rootBlock []byte
+	rootBlockViewF := func(b []byte) error {
+		rootBlock = make([]byte, len(b))
+		copy(rootBlock, b)
+		return nil
+	}
+	if err := bs.ViewBlock(root_, rootBlockViewF); err != nil && err != blockstore.ErrNotFound {
+		handleError(err)
+		return
+	}
+	hasRootBlock := rootBlock != nil
+	if !hasRootBlock {
+		if err := session.RequestBlocks([]cid.Cid{rootCid}); err != nil {
+			handleError(err)
+			return
+		}
+		bitswapLogger.Debugf("Requested download of %s", codanet.BlockHashToCidSuffix(root_))
+	}
+	bs.SetDeadline(root_, downloadTimeout)
+	if hasRootBlock {
+		b, _ := blocks.NewBlockWithCid(rootBlock, rootCid)
+		ProcessDownloadedBlock(b, bs)
+	}
+}
+
+// ClearRootDownloadState forgets the download of the root and blocks
+// awaited for it, cancelling its session
+func ClearRootDownloadState(bs BitswapState, root Root) {
+	rootStates := bs.RootDownloadStates()
+	nodeParams := bs.NodeDownloadParams()
+	state, has := rootStates[root]
+	if !has {
+		return
+	}
+	delete(rootStates, root)
+	bs.CancelDeadline(root)
+	ActiveDownloadsMetric.Set(float64(len(rootStates)))
+	// Blocks awaited for the root are looked up among all awaited blocks,
+	// none are awaited for a completed root
+	if state.RemainingNodeCounter > 0 {
+		for c, np := range nodeParams {
+			if _, hasNp := np[root]; hasNp {
+				delete(np, root)
+				if len(np) == 0 {
+					delete(nodeParams, c)
+				}
+			}
+		}
+	}
+	state.CancelF()
+}
+
+type malformedRoots map[Root]error
+
+// IsValidEncodedBlockSize checks a max block size encoded in a root block
+func IsValidEncodedBlockSize(maxBlockSize int) bool {
+	return IsValidMaxBlockSize(maxBlockSize) && maxBlockSize >= minEncodedBlockSize && maxBlockSize <= maxEncodedBlockSize
+}
+
+// ReadRootBlock reads tag and length from data of the root block and
+// computes schema of the tree, checking them against config of the tag.
+// Trees of roots not encoding their max block size are of maxBlockSize.
+func ReadRootBlock(data []byte, maxBlockSize int, tagConfig map[BitswapDataTag]BitswapDataConfig) (BitswapDataTag, BitswapBlockSchema, error) {
+	blockData, dataLen, encodedBlockSize, err := ExtractRootBlockMeta(data)
+	if err != nil {
+		return 0, BitswapBlockSchema{}, err
+	}
+	// Length prefix (and block size) is a part of the data
+	prefixLen := 4
+	if encodedBlockSize != 0 {
+		if !IsValidEncodedBlockSize(encodedBlockSize) {
+			return 0, BitswapBlockSchema{}, fmt.Errorf("invalid max block size: %d", encodedBlockSize)
+		}
+		prefixLen = 8
+	}
+	if len(blockData) < 1 {
+		return 0, BitswapBlockSchema{}, errors.New("error reading tag from block")
+	}
+	tag := BitswapDataTag(blockData[0])
+	dataConf, hasDataConf := tagConfig[tag]
+	if !hasDataConf {
+		return tag, BitswapBlockSchema{}, fmt.Errorf("no tag config for tag %d", tag)
+	}
+	if dataConf.MaxSize < dataLen-1 {
+		return tag, BitswapBlockSchema{}, fmt.Errorf("data is too large: %d > %d", dataLen-1, dataConf.MaxSize)
+	}
+	var schema BitswapBlockSchema
+	if encodedBlockSize == 0 {
+		schema = MkBitswapBlockSchema(maxBlockSize, dataLen+prefixLen)
+	} else {
+		schema = MkBitswapBlockSchema(encodedBlockSize, dataLen+prefixLen)
+	}
+	if dataConf.MaxBlocks > 0 && schema.TotalBlocks > dataConf.MaxBlocks {
+		return tag, schema, fmt.Errorf("%w: root block declares %d blocks > %d",
+			errTreeTooLarge, schema.TotalBlocks, dataConf.MaxBlocks)
+	}
+	if depth := treeDepth(&schema); dataConf.MaxDepth > 0 && depth > dataConf.MaxDepth {
+		return tag, schema, fmt.Errorf("%w: root block declares depth %d > %d",
+			errTreeTooDeep, depth, dataConf.MaxDepth)
+	}
+	return tag, schema, nil
+}
+
+// processDownloadedBlockStep is a small-step transition of root block retrieval state machine
+// It calculates state transition for a single block
+func processDownloadedBlockStep(params map[Root][]NodeIndex, block blocks.Block, rootParams map[Root]RootParams,
+	maxBlockSize int, di DepthIndices, tagConfig map[BitswapDataTag]BitswapDataConfig) (map[BitswapBlockLink]map[Root][]NodeIndex, malformedRoots) {
+	id := block.Cid()
+	malformed := make(malformedRoots)
+	links, fullBlockData, err := ReadBitswapBlock(block.RawData())
+	if err != nil {
+		for root := range params {
+			malformed[root] = fmt.Errorf("Error reading block %s: %v", id, err)
+		}
+		return nil, malformed
+	}
+	children := make(map[BitswapBlockLink]map[Root][]NodeIndex)
+	for root_, ixs := range params {
+		rp, hasRp := rootParams[root_]
+		if !hasRp {
+			bitswapLogger.Errorf("processBlock: didn't find root state for %s (root %s)",
+				id, codanet.BlockHashToCidSuffix(root_))
+			continue
+		}
+		schema := rp.getSchema()
+		hasRootIx := false
+		for _, ix := range ixs {
+			if ix == 0 {
+				hasRootIx = true
+				break
+			}
+		}
+		if hasRootIx {
+			tag, schema_, err := ReadRootBlock(fullBlockData, maxBlockSize, tagConfig)
+			if err == nil && tag != rp.getTag() {
+				err = fmt.Errorf("tag mismatch: %d != %d", tag, rp.getTag())
+			}
+			if err != nil {
+				malformed[root_] = fmt.Errorf("error reading root block %s: %w", id, err)
+				continue
+			}
+			schema = &schema_
+			rp.setSchema(schema)
+		}
+		if schema == nil {
+			bitswapLogger.Errorf("Invariant broken for %s (root %s): schema not set for non-root block",
+				id, codanet.BlockHashToCidSuffix(root_))
+			continue
+		}
+		rootDi := DepthIndicesOf(di, schema)
+		for _, ix := range ixs {
+			if len(block.RawData()) != schema.BlockSize(ix) {
+				malformed[root_] = fmt.Errorf("unexpected size for block #%d (%s) of root %s: %d != %d",
+					ix, id, codanet.BlockHashToCidSuffix(root_), len(block.RawData()), schema.BlockSize(ix))
+				break
+			}
+			if len(links) != schema.LinkCount(ix) {
+				malformed[root_] = fmt.Errorf("unexpected link count for block %s of root %s: %d != %d (fullLinkBlocks: %d, ix: %d)",
+					id, codanet.BlockHashToCidSuffix(root_), len(links), schema.LinkCount(ix), schema.fullLinkBlocks, ix)
+				break
+			}
+			fstChildId := rootDi.FirstChildId(ix)
+			if fstChildId < 0 && len(links) > 0 {
+				malformed[root_] = fmt.Errorf("%w: block #%d (%s) of root %s is beyond depth %d",
+					errTreeTooDeep, ix, id, codanet.BlockHashToCidSuffix(root_), rootDi.Depth())
+				break
+			}
+			for childIx, link := range links {
+				if children[link] == nil {
+					children[link] = make(map[Root][]NodeIndex)
+				}
+				children[link][root_] = append(children[link][root_], fstChildId+NodeIndex(childIx))
+			}
+		}
+	}
+	return children, malformed
+}
+
+// takeDeferredBlock returns the block if it arrived before it was
+// discovered from its parent, removing it from early blocks
+func takeDeferredBlock(bs BitswapState, id cid.Cid) (blocks.Block, bool) {
+	return bs.EarlyBlocks().Take(id, bs.Now())
+}
+
+// maxBlockLoaders bounds the number of goroutines
+// reading child blocks from the storage at once
+var maxBlockLoaders = 8
+
+// loadStoredBlocks reads blocks from the storage in batches, one batch
+// per worker of a bounded pool; ids of blocks that couldn't be read
+// are returned as missing
+func loadStoredBlocks(bs BitswapState, links []BitswapBlockLink) ([]blocks.Block, []cid.Cid) {
+	workers := maxBlockLoaders
+	if len(links) < workers {
+		workers = len(links)
+	}
+	batches := make([]map[[32]byte][]byte, workers)
+	load := func(w int) {
+		batch := links[w*len(links)/workers : (w+1)*len(links)/workers]
+		res, err := bs.GetBlocks(batch)
+		if err != nil {
+			// we still schedule blocks for downloading
+			// this case should rarely happen in practice
+			bitswapLogger.Warnf("Failed to retrieve %d blocks from storage: %s", len(batch), err)
+			return
+		}
+		batches[w] = res
+	}
+	if workers <= 1 {
+		for w := 0; w < workers; w++ {
+			load(w)
+		}
+	} else {
+		var wg sync.WaitGroup
+		wg.Add(workers)
+		for w := 0; w < workers; w++ {
+			go func(w int) {
+				defer wg.Done()
+				load(w)
+			}(w)
+		}
+		wg.Wait()
+	}
+	found := make([]blocks.Block, 0, len(links))
+	missing := make([]cid.Cid, 0)
+	for w, res := range batches {
+		for _, link := range links[w*len(links)/workers : (w+1)*len(links)/workers] {
+			childId := codanet.BlockHashToCid(link)
+			if data, has := res[link]; has {
+				b, _ := blocks.NewBlockWithCid(data, childId)
+				found = append(found, b)
+			} else {
+				missing = append(missing, childId)
+			}
+		}
+	}
+	return found, missing
+}
+
+// ProcessDownloadedBlock is a big-step transition of root block retrieval state machine
+// It transits state for the block and for its descendants already present in
+// the storage. Descendants are processed iteratively from a work stack (rather
+// than by recursion), so that the depth of a tree doesn't grow the call stack.
+func ProcessDownloadedBlock(block blocks.Block, bs BitswapState) {
+	ProcessDownloadedBlocks([]blocks.Block{block}, bs)
+}
+
+// ProcessDownloadedBlocks processes a batch of blocks received at once
+func ProcessDownloadedBlocks(batch []blocks.Block, bs BitswapState) {
+	stack := append([]blocks.Block{}, batch...)
+	for len(stack) > 0 {
+		last := len(stack) - 1
+		b := stack[last]
+		stack = append(stack[:last], processBlock(b, bs)...)
+	}
+}
+
+// processBlock transits state for a single block, blocks of its
+// children that are available without downloading are returned
+func processBlock(block blocks.Block, bs BitswapState) []blocks.Block {
+	bs.CheckInvariants()
+	id := block.Cid()
+	nodeDownloadParams := bs.NodeDownloadParams()
+	rootDownloadStates := bs.RootDownloadStates()
+	depthIndices := bs.DepthIndices()
+	oldPs, foundRoot := nodeDownloadParams[id]
+	delete(nodeDownloadParams, id)
+	if !foundRoot {
+		// Block arrived ahead of its parent, it's processed
+		// once discovered (if it's not evicted before)
+		bitswapLogger.Debugf("Keeping block %s not awaited yet", id)
+		bs.EarlyBlocks().Put(block, bs.Now())
+		return nil
+	}
+	rps := make(map[Root]RootParams)
+	// Can not just pass the `rootDownloadStates` map to processBlock function :(
+	for root, ixs := range oldPs {
+		rootState, hasRS := rootDownloadStates[root]
+		if !hasRS {
+			bitswapLogger.Errorf("processDownloadedBlock: didn't find root state for %s (root %s)",
+				id, codanet.BlockHashToCidSuffix(root))
+			continue
+		}
+		rootState.RemainingNodeCounter = rootState.RemainingNodeCounter - len(ixs)
+		rootState.FetchedNodes += len(ixs)
+		rootState.FetchedBytes += len(ixs) * len(block.RawData())
+		rps[root] = rootState
+	}
+	newParams, malformed := processDownloadedBlockStep(oldPs, block, rps, bs.MaxBlockSize(), depthIndices, bs.DataConfig())
+	for root, err := range malformed {
+		if errors.Is(err, errTreeTooLarge) {
+			bitswapLogger.Warnf("Aborting download of root %s: %s", codanet.BlockHashToCidSuffix(root), err)
+			MalformedBlocksMetric.WithLabelValues("tree_too_large").Inc()
+		} else if errors.Is(err, errTreeTooDeep) {
+			bitswapLogger.Warnf("Aborting download of root %s: %s", codanet.BlockHashToCidSuffix(root), err)
+			MalformedBlocksMetric.WithLabelValues("tree_too_deep").Inc()
+		} else {
+			bitswapLogger.Warnf("Block %s of root %s is malformed: %s", id, codanet.BlockHashToCidSuffix(root), err)
+			MalformedBlocksMetric.WithLabelValues("malformed").Inc()
+			bs.ReportMalformedBlock(root, id)
+		}
+		if rootState, hasRS := rootDownloadStates[root]; hasRS {
+			bs.ObserveDownload(rootState, DownloadBroken)
+		}
+		ClearRootDownloadState(bs, root)
+		bs.SendResourceUpdate(ipc.ResourceUpdateType_broken, root)
+	}
+
+	blocksToProcess := make([]blocks.Block, 0)
+	toLoad := make([]BitswapBlockLink, 0)
+	var someRootState *RootDownloadState
+	for link, ps := range newParams {
+		childId := codanet.BlockHashToCid(link)
+		np, has := nodeDownloadParams[childId]
+		if !has {
+			np = make(map[Root][]NodeIndex)
+			nodeDownloadParams[childId] = np
+		}
+		for root, ixs := range ps {
+			np[root] = append(np[root], ixs...)
+			rootState, hasRS := rootDownloadStates[root]
+			if !hasRS {
+				bitswapLogger.Errorf("processDownloadedBlock (2): didn't find root state for %s (root %s)",
+					id, codanet.BlockHashToCidSuffix(root))
+				continue
+			}
+			someRootState = rootState
+			rootState.RemainingNodeCounter = rootState.RemainingNodeCounter + len(ixs)
+			rootState.DiscoveredNodes += len(ixs)
+		}
+		if b, deferred := takeDeferredBlock(bs, childId); deferred {
+			blocksToProcess = append(blocksToProcess, b)
+			continue
+		}
+		toLoad = append(toLoad, link)
+	}
+	stored, toDownload := loadStoredBlocks(bs, toLoad)
+	blocksToProcess = append(blocksToProcess, stored...)
+	if len(toDownload) > 0 {
+		// It's fine to use someRootState because all blocks from toDownload
+		// inevitably belong to each root, so any will do
+		someRootState.session.RequestBlocks(toDownload)
+	}
+	now := bs.Now()
+	for root := range oldPs {
+		rootState, hasRS := rootDownloadStates[root]
+		if hasRS && rootState.ExtendDeadline(bs.DataConfig()[rootState.Tag], now) {
+			bs.SetDeadline(root, rootState.Deadline.Sub(now))
+		}
+	}
+	for root := range oldPs {
+		rootState, hasRS := rootDownloadStates[root]
+		if hasRS && rootState.RemainingNodeCounter == 0 {
+			bs.ObserveDownload(rootState, DownloadCompleted)
+			if bs.VerifyRoot(root, rootState.Tag) {
+				// root is marked full once the daemon accepts it
+				ClearRootDownloadState(bs, root)
+				continue
+			}
+			// clean-up
+			err := bs.SetStatus(root, codanet.Full)
+			if err != nil {
+				bitswapLogger.Warnf("Failed to update status of fully downloaded root %s: %s", root, err)
+			}
+			ClearRootDownloadState(bs, root)
+			bs.SendResourceUpdate(ipc.ResourceUpdateType_added, root)
+		} else if hasRS && now.Sub(rootState.lastProgress) >= downloadProgressInterval {
+			rootState.lastProgress = now
+			bs.SendDownloadProgress(root, rootState.Progress())
+		}
+	}
+	return blocksToProcess
+}
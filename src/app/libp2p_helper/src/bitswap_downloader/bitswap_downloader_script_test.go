@@ -0,0 +1,586 @@
+package bitswap_downloader
+
+import (
+	"codanet"
+	"fmt"
+	ipc "libp2p_ipc"
+	"math/rand"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+)
+
+// Scripted scenarios of the downloader state machine: a script is a sequence
+// of steps, each either performing an action on a BitswapState (starting
+// a download, delivering a block, timing a root out) or asserting on
+// the resulting state and side effects (requested blocks, resource updates,
+// statuses, download state).
+
+type scriptResource struct {
+	root Root
+	tag  BitswapDataTag
+	// blocks of the tree
+	blocks map[cid.Cid][]byte
+	// distinct blocks of the tree in BFS order
+	order []cid.Cid
+}
+
+type scriptState struct {
+	t         *testing.T
+	bs        *testBitswapState
+	resources map[string]*scriptResource
+}
+
+type scriptStep struct {
+	desc string
+	run  func(s *scriptState)
+}
+
+func newScriptBitswapState(maxBlockSize int) *testBitswapState {
+	return &testBitswapState{
+		r:                  rand.New(rand.NewSource(0)),
+		statuses:           map[BitswapBlockLink]codanet.RootBlockStatus{},
+		blocks:             map[cid.Cid][]byte{},
+		nodeDownloadParams: map[cid.Cid]map[Root][]NodeIndex{},
+		rootDownloadStates: map[Root]*RootDownloadState{},
+		awaitingBlocks:     map[cid.Cid]interface{}{},
+		awaitingBlocksQ:    map[uint64]cid.Cid{},
+		maxBlockSize:       maxBlockSize,
+		resourceUpdates:    map[Root]ipc.ResourceUpdateType{},
+		checkInvariantsNow: func() bool { return true },
+		now:                testClockStart,
+	}
+}
+
+func runScript(t *testing.T, maxBlockSize int, steps ...scriptStep) {
+	s := &scriptState{
+		t:         t,
+		bs:        newScriptBitswapState(maxBlockSize),
+		resources: map[string]*scriptResource{},
+	}
+	current := -1
+	defer func() {
+		if t.Failed() && current >= 0 {
+			t.Logf("script failed at step #%d: %s", current, steps[current].desc)
+		}
+	}()
+	for i, step := range steps {
+		current = i
+		step.run(s)
+		if t.Failed() {
+			t.FailNow()
+		}
+		// Every node download param refers to a root being downloaded
+		for id, params := range s.bs.nodeDownloadParams {
+			for r := range params {
+				if _, has := s.bs.rootDownloadStates[r]; !has {
+					t.Fatalf("orphaned node params of %s for root %s",
+						id, codanet.BlockHashToCidSuffix(r))
+				}
+			}
+		}
+	}
+}
+
+func (s *scriptState) resource(name string) *scriptResource {
+	res, has := s.resources[name]
+	if !has {
+		s.t.Fatalf("resource %s is not defined", name)
+	}
+	return res
+}
+
+func (s *scriptState) blockOf(name string, ix int) (cid.Cid, []byte) {
+	res := s.resource(name)
+	require.Less(s.t, ix, len(res.order), "resource %s has no block #%d", name, ix)
+	id := res.order[ix]
+	return id, res.blocks[id]
+}
+
+// defineResource splits data into a tree of blocks known to the script
+func defineResource(name string, tag BitswapDataTag, data []byte) scriptStep {
+	return defineResourceWithBlockSize(name, tag, data, 0)
+}
+
+// defineResourceWithBlockSize splits data into a tree of blocks of the max
+// block size encoded in the root block, or of the default one if zero
+func defineResourceWithBlockSize(name string, tag BitswapDataTag, data []byte, blockSize int) scriptStep {
+	return scriptStep{fmt.Sprintf("define %s", name), func(s *scriptState) {
+		blockMap, root_ := SplitDataToBitswapBlocksLengthPrefixedWithTag(s.bs.maxBlockSize, data, tag)
+		if blockSize != 0 {
+			blockMap, root_ = SplitDataToBitswapBlocksWithBlockSize(blockSize, data, tag)
+		}
+		res := &scriptResource{root: root_, tag: tag, blocks: map[cid.Cid][]byte{}}
+		for h, b := range blockMap {
+			res.blocks[codanet.BlockHashToCid(h)] = b
+		}
+		visited := map[cid.Cid]bool{}
+		for q := []BitswapBlockLink{root_}; len(q) > 0; q = q[1:] {
+			id := codanet.BlockHashToCid(q[0])
+			if visited[id] {
+				continue
+			}
+			visited[id] = true
+			res.order = append(res.order, id)
+			links, _, err := ReadBitswapBlock(res.blocks[id])
+			require.NoError(s.t, err)
+			q = append(q, links...)
+		}
+		s.resources[name] = res
+	}}
+}
+
+func download(name string) scriptStep {
+	return scriptStep{fmt.Sprintf("download %s", name), func(s *scriptState) {
+		res := s.resource(name)
+		KickStartRootDownload(res.root, res.tag, s.bs)
+	}}
+}
+
+func (s *scriptState) deliverBlock(id cid.Cid, data []byte) {
+	delete(s.bs.awaitingBlocks, id)
+	for k, id2 := range s.bs.awaitingBlocksQ {
+		if id2 == id {
+			delete(s.bs.awaitingBlocksQ, k)
+		}
+	}
+	// Block is put to the storage by Bitswap before it's processed
+	s.bs.blocks[id] = data
+	b, err := blocks.NewBlockWithCid(data, id)
+	require.NoError(s.t, err)
+	ProcessDownloadedBlock(b, s.bs)
+}
+
+// deliver emulates arrival of the block #ix (in BFS order) of the resource
+func deliver(name string, ix int) scriptStep {
+	return scriptStep{fmt.Sprintf("deliver %s #%d", name, ix), func(s *scriptState) {
+		id, data := s.blockOf(name, ix)
+		s.deliverBlock(id, data)
+	}}
+}
+
+// advance moves the simulated clock forward
+func advance(d time.Duration) scriptStep {
+	return scriptStep{fmt.Sprintf("advance the clock by %s", d), func(s *scriptState) {
+		s.bs.now = s.bs.now.Add(d)
+	}}
+}
+
+// deliverRequested delivers requested blocks of the resource
+// until none of them are requested
+func deliverRequested(name string) scriptStep {
+	return scriptStep{fmt.Sprintf("deliver requested blocks of %s", name), func(s *scriptState) {
+		res := s.resource(name)
+		for delivered := true; delivered; {
+			delivered = false
+			for _, id := range res.order {
+				if _, requested := s.bs.awaitingBlocks[id]; requested {
+					s.deliverBlock(id, res.blocks[id])
+					delivered = true
+				}
+			}
+		}
+	}}
+}
+
+// deliverCorrupted emulates arrival of the block #ix of the resource
+// with its data replaced
+func deliverCorrupted(name string, ix int, data []byte) scriptStep {
+	return scriptStep{fmt.Sprintf("deliver corrupted %s #%d", name, ix), func(s *scriptState) {
+		id, _ := s.blockOf(name, ix)
+		s.deliverBlock(id, data)
+	}}
+}
+
+// prepopulate puts the block #ix of the resource to the storage
+func prepopulate(name string, ix int) scriptStep {
+	return scriptStep{fmt.Sprintf("prepopulate %s #%d", name, ix), func(s *scriptState) {
+		id, data := s.blockOf(name, ix)
+		s.bs.blocks[id] = data
+	}}
+}
+
+// timeout emulates expiry of the download deadline of the resource
+func timeout(name string) scriptStep {
+	return scriptStep{fmt.Sprintf("timeout %s", name), func(s *scriptState) {
+		ClearRootDownloadState(s.bs, s.resource(name).root)
+	}}
+}
+
+func expectRequested(name string, ixs ...int) scriptStep {
+	return scriptStep{fmt.Sprintf("expect requested %s %v", name, ixs), func(s *scriptState) {
+		res := s.resource(name)
+		expected := map[int]bool{}
+		for _, ix := range ixs {
+			expected[ix] = true
+		}
+		for ix, id := range res.order {
+			_, requested := s.bs.awaitingBlocks[id]
+			if requested != expected[ix] {
+				s.t.Errorf("block #%d of %s: requested=%v, expected %v", ix, name, requested, expected[ix])
+			}
+		}
+	}}
+}
+
+// expectEarlyBlocks checks the number of blocks kept
+// until they're discovered from their parents
+func expectEarlyBlocks(n int) scriptStep {
+	return scriptStep{fmt.Sprintf("expect %d early blocks", n), func(s *scriptState) {
+		require.Equal(s.t, n, s.bs.EarlyBlocks().Len())
+	}}
+}
+
+func expectUpdate(name string, type_ ipc.ResourceUpdateType) scriptStep {
+	return scriptStep{fmt.Sprintf("expect %s update of %s", type_, name), func(s *scriptState) {
+		actual, has := s.bs.resourceUpdates[s.resource(name).root]
+		require.True(s.t, has, "no resource update for %s", name)
+		require.Equal(s.t, type_, actual)
+	}}
+}
+
+func expectNoUpdate(name string) scriptStep {
+	return scriptStep{fmt.Sprintf("expect no update of %s", name), func(s *scriptState) {
+		_, has := s.bs.resourceUpdates[s.resource(name).root]
+		require.False(s.t, has, "unexpected resource update for %s", name)
+	}}
+}
+
+func expectStatus(name string, status codanet.RootBlockStatus) scriptStep {
+	return scriptStep{fmt.Sprintf("expect status %d of %s", status, name), func(s *scriptState) {
+		require.Equal(s.t, status, s.bs.statuses[s.resource(name).root])
+	}}
+}
+
+func expectDownloading(name string, downloading bool) scriptStep {
+	return scriptStep{fmt.Sprintf("expect downloading %s: %v", name, downloading), func(s *scriptState) {
+		_, has := s.bs.rootDownloadStates[s.resource(name).root]
+		require.Equal(s.t, downloading, has)
+	}}
+}
+
+// expectProgress asserts the last progress update of the resource, with
+// first `fetched` blocks of the tree downloaded
+func expectProgress(name string, discovered, fetched int) scriptStep {
+	return scriptStep{fmt.Sprintf("expect progress %d/%d of %s", discovered, fetched, name), func(s *scriptState) {
+		res := s.resource(name)
+		expected := DownloadProgress{
+			DescendantsDiscovered: discovered,
+			BlocksFetched:         fetched,
+			BlocksRemaining:       len(res.order) - fetched,
+		}
+		for i, id := range res.order {
+			if i < fetched {
+				expected.BytesFetched += len(res.blocks[id])
+			} else {
+				expected.BytesRemaining += len(res.blocks[id])
+			}
+		}
+		updates := s.bs.progress[res.root]
+		require.NotEmpty(s.t, updates, "no progress update for %s", name)
+		require.Equal(s.t, expected, updates[len(updates)-1])
+	}}
+}
+
+// expectIdle asserts that no download is in progress
+func expectIdle() scriptStep {
+	return scriptStep{"expect idle", func(s *scriptState) {
+		require.Empty(s.t, s.bs.rootDownloadStates)
+		require.Empty(s.t, s.bs.nodeDownloadParams)
+	}}
+}
+
+func scriptData(n int, seed byte) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i) ^ seed
+	}
+	return data
+}
+
+func TestScriptDownloadInOrder(t *testing.T) {
+	// With max block size of 100 a block has at most 3 links,
+	// 2000 bytes make a tree of 30 blocks
+	runScript(t, 100,
+		defineResource("a", 0, scriptData(2000, 1)),
+		download("a"),
+		expectRequested("a", 0),
+		expectStatus("a", codanet.Partial),
+		deliver("a", 0),
+		expectRequested("a", 1, 2, 3),
+		deliver("a", 2),
+		expectRequested("a", 1, 3, 7, 8, 9),
+		expectNoUpdate("a"),
+		deliverRequested("a"),
+		expectUpdate("a", ipc.ResourceUpdateType_added),
+		expectStatus("a", codanet.Full),
+		expectIdle(),
+	)
+}
+
+func TestScriptProgress(t *testing.T) {
+	// Progress is reported for the root block, the next block arrives
+	// within the interval between progress updates, the one after
+	// the interval passes
+	runScript(t, 100,
+		defineResource("a", 0, scriptData(2000, 1)),
+		download("a"),
+		deliver("a", 0),
+		expectProgress("a", 4, 1),
+		deliver("a", 1),
+		expectProgress("a", 4, 1),
+		advance(downloadProgressInterval),
+		deliver("a", 2),
+		expectProgress("a", 10, 3),
+		deliverRequested("a"),
+		expectUpdate("a", ipc.ResourceUpdateType_added),
+		expectIdle(),
+	)
+}
+
+func TestScriptDuplicateIndices(t *testing.T) {
+	// Chunks of zero data are identical, hence the same block
+	// is referenced by many indices of the tree
+	runScript(t, 100,
+		defineResource("zeros", 0, make([]byte, 2000)),
+		download("zeros"),
+		deliver("zeros", 0),
+		deliver("zeros", 1),
+		scriptStep{"expect duplicate indices", func(s *scriptState) {
+			root_ := s.resource("zeros").root
+			for _, params := range s.bs.nodeDownloadParams {
+				if len(params[root_]) > 1 {
+					return
+				}
+			}
+			s.t.Error("no block is awaited at multiple indices")
+		}},
+		deliverRequested("zeros"),
+		expectUpdate("zeros", ipc.ResourceUpdateType_added),
+		expectIdle(),
+	)
+}
+
+func TestScriptDuplicateDelivery(t *testing.T) {
+	// Blocks delivered again (e.g. by another session) are ignored
+	runScript(t, 100,
+		defineResource("a", 0, scriptData(2000, 1)),
+		download("a"),
+		deliver("a", 0),
+		deliver("a", 0),
+		expectRequested("a", 1, 2, 3),
+		expectProgress("a", 4, 1),
+		deliverRequested("a"),
+		expectUpdate("a", ipc.ResourceUpdateType_added),
+		expectIdle(),
+		deliver("a", 1),
+		expectIdle(),
+	)
+}
+
+func TestScriptDuplicateIndicesTimeout(t *testing.T) {
+	// Blocks awaited at multiple indices are
+	// forgotten when the root times out
+	runScript(t, 100,
+		defineResource("zeros", 0, make([]byte, 2000)),
+		defineResource("a", 0, scriptData(2000, 1)),
+		download("zeros"),
+		download("a"),
+		deliver("zeros", 0),
+		deliver("zeros", 1),
+		timeout("zeros"),
+		expectDownloading("zeros", false),
+		expectNoUpdate("zeros"),
+		deliverRequested("a"),
+		expectUpdate("a", ipc.ResourceUpdateType_added),
+		expectIdle(),
+	)
+}
+
+func TestScriptSharedBlocks(t *testing.T) {
+	// Trees of different roots share blocks of zero data
+	runScript(t, 100,
+		defineResource("a", 0, make([]byte, 2000)),
+		defineResource("b", 0, make([]byte, 2100)),
+		download("a"),
+		download("b"),
+		deliverRequested("a"),
+		expectUpdate("a", ipc.ResourceUpdateType_added),
+		expectNoUpdate("b"),
+		expectDownloading("b", true),
+		deliverRequested("b"),
+		expectUpdate("b", ipc.ResourceUpdateType_added),
+		expectIdle(),
+	)
+}
+
+func TestScriptTimeout(t *testing.T) {
+	runScript(t, 100,
+		defineResource("a", 0, scriptData(2000, 1)),
+		defineResource("b", 0, scriptData(2000, 2)),
+		download("a"),
+		download("b"),
+		deliver("a", 0),
+		timeout("a"),
+		expectDownloading("a", false),
+		expectNoUpdate("a"),
+		// Late blocks of a timed out root are ignored
+		deliver("a", 1),
+		expectNoUpdate("a"),
+		expectDownloading("b", true),
+		deliverRequested("b"),
+		expectUpdate("b", ipc.ResourceUpdateType_added),
+		// Download restarts from blocks already stored
+		download("a"),
+		expectRequested("a", 2, 3, 4, 5, 6),
+		deliverRequested("a"),
+		expectUpdate("a", ipc.ResourceUpdateType_added),
+		expectIdle(),
+	)
+}
+
+func TestScriptMalformedBlock(t *testing.T) {
+	runScript(t, 100,
+		defineResource("a", 0, scriptData(2000, 1)),
+		defineResource("b", 0, scriptData(2000, 2)),
+		download("a"),
+		download("b"),
+		deliver("a", 0),
+		// Block of unexpected size
+		deliverCorrupted("a", 1, []byte{0, 0, 1}),
+		expectUpdate("a", ipc.ResourceUpdateType_broken),
+		expectDownloading("a", false),
+		deliverRequested("b"),
+		expectUpdate("b", ipc.ResourceUpdateType_added),
+		expectIdle(),
+	)
+}
+
+func TestScriptBlockAheadOfRoot(t *testing.T) {
+	runScript(t, 100,
+		defineResource("a", 0, scriptData(2000, 1)),
+		download("a"),
+		// Block arrives before the root block, it's kept
+		// rather than treated as malformed
+		deliver("a", 1),
+		expectNoUpdate("a"),
+		expectDownloading("a", true),
+		expectEarlyBlocks(1),
+		deliver("a", 0),
+		// The kept block is processed once discovered, its children
+		// are requested along with the root's
+		expectEarlyBlocks(0),
+		expectRequested("a", 2, 3, 4, 5, 6),
+		deliverRequested("a"),
+		expectUpdate("a", ipc.ResourceUpdateType_added),
+		expectIdle(),
+	)
+}
+
+func TestScriptEncodedBlockSize(t *testing.T) {
+	// Trees of different max block sizes are downloaded concurrently
+	runScript(t, 100,
+		defineResource("a", 0, scriptData(2000, 1)),
+		defineResourceWithBlockSize("b", 0, scriptData(20000, 2), 1<<12),
+		download("a"),
+		download("b"),
+		deliver("a", 0),
+		deliver("b", 0),
+		expectRequested("a", 1, 2, 3),
+		// 20000 bytes make a tree of 5 blocks of 4 KiB
+		expectRequested("b", 1, 2, 3, 4),
+		deliverRequested("b"),
+		expectUpdate("b", ipc.ResourceUpdateType_added),
+		expectNoUpdate("a"),
+		deliverRequested("a"),
+		expectUpdate("a", ipc.ResourceUpdateType_added),
+		expectIdle(),
+	)
+}
+
+func TestScriptInvalidEncodedBlockSize(t *testing.T) {
+	runScript(t, 100,
+		defineResourceWithBlockSize("a", 0, scriptData(2000, 1), 100),
+		download("a"),
+		deliver("a", 0),
+		expectUpdate("a", ipc.ResourceUpdateType_broken),
+		expectIdle(),
+	)
+}
+
+func TestScriptTreeTooDeep(t *testing.T) {
+	runScript(t, 100,
+		// Tag 3 allows trees of depth 2 at most, 200 bytes make
+		// a tree of depth 2 and 2000 bytes one of depth 4
+		defineResource("a", 3, scriptData(200, 1)),
+		defineResource("b", 3, scriptData(2000, 2)),
+		download("a"),
+		download("b"),
+		deliver("b", 0),
+		expectUpdate("b", ipc.ResourceUpdateType_broken),
+		expectDownloading("b", false),
+		deliverRequested("a"),
+		expectUpdate("a", ipc.ResourceUpdateType_added),
+		expectIdle(),
+	)
+}
+
+func TestScriptTagMismatch(t *testing.T) {
+	runScript(t, 100,
+		defineResource("a", 1, scriptData(200, 1)),
+		scriptStep{"download a with tag 0", func(s *scriptState) {
+			KickStartRootDownload(s.resource("a").root, 0, s.bs)
+		}},
+		deliver("a", 0),
+		expectUpdate("a", ipc.ResourceUpdateType_broken),
+		expectIdle(),
+	)
+}
+
+func TestScriptUnsupportedTag(t *testing.T) {
+	runScript(t, 100,
+		defineResource("a", 7, scriptData(200, 1)),
+		scriptStep{"download a with tag 7", func(s *scriptState) {
+			KickStartRootDownload(s.resource("a").root, 7, s.bs)
+		}},
+		expectDownloading("a", false),
+		expectRequested("a"),
+		expectNoUpdate("a"),
+		expectIdle(),
+	)
+}
+
+func TestScriptPrepopulated(t *testing.T) {
+	runScript(t, 100,
+		defineResource("a", 0, scriptData(2000, 1)),
+		prepopulate("a", 0),
+		prepopulate("a", 2),
+		download("a"),
+		// Stored blocks are processed without requesting them
+		expectRequested("a", 1, 3, 7, 8, 9),
+		deliverRequested("a"),
+		expectUpdate("a", ipc.ResourceUpdateType_added),
+		expectIdle(),
+	)
+}
+
+func TestScriptRepeatedDownload(t *testing.T) {
+	runScript(t, 100,
+		defineResource("a", 0, scriptData(2000, 1)),
+		download("a"),
+		// Repeated request of a root being downloaded is skipped
+		download("a"),
+		expectRequested("a", 0),
+		deliverRequested("a"),
+		expectUpdate("a", ipc.ResourceUpdateType_added),
+		expectIdle(),
+		// Fully downloaded root is completed from the storage
+		download("a"),
+		expectRequested("a"),
+		expectUpdate("a", ipc.ResourceUpdateType_added),
+		expectIdle(),
+	)
+}
@@ -0,0 +1,158 @@
+package bitswap_downloader
+
+import (
+	"codanet"
+	ipc "libp2p_ipc"
+	"math/rand"
+	"testing"
+	"testing/quick"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+)
+
+// Deterministic simulation of the downloader state machine: all randomness
+// (trees, blocks present in the storage, order of block arrival) derives
+// from a single seed, so that a failing seed reproduces the same run.
+
+type downloadSim struct {
+	bs *testBitswapState
+	// blocks served by the simulated network
+	network map[cid.Cid][]byte
+}
+
+// newDownloadSim makes a simulation of downloading roots of the group,
+// each block of the group is put to the storage beforehand with the
+// probability
+func newDownloadSim(r *rand.Rand, bg blockGroup, storedProbability float64) *downloadSim {
+	stored := map[cid.Cid][]byte{}
+	for id, b := range bg.blocks {
+		if r.Float64() < storedProbability {
+			stored[id] = b
+		}
+	}
+	return &downloadSim{
+		bs: &testBitswapState{
+			r:                  r,
+			statuses:           map[BitswapBlockLink]codanet.RootBlockStatus{},
+			blocks:             stored,
+			nodeDownloadParams: map[cid.Cid]map[Root][]NodeIndex{},
+			rootDownloadStates: map[Root]*RootDownloadState{},
+			awaitingBlocks:     map[cid.Cid]interface{}{},
+			awaitingBlocksQ:    map[uint64]cid.Cid{},
+			maxBlockSize:       bg.maxBlockSize,
+			resourceUpdates:    map[Root]ipc.ResourceUpdateType{},
+			checkInvariantsNow: func() bool { return true },
+			now:                testClockStart,
+		},
+		network: bg.blocks,
+	}
+}
+
+// run starts downloads of the roots and delivers requested blocks one by
+// one until none are awaited, blocks are picked by the smallest key of the
+// awaiting queue, keys being drawn from the seeded source
+func (s *downloadSim) run(starts []blockGroupStart) {
+	for _, start := range starts {
+		KickStartRootDownload(start.root, start.tag, s.bs)
+	}
+	for len(s.bs.awaitingBlocksQ) > 0 {
+		first := true
+		var k uint64
+		for k1 := range s.bs.awaitingBlocksQ {
+			if first || k1 < k {
+				k, first = k1, false
+			}
+		}
+		id := s.bs.awaitingBlocksQ[k]
+		delete(s.bs.awaitingBlocksQ, k)
+		delete(s.bs.awaitingBlocks, id)
+		data, has := s.network[id]
+		if !has {
+			continue
+		}
+		// Block is put to the storage by Bitswap before it's processed
+		s.bs.blocks[id] = data
+		b, _ := blocks.NewBlockWithCid(data, id)
+		ProcessDownloadedBlock(b, s.bs)
+	}
+}
+
+// checkDrained tells whether no state of any root is left behind
+func (s *downloadSim) checkDrained(t *testing.T) bool {
+	if len(s.bs.rootDownloadStates) > 0 || len(s.bs.nodeDownloadParams) > 0 {
+		t.Logf("%d root download states and %d node download params are left",
+			len(s.bs.rootDownloadStates), len(s.bs.nodeDownloadParams))
+		return false
+	}
+	return true
+}
+
+// Trees of a random structure are reported broken exactly when their
+// structure is invalid, while a valid root downloaded alongside is added,
+// whichever blocks are already stored and in whichever order blocks arrive
+func TestMalformedTreeSimulationQC(t *testing.T) {
+	f := func(seed int64) bool {
+		r := rand.New(rand.NewSource(seed))
+		proto := genProto(r)
+		maxBlockSize := int(proto.maxBlockSize)
+		if !IsValidMaxBlockSize(maxBlockSize) {
+			return true
+		}
+		bg := proto.genTreeFromProto(r, 0, r.Intn(2) == 0)
+		malformed := bg.starts[0].root
+		bg.add(genValidBlockGroupImpl(r, maxBlockSize, 64+r.Intn(10000), 0))
+		valid := bg.starts[1].root
+
+		sim := newDownloadSim(r, bg, r.Float64()/2)
+		sim.run(bg.starts)
+
+		expected := ipc.ResourceUpdateType_added
+		if !proto.isValid() {
+			expected = ipc.ResourceUpdateType_broken
+		}
+		if update, has := sim.bs.resourceUpdates[malformed]; !has || update != expected {
+			t.Logf("seed %d: root of the tree got update %d (has=%v), expected %d", seed, update, has, expected)
+			return false
+		}
+		if update := sim.bs.resourceUpdates[valid]; update != ipc.ResourceUpdateType_added {
+			t.Logf("seed %d: valid root got update %d", seed, update)
+			return false
+		}
+		// Malformed blocks are reported for attribution to their senders
+		if _, reported := sim.bs.malformedBlocks[malformed]; reported == proto.isValid() {
+			t.Logf("seed %d: malformed block reported: %v", seed, reported)
+			return false
+		}
+		return sim.checkDrained(t)
+	}
+	require.NoError(t, quick.Check(f, &quick.Config{MaxCount: 300}))
+}
+
+// Roots downloaded alongside many roots of invalid structure
+// complete regardless of them being broken
+func TestMalformedTreesAlongsideValidSimulation(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	bg := genValidBlockGroupImpl(r, 200, 5000, 0)
+	_ = bg.addDuplicateOfRoot(r, 0, 0)
+	invalid := 0
+	for invalid < 10 {
+		proto := genProtoWithMaxBlockSize(r, bg.maxBlockSize)
+		if proto.isValid() {
+			continue
+		}
+		bg.add(proto.genTreeFromProto(r, 0, true))
+		invalid++
+	}
+	sim := newDownloadSim(r, bg, 0)
+	sim.run(bg.starts)
+	for i, start := range bg.starts {
+		expected := ipc.ResourceUpdateType_broken
+		if i < 2 {
+			expected = ipc.ResourceUpdateType_added
+		}
+		require.Equal(t, expected, sim.bs.resourceUpdates[start.root], "root #%d", i)
+	}
+	require.True(t, sim.checkDrained(t))
+}
@@ -0,0 +1,22 @@
+package bitswap_downloader
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Outcomes of root downloads
+const (
+	DownloadCompleted = "completed"
+	DownloadBroken    = "broken"
+	DownloadTimedOut  = "timed_out"
+	DownloadCancelled = "cancelled"
+	DownloadPreempted = "preempted"
+)
+
+var MalformedBlocksMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "Mina_libp2p_bitswap_malformed_blocks",
+	Help: "Number of downloaded blocks that made their roots broken, by reason",
+}, []string{"reason"})
+
+var ActiveDownloadsMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "Mina_libp2p_bitswap_active_root_downloads",
+	Help: "Number of roots being downloaded",
+})
@@ -0,0 +1,34 @@
+package bitswap_downloader
+
+import (
+	"testing"
+
+	ipc "libp2p_ipc"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitswapDownloadMetrics(t *testing.T) {
+	malformed := testutil.ToFloat64(MalformedBlocksMetric.WithLabelValues("malformed"))
+	runScript(t, 100,
+		defineResource("a", 0, scriptData(2000, 1)),
+		defineResource("b", 0, scriptData(2000, 2)),
+		download("a"),
+		download("b"),
+		scriptStep{"expect two active downloads", func(s *scriptState) {
+			require.Equal(t, 2.0, testutil.ToFloat64(ActiveDownloadsMetric))
+		}},
+		deliver("a", 0),
+		deliverCorrupted("a", 1, []byte{0, 0, 1}),
+		expectUpdate("a", ipc.ResourceUpdateType_broken),
+		deliverRequested("b"),
+		expectUpdate("b", ipc.ResourceUpdateType_added),
+		scriptStep{"expect metrics of finished downloads", func(s *scriptState) {
+			require.Equal(t, 0.0, testutil.ToFloat64(ActiveDownloadsMetric))
+			require.Equal(t, malformed+1, testutil.ToFloat64(MalformedBlocksMetric.WithLabelValues("malformed")))
+			// Both outcomes are observed
+			require.Equal(t, map[string]int{DownloadBroken: 1, DownloadCompleted: 1}, s.bs.outcomes)
+		}},
+	)
+}
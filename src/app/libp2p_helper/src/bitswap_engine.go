@@ -0,0 +1,67 @@
+package codanet
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-bitswap"
+)
+
+// Worker counts of the Bitswap engine are capped, each
+// worker being a goroutine running for the helper's lifetime
+const maxBitswapEngineWorkers = 1024
+
+// BitswapEngineConfig tunes the go-bitswap engine, zero fields keep
+// defaults of go-bitswap. It's fixed once Bitswap is started.
+type BitswapEngineConfig struct {
+	// workers sending blocks to peers
+	TaskWorkerCount int
+	// workers of the decision engine, picking blocks to send
+	EngineTaskWorkerCount int
+	// workers of the decision engine reading blocks from the blockstore
+	EngineBlockstoreWorkerCount int
+	// delay before providers of blocks wanted by a session are looked up
+	ProviderSearchDelay time.Duration
+	// bytes of blocks queued for a single peer at most
+	MaxOutstandingBytesPerPeer int
+}
+
+func (c BitswapEngineConfig) Validate() error {
+	for _, w := range []struct {
+		name  string
+		count int
+	}{
+		{"task", c.TaskWorkerCount},
+		{"engine task", c.EngineTaskWorkerCount},
+		{"engine blockstore", c.EngineBlockstoreWorkerCount},
+	} {
+		if w.count < 0 || w.count > maxBitswapEngineWorkers {
+			return fmt.Errorf("%s worker count %d is out of range [0, %d]", w.name, w.count, maxBitswapEngineWorkers)
+		}
+	}
+	if c.ProviderSearchDelay < 0 || c.MaxOutstandingBytesPerPeer < 0 {
+		return errors.New("negative Bitswap engine parameter")
+	}
+	return nil
+}
+
+func (c BitswapEngineConfig) options() []bitswap.Option {
+	var res []bitswap.Option
+	if c.TaskWorkerCount > 0 {
+		res = append(res, bitswap.TaskWorkerCount(c.TaskWorkerCount))
+	}
+	if c.EngineTaskWorkerCount > 0 {
+		res = append(res, bitswap.EngineTaskWorkerCount(c.EngineTaskWorkerCount))
+	}
+	if c.EngineBlockstoreWorkerCount > 0 {
+		res = append(res, bitswap.EngineBlockstoreWorkerCount(c.EngineBlockstoreWorkerCount))
+	}
+	if c.ProviderSearchDelay > 0 {
+		res = append(res, bitswap.ProviderSearchDelay(c.ProviderSearchDelay))
+	}
+	if c.MaxOutstandingBytesPerPeer > 0 {
+		res = append(res, bitswap.MaxOutstandingBytesPerPeer(c.MaxOutstandingBytesPerPeer))
+	}
+	return res
+}
@@ -0,0 +1,27 @@
+package codanet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitswapEngineConfig(t *testing.T) {
+	require.NoError(t, BitswapEngineConfig{}.Validate())
+	require.Empty(t, BitswapEngineConfig{}.options())
+
+	c := BitswapEngineConfig{
+		TaskWorkerCount:             16,
+		EngineBlockstoreWorkerCount: 256,
+		ProviderSearchDelay:         100 * time.Millisecond,
+	}
+	require.NoError(t, c.Validate())
+	require.Len(t, c.options(), 3)
+
+	c.EngineTaskWorkerCount = maxBitswapEngineWorkers + 1
+	require.Error(t, c.Validate())
+	c.EngineTaskWorkerCount = 1
+	c.MaxOutstandingBytesPerPeer = -1
+	require.Error(t, c.Validate())
+}
@@ -0,0 +1,119 @@
+package codanet
+
+import (
+	"context"
+	"fmt"
+
+	lmdbbs "github.com/georgeee/go-bs-lmdb"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/multiformats/go-multihash"
+)
+
+// Size of metadata of a root at most
+const MaxRootMetadataSize = 256
+
+// BitswapRootMetadata is implemented by storages keeping opaque metadata
+// attached to roots (e.g. height of the block a block body belongs to),
+// so that roots are pruned by it. Metadata is kept until deleted, apart
+// from the status of the root.
+type BitswapRootMetadata interface {
+	SetRootMetadata(key [32]byte, metadata []byte) error
+	// RootMetadata returns blockstore.ErrNotFound for roots without metadata
+	RootMetadata(key [32]byte) ([]byte, error)
+	DeleteRootMetadata(key [32]byte) error
+}
+
+func metadataKey(key [32]byte) []byte {
+	return append([]byte{BS_METADATA_PREFIX}, key[:]...)
+}
+
+func checkRootMetadata(metadata []byte) error {
+	if len(metadata) == 0 || len(metadata) > MaxRootMetadataSize {
+		return fmt.Errorf("root metadata of %d bytes, expected 1 to %d", len(metadata), MaxRootMetadataSize)
+	}
+	return nil
+}
+
+func (bs_ *BitswapStorageLmdb) SetRootMetadata(key [32]byte, metadata []byte) error {
+	if err := checkRootMetadata(metadata); err != nil {
+		return err
+	}
+	bs := (*lmdbbs.Blockstore)(bs_)
+	return bs.PutData(metadataKey(key), func(_ []byte, _ bool) ([]byte, bool, error) {
+		return metadata, true, nil
+	})
+}
+
+func (bs_ *BitswapStorageLmdb) RootMetadata(key [32]byte) ([]byte, error) {
+	return (*lmdbbs.Blockstore)(bs_).GetData(metadataKey(key))
+}
+
+func (bs_ *BitswapStorageLmdb) DeleteRootMetadata(key [32]byte) error {
+	bs := (*lmdbbs.Blockstore)(bs_)
+	return bs.PutData(metadataKey(key), func(_ []byte, _ bool) ([]byte, bool, error) {
+		return nil, false, nil
+	})
+}
+
+// ScanRootMetadata lists metadata of all roots having it in the storage
+// located in the given state directory. It's to be called before
+// the storage is opened for Bitswap.
+func ScanRootMetadata(ctx context.Context, statedir string) (map[[32]byte][]byte, error) {
+	bs_, err := OpenBitswapStorageLmdbForScan(statedir)
+	if err != nil {
+		return nil, err
+	}
+	defer bs_.Close()
+	ch, err := (*lmdbbs.Blockstore)(bs_).AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[[32]byte][]byte)
+	for id := range ch {
+		if id.Prefix().Codec != metadataCidCodec {
+			continue
+		}
+		mh, err := multihash.Decode(id.Hash())
+		if err != nil || len(mh.Digest) != 32 {
+			continue
+		}
+		var key [32]byte
+		copy(key[:], mh.Digest)
+		metadata, err := bs_.RootMetadata(key)
+		if err == blockstore.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res[key] = metadata
+	}
+	return res, ctx.Err()
+}
+
+func (bs *BitswapStorageMemory) SetRootMetadata(key [32]byte, metadata []byte) error {
+	if err := checkRootMetadata(metadata); err != nil {
+		return err
+	}
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	bs.metadata[key] = append([]byte{}, metadata...)
+	return nil
+}
+
+func (bs *BitswapStorageMemory) RootMetadata(key [32]byte) ([]byte, error) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	metadata, has := bs.metadata[key]
+	if !has {
+		return nil, blockstore.ErrNotFound
+	}
+	return metadata, nil
+}
+
+func (bs *BitswapStorageMemory) DeleteRootMetadata(key [32]byte) error {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	delete(bs.metadata, key)
+	return nil
+}
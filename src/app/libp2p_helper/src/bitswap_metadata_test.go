@@ -0,0 +1,58 @@
+package codanet
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootMetadataLmdb(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	bs := openTestStorageLmdb(t, dir)
+	a, b := [32]byte{1}, [32]byte{2}
+	require.NoError(t, bs.SetStatus(a, Full))
+	require.NoError(t, bs.SetRootMetadata(a, []byte{0, 10}))
+	require.NoError(t, bs.SetRootMetadata(b, []byte{0, 20}))
+	require.Error(t, bs.SetRootMetadata(b, nil))
+	require.Error(t, bs.SetRootMetadata(b, make([]byte, MaxRootMetadataSize+1)))
+	metadata, err := bs.RootMetadata(a)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 10}, metadata)
+	require.NoError(t, bs.DeleteRootMetadata(b))
+	_, err = bs.RootMetadata(b)
+	require.Equal(t, blockstore.ErrNotFound, err)
+
+	// Metadata isn't listed as blocks or roots
+	blocks_, roots, err := bs.Scan(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, blocks_)
+	require.Equal(t, [][32]byte{a}, roots)
+	require.NoError(t, bs.Close())
+
+	scanned, err := ScanRootMetadata(context.Background(), dir)
+	require.NoError(t, err)
+	require.Equal(t, map[[32]byte][]byte{a: {0, 10}}, scanned)
+}
+
+func TestRootMetadataMemory(t *testing.T) {
+	bs := NewBitswapStorageMemory(1 << 10)
+	a := [32]byte{1}
+	_, err := bs.RootMetadata(a)
+	require.Equal(t, blockstore.ErrNotFound, err)
+	metadata := []byte{1, 2}
+	require.NoError(t, bs.SetRootMetadata(a, metadata))
+	// Metadata is copied
+	metadata[0] = 3
+	stored, err := bs.RootMetadata(a)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2}, stored)
+	require.NoError(t, bs.DeleteRootMetadata(a))
+	_, err = bs.RootMetadata(a)
+	require.Equal(t, blockstore.ErrNotFound, err)
+}
@@ -0,0 +1,163 @@
+package codanet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	bitnet "github.com/ipfs/go-bitswap/network"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// BitswapProtocolPrefix prefixes dedicated Bitswap protocols,
+// e.g. /mina/bitswap/mainnet/1.2.0
+const BitswapProtocolPrefix = protocol.ID("/mina/bitswap/")
+
+// Versions of dedicated protocols, go-bitswap speaks the
+// legacy protocol of the same version over them
+var bitswapProtocolVersions = []struct {
+	version string
+	legacy  protocol.ID
+}{
+	{"1.2.0", BitSwapExchange + bitnet.ProtocolBitswap},
+	{"1.1.0", BitSwapExchange + bitnet.ProtocolBitswapOneOne},
+	{"1.0.0", BitSwapExchange + bitnet.ProtocolBitswapOneZero},
+}
+
+// BitswapProtocolConfig selects protocols Bitswap is run under. With a
+// network set, Bitswap is run under protocols dedicated to the network,
+// so that peers of other networks never exchange blocks with the node.
+// Legacy protocols prefixed with BitSwapExchange are spoken as a
+// fallback if enabled, to roll dedicated protocols out gradually; they
+// are the only protocols spoken if no network is set.
+type BitswapProtocolConfig struct {
+	Network string
+	Legacy  bool
+}
+
+func (c BitswapProtocolConfig) Validate() error {
+	if strings.ContainsAny(c.Network, "/ \t\n") {
+		return fmt.Errorf("invalid Bitswap network %q", c.Network)
+	}
+	return nil
+}
+
+func (c BitswapProtocolConfig) legacy() bool {
+	return c.Legacy || c.Network == ""
+}
+
+// Protocols lists protocols Bitswap speaks, in the order
+// of preference: dedicated protocols come first
+func (c BitswapProtocolConfig) Protocols() []protocol.ID {
+	var res []protocol.ID
+	if c.Network != "" {
+		for _, v := range bitswapProtocolVersions {
+			res = append(res, BitswapProtocolPrefix+protocol.ID(c.Network+"/"+v.version))
+		}
+	}
+	if c.legacy() {
+		for _, v := range bitswapProtocolVersions {
+			res = append(res, v.legacy)
+		}
+		res = append(res, BitSwapExchange+bitnet.ProtocolBitswapNoVers)
+	}
+	return res
+}
+
+// bitswapProtocolHost runs go-bitswap, which only speaks protocols
+// prefixed with BitSwapExchange, under dedicated protocols. Streams
+// of dedicated protocols are passed to go-bitswap as streams of
+// legacy protocols of the same version. Legacy protocols are
+// neither handled nor negotiated unless spoken as a fallback.
+type bitswapProtocolHost struct {
+	host.Host
+	// dedicated protocols by legacy protocols, and vice versa
+	dedicated map[protocol.ID]protocol.ID
+	legacy    map[protocol.ID]protocol.ID
+	// whether legacy protocols are spoken
+	fallback bool
+}
+
+func newBitswapProtocolHost(h host.Host, c BitswapProtocolConfig) (host.Host, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.Network == "" {
+		return h, nil
+	}
+	res := &bitswapProtocolHost{
+		Host:      h,
+		dedicated: make(map[protocol.ID]protocol.ID),
+		legacy:    make(map[protocol.ID]protocol.ID),
+		fallback:  c.legacy(),
+	}
+	protocols := c.Protocols()
+	for i, v := range bitswapProtocolVersions {
+		pid := protocols[i]
+		res.dedicated[v.legacy] = pid
+		res.legacy[pid] = v.legacy
+	}
+	return res, nil
+}
+
+// bitswapProtocolStream is a stream of a dedicated
+// protocol presented as a stream of a legacy one
+type bitswapProtocolStream struct {
+	network.Stream
+	legacy protocol.ID
+}
+
+func (s *bitswapProtocolStream) Protocol() protocol.ID {
+	return s.legacy
+}
+
+func (h *bitswapProtocolHost) wrap(s network.Stream) network.Stream {
+	if legacy, has := h.legacy[s.Protocol()]; has {
+		return &bitswapProtocolStream{Stream: s, legacy: legacy}
+	}
+	return s
+}
+
+func (h *bitswapProtocolHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	if dedicated, has := h.dedicated[pid]; has {
+		h.Host.SetStreamHandler(dedicated, func(s network.Stream) {
+			handler(h.wrap(s))
+		})
+	}
+	if h.fallback {
+		h.Host.SetStreamHandler(pid, handler)
+	}
+}
+
+func (h *bitswapProtocolHost) RemoveStreamHandler(pid protocol.ID) {
+	if dedicated, has := h.dedicated[pid]; has {
+		h.Host.RemoveStreamHandler(dedicated)
+	}
+	h.Host.RemoveStreamHandler(pid)
+}
+
+// NewStream negotiates dedicated protocols ahead of legacy ones,
+// legacy protocols are only offered if spoken as a fallback
+func (h *bitswapProtocolHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	protos := make([]protocol.ID, 0, 2*len(pids))
+	for _, pid := range pids {
+		if dedicated, has := h.dedicated[pid]; has {
+			protos = append(protos, dedicated)
+		}
+	}
+	if h.fallback {
+		protos = append(protos, pids...)
+	}
+	if len(protos) == 0 {
+		return nil, errors.New("no Bitswap protocol to negotiate")
+	}
+	s, err := h.Host.NewStream(ctx, p, protos...)
+	if err != nil {
+		return nil, err
+	}
+	return h.wrap(s), nil
+}
@@ -0,0 +1,92 @@
+package codanet
+
+import (
+	"context"
+	"testing"
+
+	bitnet "github.com/ipfs/go-bitswap/network"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var legacyBitswapProtocols = []protocol.ID{
+	BitSwapExchange + bitnet.ProtocolBitswap,
+	BitSwapExchange + bitnet.ProtocolBitswapOneOne,
+	BitSwapExchange + bitnet.ProtocolBitswapOneZero,
+	BitSwapExchange + bitnet.ProtocolBitswapNoVers,
+}
+
+func TestBitswapProtocolConfig(t *testing.T) {
+	require.Equal(t, legacyBitswapProtocols, BitswapProtocolConfig{}.Protocols())
+	require.Equal(t, []protocol.ID{
+		"/mina/bitswap/mainnet/1.2.0",
+		"/mina/bitswap/mainnet/1.1.0",
+		"/mina/bitswap/mainnet/1.0.0",
+	}, BitswapProtocolConfig{Network: "mainnet"}.Protocols())
+	withLegacy := BitswapProtocolConfig{Network: "mainnet", Legacy: true}.Protocols()
+	require.Len(t, withLegacy, 7)
+	require.Equal(t, legacyBitswapProtocols, withLegacy[3:])
+
+	require.NoError(t, BitswapProtocolConfig{Network: "devnet"}.Validate())
+	require.Error(t, BitswapProtocolConfig{Network: "dev/net"}.Validate())
+}
+
+func TestBitswapProtocolNegotiation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn, err := mocknet.FullMeshLinked(ctx, 5)
+	require.NoError(t, err)
+
+	// go-bitswap handles and negotiates legacy protocols
+	serve := func(h host.Host, c BitswapProtocolConfig) host.Host {
+		wrapped, err := newBitswapProtocolHost(h, c)
+		require.NoError(t, err)
+		for _, pid := range legacyBitswapProtocols {
+			wrapped.SetStreamHandler(pid, func(s network.Stream) {
+				_ = s.Close()
+			})
+		}
+		return wrapped
+	}
+	hosts := mn.Hosts()
+	mainnet := serve(hosts[0], BitswapProtocolConfig{Network: "mainnet"})
+	mainnet2 := serve(hosts[1], BitswapProtocolConfig{Network: "mainnet"})
+	devnet := serve(hosts[2], BitswapProtocolConfig{Network: "devnet"})
+	legacy := serve(hosts[3], BitswapProtocolConfig{})
+	fallback := serve(hosts[4], BitswapProtocolConfig{Network: "mainnet", Legacy: true})
+
+	negotiate := func(from host.Host, to host.Host) (protocol.ID, error) {
+		s, err := from.NewStream(ctx, to.ID(), legacyBitswapProtocols...)
+		if err != nil {
+			return "", err
+		}
+		defer s.Close()
+		return s.Protocol(), nil
+	}
+
+	// Peers of the network negotiate the dedicated protocol,
+	// it's presented to go-bitswap as the legacy one
+	pid, err := negotiate(mainnet, mainnet2)
+	require.NoError(t, err)
+	require.Equal(t, BitSwapExchange+bitnet.ProtocolBitswap, pid)
+	pid, err = negotiate(mainnet, fallback)
+	require.NoError(t, err)
+	require.Equal(t, BitSwapExchange+bitnet.ProtocolBitswap, pid)
+
+	// Peers of other networks fail to negotiate
+	_, err = negotiate(mainnet, devnet)
+	require.Error(t, err)
+
+	// Legacy peers are only spoken to with the fallback
+	_, err = negotiate(mainnet, legacy)
+	require.Error(t, err)
+	_, err = negotiate(legacy, mainnet)
+	require.Error(t, err)
+	_, err = negotiate(fallback, legacy)
+	require.NoError(t, err)
+	_, err = negotiate(legacy, fallback)
+	require.NoError(t, err)
+}
@@ -0,0 +1,241 @@
+package codanet
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	lmdbbs "github.com/georgeee/go-bs-lmdb"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/multiformats/go-multihash"
+)
+
+// BitswapRefCounter is implemented by storages that count references of
+// full roots to their blocks, so that a block shared between roots is
+// only deleted along with the last root referencing it. A root references
+// each distinct block of its tree once.
+type BitswapRefCounter interface {
+	// RefBlocks adds a reference to each of the blocks
+	RefBlocks(keys [][32]byte) error
+	// UnrefBlocks removes a reference from each of the blocks,
+	// returning the blocks that are no longer referenced
+	UnrefBlocks(keys [][32]byte) ([][32]byte, error)
+	RefCount(key [32]byte) (int, error)
+	// UnreferencedBlocks lists blocks of the storage not referenced by
+	// any root, along with their total size and total size of all blocks
+	// in the storage
+	UnreferencedBlocks(ctx context.Context) (keys [][32]byte, unreferencedSize int, totalSize int, err error)
+	// DedupStats tells how much the storage saves by keeping
+	// blocks shared between roots once
+	DedupStats(ctx context.Context) (BitswapDedupStats, error)
+	// RefCountsInitialized tells whether reference counts cover all full
+	// roots of the storage. It's false for storages created before
+	// reference counting was introduced, until counts are rebuilt.
+	RefCountsInitialized() (bool, error)
+	// SetRefCounts sets reference counts of the blocks (zero removes
+	// the count) and marks reference counts as initialized
+	SetRefCounts(counts map[[32]byte]int) error
+}
+
+// BitswapDedupStats describes blocks stored once while
+// being referenced by several roots
+type BitswapDedupStats struct {
+	// Number of blocks referenced by more than one root
+	SharedBlocks int
+	// Size the shared blocks would take if stored once per root
+	// referencing them, less their actual size
+	SavedBytes int
+}
+
+func refCountKey(key [32]byte) []byte {
+	return append([]byte{BS_REFCOUNT_PREFIX}, key[:]...)
+}
+
+// Marker of initialized reference counts, it's
+// shorter than keys of reference counts
+var refCountsInitializedKey = []byte{BS_REFCOUNT_PREFIX}
+
+func unmarshalRefCount(r []byte) (int, error) {
+	if len(r) != 4 {
+		return 0, fmt.Errorf("wrong reference count retrieved: %v", r)
+	}
+	return int(binary.LittleEndian.Uint32(r)), nil
+}
+
+func marshalRefCount(count int) []byte {
+	res := make([]byte, 4)
+	binary.LittleEndian.PutUint32(res, uint32(count))
+	return res
+}
+
+// updateRefCount applies the change to the reference count of the block,
+// returning the new count, reference counts never go below zero
+func (bs_ *BitswapStorageLmdb) updateRefCount(key [32]byte, change func(int) int) (int, error) {
+	bs := (*lmdbbs.Blockstore)(bs_)
+	var count int
+	err := bs.PutData(refCountKey(key), func(prevVal []byte, exists bool) ([]byte, bool, error) {
+		prev := 0
+		if exists {
+			var err error
+			if prev, err = unmarshalRefCount(prevVal); err != nil {
+				return nil, false, err
+			}
+		}
+		count = change(prev)
+		if count <= 0 {
+			count = 0
+			return nil, false, nil
+		}
+		return marshalRefCount(count), true, nil
+	})
+	return count, err
+}
+
+func (bs_ *BitswapStorageLmdb) RefBlocks(keys [][32]byte) error {
+	for _, key := range keys {
+		if _, err := bs_.updateRefCount(key, func(c int) int { return c + 1 }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bs_ *BitswapStorageLmdb) UnrefBlocks(keys [][32]byte) ([][32]byte, error) {
+	released := [][32]byte{}
+	for _, key := range keys {
+		count, err := bs_.updateRefCount(key, func(c int) int { return c - 1 })
+		if err != nil {
+			return released, err
+		}
+		if count == 0 {
+			released = append(released, key)
+		}
+	}
+	return released, nil
+}
+
+func (bs_ *BitswapStorageLmdb) RefCount(key [32]byte) (int, error) {
+	bs := (*lmdbbs.Blockstore)(bs_)
+	r, err := bs.GetData(refCountKey(key))
+	if err == blockstore.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return unmarshalRefCount(r)
+}
+
+func (bs_ *BitswapStorageLmdb) UnreferencedBlocks(ctx context.Context) ([][32]byte, int, int, error) {
+	bs := (*lmdbbs.Blockstore)(bs_)
+	ch, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	res := [][32]byte{}
+	unreferenced, total := 0, 0
+	for id := range ch {
+		mh, err := multihash.Decode(id.Hash())
+		if err != nil || len(mh.Digest) != 32 {
+			continue
+		}
+		size, err := bs.GetSize(id)
+		if err == blockstore.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		total += size
+		var key [32]byte
+		copy(key[:], mh.Digest)
+		count, err := bs_.RefCount(key)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if count == 0 {
+			res = append(res, key)
+			unreferenced += size
+		}
+	}
+	return res, unreferenced, total, ctx.Err()
+}
+
+func (bs_ *BitswapStorageLmdb) DedupStats(ctx context.Context) (BitswapDedupStats, error) {
+	bs := (*lmdbbs.Blockstore)(bs_)
+	var stats BitswapDedupStats
+	ch, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return stats, err
+	}
+	for id := range ch {
+		mh, err := multihash.Decode(id.Hash())
+		if err != nil || len(mh.Digest) != 32 {
+			continue
+		}
+		var key [32]byte
+		copy(key[:], mh.Digest)
+		count, err := bs_.RefCount(key)
+		if err != nil {
+			return stats, err
+		}
+		if count < 2 {
+			continue
+		}
+		size, err := bs.GetSize(id)
+		if err == blockstore.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return stats, err
+		}
+		stats.SharedBlocks++
+		stats.SavedBytes += (count - 1) * size
+	}
+	return stats, ctx.Err()
+}
+
+func (bs_ *BitswapStorageLmdb) RefCountsInitialized() (bool, error) {
+	bs := (*lmdbbs.Blockstore)(bs_)
+	_, err := bs.GetData(refCountsInitializedKey)
+	if err == blockstore.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (bs_ *BitswapStorageLmdb) markRefCountsInitialized() error {
+	bs := (*lmdbbs.Blockstore)(bs_)
+	return bs.PutData(refCountsInitializedKey, func(_ []byte, _ bool) ([]byte, bool, error) {
+		return []byte{1}, true, nil
+	})
+}
+
+func (bs_ *BitswapStorageLmdb) SetRefCounts(counts map[[32]byte]int) error {
+	for key, count := range counts {
+		count := count
+		if _, err := bs_.updateRefCount(key, func(int) int { return count }); err != nil {
+			return err
+		}
+	}
+	return bs_.markRefCountsInitialized()
+}
+
+// InitRefCounts marks reference counts of an empty storage as initialized,
+// as there are no roots that could miss references
+func (bs_ *BitswapStorageLmdb) InitRefCounts(ctx context.Context) error {
+	initialized, err := bs_.RefCountsInitialized()
+	if err != nil || initialized {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch, err := (*lmdbbs.Blockstore)(bs_).AllKeysChan(ctx)
+	if err != nil {
+		return err
+	}
+	if _, nonEmpty := <-ch; nonEmpty {
+		return nil
+	}
+	return bs_.markRefCountsInitialized()
+}
@@ -0,0 +1,81 @@
+package codanet
+
+import (
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Blocks whose senders are remembered at most
+const maxRememberedSenders = 1 << 16
+
+// BitswapSenders remembers peers that sent recently received blocks, so
+// that a block found malformed once it's processed is attributed to its
+// sender. The least recently received blocks are forgotten first.
+// A block received while its sender is still remembered is reported
+// as a duplicate.
+type BitswapSenders struct {
+	senders map[cid.Cid]peer.ID
+	// ring of remembered blocks, next is the slot to reuse
+	ring        []cid.Cid
+	next        int
+	onDuplicate func(b blocks.Block)
+	mutex       sync.Mutex
+}
+
+func NewBitswapSenders() *BitswapSenders {
+	return newBitswapSenders(maxRememberedSenders)
+}
+
+func newBitswapSenders(capacity int) *BitswapSenders {
+	return &BitswapSenders{
+		senders: make(map[cid.Cid]peer.ID),
+		ring:    make([]cid.Cid, 0, capacity),
+	}
+}
+
+// OnDuplicate sets the handler of blocks received more than once,
+// it's called for every duplicate and mustn't block
+func (s *BitswapSenders) OnDuplicate(f func(b blocks.Block)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.onDuplicate = f
+}
+
+func (s *BitswapSenders) record(sender peer.ID, blks []blocks.Block) {
+	var duplicates []blocks.Block
+	s.mutex.Lock()
+	onDuplicate := s.onDuplicate
+	for _, b := range blks {
+		id := b.Cid()
+		if _, has := s.senders[id]; has {
+			s.senders[id] = sender
+			duplicates = append(duplicates, b)
+			continue
+		}
+		if len(s.ring) < cap(s.ring) {
+			s.ring = append(s.ring, id)
+		} else {
+			delete(s.senders, s.ring[s.next])
+			s.ring[s.next] = id
+			s.next = (s.next + 1) % len(s.ring)
+		}
+		s.senders[id] = sender
+	}
+	s.mutex.Unlock()
+	if onDuplicate != nil {
+		for _, b := range duplicates {
+			onDuplicate(b)
+		}
+	}
+}
+
+// Sender returns the peer the block was last received from
+func (s *BitswapSenders) Sender(id cid.Cid) (peer.ID, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	p, has := s.senders[id]
+	return p, has
+}
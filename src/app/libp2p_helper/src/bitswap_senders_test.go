@@ -0,0 +1,50 @@
+package codanet
+
+import (
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitswapSenders(t *testing.T) {
+	s := newBitswapSenders(2)
+	a, b, c := blocks.NewBlock([]byte("a")), blocks.NewBlock([]byte("b")), blocks.NewBlock([]byte("c"))
+	s.record(peer.ID("p1"), []blocks.Block{a, b})
+	p, has := s.Sender(a.Cid())
+	require.True(t, has)
+	require.Equal(t, peer.ID("p1"), p)
+
+	// Block received again is attributed to its last sender
+	s.record(peer.ID("p2"), []blocks.Block{a})
+	p, _ = s.Sender(a.Cid())
+	require.Equal(t, peer.ID("p2"), p)
+
+	// The least recently received block is forgotten
+	s.record(peer.ID("p3"), []blocks.Block{c})
+	_, has = s.Sender(a.Cid())
+	require.False(t, has)
+	p, _ = s.Sender(b.Cid())
+	require.Equal(t, peer.ID("p1"), p)
+	p, _ = s.Sender(c.Cid())
+	require.Equal(t, peer.ID("p3"), p)
+}
+
+func TestBitswapSendersDuplicates(t *testing.T) {
+	s := newBitswapSenders(2)
+	var duplicates []blocks.Block
+	s.OnDuplicate(func(b blocks.Block) {
+		duplicates = append(duplicates, b)
+	})
+	a, b, c := blocks.NewBlock([]byte("a")), blocks.NewBlock([]byte("b")), blocks.NewBlock([]byte("c"))
+	s.record(peer.ID("p1"), []blocks.Block{a, b})
+	require.Empty(t, duplicates)
+	s.record(peer.ID("p2"), []blocks.Block{a})
+	require.Equal(t, []blocks.Block{a}, duplicates)
+
+	// Forgotten blocks aren't duplicates once received again
+	s.record(peer.ID("p3"), []blocks.Block{c})
+	s.record(peer.ID("p3"), []blocks.Block{a})
+	require.Equal(t, []blocks.Block{a}, duplicates)
+}
@@ -0,0 +1,149 @@
+package codanet
+
+import (
+	"sync"
+	"time"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Window over which blocks requested by a peer are counted
+const bitswapServingWindow = time.Minute
+
+type servingWindow struct {
+	start time.Time
+	count int
+}
+
+// BitswapServingLimiter caps blocks served over Bitswap to each peer and
+// denies serving to listed peers. Bitswap serves blocks to wants of its
+// peers, hence wants of blocks over the limit and all wants of denied
+// peers are dropped from received messages. Blocks received from such
+// peers and wants of block presence only are not affected.
+type BitswapServingLimiter struct {
+	// blocks served to a peer per minute, zero means no limit
+	maxBlocksPerMinute int
+	denied             map[peer.ID]bool
+	windows            map[peer.ID]*servingWindow
+	now                func() time.Time
+	// called with the number of wants of blocks dropped
+	// from a message of a peer that's not denied
+	onOverLimit func(p peer.ID, dropped int)
+	mutex       sync.Mutex
+}
+
+func NewBitswapServingLimiter() *BitswapServingLimiter {
+	return &BitswapServingLimiter{
+		denied:  make(map[peer.ID]bool),
+		windows: make(map[peer.ID]*servingWindow),
+		now:     time.Now,
+	}
+}
+
+// Configure replaces the limit and the deny list,
+// blocks counted in current windows are kept
+func (l *BitswapServingLimiter) Configure(maxBlocksPerMinute int, denied []peer.ID) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.maxBlocksPerMinute = maxBlocksPerMinute
+	l.denied = make(map[peer.ID]bool, len(denied))
+	for _, p := range denied {
+		l.denied[p] = true
+	}
+}
+
+// OnOverLimit sets the handler of peers exceeding the limit
+func (l *BitswapServingLimiter) OnOverLimit(f func(p peer.ID, dropped int)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.onOverLimit = f
+}
+
+func (l *BitswapServingLimiter) Denied(p peer.ID) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.denied[p]
+}
+
+// admit counts wants of blocks of the peer, returning how many
+// of them may be served
+func (l *BitswapServingLimiter) admit(p peer.ID, wants int) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.denied[p] {
+		return 0
+	}
+	if l.maxBlocksPerMinute <= 0 {
+		return wants
+	}
+	now := l.now()
+	w, has := l.windows[p]
+	if !has || now.Sub(w.start) >= bitswapServingWindow {
+		w = &servingWindow{start: now}
+		l.windows[p] = w
+	}
+	admitted := l.maxBlocksPerMinute - w.count
+	if admitted > wants {
+		admitted = wants
+	}
+	if admitted < 0 {
+		admitted = 0
+	}
+	w.count += admitted
+	return admitted
+}
+
+func (l *BitswapServingLimiter) forgetPeer(p peer.ID) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.windows, p)
+}
+
+// filter returns the message with wants not admitted removed,
+// the message itself is returned if all wants are admitted
+func (l *BitswapServingLimiter) filter(sender peer.ID, incoming bsmsg.BitSwapMessage) bsmsg.BitSwapMessage {
+	wantlist := incoming.Wantlist()
+	if len(wantlist) == 0 {
+		return incoming
+	}
+	denied := l.Denied(sender)
+	blockWants := 0
+	for _, e := range wantlist {
+		if !e.Cancel && e.WantType == pb.Message_Wantlist_Block {
+			blockWants++
+		}
+	}
+	admitted := blockWants
+	if !denied && blockWants > 0 {
+		admitted = l.admit(sender, blockWants)
+	}
+	if !denied && admitted == blockWants {
+		return incoming
+	}
+	if !denied {
+		l.mutex.Lock()
+		onOverLimit := l.onOverLimit
+		l.mutex.Unlock()
+		if onOverLimit != nil {
+			onOverLimit(sender, blockWants-admitted)
+		}
+	}
+	// Wants are admitted in the order of the message, cancels pass
+	filtered := incoming.Clone()
+	for _, e := range wantlist {
+		if e.Cancel {
+			continue
+		}
+		if !denied && e.WantType == pb.Message_Wantlist_Block && admitted > 0 {
+			admitted--
+			continue
+		}
+		if !denied && e.WantType != pb.Message_Wantlist_Block {
+			continue
+		}
+		filtered.Remove(e.Cid)
+	}
+	return filtered
+}
@@ -0,0 +1,84 @@
+package codanet
+
+import (
+	"testing"
+	"time"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func mkServingTestMsg(blockWants, haveWants int) bsmsg.BitSwapMessage {
+	msg := bsmsg.New(false)
+	for i := 0; i < blockWants; i++ {
+		msg.AddEntry(BlockHashToCid([32]byte{1, byte(i)}), 1, pb.Message_Wantlist_Block, true)
+	}
+	for i := 0; i < haveWants; i++ {
+		msg.AddEntry(BlockHashToCid([32]byte{2, byte(i)}), 1, pb.Message_Wantlist_Have, true)
+	}
+	msg.Cancel(BlockHashToCid([32]byte{3}))
+	return msg
+}
+
+func servingTestWants(msg bsmsg.BitSwapMessage) (blockWants, haveWants, cancels int) {
+	for _, e := range msg.Wantlist() {
+		switch {
+		case e.Cancel:
+			cancels++
+		case e.WantType == pb.Message_Wantlist_Block:
+			blockWants++
+		default:
+			haveWants++
+		}
+	}
+	return
+}
+
+func TestBitswapServingLimit(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewBitswapServingLimiter()
+	l.now = func() time.Time { return now }
+
+	// No limit by default
+	msg := mkServingTestMsg(100, 1)
+	require.Equal(t, msg, l.filter(peer.ID("a"), msg))
+
+	l.Configure(10, nil)
+	overLimit := map[peer.ID]int{}
+	l.OnOverLimit(func(p peer.ID, dropped int) { overLimit[p] += dropped })
+	msg = l.filter(peer.ID("a"), mkServingTestMsg(6, 1))
+	blockWants, haveWants, cancels := servingTestWants(msg)
+	require.Equal(t, []int{6, 1, 1}, []int{blockWants, haveWants, cancels})
+	require.Empty(t, overLimit)
+	msg = l.filter(peer.ID("a"), mkServingTestMsg(6, 1))
+	blockWants, haveWants, cancels = servingTestWants(msg)
+	require.Equal(t, []int{4, 1, 1}, []int{blockWants, haveWants, cancels})
+	require.Equal(t, map[peer.ID]int{"a": 2}, overLimit)
+	// Other peers have their own limits
+	msg = l.filter(peer.ID("b"), mkServingTestMsg(6, 0))
+	blockWants, _, _ = servingTestWants(msg)
+	require.Equal(t, 6, blockWants)
+
+	// Limit is restored after the window passes
+	now = now.Add(bitswapServingWindow)
+	msg = l.filter(peer.ID("a"), mkServingTestMsg(6, 0))
+	blockWants, _, _ = servingTestWants(msg)
+	require.Equal(t, 6, blockWants)
+}
+
+func TestBitswapServingDenied(t *testing.T) {
+	l := NewBitswapServingLimiter()
+	l.Configure(0, []peer.ID{"a"})
+	require.True(t, l.Denied(peer.ID("a")))
+	// Only cancels of a denied peer pass
+	blockWants, haveWants, cancels := servingTestWants(l.filter(peer.ID("a"), mkServingTestMsg(2, 2)))
+	require.Equal(t, []int{0, 0, 1}, []int{blockWants, haveWants, cancels})
+
+	// Deny list is replaced
+	l.Configure(0, nil)
+	require.False(t, l.Denied(peer.ID("a")))
+	blockWants, haveWants, _ = servingTestWants(l.filter(peer.ID("a"), mkServingTestMsg(2, 2)))
+	require.Equal(t, []int{2, 2}, []int{blockWants, haveWants})
+}
@@ -1,10 +1,14 @@
 package codanet
 
 import (
+	"context"
 	"fmt"
+	"path"
 
 	lmdbbs "github.com/georgeee/go-bs-lmdb"
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	"github.com/multiformats/go-multihash"
 )
 
@@ -16,16 +20,58 @@ const (
 	Deleting
 )
 
+// BitswapStorage is safe for concurrent use: the downloader reads blocks
+// of a tree from several goroutines while Bitswap writes blocks received.
 type BitswapStorage interface {
 	GetStatus(key [32]byte) (RootBlockStatus, error)
 	SetStatus(key [32]byte, value RootBlockStatus) error
 	DeleteStatus(key [32]byte) error
 	DeleteBlocks(keys [][32]byte) error
 	ViewBlock(key [32]byte, callback func([]byte) error) error
+	// PutBlocks writes the blocks in a single batch
+	PutBlocks(blockMap map[[32]byte][]byte) error
+	// GetBlocks reads the blocks in a single batch, blocks missing from
+	// the storage are absent from the result. Returned data is not
+	// shared with the storage, yet it must not be modified.
+	GetBlocks(keys [][32]byte) (map[[32]byte][]byte, error)
+}
+
+// BitswapPinner is implemented by storages that may evict blocks,
+// pinned blocks are protected from eviction. Pins are counted, a block
+// pinned a number of times stays pinned until unpinned as many times.
+type BitswapPinner interface {
+	PinBlocks(keys [][32]byte)
+	UnpinBlocks(keys [][32]byte)
 }
 
 type BitswapStorageLmdb lmdbbs.Blockstore
 
+// BitswapStorageOptions returns options of the LMDB storage
+// located in the given state directory
+func BitswapStorageOptions(statedir string) lmdbbs.Options {
+	// 256MiB, a large enough mmap size to make mmap grow() a rare event
+	return lmdbbs.Options{
+		Path:            path.Join(statedir, "block-db"),
+		InitialMmapSize: 256 << 20,
+		CidToKeyMapper:  cidToKeyMapper,
+		KeyToCidMapper:  keyToCidMapper,
+	}
+}
+
+// OpenBitswapStorageLmdbForScan opens the storage located in the given
+// state directory for offline inspection: keys of root statuses are
+// listed by Scan along with keys of blocks.
+// Storage opened this way shouldn't be handed over to Bitswap.
+func OpenBitswapStorageLmdbForScan(statedir string) (*BitswapStorageLmdb, error) {
+	opt := BitswapStorageOptions(statedir)
+	opt.KeyToCidMapper = keyToCidMapperWithStatuses
+	bs, err := lmdbbs.Open(&opt)
+	if err != nil {
+		return nil, err
+	}
+	return (*BitswapStorageLmdb)(bs), nil
+}
+
 func UnmarshalRootBlockStatus(r []byte) (res RootBlockStatus, err error) {
 	err = fmt.Errorf("wrong root block status retrieved: %v", r)
 	if len(r) != 1 {
@@ -51,6 +97,49 @@ func (bs_ *BitswapStorageLmdb) ViewBlock(key [32]byte, callback func([]byte) err
 	return bs.View(BlockHashToCid(key), callback)
 }
 
+func (bs_ *BitswapStorageLmdb) PutBlocks(blockMap map[[32]byte][]byte) error {
+	blocks_, err := blocksOfMap(blockMap)
+	if err != nil {
+		return err
+	}
+	return (*lmdbbs.Blockstore)(bs_).PutMany(blocks_)
+}
+
+func (bs_ *BitswapStorageLmdb) GetBlocks(keys [][32]byte) (map[[32]byte][]byte, error) {
+	return getBlocks(bs_.ViewBlock, keys)
+}
+
+// blocksOfMap converts blocks keyed by their hashes for Blockstore.PutMany
+func blocksOfMap(blockMap map[[32]byte][]byte) ([]blocks.Block, error) {
+	res := make([]blocks.Block, 0, len(blockMap))
+	for key, data := range blockMap {
+		block, err := blocks.NewBlockWithCid(data, BlockHashToCid(key))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, block)
+	}
+	return res, nil
+}
+
+// getBlocks reads the blocks with the view function,
+// copying their data out of the storage
+func getBlocks(view func([32]byte, func([]byte) error) error, keys [][32]byte) (map[[32]byte][]byte, error) {
+	res := make(map[[32]byte][]byte, len(keys))
+	for _, key := range keys {
+		err := view(key, func(b []byte) error {
+			data := make([]byte, len(b))
+			copy(data, b)
+			res[key] = data
+			return nil
+		})
+		if err != nil && err != blockstore.ErrNotFound {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
 func (bs_ *BitswapStorageLmdb) GetStatus(key [32]byte) (res RootBlockStatus, err error) {
 	bs := (*lmdbbs.Blockstore)(bs_)
 	r, err := bs.GetData(statusKey(key))
@@ -99,6 +188,73 @@ func (bs_ *BitswapStorageLmdb) SetStatus(key [32]byte, newStatus RootBlockStatus
 		return []byte{byte(newStatus)}, true, nil
 	})
 }
+
+// ForceStatus sets status of a root ignoring the allowed status transitions,
+// it's meant to be used only for repairs of the storage
+func (bs_ *BitswapStorageLmdb) ForceStatus(key [32]byte, newStatus RootBlockStatus) error {
+	bs := (*lmdbbs.Blockstore)(bs_)
+	return bs.PutData(statusKey(key), func(_ []byte, _ bool) ([]byte, bool, error) {
+		return []byte{byte(newStatus)}, true, nil
+	})
+}
+
+// Scan lists hashes of all blocks and all roots with a status
+// in the storage opened by OpenBitswapStorageLmdbForScan,
+// keys of root metadata are skipped
+func (bs_ *BitswapStorageLmdb) Scan(ctx context.Context) (blocks [][32]byte, roots [][32]byte, err error) {
+	bs := (*lmdbbs.Blockstore)(bs_)
+	ch, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return
+	}
+	for id := range ch {
+		mh, err := multihash.Decode(id.Hash())
+		if err != nil || len(mh.Digest) != 32 {
+			continue
+		}
+		var key [32]byte
+		copy(key[:], mh.Digest)
+		switch id.Prefix().Codec {
+		case statusCidCodec:
+			roots = append(roots, key)
+		case cid.Raw:
+			blocks = append(blocks, key)
+		}
+	}
+	err = ctx.Err()
+	return
+}
+
+// ScanPartialRoots lists roots with partial status in the storage
+// located in the given state directory. It's to be called before
+// the storage is opened for Bitswap.
+func ScanPartialRoots(ctx context.Context, statedir string) ([][32]byte, error) {
+	bs, err := OpenBitswapStorageLmdbForScan(statedir)
+	if err != nil {
+		return nil, err
+	}
+	defer bs.Close()
+	_, roots, err := bs.Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := [][32]byte{}
+	for _, root := range roots {
+		status, err := bs.GetStatus(root)
+		if err != nil {
+			return nil, err
+		}
+		if status == Partial {
+			res = append(res, root)
+		}
+	}
+	return res, nil
+}
+
+func (bs_ *BitswapStorageLmdb) Close() error {
+	return (*lmdbbs.Blockstore)(bs_).Close()
+}
+
 func (bs_ *BitswapStorageLmdb) DeleteBlocks(keys [][32]byte) error {
 	bs := (*lmdbbs.Blockstore)(bs_)
 	cids := make([]cid.Cid, len(keys))
@@ -111,6 +267,9 @@ func (bs_ *BitswapStorageLmdb) DeleteBlocks(keys [][32]byte) error {
 const (
 	BS_BLOCK_PREFIX byte = iota
 	BS_STATUS_PREFIX
+	BS_REFCOUNT_PREFIX
+	BS_FORMAT_PREFIX
+	BS_METADATA_PREFIX
 )
 
 var MULTI_HASH_CODE = multihash.Names["blake2b-256"]
@@ -141,3 +300,22 @@ func keyToCidMapper(key []byte) (id cid.Cid) {
 	}
 	return
 }
+
+// Codecs of CIDs that status and metadata keys are
+// mapped to by keyToCidMapperWithStatuses
+const (
+	statusCidCodec   = cid.DagCBOR
+	metadataCidCodec = cid.DagProtobuf
+)
+
+func keyToCidMapperWithStatuses(key []byte) (id cid.Cid) {
+	if len(key) == 33 && key[0] == BS_STATUS_PREFIX {
+		mh, _ := multihash.Encode(key[1:], MULTI_HASH_CODE)
+		return cid.NewCidV1(statusCidCodec, mh)
+	}
+	if len(key) == 33 && key[0] == BS_METADATA_PREFIX {
+		mh, _ := multihash.Encode(key[1:], MULTI_HASH_CODE)
+		return cid.NewCidV1(metadataCidCodec, mh)
+	}
+	return keyToCidMapper(key)
+}
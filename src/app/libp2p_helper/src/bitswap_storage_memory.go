@@ -0,0 +1,396 @@
+package codanet
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/multiformats/go-multihash"
+)
+
+type memoryBlock struct {
+	key  [32]byte
+	data []byte
+}
+
+// BitswapStorageMemory is an ephemeral storage for stateless nodes that
+// download, verify and discard block bodies without touching the disk.
+// It serves both as a blockstore for Bitswap and as a BitswapStorage.
+// Once total size of stored blocks exceeds the bound, least recently
+// used blocks are evicted, except for pinned ones; statuses of roots
+// are kept until deleted.
+type BitswapStorageMemory struct {
+	maxSize int
+	size    int
+	// most recently used blocks are at the front
+	lru *list.List
+	// pinned blocks are kept out of lru
+	pinned   *list.List
+	pins     map[[32]byte]int
+	blocks   map[[32]byte]*list.Element
+	statuses map[[32]byte]RootBlockStatus
+	refs     map[[32]byte]int
+	metadata map[[32]byte][]byte
+	mutex    sync.Mutex
+}
+
+func NewBitswapStorageMemory(maxSize int) *BitswapStorageMemory {
+	return &BitswapStorageMemory{
+		maxSize:  maxSize,
+		lru:      list.New(),
+		pinned:   list.New(),
+		pins:     make(map[[32]byte]int),
+		blocks:   make(map[[32]byte]*list.Element),
+		statuses: make(map[[32]byte]RootBlockStatus),
+		refs:     make(map[[32]byte]int),
+		metadata: make(map[[32]byte][]byte),
+	}
+}
+
+// CidToBlockHash is the inverse of BlockHashToCid, ok is false
+// for CIDs of other codecs or hash functions
+func CidToBlockHash(id cid.Cid) (key [32]byte, ok bool) {
+	mh, err := multihash.Decode(id.Hash())
+	if err == nil && mh.Code == MULTI_HASH_CODE && id.Prefix().Codec == cid.Raw && len(mh.Digest) == 32 {
+		copy(key[:], mh.Digest)
+		ok = true
+	}
+	return
+}
+
+// Size returns total size of blocks currently stored
+func (bs *BitswapStorageMemory) Size() int {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	return bs.size
+}
+
+// lookup returns data of the block marking it as recently used
+func (bs *BitswapStorageMemory) lookup(key [32]byte) ([]byte, bool) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	el, has := bs.blocks[key]
+	if !has {
+		return nil, false
+	}
+	bs.lru.MoveToFront(el)
+	return el.Value.(*memoryBlock).data, true
+}
+
+// listOf returns the list a block with the key belongs to
+func (bs *BitswapStorageMemory) listOf(key [32]byte) *list.List {
+	if bs.pins[key] > 0 {
+		return bs.pinned
+	}
+	return bs.lru
+}
+
+func (bs *BitswapStorageMemory) remove(el *list.Element) {
+	b := el.Value.(*memoryBlock)
+	bs.listOf(b.key).Remove(el)
+	delete(bs.blocks, b.key)
+	bs.size -= len(b.data)
+}
+
+func (bs *BitswapStorageMemory) evict() {
+	// The most recently used block is never evicted
+	for bs.size > bs.maxSize && bs.lru.Len() > 1 {
+		bs.remove(bs.lru.Back())
+	}
+}
+
+func (bs *BitswapStorageMemory) PinBlocks(keys [][32]byte) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	for _, key := range keys {
+		bs.pins[key]++
+		if el, has := bs.blocks[key]; has && bs.pins[key] == 1 {
+			bs.blocks[key] = bs.pinned.PushBack(bs.lru.Remove(el))
+		}
+	}
+}
+
+func (bs *BitswapStorageMemory) UnpinBlocks(keys [][32]byte) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	for _, key := range keys {
+		if bs.pins[key] == 0 {
+			continue
+		}
+		bs.pins[key]--
+		if bs.pins[key] > 0 {
+			continue
+		}
+		delete(bs.pins, key)
+		if el, has := bs.blocks[key]; has {
+			bs.blocks[key] = bs.lru.PushFront(bs.pinned.Remove(el))
+		}
+	}
+	bs.evict()
+}
+
+func (bs *BitswapStorageMemory) ViewBlock(key [32]byte, callback func([]byte) error) error {
+	data, has := bs.lookup(key)
+	if !has {
+		return blockstore.ErrNotFound
+	}
+	return callback(data)
+}
+
+func (bs *BitswapStorageMemory) PutBlocks(blockMap map[[32]byte][]byte) error {
+	blocks_, err := blocksOfMap(blockMap)
+	if err != nil {
+		return err
+	}
+	return bs.PutMany(blocks_)
+}
+
+// GetBlocks returns data of blocks without copying it,
+// stored data is never modified
+func (bs *BitswapStorageMemory) GetBlocks(keys [][32]byte) (map[[32]byte][]byte, error) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	res := make(map[[32]byte][]byte, len(keys))
+	for _, key := range keys {
+		if el, has := bs.blocks[key]; has {
+			bs.lru.MoveToFront(el)
+			res[key] = el.Value.(*memoryBlock).data
+		}
+	}
+	return res, nil
+}
+
+func (bs *BitswapStorageMemory) GetStatus(key [32]byte) (RootBlockStatus, error) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	status, has := bs.statuses[key]
+	if !has {
+		return status, blockstore.ErrNotFound
+	}
+	return status, nil
+}
+
+func (bs *BitswapStorageMemory) SetStatus(key [32]byte, newStatus RootBlockStatus) error {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	prev, exists := bs.statuses[key]
+	if !isStatusTransitionAllowed(exists, prev, newStatus) {
+		return fmt.Errorf("wrong status transition: from %d to %d", prev, newStatus)
+	}
+	bs.statuses[key] = newStatus
+	return nil
+}
+
+// ForceStatus sets status of a root ignoring the allowed status transitions,
+// it's meant to be used only for repairs of the storage
+func (bs *BitswapStorageMemory) ForceStatus(key [32]byte, newStatus RootBlockStatus) error {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	bs.statuses[key] = newStatus
+	return nil
+}
+
+func (bs *BitswapStorageMemory) DeleteStatus(key [32]byte) error {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	prev, exists := bs.statuses[key]
+	if exists && prev != Deleting {
+		return fmt.Errorf("wrong status deletion from %d", prev)
+	}
+	delete(bs.statuses, key)
+	return nil
+}
+
+func (bs *BitswapStorageMemory) DeleteBlocks(keys [][32]byte) error {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	for _, key := range keys {
+		if el, has := bs.blocks[key]; has {
+			bs.remove(el)
+		}
+	}
+	return nil
+}
+
+// Reference counts of evicted blocks are kept, as their roots still
+// reference them
+
+func (bs *BitswapStorageMemory) RefBlocks(keys [][32]byte) error {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	for _, key := range keys {
+		bs.refs[key]++
+	}
+	return nil
+}
+
+func (bs *BitswapStorageMemory) UnrefBlocks(keys [][32]byte) ([][32]byte, error) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	released := [][32]byte{}
+	for _, key := range keys {
+		if bs.refs[key] > 1 {
+			bs.refs[key]--
+			continue
+		}
+		delete(bs.refs, key)
+		released = append(released, key)
+	}
+	return released, nil
+}
+
+func (bs *BitswapStorageMemory) RefCount(key [32]byte) (int, error) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	return bs.refs[key], nil
+}
+
+func (bs *BitswapStorageMemory) UnreferencedBlocks(ctx context.Context) ([][32]byte, int, int, error) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	res := [][32]byte{}
+	unreferenced := 0
+	for key, el := range bs.blocks {
+		if bs.refs[key] == 0 {
+			res = append(res, key)
+			unreferenced += len(el.Value.(*memoryBlock).data)
+		}
+	}
+	return res, unreferenced, bs.size, nil
+}
+
+// DedupStats only counts blocks currently stored, evicted
+// blocks save nothing
+func (bs *BitswapStorageMemory) DedupStats(ctx context.Context) (BitswapDedupStats, error) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	var stats BitswapDedupStats
+	for key, count := range bs.refs {
+		el, has := bs.blocks[key]
+		if count < 2 || !has {
+			continue
+		}
+		stats.SharedBlocks++
+		stats.SavedBytes += (count - 1) * len(el.Value.(*memoryBlock).data)
+	}
+	return stats, nil
+}
+
+// RefCountsInitialized is always true, as the storage starts empty
+func (bs *BitswapStorageMemory) RefCountsInitialized() (bool, error) { return true, nil }
+
+func (bs *BitswapStorageMemory) SetRefCounts(counts map[[32]byte]int) error {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	for key, count := range counts {
+		if count > 0 {
+			bs.refs[key] = count
+		} else {
+			delete(bs.refs, key)
+		}
+	}
+	return nil
+}
+
+// Blockstore interface, used by Bitswap
+
+func (bs *BitswapStorageMemory) DeleteBlock(id cid.Cid) error {
+	if key, ok := CidToBlockHash(id); ok {
+		return bs.DeleteBlocks([][32]byte{key})
+	}
+	return nil
+}
+
+func (bs *BitswapStorageMemory) Has(id cid.Cid) (bool, error) {
+	key, ok := CidToBlockHash(id)
+	if !ok {
+		return false, nil
+	}
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	_, has := bs.blocks[key]
+	return has, nil
+}
+
+func (bs *BitswapStorageMemory) Get(id cid.Cid) (blocks.Block, error) {
+	key, ok := CidToBlockHash(id)
+	if !ok {
+		return nil, blockstore.ErrNotFound
+	}
+	data, has := bs.lookup(key)
+	if !has {
+		return nil, blockstore.ErrNotFound
+	}
+	return blocks.NewBlockWithCid(data, id)
+}
+
+func (bs *BitswapStorageMemory) GetSize(id cid.Cid) (int, error) {
+	key, ok := CidToBlockHash(id)
+	if !ok {
+		return -1, blockstore.ErrNotFound
+	}
+	data, has := bs.lookup(key)
+	if !has {
+		return -1, blockstore.ErrNotFound
+	}
+	return len(data), nil
+}
+
+func (bs *BitswapStorageMemory) Put(block blocks.Block) error {
+	return bs.PutMany([]blocks.Block{block})
+}
+
+func (bs *BitswapStorageMemory) PutMany(blocks_ []blocks.Block) error {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	for _, block := range blocks_ {
+		key, ok := CidToBlockHash(block.Cid())
+		if !ok {
+			return fmt.Errorf("unsupported block cid: %s", block.Cid())
+		}
+		if el, has := bs.blocks[key]; has {
+			// no-op for pinned blocks
+			bs.lru.MoveToFront(el)
+			continue
+		}
+		data := block.RawData()
+		b := &memoryBlock{key: key, data: data}
+		if bs.pins[key] > 0 {
+			bs.blocks[key] = bs.pinned.PushBack(b)
+		} else {
+			bs.blocks[key] = bs.lru.PushFront(b)
+		}
+		bs.size += len(data)
+	}
+	bs.evict()
+	return nil
+}
+
+func (bs *BitswapStorageMemory) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	bs.mutex.Lock()
+	keys := make([]cid.Cid, 0, len(bs.blocks))
+	for key := range bs.blocks {
+		keys = append(keys, BlockHashToCid(key))
+	}
+	bs.mutex.Unlock()
+	ch := make(chan cid.Cid)
+	go func() {
+		defer close(ch)
+		for _, id := range keys {
+			select {
+			case ch <- id:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// HashOnRead is a no-op, blocks are never read from a medium
+// that could corrupt them
+func (bs *BitswapStorageMemory) HashOnRead(bool) {}
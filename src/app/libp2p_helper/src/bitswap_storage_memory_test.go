@@ -0,0 +1,119 @@
+package codanet
+
+import (
+	"context"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+)
+
+func mkMemoryTestBlock(t *testing.T, data []byte) ([32]byte, blocks.Block) {
+	key := blake2b.Sum256(data)
+	block, err := blocks.NewBlockWithCid(data, BlockHashToCid(key))
+	require.NoError(t, err)
+	return key, block
+}
+
+func TestBitswapStorageMemoryEviction(t *testing.T) {
+	bs := NewBitswapStorageMemory(10)
+	k1, b1 := mkMemoryTestBlock(t, []byte("aaaa"))
+	k2, b2 := mkMemoryTestBlock(t, []byte("bbbb"))
+	k3, b3 := mkMemoryTestBlock(t, []byte("cccc"))
+	require.NoError(t, bs.PutMany([]blocks.Block{b1, b2}))
+	// Reading the first block makes the second one the least recently used
+	require.NoError(t, bs.ViewBlock(k1, func([]byte) error { return nil }))
+	require.NoError(t, bs.Put(b3))
+	require.Equal(t, 8, bs.Size())
+
+	require.Equal(t, blockstore.ErrNotFound, bs.ViewBlock(k2, func([]byte) error { return nil }))
+	for _, b := range []blocks.Block{b1, b3} {
+		has, err := bs.Has(b.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+	require.NoError(t, bs.DeleteBlocks([][32]byte{k1, k3}))
+	require.Equal(t, 0, bs.Size())
+}
+
+func TestBitswapStorageMemoryStatuses(t *testing.T) {
+	bs := NewBitswapStorageMemory(10)
+	key := [32]byte{1}
+	_, err := bs.GetStatus(key)
+	require.Equal(t, blockstore.ErrNotFound, err)
+	require.NoError(t, bs.SetStatus(key, Partial))
+	require.NoError(t, bs.SetStatus(key, Full))
+	require.Error(t, bs.SetStatus(key, Partial))
+	require.Error(t, bs.DeleteStatus(key))
+	require.NoError(t, bs.SetStatus(key, Deleting))
+	require.NoError(t, bs.DeleteStatus(key))
+	_, err = bs.GetStatus(key)
+	require.Equal(t, blockstore.ErrNotFound, err)
+}
+
+func TestBitswapStorageMemoryPins(t *testing.T) {
+	bs := NewBitswapStorageMemory(4)
+	k1, b1 := mkMemoryTestBlock(t, []byte("aaaa"))
+	k2, b2 := mkMemoryTestBlock(t, []byte("bbbb"))
+	bs.PinBlocks([][32]byte{k1, k1})
+	require.NoError(t, bs.Put(b1))
+	require.NoError(t, bs.Put(b2))
+	// Pinned block isn't evicted even though the bound is exceeded
+	has, err := bs.Has(b1.Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+
+	bs.UnpinBlocks([][32]byte{k1})
+	has, err = bs.Has(b1.Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+	// Unpinned block becomes the most recently used one
+	bs.UnpinBlocks([][32]byte{k1})
+	require.Equal(t, blockstore.ErrNotFound, bs.ViewBlock(k2, func([]byte) error { return nil }))
+	require.Equal(t, 4, bs.Size())
+}
+
+func TestBitswapStorageMemoryRefCounts(t *testing.T) {
+	bs := NewBitswapStorageMemory(100)
+	k1, b1 := mkMemoryTestBlock(t, []byte("aaaa"))
+	k2, b2 := mkMemoryTestBlock(t, []byte("bbbbbb"))
+	require.NoError(t, bs.PutMany([]blocks.Block{b1, b2}))
+	require.NoError(t, bs.RefBlocks([][32]byte{k1, k2}))
+	require.NoError(t, bs.RefBlocks([][32]byte{k1}))
+
+	unreferenced, unreferencedSize, totalSize, err := bs.UnreferencedBlocks(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, unreferenced)
+	require.Equal(t, 0, unreferencedSize)
+	require.Equal(t, 10, totalSize)
+
+	stats, err := bs.DedupStats(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, BitswapDedupStats{SharedBlocks: 1, SavedBytes: 4}, stats)
+
+	// Shared block stays referenced by the other root
+	released, err := bs.UnrefBlocks([][32]byte{k1, k2})
+	require.NoError(t, err)
+	require.Equal(t, [][32]byte{k2}, released)
+	count, err := bs.RefCount(k1)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	unreferenced, unreferencedSize, _, err = bs.UnreferencedBlocks(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, [][32]byte{k2}, unreferenced)
+	require.Equal(t, 6, unreferencedSize)
+	stats, err = bs.DedupStats(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, BitswapDedupStats{}, stats)
+
+	require.NoError(t, bs.SetRefCounts(map[[32]byte]int{k1: 0, k2: 2}))
+	count, err = bs.RefCount(k2)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	released, err = bs.UnrefBlocks([][32]byte{k1})
+	require.NoError(t, err)
+	require.Equal(t, [][32]byte{k1}, released)
+}
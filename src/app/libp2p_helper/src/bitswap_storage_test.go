@@ -0,0 +1,157 @@
+package codanet
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Number of rounds of reads and writes of testConcurrentReads
+const concurrentTestRounds = 50
+
+// testConcurrentReads reads the blocks from several goroutines, as the
+// downloader does, while another goroutine writes new blocks (unless
+// write is nil), as Bitswap does. Run with -race.
+func testConcurrentReads(t *testing.T, storage BitswapStorage, stored map[[32]byte][]byte, write func(i int) error) {
+	keys := make([][32]byte, 0, len(stored))
+	for key := range stored {
+		keys = append(keys, key)
+	}
+	const readers = 8
+	var wg sync.WaitGroup
+	wg.Add(readers)
+	for w := 0; w < readers; w++ {
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < concurrentTestRounds; i++ {
+				res, err := storage.GetBlocks(keys[w%len(keys):])
+				if err != nil {
+					t.Errorf("GetBlocks: %s", err)
+					return
+				}
+				for key, data := range res {
+					if !bytes.Equal(stored[key], data) {
+						t.Errorf("GetBlocks returned wrong data of block %x", key)
+						return
+					}
+				}
+				key := keys[(w+i)%len(keys)]
+				err = storage.ViewBlock(key, func(data []byte) error {
+					if !bytes.Equal(stored[key], data) {
+						t.Errorf("ViewBlock returned wrong data of block %x", key)
+					}
+					return nil
+				})
+				if err != nil {
+					t.Errorf("ViewBlock: %s", err)
+					return
+				}
+				if _, err := storage.GetStatus(key); err != nil {
+					t.Errorf("GetStatus: %s", err)
+					return
+				}
+			}
+		}(w)
+	}
+	if write != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < concurrentTestRounds; i++ {
+				if err := write(i); err != nil {
+					t.Errorf("write: %s", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// mkConcurrentTestBlocks makes blocks with statuses set in the storage
+func mkConcurrentTestBlocks(t *testing.T, r *rand.Rand, storage BitswapStorage, n int) map[[32]byte][]byte {
+	stored := make(map[[32]byte][]byte, n)
+	for i := 0; i < n; i++ {
+		key, block := mkCompressibleTestBlock(t, r)
+		stored[key] = block.RawData()
+	}
+	require.NoError(t, storage.PutBlocks(stored))
+	for key := range stored {
+		require.NoError(t, storage.SetStatus(key, Full))
+	}
+	return stored
+}
+
+// writeConcurrentTestBlocks returns a writer of new blocks to the storage,
+// a block per round
+func writeConcurrentTestBlocks(t *testing.T, storage BitswapStorage) func(i int) error {
+	r := rand.New(rand.NewSource(1))
+	keys := make([][32]byte, concurrentTestRounds)
+	data := make([][]byte, concurrentTestRounds)
+	for i := range keys {
+		key, block := mkCompressibleTestBlock(t, r)
+		keys[i], data[i] = key, block.RawData()
+	}
+	return func(i int) error {
+		if err := storage.PutBlocks(map[[32]byte][]byte{keys[i]: data[i]}); err != nil {
+			return err
+		}
+		return storage.SetStatus(keys[i], Partial)
+	}
+}
+
+func TestBitswapStorageConcurrentReads(t *testing.T) {
+	t.Run("lmdb", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "mina_test_*")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		storage := openTestStorageLmdb(t, dir)
+		defer storage.Close()
+		stored := mkConcurrentTestBlocks(t, rand.New(rand.NewSource(0)), storage, 32)
+		testConcurrentReads(t, storage, stored, writeConcurrentTestBlocks(t, storage))
+	})
+	t.Run("compressed", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "mina_test_*")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		lmdb := openTestStorageLmdb(t, dir)
+		defer lmdb.Close()
+		storage, err := NewBitswapStorageCompressed(context.Background(), lmdb)
+		require.NoError(t, err)
+		require.NoError(t, storage.SetCodec(BlockCodecZstd))
+		// Cache fitting a few blocks, so that blocks are evicted
+		// from it while read
+		storage.SetCacheSize(4 << 12)
+		stored := mkConcurrentTestBlocks(t, rand.New(rand.NewSource(0)), storage, 32)
+		testConcurrentReads(t, storage, stored, writeConcurrentTestBlocks(t, storage))
+	})
+	t.Run("memory", func(t *testing.T) {
+		storage := NewBitswapStorageMemory(1 << 24)
+		stored := mkConcurrentTestBlocks(t, rand.New(rand.NewSource(0)), storage, 32)
+		testConcurrentReads(t, storage, stored, writeConcurrentTestBlocks(t, storage))
+	})
+	t.Run("archive", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "mina_test_*")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		lmdb := openTestStorageLmdb(t, dir)
+		built, err := NewBitswapStorageCompressed(context.Background(), lmdb)
+		require.NoError(t, err)
+		require.NoError(t, built.SetCodec(BlockCodecZstd))
+		stored := mkConcurrentTestBlocks(t, rand.New(rand.NewSource(0)), built, 32)
+		require.NoError(t, lmdb.Close())
+
+		// Archive is never written to
+		archive, err := OpenBitswapArchive(path.Join(dir, "block-db"), true)
+		require.NoError(t, err)
+		defer archive.Close()
+		testConcurrentReads(t, archive.storage, stored, nil)
+	})
+}
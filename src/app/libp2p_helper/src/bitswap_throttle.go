@@ -0,0 +1,187 @@
+package codanet
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	bitnet "github.com/ipfs/go-bitswap/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// BitswapThrottleLimits are rates of blocks received over Bitswap,
+// globally and from a single peer. Zero rates are not limited.
+type BitswapThrottleLimits struct {
+	BytesPerSec      int
+	BlocksPerSec     int
+	PeerBytesPerSec  int
+	PeerBlocksPerSec int
+}
+
+// tokenBucket holds up to a second worth of tokens. Tokens may be
+// borrowed, so that requests larger than the bucket pass eventually.
+type tokenBucket struct {
+	// tokens per second, zero means no limit
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// setRate changes the rate, a new bucket starts full
+func (b *tokenBucket) setRate(rate float64, now time.Time) {
+	fresh := b.last.IsZero()
+	b.refill(now)
+	b.rate = rate
+	if fresh || b.tokens > rate {
+		b.tokens = rate
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		b.last = now
+	}
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+// take takes n tokens, returning the time to wait until
+// the tokens borrowed are paid back
+func (b *tokenBucket) take(n float64, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type peerBuckets struct {
+	bytes, blocks tokenBucket
+}
+
+// BitswapThrottle limits the rate at which blocks are received over
+// Bitswap. Messages carrying blocks are held back until they fit the
+// limits, which in turn stops reading from the peer's stream, so that
+// the peer's sending is throttled as well. Limits may be adjusted at
+// runtime.
+type BitswapThrottle struct {
+	limits        BitswapThrottleLimits
+	bytes, blocks tokenBucket
+	peers         map[peer.ID]*peerBuckets
+	now           func() time.Time
+	mutex         sync.Mutex
+}
+
+func NewBitswapThrottle() *BitswapThrottle {
+	return &BitswapThrottle{
+		peers: make(map[peer.ID]*peerBuckets),
+		now:   time.Now,
+	}
+}
+
+// Configure replaces the limits, tokens accumulated under
+// the previous limits are kept up to the new ones
+func (t *BitswapThrottle) Configure(limits BitswapThrottleLimits) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := t.now()
+	t.limits = limits
+	t.bytes.setRate(float64(limits.BytesPerSec), now)
+	t.blocks.setRate(float64(limits.BlocksPerSec), now)
+	for _, b := range t.peers {
+		b.bytes.setRate(float64(limits.PeerBytesPerSec), now)
+		b.blocks.setRate(float64(limits.PeerBlocksPerSec), now)
+	}
+}
+
+func (t *BitswapThrottle) Limits() BitswapThrottleLimits {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.limits
+}
+
+// delay takes tokens for blocks of the given total size received
+// from the peer, returning the time to hold them back for
+func (t *BitswapThrottle) delay(p peer.ID, blocks, size int) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := t.now()
+	pb, has := t.peers[p]
+	if !has {
+		pb = &peerBuckets{}
+		pb.bytes.setRate(float64(t.limits.PeerBytesPerSec), now)
+		pb.blocks.setRate(float64(t.limits.PeerBlocksPerSec), now)
+		t.peers[p] = pb
+	}
+	res := t.bytes.take(float64(size), now)
+	for _, d := range []time.Duration{
+		t.blocks.take(float64(blocks), now),
+		pb.bytes.take(float64(size), now),
+		pb.blocks.take(float64(blocks), now),
+	} {
+		if d > res {
+			res = d
+		}
+	}
+	return res
+}
+
+func (t *BitswapThrottle) forgetPeer(p peer.ID) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.peers, p)
+}
+
+// throttledBitswapNetwork passes messages received over the network
+// to Bitswap through the throttle and the serving limiter, senders
+// of blocks are remembered
+type throttledBitswapNetwork struct {
+	bitnet.BitSwapNetwork
+	throttle *BitswapThrottle
+	serving  *BitswapServingLimiter
+	senders  *BitswapSenders
+}
+
+func (n *throttledBitswapNetwork) SetDelegate(r bitnet.Receiver) {
+	n.BitSwapNetwork.SetDelegate(&throttledReceiver{Receiver: r, throttle: n.throttle, serving: n.serving, senders: n.senders})
+}
+
+type throttledReceiver struct {
+	bitnet.Receiver
+	throttle *BitswapThrottle
+	serving  *BitswapServingLimiter
+	senders  *BitswapSenders
+}
+
+func (r *throttledReceiver) ReceiveMessage(ctx context.Context, sender peer.ID, incoming bsmsg.BitSwapMessage) {
+	// Wantlists and presences are not throttled
+	if blks := incoming.Blocks(); len(blks) > 0 {
+		size := 0
+		for _, b := range blks {
+			size += len(b.RawData())
+		}
+		if d := r.throttle.delay(sender, len(blks), size); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+		}
+		r.senders.record(sender, blks)
+	}
+	r.Receiver.ReceiveMessage(ctx, sender, r.serving.filter(sender, incoming))
+}
+
+func (r *throttledReceiver) PeerDisconnected(p peer.ID) {
+	r.throttle.forgetPeer(p)
+	r.serving.forgetPeer(p)
+	r.Receiver.PeerDisconnected(p)
+}
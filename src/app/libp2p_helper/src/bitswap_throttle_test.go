@@ -0,0 +1,53 @@
+package codanet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func mkTestThrottle(limits BitswapThrottleLimits) (*BitswapThrottle, *time.Time) {
+	now := time.Unix(1000, 0)
+	t := NewBitswapThrottle()
+	t.now = func() time.Time { return now }
+	t.Configure(limits)
+	return t, &now
+}
+
+func TestBitswapThrottleUnlimited(t *testing.T) {
+	throttle, _ := mkTestThrottle(BitswapThrottleLimits{})
+	require.Zero(t, throttle.delay(peer.ID("a"), 1000, 1<<30))
+}
+
+func TestBitswapThrottleBytes(t *testing.T) {
+	throttle, now := mkTestThrottle(BitswapThrottleLimits{BytesPerSec: 1000})
+	// Bucket starts full
+	require.Zero(t, throttle.delay(peer.ID("a"), 1, 1000))
+	require.Equal(t, 500*time.Millisecond, throttle.delay(peer.ID("b"), 1, 500))
+	// Borrowed tokens are paid back first
+	*now = now.Add(time.Second)
+	require.Equal(t, time.Second, throttle.delay(peer.ID("a"), 1, 1500))
+	// Bucket holds at most a second worth of tokens
+	*now = now.Add(time.Hour)
+	require.Equal(t, time.Second, throttle.delay(peer.ID("a"), 1, 2000))
+}
+
+func TestBitswapThrottlePeers(t *testing.T) {
+	throttle, now := mkTestThrottle(BitswapThrottleLimits{BlocksPerSec: 100, PeerBlocksPerSec: 10})
+	require.Zero(t, throttle.delay(peer.ID("a"), 10, 0))
+	require.Equal(t, time.Second, throttle.delay(peer.ID("a"), 10, 0))
+	// Other peers are only limited by the global rate
+	require.Zero(t, throttle.delay(peer.ID("b"), 10, 0))
+
+	// Peer starts anew after it disconnected
+	throttle.forgetPeer(peer.ID("a"))
+	require.Zero(t, throttle.delay(peer.ID("a"), 10, 0))
+
+	// Lowered limits apply to known peers
+	*now = now.Add(time.Second)
+	throttle.Configure(BitswapThrottleLimits{PeerBlocksPerSec: 5})
+	require.Equal(t, time.Second, throttle.delay(peer.ID("b"), 10, 0))
+	require.Equal(t, BitswapThrottleLimits{PeerBlocksPerSec: 5}, throttle.Limits())
+}
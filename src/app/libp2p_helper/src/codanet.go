@@ -11,15 +11,19 @@ import (
 	gonet "net"
 	"path"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	lmdbbs "github.com/georgeee/go-bs-lmdb"
 	"github.com/ipfs/go-bitswap"
 	bitnet "github.com/ipfs/go-bitswap/network"
+	"github.com/ipfs/go-datastore"
 	dsb "github.com/ipfs/go-ds-badger"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	logging "github.com/ipfs/go-log/v2"
 	p2p "github.com/libp2p/go-libp2p"
 
+	circuit "github.com/libp2p/go-libp2p-circuit"
 	p2pconnmgr "github.com/libp2p/go-libp2p-connmgr"
 	"github.com/libp2p/go-libp2p-core/connmgr"
 	"github.com/libp2p/go-libp2p-core/control"
@@ -49,6 +53,10 @@ import (
 
 const NodeStatusTimeout = 10 * time.Second
 
+// DefaultAgentVersion is advertised in identify unless the daemon
+// configured an agent version
+const DefaultAgentVersion = "github.com/codaprotocol/coda/tree/master/src/app/libp2p_helper"
+
 func parseCIDR(cidr string) gonet.IPNet {
 	_, ipnet, err := gonet.ParseCIDR(cidr)
 	if err != nil {
@@ -101,6 +109,14 @@ type CodaConnectionManager struct {
 	ctx        context.Context
 	host       host.Host
 	p2pManager *p2pconnmgr.BasicConnMgr
+	// guards replacement of p2pManager by SetLimits
+	p2pManagerLock sync.RWMutex
+	// set by SetLimits, zero for the default of p2pconnmgr
+	silencePeriod time.Duration
+	// decaying tags registered by users of the manager,
+	// registered anew with managers replacing p2pManager
+	decayingTags     []*decayingTagProxy
+	decayingTagsLock sync.Mutex
 	// minaPeerExchange controls whether to send random peers to the other ndoe before trimming its
 	// recently opened connection
 	minaPeerExchange bool
@@ -127,20 +143,20 @@ func newCodaConnectionManager(minConnections, maxConnections int, minaPeerExchan
 
 // proxy connmgr.ConnManager interface to p2pconnmgr.BasicConnMgr
 func (cm *CodaConnectionManager) TagPeer(p peer.ID, tag string, weight int) {
-	cm.p2pManager.TagPeer(p, tag, weight)
+	cm.manager().TagPeer(p, tag, weight)
 }
-func (cm *CodaConnectionManager) UntagPeer(p peer.ID, tag string) { cm.p2pManager.UntagPeer(p, tag) }
+func (cm *CodaConnectionManager) UntagPeer(p peer.ID, tag string) { cm.manager().UntagPeer(p, tag) }
 func (cm *CodaConnectionManager) UpsertTag(p peer.ID, tag string, upsert func(int) int) {
-	cm.p2pManager.UpsertTag(p, tag, upsert)
+	cm.manager().UpsertTag(p, tag, upsert)
 }
 func (cm *CodaConnectionManager) GetTagInfo(p peer.ID) *connmgr.TagInfo {
-	return cm.p2pManager.GetTagInfo(p)
+	return cm.manager().GetTagInfo(p)
 }
-func (cm *CodaConnectionManager) TrimOpenConns(ctx context.Context) { cm.p2pManager.TrimOpenConns(ctx) }
+func (cm *CodaConnectionManager) TrimOpenConns(ctx context.Context) { cm.manager().TrimOpenConns(ctx) }
 func (cm *CodaConnectionManager) Protect(p peer.ID, tag string) {
-	cm.p2pManager.Protect(p, tag)
 	cm.protectedMirrorLock.Lock()
 	defer cm.protectedMirrorLock.Unlock()
+	cm.manager().Protect(p, tag)
 	pm := cm.protectedMirror
 	pm_, has := pm[p]
 	if !has {
@@ -150,9 +166,9 @@ func (cm *CodaConnectionManager) Protect(p peer.ID, tag string) {
 	pm_[tag] = nil
 }
 func (cm *CodaConnectionManager) Unprotect(p peer.ID, tag string) bool {
-	res := cm.p2pManager.Unprotect(p, tag)
 	cm.protectedMirrorLock.Lock()
 	defer cm.protectedMirrorLock.Unlock()
+	res := cm.manager().Unprotect(p, tag)
 	pm := cm.protectedMirror
 	pm_, has := pm[p]
 	if has {
@@ -166,16 +182,22 @@ func (cm *CodaConnectionManager) ViewProtected(f func(map[peer.ID]map[string]int
 	f(cm.protectedMirror)
 }
 func (cm *CodaConnectionManager) IsProtected(p peer.ID, tag string) bool {
-	return cm.p2pManager.IsProtected(p, tag)
+	return cm.manager().IsProtected(p, tag)
 }
-func (cm *CodaConnectionManager) Close() error { return cm.p2pManager.Close() }
+func (cm *CodaConnectionManager) Close() error { return cm.manager().Close() }
 
-// proxy connmgr.Decayer interface to p2pconnmgr.BasicConnMgr (which implements connmgr.Decayer via struct inheritance)
+// proxy connmgr.Decayer interface to p2pconnmgr.BasicConnMgr (which implements connmgr.Decayer via struct inheritance),
+// the tag is a proxy carried over to managers replacing it (see SetLimits)
 func (cm *CodaConnectionManager) RegisterDecayingTag(name string, interval time.Duration, decayFn connmgr.DecayFn, bumpFn connmgr.BumpFn) (connmgr.DecayingTag, error) {
-	// casting to Decayer here should always succeed
-	decayer, _ := interface{}(cm.p2pManager).(connmgr.Decayer)
-	tag, err := decayer.RegisterDecayingTag(name, interval, decayFn, bumpFn)
-	return tag, err
+	cm.decayingTagsLock.Lock()
+	defer cm.decayingTagsLock.Unlock()
+	tag, err := registerDecayingTag(cm.manager(), name, interval, decayFn, bumpFn)
+	if err != nil {
+		return nil, err
+	}
+	proxy := &decayingTagProxy{cm: cm, name: name, interval: interval, decayFn: decayFn, bumpFn: bumpFn, tag: tag}
+	cm.decayingTags = append(cm.decayingTags, proxy)
+	return proxy, nil
 }
 
 // redirect Notifee() to self for notification interception
@@ -183,21 +205,21 @@ func (cm *CodaConnectionManager) Notifee() network.Notifiee { return cm }
 
 // proxy Notifee notifications to p2pconnmgr.BasicConnMgr, intercepting Connected and Disconnected
 func (cm *CodaConnectionManager) Listen(net network.Network, addr ma.Multiaddr) {
-	cm.p2pManager.Notifee().Listen(net, addr)
+	cm.manager().Notifee().Listen(net, addr)
 }
 func (cm *CodaConnectionManager) ListenClose(net network.Network, addr ma.Multiaddr) {
-	cm.p2pManager.Notifee().ListenClose(net, addr)
+	cm.manager().Notifee().ListenClose(net, addr)
 }
 func (cm *CodaConnectionManager) OpenedStream(net network.Network, stream network.Stream) {
-	cm.p2pManager.Notifee().OpenedStream(net, stream)
+	cm.manager().Notifee().OpenedStream(net, stream)
 }
 func (cm *CodaConnectionManager) ClosedStream(net network.Network, stream network.Stream) {
-	cm.p2pManager.Notifee().ClosedStream(net, stream)
+	cm.manager().Notifee().ClosedStream(net, stream)
 }
 func (cm *CodaConnectionManager) Connected(net network.Network, c network.Conn) {
 	logger.Debugf("%s connected to %s", c.LocalPeer(), c.RemotePeer())
 	cm.OnConnect(net, c)
-	cm.p2pManager.Notifee().Connected(net, c)
+	cm.manager().Notifee().Connected(net, c)
 
 	info := cm.GetInfo()
 	if len(net.Peers()) <= info.HighWater {
@@ -253,12 +275,12 @@ func (cm *CodaConnectionManager) Connected(net network.Network, c network.Conn)
 
 func (cm *CodaConnectionManager) Disconnected(net network.Network, c network.Conn) {
 	cm.OnDisconnect(net, c)
-	cm.p2pManager.Notifee().Disconnected(net, c)
+	cm.manager().Notifee().Disconnected(net, c)
 }
 
 // proxy remaining p2pconnmgr.BasicConnMgr methods for access
 func (cm *CodaConnectionManager) GetInfo() p2pconnmgr.CMInfo {
-	return cm.p2pManager.GetInfo()
+	return cm.manager().GetInfo()
 }
 
 // Helper contains all the daemon state
@@ -266,6 +288,12 @@ type Helper struct {
 	Host              host.Host
 	Bitswap           *bitswap.Bitswap
 	BitswapStorage    BitswapStorage
+	BitswapThrottle   *BitswapThrottle
+	BitswapServing    *BitswapServingLimiter
+	BitswapSenders    *BitswapSenders
+	BitswapProtocols  []protocol.ID
+	ProviderHints     *ProviderHints
+	Blockstore        *ArchivedBlockstore
 	Mdns              *mdns.Service
 	Dht               *dual.DHT
 	Ctx               context.Context
@@ -276,11 +304,74 @@ type Helper struct {
 	Me                peer.ID
 	gatingState       *CodaGatingState
 	ConnectionManager *CodaConnectionManager
+	ConnFailures      *ConnectionFailures
 	BandwidthCounter  *metrics.BandwidthCounter
 	MsgStats          *MessageStats
 	Seeds             []peer.AddrInfo
 	NodeStatus        []byte
 	pxDiscoveries     chan peer.AddrInfo
+	announce          *announceState
+	peerExchange      *peerExchangeLimiter
+	// peerstore datastore, also keeps reputation of peers
+	datastore datastore.Batching
+}
+
+type announceState struct {
+	config *AnnounceConfig
+	// external address of the node, announced regardless of the config
+	external ma.Multiaddr
+	verifier *addrVerifier
+	mutex    sync.RWMutex
+}
+
+// withExternal returns the config extended with the external address
+func (s *announceState) withExternal(c *AnnounceConfig) *AnnounceConfig {
+	if s.external == nil || ma.Contains(c.Announce, s.external) {
+		return c
+	}
+	res := *c
+	res.Announce = append([]ma.Multiaddr{s.external}, c.Announce...)
+	return &res
+}
+
+func (s *announceState) apply(addrs []ma.Multiaddr) []ma.Multiaddr {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	res := s.config.Apply(addrs)
+	if s.config.VerifyDialBack {
+		res = s.verifier.filter(res, time.Now())
+	}
+	return res
+}
+
+// AnnounceConfig controls which addresses of the node are advertised
+// in identify and DHT records
+type AnnounceConfig struct {
+	// Announce addresses are always advertised
+	Announce []ma.Multiaddr
+	// NoAnnounce filters out addresses that are never advertised
+	// (unless also present in Announce)
+	NoAnnounce *ma.Filters
+	// VerifyDialBack makes public addresses (including Announce ones)
+	// advertised only after a connected peer managed to dial back on them
+	VerifyDialBack bool
+}
+
+// Apply returns the list of addresses to advertise given addresses the
+// node listens on
+func (c *AnnounceConfig) Apply(addrs []ma.Multiaddr) []ma.Multiaddr {
+	res := make([]ma.Multiaddr, 0, len(addrs)+len(c.Announce))
+	for _, addr := range addrs {
+		if c.NoAnnounce == nil || !c.NoAnnounce.AddrBlocked(addr) {
+			res = append(res, addr)
+		}
+	}
+	for _, addr := range c.Announce {
+		if !ma.Contains(res, addr) {
+			res = append(res, addr)
+		}
+	}
+	return res
 }
 
 type MessageStats struct {
@@ -341,6 +432,17 @@ type CodaGatingState struct {
 	TrustedAddrFilters      *ma.Filters
 	BannedPeers             *peer.Set
 	TrustedPeers            *peer.Set
+	// peers banned by the helper itself (see Helper.BanPeer), kept
+	// when the daemon replaces the gating config
+	penalizedPeers *peer.Set
+	// non-zero while inbound connections from untrusted
+	// addresses are refused, accessed atomically
+	rejectInbound int32
+	// connections per subnet and their caps, counts are
+	// kept when the daemon replaces the gating config
+	subnetConns *subnetConns
+	// bans with expiry, kept when the daemon replaces the gating config
+	temporaryBans *temporaryBans
 }
 
 // NewCodaGatingState returns a new CodaGatingState
@@ -374,9 +476,38 @@ func NewCodaGatingState(bannedAddrFilters *ma.Filters, trustedAddrFilters *ma.Fi
 		KnownPrivateAddrFilters: knownPrivateAddrFilters,
 		BannedPeers:             bannedPeers,
 		TrustedPeers:            trustedPeers,
+		penalizedPeers:          peer.NewSet(),
+		subnetConns:             newSubnetConns(),
+		temporaryBans:           newTemporaryBans(),
 	}
 }
 
+// SetAnnounceConfig replaces the address announcement configuration,
+// new addresses are pushed to connected peers with the next identify push.
+// The external address of the node is announced in addition to ones of c.
+func (h *Helper) SetAnnounceConfig(c *AnnounceConfig) {
+	c = h.announce.withExternal(c)
+	h.announce.mutex.Lock()
+	defer h.announce.mutex.Unlock()
+	h.announce.config = c
+}
+
+// BanPeer bans a peer misbehaving at the protocol level (e.g. sending
+// malformed blocks) and closes connections to it. Such bans are kept
+// until the helper restarts and restored as temporary bans after it
+// (see RestoreReputation), trusted peers aren't banned.
+func (h *Helper) BanPeer(p peer.ID) {
+	if h.gatingState.isPeerTrusted(p) {
+		return
+	}
+	h.gatingState.penalizedPeers.Add(p)
+	go func() {
+		if err := h.Host.Network().ClosePeer(p); err != nil {
+			h.gatingState.logger.Infof("failed to close banned peer %v: %v", p, err)
+		}
+	}()
+}
+
 func (h *Helper) GatingState() *CodaGatingState {
 	return h.gatingState
 }
@@ -387,6 +518,7 @@ func (h *Helper) SetGatingState(gs *CodaGatingState) {
 	h.gatingState.TrustedAddrFilters = gs.TrustedAddrFilters
 	h.gatingState.BannedAddrFilters = gs.BannedAddrFilters
 	h.gatingState.KnownPrivateAddrFilters = gs.KnownPrivateAddrFilters
+	h.gatingState.SetSubnetCaps(gs.SubnetCaps())
 	for _, c := range h.Host.Network().Conns() {
 		pid := c.RemotePeer()
 		maddr := c.RemoteMultiaddr()
@@ -418,12 +550,26 @@ func (gs *CodaGatingState) MarkPrivateAddrAsKnown(addr ma.Multiaddr) {
 	}
 }
 
+// SetRejectInbound toggles refusal of new inbound connections from
+// addresses that are not trusted, existing connections are kept
+func (gs *CodaGatingState) SetRejectInbound(reject bool) {
+	var v int32
+	if reject {
+		v = 1
+	}
+	atomic.StoreInt32(&gs.rejectInbound, v)
+}
+
+func (gs *CodaGatingState) isRejectingInbound() bool {
+	return atomic.LoadInt32(&gs.rejectInbound) != 0
+}
+
 func (gs *CodaGatingState) isPeerTrusted(p peer.ID) bool {
 	return gs.TrustedPeers.Contains(p)
 }
 
 func (gs *CodaGatingState) isPeerBanned(p peer.ID) bool {
-	return gs.BannedPeers.Contains(p)
+	return gs.BannedPeers.Contains(p) || gs.penalizedPeers.Contains(p) || gs.temporaryBans.isPeerBanned(p)
 }
 
 // checks if a peer id is allowed to dial/accept
@@ -431,12 +577,18 @@ func (gs *CodaGatingState) isAllowedPeer(p peer.ID) bool {
 	return gs.isPeerTrusted(p) || !gs.isPeerBanned(p)
 }
 
+// IsPeerAllowed tells whether the peer may be dialed, unlike
+// InterceptPeerDial disallowed peers aren't logged
+func (gs *CodaGatingState) IsPeerAllowed(p peer.ID) bool {
+	return gs.isAllowedPeer(p)
+}
+
 func (gs *CodaGatingState) isAddrTrusted(addr ma.Multiaddr) bool {
 	return !gs.TrustedAddrFilters.AddrBlocked(addr)
 }
 
 func (gs *CodaGatingState) isAddrBanned(addr ma.Multiaddr) bool {
-	return gs.BannedAddrFilters.AddrBlocked(addr)
+	return gs.BannedAddrFilters.AddrBlocked(addr) || gs.temporaryBans.isAddrBanned(addr)
 }
 
 // checks if an address is allowed to dial/accept
@@ -479,6 +631,8 @@ func (gs *CodaGatingState) InterceptAddrDial(id peer.ID, addr ma.Multiaddr) (all
 	if !allow {
 		gs.logger.Infof("disallowing peer dial to: %v + %v (peer + address)", id, addr)
 		gs.logGate()
+	} else {
+		allow = gs.isWithinSubnetCaps(id, addr)
 	}
 
 	return
@@ -495,6 +649,11 @@ func (gs *CodaGatingState) InterceptAccept(addrs network.ConnMultiaddrs) (allow
 	if !allow {
 		gs.logger.Infof("refusing to accept inbound connection from addr: %v", remoteAddr)
 		gs.logGate()
+	} else if gs.isRejectingInbound() && !gs.isAddrTrusted(remoteAddr) {
+		allow = false
+		gs.logger.Debugf("refusing to accept inbound connection from addr: %v (inbound connections are paused)", remoteAddr)
+	} else {
+		allow = gs.isWithinSubnetCaps("", remoteAddr)
 	}
 
 	// If we are receiving a connection, and the remote address is private,
@@ -615,6 +774,8 @@ func (h *Helper) handlePxStreams(s network.Stream) {
 	}
 
 	for _, p := range peers {
+		// Addresses sent by the peer are replaced by signed ones if known
+		p = certifiedAddrs(h.Host.Peerstore(), p)
 		select {
 		case h.pxDiscoveries <- p:
 		default:
@@ -658,6 +819,7 @@ func (h Helper) pxConnectionWorker() {
 		if connInfo.ConnCount < connInfo.LowWater {
 			err := h.Host.Connect(h.Ctx, peer)
 			if err != nil {
+				h.ConnFailures.Record(peer.ID)
 				logger.Debugf("failed to connect to peer %v err=%s", peer, err)
 			} else {
 				logger.Debugf("connected to peer! %v", peer)
@@ -669,12 +831,32 @@ func (h Helper) pxConnectionWorker() {
 	}
 }
 
+// HelperOptions are the optional settings of MakeHelper,
+// the zero value keeps the defaults
+type HelperOptions struct {
+	// circuit relay is enabled for dialing and being dialed through relays
+	EnableRelay bool
+	// the node only relays connections and serves the DHT,
+	// gossip and Bitswap are disabled
+	RelayOnly bool
+	// Bitswap blocks are kept in memory up to that many bytes
+	// if positive, otherwise they're stored on disk
+	EphemeralBlockstoreSize int
+	BitswapEngine           BitswapEngineConfig
+	BitswapProtocol         BitswapProtocolConfig
+	// identify agent version, DefaultAgentVersion if empty
+	AgentVersion string
+}
+
 // MakeHelper does all the initialization to run one host
-func MakeHelper(ctx context.Context, listenOn []ma.Multiaddr, externalAddr ma.Multiaddr, statedir string, pk crypto.PrivKey, networkID string, seeds []peer.AddrInfo, gatingState *CodaGatingState, minConnections, maxConnections int, minaPeerExchange bool, grace time.Duration) (*Helper, error) {
+func MakeHelper(ctx context.Context, listenOn []ma.Multiaddr, externalAddr ma.Multiaddr, statedir string, pk crypto.PrivKey, networkID string, seeds []peer.AddrInfo, gatingState *CodaGatingState, minConnections, maxConnections int, minaPeerExchange bool, grace time.Duration, options HelperOptions) (*Helper, error) {
 	me, err := peer.IDFromPrivateKey(pk)
 	if err != nil {
 		return nil, err
 	}
+	if options.AgentVersion == "" {
+		options.AgentVersion = DefaultAgentVersion
+	}
 
 	initPrivateIpFilter()
 
@@ -708,23 +890,34 @@ func MakeHelper(ctx context.Context, listenOn []ma.Multiaddr, externalAddr ma.Mu
 	mplex.MaxMessageSize = 1 << 30
 
 	connManager := newCodaConnectionManager(minConnections, maxConnections, minaPeerExchange, grace)
+	connFailures := NewConnectionFailures()
 	bandwidthCounter := metrics.NewBandwidthCounter()
 
+	// Relay transport is needed to dial peers through relays, hole punching
+	// upgrades such relayed connections to direct ones
+	relayOption := p2p.DisableRelay()
+	if options.EnableRelay {
+		relayOption = p2p.ChainOptions(p2p.EnableRelay(), p2p.EnableHolePunching())
+	}
+	// Relay-only nodes relay connections of other peers
+	// and tell them whether they're reachable
+	if options.RelayOnly {
+		relayOption = p2p.ChainOptions(p2p.EnableRelay(circuit.OptHop), p2p.EnableNATService())
+	}
+
+	// External address is always announced, see SetAnnounceConfig
+	announce := &announceState{external: externalAddr, verifier: newAddrVerifier(ctx, pnetKey[:])}
+	announce.config = announce.withExternal(&AnnounceConfig{})
+
 	host, err := p2p.New(ctx,
 		p2p.Muxer("/coda/mplex/1.0.0", libp2pmplex.DefaultTransport),
 		p2p.Identity(pk),
 		p2p.Peerstore(ps),
-		p2p.DisableRelay(),
+		relayOption,
 		p2p.ConnectionGater(gatingState),
 		p2p.ConnectionManager(connManager),
 		p2p.ListenAddrs(listenOn...),
-		p2p.AddrsFactory(func(as []ma.Multiaddr) []ma.Multiaddr {
-			if externalAddr != nil {
-				as = append(as, externalAddr)
-			}
-
-			return as
-		}),
+		p2p.AddrsFactory(announce.apply),
 		p2p.NATPortMap(),
 		p2p.Routing(
 			p2pconfig.RoutingC(func(host host.Host) (routing.PeerRouting, error) {
@@ -732,15 +925,21 @@ func MakeHelper(ctx context.Context, listenOn []ma.Multiaddr, externalAddr ma.Mu
 					return nil, nil
 				}
 
-				kad, err = dual.New(ctx, host,
+				opts := []dual.Option{
 					dual.WanDHTOption(dht.Datastore(dsDht)),
 					dual.DHTOption(dht.Validator(rv)),
 					dual.DHTOption(dht.BootstrapPeers(seeds...)),
 					dual.DHTOption(dht.ProtocolPrefix("/coda")),
-				)
+				}
+				// Relay-only nodes serve the DHT regardless
+				// of their reachability detected by AutoNAT
+				if options.RelayOnly {
+					opts = append(opts, dual.DHTOption(dht.Mode(dht.ModeServer)))
+				}
+				kad, err = dual.New(ctx, host, opts...)
 				return kad, err
 			})),
-		p2p.UserAgent("github.com/codaprotocol/coda/tree/master/src/app/libp2p_helper"),
+		p2p.UserAgent(options.AgentVersion),
 		p2p.PrivateNetwork(pnetKey[:]),
 		p2p.BandwidthReporter(bandwidthCounter),
 	)
@@ -749,26 +948,81 @@ func MakeHelper(ctx context.Context, listenOn []ma.Multiaddr, externalAddr ma.Mu
 		return nil, err
 	}
 
-	// 256MiB, a large enough mmap size to make mmap grow() a rare event
-	opt := lmdbbs.Options{
-		Path:            path.Join(statedir, "block-db"),
-		InitialMmapSize: 256 << 20,
-		CidToKeyMapper:  cidToKeyMapper,
-		KeyToCidMapper:  keyToCidMapper,
-	}
-	bstore, err := lmdbbs.Open(&opt)
-	if err != nil {
-		return nil, err
-	}
+	// Connections are counted per subnet for their caps
+	host.Network().Notify(gatingState.subnetConns)
+	// Failed dials are forgotten once the peer is connected to
+	host.Network().Notify(connFailures)
+	go gatingState.temporaryBans.sweepPeriodically(ctx)
+
+	// Blocks are received through the throttle and served through
+	// the serving limiter, no limits are set until configured
+	throttle := NewBitswapThrottle()
+	serving := NewBitswapServingLimiter()
+	senders := NewBitswapSenders()
+	// Relay-only nodes neither store nor exchange blocks, hence
+	// the blockstore isn't opened and Bitswap isn't started
+	var bs *bitswap.Bitswap
+	var bitswapStorage BitswapStorage
+	var providerHints *ProviderHints
+	var archived *ArchivedBlockstore
+	if !options.RelayOnly {
+		// Ephemeral blockstore is kept in memory and bounded by
+		// EphemeralBlockstoreSize bytes, otherwise LMDB storage is used
+		var bstore blockstore.Blockstore
+		if options.EphemeralBlockstoreSize > 0 {
+			mem := NewBitswapStorageMemory(options.EphemeralBlockstoreSize)
+			bstore, bitswapStorage = mem, mem
+		} else {
+			opt := BitswapStorageOptions(statedir)
+			lmdb, err := lmdbbs.Open(&opt)
+			if err != nil {
+				return nil, err
+			}
+			if err := (*BitswapStorageLmdb)(lmdb).InitRefCounts(ctx); err != nil {
+				return nil, err
+			}
+			compressed, err := NewBitswapStorageCompressed(ctx, (*BitswapStorageLmdb)(lmdb))
+			if err != nil {
+				return nil, err
+			}
+			bstore, bitswapStorage = compressed, compressed
+		}
 
-	bitswapNetwork := bitnet.NewFromIpfsHost(host, kad, bitnet.Prefix(BitSwapExchange))
-	bs := bitswap.New(context.Background(), bitswapNetwork, bstore).(*bitswap.Bitswap)
+		// Providers of blocks are rotated to spread the catch-up load,
+		// peers hinted by the daemon are found ahead of them
+		var contentRouting routing.ContentRouting = kad
+		if kad != nil {
+			contentRouting = newProviderRotation(kad, host.Peerstore())
+		}
+		providerHints = NewProviderHints(contentRouting)
+		// go-bitswap speaks protocols prefixed with BitSwapExchange,
+		// they're negotiated as dedicated ones if configured
+		bitswapHost, err := newBitswapProtocolHost(host, options.BitswapProtocol)
+		if err != nil {
+			return nil, err
+		}
+		bitswapNetwork := &throttledBitswapNetwork{
+			BitSwapNetwork: bitnet.NewFromIpfsHost(bitswapHost, providerHints, bitnet.Prefix(BitSwapExchange)),
+			throttle:       throttle,
+			serving:        serving,
+			senders:        senders,
+		}
+		// Archives of historical blocks are mounted to the blockstore at runtime
+		archived = NewArchivedBlockstore(bstore)
+		bs = bitswap.New(context.Background(), bitswapNetwork, archived, options.BitswapEngine.options()...).(*bitswap.Bitswap)
+	}
 
 	// nil fields are initialized by beginAdvertising
 	h := &Helper{
 		Host:              host,
 		Bitswap:           bs,
-		BitswapStorage:    (*BitswapStorageLmdb)(bstore),
+		BitswapStorage:    bitswapStorage,
+		BitswapThrottle:   throttle,
+		BitswapServing:    serving,
+		BitswapSenders:    senders,
+		BitswapProtocols:  options.BitswapProtocol.Protocols(),
+		ProviderHints:     providerHints,
+		Blockstore:        archived,
 		Ctx:               ctx,
 		Mdns:              nil,
 		Dht:               kad,
@@ -779,12 +1033,22 @@ func MakeHelper(ctx context.Context, listenOn []ma.Multiaddr, externalAddr ma.Mu
 		Me:                me,
 		gatingState:       gatingState,
 		ConnectionManager: connManager,
+		ConnFailures:      connFailures,
 		BandwidthCounter:  bandwidthCounter,
 		MsgStats:          &MessageStats{min: math.MaxUint64},
 		Seeds:             seeds,
 		pxDiscoveries:     nil,
+		announce:          announce,
+		peerExchange:      newPeerExchangeLimiter(),
+		datastore:         ds,
 	}
 
+	// Dial-backs are performed for other peers regardless
+	// of whether own addresses are verified
+	announce.verifier.host = host
+	host.SetStreamHandler(DialBackProtocolID, announce.verifier.handleStream)
+	go announce.verifier.run()
+
 	if !minaPeerExchange {
 		return h, nil
 	}
@@ -798,6 +1062,7 @@ func MakeHelper(ctx context.Context, listenOn []ma.Multiaddr, externalAddr ma.Mu
 	connManager.ctx = ctx
 	connManager.host = host
 	h.Host.SetStreamHandler(pxProtocolID, h.handlePxStreams)
+	h.Host.SetStreamHandler(PeerExchangeProtocolID, h.handlePeerExchangeStreams)
 	h.Host.SetStreamHandler(NodeStatusProtocolID, h.handleNodeStatusStreams)
 	return h, nil
 }
@@ -39,6 +39,46 @@ func TestTrustedPrivateConnectionGating(t *testing.T) {
 	require.True(t, allowed)
 }
 
+func TestPenalizedPeerGating(t *testing.T) {
+	gs := NewCodaGatingState(nil, nil, nil, nil)
+	p := peer.ID("testid")
+	require.True(t, gs.InterceptPeerDial(p))
+	gs.penalizedPeers.Add(p)
+	require.False(t, gs.InterceptPeerDial(p))
+	gs.TrustedPeers.Add(p)
+	require.True(t, gs.InterceptPeerDial(p))
+}
+
+type testConnMultiaddrs struct {
+	local, remote ma.Multiaddr
+}
+
+func (c testConnMultiaddrs) LocalMultiaddr() ma.Multiaddr  { return c.local }
+func (c testConnMultiaddrs) RemoteMultiaddr() ma.Multiaddr { return c.remote }
+
+func TestRejectInbound(t *testing.T) {
+	initPrivateIpFilter()
+
+	_, totalIpNet, err := gonet.ParseCIDR("0.0.0.0/0")
+	require.NoError(t, err)
+	trustedAddrFilters := ma.NewFilters()
+	trustedAddrFilters.AddFilter(*totalIpNet, ma.ActionDeny)
+
+	gs := NewCodaGatingState(nil, trustedAddrFilters, nil, nil)
+
+	local, err := ma.NewMultiaddr("/ip4/5.6.7.8/tcp/8302")
+	require.NoError(t, err)
+	remote, err := ma.NewMultiaddr("/ip4/1.2.3.4/tcp/8302")
+	require.NoError(t, err)
+	addrs := testConnMultiaddrs{local: local, remote: remote}
+
+	require.True(t, gs.InterceptAccept(addrs))
+	gs.SetRejectInbound(true)
+	require.False(t, gs.InterceptAccept(addrs))
+	gs.SetRejectInbound(false)
+	require.True(t, gs.InterceptAccept(addrs))
+}
+
 /*
 func TestAcceptedPrivateConnectionGating(t *testing.T) {
   initPrivateIpFilter()
@@ -62,3 +102,48 @@ func TestAcceptedPrivateConnectionGating(t *testing.T) {
 	require.True(t, allowed)
 }
 */
+
+func TestAnnounceConfig(t *testing.T) {
+	_, rfc1918, err := gonet.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	noAnnounce := ma.NewFilters()
+	noAnnounce.AddFilter(*rfc1918, ma.ActionDeny)
+
+	private, err := ma.NewMultiaddr("/ip4/10.0.0.1/tcp/8302")
+	require.NoError(t, err)
+	public, err := ma.NewMultiaddr("/ip4/1.2.3.4/tcp/8302")
+	require.NoError(t, err)
+	static, err := ma.NewMultiaddr("/ip4/5.6.7.8/tcp/8302")
+	require.NoError(t, err)
+
+	c := &AnnounceConfig{Announce: []ma.Multiaddr{static}, NoAnnounce: noAnnounce}
+	require.Equal(t, []ma.Multiaddr{public, static}, c.Apply([]ma.Multiaddr{private, public}))
+	// announced address isn't duplicated
+	require.Equal(t, []ma.Multiaddr{static}, c.Apply([]ma.Multiaddr{static}))
+	// empty config advertises all addresses
+	require.Equal(t, []ma.Multiaddr{private, public}, (&AnnounceConfig{}).Apply([]ma.Multiaddr{private, public}))
+}
+
+func TestSetAnnounceConfigKeepsExternalAddr(t *testing.T) {
+	external, err := ma.NewMultiaddr("/ip4/1.2.3.4/tcp/8302")
+	require.NoError(t, err)
+	static, err := ma.NewMultiaddr("/ip4/5.6.7.8/tcp/8302")
+	require.NoError(t, err)
+	listening, err := ma.NewMultiaddr("/ip4/9.9.9.9/tcp/8302")
+	require.NoError(t, err)
+
+	announce := &announceState{external: external}
+	announce.config = announce.withExternal(&AnnounceConfig{})
+	h := &Helper{announce: announce}
+	require.Equal(t, []ma.Multiaddr{listening, external}, announce.apply([]ma.Multiaddr{listening}))
+
+	// runtime config doesn't drop the external address
+	noAnnounce := ma.NewFilters()
+	noAnnounce.AddFilter(gonet.IPNet{IP: gonet.ParseIP("9.9.9.9"), Mask: gonet.CIDRMask(32, 32)}, ma.ActionDeny)
+	h.SetAnnounceConfig(&AnnounceConfig{Announce: []ma.Multiaddr{static}, NoAnnounce: noAnnounce})
+	require.Equal(t, []ma.Multiaddr{external, static}, announce.apply([]ma.Multiaddr{listening}))
+
+	// nor duplicates it when announced explicitly
+	h.SetAnnounceConfig(&AnnounceConfig{Announce: []ma.Multiaddr{external}})
+	require.Equal(t, []ma.Multiaddr{listening, external}, announce.apply([]ma.Multiaddr{listening}))
+}
@@ -0,0 +1,182 @@
+package codanet
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	p2pconnmgr "github.com/libp2p/go-libp2p-connmgr"
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ConnectionLimits are the watermarks and periods of the connection
+// manager, see p2pconnmgr.NewConnManager
+type ConnectionLimits struct {
+	LowWater  int
+	HighWater int
+	// time a new connection is exempt from trimming
+	GracePeriod time.Duration
+	// minimal time between trims
+	SilencePeriod time.Duration
+}
+
+// p2pconnmgr reads its package-level silence period when a manager is created
+var silencePeriodLock sync.Mutex
+
+func newConnManager(limits ConnectionLimits) *p2pconnmgr.BasicConnMgr {
+	silencePeriodLock.Lock()
+	defer silencePeriodLock.Unlock()
+	defaultSilence := p2pconnmgr.SilencePeriod
+	if limits.SilencePeriod > 0 {
+		p2pconnmgr.SilencePeriod = limits.SilencePeriod
+	}
+	m := p2pconnmgr.NewConnManager(limits.LowWater, limits.HighWater, limits.GracePeriod)
+	p2pconnmgr.SilencePeriod = defaultSilence
+	return m
+}
+
+func (cm *CodaConnectionManager) manager() *p2pconnmgr.BasicConnMgr {
+	cm.p2pManagerLock.RLock()
+	defer cm.p2pManagerLock.RUnlock()
+	return cm.p2pManager
+}
+
+// Limits returns the limits in effect
+func (cm *CodaConnectionManager) Limits() ConnectionLimits {
+	cm.p2pManagerLock.RLock()
+	defer cm.p2pManagerLock.RUnlock()
+	info := cm.p2pManager.GetInfo()
+	silence := cm.silencePeriod
+	if silence == 0 {
+		silence = p2pconnmgr.SilencePeriod
+	}
+	return ConnectionLimits{
+		LowWater:      info.LowWater,
+		HighWater:     info.HighWater,
+		GracePeriod:   info.GracePeriod,
+		SilencePeriod: silence,
+	}
+}
+
+// SetLimits replaces the manager of connections of the network with one
+// of the limits. p2pconnmgr doesn't allow changing limits of a manager,
+// so connections, tags, protections and decaying tags are carried over
+// to the new one. Connections open at the change are given a new grace
+// period and values of decaying tags start anew.
+func (cm *CodaConnectionManager) SetLimits(net network.Network, limits ConnectionLimits) error {
+	if limits.LowWater < 0 || limits.HighWater < limits.LowWater {
+		return errors.New("low watermark must not exceed the high watermark")
+	}
+	if limits.GracePeriod < 0 || limits.SilencePeriod < 0 {
+		return errors.New("periods must not be negative")
+	}
+	m := newConnManager(limits)
+
+	// Protections are kept still while they're carried over
+	cm.protectedMirrorLock.Lock()
+	defer cm.protectedMirrorLock.Unlock()
+	cm.decayingTagsLock.Lock()
+	defer cm.decayingTagsLock.Unlock()
+	cm.p2pManagerLock.Lock()
+	old := cm.p2pManager
+	decaying := make(map[string]bool, len(cm.decayingTags))
+	for _, proxy := range cm.decayingTags {
+		decaying[proxy.name] = true
+		if err := proxy.reregister(m); err != nil {
+			logger.Warnf("failed to carry over decaying tag %s: %s", proxy.name, err)
+		}
+	}
+	for _, c := range net.Conns() {
+		m.Notifee().Connected(net, c)
+	}
+	for _, p := range net.Peers() {
+		if info := old.GetTagInfo(p); info != nil {
+			for tag, value := range info.Tags {
+				if !decaying[tag] {
+					m.TagPeer(p, tag, value)
+				}
+			}
+		}
+	}
+	for p, tags := range cm.protectedMirror {
+		for tag := range tags {
+			m.Protect(p, tag)
+		}
+	}
+	cm.p2pManager = m
+	cm.silencePeriod = limits.SilencePeriod
+	cm.p2pManagerLock.Unlock()
+
+	if err := old.Close(); err != nil {
+		logger.Warnf("failed to close the replaced connection manager: %s", err)
+	}
+	// The new manager trims once over its high watermark
+	go m.TrimOpenConns(context.Background())
+	return nil
+}
+
+func registerDecayingTag(m *p2pconnmgr.BasicConnMgr, name string, interval time.Duration, decayFn connmgr.DecayFn, bumpFn connmgr.BumpFn) (connmgr.DecayingTag, error) {
+	// casting to Decayer here should always succeed
+	decayer, _ := interface{}(m).(connmgr.Decayer)
+	return decayer.RegisterDecayingTag(name, interval, decayFn, bumpFn)
+}
+
+// decayingTagProxy passes calls to the decaying tag of the current
+// manager of CodaConnectionManager
+type decayingTagProxy struct {
+	cm       *CodaConnectionManager
+	name     string
+	interval time.Duration
+	decayFn  connmgr.DecayFn
+	bumpFn   connmgr.BumpFn
+	tag      connmgr.DecayingTag
+	closed   bool
+	lock     sync.Mutex
+}
+
+var _ connmgr.DecayingTag = (*decayingTagProxy)(nil)
+
+func (t *decayingTagProxy) reregister(m *p2pconnmgr.BasicConnMgr) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return nil
+	}
+	tag, err := registerDecayingTag(m, t.name, t.interval, t.decayFn, t.bumpFn)
+	if err != nil {
+		return err
+	}
+	t.tag = tag
+	return nil
+}
+
+func (t *decayingTagProxy) current() connmgr.DecayingTag {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.tag
+}
+
+func (t *decayingTagProxy) Name() string            { return t.name }
+func (t *decayingTagProxy) Interval() time.Duration { return t.current().Interval() }
+func (t *decayingTagProxy) Bump(p peer.ID, delta int) error {
+	return t.current().Bump(p, delta)
+}
+func (t *decayingTagProxy) Remove(p peer.ID) error { return t.current().Remove(p) }
+
+func (t *decayingTagProxy) Close() error {
+	t.cm.decayingTagsLock.Lock()
+	defer t.cm.decayingTagsLock.Unlock()
+	for i, proxy := range t.cm.decayingTags {
+		if proxy == t {
+			t.cm.decayingTags = append(t.cm.decayingTags[:i], t.cm.decayingTags[i+1:]...)
+			break
+		}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.closed = true
+	return t.tag.Close()
+}
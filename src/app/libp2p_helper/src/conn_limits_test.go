@@ -0,0 +1,47 @@
+package codanet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionManagerSetLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	require.NoError(t, err)
+	a, err := mn.GenPeer()
+	require.NoError(t, err)
+	b, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+
+	cm := newCodaConnectionManager(10, 20, false, time.Minute)
+	defer cm.Close()
+	h.Network().Notify(cm)
+	require.NoError(t, mn.ConnectAllButSelf())
+	require.Eventually(t, func() bool { return cm.GetInfo().ConnCount == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	cm.Protect(a.ID(), "test")
+	cm.TagPeer(b.ID(), "weight", 7)
+	tag, err := cm.RegisterDecayingTag("decaying", time.Second, connmgr.DecayNone(), connmgr.BumpSumUnbounded())
+	require.NoError(t, err)
+
+	require.Error(t, cm.SetLimits(h.Network(), ConnectionLimits{LowWater: 5, HighWater: 4}))
+	require.NoError(t, cm.SetLimits(h.Network(), ConnectionLimits{LowWater: 30, HighWater: 40, GracePeriod: time.Second, SilencePeriod: time.Minute}))
+	require.Equal(t, ConnectionLimits{LowWater: 30, HighWater: 40, GracePeriod: time.Second, SilencePeriod: time.Minute}, cm.Limits())
+
+	// Connections, tags and protections are carried over
+	require.Equal(t, 2, cm.GetInfo().ConnCount)
+	require.True(t, cm.IsProtected(a.ID(), "test"))
+	require.Equal(t, 7, cm.GetTagInfo(b.ID()).Tags["weight"])
+	require.NoError(t, tag.Bump(b.ID(), 3))
+	require.Eventually(t, func() bool { return cm.GetTagInfo(b.ID()).Tags["decaying"] == 3 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, tag.Close())
+}
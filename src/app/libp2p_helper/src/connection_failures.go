@@ -0,0 +1,112 @@
+package codanet
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Peers with failures kept at most, the peer whose last
+// failure is the oldest is forgotten to make room for another
+const maxConnectionFailurePeers = 4096
+
+// ConnectionFailure is the history of failed dials of a peer since
+// the last outbound connection to it
+type ConnectionFailure struct {
+	Count int
+	Last  time.Time
+}
+
+// ConnectionFailures tracks failed dials of peers, the history
+// of a peer is cleared once an outbound connection to it is opened
+type ConnectionFailures struct {
+	failures map[peer.ID]ConnectionFailure
+	now      func() time.Time
+	mutex    sync.Mutex
+}
+
+func NewConnectionFailures() *ConnectionFailures {
+	return &ConnectionFailures{
+		failures: make(map[peer.ID]ConnectionFailure),
+		now:      time.Now,
+	}
+}
+
+// Record records a failed dial of the peer
+func (f *ConnectionFailures) Record(p peer.ID) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	failure, has := f.failures[p]
+	if !has && len(f.failures) >= maxConnectionFailurePeers {
+		f.forgetOldest()
+	}
+	failure.Count++
+	failure.Last = f.now()
+	f.failures[p] = failure
+}
+
+func (f *ConnectionFailures) forgetOldest() {
+	var oldest peer.ID
+	var oldestAt time.Time
+	for p, failure := range f.failures {
+		if oldest == "" || failure.Last.Before(oldestAt) {
+			oldest, oldestAt = p, failure.Last
+		}
+	}
+	delete(f.failures, oldest)
+}
+
+// Get returns failures of the peer since the last outbound connection
+func (f *ConnectionFailures) Get(p peer.ID) (ConnectionFailure, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	failure, has := f.failures[p]
+	return failure, has
+}
+
+// All returns a copy of failures of all peers
+func (f *ConnectionFailures) All() map[peer.ID]ConnectionFailure {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	res := make(map[peer.ID]ConnectionFailure, len(f.failures))
+	for p, failure := range f.failures {
+		res[p] = failure
+	}
+	return res
+}
+
+// merge adds failures recorded before, e.g. by the previous run of
+// the helper, to those recorded since
+func (f *ConnectionFailures) merge(failures map[peer.ID]ConnectionFailure) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for p, before := range failures {
+		failure, has := f.failures[p]
+		if !has && len(f.failures) >= maxConnectionFailurePeers {
+			continue
+		}
+		failure.Count += before.Count
+		if failure.Last.Before(before.Last) {
+			failure.Last = before.Last
+		}
+		f.failures[p] = failure
+	}
+}
+
+func (f *ConnectionFailures) Connected(net network.Network, c network.Conn) {
+	if c.Stat().Direction != network.DirOutbound {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.failures, c.RemotePeer())
+}
+
+func (f *ConnectionFailures) Disconnected(net network.Network, c network.Conn)        {}
+func (f *ConnectionFailures) Listen(net network.Network, addr ma.Multiaddr)           {}
+func (f *ConnectionFailures) ListenClose(net network.Network, addr ma.Multiaddr)      {}
+func (f *ConnectionFailures) OpenedStream(net network.Network, stream network.Stream) {}
+func (f *ConnectionFailures) ClosedStream(net network.Network, stream network.Stream) {}
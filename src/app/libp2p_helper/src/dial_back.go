@@ -0,0 +1,318 @@
+package codanet
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"time"
+
+	p2p "github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	protocol "github.com/libp2p/go-libp2p-core/protocol"
+	libp2pmplex "github.com/libp2p/go-libp2p-mplex"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+const (
+	DialBackProtocolID = protocol.ID("/mina/dial-back/1.0.0")
+
+	// Time limit of a single dial-back, including the request
+	dialBackTimeout = 15 * time.Second
+	// Interval of retrying verification of an address that failed it
+	dialBackRetryInterval = 5 * time.Minute
+	// Interval of retrying verification no peer could perform
+	dialBackInconclusiveRetryInterval = 30 * time.Second
+	// Interval of re-verifying a verified address, it's still
+	// advertised while being re-verified
+	dialBackReverifyInterval = time.Hour
+	// Peers asked to dial back an address before giving up
+	maxDialBackAttempts = 3
+	// Dial-backs performed for other peers concurrently at most,
+	// further requests are refused
+	maxConcurrentDialBacks = 4
+	maxDialBackRequestSize = 1024
+	dialBackQueueSize      = 16
+)
+
+// Result of a dial-back, sent by the peer performing it as a single byte
+const (
+	dialBackSucceeded byte = iota
+	dialBackFailed
+	// peer refused to dial the address back, another peer is to be asked
+	dialBackRefused
+)
+
+type addrVerification struct {
+	verified  bool
+	pending   bool
+	checkedAt time.Time
+	// time to wait before checking the address again
+	retryAfter time.Duration
+}
+
+// addrVerifier checks that public addresses of the node are reachable
+// before they get advertised by asking connected peers to dial back on
+// them. A peer dials back from a separate host with a throwaway identity
+// (so that the existing connection isn't reused) and only addresses with
+// the IP it sees the requester connected from, so that the protocol can't
+// be used to make nodes dial arbitrary hosts.
+type addrVerifier struct {
+	ctx     context.Context
+	host    host.Host
+	pnetKey []byte
+
+	state map[string]*addrVerification
+	queue chan ma.Multiaddr
+	mutex sync.Mutex
+
+	dialer      host.Host
+	dialerMutex sync.Mutex
+	dialBacks   chan struct{}
+}
+
+func newAddrVerifier(ctx context.Context, pnetKey []byte) *addrVerifier {
+	return &addrVerifier{
+		ctx:       ctx,
+		pnetKey:   pnetKey,
+		state:     make(map[string]*addrVerification),
+		queue:     make(chan ma.Multiaddr, dialBackQueueSize),
+		dialBacks: make(chan struct{}, maxConcurrentDialBacks),
+	}
+}
+
+// needsDialBack tells whether the address is to be verified before being
+// advertised: private addresses aren't verified as they are only useful
+// to peers of the same network, relay addresses are verified by the relay
+func needsDialBack(addr ma.Multiaddr) bool {
+	if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+		return false
+	}
+	return manet.IsPublicAddr(addr)
+}
+
+// filter returns addresses that can be advertised, queueing verification
+// of addresses not verified yet. State of addresses missing from addrs
+// is forgotten.
+func (v *addrVerifier) filter(addrs []ma.Multiaddr, now time.Time) []ma.Multiaddr {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	res := make([]ma.Multiaddr, 0, len(addrs))
+	seen := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		if !needsDialBack(addr) {
+			res = append(res, addr)
+			continue
+		}
+		key := string(addr.Bytes())
+		seen[key] = struct{}{}
+		s, has := v.state[key]
+		if !has {
+			s = &addrVerification{}
+			v.state[key] = s
+		}
+		if s.verified {
+			res = append(res, addr)
+		}
+		if !s.pending && (s.checkedAt.IsZero() || now.Sub(s.checkedAt) >= s.retryAfter) {
+			select {
+			case v.queue <- addr:
+				s.pending = true
+			default:
+			}
+		}
+	}
+	for key := range v.state {
+		if _, has := seen[key]; !has {
+			delete(v.state, key)
+		}
+	}
+	return res
+}
+
+// record updates the state of the address with the result of
+// verification, result of dialBackRefused means no peer could verify it
+func (v *addrVerifier) record(addr ma.Multiaddr, result byte, now time.Time) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	s, has := v.state[string(addr.Bytes())]
+	if !has {
+		return
+	}
+	s.pending = false
+	s.checkedAt = now
+	switch result {
+	case dialBackSucceeded:
+		s.verified = true
+		s.retryAfter = dialBackReverifyInterval
+	case dialBackFailed:
+		s.verified = false
+		s.retryAfter = dialBackRetryInterval
+	default:
+		// Verified address stays advertised if no peer could re-verify it
+		s.retryAfter = dialBackInconclusiveRetryInterval
+	}
+}
+
+func (v *addrVerifier) run() {
+	for {
+		select {
+		case <-v.ctx.Done():
+			return
+		case addr := <-v.queue:
+			result := v.verify(addr)
+			switch result {
+			case dialBackSucceeded:
+				logger.Infof("address %s verified by dial-back", addr)
+			case dialBackFailed:
+				logger.Warnf("address %s failed dial-back verification, not advertising it", addr)
+			default:
+				logger.Debugf("no peer could verify address %s", addr)
+			}
+			v.record(addr, result, time.Now())
+		}
+	}
+}
+
+// verify asks connected peers supporting the protocol to dial back on the
+// address, until one of them doesn't refuse it
+func (v *addrVerifier) verify(addr ma.Multiaddr) byte {
+	peers := v.host.Network().Peers()
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	attempts := 0
+	for _, p := range peers {
+		if attempts >= maxDialBackAttempts {
+			break
+		}
+		if protos, err := v.host.Peerstore().SupportsProtocols(p, string(DialBackProtocolID)); err != nil || len(protos) == 0 {
+			continue
+		}
+		attempts++
+		result, err := v.requestDialBack(p, addr)
+		if err != nil {
+			logger.Debugf("dial-back request to %s failed: %s", p, err)
+			continue
+		}
+		if result != dialBackRefused {
+			return result
+		}
+	}
+	return dialBackRefused
+}
+
+func (v *addrVerifier) requestDialBack(p peer.ID, addr ma.Multiaddr) (byte, error) {
+	ctx, cancel := context.WithTimeout(v.ctx, dialBackTimeout)
+	defer cancel()
+	s, err := v.host.NewStream(ctx, p, DialBackProtocolID)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+	_ = s.SetDeadline(time.Now().Add(dialBackTimeout))
+	if _, err := s.Write(addr.Bytes()); err != nil {
+		_ = s.Reset()
+		return 0, err
+	}
+	if err := s.CloseWrite(); err != nil {
+		_ = s.Reset()
+		return 0, err
+	}
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		_ = s.Reset()
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+func (v *addrVerifier) handleStream(s network.Stream) {
+	defer func() {
+		_ = s.Close()
+	}()
+	_ = s.SetDeadline(time.Now().Add(dialBackTimeout))
+	buf, err := ioutil.ReadAll(io.LimitReader(s, maxDialBackRequestSize))
+	if err != nil {
+		_ = s.Reset()
+		return
+	}
+	addr, err := ma.NewMultiaddrBytes(buf)
+	if err != nil {
+		logger.Debugf("malformed dial-back request from %s: %s", s.Conn().RemotePeer(), err)
+		_ = s.Reset()
+		return
+	}
+	if _, err := s.Write([]byte{v.dialBack(s.Conn(), addr)}); err != nil {
+		logger.Debugf("failed to write dial-back result: %s", err)
+	}
+}
+
+// dialBack dials the requester on the address from the dialer host
+func (v *addrVerifier) dialBack(conn network.Conn, addr ma.Multiaddr) byte {
+	if !sameIP(conn.RemoteMultiaddr(), addr) {
+		return dialBackRefused
+	}
+	select {
+	case v.dialBacks <- struct{}{}:
+		defer func() { <-v.dialBacks }()
+	default:
+		return dialBackRefused
+	}
+	dialer, err := v.getDialer()
+	if err != nil {
+		logger.Errorf("failed to create dial-back host: %s", err)
+		return dialBackRefused
+	}
+	p := conn.RemotePeer()
+	ctx, cancel := context.WithTimeout(v.ctx, dialBackTimeout)
+	defer cancel()
+	err = dialer.Connect(ctx, peer.AddrInfo{ID: p, Addrs: []ma.Multiaddr{addr}})
+	_ = dialer.Network().ClosePeer(p)
+	dialer.Peerstore().ClearAddrs(p)
+	if err != nil {
+		logger.Debugf("dial-back to %s on %s failed: %s", p, addr, err)
+		return dialBackFailed
+	}
+	return dialBackSucceeded
+}
+
+// sameIP tells whether both addresses have the same IP, relayed
+// connections and non-IP addresses never match
+func sameIP(a, b ma.Multiaddr) bool {
+	if _, err := a.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+		return false
+	}
+	ipA, err := manet.ToIP(a)
+	if err != nil {
+		return false
+	}
+	ipB, err := manet.ToIP(b)
+	if err != nil {
+		return false
+	}
+	return ipA.Equal(ipB)
+}
+
+// getDialer returns the host dial-backs are performed from,
+// it's created on the first dial-back
+func (v *addrVerifier) getDialer() (host.Host, error) {
+	v.dialerMutex.Lock()
+	defer v.dialerMutex.Unlock()
+	if v.dialer != nil {
+		return v.dialer, nil
+	}
+	dialer, err := p2p.New(v.ctx,
+		p2p.Muxer("/coda/mplex/1.0.0", libp2pmplex.DefaultTransport),
+		p2p.NoListenAddrs,
+		p2p.DisableRelay(),
+		p2p.PrivateNetwork(v.pnetKey),
+	)
+	if err != nil {
+		return nil, err
+	}
+	v.dialer = dialer
+	return dialer, nil
+}
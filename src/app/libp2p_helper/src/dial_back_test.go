@@ -0,0 +1,51 @@
+package codanet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddrVerifierFilter(t *testing.T) {
+	v := newAddrVerifier(context.Background(), nil)
+	public := ma.StringCast("/ip4/1.2.3.4/tcp/8302")
+	private := ma.StringCast("/ip4/10.0.0.1/tcp/8302")
+	now := time.Now()
+
+	// Public address is held back until verified
+	require.Equal(t, []ma.Multiaddr{private}, v.filter([]ma.Multiaddr{private, public}, now))
+	require.True(t, public.Equal(<-v.queue))
+	// Pending verification isn't queued again
+	v.filter([]ma.Multiaddr{public}, now)
+	require.Empty(t, v.queue)
+
+	v.record(public, dialBackSucceeded, now)
+	require.Equal(t, []ma.Multiaddr{public}, v.filter([]ma.Multiaddr{public}, now))
+	require.Empty(t, v.queue)
+
+	// Verified address stays advertised while being re-verified
+	now = now.Add(dialBackReverifyInterval)
+	require.Equal(t, []ma.Multiaddr{public}, v.filter([]ma.Multiaddr{public}, now))
+	require.True(t, public.Equal(<-v.queue))
+	v.record(public, dialBackFailed, now)
+	require.Empty(t, v.filter([]ma.Multiaddr{public}, now))
+	require.Empty(t, v.queue)
+
+	// Failed address is retried after the retry interval
+	now = now.Add(dialBackRetryInterval)
+	require.Empty(t, v.filter([]ma.Multiaddr{public}, now))
+	require.True(t, public.Equal(<-v.queue))
+
+	// State of addresses no longer present is forgotten
+	v.filter([]ma.Multiaddr{private}, now)
+	require.Empty(t, v.state)
+}
+
+func TestSameIP(t *testing.T) {
+	require.True(t, sameIP(ma.StringCast("/ip4/1.2.3.4/tcp/1000"), ma.StringCast("/ip4/1.2.3.4/tcp/8302")))
+	require.False(t, sameIP(ma.StringCast("/ip4/1.2.3.4/tcp/1000"), ma.StringCast("/ip4/1.2.3.5/tcp/8302")))
+	require.False(t, sameIP(ma.StringCast("/dns4/example.com/tcp/1000"), ma.StringCast("/ip4/1.2.3.4/tcp/8302")))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	ipc "libp2p_ipc"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+const minaAgentProduct = "mina"
+
+// agentInfo is metadata of a node carried in its identify agent version
+// as space-separated `name/value` tokens: `mina/<version> chain/<chainId>
+// role/<role>`. Product token comes first and is always present, other
+// tokens are omitted if empty.
+type agentInfo struct {
+	version string
+	chainId string
+	role    string
+}
+
+func (a agentInfo) String() string {
+	tokens := []string{minaAgentProduct + "/" + a.version}
+	if a.chainId != "" {
+		tokens = append(tokens, "chain/"+a.chainId)
+	}
+	if a.role != "" {
+		tokens = append(tokens, "role/"+a.role)
+	}
+	return strings.Join(tokens, " ")
+}
+
+func (a agentInfo) isEmpty() bool {
+	return a == agentInfo{}
+}
+
+func validateAgentField(name, value string) error {
+	if strings.IndexFunc(value, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("agent %s contains whitespace: %q", name, value)
+	}
+	return nil
+}
+
+// parseAgentVersion reads agent version of the agentInfo format,
+// false is returned for agent versions of other formats
+func parseAgentVersion(s string) (agentInfo, bool) {
+	var res agentInfo
+	tokens := strings.Fields(s)
+	if len(tokens) == 0 {
+		return res, false
+	}
+	for i, token := range tokens {
+		kv := strings.SplitN(token, "/", 2)
+		if len(kv) != 2 {
+			return agentInfo{}, false
+		}
+		if i == 0 {
+			if kv[0] != minaAgentProduct {
+				return agentInfo{}, false
+			}
+			res.version = kv[1]
+			continue
+		}
+		// Unknown tokens are skipped, so that fields can be added
+		switch kv[0] {
+		case "chain":
+			res.chainId = kv[1]
+		case "role":
+			res.role = kv[1]
+		}
+	}
+	return res, true
+}
+
+func readAgentInfo(m ipc.AgentInfo) (agentInfo, error) {
+	var res agentInfo
+	var err error
+	if res.version, err = m.Version(); err != nil {
+		return res, err
+	}
+	if res.chainId, err = m.ChainId(); err != nil {
+		return res, err
+	}
+	if res.role, err = m.Role(); err != nil {
+		return res, err
+	}
+	for _, f := range []struct{ name, value string }{
+		{"version", res.version}, {"chain id", res.chainId}, {"role", res.role},
+	} {
+		if err := validateAgentField(f.name, f.value); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+func setAgentInfo(m ipc.AgentInfo, a agentInfo) {
+	panicOnErr(m.SetVersion(a.version))
+	panicOnErr(m.SetChainId(a.chainId))
+	panicOnErr(m.SetRole(a.role))
+}
+
+// peerAgentVersion returns agent version the peer reported in identify,
+// empty if it's not known
+func (app *app) peerAgentVersion(p peer.ID) string {
+	v, err := app.P2p.Host.Peerstore().Get(p, "AgentVersion")
+	if err != nil {
+		return ""
+	}
+	s, _ := v.(string)
+	return s
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentVersionRoundtrip(t *testing.T) {
+	for _, a := range []agentInfo{
+		{version: "1.3.0-abcdef", chainId: "5f704cc0c82e0ed70e873f0893d7e06f148524e3f0bdae2afb02e7819a0c24d1", role: "block-producer"},
+		{version: "1.3.0", role: "seed"},
+		{version: "1.3.0"},
+		{chainId: "abc"},
+	} {
+		parsed, ok := parseAgentVersion(a.String())
+		require.True(t, ok)
+		require.Equal(t, a, parsed)
+	}
+	require.Equal(t, "mina/1.3.0 chain/abc role/seed", agentInfo{version: "1.3.0", chainId: "abc", role: "seed"}.String())
+}
+
+func TestParseAgentVersion(t *testing.T) {
+	a, ok := parseAgentVersion("mina/1.3.0 os/linux role/archive")
+	require.True(t, ok)
+	require.Equal(t, agentInfo{version: "1.3.0", role: "archive"}, a)
+
+	for _, s := range []string{
+		"",
+		"github.com/codaprotocol/coda/tree/master/src/app/libp2p_helper",
+		"go-ipfs/0.9.0",
+		"mina/1.3.0 chain",
+	} {
+		_, ok := parseAgentVersion(s)
+		require.False(t, ok, s)
+	}
+}
+
+func TestValidateAgentField(t *testing.T) {
+	require.NoError(t, validateAgentField("role", "block-producer"))
+	require.Error(t, validateAgentField("role", "block producer"))
+}
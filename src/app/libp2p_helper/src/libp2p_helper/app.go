@@ -31,6 +31,8 @@ func newApp() *app {
 		Ctx:                      ctx,
 		Subs:                     make(map[uint64]subscription),
 		Topics:                   make(map[string]*pubsub.Topic),
+		TopicDispatchers:         make(map[string]*topicDispatcher),
+		validationQueues:         make(map[string]*validationQueue),
 		ValidatorMutex:           &sync.Mutex{},
 		Validators:               make(map[uint64]*validationStatus),
 		Streams:                  make(map[uint64]net.Stream),
@@ -41,6 +43,12 @@ func newApp() *app {
 		metricsCollectionStarted: false,
 		metricsServer:            nil,
 		bitswapCtx:               NewBitswapCtx(ctx, outChan),
+		dialLadder:               newDialLadder(0, 0, 0, nil),
+		topicSpecs:               newTopicRegistry(),
+		rpcAdmission:             newRpcAdmission(),
+		peerAudit:                newPeerAuditLog(),
+		schemaMismatches:         newSchemaMismatches(),
+		malformedBlockPenalties:  newMalformedBlockPenalties(),
 	}
 }
 
@@ -49,6 +57,7 @@ func (app *app) SetConnectionHandlers() {
 		app.P2p.ConnectionManager.OnConnect = func(net net.Network, c net.Conn) {
 			app.updateConnectionMetrics()
 			app.writeMsg(mkPeerConnectedUpcall(peer.Encode(c.RemotePeer())))
+			app.gossipCatchupConnected(c.RemotePeer())
 		}
 
 		app.P2p.ConnectionManager.OnDisconnect = func(net net.Network, c net.Conn) {
@@ -286,6 +295,11 @@ func (app *app) checkLatency() {
 	}
 
 	for {
+		// Walking the whole peerstore is skipped during maintenance
+		if app.inMaintenance() {
+			time.Sleep(app.MetricsRefreshTime)
+			continue
+		}
 		peers := app.P2p.Host.Peerstore().Peers()
 		if len(peers) > 0 {
 			sum := 0.0
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+const (
+	availabilityAnnounceInterval = 10 * time.Second
+	// Roots announced in a single message at most, the most recently
+	// completed ones are announced when more roots were completed
+	maxAnnouncedRoots = 64
+	// Time for which an announcement is used as a provider hint
+	availabilityHintTTL = 10 * time.Minute
+	maxHintedRoots      = 4096
+	// Peers remembered for a root, the most recent announcements are kept
+	maxHintedPeersPerRoot = 8
+	// Peers hinted for a single download request
+	maxHintedPeersPerDownload = 16
+)
+
+var errMalformedAnnouncement = errors.New("malformed availability announcement")
+
+type availabilityHint struct {
+	peer peer.ID
+	at   time.Time
+}
+
+// availabilityHints gossips roots recently completed by the node over
+// a dedicated topic and collects roots announced by other nodes. Announcing
+// peers are used as provider candidates for downloads, reducing reliance
+// on DHT provider records which propagate slowly.
+//
+// An announcement is a concatenation of root hashes. It's signed by its
+// author as any pubsub message, and authors announcing more often than
+// once per half of the announce interval are ignored.
+type availabilityHints struct {
+	topic *pubsub.Topic
+	self  peer.ID
+	// roots completed since the last announcement, oldest first
+	pending []dl.Root
+	hints   map[dl.Root][]availabilityHint
+	// last announcement accepted from each peer
+	lastSeen map[peer.ID]time.Time
+	mutex    sync.Mutex
+}
+
+func newAvailabilityHints(topic *pubsub.Topic, self peer.ID) *availabilityHints {
+	return &availabilityHints{
+		topic:    topic,
+		self:     self,
+		hints:    make(map[dl.Root][]availabilityHint),
+		lastSeen: make(map[peer.ID]time.Time),
+	}
+}
+
+func encodeAnnouncement(roots []dl.Root) []byte {
+	res := make([]byte, 0, len(roots)*dl.BITSWAP_BLOCK_LINK_SIZE)
+	for _, r := range roots {
+		res = append(res, r[:]...)
+	}
+	return res
+}
+
+func decodeAnnouncement(data []byte) ([]dl.Root, error) {
+	if len(data) == 0 || len(data)%dl.BITSWAP_BLOCK_LINK_SIZE != 0 || len(data)/dl.BITSWAP_BLOCK_LINK_SIZE > maxAnnouncedRoots {
+		return nil, errMalformedAnnouncement
+	}
+	res := make([]dl.Root, len(data)/dl.BITSWAP_BLOCK_LINK_SIZE)
+	for i := range res {
+		copy(res[i][:], data[i*dl.BITSWAP_BLOCK_LINK_SIZE:])
+	}
+	return res, nil
+}
+
+// Announce queues roots to be announced with the next announcement,
+// it's a no-op for nil hints
+func (a *availabilityHints) Announce(roots ...dl.Root) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, r := range roots {
+		pending := false
+		for _, p := range a.pending {
+			if p == r {
+				pending = true
+				break
+			}
+		}
+		if !pending {
+			a.pending = append(a.pending, r)
+		}
+	}
+	if len(a.pending) > maxAnnouncedRoots {
+		a.pending = a.pending[len(a.pending)-maxAnnouncedRoots:]
+	}
+}
+
+func (a *availabilityHints) takePending() []dl.Root {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	res := a.pending
+	a.pending = nil
+	return res
+}
+
+// validate accepts well-formed announcements of other peers,
+// throttling peers that announce too often
+func (a *availabilityHints) validate(from peer.ID, data []byte, now time.Time) pubsub.ValidationResult {
+	if _, err := decodeAnnouncement(data); err != nil {
+		return pubsub.ValidationReject
+	}
+	if from == a.self {
+		return pubsub.ValidationAccept
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if last, has := a.lastSeen[from]; has && now.Sub(last) < availabilityAnnounceInterval/2 {
+		return pubsub.ValidationIgnore
+	}
+	a.lastSeen[from] = now
+	return pubsub.ValidationAccept
+}
+
+// record remembers the peer as a provider of roots
+func (a *availabilityHints) record(from peer.ID, roots []dl.Root, now time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, r := range roots {
+		hints, has := a.hints[r]
+		if !has && len(a.hints) >= maxHintedRoots {
+			continue
+		}
+		updated := make([]availabilityHint, 0, len(hints)+1)
+		for _, h := range hints {
+			if h.peer != from {
+				updated = append(updated, h)
+			}
+		}
+		updated = append(updated, availabilityHint{peer: from, at: now})
+		if len(updated) > maxHintedPeersPerRoot {
+			updated = updated[len(updated)-maxHintedPeersPerRoot:]
+		}
+		a.hints[r] = updated
+	}
+}
+
+// prune forgets expired hints
+func (a *availabilityHints) prune(now time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for r, hints := range a.hints {
+		// Hints are ordered by time of announcement
+		i := 0
+		for i < len(hints) && now.Sub(hints[i].at) > availabilityHintTTL {
+			i++
+		}
+		if i == len(hints) {
+			delete(a.hints, r)
+		} else {
+			a.hints[r] = hints[i:]
+		}
+	}
+	for p, last := range a.lastSeen {
+		if now.Sub(last) > availabilityAnnounceInterval {
+			delete(a.lastSeen, p)
+		}
+	}
+}
+
+// Providers returns peers that recently announced any of the roots,
+// most recent announcements first, nil for nil hints
+func (a *availabilityHints) Providers(roots []dl.Root) []peer.ID {
+	if a == nil {
+		return nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	now := time.Now()
+	seen := make(map[peer.ID]struct{})
+	res := []peer.ID{}
+	for _, r := range roots {
+		hints := a.hints[r]
+		for i := len(hints) - 1; i >= 0 && len(res) < maxHintedPeersPerDownload; i-- {
+			h := hints[i]
+			if _, has := seen[h.peer]; has || now.Sub(h.at) > availabilityHintTTL {
+				continue
+			}
+			seen[h.peer] = struct{}{}
+			res = append(res, h.peer)
+		}
+	}
+	return res
+}
+
+// startAvailabilityHints joins the topic, subscribes to announcements of
+// other nodes and launches periodic announcement of completed roots
+func startAvailabilityHints(ctx context.Context, ps *pubsub.PubSub, self peer.ID, topicName string) (*availabilityHints, error) {
+	topic, err := ps.Join(topicName)
+	if err != nil {
+		return nil, err
+	}
+	a := newAvailabilityHints(topic, self)
+	err = ps.RegisterTopicValidator(topicName, func(_ context.Context, _ peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		// Author is authenticated by the message signature
+		author, err := peer.IDFromBytes(msg.GetFrom())
+		if err != nil {
+			return pubsub.ValidationReject
+		}
+		return a.validate(author, msg.GetData(), time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			msg, err := sub.Next(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					bitswapLogger.Errorf("Failed to receive availability announcement: %s", err)
+				}
+				return
+			}
+			// Message was validated already
+			author, _ := peer.IDFromBytes(msg.GetFrom())
+			if author == self {
+				continue
+			}
+			roots, _ := decodeAnnouncement(msg.GetData())
+			a.record(author, roots, time.Now())
+		}
+	}()
+	go a.announceLoop(ctx)
+	return a, nil
+}
+
+func (a *availabilityHints) announceLoop(ctx context.Context) {
+	ticker := time.NewTicker(availabilityAnnounceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			a.prune(now)
+			roots := a.takePending()
+			if len(roots) == 0 {
+				continue
+			}
+			if err := a.topic.Publish(ctx, encodeAnnouncement(roots)); err != nil {
+				bitswapLogger.Errorf("Failed to announce %d roots (e.g. %s): %s",
+					len(roots), codanet.BlockHashToCidSuffix(roots[0]), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnouncementEncoding(t *testing.T) {
+	roots := []dl.Root{{1}, {2}, {3}}
+	data := encodeAnnouncement(roots)
+	decoded, err := decodeAnnouncement(data)
+	require.NoError(t, err)
+	require.Equal(t, roots, decoded)
+
+	_, err = decodeAnnouncement(data[1:])
+	require.ErrorIs(t, err, errMalformedAnnouncement)
+	_, err = decodeAnnouncement(nil)
+	require.ErrorIs(t, err, errMalformedAnnouncement)
+	_, err = decodeAnnouncement(make([]byte, (maxAnnouncedRoots+1)*dl.BITSWAP_BLOCK_LINK_SIZE))
+	require.ErrorIs(t, err, errMalformedAnnouncement)
+}
+
+func TestAvailabilityHints(t *testing.T) {
+	self, author1, author2 := peer.ID("self"), peer.ID("author1"), peer.ID("author2")
+	a := newAvailabilityHints(nil, self)
+	now := time.Now()
+	data := encodeAnnouncement([]dl.Root{{1}})
+
+	require.Equal(t, pubsub.ValidationAccept, a.validate(author1, data, now))
+	// Announcing too often
+	require.Equal(t, pubsub.ValidationIgnore, a.validate(author1, data, now.Add(time.Second)))
+	require.Equal(t, pubsub.ValidationAccept, a.validate(author1, data, now.Add(availabilityAnnounceInterval)))
+	require.Equal(t, pubsub.ValidationReject, a.validate(author2, data[1:], now))
+
+	a.record(author1, []dl.Root{{1}, {2}}, now.Add(-time.Minute))
+	a.record(author2, []dl.Root{{2}}, now)
+	require.Equal(t, []peer.ID{author1}, a.Providers([]dl.Root{{1}}))
+	// Most recent announcements first
+	require.Equal(t, []peer.ID{author2, author1}, a.Providers([]dl.Root{{2}, {1}}))
+	require.Empty(t, a.Providers([]dl.Root{{3}}))
+
+	a.prune(now.Add(availabilityHintTTL))
+	require.Empty(t, a.Providers([]dl.Root{{1}}))
+	require.Equal(t, []peer.ID{author2}, a.Providers([]dl.Root{{2}}))
+
+	var nilHints *availabilityHints
+	nilHints.Announce(dl.Root{1})
+	require.Nil(t, nilHints.Providers([]dl.Root{{1}}))
+}
+
+func TestAnnounceRoots(t *testing.T) {
+	a := newAvailabilityHints(nil, peer.ID("self"))
+	a.Announce(dl.Root{1}, dl.Root{2})
+	a.Announce(dl.Root{1})
+	require.Equal(t, []dl.Root{{1}, {2}}, a.takePending())
+	require.Empty(t, a.takePending())
+
+	for i := 0; i < maxAnnouncedRoots+1; i++ {
+		a.Announce(dl.Root{byte(i), 1})
+	}
+	pending := a.takePending()
+	require.Len(t, pending, maxAnnouncedRoots)
+	// Most recently completed roots are announced
+	require.Equal(t, dl.Root{byte(maxAnnouncedRoots), 1}, pending[maxAnnouncedRoots-1])
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"codanet"
+	dl "codanet/bitswap_downloader"
 	"context"
+	"errors"
+	"fmt"
 	ipc "libp2p_ipc"
 	"math"
 	"time"
@@ -13,63 +16,164 @@ import (
 	"github.com/ipfs/go-cid"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	exchange "github.com/ipfs/go-ipfs-exchange-interface"
+	peer "github.com/libp2p/go-libp2p-core/peer"
 )
 
 type bitswapDeleteCmd struct {
-	rootIds []root
+	rootIds []dl.Root
+	traceId string
 }
 
 type bitswapAddCmd struct {
-	tag  BitswapDataTag
-	data []byte
+	tag      dl.BitswapDataTag
+	data     []byte
+	metadata []byte
+	traceId  string
+}
+
+type rootDependency struct {
+	parent dl.Root
+	child  dl.Root
 }
 
 type bitswapDownloadCmd struct {
-	tag     BitswapDataTag
-	rootIds []root
+	tag          dl.BitswapDataTag
+	priority     ipc.DownloadPriority
+	rootIds      []dl.Root
+	dependencies []rootDependency
+	inlineBlocks [][]byte
+	// peers hinted to provide blocks of the roots
+	providers map[dl.Root][]peer.ID
+	traceId   string
+	// roots share a Bitswap session
+	batch bool
+	// metadata attached to the roots, by root
+	metadata map[dl.Root][]byte
+}
+
+type bitswapPinCmd struct {
+	root   dl.Root
+	pin    bool
+	result chan<- error
 }
 
 type BitswapCtx struct {
 	downloadCmds       chan bitswapDownloadCmd
 	addCmds            chan bitswapAddCmd
 	deleteCmds         chan bitswapDeleteCmd
+	pinCmds            chan bitswapPinCmd
+	revalidateCmds     chan bitswapRevalidateCmd
+	cancelCmds         chan bitswapCancelCmd
+	publishCmds        chan bitswapPublishCmd
+	gcCmds             chan bitswapGcCmd
+	reapCmds           chan bitswapReapCmd
+	verdictCmds        chan bitswapVerdictCmd
+	uploadCmds         chan bitswapUploadCmd
+	wantsCmds          chan bitswapWantsCmd
+	importCmds         chan bitswapImportCmd
+	auditCmds          chan bitswapAuditCmd
+	deleteBeforeCmds   chan bitswapDeleteBeforeCmd
+	duplicates         chan blocks.Block
 	engine             *bitswap.Bitswap
+	providerHints      *codanet.ProviderHints
+	senders            *codanet.BitswapSenders
 	storage            codanet.BitswapStorage
 	ctx                context.Context
 	blockSink          chan blocks.Block
-	nodeDownloadParams map[cid.Cid]map[root][]NodeIndex
-	rootDownloadStates map[root]*RootDownloadState
-	deadlineChan       chan root
+	nodeDownloadParams map[cid.Cid]map[dl.Root][]dl.NodeIndex
+	rootDownloadStates map[dl.Root]*dl.RootDownloadState
+	deadlines          *rootDeadlines
 	outMsgChan         chan<- *capnp.Message
 	maxBlockSize       int
-	dataConfig         map[BitswapDataTag]BitswapDataConfig
-	depthIndices       DepthIndices
+	dataConfig         map[dl.BitswapDataTag]dl.BitswapDataConfig
+	depthIndices       dl.DepthIndices
+	// trace IDs of commands roots are being processed for,
+	// reported with the resource update on completion
+	traceIds     map[dl.Root]string
+	dependencies *rootDependencies
+	// blocks of pinned roots
+	pinned map[dl.Root][]dl.BitswapBlockLink
+	// completed roots are announced to other nodes, if set
+	availability *availabilityHints
+	scheduler    *downloadScheduler
+	retries      *downloadRetries
+	updateLog    resourceUpdateLog
+	partialRoots map[dl.Root]*partialRoot
+	// downloaded roots awaiting a verdict of the daemon
+	verifications *downloadVerifications
+	// resources being added in pieces, by session
+	uploads map[uint64]*uploadSession
+	// peers hinted by the daemon to provide roots
+	providers map[dl.Root][]peer.ID
+	// batches of roots requested together, by root
+	batches map[dl.Root]*downloadBatch
+	// metadata attached to roots by the daemon
+	rootMetadata map[dl.Root][]byte
+	// distribution of staking ledger snapshots, if enabled
+	stakingLedgers *stakingLedgers
+	// malformed blocks are attributed to their senders, if set
+	onMalformedBlock func(sender peer.ID, root dl.Root, id cid.Cid)
+	// roots of recently processed blocks, their duplicates are
+	// attributed to downloads of the roots
+	recentBlocks *recentBlocks
+	// blocks received before they were awaited by any download
+	earlyBlocks          *dl.EarlyBlocks
+	duplicateSuppression duplicateSuppression
+	backpressure         downloadBackpressure
 }
 
 func NewBitswapCtx(ctx context.Context, outMsgChan chan<- *capnp.Message) *BitswapCtx {
-	maxBlockSize := 1 << 18 // 256 KiB
+	maxBlockSize := 1 << 18         // 256 KiB
+	maxBlockBodySize := 1 << 26     // 64 MiB
+	maxEpochLedgerSize := 1 << 30   // 1 GiB
+	maxStakingLedgerSize := 1 << 30 // 1 GiB
 	return &BitswapCtx{
 		downloadCmds:       make(chan bitswapDownloadCmd, 100),
 		addCmds:            make(chan bitswapAddCmd, 100),
 		deleteCmds:         make(chan bitswapDeleteCmd, 100),
+		pinCmds:            make(chan bitswapPinCmd, 100),
+		revalidateCmds:     make(chan bitswapRevalidateCmd, 100),
+		cancelCmds:         make(chan bitswapCancelCmd, 100),
+		publishCmds:        make(chan bitswapPublishCmd, 100),
+		gcCmds:             make(chan bitswapGcCmd, 100),
+		reapCmds:           make(chan bitswapReapCmd, 100),
+		verdictCmds:        make(chan bitswapVerdictCmd, 100),
+		uploadCmds:         make(chan bitswapUploadCmd, 100),
+		wantsCmds:          make(chan bitswapWantsCmd, 100),
+		importCmds:         make(chan bitswapImportCmd, 100),
+		auditCmds:          make(chan bitswapAuditCmd, 100),
+		deleteBeforeCmds:   make(chan bitswapDeleteBeforeCmd, 100),
+		duplicates:         make(chan blocks.Block, duplicateQueueSize),
 		ctx:                ctx,
-		rootDownloadStates: make(map[root]*RootDownloadState),
-		nodeDownloadParams: make(map[cid.Cid]map[root][]NodeIndex),
+		rootDownloadStates: make(map[dl.Root]*dl.RootDownloadState),
+		nodeDownloadParams: make(map[cid.Cid]map[dl.Root][]dl.NodeIndex),
 		blockSink:          make(chan blocks.Block, 100),
-		deadlineChan:       make(chan root, 100),
+		deadlines:          newRootDeadlines(),
 		outMsgChan:         outMsgChan,
 		maxBlockSize:       maxBlockSize,
-		dataConfig: map[BitswapDataTag]BitswapDataConfig{
-			BlockBodyTag: {
-				maxSize:         1 << 26, // 64 MiB
-				downloadTimeout: time.Minute * 10,
-			},
+		dataConfig: map[dl.BitswapDataTag]dl.BitswapDataConfig{
+			dl.BlockBodyTag:     dl.NewBitswapDataConfig(maxBlockSize, maxBlockBodySize, time.Minute*10),
+			dl.EpochLedgerTag:   dl.NewBitswapDataConfig(maxBlockSize, maxEpochLedgerSize, time.Minute*30),
+			dl.StakingLedgerTag: dl.NewBitswapDataConfig(maxBlockSize, maxStakingLedgerSize, time.Minute*30),
 		},
-		depthIndices: MkDepthIndices(LinksPerBlock(maxBlockSize), math.MaxInt32),
+		depthIndices:  dl.MkDepthIndices(dl.LinksPerBlock(maxBlockSize), math.MaxInt32),
+		traceIds:      make(map[dl.Root]string),
+		dependencies:  newRootDependencies(),
+		pinned:        make(map[dl.Root][]dl.BitswapBlockLink),
+		scheduler:     newDownloadScheduler(),
+		retries:       newDownloadRetries(),
+		partialRoots:  make(map[dl.Root]*partialRoot),
+		verifications: newDownloadVerifications(),
+		uploads:       make(map[uint64]*uploadSession),
+		providers:     make(map[dl.Root][]peer.ID),
+		batches:       make(map[dl.Root]*downloadBatch),
+		rootMetadata:  make(map[dl.Root][]byte),
+		recentBlocks:  newRecentBlocks(maxRecentBlocks),
+		earlyBlocks:   dl.NewEarlyBlocks(),
 	}
 }
 
-func announceNewRootBlock(engine *bitswap.Bitswap, statusStorage codanet.BitswapStorage, bs map[BitswapBlockLink][]byte, root BitswapBlockLink) error {
+func announceNewRootBlock(engine *bitswap.Bitswap, statusStorage codanet.BitswapStorage, bs map[dl.BitswapBlockLink][]byte, root dl.BitswapBlockLink) error {
 	err := statusStorage.SetStatus(root, codanet.Partial)
 	if err != nil {
 		return err
@@ -86,129 +190,354 @@ func announceNewRootBlock(engine *bitswap.Bitswap, statusStorage codanet.Bitswap
 	return statusStorage.SetStatus(root, codanet.Full)
 }
 
-func (bs *BitswapCtx) deleteRoot(root BitswapBlockLink) error {
-	if err := bs.storage.SetStatus(root, codanet.Deleting); err != nil {
-		return err
-	}
-	ClearRootDownloadState(bs, root)
-	allDescendants := []BitswapBlockLink{root}
+// rootBlocks returns the root along with all of its descendants
+// that are present in the storage
+func (bs *BitswapCtx) rootBlocks(root dl.BitswapBlockLink) ([]dl.BitswapBlockLink, error) {
+	allDescendants := []dl.BitswapBlockLink{root}
 	viewBlockF := func(b []byte) error {
-		links, _, err := ReadBitswapBlock(b)
+		links, _, err := dl.ReadBitswapBlock(b)
 		if err == nil {
 			for _, l := range links {
-				var l2 BitswapBlockLink
+				var l2 dl.BitswapBlockLink
 				copy(l2[:], l[:])
 				allDescendants = append(allDescendants, l2)
 			}
 		}
 		return err
 	}
-	for _, block := range allDescendants {
-		if err := bs.storage.ViewBlock(block, viewBlockF); err != nil && err != blockstore.ErrNotFound {
-			return err
+	for i := 0; i < len(allDescendants); i++ {
+		// Links of blocks failing their checksums can't be followed,
+		// their descendants are left to garbage collection
+		err := bs.storage.ViewBlock(allDescendants[i], viewBlockF)
+		if err != nil && err != blockstore.ErrNotFound && !errors.Is(err, codanet.ErrBlockChecksum) {
+			return nil, err
 		}
 	}
-	if err := bs.storage.DeleteBlocks(allDescendants); err != nil {
+	return allDescendants, nil
+}
+
+// deleteRoot deletes the root along with its blocks, except for
+// blocks still referenced by other roots
+func (bs *BitswapCtx) deleteRoot(root dl.BitswapBlockLink) error {
+	status, statusErr := bs.storage.GetStatus(root)
+	if err := bs.storage.SetStatus(root, codanet.Deleting); err != nil {
+		return err
+	}
+	delete(bs.partialRoots, root)
+	delete(bs.verifications.pending, root)
+	bs.scheduler.Remove(root)
+	bs.retries.Forget(root)
+	dl.ClearRootDownloadState(bs, root)
+	bs.unpinRoot(root)
+	var toDelete []dl.BitswapBlockLink
+	var err error
+	if refCounter, ok := bs.storage.(codanet.BitswapRefCounter); ok && statusErr == nil {
+		toDelete, err = bs.releaseRootBlocks(refCounter, root, status)
+	} else {
+		toDelete, err = bs.rootBlocks(root)
+	}
+	if err != nil {
+		return err
+	}
+	if err := bs.storage.DeleteBlocks(toDelete); err != nil {
+		return err
+	}
+	if err := bs.deleteRootMetadata(root); err != nil {
 		return err
 	}
 	return bs.storage.DeleteStatus(root)
 }
 
-func ClearRootDownloadState(bs BitswapState, root root) {
-	rootStates := bs.RootDownloadStates()
-	nodeParams := bs.NodeDownloadParams()
-	state, has := rootStates[root]
-	if !has {
-		return
-	}
-	delete(rootStates, root)
-	state.allDescendants.ForEach(func(c cid.Cid) error {
-		np, hasNp := nodeParams[c]
-		if hasNp {
-			delete(np, root)
-			if len(np) == 0 {
-				delete(nodeParams, c)
-			}
+// deleteResources deletes the roots, reporting the ones deleted
+// with a resource update
+func (bs *BitswapCtx) deleteResources(rootIds []dl.Root) []dl.Root {
+	success := []dl.Root{}
+	for _, root := range rootIds {
+		err := bs.deleteRoot(root)
+		if err == nil {
+			success = append(success, root)
+		} else {
+			bitswapLogger.Errorf("Error processing delete request for %s: %w", codanet.BlockHashToCidSuffix(root), err)
+			delete(bs.traceIds, root)
 		}
+	}
+	bs.SendResourceUpdates(ipc.ResourceUpdateType_removed, success...)
+	return success
+}
+
+// pinRoot protects blocks of a fully downloaded root from eviction
+func (bs *BitswapCtx) pinRoot(root dl.Root) error {
+	if _, pinned := bs.pinned[root]; pinned {
 		return nil
-	})
-	state.cancelF()
+	}
+	status, err := bs.storage.GetStatus(root)
+	if err == blockstore.ErrNotFound || (err == nil && status != codanet.Full) {
+		return fmt.Errorf("resource %s is not fully downloaded", codanet.BlockHashToCidSuffix(root))
+	}
+	if err != nil {
+		return err
+	}
+	keys, err := bs.rootBlocks(root)
+	if err != nil {
+		return err
+	}
+	if pinner, ok := bs.storage.(codanet.BitswapPinner); ok {
+		pinner.PinBlocks(keys)
+	}
+	bs.pinned[root] = keys
+	return nil
 }
 
-func (bs *BitswapCtx) SendResourceUpdate(type_ ipc.ResourceUpdateType, root root) {
+func (bs *BitswapCtx) unpinRoot(root dl.Root) {
+	bs.forgetSnapshot(root)
+	keys, pinned := bs.pinned[root]
+	if !pinned {
+		return
+	}
+	delete(bs.pinned, root)
+	if pinner, ok := bs.storage.(codanet.BitswapPinner); ok {
+		pinner.UnpinBlocks(keys)
+	}
+}
+
+func (bs *BitswapCtx) SendResourceUpdate(type_ ipc.ResourceUpdateType, root dl.Root) {
 	bs.SendResourceUpdates(type_, root)
 }
-func (bs *BitswapCtx) SendResourceUpdates(type_ ipc.ResourceUpdateType, roots ...root) {
-	// Non-blocking upcall sending
+
+// SendDownloadProgress notifies of progress of the root download, progress
+// updates are advisory and aren't redelivered if the message queue is full
+func (bs *BitswapCtx) SendDownloadProgress(root dl.Root, progress dl.DownloadProgress) {
 	select {
-	case bs.outMsgChan <- mkResourceUpdatedUpcall(type_, roots):
+	case bs.outMsgChan <- mkDownloadProgressUpcall(bs.traceIds[root], root, progress):
 	default:
+		bitswapLogger.Debugf("Skipped progress update for %s (message queue is full)", codanet.BlockHashToCidSuffix(root))
+	}
+}
+func (bs *BitswapCtx) SendResourceUpdates(type_ ipc.ResourceUpdateType, roots ...dl.Root) {
+	// Completion of roots is announced in the order of dependency hints
+	if type_ == ipc.ResourceUpdateType_added {
+		ordered := make([]dl.Root, 0, len(roots))
 		for _, root := range roots {
-			bitswapLogger.Errorf("Failed to send resource update of type %d"+
-				" for %s (message queue is full)",
-				type_, codanet.BlockHashToCidSuffix(root))
+			ordered = append(ordered, bs.dependencies.Complete(root)...)
+		}
+		bs.sendResourceUpdates(type_, ordered)
+		return
+	}
+	released := []dl.Root{}
+	for _, root := range roots {
+		released = append(released, bs.dependencies.Fail(root)...)
+	}
+	bs.sendResourceUpdates(type_, roots)
+	bs.sendResourceUpdates(ipc.ResourceUpdateType_added, released)
+}
+
+func (bs *BitswapCtx) sendResourceUpdates(type_ ipc.ResourceUpdateType, roots []dl.Root) {
+	// Roots are split to consecutive groups with the same trace ID, so that
+	// each update carries the trace ID of the command that initiated
+	// processing of its roots and the order of roots is preserved
+	for len(roots) > 0 {
+		traceId := bs.traceIds[roots[0]]
+		n := 1
+		for n < len(roots) && bs.traceIds[roots[n]] == traceId {
+			n++
+		}
+		group := roots[:n]
+		roots = roots[n:]
+		for _, root := range group {
+			delete(bs.traceIds, root)
+			delete(bs.providers, root)
+			delete(bs.batches, root)
+			bs.retries.Forget(root)
+			if traceId != "" {
+				bitswapLogger.Debugw("resource updated", "root", codanet.BlockHashToCidSuffix(root),
+					"type", type_.String(), "trace_id", traceId)
+			}
+		}
+		if type_ == ipc.ResourceUpdateType_added {
+			bs.availability.Announce(group...)
+		}
+		u := bs.updateLog.Record(type_, traceId, group, time.Now())
+		// Non-blocking upcall sending
+		select {
+		case bs.outMsgChan <- u.upcall():
+		default:
+			for _, root := range group {
+				bitswapLogger.Errorf("Failed to send resource update #%d of type %d"+
+					" for %s (message queue is full)",
+					u.seqno, type_, codanet.BlockHashToCidSuffix(root))
+			}
 		}
 	}
 }
 
+// abandonRoot releases roots waiting for the root
+// which won't be announced as added
+func (bs *BitswapCtx) abandonRoot(root dl.Root) {
+	if !bs.dependencies.held[root] {
+		bs.sendResourceUpdates(ipc.ResourceUpdateType_added, bs.dependencies.Fail(root))
+	}
+}
+
+func (bs *BitswapCtx) registerTraceId(traceId string, roots ...dl.Root) {
+	if traceId == "" {
+		return
+	}
+	for _, root := range roots {
+		bs.traceIds[root] = traceId
+		bitswapLogger.Debugw("processing root", "root", codanet.BlockHashToCidSuffix(root), "trace_id", traceId)
+	}
+}
+
 func (bs *BitswapCtx) CheckInvariants() {
 	// No checking invariants in production
 }
-func (bs *BitswapCtx) NodeDownloadParams() map[cid.Cid]map[root][]NodeIndex {
+func (bs *BitswapCtx) NodeDownloadParams() map[cid.Cid]map[dl.Root][]dl.NodeIndex {
 	return bs.nodeDownloadParams
 }
-func (bs *BitswapCtx) RootDownloadStates() map[root]*RootDownloadState  { return bs.rootDownloadStates }
-func (bs *BitswapCtx) MaxBlockSize() int                                { return bs.maxBlockSize }
-func (bs *BitswapCtx) DataConfig() map[BitswapDataTag]BitswapDataConfig { return bs.dataConfig }
-func (bs *BitswapCtx) DepthIndices() DepthIndices                       { return bs.depthIndices }
-func (bs *BitswapCtx) NewSession(downloadTimeout time.Duration) (BlockRequester, context.CancelFunc) {
-	ctx, cancelF := context.WithTimeout(bs.ctx, downloadTimeout)
+func (bs *BitswapCtx) RootDownloadStates() map[dl.Root]*dl.RootDownloadState {
+	return bs.rootDownloadStates
+}
+func (bs *BitswapCtx) MaxBlockSize() int                                      { return bs.maxBlockSize }
+func (bs *BitswapCtx) DataConfig() map[dl.BitswapDataTag]dl.BitswapDataConfig { return bs.dataConfig }
+func (bs *BitswapCtx) DepthIndices() dl.DepthIndices                          { return bs.depthIndices }
+func (bs *BitswapCtx) Now() time.Time                                         { return time.Now() }
+func (bs *BitswapCtx) EarlyBlocks() *dl.EarlyBlocks                           { return bs.earlyBlocks }
+func (bs *BitswapCtx) ObserveDownload(state *dl.RootDownloadState, outcome string) {
+	observeRootDownload(state, outcome)
+}
+
+// NewSession creates a session downloading blocks of the root, peers
+// hinted to provide the root are hinted as providers of its blocks.
+// Roots of a batch join the session of the batch instead.
+func (bs *BitswapCtx) NewSession(downloadTimeout time.Duration, root dl.Root) (dl.BlockRequester, context.CancelFunc) {
+	if b, has := bs.batches[root]; has {
+		return b.join(bs, root)
+	}
+	var ctx context.Context
+	var cancelF context.CancelFunc
+	if downloadTimeout > 0 {
+		ctx, cancelF = context.WithTimeout(bs.ctx, downloadTimeout)
+	} else {
+		ctx, cancelF = context.WithCancel(bs.ctx)
+	}
 	s := bs.engine.NewSession(ctx)
 	return &BitswapBlockRequester{
-		fetcher: s,
-		ctx:     ctx,
-		sink:    bs.blockSink,
+		fetcher:   s,
+		ctx:       ctx,
+		sink:      bs.blockSink,
+		hints:     bs.providerHints,
+		providers: bs.providers[root],
 	}, cancelF
 }
-func (bs *BitswapCtx) RegisterDeadlineTracker(root_ root, downloadTimeout time.Duration) {
-	go func() {
-		<-time.After(downloadTimeout)
-		if _, has := bs.rootDownloadStates[root_]; has {
-			bs.deadlineChan <- root_
-		}
-	}()
+func (bs *BitswapCtx) SetDeadline(root_ dl.Root, timeout time.Duration) {
+	bs.deadlines.Set(root_, time.Now().Add(timeout))
+}
+func (bs *BitswapCtx) CancelDeadline(root_ dl.Root) {
+	bs.deadlines.Cancel(root_)
 }
 func (bs *BitswapCtx) GetStatus(key [32]byte) (codanet.RootBlockStatus, error) {
 	return bs.storage.GetStatus(key)
 }
 func (bs *BitswapCtx) SetStatus(key [32]byte, value codanet.RootBlockStatus) error {
-	return bs.storage.SetStatus(key, value)
+	prev, prevErr := bs.storage.GetStatus(key)
+	if err := bs.storage.SetStatus(key, value); err != nil {
+		return err
+	}
+	bs.trackPartialRoot(key, value)
+	becameFull := prevErr == blockstore.ErrNotFound || (prevErr == nil && prev != codanet.Full)
+	if value == codanet.Full && becameFull {
+		bs.refRootBlocks(key)
+		bs.seedSnapshot(key)
+	}
+	return nil
 }
 func (bs *BitswapCtx) DeleteStatus(key [32]byte) error    { return bs.storage.DeleteStatus(key) }
 func (bs *BitswapCtx) DeleteBlocks(keys [][32]byte) error { return bs.storage.DeleteBlocks(keys) }
 func (bs *BitswapCtx) ViewBlock(key [32]byte, callback func([]byte) error) error {
 	return bs.storage.ViewBlock(key, callback)
 }
+func (bs *BitswapCtx) PutBlocks(blockMap map[[32]byte][]byte) error {
+	return bs.storage.PutBlocks(blockMap)
+}
+func (bs *BitswapCtx) GetBlocks(keys [][32]byte) (map[[32]byte][]byte, error) {
+	return bs.storage.GetBlocks(keys)
+}
 
 type BitswapBlockRequester struct {
-	fetcher exchange.Fetcher
-	ctx     context.Context
-	sink    chan<- blocks.Block
+	fetcher   exchange.Fetcher
+	ctx       context.Context
+	sink      chan<- blocks.Block
+	hints     *codanet.ProviderHints
+	providers []peer.ID
 }
 
 func (br *BitswapBlockRequester) RequestBlocks(ids []cid.Cid) error {
+	// Hints are kept while blocks are awaited
+	hinted := br.hints != nil && len(br.providers) > 0
+	if hinted {
+		br.hints.Add(ids, br.providers)
+	}
 	ch, err := br.fetcher.GetBlocks(br.ctx, ids)
 	if err != nil {
+		if hinted {
+			br.hints.Remove(ids, br.providers)
+		}
 		return err
 	}
 	go func() {
 		for v := range ch {
 			br.sink <- v
 		}
+		if hinted {
+			br.hints.Remove(ids, br.providers)
+		}
 	}()
 	return nil
 }
 
+// addResource splits data to blocks and announces them,
+// reporting the root with a resource update; blocks are
+// returned along with the root
+func (bs *BitswapCtx) addResource(tag dl.BitswapDataTag, data []byte, traceId string) (map[dl.BitswapBlockLink][]byte, dl.BitswapBlockLink, error) {
+	dataConf, hasDC := bs.dataConfig[tag]
+	if !hasDC || len(data) > dataConf.MaxSize {
+		bitswapLogger.Errorf("Failed to add resource of %d bytes with tag %d (tag not supported or data too large)",
+			len(data), tag)
+		return nil, dl.BitswapBlockLink{}, fmt.Errorf("tag %d not supported or data of %d bytes too large", tag, len(data))
+	}
+	var blocks map[dl.BitswapBlockLink][]byte
+	var root dl.BitswapBlockLink
+	if dataConf.BlockSize == 0 || dataConf.BlockSize == bs.maxBlockSize {
+		blocks, root = dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(bs.maxBlockSize, data, tag)
+	} else {
+		blocks, root = dl.SplitDataToBitswapBlocksWithBlockSize(dataConf.BlockSize, data, tag)
+	}
+	bs.registerTraceId(traceId, root)
+	err := announceNewRootBlock(bs.engine, bs, blocks, root)
+	if err == nil {
+		bs.SendResourceUpdate(ipc.ResourceUpdateType_added, root)
+	} else {
+		bitswapLogger.Errorf("Failed to announce root cid %s (%w)", codanet.BlockHashToCidSuffix(root), err)
+		delete(bs.traceIds, root)
+	}
+	return blocks, root, err
+}
+
+// receivedBlocks returns the block along with blocks of sessions
+// buffered in the sink after it, so that they're processed in a batch
+func (bs *BitswapCtx) receivedBlocks(block blocks.Block) []blocks.Block {
+	batch := []blocks.Block{block}
+	for len(batch) < cap(bs.blockSink) {
+		select {
+		case b := <-bs.blockSink:
+			batch = append(batch, b)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
 // BitswapLoop: Bitswap processing loop
 //  Do not launch more than one instance of it
 func (bs *BitswapCtx) Loop() {
@@ -219,48 +548,156 @@ func (bs *BitswapCtx) Loop() {
 			panic("BitswapLoop: context not configured")
 		}
 	}
+	redeliveryTicker := time.NewTicker(resourceUpdateRedeliveryCheck)
+	defer redeliveryTicker.Stop()
+	retryTicker := time.NewTicker(downloadRetryCheck)
+	defer retryTicker.Stop()
+	verificationTicker := time.NewTicker(verificationTimeoutCheck)
+	defer verificationTicker.Stop()
+	uploadTicker := time.NewTicker(uploadSessionTimeoutCheck)
+	defer uploadTicker.Stop()
+	duplicateSuppressionTicker := time.NewTicker(duplicateSuppressionCheck)
+	defer duplicateSuppressionTicker.Stop()
 	for {
 		select {
 		case <-bs.ctx.Done():
 			return
-		case root := <-bs.deadlineChan:
+		case now := <-redeliveryTicker.C:
+			bs.redeliverResourceUpdates(now, false)
+		case now := <-retryTicker.C:
+			bs.retryDownloads(now)
+			bs.startDownloads()
+		case now := <-verificationTicker.C:
+			if bs.verifications.Len() > 0 {
+				configuredCheck()
+				bs.expireVerifications(now)
+			}
+		case now := <-bs.deadlines.C():
 			configuredCheck()
-			ClearRootDownloadState(bs, root)
+			for _, root := range bs.deadlines.Expired(now) {
+				bs.timeOutRoot(root, now)
+			}
+			bs.startDownloads()
 		case cmd := <-bs.addCmds:
 			configuredCheck()
-			blocks, root := SplitDataToBitswapBlocksLengthPrefixedWithTag(bs.maxBlockSize, cmd.data, BlockBodyTag)
-			err := announceNewRootBlock(engine, storage, blocks, root)
-			if err == nil {
-				bs.SendResourceUpdate(ipc.ResourceUpdateType_added, root)
-			} else {
-				bitswapLogger.Errorf("Failed to announce root cid %s (%w)", codanet.BlockHashToCidSuffix(root), err)
+			if _, root, err := bs.addResource(cmd.tag, cmd.data, cmd.traceId); err == nil {
+				bs.setRootMetadata(root, cmd.metadata)
 			}
+		case cmd := <-bs.publishCmds:
+			configuredCheck()
+			cmd.result <- bs.publishResource(cmd.tag, cmd.data)
+		case cmd := <-bs.uploadCmds:
+			configuredCheck()
+			bs.handleUpload(cmd, time.Now())
+		case <-duplicateSuppressionTicker.C:
+			bs.adjustProviderFanOut()
+		case b := <-bs.duplicates:
+			bs.attributeDuplicate(b)
+		case now := <-uploadTicker.C:
+			bs.expireUploads(now)
 		case cmd := <-bs.deleteCmds:
 			configuredCheck()
-			success := []root{}
-			for _, root := range cmd.rootIds {
-				err := bs.deleteRoot(root)
-				if err == nil {
-					success = append(success, root)
-				} else {
-					bitswapLogger.Errorf("Error processing delete request for %s: %w", codanet.BlockHashToCidSuffix(root), err)
-				}
+			bs.registerTraceId(cmd.traceId, cmd.rootIds...)
+			bs.deleteResources(cmd.rootIds)
+			bs.startDownloads()
+		case cmd := <-bs.deleteBeforeCmds:
+			configuredCheck()
+			cmd.result <- bs.deleteResourcesBefore(cmd.bound)
+			bs.startDownloads()
+		case cmd := <-bs.pinCmds:
+			configuredCheck()
+			if cmd.pin {
+				cmd.result <- bs.pinRoot(cmd.root)
+			} else {
+				bs.unpinRoot(cmd.root)
+				cmd.result <- nil
 			}
-			bs.SendResourceUpdates(ipc.ResourceUpdateType_removed, success...)
+		case cmd := <-bs.revalidateCmds:
+			configuredCheck()
+			cmd.result <- bs.revalidateRoot(cmd.root)
+		case cmd := <-bs.cancelCmds:
+			configuredCheck()
+			cmd.result <- bs.cancelDownload(cmd.root)
+			bs.startDownloads()
+		case cmd := <-bs.gcCmds:
+			configuredCheck()
+			cmd.result <- bs.collectGarbage(cmd)
+		case cmd := <-bs.reapCmds:
+			configuredCheck()
+			cmd.result <- bs.reapStaleRoots(cmd)
+		case cmd := <-bs.wantsCmds:
+			configuredCheck()
+			cmd.result <- bs.listWants()
+		case cmd := <-bs.importCmds:
+			configuredCheck()
+			cmd.result <- bs.importResource(cmd)
+		case cmd := <-bs.auditCmds:
+			configuredCheck()
+			cmd.result <- bs.auditRoot(cmd.root)
+		case cmd := <-bs.verdictCmds:
+			configuredCheck()
+			bs.completeVerification(cmd.root, cmd.accept)
+			bs.startDownloads()
 		case cmd := <-bs.downloadCmds:
 			configuredCheck()
 			// We put all ids to map to avoid
 			// unneccessary querying in case of id duplicates
-			m := make(map[BitswapBlockLink]bool)
+			m := make(map[dl.BitswapBlockLink]bool)
+			roots := make([]dl.Root, 0, len(cmd.rootIds))
 			for _, root := range cmd.rootIds {
+				if !m[root] {
+					roots = append(roots, root)
+				}
 				m[root] = true
 			}
-			for root := range m {
-				kickStartRootDownload(root, cmd.tag, bs)
+			for _, dep := range cmd.dependencies {
+				// Hints are only registered for parents that are being downloaded,
+				// otherwise children would wait for them forever
+				_, parentDownloading := bs.rootDownloadStates[dep.parent]
+				parentQueued := bs.scheduler.Queued(dep.parent) || bs.retries.Waiting(dep.parent)
+				if (m[dep.parent] || parentDownloading || parentQueued) && m[dep.child] {
+					if !bs.dependencies.Add(dep.parent, dep.child) {
+						bitswapLogger.Warnf("Ignoring cyclic dependency hint %s -> %s",
+							codanet.BlockHashToCidSuffix(dep.parent), codanet.BlockHashToCidSuffix(dep.child))
+					}
+				}
+			}
+			for root, providers := range cmd.providers {
+				if m[root] {
+					bs.providers[root] = providers
+				}
+			}
+			if cmd.batch {
+				bs.batchRoots(roots)
+			}
+			for _, root := range roots {
+				bs.setRootMetadata(root, cmd.metadata[root])
+			}
+			inline := bs.storeInlineBlocks(cmd.inlineBlocks, m)
+			priority := bs.stakingLedgers.downloadPriority(cmd.tag, cmd.priority, time.Now())
+			// Ancestors are queued first
+			for _, root := range bs.dependencies.Order(roots) {
+				if _, downloading := bs.rootDownloadStates[root]; downloading || bs.verifications.Pending(root) {
+					continue
+				}
+				if inline[root] {
+					// Nothing is fetched for roots delivered inline,
+					// they aren't subject to the limit of the scheduler
+					bs.scheduler.Remove(root)
+					bs.retries.Forget(root)
+					bs.startDownload(queuedDownload{root: root, tag: cmd.tag, priority: priority, traceId: cmd.traceId})
+				} else {
+					bs.scheduler.Enqueue(root, cmd.tag, priority, cmd.traceId)
+				}
 			}
+			bs.startDownloads()
 		case block := <-bs.blockSink:
 			configuredCheck()
-			processDownloadedBlock(block, bs)
+			batch := bs.receivedBlocks(block)
+			bs.rememberBlockRoots(batch)
+			dl.ProcessDownloadedBlocks(batch, bs)
+			bs.startDownloads()
 		}
+		bs.signalBackpressure()
 	}
 }
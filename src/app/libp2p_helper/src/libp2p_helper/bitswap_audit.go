@@ -0,0 +1,252 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"context"
+	"errors"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"golang.org/x/crypto/blake2b"
+)
+
+type keyLister interface {
+	AllKeysChan(ctx context.Context) (<-chan cid.Cid, error)
+}
+
+type blockstoreScan struct {
+	blocks int
+	// blocks not matching their hashes
+	corrupted map[dl.BitswapBlockLink]bool
+	// blocks having a status, i.e. root blocks of roots
+	roots []dl.Root
+}
+
+// scanStorageBlocks re-hashes every block of the storage. Blocks that
+// can't be read (e.g. failing to decompress) are counted as corrupted.
+func scanStorageBlocks(ctx context.Context, storage codanet.BitswapStorage) (blockstoreScan, error) {
+	res := blockstoreScan{corrupted: make(map[dl.BitswapBlockLink]bool)}
+	lister, ok := storage.(keyLister)
+	if !ok {
+		return res, errors.New("storage doesn't support listing blocks")
+	}
+	ch, err := lister.AllKeysChan(ctx)
+	if err != nil {
+		return res, err
+	}
+	for id := range ch {
+		key, ok := codanet.CidToBlockHash(id)
+		if !ok {
+			continue
+		}
+		var matches bool
+		err := storage.ViewBlock(key, func(b []byte) error {
+			matches = blake2b.Sum256(b) == key
+			return nil
+		})
+		if err == blockstore.ErrNotFound {
+			// Deleted since listed
+			continue
+		}
+		res.blocks++
+		if err != nil || !matches {
+			res.corrupted[key] = true
+		}
+		if _, err := storage.GetStatus(key); err == nil {
+			res.roots = append(res.roots, key)
+		}
+	}
+	return res, ctx.Err()
+}
+
+type auditedRoot struct {
+	// root was being downloaded or verified, or it was deleted
+	skipped bool
+	// status of the root was changed
+	repaired bool
+	// blocks of the tree not matching their hashes
+	corrupted []dl.BitswapBlockLink
+	err       error
+}
+
+type bitswapAuditCmd struct {
+	root   dl.Root
+	result chan<- auditedRoot
+}
+
+// auditRoot checks the status of a root against its tree. A full root with
+// an inconsistent tree is downgraded to partial (as by revalidateResource)
+// and a partial root with a complete tree is completed as if downloaded.
+// Corrupted blocks of the tree are deleted and the root is reported with
+// a corrupted resource update.
+func (bs *BitswapCtx) auditRoot(r dl.Root) auditedRoot {
+	var res auditedRoot
+	if _, downloading := bs.rootDownloadStates[r]; downloading || bs.verifications.Pending(r) {
+		res.skipped = true
+		return res
+	}
+	status, err := bs.storage.GetStatus(r)
+	if err == blockstore.ErrNotFound || (err == nil && status == codanet.Deleting) {
+		res.skipped = true
+		return res
+	}
+	if err != nil {
+		res.err = err
+		return res
+	}
+	v, err := validateRootTree(bs.storage, r, bs.maxBlockSize, bs.depthIndices, bs.dataConfig)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	res.corrupted = v.corrupted
+	if len(v.corrupted) > 0 {
+		bs.sendResourceUpdates(ipc.ResourceUpdateType_corrupted, []dl.Root{r})
+	}
+	switch {
+	case status == codanet.Full && v.problem != nil:
+		res.err = bs.downgradeRoot(r, v)
+		res.repaired = res.err == nil
+	case status == codanet.Partial && v.problem == nil:
+		var tag dl.BitswapDataTag
+		res.err = bs.storage.ViewBlock(r, func(b []byte) error {
+			_, data, err := dl.ReadBitswapBlock(b)
+			if err == nil {
+				tag, _, err = dl.ReadRootBlock(data, bs.maxBlockSize, bs.dataConfig)
+			}
+			return err
+		})
+		if res.err != nil {
+			return res
+		}
+		bitswapLogger.Infof("Completing resource %s left partial with a complete tree", codanet.BlockHashToCidSuffix(r))
+		bs.scheduler.Remove(r)
+		bs.retries.Forget(r)
+		res.repaired = true
+		if bs.VerifyRoot(r, tag) {
+			return res
+		}
+		if res.err = bs.SetStatus(r, codanet.Full); res.err == nil {
+			bs.SendResourceUpdate(ipc.ResourceUpdateType_added, r)
+		}
+	case len(v.corrupted) > 0:
+		// Blocks of a partial root are downloaded again
+		res.err = bs.storage.DeleteBlocks(v.corrupted)
+	}
+	return res
+}
+
+type blockstoreAuditReport struct {
+	blocks          int
+	corruptedBlocks int
+	roots           int
+	repairedRoots   int
+	corruptedRoots  int
+	skippedRoots    int
+	err             error
+}
+
+// auditBlockstore scans the storage and audits roots found one at a time,
+// so that the Bitswap loop isn't held for the whole audit
+func (app *app) auditBlockstore(ctx context.Context) blockstoreAuditReport {
+	var report blockstoreAuditReport
+	scan, err := scanStorageBlocks(ctx, app.bitswapCtx.storage)
+	report.blocks = scan.blocks
+	report.corruptedBlocks = len(scan.corrupted)
+	if err != nil {
+		report.err = err
+		return report
+	}
+	for _, root := range scan.roots {
+		result := make(chan auditedRoot, 1)
+		app.bitswapCtx.auditCmds <- bitswapAuditCmd{root: root, result: result}
+		var res auditedRoot
+		select {
+		case <-ctx.Done():
+			report.err = ctx.Err()
+			return report
+		case res = <-result:
+		}
+		if res.err != nil {
+			bitswapLogger.Errorf("Failed to audit resource %s: %s", codanet.BlockHashToCidSuffix(root), res.err)
+		}
+		if res.skipped {
+			report.skippedRoots++
+			continue
+		}
+		report.roots++
+		if res.repaired {
+			report.repairedRoots++
+		}
+		if len(res.corrupted) > 0 {
+			report.corruptedRoots++
+		}
+	}
+	return report
+}
+
+// startBlockstoreAudit runs an audit unless another one is running,
+// the report is sent once it's done
+func (app *app) startBlockstoreAudit() error {
+	app.auditMutex.Lock()
+	defer app.auditMutex.Unlock()
+	if app.auditing {
+		return errors.New("a blockstore audit is already running")
+	}
+	app.auditing = true
+	bitswapLogger.Info("Starting blockstore audit")
+	go func() {
+		report := app.auditBlockstore(app.Ctx)
+		app.auditMutex.Lock()
+		app.auditing = false
+		app.auditMutex.Unlock()
+		if app.Ctx.Err() != nil {
+			return
+		}
+		bitswapLogger.Infof("Blockstore audit done: %d blocks (%d corrupted), %d roots (%d repaired, %d corrupted, %d skipped)",
+			report.blocks, report.corruptedBlocks, report.roots, report.repairedRoots, report.corruptedRoots, report.skippedRoots)
+		app.writeMsg(mkBlockstoreAuditedUpcall(report))
+	}()
+	return nil
+}
+
+func mkBlockstoreAuditedUpcall(report blockstoreAuditReport) *capnp.Message {
+	return mkPushMsg(func(m ipc.DaemonInterface_PushMessage) {
+		im, err := m.NewBlockstoreAudited()
+		panicOnErr(err)
+		im.SetBlocks(uint64(report.blocks))
+		im.SetCorruptedBlocks(uint32(report.corruptedBlocks))
+		im.SetRoots(uint32(report.roots))
+		im.SetRepairedRoots(uint32(report.repairedRoots))
+		im.SetCorruptedRoots(uint32(report.corruptedRoots))
+		im.SetSkippedRoots(uint32(report.skippedRoots))
+		if report.err != nil {
+			panicOnErr(im.SetError(report.err.Error()))
+		}
+	})
+}
+
+type AuditBlockstoreReqT = ipc.Libp2pHelperInterface_AuditBlockstore_Request
+type AuditBlockstoreReq AuditBlockstoreReqT
+
+func fromAuditBlockstoreReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.AuditBlockstore()
+	return AuditBlockstoreReq(i), err
+}
+
+func (m AuditBlockstoreReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	if err := app.startBlockstoreAudit(); err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewAuditBlockstore()
+		panicOnErr(err)
+	})
+}
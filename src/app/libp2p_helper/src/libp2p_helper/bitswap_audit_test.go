@@ -0,0 +1,80 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"context"
+	"math"
+	"testing"
+
+	ipc "libp2p_ipc"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditBlockstore(t *testing.T) {
+	bs, storage, outChan := mkReaperTestCtx()
+	bs.maxBlockSize = 1000
+	bs.depthIndices = dl.MkDepthIndices(dl.LinksPerBlock(1000), math.MaxInt32)
+
+	fullMap, fullRoot := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, make([]byte, 20000), dl.BlockBodyTag)
+	require.NoError(t, storage.PutBlocks(fullMap))
+	require.NoError(t, bs.SetStatus(fullRoot, codanet.Full))
+	data := make([]byte, 30000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	partialMap, partialRoot := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, data, dl.BlockBodyTag)
+	require.NoError(t, storage.PutBlocks(partialMap))
+	require.NoError(t, bs.SetStatus(partialRoot, codanet.Partial))
+
+	// Block of the full root with contents not matching the hash
+	var corrupted dl.BitswapBlockLink
+	for h, b := range fullMap {
+		if h != fullRoot {
+			corrupted = h
+			b = append([]byte{}, b...)
+			b[len(b)-1]++
+			block, err := blocks.NewBlockWithCid(b, codanet.BlockHashToCid(h))
+			require.NoError(t, err)
+			require.NoError(t, storage.DeleteBlocks([][32]byte{h}))
+			require.NoError(t, storage.Put(block))
+			break
+		}
+	}
+
+	scan, err := scanStorageBlocks(context.Background(), storage)
+	require.NoError(t, err)
+	require.Equal(t, len(fullMap)+len(partialMap), scan.blocks)
+	require.Equal(t, map[dl.BitswapBlockLink]bool{corrupted: true}, scan.corrupted)
+	require.ElementsMatch(t, []dl.Root{fullRoot, partialRoot}, scan.roots)
+
+	res := bs.auditRoot(fullRoot)
+	require.NoError(t, res.err)
+	require.True(t, res.repaired)
+	require.Equal(t, []dl.BitswapBlockLink{corrupted}, res.corrupted)
+	requireReaperTestUpdate(t, outChan, ipc.ResourceUpdateType_corrupted, fullRoot)
+	status, err := storage.GetStatus(fullRoot)
+	require.NoError(t, err)
+	require.Equal(t, codanet.Partial, status)
+	has, err := storage.Has(codanet.BlockHashToCid(corrupted))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// Partial root with a complete tree is completed
+	res = bs.auditRoot(partialRoot)
+	require.NoError(t, res.err)
+	require.True(t, res.repaired)
+	require.Empty(t, res.corrupted)
+	requireReaperTestUpdate(t, outChan, ipc.ResourceUpdateType_added, partialRoot)
+	status, err = storage.GetStatus(partialRoot)
+	require.NoError(t, err)
+	require.Equal(t, codanet.Full, status)
+
+	// Consistent roots are left as they are
+	res = bs.auditRoot(partialRoot)
+	require.NoError(t, res.err)
+	require.False(t, res.repaired)
+	require.Empty(t, outChan)
+}
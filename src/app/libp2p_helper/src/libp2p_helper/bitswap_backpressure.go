@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var bitswapBackpressureMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "Mina_libp2p_bitswap_download_backpressure",
+	Help: "1 while the daemon is signalled to pause requesting downloads, 0 otherwise",
+})
+
+// downloadBackpressure tells the daemon to pause requesting downloads
+// while the helper can't keep up with them, rather than have requests
+// time out. The helper is busy once roots queued for a download slot or
+// received blocks waiting to be written to the blockstore reach their
+// high watermark, and ready again once both drop to their low
+// watermarks. A zero high watermark disables the respective signal.
+//
+// State is only accessed from the Bitswap loop, configuration may be
+// updated concurrently.
+type downloadBackpressure struct {
+	rootsHigh, rootsLow   int
+	blocksHigh, blocksLow int
+	mutex                 sync.Mutex
+	// state last signalled to the daemon
+	busy bool
+}
+
+func (b *downloadBackpressure) Configure(rootsHigh, rootsLow, blocksHigh, blocksLow int) error {
+	if (rootsHigh > 0 && rootsLow >= rootsHigh) || (blocksHigh > 0 && blocksLow >= blocksHigh) {
+		return errors.New("low watermark of download backpressure isn't below the high one")
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.rootsHigh, b.rootsLow = rootsHigh, rootsLow
+	b.blocksHigh, b.blocksLow = blocksHigh, blocksLow
+	return nil
+}
+
+// readDownloadBackpressureConfig returns the watermarks of queued roots and
+// blocks, the latter may not exceed the capacity of the queue of blocks
+func readDownloadBackpressureConfig(c ipc.DownloadBackpressureConfig, maxQueuedBlocks int) (rootsHigh, rootsLow, blocksHigh, blocksLow int, err error) {
+	if int(c.QueuedBlocksHigh()) > maxQueuedBlocks {
+		return 0, 0, 0, 0, fmt.Errorf("high watermark of queued blocks exceeds %d", maxQueuedBlocks)
+	}
+	return int(c.QueuedRootsHigh()), int(c.QueuedRootsLow()), int(c.QueuedBlocksHigh()), int(c.QueuedBlocksLow()), nil
+}
+
+// next returns whether the helper is busy with the given
+// load, depending on the state last signalled
+func (b *downloadBackpressure) next(queuedRoots, queuedBlocks int) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.busy {
+		return (b.rootsHigh > 0 && queuedRoots >= b.rootsHigh) ||
+			(b.blocksHigh > 0 && queuedBlocks >= b.blocksHigh)
+	}
+	rootsReady := b.rootsHigh == 0 || queuedRoots <= b.rootsLow
+	blocksReady := b.blocksHigh == 0 || queuedBlocks <= b.blocksLow
+	return !(rootsReady && blocksReady)
+}
+
+// signalBackpressure notifies the daemon once the helper becomes busy or
+// ready. A signal not sent because the message queue is full is retried
+// by the next check, which follows every iteration of the Bitswap loop.
+func (bs *BitswapCtx) signalBackpressure() {
+	queuedRoots, queuedBlocks := bs.scheduler.Len(), len(bs.blockSink)
+	busy := bs.backpressure.next(queuedRoots, queuedBlocks)
+	if busy == bs.backpressure.busy {
+		return
+	}
+	select {
+	case bs.outMsgChan <- mkDownloadBackpressureUpcall(busy, queuedRoots, queuedBlocks):
+	default:
+		bitswapLogger.Debug("Postponed download backpressure signal (message queue is full)")
+		return
+	}
+	bs.backpressure.busy = busy
+	if busy {
+		bitswapLogger.Infof("Downloads are saturated (%d roots, %d blocks queued), signalled the daemon to pause", queuedRoots, queuedBlocks)
+		bitswapBackpressureMetric.Set(1)
+	} else {
+		bitswapLogger.Info("Downloads are no longer saturated, signalled the daemon to resume")
+		bitswapBackpressureMetric.Set(0)
+	}
+}
+
+func mkDownloadBackpressureUpcall(busy bool, queuedRoots, queuedBlocks int) *capnp.Message {
+	return mkPushMsg(func(m ipc.DaemonInterface_PushMessage) {
+		im, err := m.NewDownloadBackpressure()
+		panicOnErr(err)
+		im.SetBusy(busy)
+		im.SetQueuedRoots(uint32(queuedRoots))
+		im.SetQueuedBlocks(uint32(queuedBlocks))
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"testing"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadBackpressure(t *testing.T) {
+	var b downloadBackpressure
+	require.Error(t, b.Configure(10, 10, 0, 0))
+	require.Error(t, b.Configure(0, 0, 5, 8))
+
+	// Disabled by default
+	require.False(t, b.next(1000, 100))
+
+	require.NoError(t, b.Configure(10, 4, 80, 20))
+	require.False(t, b.next(9, 79))
+	require.True(t, b.next(10, 0))
+	require.True(t, b.next(0, 80))
+
+	// Busy until both drop to their low watermarks
+	b.busy = true
+	require.True(t, b.next(5, 0))
+	require.True(t, b.next(4, 21))
+	require.False(t, b.next(4, 20))
+
+	// Disabling the backpressure makes the helper ready
+	require.NoError(t, b.Configure(0, 0, 0, 0))
+	require.False(t, b.next(1000, 100))
+}
+
+func requireBackpressureTestSignal(t *testing.T, outChan chan *capnp.Message, busy bool, queuedRoots int) {
+	require.NotEmpty(t, outChan)
+	msg, err := ipc.ReadRootDaemonInterface_Message(<-outChan)
+	require.NoError(t, err)
+	pm, err := msg.PushMessage()
+	require.NoError(t, err)
+	db, err := pm.DownloadBackpressure()
+	require.NoError(t, err)
+	require.Equal(t, busy, db.Busy())
+	require.Equal(t, uint32(queuedRoots), db.QueuedRoots())
+}
+
+func TestSignalBackpressure(t *testing.T) {
+	bs, _, outChan := mkReaperTestCtx()
+	require.NoError(t, bs.backpressure.Configure(2, 0, 0, 0))
+	bs.scheduler.Enqueue(dl.Root{1}, dl.BlockBodyTag, ipc.DownloadPriority_normal, "")
+	bs.signalBackpressure()
+	require.Empty(t, outChan)
+
+	// Only transitions are signalled
+	bs.scheduler.Enqueue(dl.Root{2}, dl.BlockBodyTag, ipc.DownloadPriority_normal, "")
+	bs.signalBackpressure()
+	requireBackpressureTestSignal(t, outChan, true, 2)
+	bs.scheduler.Remove(dl.Root{1})
+	bs.signalBackpressure()
+	require.Empty(t, outChan)
+	bs.scheduler.Remove(dl.Root{2})
+	bs.signalBackpressure()
+	requireBackpressureTestSignal(t, outChan, false, 0)
+
+	// Signals not sent are retried
+	for len(outChan) < cap(outChan) {
+		outChan <- mkDownloadBackpressureUpcall(false, 0, 0)
+	}
+	require.NoError(t, bs.backpressure.Configure(0, 0, 1, 0))
+	bs.blockSink <- blocks.NewBlock([]byte("block"))
+	bs.signalBackpressure()
+	require.False(t, bs.backpressure.busy)
+	for len(outChan) > 0 {
+		<-outChan
+	}
+	bs.signalBackpressure()
+	require.True(t, bs.backpressure.busy)
+	requireBackpressureTestSignal(t, outChan, true, 0)
+}
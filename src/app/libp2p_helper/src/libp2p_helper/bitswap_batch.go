@@ -0,0 +1,150 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"context"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	exchange "github.com/ipfs/go-ipfs-exchange-interface"
+)
+
+// downloadBatch is a Bitswap session shared by roots requested together,
+// so that peers found to have blocks of one root are asked for blocks of
+// the others first. The session is started with the first download of
+// the batch and ended once no download of the batch is in progress, it
+// has no timeout of its own: downloads time out by their deadlines.
+type downloadBatch struct {
+	session exchange.Fetcher
+	ctx     context.Context
+	cancelF context.CancelFunc
+	// downloads of the batch in progress
+	active int
+}
+
+// join starts a download of the root in the session of the batch, the
+// returned function leaves the session
+func (b *downloadBatch) join(bs *BitswapCtx, root dl.Root) (dl.BlockRequester, context.CancelFunc) {
+	if b.active == 0 {
+		b.ctx, b.cancelF = context.WithCancel(bs.ctx)
+		b.session = bs.engine.NewSession(b.ctx)
+	}
+	b.active++
+	left := false
+	leave := func() {
+		if left {
+			return
+		}
+		left = true
+		b.active--
+		if b.active == 0 {
+			b.cancelF()
+		}
+	}
+	return &BitswapBlockRequester{
+		fetcher:   b.session,
+		ctx:       b.ctx,
+		sink:      bs.blockSink,
+		hints:     bs.providerHints,
+		providers: bs.providers[root],
+	}, leave
+}
+
+// batchRoots registers roots of a batched download command, roots already
+// being downloaded keep their sessions
+func (bs *BitswapCtx) batchRoots(roots []dl.Root) {
+	b := &downloadBatch{}
+	for _, root := range roots {
+		if _, downloading := bs.rootDownloadStates[root]; downloading {
+			continue
+		}
+		bs.batches[root] = b
+	}
+}
+
+// dedupBatch drops repeated roots of resources, keeping the first
+// occurrence of each, and groups roots by their tags. Tags are listed
+// in the order of their first resources.
+func dedupBatch(resources []batchedResource) (tags []dl.BitswapDataTag, byTag map[dl.BitswapDataTag][]dl.Root, duplicates int) {
+	byTag = make(map[dl.BitswapDataTag][]dl.Root)
+	seen := make(map[dl.Root]bool, len(resources))
+	for _, r := range resources {
+		if seen[r.root] {
+			duplicates++
+			continue
+		}
+		seen[r.root] = true
+		if _, has := byTag[r.tag]; !has {
+			tags = append(tags, r.tag)
+		}
+		byTag[r.tag] = append(byTag[r.tag], r.root)
+	}
+	return
+}
+
+type batchedResource struct {
+	tag      dl.BitswapDataTag
+	root     dl.Root
+	metadata []byte
+}
+
+type DownloadResourcesReqT = ipc.Libp2pHelperInterface_DownloadResources_Request
+type DownloadResourcesReq DownloadResourcesReqT
+
+func fromDownloadResourcesReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.DownloadResources()
+	return DownloadResourcesReq(i), err
+}
+
+func (m DownloadResourcesReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	resourcesM, err := DownloadResourcesReqT(m).Resources()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	resources := make([]batchedResource, 0, resourcesM.Len())
+	for i := 0; i < resourcesM.Len(); i++ {
+		rM := resourcesM.At(i)
+		idM, err := rM.Root()
+		if err != nil {
+			return mkRpcRespError(seqno, badRPC(err))
+		}
+		root, err := extractRootBlockId(idM)
+		if err != nil {
+			return mkRpcRespError(seqno, badRPC(err))
+		}
+		metadata, err := rM.Metadata()
+		if err == nil {
+			err = checkRootMetadata(metadata)
+		}
+		if err != nil {
+			return mkRpcRespError(seqno, badRPC(err))
+		}
+		resources = append(resources, batchedResource{tag: dl.BitswapDataTag(rM.Tag()), root: root, metadata: metadata})
+	}
+	tags, byTag, duplicates := dedupBatch(resources)
+	rootMetadata := make(map[dl.Root][]byte)
+	for _, r := range resources {
+		if _, has := rootMetadata[r.root]; !has && len(r.metadata) > 0 {
+			rootMetadata[r.root] = r.metadata
+		}
+	}
+	for _, tag := range tags {
+		app.bitswapCtx.downloadCmds <- bitswapDownloadCmd{
+			rootIds:  byTag[tag],
+			tag:      tag,
+			priority: DownloadResourcesReqT(m).Priority(),
+			batch:    true,
+			metadata: rootMetadata,
+		}
+	}
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		resp, err := m.NewDownloadResources()
+		panicOnErr(err)
+		resp.SetRoots(uint32(len(resources) - duplicates))
+		resp.SetDuplicates(uint32(duplicates))
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"testing"
+
+	ipc "libp2p_ipc"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupBatch(t *testing.T) {
+	a, b, c := dl.Root{1}, dl.Root{2}, dl.Root{3}
+	tags, byTag, duplicates := dedupBatch([]batchedResource{
+		{tag: dl.EpochLedgerTag, root: a},
+		{tag: dl.BlockBodyTag, root: b},
+		{tag: dl.BlockBodyTag, root: a},
+		{tag: dl.EpochLedgerTag, root: c},
+		{tag: dl.BlockBodyTag, root: b},
+	})
+	require.Equal(t, []dl.BitswapDataTag{dl.EpochLedgerTag, dl.BlockBodyTag}, tags)
+	require.Equal(t, map[dl.BitswapDataTag][]dl.Root{
+		dl.EpochLedgerTag: {a, c},
+		dl.BlockBodyTag:   {b},
+	}, byTag)
+	require.Equal(t, 2, duplicates)
+}
+
+func TestBatchRoots(t *testing.T) {
+	bs, _, _ := mkReaperTestCtx()
+	a, b, c := dl.Root{1}, dl.Root{2}, dl.Root{3}
+	bs.rootDownloadStates[c] = &dl.RootDownloadState{}
+	bs.batchRoots([]dl.Root{a, b, c})
+	require.Len(t, bs.batches, 2)
+	require.Same(t, bs.batches[a], bs.batches[b])
+
+	// Roots leave the batch once they're reported
+	bs.SendResourceUpdate(ipc.ResourceUpdateType_added, a)
+	require.Len(t, bs.batches, 1)
+	bs.startDownload(queuedDownload{root: b, tag: dl.BitswapDataTag(255)})
+	require.Empty(t, bs.batches)
+}
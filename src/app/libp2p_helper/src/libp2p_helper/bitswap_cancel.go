@@ -0,0 +1,37 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+
+	ipc "libp2p_ipc"
+)
+
+type bitswapCancelCmd struct {
+	root dl.Root
+	// receives whether a download of the root was in flight
+	result chan<- bool
+}
+
+// cancelDownload aborts the download of a root in progress, queued or
+// waiting for a retry. Blocks fetched so far are kept and the root is left
+// partial, so that a later download continues where this one stopped (or
+// the reaper collects it). Roots waiting for the cancelled one are
+// released as if it failed.
+func (bs *BitswapCtx) cancelDownload(root dl.Root) bool {
+	state, downloading := bs.rootDownloadStates[root]
+	if !downloading && !bs.scheduler.Queued(root) && !bs.retries.Waiting(root) {
+		return false
+	}
+	if downloading {
+		observeRootDownload(state, dl.DownloadCancelled)
+	}
+	bitswapLogger.Debugw("root download cancelled", "root", codanet.BlockHashToCidSuffix(root),
+		"trace_id", bs.traceIds[root])
+	bs.scheduler.Remove(root)
+	bs.retries.Forget(root)
+	dl.ClearRootDownloadState(bs, root)
+	bs.abandonRoot(root)
+	bs.SendResourceUpdate(ipc.ResourceUpdateType_cancelled, root)
+	return true
+}
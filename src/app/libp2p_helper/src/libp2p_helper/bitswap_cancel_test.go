@@ -0,0 +1,63 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCancelDownload(t *testing.T) {
+	bs, storage, outChan := mkReaperTestCtx()
+	bs.retries.Configure(3, time.Second, time.Minute)
+	a := putPartialTestRoot(t, bs, storage, dl.BlockBodyTag)
+	b := putPartialTestRoot(t, bs, storage, dl.EpochLedgerTag)
+	c := dl.Root{3}
+	child := dl.Root{4}
+
+	// Root a is being downloaded and awaits a block
+	cancelled := false
+	bs.rootDownloadStates[a] = &dl.RootDownloadState{
+		CancelF:              func() { cancelled = true },
+		Tag:                  dl.BlockBodyTag,
+		RemainingNodeCounter: 1,
+		StartedAt:            time.Now(),
+	}
+	awaited := codanet.BlockHashToCid(dl.Root{9})
+	bs.nodeDownloadParams[awaited] = map[dl.Root][]dl.NodeIndex{a: {1}}
+	require.True(t, bs.dependencies.Add(a, child))
+	require.Empty(t, bs.dependencies.Complete(child))
+	// Root b is queued, root c waits for a retry
+	bs.scheduler.Enqueue(b, dl.EpochLedgerTag, ipc.DownloadPriority_normal, "")
+	require.True(t, bs.retries.TimedOut(c, dl.BlockBodyTag, ipc.DownloadPriority_normal, "", time.Now()))
+
+	require.True(t, bs.cancelDownload(a))
+	require.True(t, cancelled)
+	require.Empty(t, bs.rootDownloadStates)
+	require.Empty(t, bs.nodeDownloadParams)
+	// Blocks fetched so far are kept
+	status, err := storage.GetStatus(a)
+	require.NoError(t, err)
+	require.Equal(t, codanet.Partial, status)
+	requireGcTestBlock(t, storage, a, true)
+	// Child held by the cancelled root is released
+	requireReaperTestUpdate(t, outChan, ipc.ResourceUpdateType_added, child)
+	requireReaperTestUpdate(t, outChan, ipc.ResourceUpdateType_cancelled, a)
+
+	require.True(t, bs.cancelDownload(b))
+	require.False(t, bs.scheduler.Queued(b))
+	requireReaperTestUpdate(t, outChan, ipc.ResourceUpdateType_cancelled, b)
+
+	require.True(t, bs.cancelDownload(c))
+	require.False(t, bs.retries.Waiting(c))
+	requireReaperTestUpdate(t, outChan, ipc.ResourceUpdateType_cancelled, c)
+
+	// Roots without a download in flight are ignored
+	require.False(t, bs.cancelDownload(a))
+	require.False(t, bs.cancelDownload(dl.Root{5}))
+	require.Empty(t, outChan)
+}
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/crypto/blake2b"
+)
+
+// CAR (content addressable archive) files carry blocks of a resource out
+// of band. Files are written in the CARv2 format without an index: the
+// pragma, the CARv2 header and a CARv1 payload of a header naming the
+// root followed by sections of blocks. Files in the CARv1 format are
+// read as well.
+
+// carV2Pragma is the CARv1 header {version: 2} opening CARv2 files
+var carV2Pragma = []byte{0x0a, 0xa1, 0x67, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x02}
+
+// Characteristics (16 bytes), data offset, data size and index offset
+const carV2HeaderSize = 40
+
+// carV1Header encodes the DAG-CBOR header {roots: [root], version: 1}
+func carV1Header(root cid.Cid) []byte {
+	var b bytes.Buffer
+	b.WriteByte(0xa2)
+	b.Write(cborHead(3, 5))
+	b.WriteString("roots")
+	b.Write(cborHead(4, 1))
+	// CIDs are tag 42 of the CID bytes prefixed with
+	// the identity multibase
+	b.Write([]byte{0xd8, 0x2a})
+	b.Write(cborHead(2, uint64(root.ByteLen()+1)))
+	b.WriteByte(0)
+	b.Write(root.Bytes())
+	b.Write(cborHead(3, 7))
+	b.WriteString("version")
+	b.WriteByte(0x01)
+	return b.Bytes()
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 1<<8:
+		return []byte{major<<5 | 24, byte(n)}
+	case n < 1<<16:
+		res := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(res[1:], uint16(n))
+		return res
+	case n < 1<<32:
+		res := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(res[1:], uint32(n))
+		return res
+	}
+	res := []byte{major<<5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(res[1:], n)
+	return res
+}
+
+// carWriter writes a CARv2 file, the CARv2 header is
+// written once the payload is complete
+type carWriter struct {
+	w        io.WriteSeeker
+	buf      *bufio.Writer
+	dataSize uint64
+}
+
+func newCarWriter(w io.WriteSeeker, root cid.Cid) (*carWriter, error) {
+	cw := &carWriter{w: w, buf: bufio.NewWriter(w)}
+	if _, err := cw.buf.Write(carV2Pragma); err != nil {
+		return nil, err
+	}
+	if _, err := cw.buf.Write(make([]byte, carV2HeaderSize)); err != nil {
+		return nil, err
+	}
+	header := carV1Header(root)
+	if err := cw.writeSection(nil, header); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *carWriter) writeSection(id []byte, data []byte) error {
+	prefix := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(prefix, uint64(len(id)+len(data)))
+	for _, b := range [][]byte{prefix[:n], id, data} {
+		if _, err := cw.buf.Write(b); err != nil {
+			return err
+		}
+	}
+	cw.dataSize += uint64(n + len(id) + len(data))
+	return nil
+}
+
+func (cw *carWriter) WriteBlock(id cid.Cid, data []byte) error {
+	return cw.writeSection(id.Bytes(), data)
+}
+
+// Close completes the CARv2 header, the underlying writer is left open
+func (cw *carWriter) Close() error {
+	if err := cw.buf.Flush(); err != nil {
+		return err
+	}
+	header := make([]byte, carV2HeaderSize)
+	binary.LittleEndian.PutUint64(header[16:], uint64(len(carV2Pragma)+carV2HeaderSize))
+	binary.LittleEndian.PutUint64(header[24:], cw.dataSize)
+	if _, err := cw.w.Seek(int64(len(carV2Pragma)), io.SeekStart); err != nil {
+		return err
+	}
+	_, err := cw.w.Write(header)
+	return err
+}
+
+// readCar reads blocks of a CAR file, the callback is called for every
+// block; roots named by the header are returned. Sections larger than
+// maxSectionSize are refused.
+func readCar(r io.Reader, maxSectionSize int, onBlock func(id cid.Cid, data []byte) error) ([]cid.Cid, error) {
+	br := bufio.NewReader(r)
+	header, err := readCarSection(br, maxSectionSize)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CAR header: %w", err)
+	}
+	roots, version, err := parseCarHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	if version == 2 {
+		v2Header := make([]byte, carV2HeaderSize)
+		if _, err := io.ReadFull(br, v2Header); err != nil {
+			return nil, fmt.Errorf("error reading CARv2 header: %w", err)
+		}
+		dataOffset := binary.LittleEndian.Uint64(v2Header[16:])
+		dataSize := binary.LittleEndian.Uint64(v2Header[24:])
+		read := uint64(len(carV2Pragma) + carV2HeaderSize)
+		if dataOffset < read {
+			return nil, fmt.Errorf("wrong CARv2 data offset %d", dataOffset)
+		}
+		if _, err := io.CopyN(ioutil.Discard, br, int64(dataOffset-read)); err != nil {
+			return nil, err
+		}
+		// Index following the payload isn't read
+		br = bufio.NewReader(io.LimitReader(br, int64(dataSize)))
+		if header, err = readCarSection(br, maxSectionSize); err != nil {
+			return nil, fmt.Errorf("error reading CARv1 header of CARv2 payload: %w", err)
+		}
+		if roots, version, err = parseCarHeader(header); err != nil {
+			return nil, err
+		}
+	}
+	if version != 1 {
+		return nil, fmt.Errorf("unsupported CAR version %d", version)
+	}
+	for {
+		section, err := readCarSection(br, maxSectionSize)
+		if err == io.EOF {
+			return roots, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		n, id, err := cid.CidFromBytes(section)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CID of CAR section: %w", err)
+		}
+		if err := onBlock(id, section[n:]); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readCarSection reads a varint-prefixed section,
+// io.EOF is returned at the end of the input
+func readCarSection(br *bufio.Reader, maxSize int) ([]byte, error) {
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(maxSize) {
+		return nil, fmt.Errorf("CAR section of %d bytes is too large", size)
+	}
+	res := make([]byte, size)
+	if _, err := io.ReadFull(br, res); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+// parseCarHeader returns roots and version of the DAG-CBOR header,
+// roots are absent from the CARv2 pragma
+func parseCarHeader(header []byte) ([]cid.Cid, uint64, error) {
+	d := &cborDecoder{data: header}
+	v, err := d.decode()
+	if err == nil && len(d.data) > 0 {
+		err = errors.New("trailing bytes")
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("malformed CAR header: %w", err)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, 0, errors.New("malformed CAR header: not a map")
+	}
+	version, ok := m["version"].(uint64)
+	if !ok {
+		return nil, 0, errors.New("malformed CAR header: no version")
+	}
+	var roots []cid.Cid
+	rootsV, _ := m["roots"].([]interface{})
+	for _, rv := range rootsV {
+		tagged, ok := rv.(cborTagged)
+		data, isBytes := tagged.value.([]byte)
+		if !ok || tagged.tag != 42 || !isBytes || len(data) == 0 || data[0] != 0 {
+			return nil, 0, errors.New("malformed CAR header: root isn't a CID")
+		}
+		id, err := cid.Cast(data[1:])
+		if err != nil {
+			return nil, 0, fmt.Errorf("malformed CAR header: %w", err)
+		}
+		roots = append(roots, id)
+	}
+	return roots, version, nil
+}
+
+type cborTagged struct {
+	tag   uint64
+	value interface{}
+}
+
+// cborDecoder decodes the subset of CBOR used by CAR headers: unsigned
+// integers, byte and text strings, arrays, maps with text keys and tags
+type cborDecoder struct {
+	data []byte
+}
+
+var errCborTruncated = errors.New("truncated CBOR")
+
+func (d *cborDecoder) head() (byte, uint64, error) {
+	if len(d.data) == 0 {
+		return 0, 0, errCborTruncated
+	}
+	major, info := d.data[0]>>5, d.data[0]&0x1f
+	d.data = d.data[1:]
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+	if info > 27 {
+		return 0, 0, fmt.Errorf("unsupported CBOR additional info %d", info)
+	}
+	size := 1 << (info - 24)
+	if len(d.data) < size {
+		return 0, 0, errCborTruncated
+	}
+	var n uint64
+	for _, b := range d.data[:size] {
+		n = n<<8 | uint64(b)
+	}
+	d.data = d.data[size:]
+	return major, n, nil
+}
+
+func (d *cborDecoder) decode() (interface{}, error) {
+	major, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 0:
+		return n, nil
+	case 2, 3:
+		if uint64(len(d.data)) < n {
+			return nil, errCborTruncated
+		}
+		b := d.data[:n]
+		d.data = d.data[n:]
+		if major == 3 {
+			return string(b), nil
+		}
+		return b, nil
+	case 4:
+		// Every item takes at least a byte
+		if uint64(len(d.data)) < n {
+			return nil, errCborTruncated
+		}
+		res := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			v, err := d.decode()
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, v)
+		}
+		return res, nil
+	case 5:
+		res := make(map[string]interface{})
+		for i := uint64(0); i < n; i++ {
+			k, err := d.decode()
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, errors.New("CBOR map key isn't a string")
+			}
+			if res[key], err = d.decode(); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	case 6:
+		v, err := d.decode()
+		return cborTagged{tag: n, value: v}, err
+	}
+	return nil, fmt.Errorf("unsupported CBOR major type %d", major)
+}
+
+// Section of a block holds its CID (36 bytes for blake2b-256 raw
+// blocks) along with the block, some slack is left for other CIDs
+const carSectionOverhead = 64
+
+type exportedResource struct {
+	blocks int
+	size   uint64
+}
+
+// exportResource writes blocks of a full root to a CAR file, the file
+// is written under a temporary name and renamed once it's complete
+func exportResource(storage codanet.BitswapStorage, root_ dl.Root, blockLinks []dl.BitswapBlockLink, path string) (exportedResource, error) {
+	var res exportedResource
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return res, err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(path + ".tmp")
+		}
+	}()
+	cw, err := newCarWriter(f, codanet.BlockHashToCid(root_))
+	if err != nil {
+		return res, err
+	}
+	written := make(map[dl.BitswapBlockLink]bool)
+	for _, link := range blockLinks {
+		if written[link] {
+			continue
+		}
+		written[link] = true
+		err := storage.ViewBlock(link, func(b []byte) error {
+			res.size += uint64(len(b))
+			return cw.WriteBlock(codanet.BlockHashToCid(link), b)
+		})
+		if err != nil {
+			return res, fmt.Errorf("error exporting block %s: %w", codanet.BlockHashToCidSuffix(link), err)
+		}
+		res.blocks++
+	}
+	if err := cw.Close(); err != nil {
+		return res, err
+	}
+	if err := f.Sync(); err != nil {
+		return res, err
+	}
+	if err := f.Close(); err != nil {
+		f = nil
+		os.Remove(path + ".tmp")
+		return res, err
+	}
+	f = nil
+	return res, os.Rename(path+".tmp", path)
+}
+
+// readCarResource reads blocks of a CAR file naming a single root, blocks
+// not matching their CIDs are refused. Total size of blocks is capped.
+func readCarResource(r io.Reader, maxBlockSize int, maxSize int) (dl.Root, map[dl.BitswapBlockLink][]byte, error) {
+	blockMap := make(map[dl.BitswapBlockLink][]byte)
+	size := 0
+	roots, err := readCar(r, maxBlockSize+carSectionOverhead, func(id cid.Cid, data []byte) error {
+		key, ok := codanet.CidToBlockHash(id)
+		if !ok {
+			return fmt.Errorf("block %s isn't a blake2b-256 raw block", id)
+		}
+		if len(data) > maxBlockSize {
+			return fmt.Errorf("block %s of %d bytes is too large", id, len(data))
+		}
+		if blake2b.Sum256(data) != key {
+			return fmt.Errorf("block %s doesn't match its hash", id)
+		}
+		if _, has := blockMap[key]; has {
+			return nil
+		}
+		if size += len(data); size > maxSize {
+			return fmt.Errorf("blocks exceed %d bytes", maxSize)
+		}
+		blockMap[key] = data
+		return nil
+	})
+	if err != nil {
+		return dl.Root{}, nil, err
+	}
+	if len(roots) != 1 {
+		return dl.Root{}, nil, fmt.Errorf("CAR file names %d roots instead of one", len(roots))
+	}
+	root_, ok := codanet.CidToBlockHash(roots[0])
+	if !ok {
+		return dl.Root{}, nil, fmt.Errorf("root %s isn't a blake2b-256 raw block", roots[0])
+	}
+	return root_, blockMap, nil
+}
+
+// maxImportSize caps total size of blocks of an imported file, blocks of
+// a tree of the largest resource configured fit it along with their links
+func maxImportSize(maxBlockSize int, dataConfig map[dl.BitswapDataTag]dl.BitswapDataConfig) int {
+	res := 0
+	for _, c := range dataConfig {
+		if c.MaxSize > res {
+			res = c.MaxSize
+		}
+	}
+	return 2*res + maxBlockSize
+}
+
+// validateImport checks the tree of the root as it's checked once the
+// root is downloaded, blocks of the tree are returned with its tag
+func validateImport(blockMap map[dl.BitswapBlockLink][]byte, root_ dl.Root, maxBlockSize int, di dl.DepthIndices, dataConfig map[dl.BitswapDataTag]dl.BitswapDataConfig) (dl.BitswapDataTag, map[dl.BitswapBlockLink][]byte, error) {
+	rootBlock, has := blockMap[root_]
+	if !has {
+		return 0, nil, errors.New("root block is missing")
+	}
+	memory := codanet.NewBitswapStorageMemory(maxImportSize(maxBlockSize, dataConfig))
+	if err := memory.PutBlocks(blockMap); err != nil {
+		return 0, nil, err
+	}
+	v, err := validateRootTree(memory, root_, maxBlockSize, di, dataConfig)
+	if err != nil {
+		return 0, nil, err
+	}
+	if v.problem != nil {
+		return 0, nil, v.problem
+	}
+	_, data, err := dl.ReadBitswapBlock(rootBlock)
+	if err != nil {
+		return 0, nil, err
+	}
+	tag, _, err := dl.ReadRootBlock(data, maxBlockSize, dataConfig)
+	if err != nil {
+		return 0, nil, err
+	}
+	// Blocks of the file outside of the tree aren't imported
+	tree := map[dl.BitswapBlockLink][]byte{root_: rootBlock}
+	queue := []dl.BitswapBlockLink{root_}
+	for len(queue) > 0 {
+		links, _, err := dl.ReadBitswapBlock(tree[queue[0]])
+		if err != nil {
+			return 0, nil, err
+		}
+		queue = queue[1:]
+		for _, l := range links {
+			if _, has := tree[l]; !has {
+				tree[l] = blockMap[l]
+				queue = append(queue, l)
+			}
+		}
+	}
+	return tag, tree, nil
+}
+
+type importedResource struct {
+	tag dl.BitswapDataTag
+	err error
+}
+
+type bitswapImportCmd struct {
+	root   dl.Root
+	blocks map[dl.BitswapBlockLink][]byte
+	result chan<- importedResource
+}
+
+// importResource stores blocks of a root read from a CAR file, the root is
+// completed as if it was downloaded, so roots of verified tags are marked
+// full once the daemon accepts them
+func (bs *BitswapCtx) importResource(cmd bitswapImportCmd) importedResource {
+	root_ := cmd.root
+	id := codanet.BlockHashToCidSuffix(root_)
+	if _, downloading := bs.rootDownloadStates[root_]; downloading || bs.verifications.Pending(root_) {
+		return importedResource{err: fmt.Errorf("root %s is being downloaded", id)}
+	}
+	tag, tree, err := validateImport(cmd.blocks, root_, bs.maxBlockSize, bs.depthIndices, bs.dataConfig)
+	if err != nil {
+		return importedResource{err: fmt.Errorf("invalid resource %s: %w", id, err)}
+	}
+	if status, err := bs.storage.GetStatus(root_); err == nil && status == codanet.Full {
+		return importedResource{tag: tag}
+	}
+	if err := bs.SetStatus(root_, codanet.Partial); err != nil {
+		return importedResource{err: err}
+	}
+	bs.scheduler.Remove(root_)
+	bs.retries.Forget(root_)
+	for h, b := range tree {
+		block, _ := blocks.NewBlockWithCid(b, codanet.BlockHashToCid(h))
+		if err := bs.engine.HasBlock(block); err != nil {
+			// Root is left partial, to be reaped or downloaded
+			return importedResource{err: err}
+		}
+	}
+	bitswapLogger.Infof("Imported root %s of %d blocks", id, len(tree))
+	if bs.VerifyRoot(root_, tag) {
+		return importedResource{tag: tag}
+	}
+	if err := bs.SetStatus(root_, codanet.Full); err != nil {
+		return importedResource{err: err}
+	}
+	bs.SendResourceUpdate(ipc.ResourceUpdateType_added, root_)
+	return importedResource{tag: tag}
+}
+
+type ExportResourceReqT = ipc.Libp2pHelperInterface_ExportResource_Request
+type ExportResourceReq ExportResourceReqT
+
+func fromExportResourceReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.ExportResource()
+	return ExportResourceReq(i), err
+}
+
+func (m ExportResourceReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	rootId, err := ExportResourceReqT(m).Root()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	root_, err := extractRootBlockId(rootId)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	path, err := ExportResourceReqT(m).Path()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	bs := app.bitswapCtx
+	status, err := bs.storage.GetStatus(root_)
+	if err == nil && status != codanet.Full {
+		err = fmt.Errorf("root %s is not fully downloaded", codanet.BlockHashToCidSuffix(root_))
+	}
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	blockLinks, err := bs.rootBlocks(root_)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	exported, err := exportResource(bs.storage, root_, blockLinks, path)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		resp, err := m.NewExportResource()
+		panicOnErr(err)
+		resp.SetBlocks(uint32(exported.blocks))
+		resp.SetSize(exported.size)
+	})
+}
+
+type ImportResourceReqT = ipc.Libp2pHelperInterface_ImportResource_Request
+type ImportResourceReq ImportResourceReqT
+
+func fromImportResourceReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.ImportResource()
+	return ImportResourceReq(i), err
+}
+
+func (m ImportResourceReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	path, err := ImportResourceReqT(m).Path()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	defer f.Close()
+	bs := app.bitswapCtx
+	root_, blockMap, err := readCarResource(f, bs.maxBlockSize, maxImportSize(bs.maxBlockSize, bs.dataConfig))
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(fmt.Errorf("error reading %s: %w", path, err)))
+	}
+	result := make(chan importedResource, 1)
+	bs.importCmds <- bitswapImportCmd{root: root_, blocks: blockMap, result: result}
+	imported := <-result
+	if imported.err != nil {
+		return mkRpcRespError(seqno, badRPC(imported.err))
+	}
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		resp, err := m.NewImportResource()
+		panicOnErr(err)
+		rootId, err := resp.NewRoot()
+		panicOnErr(err)
+		panicOnErr(rootId.SetBlake2bHash(root_[:]))
+		resp.SetTag(uint8(imported.tag))
+	})
+}
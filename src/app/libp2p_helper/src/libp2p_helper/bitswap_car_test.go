@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	capnp "capnproto.org/go/capnp/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCarExportImport(t *testing.T) {
+	bs := NewBitswapCtx(context.Background(), make(chan *capnp.Message, 10))
+	bs.maxBlockSize = 1000
+	bs.depthIndices = dl.MkDepthIndices(dl.LinksPerBlock(1000), math.MaxInt32)
+	storage := codanet.NewBitswapStorageMemory(1 << 20)
+
+	data := make([]byte, 40000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	blockMap, root := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, data, dl.BlockBodyTag)
+	require.NoError(t, storage.PutBlocks(blockMap))
+	links := []dl.BitswapBlockLink{root}
+	for h := range blockMap {
+		// Duplicate links are written once
+		links = append(links, h)
+	}
+
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "resource.car")
+	exported, err := exportResource(storage, root, links, path)
+	require.NoError(t, err)
+	require.Equal(t, len(blockMap), exported.blocks)
+	_, err = os.Stat(path + ".tmp")
+	require.True(t, os.IsNotExist(err))
+
+	f, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(f, carV2Pragma))
+	imported, importedMap, err := readCarResource(bytes.NewReader(f), bs.maxBlockSize, maxImportSize(bs.maxBlockSize, bs.dataConfig))
+	require.NoError(t, err)
+	require.Equal(t, root, imported)
+	require.Equal(t, blockMap, importedMap)
+
+	tag, tree, err := validateImport(importedMap, root, bs.maxBlockSize, bs.depthIndices, bs.dataConfig)
+	require.NoError(t, err)
+	require.Equal(t, dl.BlockBodyTag, tag)
+	require.Equal(t, blockMap, tree)
+
+	// Truncated files are refused
+	_, _, err = readCarResource(bytes.NewReader(f[:len(f)-10]), bs.maxBlockSize, maxImportSize(bs.maxBlockSize, bs.dataConfig))
+	require.Error(t, err)
+	// Blocks are capped in total
+	_, _, err = readCarResource(bytes.NewReader(f), bs.maxBlockSize, len(data)/2)
+	require.Error(t, err)
+
+	// Tree missing a block is refused
+	for h := range importedMap {
+		if h != root {
+			delete(importedMap, h)
+			break
+		}
+	}
+	_, _, err = validateImport(importedMap, root, bs.maxBlockSize, bs.depthIndices, bs.dataConfig)
+	require.Error(t, err)
+}
+
+func TestCarBlockNotMatchingHash(t *testing.T) {
+	blockMap, root := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, make([]byte, 5000), dl.BlockBodyTag)
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	f, err := os.Create(filepath.Join(dir, "resource.car"))
+	require.NoError(t, err)
+	cw, err := newCarWriter(f, codanet.BlockHashToCid(root))
+	require.NoError(t, err)
+	for h, b := range blockMap {
+		if h != root {
+			b = append([]byte{}, b...)
+			b[len(b)-1]++
+		}
+		require.NoError(t, cw.WriteBlock(codanet.BlockHashToCid(h), b))
+	}
+	require.NoError(t, cw.Close())
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	_, _, err = readCarResource(f, 1000, 1<<20)
+	require.Error(t, err)
+	require.NoError(t, f.Close())
+}
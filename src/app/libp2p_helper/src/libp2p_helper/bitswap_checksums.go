@@ -0,0 +1,52 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var bitswapChecksumRepairsMetric = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "Mina_libp2p_bitswap_checksum_repairs",
+	Help: "Roots whose corrupted blocks were deleted to be downloaded again once the roots were requested",
+})
+
+// repairCorruptedRoot deletes corrupted blocks of the root before its
+// download is started, so that they're fetched over Bitswap once more,
+// and downgrades a full root with such blocks to partial. Trees are only
+// validated while the storage reports blocks failing their checksums on
+// read (e.g. by the daemon reading the resource or by peers asking for
+// its blocks), as roots are mostly requested again once a read failed.
+func (bs *BitswapCtx) repairCorruptedRoot(root dl.Root) {
+	storage, ok := bs.storage.(codanet.BitswapChecksumFailures)
+	if !ok || len(storage.ChecksumFailures()) == 0 {
+		return
+	}
+	if _, downloading := bs.rootDownloadStates[root]; downloading || bs.verifications.Pending(root) {
+		return
+	}
+	status, err := bs.storage.GetStatus(root)
+	if err != nil || status == codanet.Deleting {
+		return
+	}
+	v, err := validateRootTree(bs.storage, root, bs.maxBlockSize, bs.depthIndices, bs.dataConfig)
+	if err != nil {
+		bitswapLogger.Errorf("Failed to validate resource %s: %s", codanet.BlockHashToCidSuffix(root), err)
+		return
+	}
+	if len(v.corrupted) == 0 {
+		return
+	}
+	bitswapLogger.Warnf("Downloading %d corrupted blocks of resource %s again", len(v.corrupted), codanet.BlockHashToCidSuffix(root))
+	if status == codanet.Full {
+		err = bs.downgradeRoot(root, v)
+	} else {
+		err = bs.storage.DeleteBlocks(v.corrupted)
+	}
+	if err != nil {
+		bitswapLogger.Errorf("Failed to repair resource %s: %s", codanet.BlockHashToCidSuffix(root), err)
+		return
+	}
+	bitswapChecksumRepairsMetric.Inc()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// checksumTestStorage fails checksums of the blocks on read
+type checksumTestStorage struct {
+	*codanet.BitswapStorageMemory
+	failing map[dl.BitswapBlockLink]bool
+}
+
+func (s *checksumTestStorage) ViewBlock(key [32]byte, callback func([]byte) error) error {
+	if s.failing[key] {
+		if has, err := s.Has(codanet.BlockHashToCid(key)); err == nil && has {
+			return codanet.ErrBlockChecksum
+		}
+	}
+	return s.BitswapStorageMemory.ViewBlock(key, callback)
+}
+
+func (s *checksumTestStorage) ChecksumFailures() [][32]byte {
+	res := [][32]byte{}
+	for key := range s.failing {
+		if has, err := s.Has(codanet.BlockHashToCid(key)); err == nil && has {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+func TestRepairCorruptedRoot(t *testing.T) {
+	bs, memory, _ := mkReaperTestCtx()
+	bs.maxBlockSize = 1000
+	bs.depthIndices = dl.MkDepthIndices(dl.LinksPerBlock(1000), math.MaxInt32)
+	storage := &checksumTestStorage{BitswapStorageMemory: memory, failing: map[dl.BitswapBlockLink]bool{}}
+	bs.storage = storage
+	root, blockMap := putGcTestRoot(t, bs, memory, dl.BlockBodyTag)
+
+	// Roots aren't validated without checksum failures
+	bs.repairCorruptedRoot(root)
+	status, err := memory.GetStatus(root)
+	require.NoError(t, err)
+	require.Equal(t, codanet.Full, status)
+
+	var corrupted dl.BitswapBlockLink
+	for h := range blockMap {
+		if h != root {
+			corrupted = h
+			break
+		}
+	}
+	storage.failing[corrupted] = true
+	bs.repairCorruptedRoot(root)
+	status, err = memory.GetStatus(root)
+	require.NoError(t, err)
+	require.Equal(t, codanet.Partial, status)
+	requireGcTestBlock(t, memory, corrupted, false)
+	require.Empty(t, storage.ChecksumFailures())
+}
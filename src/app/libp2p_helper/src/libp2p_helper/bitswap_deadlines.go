@@ -0,0 +1,107 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"container/heap"
+	"time"
+)
+
+type rootDeadline struct {
+	root     dl.Root
+	deadline time.Time
+	// position in the heap
+	pos int
+}
+
+type deadlineHeap []*rootDeadline
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h deadlineHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos = i
+	h[j].pos = j
+}
+func (h *deadlineHeap) Push(x interface{}) {
+	e := x.(*rootDeadline)
+	e.pos = len(*h)
+	*h = append(*h, e)
+}
+func (h *deadlineHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// rootDeadlines keeps deadlines of root downloads on a heap, a single
+// timer is armed for the earliest one. Deadlines may be moved or
+// cancelled; it's only accessed from the Bitswap loop.
+type rootDeadlines struct {
+	heap  deadlineHeap
+	roots map[dl.Root]*rootDeadline
+	timer *time.Timer
+}
+
+func newRootDeadlines() *rootDeadlines {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	return &rootDeadlines{roots: make(map[dl.Root]*rootDeadline), timer: timer}
+}
+
+// C fires once the earliest deadline passes
+func (d *rootDeadlines) C() <-chan time.Time {
+	return d.timer.C
+}
+
+func (d *rootDeadlines) Len() int {
+	return len(d.heap)
+}
+
+// Set sets the deadline of the root, replacing the previous one
+func (d *rootDeadlines) Set(r dl.Root, deadline time.Time) {
+	if e, has := d.roots[r]; has {
+		e.deadline = deadline
+		heap.Fix(&d.heap, e.pos)
+	} else {
+		e := &rootDeadline{root: r, deadline: deadline}
+		heap.Push(&d.heap, e)
+		d.roots[r] = e
+	}
+	d.arm()
+}
+
+func (d *rootDeadlines) Cancel(r dl.Root) {
+	if e, has := d.roots[r]; has {
+		heap.Remove(&d.heap, e.pos)
+		delete(d.roots, r)
+		d.arm()
+	}
+}
+
+// Expired removes roots whose deadlines passed, earliest first
+func (d *rootDeadlines) Expired(now time.Time) []dl.Root {
+	var res []dl.Root
+	for len(d.heap) > 0 && !d.heap[0].deadline.After(now) {
+		e := heap.Pop(&d.heap).(*rootDeadline)
+		delete(d.roots, e.root)
+		res = append(res, e.root)
+	}
+	d.arm()
+	return res
+}
+
+// arm resets the timer to the earliest deadline, a tick
+// of the timer not received yet is dropped
+func (d *rootDeadlines) arm() {
+	if !d.timer.Stop() {
+		select {
+		case <-d.timer.C:
+		default:
+		}
+	}
+	if len(d.heap) > 0 {
+		d.timer.Reset(time.Until(d.heap[0].deadline))
+	}
+}
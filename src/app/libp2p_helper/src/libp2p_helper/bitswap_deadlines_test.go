@@ -0,0 +1,54 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootDeadlines(t *testing.T) {
+	d := newRootDeadlines()
+	a, b, c := dl.Root{1}, dl.Root{2}, dl.Root{3}
+	now := time.Now()
+	d.Set(a, now.Add(time.Second))
+	d.Set(b, now.Add(2*time.Second))
+	d.Set(c, now.Add(3*time.Second))
+	// Extended and cancelled deadlines don't expire
+	d.Set(a, now.Add(time.Hour))
+	d.Cancel(b)
+	require.Empty(t, d.Expired(now))
+	require.Equal(t, []dl.Root{c}, d.Expired(now.Add(time.Minute)))
+	require.Equal(t, 1, d.Len())
+	require.Equal(t, []dl.Root{a}, d.Expired(now.Add(time.Hour)))
+	require.Equal(t, 0, d.Len())
+}
+
+func TestRootDeadlinesTimer(t *testing.T) {
+	d := newRootDeadlines()
+	d.Set(dl.Root{1}, time.Now().Add(time.Hour))
+	d.Set(dl.Root{2}, time.Now().Add(10*time.Millisecond))
+	select {
+	case now := <-d.C():
+		require.Equal(t, []dl.Root{{2}}, d.Expired(now))
+	case <-time.After(time.Second):
+		t.Fatal("timer didn't fire for the earliest deadline")
+	}
+	d.Cancel(dl.Root{1})
+	select {
+	case <-d.C():
+		t.Fatal("timer fired without deadlines")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClearRootDownloadStateCancelsDeadline(t *testing.T) {
+	bs, _, _ := mkReaperTestCtx()
+	a := dl.Root{1}
+	bs.rootDownloadStates[a] = &dl.RootDownloadState{CancelF: func() {}}
+	bs.SetDeadline(a, time.Minute)
+	require.Equal(t, 1, bs.deadlines.Len())
+	dl.ClearRootDownloadState(bs, a)
+	require.Equal(t, 0, bs.deadlines.Len())
+}
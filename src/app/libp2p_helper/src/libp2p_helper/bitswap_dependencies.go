@@ -0,0 +1,121 @@
+package main
+
+import dl "codanet/bitswap_downloader"
+
+// rootDependencies orders completion notifications of roots downloaded
+// in parallel according to the dependency hints (parent→child) provided
+// by the daemon: a child that completed before its parents is held back
+// until all of its parents complete or fail. This lets the daemon apply
+// blocks as soon as their bodies arrive.
+type rootDependencies struct {
+	children map[dl.Root][]dl.Root
+	// number of parents a root is still waiting for
+	pendingParents map[dl.Root]int
+	// roots that completed, but are waiting for their parents
+	held map[dl.Root]bool
+}
+
+func newRootDependencies() *rootDependencies {
+	return &rootDependencies{
+		children:       make(map[dl.Root][]dl.Root),
+		pendingParents: make(map[dl.Root]int),
+		held:           make(map[dl.Root]bool),
+	}
+}
+
+// reachable checks whether `to` is a descendant of `from`
+func (d *rootDependencies) reachable(from, to dl.Root) bool {
+	visited := map[dl.Root]bool{from: true}
+	queue := []dl.Root{from}
+	for len(queue) > 0 {
+		r := queue[0]
+		queue = queue[1:]
+		if r == to {
+			return true
+		}
+		for _, c := range d.children[r] {
+			if !visited[c] {
+				visited[c] = true
+				queue = append(queue, c)
+			}
+		}
+	}
+	return false
+}
+
+// Add registers a dependency hint, hints that would
+// introduce a cycle are ignored
+func (d *rootDependencies) Add(parent, child dl.Root) bool {
+	if d.reachable(child, parent) {
+		return false
+	}
+	d.children[parent] = append(d.children[parent], child)
+	d.pendingParents[child]++
+	return true
+}
+
+// release removes the root from the dependency graph and returns
+// the root followed by its held descendants unblocked by its removal
+func (d *rootDependencies) release(r dl.Root, res []dl.Root) []dl.Root {
+	delete(d.held, r)
+	delete(d.pendingParents, r)
+	children := d.children[r]
+	delete(d.children, r)
+	for _, c := range children {
+		d.pendingParents[c]--
+		if d.pendingParents[c] > 0 {
+			continue
+		}
+		delete(d.pendingParents, c)
+		if d.held[c] {
+			res = d.release(c, append(res, c))
+		}
+	}
+	return res
+}
+
+// Complete marks the root as completed and returns roots whose completion
+// is to be announced, in the order of announcement
+func (d *rootDependencies) Complete(r dl.Root) []dl.Root {
+	if d.pendingParents[r] > 0 {
+		d.held[r] = true
+		return nil
+	}
+	return d.release(r, []dl.Root{r})
+}
+
+// Fail marks the root as failed (broken, timed out or removed)
+// and returns held descendants it was blocking
+func (d *rootDependencies) Fail(r dl.Root) []dl.Root {
+	return d.release(r, nil)
+}
+
+// Order sorts roots so that parents go before their children
+func (d *rootDependencies) Order(roots []dl.Root) []dl.Root {
+	inSet := make(map[dl.Root]bool, len(roots))
+	for _, r := range roots {
+		inSet[r] = true
+	}
+	visited := make(map[dl.Root]bool, len(roots))
+	res := make([]dl.Root, 0, len(roots))
+	var visit func(r dl.Root)
+	visit = func(r dl.Root) {
+		visited[r] = true
+		for _, c := range d.children[r] {
+			if inSet[c] && !visited[c] {
+				visit(c)
+			}
+		}
+		res = append(res, r)
+	}
+	for _, r := range roots {
+		if !visited[r] {
+			visit(r)
+		}
+	}
+	// res is in the post-order, reverse it
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootDependenciesComplete(t *testing.T) {
+	a, b, c := dl.Root{1}, dl.Root{2}, dl.Root{3}
+	d := newRootDependencies()
+	require.True(t, d.Add(a, b))
+	require.True(t, d.Add(b, c))
+
+	// Children completed before their ancestors are held back
+	require.Empty(t, d.Complete(c))
+	require.Empty(t, d.Complete(b))
+	require.Equal(t, []dl.Root{a, b, c}, d.Complete(a))
+	require.Empty(t, d.held)
+	require.Empty(t, d.pendingParents)
+	require.Empty(t, d.children)
+}
+
+func TestRootDependenciesFail(t *testing.T) {
+	a, b, c := dl.Root{1}, dl.Root{2}, dl.Root{3}
+	d := newRootDependencies()
+	require.True(t, d.Add(a, c))
+	require.True(t, d.Add(b, c))
+
+	require.Empty(t, d.Complete(c))
+	require.Empty(t, d.Fail(a))
+	// Child is released once the last of its parents is done
+	require.Equal(t, []dl.Root{c}, d.Fail(b))
+	require.Empty(t, d.held)
+}
+
+func TestRootDependenciesCycle(t *testing.T) {
+	a, b, c := dl.Root{1}, dl.Root{2}, dl.Root{3}
+	d := newRootDependencies()
+	require.True(t, d.Add(a, b))
+	require.True(t, d.Add(b, c))
+	require.False(t, d.Add(c, a))
+	require.False(t, d.Add(a, a))
+	require.Equal(t, []dl.Root{a}, d.Complete(a))
+}
+
+func TestRootDependenciesOrder(t *testing.T) {
+	a, b, c, e := dl.Root{1}, dl.Root{2}, dl.Root{3}, dl.Root{4}
+	d := newRootDependencies()
+	require.True(t, d.Add(a, b))
+	require.True(t, d.Add(b, c))
+
+	order := d.Order([]dl.Root{c, e, b, a})
+	require.Len(t, order, 4)
+	pos := make(map[dl.Root]int)
+	for i, r := range order {
+		pos[r] = i
+	}
+	require.Less(t, pos[a], pos[b])
+	require.Less(t, pos[b], pos[c])
+	require.Contains(t, pos, e)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"errors"
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var bitswapDuplicateBlocksMetric = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "Mina_libp2p_bitswap_duplicate_blocks",
+	Help: "Number of blocks received again from another peer while their first copy was remembered",
+})
+
+var bitswapDuplicateBytesMetric = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "Mina_libp2p_bitswap_duplicate_bytes",
+	Help: "Bytes of blocks received again from another peer while their first copy was remembered",
+})
+
+var bitswapDownloadDuplicateRatioMetric = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "Mina_libp2p_bitswap_root_download_duplicate_ratio",
+	Help:    "Duplicate bytes received per byte fetched by completed root downloads",
+	Buckets: prometheus.ExponentialBuckets(0.01, 2, 10),
+})
+
+var bitswapSessionProviderCapMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "Mina_libp2p_bitswap_session_provider_cap",
+	Help: "Providers found by routing passed to Bitswap sessions per lookup, zero if not capped",
+})
+
+// Blocks whose roots are remembered after they're
+// processed, to attribute their duplicates
+const maxRecentBlocks = 4096
+
+// Duplicates received and not attributed yet at most,
+// duplicates exceeding it are only counted by metrics
+const duplicateQueueSize = 1024
+
+// recentBlocks remembers roots of the most recently processed blocks,
+// duplicates of a block mostly arrive once its first copy is processed
+type recentBlocks struct {
+	roots map[cid.Cid][]dl.Root
+	// ring of remembered blocks, next is the slot to reuse
+	ring []cid.Cid
+	next int
+}
+
+func newRecentBlocks(capacity int) *recentBlocks {
+	return &recentBlocks{
+		roots: make(map[cid.Cid][]dl.Root),
+		ring:  make([]cid.Cid, 0, capacity),
+	}
+}
+
+func (r *recentBlocks) record(id cid.Cid, roots []dl.Root) {
+	if _, has := r.roots[id]; !has {
+		if len(r.ring) < cap(r.ring) {
+			r.ring = append(r.ring, id)
+		} else {
+			delete(r.roots, r.ring[r.next])
+			r.ring[r.next] = id
+			r.next = (r.next + 1) % len(r.ring)
+		}
+	}
+	r.roots[id] = roots
+}
+
+// rememberBlockRoots records roots awaiting blocks of the batch,
+// called before the batch is processed
+func (bs *BitswapCtx) rememberBlockRoots(batch []blocks.Block) {
+	for _, b := range batch {
+		params, has := bs.nodeDownloadParams[b.Cid()]
+		if !has {
+			continue
+		}
+		roots := make([]dl.Root, 0, len(params))
+		for root := range params {
+			roots = append(roots, root)
+		}
+		bs.recentBlocks.record(b.Cid(), roots)
+	}
+}
+
+// onDuplicateBlock is called by the network layer for every
+// duplicate, it mustn't block
+func (bs *BitswapCtx) onDuplicateBlock(b blocks.Block) {
+	bitswapDuplicateBlocksMetric.Inc()
+	bitswapDuplicateBytesMetric.Add(float64(len(b.RawData())))
+	select {
+	case bs.duplicates <- b:
+	default:
+	}
+}
+
+// attributeDuplicate counts the duplicate against downloads of its roots
+// that are still in progress, i.e. against their sessions
+func (bs *BitswapCtx) attributeDuplicate(b blocks.Block) {
+	id := b.Cid()
+	roots := make(map[dl.Root]bool)
+	for _, root := range bs.recentBlocks.roots[id] {
+		roots[root] = true
+	}
+	for root := range bs.nodeDownloadParams[id] {
+		roots[root] = true
+	}
+	for root := range roots {
+		if state, has := bs.rootDownloadStates[root]; has {
+			state.DuplicateBlocks++
+			state.DuplicateBytes += len(b.RawData())
+		}
+	}
+}
+
+// Interval of adjusting the provider cap to duplication
+const duplicateSuppressionCheck = 30 * time.Second
+
+// Bytes fetched within an interval for its duplication to be
+// considered, the cap is kept over quieter intervals
+const minDuplicationSampleBytes = 1 << 20
+
+// Providers a session of go-bitswap looks up per want, the cap
+// is halved from it and it's dropped once doubled back to it
+const sessionProviderLookup = 10
+
+// duplicateSuppression shrinks fan-out of Bitswap sessions on nodes
+// receiving much duplicate data. Over each interval, the ratio of
+// duplicate bytes received to bytes fetched by downloads is compared
+// with the threshold: above it, the cap of providers passed to sessions
+// is halved down to minProviders; below half of it, the cap is doubled
+// until it's dropped. Peers hinted as providers aren't capped.
+type duplicateSuppression struct {
+	// zero disables the suppression
+	threshold    float64
+	minProviders int
+	// cap in effect, zero if not capped
+	maxProviders int
+	last         downloadTotals
+	mutex        sync.Mutex
+}
+
+func (d *duplicateSuppression) Configure(threshold float64, minProviders int) error {
+	if threshold < 0 {
+		return errors.New("negative duplicate suppression threshold")
+	}
+	if minProviders <= 0 {
+		minProviders = 1
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.threshold = threshold
+	d.minProviders = minProviders
+	return nil
+}
+
+func readDuplicateSuppressionConfig(c ipc.DuplicateSuppressionConfig) (float64, int) {
+	return c.Threshold(), int(c.MinProviders())
+}
+
+// adjust returns the cap for outcomes of downloads up to totals
+func (d *duplicateSuppression) adjust(totals downloadTotals) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	interval := totals.sub(d.last)
+	if d.threshold == 0 {
+		d.last = totals
+		d.maxProviders = 0
+		return 0
+	}
+	if interval.fetchedBytes < minDuplicationSampleBytes {
+		return d.maxProviders
+	}
+	d.last = totals
+	ratio := float64(interval.duplicateBytes) / float64(interval.fetchedBytes)
+	switch {
+	case ratio > d.threshold:
+		if d.maxProviders == 0 {
+			d.maxProviders = sessionProviderLookup
+		}
+		d.maxProviders /= 2
+		if d.maxProviders < d.minProviders {
+			d.maxProviders = d.minProviders
+		}
+	case ratio < d.threshold/2 && d.maxProviders > 0:
+		d.maxProviders *= 2
+		if d.maxProviders >= sessionProviderLookup {
+			d.maxProviders = 0
+		}
+	}
+	return d.maxProviders
+}
+
+func (bs *BitswapCtx) adjustProviderFanOut() {
+	maxProviders := bs.duplicateSuppression.adjust(snapshotDownloadTotals())
+	if bs.providerHints == nil || bs.providerHints.MaxProviders() == maxProviders {
+		return
+	}
+	if maxProviders == 0 {
+		bitswapLogger.Info("Duplicate data dropped, providers of sessions are no longer capped")
+	} else {
+		bitswapLogger.Infof("Capping providers of sessions at %d to reduce duplicate data", maxProviders)
+	}
+	bs.providerHints.SetMaxProviders(maxProviders)
+	bitswapSessionProviderCapMetric.Set(float64(maxProviders))
+}
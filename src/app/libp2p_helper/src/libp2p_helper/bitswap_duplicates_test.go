@@ -0,0 +1,60 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttributeDuplicate(t *testing.T) {
+	bs, _, _ := mkReaperTestCtx()
+	a, b := dl.Root{1}, dl.Root{2}
+	bs.rootDownloadStates[a] = &dl.RootDownloadState{}
+	processed, awaited, other := blocks.NewBlock([]byte("processed")), blocks.NewBlock([]byte("awaited")), blocks.NewBlock([]byte("other"))
+	bs.nodeDownloadParams[processed.Cid()] = map[dl.Root][]dl.NodeIndex{a: {1}, b: {0}}
+	bs.rememberBlockRoots([]blocks.Block{processed})
+	delete(bs.nodeDownloadParams, processed.Cid())
+	bs.nodeDownloadParams[awaited.Cid()] = map[dl.Root][]dl.NodeIndex{a: {2}}
+
+	// Duplicates are counted against roots still being downloaded
+	bs.attributeDuplicate(processed)
+	bs.attributeDuplicate(awaited)
+	bs.attributeDuplicate(other)
+	require.Equal(t, 2, bs.rootDownloadStates[a].DuplicateBlocks)
+	require.Equal(t, len(processed.RawData())+len(awaited.RawData()), bs.rootDownloadStates[a].DuplicateBytes)
+
+	// The least recently processed block is forgotten
+	r := newRecentBlocks(1)
+	r.record(processed.Cid(), []dl.Root{a})
+	r.record(awaited.Cid(), []dl.Root{b})
+	require.Len(t, r.roots, 1)
+	require.Equal(t, []dl.Root{b}, r.roots[awaited.Cid()])
+}
+
+func TestDuplicateSuppression(t *testing.T) {
+	var d duplicateSuppression
+	totals := downloadTotals{}
+	interval := func(fetched, duplicate uint64) int {
+		totals.fetchedBytes += fetched
+		totals.duplicateBytes += duplicate
+		return d.adjust(totals)
+	}
+	// Disabled by default
+	require.Equal(t, 0, interval(10<<20, 10<<20))
+
+	require.NoError(t, d.Configure(0.5, 2))
+	require.Equal(t, 5, interval(10<<20, 8<<20))
+	require.Equal(t, 2, interval(10<<20, 8<<20))
+	require.Equal(t, 2, interval(10<<20, 8<<20))
+	// Quiet intervals keep the cap
+	require.Equal(t, 2, interval(1<<10, 0))
+	// Between the threshold and its half, the cap is kept
+	require.Equal(t, 2, interval(10<<20, 4<<20))
+	require.Equal(t, 4, interval(10<<20, 1<<20))
+	require.Equal(t, 8, interval(10<<20, 1<<20))
+	require.Equal(t, 0, interval(10<<20, 1<<20))
+
+	require.Error(t, d.Configure(-1, 0))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"errors"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var bitswapStorageSizeMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "Mina_libp2p_bitswap_storage_bytes",
+	Help: "Total size of blocks in the Bitswap storage as of the last garbage collection pass",
+})
+
+var bitswapDedupSavedMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "Mina_libp2p_bitswap_dedup_saved_bytes",
+	Help: "Size saved by storing blocks shared between roots once, as of the last garbage collection pass",
+})
+
+var bitswapGcSweptMetric = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "Mina_libp2p_bitswap_gc_swept_blocks",
+	Help: "Number of unreferenced blocks deleted by garbage collection passes",
+})
+
+type bitswapGcResult struct {
+	// set when the pass didn't look at the storage
+	skipped bool
+	swept   int
+	// total size of blocks left in the storage
+	size int
+	err  error
+}
+
+type bitswapGcCmd struct {
+	// blocks are swept only if the storage is at least that large
+	sweepAbove int
+	// warning is logged if the storage is at least that large after the pass,
+	// zero disables the warning
+	warnAbove int
+	result    chan<- bitswapGcResult
+}
+
+// distinctRootBlocks returns every block of the root's tree once, blocks
+// missing from the storage included. Links of opaque blocks and of
+// blocks failing their checksums aren't followed.
+func (bs *BitswapCtx) distinctRootBlocks(root dl.BitswapBlockLink, opaque map[dl.BitswapBlockLink]bool) ([]dl.BitswapBlockLink, error) {
+	res := []dl.BitswapBlockLink{root}
+	visited := map[dl.BitswapBlockLink]bool{root: true}
+	viewBlockF := func(b []byte) error {
+		links, _, err := dl.ReadBitswapBlock(b)
+		for _, l := range links {
+			if !visited[l] {
+				visited[l] = true
+				res = append(res, l)
+			}
+		}
+		return err
+	}
+	for i := 0; i < len(res); i++ {
+		if opaque[res[i]] {
+			continue
+		}
+		err := bs.storage.ViewBlock(res[i], viewBlockF)
+		if err != nil && err != blockstore.ErrNotFound && !errors.Is(err, codanet.ErrBlockChecksum) {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// refRootBlocks references blocks of a root that became full
+func (bs *BitswapCtx) refRootBlocks(root dl.BitswapBlockLink) {
+	refCounter, ok := bs.storage.(codanet.BitswapRefCounter)
+	if !ok {
+		return
+	}
+	keys, err := bs.distinctRootBlocks(root, nil)
+	if err == nil {
+		err = refCounter.RefBlocks(keys)
+	}
+	if err != nil {
+		// Blocks may be collected while the root still needs them,
+		// reference counts are rebuilt by `blockstore fsck`
+		bitswapLogger.Errorf("Failed to reference blocks of root %s: %s", codanet.BlockHashToCidSuffix(root), err)
+	}
+}
+
+// releaseRootBlocks returns blocks of a root being deleted that aren't
+// referenced by other roots. A full root drops its references first,
+// roots of other statuses hold no references.
+func (bs *BitswapCtx) releaseRootBlocks(refCounter codanet.BitswapRefCounter, root dl.BitswapBlockLink, status codanet.RootBlockStatus) ([]dl.BitswapBlockLink, error) {
+	keys, err := bs.distinctRootBlocks(root, nil)
+	if err != nil {
+		return nil, err
+	}
+	if status == codanet.Full {
+		return refCounter.UnrefBlocks(keys)
+	}
+	res := []dl.BitswapBlockLink{}
+	for _, key := range keys {
+		count, err := refCounter.RefCount(key)
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			res = append(res, key)
+		}
+	}
+	return res, nil
+}
+
+// collectGarbage deletes blocks not referenced by any full root. Blocks
+// of roots being downloaded (or waiting to be) aren't referenced yet,
+// hence the pass is skipped while there are such roots.
+func (bs *BitswapCtx) collectGarbage(cmd bitswapGcCmd) bitswapGcResult {
+	var res bitswapGcResult
+	refCounter, ok := bs.storage.(codanet.BitswapRefCounter)
+	if !ok {
+		res.err = errors.New("storage doesn't support reference counting")
+		return res
+	}
+	if len(bs.rootDownloadStates) > 0 || bs.scheduler.Len() > 0 || bs.retries.Len() > 0 || bs.verifications.Len() > 0 {
+		res.skipped = true
+		return res
+	}
+	initialized, err := refCounter.RefCountsInitialized()
+	if err != nil {
+		res.err = err
+		return res
+	}
+	if !initialized {
+		bitswapLogger.Warn("Skipping garbage collection: reference counts of the blockstore are not built, run `libp2p_helper blockstore fsck` to rebuild them")
+		res.skipped = true
+		return res
+	}
+	keys, unreferencedSize, size, err := refCounter.UnreferencedBlocks(bs.ctx)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	if size >= cmd.sweepAbove && len(keys) > 0 {
+		if err := bs.storage.DeleteBlocks(keys); err != nil {
+			res.err = err
+			return res
+		}
+		res.swept = len(keys)
+		size -= unreferencedSize
+		bitswapGcSweptMetric.Add(float64(len(keys)))
+	}
+	res.size = size
+	bitswapStorageSizeMetric.Set(float64(size))
+	if stats, err := refCounter.DedupStats(bs.ctx); err == nil {
+		bitswapDedupSavedMetric.Set(float64(stats.SavedBytes))
+	} else {
+		bitswapLogger.Warnf("Failed to compute deduplication stats of the storage: %s", err)
+	}
+	if cmd.warnAbove > 0 && size >= cmd.warnAbove {
+		bitswapLogger.Warnf("Bitswap storage holds %d bytes, above the threshold of %d bytes", size, cmd.warnAbove)
+	}
+	return res
+}
+
+func readBitswapGcConfig(c ipc.BitswapGcConfig) (time.Duration, int, int, error) {
+	interval, err := c.Interval()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return time.Duration(interval.NanoSec()), int(c.SweepAboveBytes()), int(c.WarnAboveBytes()), nil
+}
+
+// collectBitswapGarbage periodically deletes blocks
+// not referenced by any full root
+func (app *app) collectBitswapGarbage(interval time.Duration, sweepAbove, warnAbove int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-app.Ctx.Done():
+			return
+		case <-ticker.C:
+			if app.inMaintenance() {
+				continue
+			}
+			result := make(chan bitswapGcResult, 1)
+			app.bitswapCtx.gcCmds <- bitswapGcCmd{sweepAbove: sweepAbove, warnAbove: warnAbove, result: result}
+			var res bitswapGcResult
+			select {
+			case <-app.Ctx.Done():
+				return
+			case res = <-result:
+			}
+			if res.err != nil {
+				bitswapLogger.Errorf("Garbage collection of Bitswap storage failed: %s", res.err)
+			} else if res.swept > 0 {
+				bitswapLogger.Infof("Garbage collection swept %d blocks, %d bytes left in Bitswap storage", res.swept, res.size)
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"context"
+	"testing"
+
+	capnp "capnproto.org/go/capnp/v3"
+	blocks "github.com/ipfs/go-block-format"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+)
+
+func mkGcTestCtx() (*BitswapCtx, *codanet.BitswapStorageMemory) {
+	bs := NewBitswapCtx(context.Background(), make(chan *capnp.Message, 10))
+	storage := codanet.NewBitswapStorageMemory(1 << 20)
+	bs.storage = storage
+	return bs, storage
+}
+
+// putGcTestRoot stores a root of zeroed data, so that roots of
+// different tags share their leaf blocks
+func putGcTestRoot(t *testing.T, bs *BitswapCtx, storage *codanet.BitswapStorageMemory, tag dl.BitswapDataTag) (dl.BitswapBlockLink, map[dl.BitswapBlockLink][]byte) {
+	blockMap, root := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, make([]byte, 40000), tag)
+	require.NoError(t, bs.SetStatus(root, codanet.Partial))
+	for h, b := range blockMap {
+		block, err := blocks.NewBlockWithCid(b, codanet.BlockHashToCid(h))
+		require.NoError(t, err)
+		require.NoError(t, storage.Put(block))
+	}
+	require.NoError(t, bs.SetStatus(root, codanet.Full))
+	return root, blockMap
+}
+
+func requireGcTestBlock(t *testing.T, storage *codanet.BitswapStorageMemory, key dl.BitswapBlockLink, present bool) {
+	err := storage.ViewBlock(key, func([]byte) error { return nil })
+	if present {
+		require.NoError(t, err)
+	} else {
+		require.Equal(t, blockstore.ErrNotFound, err)
+	}
+}
+
+func TestDeleteRootSharedBlocks(t *testing.T) {
+	bs, storage := mkGcTestCtx()
+	a, aBlocks := putGcTestRoot(t, bs, storage, dl.BlockBodyTag)
+	b, bBlocks := putGcTestRoot(t, bs, storage, dl.EpochLedgerTag)
+	shared := 0
+	for key := range aBlocks {
+		if _, has := bBlocks[key]; has {
+			shared++
+			count, err := storage.RefCount(key)
+			require.NoError(t, err)
+			require.Equal(t, 2, count)
+		}
+	}
+	require.NotZero(t, shared)
+
+	require.NoError(t, bs.deleteRoot(a))
+	requireGcTestBlock(t, storage, a, false)
+	for key := range bBlocks {
+		requireGcTestBlock(t, storage, key, true)
+	}
+	require.NoError(t, bs.deleteRoot(b))
+	require.Equal(t, 0, storage.Size())
+}
+
+func TestDeletePartialRootKeepsReferencedBlocks(t *testing.T) {
+	bs, storage := mkGcTestCtx()
+	_, aBlocks := putGcTestRoot(t, bs, storage, dl.BlockBodyTag)
+	blockMap, b := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, make([]byte, 40000), dl.EpochLedgerTag)
+	require.NoError(t, bs.SetStatus(b, codanet.Partial))
+	block, err := blocks.NewBlockWithCid(blockMap[b], codanet.BlockHashToCid(b))
+	require.NoError(t, err)
+	require.NoError(t, storage.Put(block))
+
+	require.NoError(t, bs.deleteRoot(b))
+	requireGcTestBlock(t, storage, b, false)
+	for key := range aBlocks {
+		requireGcTestBlock(t, storage, key, true)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	bs, storage := mkGcTestCtx()
+	root, blockMap := putGcTestRoot(t, bs, storage, dl.BlockBodyTag)
+	orphanData := []byte("orphan")
+	orphan := dl.BitswapBlockLink(blake2b.Sum256(orphanData))
+	orphanBlock, err := blocks.NewBlockWithCid(orphanData, codanet.BlockHashToCid(orphan))
+	require.NoError(t, err)
+	require.NoError(t, storage.Put(orphanBlock))
+	size := storage.Size()
+
+	// Storage is below the sweep threshold
+	res := bs.collectGarbage(bitswapGcCmd{sweepAbove: size + 1})
+	require.NoError(t, res.err)
+	require.Equal(t, 0, res.swept)
+	require.Equal(t, size, res.size)
+
+	// Blocks of roots being downloaded aren't referenced yet
+	bs.rootDownloadStates[root] = &dl.RootDownloadState{}
+	res = bs.collectGarbage(bitswapGcCmd{})
+	require.NoError(t, res.err)
+	require.True(t, res.skipped)
+	delete(bs.rootDownloadStates, root)
+
+	res = bs.collectGarbage(bitswapGcCmd{})
+	require.NoError(t, res.err)
+	require.Equal(t, 1, res.swept)
+	require.Equal(t, size-len(orphanData), res.size)
+	requireGcTestBlock(t, storage, orphan, false)
+	for key := range blockMap {
+		requireGcTestBlock(t, storage, key, true)
+	}
+}
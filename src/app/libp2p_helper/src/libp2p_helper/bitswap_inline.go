@@ -0,0 +1,145 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	blocks "github.com/ipfs/go-block-format"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Kinds of messages published with publishResource, the kind
+// byte is followed by the root id or by the root block
+const (
+	resourceEnvelopeRoot   byte = 0
+	resourceEnvelopeInline byte = 1
+)
+
+type publishedResource struct {
+	root dl.Root
+	// root block of a resource that fits a single
+	// block, nil for resources of several blocks
+	inlineBlock []byte
+	err         error
+}
+
+type bitswapPublishCmd struct {
+	tag    dl.BitswapDataTag
+	data   []byte
+	result chan<- publishedResource
+}
+
+// publishResource adds the resource, a single block
+// of the tree is returned to be published inline
+func (bs *BitswapCtx) publishResource(tag dl.BitswapDataTag, data []byte) publishedResource {
+	blockMap, root, err := bs.addResource(tag, data, "")
+	if err != nil {
+		return publishedResource{err: err}
+	}
+	res := publishedResource{root: root}
+	if len(blockMap) == 1 {
+		res.inlineBlock = blockMap[root]
+	}
+	return res
+}
+
+// encodeResourceEnvelope makes the message published for the resource,
+// the root block is inlined if the message fits the size limit
+func encodeResourceEnvelope(r publishedResource, maxSize int) ([]byte, bool) {
+	if r.inlineBlock != nil && 1+len(r.inlineBlock) <= maxSize {
+		return append([]byte{resourceEnvelopeInline}, r.inlineBlock...), true
+	}
+	return append([]byte{resourceEnvelopeRoot}, r.root[:]...), false
+}
+
+// inlineRoots maps requested roots to root blocks delivered inline,
+// blocks not hashing to any of the requested roots are ignored
+func inlineRoots(inlineBlocks [][]byte, requested map[dl.BitswapBlockLink]bool, maxBlockSize int) map[dl.Root][]byte {
+	res := make(map[dl.Root][]byte)
+	for _, b := range inlineBlocks {
+		if len(b) > maxBlockSize {
+			bitswapLogger.Warnf("Ignoring inline block of %d bytes, larger than a block", len(b))
+			continue
+		}
+		r := dl.Root(blake2b.Sum256(b))
+		if !requested[r] {
+			bitswapLogger.Warnf("Ignoring inline block %s of a root not requested", codanet.BlockHashToCidSuffix(r))
+			continue
+		}
+		res[r] = b
+	}
+	return res
+}
+
+// storeInlineBlocks puts root blocks delivered inline to the storage, so
+// that their roots are processed without fetching anything. Roots whose
+// blocks were stored are returned.
+func (bs *BitswapCtx) storeInlineBlocks(inlineBlocks [][]byte, requested map[dl.BitswapBlockLink]bool) map[dl.Root]bool {
+	res := make(map[dl.Root]bool)
+	for r, b := range inlineRoots(inlineBlocks, requested, bs.maxBlockSize) {
+		block, err := blocks.NewBlockWithCid(b, codanet.BlockHashToCid(r))
+		if err == nil {
+			err = bs.engine.HasBlock(block)
+		}
+		if err != nil {
+			bitswapLogger.Errorf("Failed to store inline block %s: %s", codanet.BlockHashToCidSuffix(r), err)
+			continue
+		}
+		res[r] = true
+	}
+	return res
+}
+
+type PublishResourceReqT = ipc.Libp2pHelperInterface_PublishResource_Request
+type PublishResourceReq PublishResourceReqT
+
+func fromPublishResourceReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.PublishResource()
+	return PublishResourceReq(i), err
+}
+
+func (m PublishResourceReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	if app.P2p.Dht == nil {
+		return mkRpcRespError(seqno, needsDHT())
+	}
+	topicName, err := PublishResourceReqT(m).Topic()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	data, err := PublishResourceReqT(m).Data()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	topic, err := app.joinTopic(topicName)
+	if err != nil {
+		return mkRpcRespError(seqno, err)
+	}
+	result := make(chan publishedResource, 1)
+	app.bitswapCtx.publishCmds <- bitswapPublishCmd{
+		tag:    dl.BitswapDataTag(PublishResourceReqT(m).Tag()),
+		data:   data,
+		result: result,
+	}
+	published := <-result
+	if published.err != nil {
+		return mkRpcRespError(seqno, badRPC(published.err))
+	}
+	envelope, inline := encodeResourceEnvelope(published, app.topicSpecs.Lookup(topicName).maxSize)
+	if err := topic.Publish(app.Ctx, envelope); err != nil {
+		return mkRpcRespError(seqno, badp2p(err))
+	}
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		resp, err := m.NewPublishResource()
+		panicOnErr(err)
+		rootId, err := resp.NewRootId()
+		panicOnErr(err)
+		panicOnErr(rootId.SetBlake2bHash(published.root[:]))
+		resp.SetInline(inline)
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeResourceEnvelope(t *testing.T) {
+	blockMap, r := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, []byte("small body"), dl.BlockBodyTag)
+	require.Len(t, blockMap, 1)
+	small := publishedResource{root: r, inlineBlock: blockMap[r]}
+
+	envelope, inline := encodeResourceEnvelope(small, maxGossipMessageSize)
+	require.True(t, inline)
+	require.Equal(t, append([]byte{resourceEnvelopeInline}, blockMap[r]...), envelope)
+
+	// Root block not fitting a message of the topic is published by its id
+	envelope, inline = encodeResourceEnvelope(small, len(blockMap[r]))
+	require.False(t, inline)
+	require.Equal(t, append([]byte{resourceEnvelopeRoot}, r[:]...), envelope)
+
+	blockMap, r = dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, make([]byte, 5000), dl.BlockBodyTag)
+	require.Greater(t, len(blockMap), 1)
+	envelope, inline = encodeResourceEnvelope(publishedResource{root: r}, maxGossipMessageSize)
+	require.False(t, inline)
+	require.Equal(t, append([]byte{resourceEnvelopeRoot}, r[:]...), envelope)
+}
+
+func TestInlineRoots(t *testing.T) {
+	blocksA, a := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, []byte("a"), dl.BlockBodyTag)
+	blocksB, b := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, []byte("b"), dl.BlockBodyTag)
+	blocksC, c := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, []byte("c"), dl.BlockBodyTag)
+	requested := map[dl.BitswapBlockLink]bool{a: true, c: true}
+
+	// Blocks of roots not requested and blocks larger
+	// than a block are ignored
+	res := inlineRoots([][]byte{blocksA[a], blocksB[b], make([]byte, 1001)}, requested, 1000)
+	require.Equal(t, map[dl.Root][]byte{a: blocksA[a]}, res)
+
+	res = inlineRoots([][]byte{blocksC[c]}, requested, len(blocksC[c])-1)
+	require.Empty(t, res)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"time"
+
+	"github.com/ipfs/go-bitswap"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// bitswapLedger is the accounting of data exchanged with a peer over Bitswap
+type bitswapLedger struct {
+	peer      peer.ID
+	sent      uint64
+	received  uint64
+	exchanged uint64
+}
+
+// GiveTakeRatio is the smoothed ratio of bytes the peer gave us to bytes
+// it took from us, free-riders have the ratio close to zero
+func (l bitswapLedger) GiveTakeRatio() float64 {
+	return float64(l.received+1) / float64(l.sent+1)
+}
+
+// collectBitswapLedgers returns ledgers of peers that exchanged
+// at least one block with us
+func collectBitswapLedgers(engine *bitswap.Bitswap, peers []peer.ID) []bitswapLedger {
+	res := make([]bitswapLedger, 0, len(peers))
+	for _, p := range peers {
+		r := engine.LedgerForPeer(p)
+		if r == nil || r.Exchanged == 0 {
+			continue
+		}
+		res = append(res, bitswapLedger{
+			peer:      p,
+			sent:      r.Sent,
+			received:  r.Recv,
+			exchanged: r.Exchanged,
+		})
+	}
+	return res
+}
+
+// reportBitswapLedgers periodically sends ledgers of connected peers
+// to the daemon, for its trust system to account for data serving
+func (app *app) reportBitswapLedgers(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-app.Ctx.Done():
+			return
+		case <-ticker.C:
+			if app.inMaintenance() {
+				continue
+			}
+			ledgers := collectBitswapLedgers(app.P2p.Bitswap, app.P2p.Host.Network().Peers())
+			if len(ledgers) > 0 {
+				app.writeMsg(mkBitswapLedgersUpcall(ledgers))
+			}
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	ipc "libp2p_ipc"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitswapLedgersUpcall(t *testing.T) {
+	pid, err := peer.IDFromPrivateKey(newTestKey(t))
+	require.NoError(t, err)
+	ledgers := []bitswapLedger{
+		{peer: pid, sent: 1000, received: 0, exchanged: 3},
+	}
+
+	imsg, err := ipc.ReadRootDaemonInterface_Message(mkBitswapLedgersUpcall(ledgers))
+	require.NoError(t, err)
+	pmsg, err := imsg.PushMessage()
+	require.NoError(t, err)
+	require.Equal(t, ipc.DaemonInterface_PushMessage_Which_bitswapLedgers, pmsg.Which())
+	m, err := pmsg.BitswapLedgers()
+	require.NoError(t, err)
+	ms, err := m.Ledgers()
+	require.NoError(t, err)
+	require.Equal(t, 1, ms.Len())
+
+	l := ms.At(0)
+	lpid, err := l.PeerId()
+	require.NoError(t, err)
+	id, err := lpid.Id()
+	require.NoError(t, err)
+	require.Equal(t, peer.Encode(pid), id)
+	require.Equal(t, uint64(1000), l.BytesSent())
+	require.Equal(t, uint64(0), l.BytesReceived())
+	require.Equal(t, uint64(3), l.BlocksExchanged())
+	// free-rider has the ratio well below 1
+	require.Less(t, l.GiveTakeRatio(), 0.01)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"errors"
+	"fmt"
+	"sort"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+type bitswapDeleteBeforeCmd struct {
+	bound  []byte
+	result chan<- int
+}
+
+// checkRootMetadata validates metadata passed by the daemon,
+// empty metadata means none
+func checkRootMetadata(metadata []byte) error {
+	if len(metadata) > codanet.MaxRootMetadataSize {
+		return fmt.Errorf("root metadata of %d bytes exceeds %d bytes", len(metadata), codanet.MaxRootMetadataSize)
+	}
+	return nil
+}
+
+// setRootMetadata stores metadata of the root, replacing the previous one.
+// Metadata is indexed in memory as it's stored, so that roots are found by
+// it without scanning the storage.
+func (bs *BitswapCtx) setRootMetadata(root dl.Root, metadata []byte) {
+	if len(metadata) == 0 {
+		return
+	}
+	storage, ok := bs.storage.(codanet.BitswapRootMetadata)
+	if !ok {
+		return
+	}
+	if err := storage.SetRootMetadata(root, metadata); err != nil {
+		bitswapLogger.Errorf("Failed to store metadata of %s: %s", codanet.BlockHashToCidSuffix(root), err)
+		return
+	}
+	bs.rootMetadata[root] = metadata
+}
+
+func (bs *BitswapCtx) deleteRootMetadata(root dl.Root) error {
+	if _, has := bs.rootMetadata[root]; !has {
+		return nil
+	}
+	delete(bs.rootMetadata, root)
+	if storage, ok := bs.storage.(codanet.BitswapRootMetadata); ok {
+		return storage.DeleteRootMetadata(root)
+	}
+	return nil
+}
+
+// rootsBefore lists roots with metadata less than the bound,
+// ordered by their metadata
+func (bs *BitswapCtx) rootsBefore(bound []byte) []dl.Root {
+	res := []dl.Root{}
+	for root, metadata := range bs.rootMetadata {
+		if bytes.Compare(metadata, bound) < 0 {
+			res = append(res, root)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return bytes.Compare(bs.rootMetadata[res[i]], bs.rootMetadata[res[j]]) < 0
+	})
+	return res
+}
+
+// deleteResourcesBefore deletes roots with metadata less than the bound,
+// returning the number of roots deleted. Roots queued for download aren't
+// stored yet and are left as they are, metadata of other roots that aren't
+// stored (e.g. their downloads never started) is dropped.
+func (bs *BitswapCtx) deleteResourcesBefore(bound []byte) int {
+	stored := []dl.Root{}
+	for _, root := range bs.rootsBefore(bound) {
+		if bs.scheduler.Queued(root) {
+			continue
+		}
+		if _, err := bs.storage.GetStatus(root); err == blockstore.ErrNotFound {
+			if err := bs.deleteRootMetadata(root); err != nil {
+				bitswapLogger.Errorf("Failed to delete metadata of %s: %s", codanet.BlockHashToCidSuffix(root), err)
+			}
+			continue
+		}
+		stored = append(stored, root)
+	}
+	return len(bs.deleteResources(stored))
+}
+
+type DeleteResourcesBeforeReqT = ipc.Libp2pHelperInterface_DeleteResourcesBefore_Request
+type DeleteResourcesBeforeReq DeleteResourcesBeforeReqT
+
+func fromDeleteResourcesBeforeReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.DeleteResourcesBefore()
+	return DeleteResourcesBeforeReq(i), err
+}
+
+func (m DeleteResourcesBeforeReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	bound, err := DeleteResourcesBeforeReqT(m).Metadata()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	if len(bound) == 0 {
+		return mkRpcRespError(seqno, badRPC(errors.New("empty metadata bound")))
+	}
+	result := make(chan int, 1)
+	app.bitswapCtx.deleteBeforeCmds <- bitswapDeleteBeforeCmd{bound: bound, result: result}
+	deleted := <-result
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		resp, err := m.NewDeleteResourcesBefore()
+		panicOnErr(err)
+		resp.SetDeleted(uint32(deleted))
+	})
+}
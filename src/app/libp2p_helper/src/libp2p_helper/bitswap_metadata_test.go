@@ -0,0 +1,53 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"testing"
+
+	ipc "libp2p_ipc"
+
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteResourcesBefore(t *testing.T) {
+	bs, storage, outChan := mkReaperTestCtx()
+	putRoot := func(data []byte, height byte) dl.Root {
+		blockMap, root := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, data, dl.BlockBodyTag)
+		require.NoError(t, storage.PutBlocks(blockMap))
+		require.NoError(t, bs.SetStatus(root, codanet.Full))
+		bs.setRootMetadata(root, []byte{0, height})
+		return root
+	}
+	old := putRoot(make([]byte, 5000), 10)
+	recent := putRoot(make([]byte, 6000), 20)
+	// Roots without metadata are kept
+	blockMap, noMetadata := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, make([]byte, 7000), dl.BlockBodyTag)
+	require.NoError(t, storage.PutBlocks(blockMap))
+	require.NoError(t, bs.SetStatus(noMetadata, codanet.Full))
+	// Metadata of a root never stored is dropped, a queued root is kept
+	unstored, queued := dl.Root{1}, dl.Root{2}
+	bs.setRootMetadata(unstored, []byte{0, 5})
+	bs.setRootMetadata(queued, []byte{0, 5})
+	bs.scheduler.Enqueue(queued, dl.BlockBodyTag, ipc.DownloadPriority_normal, "")
+
+	// Roots are ordered by their metadata
+	before := bs.rootsBefore([]byte{0, 11})
+	require.ElementsMatch(t, []dl.Root{unstored, queued}, before[:2])
+	require.Equal(t, []dl.Root{old}, before[2:])
+	require.Equal(t, 1, bs.deleteResourcesBefore([]byte{0, 11}))
+	requireReaperTestUpdate(t, outChan, ipc.ResourceUpdateType_removed, old)
+	_, err := storage.GetStatus(old)
+	require.Equal(t, blockstore.ErrNotFound, err)
+	_, err = storage.RootMetadata(old)
+	require.Equal(t, blockstore.ErrNotFound, err)
+	_, err = storage.RootMetadata(unstored)
+	require.Equal(t, blockstore.ErrNotFound, err)
+	require.Equal(t, map[dl.Root][]byte{recent: {0, 20}, queued: {0, 5}}, bs.rootMetadata)
+	for _, root := range []dl.Root{recent, noMetadata} {
+		status, err := storage.GetStatus(root)
+		require.NoError(t, err)
+		require.Equal(t, codanet.Full, status)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var bitswapDownloadDurationMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "Mina_libp2p_bitswap_root_download_seconds",
+	Help:    "Duration of root download attempts, by outcome",
+	Buckets: prometheus.ExponentialBuckets(0.1, 2, 16),
+}, []string{"outcome"})
+
+var bitswapDownloadBlocksMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "Mina_libp2p_bitswap_root_download_blocks",
+	Help:    "Number of blocks fetched by root download attempts, by outcome",
+	Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+}, []string{"outcome"})
+
+var bitswapDownloadRetriesMetric = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "Mina_libp2p_bitswap_download_retries",
+	Help: "Number of root downloads restarted after timing out",
+})
+
+// downloadTotals accumulate outcomes of root download attempts since the
+// helper started, as metrics do, so that they're compared over intervals
+type downloadTotals struct {
+	completed int
+	// broken or timed out
+	failed        int
+	completedTime time.Duration
+	fetchedBytes  uint64
+	// duplicates received by sessions of downloads
+	duplicateBytes uint64
+}
+
+func (t downloadTotals) sub(t1 downloadTotals) downloadTotals {
+	return downloadTotals{
+		completed:      t.completed - t1.completed,
+		failed:         t.failed - t1.failed,
+		completedTime:  t.completedTime - t1.completedTime,
+		fetchedBytes:   t.fetchedBytes - t1.fetchedBytes,
+		duplicateBytes: t.duplicateBytes - t1.duplicateBytes,
+	}
+}
+
+func (t downloadTotals) add(t1 downloadTotals) downloadTotals {
+	return downloadTotals{
+		completed:      t.completed + t1.completed,
+		failed:         t.failed + t1.failed,
+		completedTime:  t.completedTime + t1.completedTime,
+		fetchedBytes:   t.fetchedBytes + t1.fetchedBytes,
+		duplicateBytes: t.duplicateBytes + t1.duplicateBytes,
+	}
+}
+
+// meanDownloadTime of completed downloads, zero if none completed
+func (t downloadTotals) meanDownloadTime() time.Duration {
+	if t.completed == 0 {
+		return 0
+	}
+	return t.completedTime / time.Duration(t.completed)
+}
+
+var (
+	currentDownloadTotals downloadTotals
+	downloadTotalsMutex   sync.Mutex
+)
+
+func snapshotDownloadTotals() downloadTotals {
+	downloadTotalsMutex.Lock()
+	defer downloadTotalsMutex.Unlock()
+	return currentDownloadTotals
+}
+
+// observeRootDownload records an attempt of downloading
+// the root that ended with the outcome
+func observeRootDownload(state *dl.RootDownloadState, outcome string) {
+	elapsed := time.Since(state.StartedAt)
+	bitswapDownloadDurationMetric.WithLabelValues(outcome).Observe(elapsed.Seconds())
+	bitswapDownloadBlocksMetric.WithLabelValues(outcome).Observe(float64(state.FetchedNodes))
+	if outcome == dl.DownloadCompleted && state.FetchedBytes > 0 {
+		bitswapDownloadDuplicateRatioMetric.Observe(float64(state.DuplicateBytes) / float64(state.FetchedBytes))
+	}
+	downloadTotalsMutex.Lock()
+	defer downloadTotalsMutex.Unlock()
+	currentDownloadTotals.fetchedBytes += uint64(state.FetchedBytes)
+	currentDownloadTotals.duplicateBytes += uint64(state.DuplicateBytes)
+	switch outcome {
+	case dl.DownloadCompleted:
+		currentDownloadTotals.completed++
+		currentDownloadTotals.completedTime += elapsed
+	case dl.DownloadBroken, dl.DownloadTimedOut:
+		currentDownloadTotals.failed++
+	}
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"errors"
 	"fmt"
 	ipc "libp2p_ipc"
+	"time"
+
+	capnp "capnproto.org/go/capnp/v3"
+	peer "github.com/libp2p/go-libp2p-core/peer"
 )
 
 type AddResourcePushT = ipc.Libp2pHelperInterface_AddResource
@@ -14,14 +21,91 @@ func fromAddResourcePush(m ipcPushMessage) (pushMessage, error) {
 }
 
 func (m AddResourcePush) handle(app *app) {
+	m.handleTraced(app, "")
+}
+
+func (m AddResourcePush) handleTraced(app *app, traceId string) {
 	d, err := AddResourcePushT(m).Data()
+	var metadata []byte
+	if err == nil {
+		metadata, err = AddResourcePushT(m).Metadata()
+	}
+	if err == nil {
+		err = checkRootMetadata(metadata)
+	}
 	if err != nil {
 		app.P2p.Logger.Errorf("AddResourcePush.handle: error %w", err)
 		return
 	}
 	app.bitswapCtx.addCmds <- bitswapAddCmd{
-		tag:  BitswapDataTag(AddResourcePushT(m).Tag()),
-		data: d,
+		tag:      dl.BitswapDataTag(AddResourcePushT(m).Tag()),
+		data:     d,
+		metadata: metadata,
+		traceId:  traceId,
+	}
+}
+
+type AddResourcePiecePushT = ipc.Libp2pHelperInterface_AddResourcePiece
+type AddResourcePiecePush AddResourcePiecePushT
+
+func fromAddResourcePiecePush(m ipcPushMessage) (pushMessage, error) {
+	i, err := m.AddResourcePiece()
+	return AddResourcePiecePush(i), err
+}
+
+func (m AddResourcePiecePush) handle(app *app) {
+	d, err := AddResourcePiecePushT(m).Data()
+	if err != nil {
+		app.P2p.Logger.Errorf("AddResourcePiecePush.handle: error %w", err)
+		return
+	}
+	app.bitswapCtx.uploadCmds <- bitswapUploadCmd{
+		sessionId: AddResourcePiecePushT(m).SessionId(),
+		offset:    AddResourcePiecePushT(m).Offset(),
+		data:      d,
+	}
+}
+
+type CommitResourcePushT = ipc.Libp2pHelperInterface_CommitResource
+type CommitResourcePush CommitResourcePushT
+
+func fromCommitResourcePush(m ipcPushMessage) (pushMessage, error) {
+	i, err := m.CommitResource()
+	return CommitResourcePush(i), err
+}
+
+func (m CommitResourcePush) handle(app *app) {
+	m.handleTraced(app, "")
+}
+
+func (m CommitResourcePush) handleTraced(app *app, traceId string) {
+	h, err := CommitResourcePushT(m).Blake2bHash()
+	if err != nil {
+		app.P2p.Logger.Errorf("CommitResourcePush.handle: error %w", err)
+		return
+	}
+	app.bitswapCtx.uploadCmds <- bitswapUploadCmd{
+		sessionId: CommitResourcePushT(m).SessionId(),
+		commit:    true,
+		tag:       dl.BitswapDataTag(CommitResourcePushT(m).Tag()),
+		length:    CommitResourcePushT(m).Length(),
+		hash:      h,
+		traceId:   traceId,
+	}
+}
+
+type AbortResourcePushT = ipc.Libp2pHelperInterface_AbortResource
+type AbortResourcePush AbortResourcePushT
+
+func fromAbortResourcePush(m ipcPushMessage) (pushMessage, error) {
+	i, err := m.AbortResource()
+	return AbortResourcePush(i), err
+}
+
+func (m AbortResourcePush) handle(app *app) {
+	app.bitswapCtx.uploadCmds <- bitswapUploadCmd{
+		sessionId: AbortResourcePushT(m).SessionId(),
+		abort:     true,
 	}
 }
 
@@ -33,26 +117,91 @@ func fromDeleteResourcePush(m ipcPushMessage) (pushMessage, error) {
 	return DeleteResourcePush(i), err
 }
 
-func extractRootBlockList(l ipc.RootBlockId_List) ([]root, error) {
-	ids := make([]root, 0, l.Len())
+func extractRootBlockId(r ipc.RootBlockId) (dl.Root, error) {
+	var link dl.Root
+	id, err := r.Blake2bHash()
+	if err != nil {
+		return link, err
+	}
+	if len(id) != dl.BITSWAP_BLOCK_LINK_SIZE {
+		return link, fmt.Errorf("bitswap block link of unexpected length %d: %v", len(id), id)
+	}
+	copy(link[:], id)
+	return link, nil
+}
+
+func extractRootBlockList(l ipc.RootBlockId_List) ([]dl.Root, error) {
+	ids := make([]dl.Root, 0, l.Len())
 	for i := 0; i < l.Len(); i++ {
-		id, err := l.At(i).Blake2bHash()
+		link, err := extractRootBlockId(l.At(i))
 		if err != nil {
 			return nil, err
 		}
-		var link root
-		if len(id) != BITSWAP_BLOCK_LINK_SIZE {
-			return nil, fmt.Errorf("bitswap block link of unexpected length %d: %v", len(id), id)
-		}
-		copy(link[:], id)
 		ids = append(ids, link)
 	}
 	return ids, nil
 }
 
+func extractProviderHints(l ipc.Libp2pHelperInterface_ProviderHint_List) (map[dl.Root][]peer.ID, error) {
+	hints := make(map[dl.Root][]peer.ID, l.Len())
+	for i := 0; i < l.Len(); i++ {
+		rootM, err := l.At(i).Root()
+		if err != nil {
+			return nil, err
+		}
+		r, err := extractRootBlockId(rootM)
+		if err != nil {
+			return nil, err
+		}
+		peersM, err := l.At(i).Peers()
+		if err != nil {
+			return nil, err
+		}
+		err = capnpPeerIdListForeach(peersM, func(id string) error {
+			p, err := peer.Decode(id)
+			if err == nil {
+				hints[r] = append(hints[r], p)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hints, nil
+}
+
+func extractRootDependencies(l ipc.Libp2pHelperInterface_RootDependency_List) ([]rootDependency, error) {
+	deps := make([]rootDependency, 0, l.Len())
+	for i := 0; i < l.Len(); i++ {
+		parentM, err := l.At(i).Parent()
+		if err != nil {
+			return nil, err
+		}
+		childM, err := l.At(i).Child()
+		if err != nil {
+			return nil, err
+		}
+		parent, err := extractRootBlockId(parentM)
+		if err != nil {
+			return nil, err
+		}
+		child, err := extractRootBlockId(childM)
+		if err != nil {
+			return nil, err
+		}
+		deps = append(deps, rootDependency{parent: parent, child: child})
+	}
+	return deps, nil
+}
+
 func (m DeleteResourcePush) handle(app *app) {
+	m.handleTraced(app, "")
+}
+
+func (m DeleteResourcePush) handleTraced(app *app, traceId string) {
 	idsM, err := DeleteResourcePushT(m).Ids()
-	var links []root
+	var links []dl.Root
 	if err == nil {
 		links, err = extractRootBlockList(idsM)
 	}
@@ -60,7 +209,10 @@ func (m DeleteResourcePush) handle(app *app) {
 		app.P2p.Logger.Errorf("DeleteResourcePush.handle: error %w", err)
 		return
 	}
-	app.bitswapCtx.deleteCmds <- bitswapDeleteCmd{links}
+	app.bitswapCtx.deleteCmds <- bitswapDeleteCmd{
+		rootIds: links,
+		traceId: traceId,
+	}
 }
 
 type DownloadResourcePushT = ipc.Libp2pHelperInterface_DownloadResource
@@ -72,17 +224,392 @@ func fromDownloadResourcePush(m ipcPushMessage) (pushMessage, error) {
 }
 
 func (m DownloadResourcePush) handle(app *app) {
+	m.handleTraced(app, "")
+}
+
+func (m DownloadResourcePush) handleTraced(app *app, traceId string) {
 	idsM, err := DownloadResourcePushT(m).Ids()
-	var links []root
+	var links []dl.Root
 	if err == nil {
 		links, err = extractRootBlockList(idsM)
 	}
+	var depsM ipc.Libp2pHelperInterface_RootDependency_List
+	if err == nil {
+		depsM, err = DownloadResourcePushT(m).Dependencies()
+	}
+	var deps []rootDependency
+	if err == nil {
+		deps, err = extractRootDependencies(depsM)
+	}
+	var peersM ipc.PeerId_List
+	if err == nil {
+		peersM, err = DownloadResourcePushT(m).Peers()
+	}
+	peers := []peer.ID{}
+	if err == nil {
+		err = capnpPeerIdListForeach(peersM, func(id string) error {
+			p, err := peer.Decode(id)
+			if err == nil {
+				peers = append(peers, p)
+			}
+			return err
+		})
+	}
+	var inlineBlocks [][]byte
+	if err == nil {
+		var inlineM capnp.DataList
+		inlineM, err = DownloadResourcePushT(m).InlineBlocks()
+		for i := 0; err == nil && i < inlineM.Len(); i++ {
+			var b []byte
+			b, err = inlineM.At(i)
+			inlineBlocks = append(inlineBlocks, b)
+		}
+	}
+	var hintsM ipc.Libp2pHelperInterface_ProviderHint_List
+	if err == nil {
+		hintsM, err = DownloadResourcePushT(m).ProviderHints()
+	}
+	var hints map[dl.Root][]peer.ID
+	if err == nil {
+		hints, err = extractProviderHints(hintsM)
+	}
+	var metadata []byte
+	if err == nil {
+		metadata, err = DownloadResourcePushT(m).Metadata()
+	}
+	if err == nil {
+		err = checkRootMetadata(metadata)
+	}
 	if err != nil {
 		app.P2p.Logger.Errorf("DownloadResourcePush.handle: error %w", err)
 		return
 	}
+	rootMetadata := make(map[dl.Root][]byte)
+	if len(metadata) > 0 {
+		for _, link := range links {
+			rootMetadata[link] = metadata
+		}
+	}
+	// Peers hinted for particular roots, cache peers and peers
+	// that announced the roots over gossip are candidates as well
+	hinted := peers
+	for _, ps := range hints {
+		hinted = downloadCandidates(nil, hinted, ps)
+	}
+	candidates := downloadCandidates(app.cachePeers, hinted, app.availability.Providers(links))
+	var supported []peer.ID
+	if len(candidates) > 0 {
+		supported = probeBitswapPeers(app.Ctx, app.P2p.Host, app.P2p.BitswapProtocols, candidates, app.peerAudit)
+		if len(supported) == 0 {
+			bitswapLogger.Infof("None of %d hinted peers support Bitswap, relying on discovery", len(candidates))
+		}
+	}
 	app.bitswapCtx.downloadCmds <- bitswapDownloadCmd{
-		rootIds: links,
-		tag:     BitswapDataTag(DownloadResourcePushT(m).Tag()),
+		rootIds:      links,
+		dependencies: deps,
+		inlineBlocks: inlineBlocks,
+		providers:    sessionProviders(links, peers, hints, supported),
+		tag:          dl.BitswapDataTag(DownloadResourcePushT(m).Tag()),
+		priority:     DownloadResourcePushT(m).Priority(),
+		traceId:      traceId,
+		metadata:     rootMetadata,
+	}
+}
+
+type AckResourceUpdatesPushT = ipc.Libp2pHelperInterface_AckResourceUpdates
+type AckResourceUpdatesPush AckResourceUpdatesPushT
+
+func fromAckResourceUpdatesPush(m ipcPushMessage) (pushMessage, error) {
+	i, err := m.AckResourceUpdates()
+	return AckResourceUpdatesPush(i), err
+}
+
+func (m AckResourceUpdatesPush) handle(app *app) {
+	app.bitswapCtx.updateLog.Ack(AckResourceUpdatesPushT(m).Seqno())
+	if AckResourceUpdatesPushT(m).Redeliver() {
+		app.bitswapCtx.redeliverResourceUpdates(time.Now(), true)
+	}
+}
+
+type ResourceVerifiedPushT = ipc.Libp2pHelperInterface_ResourceVerified
+type ResourceVerifiedPush ResourceVerifiedPushT
+
+func fromResourceVerifiedPush(m ipcPushMessage) (pushMessage, error) {
+	i, err := m.ResourceVerified()
+	return ResourceVerifiedPush(i), err
+}
+
+func (m ResourceVerifiedPush) handle(app *app) {
+	idM, err := ResourceVerifiedPushT(m).Id()
+	var link dl.Root
+	if err == nil {
+		link, err = extractRootBlockId(idM)
+	}
+	if err != nil {
+		app.P2p.Logger.Errorf("ResourceVerifiedPush.handle: error %w", err)
+		return
+	}
+	app.bitswapCtx.verdictCmds <- bitswapVerdictCmd{
+		root:   link,
+		accept: ResourceVerifiedPushT(m).Accept(),
+	}
+}
+
+func pinResource(app *app, rootM ipc.RootBlockId, pin bool) error {
+	root, err := extractRootBlockId(rootM)
+	if err != nil {
+		return err
+	}
+	result := make(chan error, 1)
+	app.bitswapCtx.pinCmds <- bitswapPinCmd{root: root, pin: pin, result: result}
+	return <-result
+}
+
+type PinResourceReqT = ipc.Libp2pHelperInterface_PinResource_Request
+type PinResourceReq PinResourceReqT
+
+func fromPinResourceReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.PinResource()
+	return PinResourceReq(i), err
+}
+func (m PinResourceReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	rootM, err := PinResourceReqT(m).Root()
+	if err == nil {
+		err = pinResource(app, rootM, true)
+	}
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewPinResource()
+		panicOnErr(err)
+	})
+}
+
+type CancelResourceDownloadReqT = ipc.Libp2pHelperInterface_CancelResourceDownload_Request
+type CancelResourceDownloadReq CancelResourceDownloadReqT
+
+func fromCancelResourceDownloadReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.CancelResourceDownload()
+	return CancelResourceDownloadReq(i), err
+}
+func (m CancelResourceDownloadReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	rootM, err := CancelResourceDownloadReqT(m).Root()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	root, err := extractRootBlockId(rootM)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	result := make(chan bool, 1)
+	app.bitswapCtx.cancelCmds <- bitswapCancelCmd{root: root, result: result}
+	cancelled := <-result
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		r, err := m.NewCancelResourceDownload()
+		panicOnErr(err)
+		r.SetCancelled(cancelled)
+	})
+}
+
+type RevalidateResourceReqT = ipc.Libp2pHelperInterface_RevalidateResource_Request
+type RevalidateResourceReq RevalidateResourceReqT
+
+func fromRevalidateResourceReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.RevalidateResource()
+	return RevalidateResourceReq(i), err
+}
+func (m RevalidateResourceReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	rootM, err := RevalidateResourceReqT(m).Root()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	root, err := extractRootBlockId(rootM)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	result := make(chan bitswapRevalidateResult, 1)
+	app.bitswapCtx.revalidateCmds <- bitswapRevalidateCmd{root: root, result: result}
+	res := <-result
+	if res.err != nil {
+		return mkRpcRespError(seqno, badRPC(res.err))
+	}
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		r, err := m.NewRevalidateResource()
+		panicOnErr(err)
+		if res.problem != nil {
+			panicOnErr(r.SetProblem(res.problem.Error()))
+		}
+		r.SetDowngraded(res.downgraded)
+	})
+}
+
+type UnpinResourceReqT = ipc.Libp2pHelperInterface_UnpinResource_Request
+type UnpinResourceReq UnpinResourceReqT
+
+func fromUnpinResourceReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.UnpinResource()
+	return UnpinResourceReq(i), err
+}
+func (m UnpinResourceReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	rootM, err := UnpinResourceReqT(m).Root()
+	if err == nil {
+		err = pinResource(app, rootM, false)
+	}
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewUnpinResource()
+		panicOnErr(err)
+	})
+}
+
+type StreamResourceReqT = ipc.Libp2pHelperInterface_StreamResource_Request
+type StreamResourceReq StreamResourceReqT
+
+func fromStreamResourceReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.StreamResource()
+	return StreamResourceReq(i), err
+}
+func (m StreamResourceReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	rootM, err := StreamResourceReqT(m).Root()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	root, err := extractRootBlockId(rootM)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	storage := app.bitswapCtx.storage
+	status, err := storage.GetStatus(root)
+	if err == nil && status != codanet.Full {
+		err = errors.New("resource is not fully downloaded")
+	}
+	var r *resourceReader
+	var tag dl.BitswapDataTag
+	var length int
+	if err == nil {
+		r, tag, length, err = openResourceReader(storage, root)
+	}
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	chunkSize := int(StreamResourceReqT(m).ChunkSize())
+	if chunkSize == 0 {
+		chunkSize = defaultResourceChunkSize
+	}
+	if chunkSize > maxResourceChunkSize {
+		chunkSize = maxResourceChunkSize
+	}
+	go app.streamResource(StreamResourceReqT(m).StreamId(), r, chunkSize)
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		resp, err := m.NewStreamResource()
+		panicOnErr(err)
+		resp.SetTag(uint8(tag))
+		resp.SetLength(uint64(length))
+	})
+}
+
+type ListBitswapWantsReqT = ipc.Libp2pHelperInterface_ListBitswapWants_Request
+type ListBitswapWantsReq ListBitswapWantsReqT
+
+func fromListBitswapWantsReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.ListBitswapWants()
+	return ListBitswapWantsReq(i), err
+}
+func (m ListBitswapWantsReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	result := make(chan bitswapWants, 1)
+	app.bitswapCtx.wantsCmds <- bitswapWantsCmd{result: result}
+	res := <-result
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		r, err := m.NewListBitswapWants()
+		panicOnErr(err)
+		wants, err := r.NewWants(int32(len(res.wants)))
+		panicOnErr(err)
+		for i, w := range res.wants {
+			mw := wants.At(i)
+			panicOnErr(mw.SetBlake2bHash(w.block[:]))
+			mw.SetWantBlock(w.wantBlock)
+		}
+		downloads, err := r.NewDownloads(int32(len(res.downloads)))
+		panicOnErr(err)
+		for i, d := range res.downloads {
+			md := downloads.At(i)
+			mRoot, err := md.NewRoot()
+			panicOnErr(err)
+			panicOnErr(mRoot.SetBlake2bHash(d.root[:]))
+			md.SetTag(uint8(d.tag))
+			md.SetPriority(d.priority)
+			startedAt, err := md.NewStartedAt()
+			panicOnErr(err)
+			startedAt.SetNanoSec(d.startedAt.UnixNano())
+			progress, err := md.NewProgress()
+			panicOnErr(err)
+			setDownloadProgress(progress, d.progress)
+			md.SetRemainingNodes(uint32(d.remainingNodes))
+			md.SetAwaitedBlocks(uint32(d.awaitedBlocks))
+			md.SetDuplicateBlocks(uint32(d.duplicateBlocks))
+			md.SetDuplicateBytes(uint64(d.duplicateBytes))
+		}
+		queued, err := r.NewQueued(int32(len(res.queued)))
+		panicOnErr(err)
+		for i, root := range res.queued {
+			panicOnErr(queued.At(i).SetBlake2bHash(root[:]))
+		}
+	})
+}
+
+type MountArchiveBlockstoreReqT = ipc.Libp2pHelperInterface_MountArchiveBlockstore_Request
+type MountArchiveBlockstoreReq MountArchiveBlockstoreReqT
+
+func fromMountArchiveBlockstoreReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.MountArchiveBlockstore()
+	return MountArchiveBlockstoreReq(i), err
+}
+func (m MountArchiveBlockstoreReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	path, err := MountArchiveBlockstoreReqT(m).Path()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	var archive *codanet.BitswapArchive
+	if path != "" {
+		archive, err = codanet.OpenBitswapArchive(path, MountArchiveBlockstoreReqT(m).Readonly())
+		if err != nil {
+			return mkRpcRespError(seqno, badRPC(err))
+		}
+	}
+	if prev := app.P2p.Blockstore.Mount(archive); prev != nil {
+		if err := prev.Close(); err != nil {
+			bitswapLogger.Warnf("Failed to close archive blockstore %s: %s", prev.Path(), err)
+		}
+	}
+	if archive != nil {
+		bitswapLogger.Infof("Mounted archive blockstore %s", path)
 	}
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewMountArchiveBlockstore()
+		panicOnErr(err)
+	})
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	"github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+const defaultPenaltyWindow = time.Hour
+
+type malformedRootOffence struct {
+	root dl.Root
+	at   time.Time
+}
+
+// malformedBlockPenalties tracks peers that sent blocks of malformed trees.
+// Blocks are content-addressed, so a sender may merely relay blocks of
+// a malformed root it downloaded itself. Hence a peer is banned only once
+// it sent blocks of banThreshold distinct malformed roots within the window,
+// and its gossip score is lowered by scorePenalty per such root.
+type malformedBlockPenalties struct {
+	banThreshold int
+	window       time.Duration
+	scorePenalty float64
+	// offences within the window of each peer, oldest first
+	offences map[peer.ID][]malformedRootOffence
+	now      func() time.Time
+	mutex    sync.Mutex
+}
+
+func newMalformedBlockPenalties() *malformedBlockPenalties {
+	return &malformedBlockPenalties{
+		window:   defaultPenaltyWindow,
+		offences: make(map[peer.ID][]malformedRootOffence),
+		now:      time.Now,
+	}
+}
+
+// Configure replaces the settings, zero window is replaced
+// with the default one, offences recorded so far are kept
+func (p *malformedBlockPenalties) Configure(banThreshold int, window time.Duration, scorePenalty float64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if window == 0 {
+		window = defaultPenaltyWindow
+	}
+	p.banThreshold = banThreshold
+	p.window = window
+	p.scorePenalty = scorePenalty
+}
+
+func readMalformedBlockPenaltyConfig(c ipc.MalformedBlockPenaltyConfig) (int, time.Duration, float64, error) {
+	window, err := c.Window()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return int(c.BanThreshold()), time.Duration(window.NanoSec()), c.ScorePenalty(), nil
+}
+
+// recent drops offences of the peer past the window
+func (p *malformedBlockPenalties) recent(sender peer.ID) []malformedRootOffence {
+	offences := p.offences[sender]
+	since := p.now().Add(-p.window)
+	i := 0
+	for i < len(offences) && offences[i].at.Before(since) {
+		i++
+	}
+	offences = offences[i:]
+	if len(offences) == 0 {
+		delete(p.offences, sender)
+	} else {
+		p.offences[sender] = offences
+	}
+	return offences
+}
+
+// Report records that the peer sent a block of the malformed root,
+// returns true if the peer is to be banned
+func (p *malformedBlockPenalties) Report(sender peer.ID, root dl.Root) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	offences := p.recent(sender)
+	for _, o := range offences {
+		if o.root == root {
+			return false
+		}
+	}
+	offences = append(offences, malformedRootOffence{root: root, at: p.now()})
+	p.offences[sender] = offences
+	return p.banThreshold > 0 && len(offences) >= p.banThreshold
+}
+
+// Score is the application-specific gossip score of the peer
+func (p *malformedBlockPenalties) Score(sender peer.ID) float64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.scorePenalty == 0 {
+		return 0
+	}
+	return -p.scorePenalty * float64(len(p.recent(sender)))
+}
+
+// Penalties returns offences within the window of all peers,
+// for them to be kept across restarts
+func (p *malformedBlockPenalties) Penalties() []codanet.Penalty {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var res []codanet.Penalty
+	for sender := range p.offences {
+		for _, o := range p.recent(sender) {
+			key := o.root
+			res = append(res, codanet.Penalty{Peer: sender, Key: key[:], At: o.at})
+		}
+	}
+	return res
+}
+
+// Restore adds offences returned by Penalties before a restart,
+// offences past the window are dropped
+func (p *malformedBlockPenalties) Restore(penalties []codanet.Penalty) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	since := p.now().Add(-p.window)
+	for _, penalty := range penalties {
+		if len(penalty.Key) != len(dl.Root{}) || penalty.At.Before(since) {
+			continue
+		}
+		var r dl.Root
+		copy(r[:], penalty.Key)
+		offences := p.offences[penalty.Peer]
+		known := false
+		for _, o := range offences {
+			known = known || o.root == r
+		}
+		if known {
+			continue
+		}
+		offences = append(offences, malformedRootOffence{root: r, at: penalty.At})
+		sort.Slice(offences, func(i, j int) bool { return offences[i].at.Before(offences[j].at) })
+		p.offences[penalty.Peer] = offences
+	}
+}
+
+// ReportMalformedBlock attributes a malformed block to the peer it was
+// received from, blocks not received over Bitswap are ignored
+func (bs *BitswapCtx) ReportMalformedBlock(root dl.Root, id cid.Cid) {
+	if bs.senders == nil || bs.onMalformedBlock == nil {
+		return
+	}
+	if sender, has := bs.senders.Sender(id); has {
+		bs.onMalformedBlock(sender, root, id)
+	}
+}
+
+func (app *app) penalizeMalformedBlock(sender peer.ID, root dl.Root, id cid.Cid) {
+	app.peerAudit.Record(sender, ipc.Libp2pHelperInterface_PeerAuditEventKind_malformedBlock,
+		fmt.Sprintf("block %s of root %s", id, codanet.BlockHashToCidSuffix(root)))
+	if app.malformedBlockPenalties.Report(sender, root) {
+		bitswapLogger.Warnf("Banning peer %s for sending blocks of malformed roots", sender)
+		app.P2p.BanPeer(sender)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMalformedBlockPenalties(t *testing.T) {
+	p := newMalformedBlockPenalties()
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	p1, p2 := peer.ID("p1"), peer.ID("p2")
+	r1, r2, r3 := dl.Root{1}, dl.Root{2}, dl.Root{3}
+
+	// Offences are recorded, but nobody is banned until configured
+	require.False(t, p.Report(p1, r1))
+	require.False(t, p.Report(p1, r2))
+	require.Zero(t, p.Score(p1))
+
+	p.Configure(3, time.Hour, 10)
+	require.Equal(t, float64(-20), p.Score(p1))
+	// Blocks of the same root count once
+	require.False(t, p.Report(p1, r2))
+	require.False(t, p.Report(p2, r3))
+	require.True(t, p.Report(p1, r3))
+	require.Equal(t, float64(-30), p.Score(p1))
+	require.Equal(t, float64(-10), p.Score(p2))
+
+	// Offences past the window are forgotten
+	now = now.Add(2 * time.Hour)
+	require.Zero(t, p.Score(p1))
+	require.False(t, p.Report(p1, r1))
+	require.Equal(t, float64(-10), p.Score(p1))
+}
+
+func TestMalformedBlockPenaltiesRestore(t *testing.T) {
+	p := newMalformedBlockPenalties()
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	p.Configure(0, time.Hour, 10)
+	p1, p2 := peer.ID("p1"), peer.ID("p2")
+	r1, r2 := dl.Root{1}, dl.Root{2}
+	p.Report(p1, r1)
+	now = now.Add(time.Minute)
+	p.Report(p1, r2)
+	p.Report(p2, r1)
+	penalties := p.Penalties()
+	require.Len(t, penalties, 3)
+
+	// Offences are kept across restarts until they're past the window
+	restored := newMalformedBlockPenalties()
+	restored.now = func() time.Time { return now }
+	restored.Configure(0, time.Hour, 10)
+	restored.Report(p1, r2)
+	restored.Restore(penalties)
+	require.Equal(t, float64(-20), restored.Score(p1))
+	require.Equal(t, float64(-10), restored.Score(p2))
+	now = now.Add(59*time.Minute + time.Second)
+	require.Equal(t, float64(-10), restored.Score(p1))
+
+	restored = newMalformedBlockPenalties()
+	restored.now = func() time.Time { return now }
+	restored.Restore(penalties)
+	require.Len(t, restored.Penalties(), 2)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"context"
+	"testing"
+
+	capnp "capnproto.org/go/capnp/v3"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinRoot(t *testing.T) {
+	bs := NewBitswapCtx(context.Background(), make(chan *capnp.Message, 10))
+	storage := codanet.NewBitswapStorageMemory(1 << 20)
+	bs.storage = storage
+
+	// Tree of more than 31 blocks has depth of 2
+	data := make([]byte, 40000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	blockMap, root := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, data, dl.BlockBodyTag)
+	require.Error(t, bs.pinRoot(root))
+
+	for h, b := range blockMap {
+		block, err := blocks.NewBlockWithCid(b, codanet.BlockHashToCid(h))
+		require.NoError(t, err)
+		require.NoError(t, storage.Put(block))
+	}
+	require.NoError(t, storage.SetStatus(root, codanet.Partial))
+	require.Error(t, bs.pinRoot(root))
+	require.NoError(t, storage.SetStatus(root, codanet.Full))
+	require.NoError(t, bs.pinRoot(root))
+	// All blocks of the tree are pinned
+	require.Len(t, bs.pinned[root], len(blockMap))
+
+	require.NoError(t, bs.deleteRoot(root))
+	require.Empty(t, bs.pinned)
+	require.Equal(t, 0, storage.Size())
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+const bitswapProbeTimeout = 5 * time.Second
+
+// errBitswapNotNegotiated is returned by probes of connected
+// peers that negotiated none of our Bitswap protocols
+var errBitswapNotNegotiated = errors.New("no Bitswap protocol negotiated")
+
+// probeBitswapPeer connects to the peer and checks that it negotiates
+// one of Bitswap protocols we speak, listed in the order of preference
+func probeBitswapPeer(ctx context.Context, h host.Host, protocols []protocol.ID, p peer.ID) error {
+	ctx, cancel := context.WithTimeout(ctx, bitswapProbeTimeout)
+	defer cancel()
+	if err := h.Connect(ctx, peer.AddrInfo{ID: p}); err != nil {
+		return err
+	}
+	s, err := h.NewStream(ctx, p, protocols...)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errBitswapNotNegotiated, err)
+	}
+	return s.Close()
+}
+
+// probeBitswapPeers probes peers hinted to have blocks of a resource
+// before a session is created for it. Bitswap sessions broadcast wants to
+// connected peers, hence peers that pass the probe are being asked
+// for blocks first. Peers that fail it are skipped, leaving blocks to be
+// found by the usual provider discovery, rather than having the session
+// wait for peers that can never respond. Peers failing to negotiate
+// Bitswap are recorded in the audit log. Peers of other networks fail
+// the probe if dedicated Bitswap protocols are configured.
+func probeBitswapPeers(ctx context.Context, h host.Host, protocols []protocol.ID, peers []peer.ID, audit *peerAuditLog) []peer.ID {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	supported := make([]peer.ID, 0, len(peers))
+	for _, p := range peers {
+		if p == h.ID() {
+			continue
+		}
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			if err := probeBitswapPeer(ctx, h, protocols, p); err != nil {
+				bitswapLogger.Debugf("Hinted peer %s failed Bitswap probe, falling back to discovery: %s", p, err)
+				if errors.Is(err, errBitswapNotNegotiated) {
+					audit.Record(p, ipc.Libp2pHelperInterface_PeerAuditEventKind_protocolNegotiationFailed, "bitswap")
+				}
+				return
+			}
+			mutex.Lock()
+			supported = append(supported, p)
+			mutex.Unlock()
+		}(p)
+	}
+	wg.Wait()
+	return supported
+}
+
+// sessionProviders tells peers that sessions of the roots ask for blocks
+// first: peers hinted for all of the roots along with peers hinted for
+// the root, only those that passed the probe
+func sessionProviders(roots []dl.Root, peers []peer.ID, hints map[dl.Root][]peer.ID, supported []peer.ID) map[dl.Root][]peer.ID {
+	ok := make(map[peer.ID]bool, len(supported))
+	for _, p := range supported {
+		ok[p] = true
+	}
+	res := make(map[dl.Root][]peer.ID)
+	for _, r := range roots {
+		for _, p := range downloadCandidates(nil, peers, hints[r]) {
+			if ok[p] {
+				res[r] = append(res[r], p)
+			}
+		}
+	}
+	return res
+}
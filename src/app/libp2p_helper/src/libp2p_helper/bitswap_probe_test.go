@@ -0,0 +1,42 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"testing"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	peerstore "github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeBitswapPeers(t *testing.T) {
+	alice, _ := newTestApp(t, nil, true)
+	bob, _ := newTestApp(t, nil, true)
+	alice.P2p.Host.Peerstore().AddAddrs(bob.P2p.Me, bob.P2p.Host.Addrs(), peerstore.PermanentAddrTTL)
+
+	// Peer with no known addresses can not be probed
+	unknown, err := peer.IDFromPrivateKey(newTestKey(t))
+	require.NoError(t, err)
+
+	supported := probeBitswapPeers(alice.Ctx, alice.P2p.Host, alice.P2p.BitswapProtocols, []peer.ID{bob.P2p.Me, unknown, alice.P2p.Me}, alice.peerAudit)
+	require.Equal(t, []peer.ID{bob.P2p.Me}, supported)
+	// Failing to connect isn't a failure of negotiation
+	require.Empty(t, alice.peerAudit.Events(unknown))
+}
+
+func TestSessionProviders(t *testing.T) {
+	a, b, c, d := peer.ID("a"), peer.ID("b"), peer.ID("c"), peer.ID("d")
+	r1, r2, r3 := dl.Root{1}, dl.Root{2}, dl.Root{3}
+	hints := map[dl.Root][]peer.ID{r1: {b, c}, r2: {a, d}}
+
+	// Peers hinted for all roots come first, peers
+	// that failed the probe are left out
+	res := sessionProviders([]dl.Root{r1, r2, r3}, []peer.ID{a}, hints, []peer.ID{a, b, c})
+	require.Equal(t, map[dl.Root][]peer.ID{
+		r1: {a, b, c},
+		r2: {a},
+		r3: {a},
+	}, res)
+
+	require.Empty(t, sessionProviders([]dl.Root{r1, r2}, nil, hints, nil))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	ipc "libp2p_ipc"
+	"time"
+
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var bitswapStaleRootsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "Mina_libp2p_bitswap_stale_roots",
+	Help: "Number of roots left partial without a download that were deleted or queued for download again",
+}, []string{"action"})
+
+// partialRoot is a root with partial status in the storage
+type partialRoot struct {
+	// time since which the root is partial without a download
+	since time.Time
+	// set when the reaper queued the root for download once again
+	requeued bool
+}
+
+type bitswapReapResult struct {
+	deleted  []dl.Root
+	requeued []dl.Root
+}
+
+type bitswapReapCmd struct {
+	// roots found partial in the storage at startup
+	found  []dl.BitswapBlockLink
+	maxAge time.Duration
+	// stale roots are queued for download once more instead
+	// of being deleted, if their tag is known
+	redownload bool
+	now        time.Time
+	result     chan<- bitswapReapResult
+}
+
+func readStaleRootReaperConfig(c ipc.StaleRootReaperConfig) (time.Duration, time.Duration, bool, error) {
+	interval, err := c.Interval()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	maxAge, err := c.MaxAge()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return time.Duration(interval.NanoSec()), time.Duration(maxAge.NanoSec()),
+		c.Policy() == ipc.StaleRootPolicy_redownload, nil
+}
+
+// trackPartialRoot keeps track of statuses set to roots,
+// so that roots left partial may be found later
+func (bs *BitswapCtx) trackPartialRoot(root dl.Root, status codanet.RootBlockStatus) {
+	if status != codanet.Partial {
+		delete(bs.partialRoots, root)
+		return
+	}
+	if _, has := bs.partialRoots[root]; !has {
+		bs.partialRoots[root] = &partialRoot{since: time.Now()}
+	}
+}
+
+// rootTag reads the tag of a root from its root block
+func (bs *BitswapCtx) rootTag(root dl.Root) (dl.BitswapDataTag, bool) {
+	var tag dl.BitswapDataTag
+	err := bs.storage.ViewBlock(root, func(b []byte) error {
+		var err error
+		tag, _, err = dl.ReadRootBlock(b, bs.maxBlockSize, bs.dataConfig)
+		return err
+	})
+	return tag, err == nil
+}
+
+// reapStaleRoots deletes roots that were left partial without a download
+// for at least maxAge, or queues them for download once again. Age of a
+// root restarts while it's being downloaded or waits for a download.
+func (bs *BitswapCtx) reapStaleRoots(cmd bitswapReapCmd) bitswapReapResult {
+	var res bitswapReapResult
+	for _, root := range cmd.found {
+		if _, has := bs.partialRoots[root]; !has {
+			bs.partialRoots[root] = &partialRoot{since: cmd.now}
+		}
+	}
+	for root, p := range bs.partialRoots {
+		_, downloading := bs.rootDownloadStates[root]
+		if downloading || bs.scheduler.Queued(root) || bs.retries.Waiting(root) || bs.verifications.Pending(root) {
+			p.since = cmd.now
+			continue
+		}
+		if cmd.now.Sub(p.since) < cmd.maxAge {
+			continue
+		}
+		status, err := bs.storage.GetStatus(root)
+		if err == blockstore.ErrNotFound || (err == nil && status != codanet.Partial) {
+			// Status was changed bypassing tracking (e.g. the root was
+			// evicted from the ephemeral storage)
+			delete(bs.partialRoots, root)
+			continue
+		}
+		if err != nil {
+			bitswapLogger.Errorf("Failed to get status of stale root %s: %s", codanet.BlockHashToCidSuffix(root), err)
+			continue
+		}
+		if cmd.redownload && !p.requeued {
+			if tag, known := bs.rootTag(root); known {
+				bs.scheduler.Enqueue(root, tag, ipc.DownloadPriority_background, "")
+				p.since = cmd.now
+				p.requeued = true
+				res.requeued = append(res.requeued, root)
+				continue
+			}
+		}
+		if err := bs.deleteRoot(root); err != nil {
+			bitswapLogger.Errorf("Failed to delete stale root %s: %s", codanet.BlockHashToCidSuffix(root), err)
+			continue
+		}
+		res.deleted = append(res.deleted, root)
+	}
+	bitswapStaleRootsMetric.WithLabelValues("deleted").Add(float64(len(res.deleted)))
+	bitswapStaleRootsMetric.WithLabelValues("requeued").Add(float64(len(res.requeued)))
+	if len(res.deleted) > 0 {
+		bs.SendResourceUpdates(ipc.ResourceUpdateType_removed, res.deleted...)
+	}
+	if len(res.requeued) > 0 {
+		bs.sendResourceUpdates(ipc.ResourceUpdateType_requeued, res.requeued)
+		bs.startDownloads()
+	}
+	return res
+}
+
+// reapBitswapStaleRoots periodically reaps roots left partial without
+// a download. Roots found partial at startup are reaped maxAge after the
+// first pass, unless the daemon requests their download meanwhile.
+func (app *app) reapBitswapStaleRoots(interval, maxAge time.Duration, redownload bool, found []dl.BitswapBlockLink) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-app.Ctx.Done():
+			return
+		case now := <-ticker.C:
+			if app.inMaintenance() {
+				continue
+			}
+			result := make(chan bitswapReapResult, 1)
+			app.bitswapCtx.reapCmds <- bitswapReapCmd{found: found, maxAge: maxAge, redownload: redownload, now: now, result: result}
+			found = nil
+			var res bitswapReapResult
+			select {
+			case <-app.Ctx.Done():
+				return
+			case res = <-result:
+			}
+			if len(res.deleted) > 0 || len(res.requeued) > 0 {
+				bitswapLogger.Infof("Reaped stale roots: %d deleted, %d queued for download again", len(res.deleted), len(res.requeued))
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"context"
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	blocks "github.com/ipfs/go-block-format"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/require"
+)
+
+func mkReaperTestCtx() (*BitswapCtx, *codanet.BitswapStorageMemory, chan *capnp.Message) {
+	outChan := make(chan *capnp.Message, 10)
+	bs := NewBitswapCtx(context.Background(), outChan)
+	storage := codanet.NewBitswapStorageMemory(1 << 20)
+	bs.storage = storage
+	return bs, storage, outChan
+}
+
+// putPartialTestRoot stores the root block of a root left partial,
+// data differs from the one of putGcTestRoot
+func putPartialTestRoot(t *testing.T, bs *BitswapCtx, storage *codanet.BitswapStorageMemory, tag dl.BitswapDataTag) dl.BitswapBlockLink {
+	blockMap, root := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, make([]byte, 30000), tag)
+	require.NoError(t, bs.SetStatus(root, codanet.Partial))
+	block, err := blocks.NewBlockWithCid(blockMap[root], codanet.BlockHashToCid(root))
+	require.NoError(t, err)
+	require.NoError(t, storage.Put(block))
+	return root
+}
+
+func requireReaperTestUpdate(t *testing.T, outChan chan *capnp.Message, type_ ipc.ResourceUpdateType, expected dl.BitswapBlockLink) {
+	require.NotEmpty(t, outChan)
+	msg, err := ipc.ReadRootDaemonInterface_Message(<-outChan)
+	require.NoError(t, err)
+	pm, err := msg.PushMessage()
+	require.NoError(t, err)
+	ru, err := pm.ResourceUpdated()
+	require.NoError(t, err)
+	require.Equal(t, type_, ru.Type())
+	ids, err := ru.Ids()
+	require.NoError(t, err)
+	require.Equal(t, 1, ids.Len())
+	id, err := ids.At(0).Blake2bHash()
+	require.NoError(t, err)
+	require.Equal(t, expected[:], id)
+}
+
+func TestReapStaleRootsDelete(t *testing.T) {
+	bs, storage, outChan := mkReaperTestCtx()
+	a := putPartialTestRoot(t, bs, storage, dl.BlockBodyTag)
+	b := putPartialTestRoot(t, bs, storage, dl.EpochLedgerTag)
+	full, _ := putGcTestRoot(t, bs, storage, dl.BlockBodyTag)
+	now := time.Now()
+	// Queued root isn't stale
+	bs.scheduler.Enqueue(b, dl.EpochLedgerTag, ipc.DownloadPriority_normal, "")
+
+	res := bs.reapStaleRoots(bitswapReapCmd{maxAge: time.Minute, now: now})
+	require.Empty(t, res.deleted)
+	res = bs.reapStaleRoots(bitswapReapCmd{maxAge: time.Minute, now: now.Add(2 * time.Minute)})
+	require.Equal(t, []dl.Root{dl.Root(a)}, res.deleted)
+	_, err := storage.GetStatus(a)
+	require.Equal(t, blockstore.ErrNotFound, err)
+	requireGcTestBlock(t, storage, a, false)
+	requireReaperTestUpdate(t, outChan, ipc.ResourceUpdateType_removed, a)
+
+	// Age of b restarted when it was seen queued
+	bs.scheduler.Remove(b)
+	res = bs.reapStaleRoots(bitswapReapCmd{maxAge: time.Minute, now: now.Add(150 * time.Second)})
+	require.Empty(t, res.deleted)
+	res = bs.reapStaleRoots(bitswapReapCmd{maxAge: time.Minute, now: now.Add(5 * time.Minute)})
+	require.Equal(t, []dl.Root{dl.Root(b)}, res.deleted)
+	requireReaperTestUpdate(t, outChan, ipc.ResourceUpdateType_removed, b)
+
+	status, err := storage.GetStatus(full)
+	require.NoError(t, err)
+	require.Equal(t, codanet.Full, status)
+	require.Empty(t, bs.partialRoots)
+}
+
+func TestReapStaleRootsRedownload(t *testing.T) {
+	bs, storage, outChan := mkReaperTestCtx()
+	// Partial roots of a previous run aren't tracked until found
+	blockMap, a := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, make([]byte, 40000), dl.EpochLedgerTag)
+	require.NoError(t, storage.SetStatus(a, codanet.Partial))
+	block, err := blocks.NewBlockWithCid(blockMap[a], codanet.BlockHashToCid(a))
+	require.NoError(t, err)
+	require.NoError(t, storage.Put(block))
+	// Tag of a root without the root block is unknown
+	_, b := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, make([]byte, 100), dl.BlockBodyTag)
+	require.NoError(t, storage.SetStatus(b, codanet.Partial))
+	// Downloads are not started while the limit is reached
+	bs.scheduler.Configure(1, ipc.DownloadPolicy_fifo, nil)
+	bs.rootDownloadStates[dl.Root{1}] = &dl.RootDownloadState{CancelF: func() {}}
+
+	now := time.Now()
+	cmd := bitswapReapCmd{found: []dl.BitswapBlockLink{a, b}, maxAge: time.Minute, redownload: true, now: now}
+	res := bs.reapStaleRoots(cmd)
+	require.Empty(t, res.deleted)
+	require.Empty(t, res.requeued)
+
+	cmd = bitswapReapCmd{maxAge: time.Minute, redownload: true, now: now.Add(time.Minute)}
+	res = bs.reapStaleRoots(cmd)
+	require.Equal(t, []dl.Root{dl.Root(b)}, res.deleted)
+	require.Equal(t, []dl.Root{dl.Root(a)}, res.requeued)
+	require.True(t, bs.scheduler.Queued(a))
+	requireReaperTestUpdate(t, outChan, ipc.ResourceUpdateType_removed, b)
+	requireReaperTestUpdate(t, outChan, ipc.ResourceUpdateType_requeued, a)
+
+	// Root is requeued once, it's deleted when stale again
+	bs.scheduler.Remove(a)
+	cmd.now = now.Add(3 * time.Minute)
+	res = bs.reapStaleRoots(cmd)
+	require.Equal(t, []dl.Root{dl.Root(a)}, res.deleted)
+	require.Empty(t, res.requeued)
+}
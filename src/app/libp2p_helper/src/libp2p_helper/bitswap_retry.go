@@ -0,0 +1,203 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+)
+
+const (
+	defaultDownloadRetryInitialBackoff = 5 * time.Second
+	defaultDownloadRetryMaxBackoff     = 5 * time.Minute
+	// Interval of checking for retries that are due
+	downloadRetryCheck = time.Second
+)
+
+type downloadRetry struct {
+	tag      dl.BitswapDataTag
+	priority ipc.DownloadPriority
+	traceId  string
+	// attempts that timed out so far
+	attempts int
+	// zero if the root isn't waiting for a retry
+	retryAt time.Time
+}
+
+// downloadRetries restarts downloads of roots that timed out, with the
+// backoff doubling after each attempt, so that transient network failures
+// don't require the daemon to re-issue the download. A root is given up
+// on (as without retries) once its attempts are exhausted.
+//
+// State is only accessed from the Bitswap loop, configuration may be
+// updated concurrently.
+type downloadRetries struct {
+	roots map[dl.Root]*downloadRetry
+
+	// attempts of a root at most, including the first one;
+	// zero or one means no retries
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	mutex          sync.Mutex
+}
+
+func newDownloadRetries() *downloadRetries {
+	return &downloadRetries{
+		roots:          make(map[dl.Root]*downloadRetry),
+		initialBackoff: defaultDownloadRetryInitialBackoff,
+		maxBackoff:     defaultDownloadRetryMaxBackoff,
+	}
+}
+
+// Configure replaces configuration of retries, zero backoffs
+// are replaced with defaults
+func (r *downloadRetries) Configure(maxAttempts int, initialBackoff, maxBackoff time.Duration) {
+	if initialBackoff == 0 {
+		initialBackoff = defaultDownloadRetryInitialBackoff
+	}
+	if maxBackoff == 0 {
+		maxBackoff = defaultDownloadRetryMaxBackoff
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.maxAttempts = maxAttempts
+	r.initialBackoff = initialBackoff
+	r.maxBackoff = maxBackoff
+}
+
+// backoff returns the delay before the retry following the given number
+// of failed attempts
+func (r *downloadRetries) backoff(attempts int) time.Duration {
+	d := r.initialBackoff
+	for i := 1; i < attempts && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+	return d
+}
+
+// TimedOut records a timed out attempt of the root, returning
+// false if the root is to be given up on
+func (r *downloadRetries) TimedOut(root dl.Root, tag dl.BitswapDataTag, priority ipc.DownloadPriority, traceId string, now time.Time) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s, has := r.roots[root]
+	if !has {
+		s = &downloadRetry{}
+		r.roots[root] = s
+	}
+	s.tag = tag
+	s.priority = priority
+	s.traceId = traceId
+	s.attempts++
+	if s.attempts >= r.maxAttempts {
+		delete(r.roots, root)
+		return false
+	}
+	s.retryAt = now.Add(r.backoff(s.attempts))
+	return true
+}
+
+// Waiting tells whether the root waits for a retry
+func (r *downloadRetries) Waiting(root dl.Root) bool {
+	s, has := r.roots[root]
+	return has && !s.retryAt.IsZero()
+}
+
+// Len returns the number of roots waiting for a retry
+func (r *downloadRetries) Len() int {
+	n := 0
+	for _, s := range r.roots {
+		if !s.retryAt.IsZero() {
+			n++
+		}
+	}
+	return n
+}
+
+// WaitingRoots returns roots waiting for a retry
+func (r *downloadRetries) WaitingRoots() []dl.Root {
+	res := []dl.Root{}
+	for root, s := range r.roots {
+		if !s.retryAt.IsZero() {
+			res = append(res, root)
+		}
+	}
+	return res
+}
+
+// Due returns roots whose retries are due, they are no longer
+// considered waiting
+func (r *downloadRetries) Due(now time.Time) []queuedDownload {
+	res := []queuedDownload{}
+	for root, s := range r.roots {
+		if !s.retryAt.IsZero() && !now.Before(s.retryAt) {
+			s.retryAt = time.Time{}
+			res = append(res, queuedDownload{root: root, tag: s.tag, priority: s.priority, traceId: s.traceId})
+		}
+	}
+	return res
+}
+
+// Attempts returns the number of timed out attempts of the root
+func (r *downloadRetries) Attempts(root dl.Root) int {
+	if s, has := r.roots[root]; has {
+		return s.attempts
+	}
+	return 0
+}
+
+// Forget drops the state of the root, called when it's
+// completed, found broken or removed
+func (r *downloadRetries) Forget(root dl.Root) {
+	delete(r.roots, root)
+}
+
+func readDownloadRetryConfig(cfg ipc.DownloadRetryConfig) (int, time.Duration, time.Duration, error) {
+	initialBackoff, err := cfg.InitialBackoff()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	maxBackoff, err := cfg.MaxBackoff()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return int(cfg.MaxAttempts()), time.Duration(initialBackoff.NanoSec()), time.Duration(maxBackoff.NanoSec()), nil
+}
+
+// timeOutRoot frees the download state of the timed out root
+// and schedules its retry, unless the root is given up on
+func (bs *BitswapCtx) timeOutRoot(root dl.Root, now time.Time) {
+	traceId, hasTraceId := bs.traceIds[root]
+	state, has := bs.rootDownloadStates[root]
+	if has {
+		observeRootDownload(state, dl.DownloadTimedOut)
+	}
+	if has && bs.retries.TimedOut(root, state.Tag, state.Priority, traceId, now) {
+		bitswapDownloadRetriesMetric.Inc()
+		bitswapLogger.Debugw("root download timed out, retrying", "root", codanet.BlockHashToCidSuffix(root),
+			"attempts", bs.retries.Attempts(root), "trace_id", traceId)
+		dl.ClearRootDownloadState(bs, root)
+		return
+	}
+	if hasTraceId {
+		bitswapLogger.Debugw("root download timed out", "root", codanet.BlockHashToCidSuffix(root), "trace_id", traceId)
+		delete(bs.traceIds, root)
+	}
+	dl.ClearRootDownloadState(bs, root)
+	bs.abandonRoot(root)
+}
+
+// retryDownloads queues roots whose retries are due
+func (bs *BitswapCtx) retryDownloads(now time.Time) {
+	for _, d := range bs.retries.Due(now) {
+		if _, downloading := bs.rootDownloadStates[d.root]; !downloading {
+			bs.scheduler.Enqueue(d.root, d.tag, d.priority, d.traceId)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadRetriesBackoff(t *testing.T) {
+	r := newDownloadRetries()
+	r.Configure(10, time.Second, 10*time.Second)
+	require.Equal(t, time.Second, r.backoff(1))
+	require.Equal(t, 2*time.Second, r.backoff(2))
+	require.Equal(t, 8*time.Second, r.backoff(4))
+	require.Equal(t, 10*time.Second, r.backoff(5))
+	require.Equal(t, 10*time.Second, r.backoff(100))
+}
+
+func TestDownloadRetries(t *testing.T) {
+	r := newDownloadRetries()
+	r.Configure(3, time.Second, time.Minute)
+	a := dl.Root{1}
+	now := time.Now()
+
+	require.True(t, r.TimedOut(a, 1, ipc.DownloadPriority_normal, "trace", now))
+	require.True(t, r.Waiting(a))
+	require.Empty(t, r.Due(now))
+	due := r.Due(now.Add(time.Second))
+	require.Equal(t, []queuedDownload{{root: a, tag: 1, traceId: "trace"}}, due)
+	require.False(t, r.Waiting(a))
+	require.Empty(t, r.Due(now.Add(time.Hour)))
+
+	// Backoff doubles after the second attempt
+	now = now.Add(time.Minute)
+	require.True(t, r.TimedOut(a, 1, ipc.DownloadPriority_normal, "trace", now))
+	require.Empty(t, r.Due(now.Add(time.Second)))
+	require.Len(t, r.Due(now.Add(2*time.Second)), 1)
+
+	// Root is given up on after the last attempt
+	require.False(t, r.TimedOut(a, 1, ipc.DownloadPriority_normal, "trace", now))
+	require.Equal(t, 0, r.Attempts(a))
+	require.False(t, r.Waiting(a))
+}
+
+func TestDownloadRetriesDisabled(t *testing.T) {
+	r := newDownloadRetries()
+	require.False(t, r.TimedOut(dl.Root{1}, 0, ipc.DownloadPriority_normal, "", time.Now()))
+	r.Configure(1, 0, 0)
+	require.False(t, r.TimedOut(dl.Root{1}, 0, ipc.DownloadPriority_normal, "", time.Now()))
+}
+
+func TestDownloadRetriesForget(t *testing.T) {
+	r := newDownloadRetries()
+	r.Configure(3, time.Second, time.Minute)
+	a := dl.Root{1}
+	now := time.Now()
+	require.True(t, r.TimedOut(a, 0, ipc.DownloadPriority_normal, "", now))
+	r.Forget(a)
+	require.False(t, r.Waiting(a))
+	require.Empty(t, r.Due(now.Add(time.Hour)))
+	// Attempts are counted anew after the root was forgotten
+	require.True(t, r.TimedOut(a, 0, ipc.DownloadPriority_normal, "", now))
+	require.Equal(t, 1, r.Attempts(a))
+}
+
+func TestExtendDeadline(t *testing.T) {
+	start := time.Now()
+	conf := dl.BitswapDataConfig{
+		DownloadTimeout:    time.Minute,
+		TimeoutPerBlock:    time.Second,
+		TimeoutPerMib:      10 * time.Second,
+		StallTimeout:       30 * time.Second,
+		MaxDownloadTimeout: 10 * time.Minute,
+	}
+	s := &dl.RootDownloadState{StartedAt: start}
+	s.ExtendDeadline(conf, start)
+	require.Equal(t, start.Add(time.Minute), s.Deadline)
+
+	// Budget of the tree is added once its schema is known
+	schema := dl.MkBitswapBlockSchemaLengthPrefixed(1<<20, 10*(1<<20)-100)
+	s.Schema = &schema
+	s.ExtendDeadline(conf, start)
+	perBlock := time.Duration(schema.TotalBlocks) * time.Second
+	perMib := time.Duration(float64(s.TotalBytes()) / (1 << 20) * float64(10*time.Second))
+	require.Equal(t, start.Add(time.Minute+perBlock+perMib), s.Deadline)
+
+	// Progress late in the download keeps the deadline stallTimeout away
+	late := s.Deadline.Add(-time.Second)
+	s.ExtendDeadline(conf, late)
+	require.Equal(t, late.Add(30*time.Second), s.Deadline)
+
+	// The deadline is capped and never moved earlier
+	s.ExtendDeadline(conf, start.Add(time.Hour))
+	require.Equal(t, start.Add(10*time.Minute), s.Deadline)
+	conf.MaxDownloadTimeout = 5 * time.Minute
+	s.ExtendDeadline(conf, start)
+	require.Equal(t, start.Add(10*time.Minute), s.Deadline)
+}
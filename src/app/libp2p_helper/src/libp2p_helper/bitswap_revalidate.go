@@ -0,0 +1,172 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"errors"
+	"fmt"
+
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"golang.org/x/crypto/blake2b"
+)
+
+type bitswapRevalidateResult struct {
+	// first inconsistency found in the tree, nil if it's consistent
+	problem error
+	// set when status of the root was downgraded from full to partial
+	downgraded bool
+	err        error
+}
+
+type bitswapRevalidateCmd struct {
+	root   dl.Root
+	result chan<- bitswapRevalidateResult
+}
+
+type treeValidation struct {
+	problem error
+	// blocks not matching their hashes
+	corrupted []dl.BitswapBlockLink
+}
+
+type treeNode struct {
+	link dl.BitswapBlockLink
+	ix   dl.NodeIndex
+}
+
+// validateRootTree re-runs checks performed on blocks of the root while
+// downloading it against blocks in the storage: every block is present and
+// matches its hash, root block declares a configured tag and a length within
+// limits of the tag, and every block has size and link count determined by
+// the length. Blocks failing their checksums on read are corrupted as well.
+// Error is only returned if the storage fails.
+func validateRootTree(storage codanet.BitswapStorage, root_ dl.Root, maxBlockSize int, di dl.DepthIndices, dataConfig map[dl.BitswapDataTag]dl.BitswapDataConfig) (treeValidation, error) {
+	var res treeValidation
+	fail := func(err error) {
+		if res.problem == nil {
+			res.problem = err
+		}
+	}
+	var schema *dl.BitswapBlockSchema
+	queue := []treeNode{{link: dl.BitswapBlockLink(root_), ix: 0}}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		id := codanet.BlockHashToCidSuffix(node.link)
+		var hashMatches bool
+		var size int
+		var links []dl.BitswapBlockLink
+		var readErr error
+		err := storage.ViewBlock(node.link, func(b []byte) error {
+			hashMatches = blake2b.Sum256(b) == node.link
+			size = len(b)
+			var data []byte
+			links, data, readErr = dl.ReadBitswapBlock(b)
+			if readErr == nil && node.ix == 0 {
+				var s dl.BitswapBlockSchema
+				_, s, readErr = dl.ReadRootBlock(data, maxBlockSize, dataConfig)
+				schema = &s
+				di = dl.DepthIndicesOf(di, schema)
+			}
+			return nil
+		})
+		if err == blockstore.ErrNotFound {
+			fail(fmt.Errorf("block #%d (%s) is missing", node.ix, id))
+			continue
+		}
+		if errors.Is(err, codanet.ErrBlockChecksum) {
+			res.corrupted = append(res.corrupted, node.link)
+			fail(fmt.Errorf("block #%d (%s) doesn't match its checksum", node.ix, id))
+			continue
+		}
+		if err != nil {
+			return res, err
+		}
+		if !hashMatches {
+			res.corrupted = append(res.corrupted, node.link)
+			fail(fmt.Errorf("block #%d (%s) doesn't match its hash", node.ix, id))
+			continue
+		}
+		// Blocks that match their hashes, but are inconsistent
+		// with the schema, make the whole tree malformed
+		if readErr != nil {
+			fail(fmt.Errorf("error reading block #%d (%s): %w", node.ix, id, readErr))
+			return res, nil
+		}
+		if size != schema.BlockSize(node.ix) {
+			fail(fmt.Errorf("unexpected size for block #%d (%s): %d != %d", node.ix, id, size, schema.BlockSize(node.ix)))
+			return res, nil
+		}
+		if len(links) != schema.LinkCount(node.ix) {
+			fail(fmt.Errorf("unexpected link count for block #%d (%s): %d != %d", node.ix, id, len(links), schema.LinkCount(node.ix)))
+			return res, nil
+		}
+		fstChildId := di.FirstChildId(node.ix)
+		for childIx, link := range links {
+			queue = append(queue, treeNode{link: link, ix: fstChildId + dl.NodeIndex(childIx)})
+		}
+	}
+	return res, nil
+}
+
+// revalidateRoot validates the tree of a stored root. A full root with
+// an inconsistent tree is downgraded to partial, so that the daemon
+// re-downloads it, and its blocks not matching their hashes are deleted,
+// as otherwise they would be served from the storage to the downloader.
+func (bs *BitswapCtx) revalidateRoot(root dl.Root) bitswapRevalidateResult {
+	var res bitswapRevalidateResult
+	status, err := bs.storage.GetStatus(root)
+	if err == blockstore.ErrNotFound {
+		res.err = fmt.Errorf("resource %s is unknown", codanet.BlockHashToCidSuffix(root))
+		return res
+	}
+	if err != nil {
+		res.err = err
+		return res
+	}
+	v, err := validateRootTree(bs.storage, root, bs.maxBlockSize, bs.depthIndices, bs.dataConfig)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	res.problem = v.problem
+	if v.problem == nil || status != codanet.Full {
+		return res
+	}
+	if err := bs.downgradeRoot(root, v); err != nil {
+		res.err = err
+		return res
+	}
+	res.downgraded = true
+	return res
+}
+
+// downgradeRoot resets status of a full root with an inconsistent tree
+// to partial, blocks of the tree not matching their hashes are deleted
+func (bs *BitswapCtx) downgradeRoot(root dl.Root, v treeValidation) error {
+	bitswapLogger.Warnf("Downgrading resource %s to partial: %s", codanet.BlockHashToCidSuffix(root), v.problem)
+	storage, ok := bs.storage.(fsckStorage)
+	if !ok {
+		return errors.New("storage doesn't support status repairs")
+	}
+	if refCounter, ok := bs.storage.(codanet.BitswapRefCounter); ok {
+		// Links of corrupted blocks can't be followed, their descendants
+		// stay referenced until reference counts are rebuilt by fsck
+		corrupted := make(map[dl.BitswapBlockLink]bool, len(v.corrupted))
+		for _, key := range v.corrupted {
+			corrupted[key] = true
+		}
+		keys, err := bs.distinctRootBlocks(root, corrupted)
+		if err == nil {
+			_, err = refCounter.UnrefBlocks(keys)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := bs.storage.DeleteBlocks(v.corrupted); err != nil {
+		return err
+	}
+	bs.unpinRoot(root)
+	return storage.ForceStatus(root, codanet.Partial)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"context"
+	"math"
+	"testing"
+
+	capnp "capnproto.org/go/capnp/v3"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevalidateRoot(t *testing.T) {
+	bs := NewBitswapCtx(context.Background(), make(chan *capnp.Message, 10))
+	storage := codanet.NewBitswapStorageMemory(1 << 20)
+	bs.storage = storage
+	bs.maxBlockSize = 1000
+	bs.depthIndices = dl.MkDepthIndices(dl.LinksPerBlock(1000), math.MaxInt32)
+
+	data := make([]byte, 40000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	blockMap, root := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, data, dl.BlockBodyTag)
+	require.Error(t, bs.revalidateRoot(root).err)
+
+	var corrupted dl.BitswapBlockLink
+	for h, b := range blockMap {
+		if h != root {
+			corrupted = h
+		}
+		block, err := blocks.NewBlockWithCid(b, codanet.BlockHashToCid(h))
+		require.NoError(t, err)
+		require.NoError(t, storage.Put(block))
+	}
+	require.NoError(t, storage.SetStatus(root, codanet.Full))
+	res := bs.revalidateRoot(root)
+	require.NoError(t, res.err)
+	require.NoError(t, res.problem)
+	require.False(t, res.downgraded)
+
+	// Block of the same size, but with contents not matching the hash
+	b := make([]byte, len(blockMap[corrupted]))
+	copy(b, blockMap[corrupted])
+	b[len(b)-1]++
+	block, err := blocks.NewBlockWithCid(b, codanet.BlockHashToCid(corrupted))
+	require.NoError(t, err)
+	require.NoError(t, storage.DeleteBlocks([][32]byte{corrupted}))
+	require.NoError(t, storage.Put(block))
+	res = bs.revalidateRoot(root)
+	require.NoError(t, res.err)
+	require.Error(t, res.problem)
+	require.True(t, res.downgraded)
+	status, err := storage.GetStatus(root)
+	require.NoError(t, err)
+	require.Equal(t, codanet.Partial, status)
+	// Corrupted block is deleted to be downloaded again
+	has, err := storage.Has(codanet.BlockHashToCid(corrupted))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// Partial roots are only reported
+	res = bs.revalidateRoot(root)
+	require.NoError(t, res.err)
+	require.Error(t, res.problem)
+	require.False(t, res.downgraded)
+}
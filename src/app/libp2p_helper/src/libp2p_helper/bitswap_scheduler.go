@@ -0,0 +1,237 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"sync"
+
+	ipc "libp2p_ipc"
+)
+
+type queuedDownload struct {
+	root     dl.Root
+	tag      dl.BitswapDataTag
+	priority ipc.DownloadPriority
+	traceId  string
+	// order of enqueueing
+	seq uint64
+}
+
+// downloadScheduler queues roots requested for download and decides
+// which of them are kick-started, so that a node isn't saturated by
+// sessions of all requested roots at once. Queued roots of higher
+// priority hinted by the daemon are started first, then roots of tags
+// with higher priority, ties are broken by the order of requests
+// (oldest or newest first, depending on the policy).
+//
+// Queue is only accessed from the Bitswap loop, configuration may be
+// updated concurrently.
+type downloadScheduler struct {
+	queue []queuedDownload
+	seq   uint64
+
+	// zero means no limit
+	maxConcurrent int
+	policy        ipc.DownloadPolicy
+	priorities    map[dl.BitswapDataTag]int32
+	mutex         sync.Mutex
+}
+
+func newDownloadScheduler() *downloadScheduler {
+	return &downloadScheduler{
+		policy:     ipc.DownloadPolicy_fifo,
+		priorities: make(map[dl.BitswapDataTag]int32),
+	}
+}
+
+// Configure replaces configuration of the scheduler, downloads
+// in progress are not affected by a lower limit
+func (s *downloadScheduler) Configure(maxConcurrent int, policy ipc.DownloadPolicy, priorities map[dl.BitswapDataTag]int32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.maxConcurrent = maxConcurrent
+	s.policy = policy
+	s.priorities = priorities
+}
+
+// SetMaxConcurrent replaces the limit of concurrent
+// downloads only, the previous limit is returned
+func (s *downloadScheduler) SetMaxConcurrent(maxConcurrent int) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	prev := s.maxConcurrent
+	s.maxConcurrent = maxConcurrent
+	return prev
+}
+
+// Queued tells whether the root waits to be started
+func (s *downloadScheduler) Queued(root dl.Root) bool {
+	for _, d := range s.queue {
+		if d.root == root {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of queued roots
+func (s *downloadScheduler) Len() int {
+	return len(s.queue)
+}
+
+// Roots returns queued roots in the order of enqueueing
+func (s *downloadScheduler) Roots() []dl.Root {
+	res := make([]dl.Root, len(s.queue))
+	for i, d := range s.queue {
+		res[i] = d.root
+	}
+	return res
+}
+
+// priorityRank orders hinted priorities of downloads
+func priorityRank(p ipc.DownloadPriority) int {
+	switch p {
+	case ipc.DownloadPriority_critical:
+		return 2
+	case ipc.DownloadPriority_background:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// Enqueue puts the root to the queue unless it's already queued,
+// priority of a queued root is raised if a higher one is given
+func (s *downloadScheduler) Enqueue(root dl.Root, tag dl.BitswapDataTag, priority ipc.DownloadPriority, traceId string) {
+	for i, d := range s.queue {
+		if d.root == root {
+			if priorityRank(priority) > priorityRank(d.priority) {
+				s.queue[i].priority = priority
+			}
+			return
+		}
+	}
+	s.seq++
+	s.queue = append(s.queue, queuedDownload{root: root, tag: tag, priority: priority, traceId: traceId, seq: s.seq})
+}
+
+// CriticalQueued tells whether any critical root waits to be started
+func (s *downloadScheduler) CriticalQueued() bool {
+	for _, d := range s.queue {
+		if d.priority == ipc.DownloadPriority_critical {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove drops the root from the queue
+func (s *downloadScheduler) Remove(root dl.Root) {
+	for i, d := range s.queue {
+		if d.root == root {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// Next dequeues the root to be started given the number
+// of roots being downloaded, false is returned if none
+func (s *downloadScheduler) Next(active int) (queuedDownload, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.queue) == 0 || (s.maxConcurrent > 0 && active >= s.maxConcurrent) {
+		return queuedDownload{}, false
+	}
+	best := 0
+	for i := 1; i < len(s.queue); i++ {
+		r, bestR := priorityRank(s.queue[i].priority), priorityRank(s.queue[best].priority)
+		p, bestP := s.priorities[s.queue[i].tag], s.priorities[s.queue[best].tag]
+		if r != bestR {
+			if r > bestR {
+				best = i
+			}
+		} else if p > bestP || (p == bestP && s.policy == ipc.DownloadPolicy_lifo) {
+			best = i
+		}
+	}
+	d := s.queue[best]
+	s.queue = append(s.queue[:best], s.queue[best+1:]...)
+	return d, true
+}
+
+func readDownloadSchedulerConfig(cfg ipc.DownloadSchedulerConfig) (int, ipc.DownloadPolicy, map[dl.BitswapDataTag]int32, error) {
+	prioritiesM, err := cfg.TagPriorities()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	priorities := make(map[dl.BitswapDataTag]int32, prioritiesM.Len())
+	for i := 0; i < prioritiesM.Len(); i++ {
+		tp := prioritiesM.At(i)
+		priorities[dl.BitswapDataTag(tp.Tag())] = tp.Priority()
+	}
+	return int(cfg.MaxConcurrentRoots()), cfg.Policy(), priorities, nil
+}
+
+// startDownloads kick-starts queued roots while the limit allows,
+// preempting downloads of lower priority for critical roots
+func (bs *BitswapCtx) startDownloads() {
+	for {
+		d, ok := bs.scheduler.Next(len(bs.rootDownloadStates))
+		if !ok {
+			if bs.scheduler.CriticalQueued() && bs.preemptDownload() {
+				continue
+			}
+			return
+		}
+		bs.startDownload(d)
+	}
+}
+
+// startDownload kick-starts the dequeued root, its corrupted
+// blocks are downloaded again
+func (bs *BitswapCtx) startDownload(d queuedDownload) {
+	bs.repairCorruptedRoot(d.root)
+	if _, downloading := bs.rootDownloadStates[d.root]; !downloading {
+		bs.registerTraceId(d.traceId, d.root)
+	}
+	dl.KickStartRootDownload(d.root, d.tag, bs)
+	if state, downloading := bs.rootDownloadStates[d.root]; downloading {
+		state.Priority = d.priority
+	} else {
+		// Download wasn't started or is already finished
+		delete(bs.traceIds, d.root)
+		delete(bs.providers, d.root)
+		delete(bs.batches, d.root)
+		bs.retries.Forget(d.root)
+		bs.abandonRoot(d.root)
+	}
+}
+
+// preemptDownload stops the download of a root of the lowest priority
+// below critical, started last, and queues the root again. Blocks fetched
+// so far are kept, so the download continues where it stopped once the
+// root is started again. False is returned if no download was preempted.
+func (bs *BitswapCtx) preemptDownload() bool {
+	var victim dl.Root
+	var victimState *dl.RootDownloadState
+	for root, state := range bs.rootDownloadStates {
+		if state.Priority == ipc.DownloadPriority_critical {
+			continue
+		}
+		if victimState == nil ||
+			priorityRank(state.Priority) < priorityRank(victimState.Priority) ||
+			(state.Priority == victimState.Priority && state.StartedAt.After(victimState.StartedAt)) {
+			victim, victimState = root, state
+		}
+	}
+	if victimState == nil {
+		return false
+	}
+	bitswapLogger.Debugw("root download preempted", "root", codanet.BlockHashToCidSuffix(victim),
+		"priority", victimState.Priority.String(), "trace_id", bs.traceIds[victim])
+	observeRootDownload(victimState, dl.DownloadPreempted)
+	dl.ClearRootDownloadState(bs, victim)
+	bs.scheduler.Enqueue(victim, victimState.Tag, victimState.Priority, bs.traceIds[victim])
+	return true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testSchedulerRoot(i byte) dl.Root {
+	var r dl.Root
+	r[0] = i
+	return r
+}
+
+func dequeueAll(s *downloadScheduler) []dl.Root {
+	res := []dl.Root{}
+	for {
+		d, ok := s.Next(0)
+		if !ok {
+			return res
+		}
+		res = append(res, d.root)
+	}
+}
+
+func TestDownloadSchedulerPolicy(t *testing.T) {
+	s := newDownloadScheduler()
+	for i := byte(1); i <= 3; i++ {
+		s.Enqueue(testSchedulerRoot(i), 0, ipc.DownloadPriority_normal, "")
+	}
+	// Duplicates are ignored
+	s.Enqueue(testSchedulerRoot(1), 0, ipc.DownloadPriority_normal, "")
+	require.Equal(t, []dl.Root{testSchedulerRoot(1), testSchedulerRoot(2), testSchedulerRoot(3)}, dequeueAll(s))
+
+	s.Configure(0, ipc.DownloadPolicy_lifo, map[dl.BitswapDataTag]int32{})
+	for i := byte(1); i <= 3; i++ {
+		s.Enqueue(testSchedulerRoot(i), 0, ipc.DownloadPriority_normal, "")
+	}
+	require.Equal(t, []dl.Root{testSchedulerRoot(3), testSchedulerRoot(2), testSchedulerRoot(1)}, dequeueAll(s))
+}
+
+func TestDownloadSchedulerPriorities(t *testing.T) {
+	s := newDownloadScheduler()
+	s.Configure(0, ipc.DownloadPolicy_fifo, map[dl.BitswapDataTag]int32{1: 10, 2: -1})
+	s.Enqueue(testSchedulerRoot(1), 2, ipc.DownloadPriority_normal, "")
+	s.Enqueue(testSchedulerRoot(2), 0, ipc.DownloadPriority_normal, "")
+	s.Enqueue(testSchedulerRoot(3), 1, ipc.DownloadPriority_normal, "")
+	s.Enqueue(testSchedulerRoot(4), 1, ipc.DownloadPriority_normal, "")
+	require.Equal(t, []dl.Root{testSchedulerRoot(3), testSchedulerRoot(4), testSchedulerRoot(2), testSchedulerRoot(1)}, dequeueAll(s))
+}
+
+func TestDownloadSchedulerPriorityHints(t *testing.T) {
+	s := newDownloadScheduler()
+	s.Configure(0, ipc.DownloadPolicy_fifo, map[dl.BitswapDataTag]int32{1: 10})
+	s.Enqueue(testSchedulerRoot(1), 1, ipc.DownloadPriority_background, "")
+	s.Enqueue(testSchedulerRoot(2), 0, ipc.DownloadPriority_normal, "")
+	s.Enqueue(testSchedulerRoot(3), 0, ipc.DownloadPriority_critical, "")
+	s.Enqueue(testSchedulerRoot(4), 0, ipc.DownloadPriority_background, "")
+	require.False(t, s.CriticalQueued())
+	// Priority of a queued root is raised, never lowered
+	s.Enqueue(testSchedulerRoot(4), 0, ipc.DownloadPriority_normal, "")
+	s.Enqueue(testSchedulerRoot(3), 0, ipc.DownloadPriority_background, "")
+	require.True(t, s.CriticalQueued())
+	require.Equal(t, []dl.Root{testSchedulerRoot(3), testSchedulerRoot(2), testSchedulerRoot(4), testSchedulerRoot(1)}, dequeueAll(s))
+	require.False(t, s.CriticalQueued())
+}
+
+func TestPreemptDownload(t *testing.T) {
+	bs, _, _ := mkReaperTestCtx()
+	now := time.Now()
+	cancelled := map[dl.Root]bool{}
+	addState := func(r dl.Root, priority ipc.DownloadPriority, startedAt time.Time) {
+		bs.rootDownloadStates[r] = &dl.RootDownloadState{
+			CancelF:   func() { cancelled[r] = true },
+			Priority:  priority,
+			StartedAt: startedAt,
+		}
+	}
+	addState(testSchedulerRoot(1), ipc.DownloadPriority_normal, now.Add(-time.Minute))
+	addState(testSchedulerRoot(2), ipc.DownloadPriority_normal, now)
+	addState(testSchedulerRoot(3), ipc.DownloadPriority_background, now.Add(-time.Hour))
+	addState(testSchedulerRoot(4), ipc.DownloadPriority_critical, now)
+
+	// Downloads of the lowest priority are preempted first,
+	// the ones started last among them
+	for _, i := range []byte{3, 2, 1} {
+		require.True(t, bs.preemptDownload())
+		require.True(t, cancelled[testSchedulerRoot(i)])
+		require.NotContains(t, bs.rootDownloadStates, testSchedulerRoot(i))
+		require.True(t, bs.scheduler.Queued(testSchedulerRoot(i)))
+	}
+	// Critical downloads are never preempted
+	require.False(t, bs.preemptDownload())
+	require.Contains(t, bs.rootDownloadStates, testSchedulerRoot(4))
+	// Preempted roots are queued with their priority
+	require.Equal(t, []dl.Root{testSchedulerRoot(2), testSchedulerRoot(1), testSchedulerRoot(3)}, dequeueAll(bs.scheduler))
+}
+
+func TestDownloadSchedulerLimit(t *testing.T) {
+	s := newDownloadScheduler()
+	s.Configure(2, ipc.DownloadPolicy_fifo, map[dl.BitswapDataTag]int32{})
+	for i := byte(1); i <= 3; i++ {
+		s.Enqueue(testSchedulerRoot(i), 0, ipc.DownloadPriority_normal, "")
+	}
+	_, ok := s.Next(2)
+	require.False(t, ok)
+	d, ok := s.Next(1)
+	require.True(t, ok)
+	require.Equal(t, testSchedulerRoot(1), d.root)
+
+	s.Remove(testSchedulerRoot(2))
+	require.False(t, s.Queued(testSchedulerRoot(2)))
+	require.Equal(t, []dl.Root{testSchedulerRoot(3)}, dequeueAll(s))
+}
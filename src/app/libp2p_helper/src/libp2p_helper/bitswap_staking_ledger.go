@@ -0,0 +1,142 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"errors"
+	"time"
+
+	ipc "libp2p_ipc"
+)
+
+const (
+	defaultSeededSnapshots  = 2
+	defaultTransitionWindow = time.Hour
+)
+
+// stakingLedgers distributes snapshots of staking ledgers (of the
+// StakingLedgerTag), which all nodes need at epoch boundaries. Snapshots
+// requested close to an epoch transition are downloaded with critical
+// priority, and seeding nodes (block producers) keep the latest snapshots
+// they completed pinned, so that they're served to other nodes. Snapshots
+// are always verified by the daemon before they're marked full.
+//
+// It's only accessed from the Bitswap loop, nil means distribution
+// of snapshots is disabled.
+type stakingLedgers struct {
+	seed             bool
+	seededSnapshots  int
+	genesis          time.Time
+	epochDuration    time.Duration
+	transitionWindow time.Duration
+	// roots pinned for seeding, oldest first
+	seeded []dl.Root
+}
+
+func readStakingLedgerConfig(c ipc.StakingLedgerConfig) (*stakingLedgers, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	genesis, err := c.GenesisTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	epochDuration, err := c.EpochDuration()
+	if err != nil {
+		return nil, err
+	}
+	window, err := c.TransitionWindow()
+	if err != nil {
+		return nil, err
+	}
+	s := &stakingLedgers{
+		seed:             c.Seed(),
+		seededSnapshots:  int(c.SeededSnapshots()),
+		genesis:          time.Unix(0, genesis.NanoSec()),
+		epochDuration:    time.Duration(epochDuration.NanoSec()),
+		transitionWindow: time.Duration(window.NanoSec()),
+	}
+	if s.epochDuration <= 0 {
+		return nil, errors.New("epoch duration of staking ledgers is not set")
+	}
+	if s.seededSnapshots == 0 {
+		s.seededSnapshots = defaultSeededSnapshots
+	}
+	if s.transitionWindow == 0 {
+		s.transitionWindow = defaultTransitionWindow
+	}
+	return s, nil
+}
+
+// nearTransition tells whether an epoch transition
+// is within the window from the time
+func (s *stakingLedgers) nearTransition(now time.Time) bool {
+	sinceTransition := now.Sub(s.genesis) % s.epochDuration
+	if sinceTransition < 0 {
+		sinceTransition += s.epochDuration
+	}
+	return sinceTransition <= s.transitionWindow || s.epochDuration-sinceTransition <= s.transitionWindow
+}
+
+// downloadPriority raises priority of snapshots requested close
+// to an epoch transition, it's a no-op for nil staking ledgers
+func (s *stakingLedgers) downloadPriority(tag dl.BitswapDataTag, priority ipc.DownloadPriority, now time.Time) ipc.DownloadPriority {
+	if s == nil || tag != dl.StakingLedgerTag || !s.nearTransition(now) {
+		return priority
+	}
+	return ipc.DownloadPriority_critical
+}
+
+// verifiedTags adds the tag of snapshots to verified tags
+func (s *stakingLedgers) verifiedTags(tags []dl.BitswapDataTag) []dl.BitswapDataTag {
+	if s == nil {
+		return tags
+	}
+	for _, tag := range tags {
+		if tag == dl.StakingLedgerTag {
+			return tags
+		}
+	}
+	return append(tags, dl.StakingLedgerTag)
+}
+
+// seedSnapshot pins a root that became full if it's a snapshot and the
+// node seeds them, the oldest snapshot pinned for seeding is unpinned
+// once there are more of them than kept. Roots pinned by the daemon
+// are left to the daemon.
+func (bs *BitswapCtx) seedSnapshot(root dl.Root) {
+	s := bs.stakingLedgers
+	if s == nil || !s.seed {
+		return
+	}
+	if _, pinned := bs.pinned[root]; pinned {
+		return
+	}
+	if tag, known := bs.rootTag(root); !known || tag != dl.StakingLedgerTag {
+		return
+	}
+	if err := bs.pinRoot(root); err != nil {
+		bitswapLogger.Errorf("Failed to pin snapshot %s for seeding: %s", codanet.BlockHashToCidSuffix(root), err)
+		return
+	}
+	bitswapLogger.Infof("Seeding snapshot %s", codanet.BlockHashToCidSuffix(root))
+	s.seeded = append(s.seeded, root)
+	// Unpinning drops the root from seeded ones
+	for len(s.seeded) > s.seededSnapshots {
+		bs.unpinRoot(s.seeded[0])
+	}
+}
+
+// forgetSnapshot drops a deleted or unpinned root from seeded snapshots
+func (bs *BitswapCtx) forgetSnapshot(root dl.Root) {
+	s := bs.stakingLedgers
+	if s == nil {
+		return
+	}
+	for i, r := range s.seeded {
+		if r == root {
+			s.seeded = append(s.seeded[:i], s.seeded[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+)
+
+// putSnapshotTestRoot stores a full root of data filled with the byte
+func putSnapshotTestRoot(t *testing.T, bs *BitswapCtx, storage *codanet.BitswapStorageMemory, tag dl.BitswapDataTag, fill byte) dl.Root {
+	blockMap, r := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, bytes.Repeat([]byte{fill}, 5000), tag)
+	require.NoError(t, bs.SetStatus(r, codanet.Partial))
+	for h, b := range blockMap {
+		block, err := blocks.NewBlockWithCid(b, codanet.BlockHashToCid(h))
+		require.NoError(t, err)
+		require.NoError(t, storage.Put(block))
+	}
+	require.NoError(t, bs.SetStatus(r, codanet.Full))
+	return r
+}
+
+func TestStakingLedgerPriority(t *testing.T) {
+	genesis := time.Unix(1600000000, 0)
+	s := &stakingLedgers{
+		genesis:          genesis,
+		epochDuration:    10 * time.Hour,
+		transitionWindow: time.Hour,
+	}
+	for _, c := range []struct {
+		at   time.Duration
+		near bool
+	}{
+		{0, true},
+		{30 * time.Minute, true},
+		{2 * time.Hour, false},
+		{9 * time.Hour, true},
+		{25 * time.Hour, false},
+		{-30 * time.Minute, true},
+		{-5 * time.Hour, false},
+	} {
+		require.Equal(t, c.near, s.nearTransition(genesis.Add(c.at)), "at %s", c.at)
+	}
+
+	near, far := genesis.Add(10*time.Hour), genesis.Add(15*time.Hour)
+	require.Equal(t, ipc.DownloadPriority_critical, s.downloadPriority(dl.StakingLedgerTag, ipc.DownloadPriority_background, near))
+	require.Equal(t, ipc.DownloadPriority_background, s.downloadPriority(dl.StakingLedgerTag, ipc.DownloadPriority_background, far))
+	require.Equal(t, ipc.DownloadPriority_normal, s.downloadPriority(dl.EpochLedgerTag, ipc.DownloadPriority_normal, near))
+	// Nil staking ledgers leave priorities and verified tags as they are
+	var disabled *stakingLedgers
+	require.Equal(t, ipc.DownloadPriority_normal, disabled.downloadPriority(dl.StakingLedgerTag, ipc.DownloadPriority_normal, near))
+	require.Equal(t, []dl.BitswapDataTag{dl.BlockBodyTag}, disabled.verifiedTags([]dl.BitswapDataTag{dl.BlockBodyTag}))
+
+	require.Equal(t, []dl.BitswapDataTag{dl.BlockBodyTag, dl.StakingLedgerTag}, s.verifiedTags([]dl.BitswapDataTag{dl.BlockBodyTag}))
+	require.Equal(t, []dl.BitswapDataTag{dl.StakingLedgerTag}, s.verifiedTags([]dl.BitswapDataTag{dl.StakingLedgerTag}))
+}
+
+func TestSeedSnapshots(t *testing.T) {
+	bs, storage, _ := mkReaperTestCtx()
+	bs.stakingLedgers = &stakingLedgers{seed: true, seededSnapshots: 2, epochDuration: time.Hour}
+
+	// Roots of other tags aren't seeded
+	body := putSnapshotTestRoot(t, bs, storage, dl.BlockBodyTag, 1)
+	require.NotContains(t, bs.pinned, body)
+
+	a := putSnapshotTestRoot(t, bs, storage, dl.StakingLedgerTag, 1)
+	b := putSnapshotTestRoot(t, bs, storage, dl.StakingLedgerTag, 2)
+	require.Contains(t, bs.pinned, a)
+	require.Contains(t, bs.pinned, b)
+
+	// The oldest snapshot is unpinned once more are seeded
+	c := putSnapshotTestRoot(t, bs, storage, dl.StakingLedgerTag, 3)
+	require.NotContains(t, bs.pinned, a)
+	require.Equal(t, []dl.Root{b, c}, bs.stakingLedgers.seeded)
+
+	// Snapshots unpinned by the daemon aren't seeded anymore
+	bs.unpinRoot(b)
+	require.Equal(t, []dl.Root{c}, bs.stakingLedgers.seeded)
+
+	// Snapshots pinned by the daemon are left to the daemon
+	bs.stakingLedgers.seeded = nil
+	require.NoError(t, bs.pinRoot(a))
+	bs.seedSnapshot(a)
+	require.Empty(t, bs.stakingLedgers.seeded)
+
+	// Nodes that don't seed pin nothing
+	bs.stakingLedgers.seed = false
+	d := putSnapshotTestRoot(t, bs, storage, dl.StakingLedgerTag, 4)
+	require.NotContains(t, bs.pinned, d)
+}
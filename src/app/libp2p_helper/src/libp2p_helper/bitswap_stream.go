@@ -0,0 +1,114 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"errors"
+	"io"
+)
+
+const (
+	defaultResourceChunkSize = 1 << 20 // 1 MiB
+	maxResourceChunkSize     = 1 << 24 // 16 MiB
+)
+
+// resourceReader reads data of a root from the storage walking its tree
+// in the order of JoinBitswapBlocks, holding a single block at a time
+type resourceReader struct {
+	storage codanet.BitswapStorage
+	// blocks not read yet
+	queue []dl.BitswapBlockLink
+	// data of the last block read, not consumed yet
+	pending []byte
+	// bytes of data in blocks not read yet
+	remaining int
+}
+
+// openResourceReader reads the root block, returning
+// the tag and length of data of the root
+func openResourceReader(storage codanet.BitswapStorage, root dl.Root) (*resourceReader, dl.BitswapDataTag, int, error) {
+	r := &resourceReader{storage: storage}
+	var tag dl.BitswapDataTag
+	var length int
+	err := storage.ViewBlock(root, func(b []byte) error {
+		links, data, err := dl.ReadBitswapBlock(b)
+		if err != nil {
+			return err
+		}
+		data, length, err = dl.ExtractLengthFromRootBlockData(data)
+		if err != nil {
+			return err
+		}
+		if length < 1 || len(data) < 1 {
+			return errors.New("root block has no tag")
+		}
+		tag = dl.BitswapDataTag(data[0])
+		// length counts the tag
+		length--
+		data = data[1:]
+		if len(data) > length {
+			data = data[:length]
+		}
+		r.queue = links
+		r.pending = append([]byte{}, data...)
+		r.remaining = length - len(data)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return r, tag, length, nil
+}
+
+func (r *resourceReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.remaining == 0 {
+			return 0, io.EOF
+		}
+		if len(r.queue) == 0 {
+			return 0, errors.New("tree ended before length of data")
+		}
+		key := r.queue[0]
+		r.queue = r.queue[1:]
+		err := r.storage.ViewBlock(key, func(b []byte) error {
+			links, data, err := dl.ReadBitswapBlock(b)
+			if err != nil {
+				return err
+			}
+			if len(data) > r.remaining {
+				data = data[:r.remaining]
+			}
+			r.queue = append(r.queue, links...)
+			r.pending = append([]byte{}, data...)
+			r.remaining -= len(data)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// streamResource sends data of the reader in chunks,
+// blocking while the message queue is full
+func (app *app) streamResource(streamId uint64, r io.Reader, chunkSize int) {
+	buf := make([]byte, chunkSize)
+	var offset uint64
+	for {
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			bitswapLogger.Warnf("Failed to stream resource (stream %d): %s", streamId, err)
+			app.writeMsg(mkResourceChunkUpcall(streamId, offset, nil, true, err.Error()))
+			return
+		}
+		app.writeMsg(mkResourceChunkUpcall(streamId, offset, buf[:n], last, ""))
+		if last || app.Ctx.Err() != nil {
+			return
+		}
+		offset += uint64(n)
+	}
+}
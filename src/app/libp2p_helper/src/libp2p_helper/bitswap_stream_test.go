@@ -0,0 +1,45 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"io/ioutil"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResourceReader(t *testing.T) {
+	storage := codanet.NewBitswapStorageMemory(1 << 22)
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	blockMap, root := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, data, dl.EpochLedgerTag)
+	for h, b := range blockMap {
+		block, err := blocks.NewBlockWithCid(b, codanet.BlockHashToCid(h))
+		require.NoError(t, err)
+		require.NoError(t, storage.Put(block))
+	}
+
+	r, tag, length, err := openResourceReader(storage, root)
+	require.NoError(t, err)
+	require.Equal(t, dl.EpochLedgerTag, tag)
+	require.Equal(t, len(data), length)
+	read, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, data, read)
+
+	// Reading fails once a block is missing
+	for h := range blockMap {
+		if h != root {
+			require.NoError(t, storage.DeleteBlocks([][32]byte{h}))
+			break
+		}
+	}
+	r, _, _, err = openResourceReader(storage, root)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	require.Error(t, err)
+}
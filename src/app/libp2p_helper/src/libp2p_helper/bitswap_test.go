@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"codanet"
+	dl "codanet/bitswap_downloader"
 	"context"
 	"errors"
 	"fmt"
@@ -52,15 +53,15 @@ func (bitswapTestConfig) Generate(r *rand.Rand, size int) reflect.Value {
 	return reflect.ValueOf(initBitswapTestConfig(r, 20, 10, 3, size))
 }
 
-func getRootIds(ids ipc.RootBlockId_List) ([]BitswapBlockLink, error) {
-	links := make([]BitswapBlockLink, ids.Len())
+func getRootIds(ids ipc.RootBlockId_List) ([]dl.BitswapBlockLink, error) {
+	links := make([]dl.BitswapBlockLink, ids.Len())
 	for i := 0; i < ids.Len(); i++ {
 		rootId := ids.At(i)
 		root_, err := rootId.Blake2bHash()
 		if err != nil {
 			return nil, err
 		}
-		var link BitswapBlockLink
+		var link dl.BitswapBlockLink
 		if len(root_) == len(link) {
 			copy(link[:], root_)
 			links[i] = link
@@ -71,7 +72,7 @@ func getRootIds(ids ipc.RootBlockId_List) ([]BitswapBlockLink, error) {
 	return links, nil
 }
 
-func deleteResource(n testNode, root root) error {
+func deleteResource(n testNode, root dl.Root) error {
 	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
 	if err != nil {
 		return err
@@ -92,7 +93,7 @@ func deleteResource(n testNode, root root) error {
 	return nil
 }
 
-func awaitRemoval(n testNode, root root) error {
+func awaitRemoval(n testNode, root dl.Root) error {
 	resUpdErr := func(s string, args ...interface{}) error {
 		return fmt.Errorf("Unexpected ResourceUpdate on remove: "+s, args...)
 	}
@@ -114,7 +115,7 @@ func awaitRemoval(n testNode, root root) error {
 	if err != nil {
 		return err
 	}
-	var ids_ []BitswapBlockLink
+	var ids_ []dl.BitswapBlockLink
 	ids_, err = getRootIds(ids)
 	if err != nil {
 		return err
@@ -141,8 +142,8 @@ func (at bitswapTestAttempt) publish(nodes []testNode) error {
 	return nil
 }
 
-func (at bitswapTestAttempt) awaitPublish(nodes []testNode) (resIds []BitswapBlockLink, err error) {
-	resIds = make([]BitswapBlockLink, len(nodes))
+func (at bitswapTestAttempt) awaitPublish(nodes []testNode) (resIds []dl.BitswapBlockLink, err error) {
+	resIds = make([]dl.BitswapBlockLink, len(nodes))
 	success := withCustomTimeout(func() {
 		resUpdErr := errors.New("Unexpected ResourceUpdate on publish")
 		for ni, nconf := range at {
@@ -157,14 +158,14 @@ func (at bitswapTestAttempt) awaitPublish(nodes []testNode) (resIds []BitswapBlo
 				return
 			}
 			data := nconf.resource
-			_, root := SplitDataToBitswapBlocksLengthPrefixedWithTag(n.node.bitswapCtx.maxBlockSize, data, BlockBodyTag)
+			_, root := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(n.node.bitswapCtx.maxBlockSize, data, dl.BlockBodyTag)
 			resIds[ni] = root
 			var ids ipc.RootBlockId_List
 			ids, err = m.Ids()
 			if err != nil {
 				return
 			}
-			var ids_ []BitswapBlockLink
+			var ids_ []dl.BitswapBlockLink
 			ids_, err = getRootIds(ids)
 			if err != nil {
 				return
@@ -182,7 +183,7 @@ func (at bitswapTestAttempt) awaitPublish(nodes []testNode) (resIds []BitswapBlo
 }
 
 func confirmBlocksNotInStorage(bs *BitswapCtx, resource []byte) error {
-	blocks, _ := SplitDataToBitswapBlocksLengthPrefixedWithTag(bs.maxBlockSize, resource, BlockBodyTag)
+	blocks, _ := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(bs.maxBlockSize, resource, dl.BlockBodyTag)
 	for h := range blocks {
 		err := bs.storage.ViewBlock(h, func(actualB []byte) error {
 			return nil
@@ -197,7 +198,7 @@ func confirmBlocksNotInStorage(bs *BitswapCtx, resource []byte) error {
 }
 
 func confirmBlocksInStorage(bs *BitswapCtx, resource []byte) error {
-	blocks, root := SplitDataToBitswapBlocksLengthPrefixedWithTag(bs.maxBlockSize, resource, BlockBodyTag)
+	blocks, root := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(bs.maxBlockSize, resource, dl.BlockBodyTag)
 	_, hasRootBlock := blocks[root]
 	if !hasRootBlock {
 		return fmt.Errorf("unexpected no root block")
@@ -215,7 +216,7 @@ func confirmBlocksInStorage(bs *BitswapCtx, resource []byte) error {
 	}
 	return nil
 }
-func (at bitswapTestAttempt) requestResources(nodes []testNode, roots []BitswapBlockLink, getRequests func(*bitswapTestNodeParams) []int) (err error) {
+func (at bitswapTestAttempt) requestResources(nodes []testNode, roots []dl.BitswapBlockLink, getRequests func(*bitswapTestNodeParams) []int) (err error) {
 	for ni, nconf := range at {
 		_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
 		if err != nil {
@@ -230,7 +231,7 @@ func (at bitswapTestAttempt) requestResources(nodes []testNode, roots []BitswapB
 		if err != nil {
 			return err
 		}
-		m.SetTag(uint8(BlockBodyTag))
+		m.SetTag(uint8(dl.BlockBodyTag))
 		for i, resId := range requests {
 			err := ids.At(i).SetBlake2bHash(roots[resId][:])
 			if err != nil {
@@ -241,7 +242,7 @@ func (at bitswapTestAttempt) requestResources(nodes []testNode, roots []BitswapB
 	}
 	return nil
 }
-func (at bitswapTestAttempt) awaitResourceDownload(nodes []testNode, roots []BitswapBlockLink, getRequests func(*bitswapTestNodeParams) []int) error {
+func (at bitswapTestAttempt) awaitResourceDownload(nodes []testNode, roots []dl.BitswapBlockLink, getRequests func(*bitswapTestNodeParams) []int) error {
 	errChan := make(chan error, len(at))
 	setResUpdErr := func(s string, args ...interface{}) {
 		errChan <- fmt.Errorf("Unexpected ResourceUpdate on download: "+s, args...)
@@ -254,8 +255,8 @@ func (at bitswapTestAttempt) awaitResourceDownload(nodes []testNode, roots []Bit
 		ctxs[ni] = ctx
 		cancels[ni] = cancelF
 		go func(ni int) {
-			allIds := make(map[BitswapBlockLink]bool)
-			remained := make(map[BitswapBlockLink]bool)
+			allIds := make(map[dl.BitswapBlockLink]bool)
+			remained := make(map[dl.BitswapBlockLink]bool)
 			for _, resId := range getRequests(&at[ni]) {
 				nodes[ni].node.P2p.Logger.Infof("node %d downloads resource %d (%s)", ni, resId, codanet.BlockHashToCidSuffix(roots[resId]))
 				allIds[roots[resId]] = true
@@ -285,7 +286,7 @@ func (at bitswapTestAttempt) awaitResourceDownload(nodes []testNode, roots []Bit
 					errChan <- err
 					return
 				}
-				var ids_ []BitswapBlockLink
+				var ids_ []dl.BitswapBlockLink
 				ids_, err = getRootIds(ids)
 				if err != nil {
 					errChan <- err
@@ -337,7 +338,7 @@ func (at bitswapTestAttempt) confirmResourceDownload(nodes []testNode, getReques
 	return nil
 }
 
-func (at *bitswapTestAttempt) downloadAndCheckResources(nodes []testNode, roots []BitswapBlockLink, getRequests func(*bitswapTestNodeParams) []int) (err error) {
+func (at *bitswapTestAttempt) downloadAndCheckResources(nodes []testNode, roots []dl.BitswapBlockLink, getRequests func(*bitswapTestNodeParams) []int) (err error) {
 	err = at.requestResources(nodes, roots, getRequests)
 	if err != nil {
 		return err
@@ -453,7 +454,7 @@ func (randomTestBytes) Generate(r *rand.Rand, size int) reflect.Value {
 func TestBitswapRootBlockCid(t *testing.T) {
 	require.NotEqual(t, codanet.MULTI_HASH_CODE, uint64(0))
 	f := func(b randomTestBytes) error {
-		blocks, root := SplitDataToBitswapBlocks(1<<8, b)
+		blocks, root := dl.SplitDataToBitswapBlocks(1<<8, b)
 		cid1 := codanet.BlockHashToCid(root)
 		rootBody, has := blocks[root]
 		if !has {
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	dl "codanet/bitswap_downloader"
+	"hash"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// Sessions of adding resources in pieces are discarded
+	// if no message of the session arrives for the timeout
+	uploadSessionTimeout = 10 * time.Minute
+	// Interval of checks for sessions that timed out
+	uploadSessionTimeoutCheck = time.Minute
+)
+
+type bitswapUploadCmd struct {
+	sessionId uint64
+	// piece of data at the offset, unless commit or abort is set
+	offset uint64
+	data   []byte
+	commit bool
+	abort  bool
+	// tag, length and hash of data, set on commit
+	tag     dl.BitswapDataTag
+	length  uint64
+	hash    []byte
+	traceId string
+}
+
+// uploadSession is a resource being added in pieces
+type uploadSession struct {
+	// data received so far without gaps
+	data   []byte
+	hasher hash.Hash
+	// pieces past the gap, by offset
+	pieces     map[uint64][]byte
+	commit     *bitswapUploadCmd
+	lastActive time.Time
+}
+
+func newUploadSession() *uploadSession {
+	hasher, _ := blake2b.New256(nil)
+	return &uploadSession{hasher: hasher, pieces: make(map[uint64][]byte)}
+}
+
+// addPiece appends the piece and pieces following it to data,
+// hashing them, or keeps the piece until the gap before it is filled
+func (s *uploadSession) addPiece(offset uint64, data []byte) bool {
+	if offset < uint64(len(s.data)) {
+		return false
+	}
+	if _, has := s.pieces[offset]; has {
+		return false
+	}
+	s.pieces[offset] = data
+	for {
+		piece, has := s.pieces[uint64(len(s.data))]
+		if !has {
+			return true
+		}
+		delete(s.pieces, uint64(len(s.data)))
+		s.hasher.Write(piece)
+		s.data = append(s.data, piece...)
+	}
+}
+
+// maxUploadSize is the size of the largest resource that may be added
+func (bs *BitswapCtx) maxUploadSize() uint64 {
+	var max int
+	for _, dataConf := range bs.dataConfig {
+		if dataConf.MaxSize > max {
+			max = dataConf.MaxSize
+		}
+	}
+	return uint64(max)
+}
+
+// handleUpload processes a message of a session of adding a resource in
+// pieces, adding the resource once it's committed and all of its data
+// arrived. Sessions failing checks are discarded.
+func (bs *BitswapCtx) handleUpload(cmd bitswapUploadCmd, now time.Time) {
+	if cmd.abort {
+		delete(bs.uploads, cmd.sessionId)
+		return
+	}
+	s, has := bs.uploads[cmd.sessionId]
+	if !has {
+		s = newUploadSession()
+		bs.uploads[cmd.sessionId] = s
+	}
+	s.lastActive = now
+	if cmd.commit {
+		if s.commit != nil {
+			bitswapLogger.Warnf("Ignoring repeated commit of upload session %d", cmd.sessionId)
+			return
+		}
+		s.commit = &cmd
+	} else {
+		if cmd.offset+uint64(len(cmd.data)) > bs.maxUploadSize() {
+			bitswapLogger.Errorf("Discarding upload session %d: piece at %d of %d bytes exceeds the maximal size of resources",
+				cmd.sessionId, cmd.offset, len(cmd.data))
+			delete(bs.uploads, cmd.sessionId)
+			return
+		}
+		if !s.addPiece(cmd.offset, cmd.data) {
+			bitswapLogger.Warnf("Ignoring piece at %d of upload session %d overlapping earlier pieces", cmd.offset, cmd.sessionId)
+		}
+	}
+	if s.commit == nil || uint64(len(s.data)) < s.commit.length {
+		return
+	}
+	delete(bs.uploads, cmd.sessionId)
+	if uint64(len(s.data)) > s.commit.length || len(s.pieces) > 0 {
+		bitswapLogger.Errorf("Discarding upload session %d: data exceeds the committed length of %d bytes",
+			cmd.sessionId, s.commit.length)
+		return
+	}
+	if len(s.commit.hash) > 0 && !bytes.Equal(s.hasher.Sum(nil), s.commit.hash) {
+		bitswapLogger.Errorf("Discarding upload session %d: hash of data doesn't match the committed hash", cmd.sessionId)
+		return
+	}
+	bs.addResource(s.commit.tag, s.data, s.commit.traceId)
+}
+
+// expireUploads discards sessions no message of which
+// arrived for uploadSessionTimeout
+func (bs *BitswapCtx) expireUploads(now time.Time) {
+	for id, s := range bs.uploads {
+		if now.Sub(s.lastActive) >= uploadSessionTimeout {
+			bitswapLogger.Warnf("Discarding upload session %d: timed out with %d bytes received", id, len(s.data))
+			delete(bs.uploads, id)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestUploadSessionPieces(t *testing.T) {
+	s := newUploadSession()
+	require.True(t, s.addPiece(6, []byte("ghi")))
+	require.True(t, s.addPiece(3, []byte("def")))
+	require.Empty(t, s.data)
+	require.True(t, s.addPiece(0, []byte("abc")))
+	require.Equal(t, []byte("abcdefghi"), s.data)
+	require.Empty(t, s.pieces)
+	// Overlapping pieces are ignored
+	require.False(t, s.addPiece(3, []byte("xyz")))
+	require.True(t, s.addPiece(12, []byte("mno")))
+	require.False(t, s.addPiece(12, []byte("xyz")))
+
+	expected := blake2b.Sum256([]byte("abcdefghi"))
+	require.Equal(t, expected[:], s.hasher.Sum(nil))
+}
+
+func TestHandleUploadDiscards(t *testing.T) {
+	bs, _, _ := mkReaperTestCtx()
+	now := time.Now()
+	wrongHash := blake2b.Sum256([]byte("other"))
+
+	// Commit may arrive before pieces
+	bs.handleUpload(bitswapUploadCmd{sessionId: 1, commit: true, tag: dl.BlockBodyTag, length: 6, hash: wrongHash[:]}, now)
+	bs.handleUpload(bitswapUploadCmd{sessionId: 1, offset: 3, data: []byte("def")}, now)
+	require.Contains(t, bs.uploads, uint64(1))
+	bs.handleUpload(bitswapUploadCmd{sessionId: 1, offset: 0, data: []byte("abc")}, now)
+	require.NotContains(t, bs.uploads, uint64(1))
+
+	// Pieces beyond the maximal size discard the session
+	bs.handleUpload(bitswapUploadCmd{sessionId: 2, offset: 0, data: []byte("abc")}, now)
+	bs.handleUpload(bitswapUploadCmd{sessionId: 2, offset: bs.maxUploadSize(), data: []byte("abc")}, now)
+	require.NotContains(t, bs.uploads, uint64(2))
+
+	// Data past the committed length discards the session
+	bs.handleUpload(bitswapUploadCmd{sessionId: 3, offset: 0, data: []byte("abcdef")}, now)
+	bs.handleUpload(bitswapUploadCmd{sessionId: 3, commit: true, tag: dl.BlockBodyTag, length: 3}, now)
+	require.NotContains(t, bs.uploads, uint64(3))
+
+	bs.handleUpload(bitswapUploadCmd{sessionId: 4, offset: 0, data: []byte("abc")}, now)
+	bs.handleUpload(bitswapUploadCmd{sessionId: 5, offset: 0, data: []byte("abc")}, now.Add(time.Minute))
+	bs.handleUpload(bitswapUploadCmd{sessionId: 5, abort: true}, now)
+	require.NotContains(t, bs.uploads, uint64(5))
+	bs.expireUploads(now.Add(uploadSessionTimeout))
+	require.Empty(t, bs.uploads)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"errors"
+	ipc "libp2p_ipc"
+	"time"
+)
+
+const (
+	defaultVerificationTimeout = time.Minute
+	// Interval of checks for verifications that timed out
+	verificationTimeoutCheck = time.Second
+)
+
+// downloadVerifications keeps roots that were downloaded and await
+// a verdict of the daemon before being marked full
+type downloadVerifications struct {
+	tags        map[dl.BitswapDataTag]bool
+	timeout     time.Duration
+	includeData bool
+	// deadlines of verdicts
+	pending map[dl.Root]time.Time
+}
+
+func newDownloadVerifications() *downloadVerifications {
+	return &downloadVerifications{
+		tags:    make(map[dl.BitswapDataTag]bool),
+		timeout: defaultVerificationTimeout,
+		pending: make(map[dl.Root]time.Time),
+	}
+}
+
+// Configure replaces verified tags, roots awaiting
+// a verdict keep their deadlines
+func (v *downloadVerifications) Configure(tags []dl.BitswapDataTag, timeout time.Duration, includeData bool) {
+	v.tags = make(map[dl.BitswapDataTag]bool, len(tags))
+	for _, tag := range tags {
+		v.tags[tag] = true
+	}
+	if timeout <= 0 {
+		timeout = defaultVerificationTimeout
+	}
+	v.timeout = timeout
+	v.includeData = includeData
+}
+
+// Pending tells whether the root awaits a verdict
+func (v *downloadVerifications) Pending(root dl.Root) bool {
+	_, pending := v.pending[root]
+	return pending
+}
+
+// Len returns the number of roots awaiting a verdict
+func (v *downloadVerifications) Len() int {
+	return len(v.pending)
+}
+
+func readDownloadVerificationConfig(c ipc.DownloadVerificationConfig) ([]dl.BitswapDataTag, time.Duration, bool, error) {
+	tagsL, err := c.Tags()
+	if err != nil {
+		return nil, 0, false, err
+	}
+	tags := make([]dl.BitswapDataTag, 0, tagsL.Len())
+	for i := 0; i < tagsL.Len(); i++ {
+		tags = append(tags, dl.BitswapDataTag(tagsL.At(i)))
+	}
+	timeout, err := c.Timeout()
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return tags, time.Duration(timeout.NanoSec()), c.IncludeData(), nil
+}
+
+type bitswapVerdictCmd struct {
+	root   dl.Root
+	accept bool
+}
+
+// rootData assembles data of a downloaded root, without the tag
+func (bs *BitswapCtx) rootData(root dl.Root) ([]byte, error) {
+	keys, err := bs.distinctRootBlocks(root, nil)
+	if err != nil {
+		return nil, err
+	}
+	blocks := make(map[dl.BitswapBlockLink][]byte, len(keys))
+	for _, key := range keys {
+		err := bs.storage.ViewBlock(key, func(b []byte) error {
+			blocks[key] = append([]byte{}, b...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	joined, err := dl.JoinBitswapBlocks(blocks, root)
+	if err != nil {
+		return nil, err
+	}
+	data, length, err := dl.ExtractLengthFromRootBlockData(joined)
+	if err != nil {
+		return nil, err
+	}
+	if length < 1 || length > len(data) {
+		return nil, errors.New("length of data doesn't match the tree")
+	}
+	return data[1:length], nil
+}
+
+// VerifyRoot requests the daemon to verify a downloaded root, false is
+// returned if roots of the tag aren't verified and may be marked full
+func (bs *BitswapCtx) VerifyRoot(root dl.Root, tag dl.BitswapDataTag) bool {
+	v := bs.verifications
+	if !v.tags[tag] {
+		return false
+	}
+	if v.Pending(root) {
+		return true
+	}
+	var data []byte
+	if v.includeData {
+		var err error
+		if data, err = bs.rootData(root); err != nil {
+			// Root is rejected once the verification times out
+			bitswapLogger.Errorf("Failed to assemble data of root %s for verification: %s", codanet.BlockHashToCidSuffix(root), err)
+		}
+	}
+	v.pending[root] = time.Now().Add(v.timeout)
+	select {
+	case bs.outMsgChan <- mkVerifyResourceUpcall(bs.traceIds[root], root, tag, data):
+	default:
+		bitswapLogger.Errorf("Failed to request verification of %s (message queue is full)", codanet.BlockHashToCidSuffix(root))
+	}
+	return true
+}
+
+// completeVerification marks an accepted root full, a rejected root
+// is reported broken and deleted along with its blocks, except for
+// blocks referenced by other roots
+func (bs *BitswapCtx) completeVerification(root dl.Root, accept bool) {
+	if !bs.verifications.Pending(root) {
+		bitswapLogger.Warnf("Ignoring verdict on root %s not awaiting verification", codanet.BlockHashToCidSuffix(root))
+		return
+	}
+	delete(bs.verifications.pending, root)
+	if accept {
+		if err := bs.SetStatus(root, codanet.Full); err != nil {
+			bitswapLogger.Warnf("Failed to update status of verified root %s: %s", codanet.BlockHashToCidSuffix(root), err)
+		}
+		bs.SendResourceUpdate(ipc.ResourceUpdateType_added, root)
+		return
+	}
+	if err := bs.deleteRoot(root); err != nil {
+		bitswapLogger.Errorf("Failed to delete rejected root %s: %s", codanet.BlockHashToCidSuffix(root), err)
+	}
+	bs.SendResourceUpdate(ipc.ResourceUpdateType_broken, root)
+}
+
+// expireVerifications rejects roots whose verdicts are overdue
+func (bs *BitswapCtx) expireVerifications(now time.Time) {
+	for root, deadline := range bs.verifications.pending {
+		if now.After(deadline) {
+			bitswapLogger.Warnf("Verification of root %s timed out", codanet.BlockHashToCidSuffix(root))
+			bs.completeVerification(root, false)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+)
+
+// putDownloadedTestRoot stores all blocks of a root
+// which is left partial, as when its download completes
+func putDownloadedTestRoot(t *testing.T, bs *BitswapCtx, storage *codanet.BitswapStorageMemory, data []byte, tag dl.BitswapDataTag) dl.BitswapBlockLink {
+	blockMap, root := dl.SplitDataToBitswapBlocksLengthPrefixedWithTag(1000, data, tag)
+	require.NoError(t, bs.SetStatus(root, codanet.Partial))
+	for h, b := range blockMap {
+		block, err := blocks.NewBlockWithCid(b, codanet.BlockHashToCid(h))
+		require.NoError(t, err)
+		require.NoError(t, storage.Put(block))
+	}
+	return root
+}
+
+func requireVerifyResourceUpcall(t *testing.T, outChan chan *capnp.Message, expected dl.BitswapBlockLink, tag dl.BitswapDataTag) []byte {
+	require.NotEmpty(t, outChan)
+	msg, err := ipc.ReadRootDaemonInterface_Message(<-outChan)
+	require.NoError(t, err)
+	pm, err := msg.PushMessage()
+	require.NoError(t, err)
+	vr, err := pm.VerifyResource()
+	require.NoError(t, err)
+	require.Equal(t, uint8(tag), vr.Tag())
+	idM, err := vr.Id()
+	require.NoError(t, err)
+	id, err := idM.Blake2bHash()
+	require.NoError(t, err)
+	require.Equal(t, expected[:], id)
+	data, err := vr.Data()
+	require.NoError(t, err)
+	return data
+}
+
+func TestVerifyRootAccept(t *testing.T) {
+	bs, storage, outChan := mkReaperTestCtx()
+	bs.verifications.Configure([]dl.BitswapDataTag{dl.BlockBodyTag}, time.Minute, true)
+	data := make([]byte, 5000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	a := putDownloadedTestRoot(t, bs, storage, data, dl.BlockBodyTag)
+	b := putDownloadedTestRoot(t, bs, storage, data, dl.EpochLedgerTag)
+
+	// Roots of tags not listed aren't verified
+	require.False(t, bs.VerifyRoot(b, dl.EpochLedgerTag))
+	require.True(t, bs.VerifyRoot(a, dl.BlockBodyTag))
+	require.Equal(t, data, requireVerifyResourceUpcall(t, outChan, a, dl.BlockBodyTag))
+	// Verification is requested once
+	require.True(t, bs.VerifyRoot(a, dl.BlockBodyTag))
+	require.Empty(t, outChan)
+
+	// Root awaiting a verdict isn't stale
+	res := bs.reapStaleRoots(bitswapReapCmd{maxAge: time.Minute, now: time.Now().Add(2 * time.Minute)})
+	require.Equal(t, []dl.Root{dl.Root(b)}, res.deleted)
+	requireReaperTestUpdate(t, outChan, ipc.ResourceUpdateType_removed, b)
+
+	bs.completeVerification(a, true)
+	status, err := storage.GetStatus(a)
+	require.NoError(t, err)
+	require.Equal(t, codanet.Full, status)
+	requireReaperTestUpdate(t, outChan, ipc.ResourceUpdateType_added, a)
+	require.Zero(t, bs.verifications.Len())
+
+	// Late verdict is ignored
+	bs.completeVerification(a, false)
+	require.Empty(t, outChan)
+}
+
+func TestVerifyRootReject(t *testing.T) {
+	bs, storage, outChan := mkReaperTestCtx()
+	bs.verifications.Configure([]dl.BitswapDataTag{dl.BlockBodyTag, dl.EpochLedgerTag}, time.Minute, false)
+	a := putDownloadedTestRoot(t, bs, storage, make([]byte, 5000), dl.BlockBodyTag)
+	b := putDownloadedTestRoot(t, bs, storage, make([]byte, 7000), dl.EpochLedgerTag)
+
+	require.True(t, bs.VerifyRoot(a, dl.BlockBodyTag))
+	require.Empty(t, requireVerifyResourceUpcall(t, outChan, a, dl.BlockBodyTag))
+	now := time.Now()
+	require.True(t, bs.VerifyRoot(b, dl.EpochLedgerTag))
+	requireVerifyResourceUpcall(t, outChan, b, dl.EpochLedgerTag)
+
+	bs.completeVerification(a, false)
+	_, err := storage.GetStatus(a)
+	require.Error(t, err)
+	requireGcTestBlock(t, storage, a, false)
+	requireReaperTestUpdate(t, outChan, ipc.ResourceUpdateType_broken, a)
+
+	// Root without a verdict is rejected on timeout
+	bs.expireVerifications(now)
+	require.Empty(t, outChan)
+	bs.expireVerifications(now.Add(2 * time.Minute))
+	requireGcTestBlock(t, storage, b, false)
+	requireReaperTestUpdate(t, outChan, ipc.ResourceUpdateType_broken, b)
+	require.Zero(t, bs.verifications.Len())
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"sort"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	"github.com/ipfs/go-cid"
+)
+
+type bitswapWantsCmd struct {
+	result chan<- bitswapWants
+}
+
+type bitswapWant struct {
+	block     dl.BitswapBlockLink
+	wantBlock bool
+}
+
+// rootDownloadInfo describes a root download in progress
+type rootDownloadInfo struct {
+	root           dl.Root
+	tag            dl.BitswapDataTag
+	priority       ipc.DownloadPriority
+	startedAt      time.Time
+	progress       dl.DownloadProgress
+	remainingNodes int
+	awaitedBlocks  int
+	// duplicates received by the session of the download
+	duplicateBlocks int
+	duplicateBytes  int
+}
+
+// bitswapWants is a snapshot of blocks wanted by the node
+type bitswapWants struct {
+	wants     []bitswapWant
+	downloads []rootDownloadInfo
+	queued    []dl.Root
+}
+
+// listWants returns wants of the Bitswap engine and state of root
+// downloads, downloads are ordered by their start, oldest first
+func (bs *BitswapCtx) listWants() bitswapWants {
+	res := bitswapWants{wants: []bitswapWant{}, downloads: []rootDownloadInfo{}}
+	if bs.engine != nil {
+		addWants := func(ids []cid.Cid, wantBlock bool) {
+			for _, id := range ids {
+				if key, ok := codanet.CidToBlockHash(id); ok {
+					res.wants = append(res.wants, bitswapWant{block: key, wantBlock: wantBlock})
+				}
+			}
+		}
+		addWants(bs.engine.GetWantBlocks(), true)
+		addWants(bs.engine.GetWantHaves(), false)
+	}
+	awaited := make(map[dl.Root]int)
+	for _, params := range bs.nodeDownloadParams {
+		for root := range params {
+			awaited[root]++
+		}
+	}
+	for root, state := range bs.rootDownloadStates {
+		res.downloads = append(res.downloads, rootDownloadInfo{
+			root:            root,
+			tag:             state.Tag,
+			priority:        state.Priority,
+			startedAt:       state.StartedAt,
+			progress:        state.Progress(),
+			remainingNodes:  state.RemainingNodeCounter,
+			awaitedBlocks:   awaited[root],
+			duplicateBlocks: state.DuplicateBlocks,
+			duplicateBytes:  state.DuplicateBytes,
+		})
+	}
+	sort.Slice(res.downloads, func(i, j int) bool {
+		return res.downloads[i].startedAt.Before(res.downloads[j].startedAt)
+	})
+	res.queued = append(bs.scheduler.Roots(), bs.retries.WaitingRoots()...)
+	return res
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListWants(t *testing.T) {
+	bs, _, _ := mkReaperTestCtx()
+	a, b, c, d := dl.Root{1}, dl.Root{2}, dl.Root{3}, dl.Root{4}
+	now := time.Now()
+	bs.rootDownloadStates[a] = &dl.RootDownloadState{
+		Tag:                  dl.BlockBodyTag,
+		Priority:             ipc.DownloadPriority_critical,
+		RemainingNodeCounter: 3,
+		DiscoveredNodes:      4,
+		FetchedNodes:         1,
+		StartedAt:            now,
+	}
+	bs.rootDownloadStates[b] = &dl.RootDownloadState{
+		Tag:                  dl.EpochLedgerTag,
+		RemainingNodeCounter: 1,
+		StartedAt:            now.Add(-time.Minute),
+	}
+	// A block shared by both roots and a block of root a are awaited
+	shared, own := codanet.BlockHashToCid(dl.Root{9}), codanet.BlockHashToCid(dl.Root{10})
+	bs.nodeDownloadParams[shared] = map[dl.Root][]dl.NodeIndex{a: {1}, b: {0}}
+	bs.nodeDownloadParams[own] = map[dl.Root][]dl.NodeIndex{a: {2, 3}}
+	bs.scheduler.Enqueue(c, dl.BlockBodyTag, ipc.DownloadPriority_normal, "")
+	require.True(t, bs.retries.TimedOut(d, dl.BlockBodyTag, ipc.DownloadPriority_normal, "", now))
+
+	res := bs.listWants()
+	require.Empty(t, res.wants)
+	require.Equal(t, []rootDownloadInfo{
+		{
+			root:           b,
+			tag:            dl.EpochLedgerTag,
+			startedAt:      now.Add(-time.Minute),
+			remainingNodes: 1,
+			awaitedBlocks:  1,
+		},
+		{
+			root:           a,
+			tag:            dl.BlockBodyTag,
+			priority:       ipc.DownloadPriority_critical,
+			startedAt:      now,
+			progress:       dl.DownloadProgress{DescendantsDiscovered: 4, BlocksFetched: 1},
+			remainingNodes: 3,
+			awaitedBlocks:  2,
+		},
+	}, res.downloads)
+	require.Equal(t, []dl.Root{c, d}, res.queued)
+}
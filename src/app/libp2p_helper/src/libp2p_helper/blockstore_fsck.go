@@ -0,0 +1,274 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"golang.org/x/crypto/blake2b"
+)
+
+type fsckStorage interface {
+	codanet.BitswapStorage
+	ForceStatus(key [32]byte, value codanet.RootBlockStatus) error
+}
+
+// fsckRootReport describes state of a single root found in the storage
+type fsckRootReport struct {
+	Root            string `json:"root"`
+	Status          string `json:"status"`
+	Blocks          int    `json:"blocks"`
+	MissingBlocks   int    `json:"missing_blocks"`
+	CorruptedBlocks int    `json:"corrupted_blocks"`
+	Complete        bool   `json:"complete"`
+	Error           string `json:"error,omitempty"`
+	// RepairedStatus is set when status of the root was (or, in dry-run
+	// mode, would be) changed
+	RepairedStatus string `json:"repaired_status,omitempty"`
+
+	// distinct blocks of the tree present in the storage
+	blocks []dl.BitswapBlockLink
+}
+
+type fsckReport struct {
+	Roots        []fsckRootReport `json:"roots"`
+	TotalBlocks  int              `json:"total_blocks"`
+	OrphanBlocks int              `json:"orphan_blocks"`
+	Repaired     int              `json:"repaired"`
+	DryRun       bool             `json:"dry_run"`
+	// RefCountsRebuilt is set when reference counts of blocks
+	// were rebuilt from full roots
+	RefCountsRebuilt bool `json:"ref_counts_rebuilt"`
+}
+
+func rootStatusString(status codanet.RootBlockStatus) string {
+	switch status {
+	case codanet.Partial:
+		return "partial"
+	case codanet.Full:
+		return "full"
+	case codanet.Deleting:
+		return "deleting"
+	}
+	return fmt.Sprintf("unknown(%d)", status)
+}
+
+// fsckRoot walks the block tree of the root, checking that every block
+// is present and its contents match its hash. Reachable blocks are
+// added to the reachable set.
+func fsckRoot(storage codanet.BitswapStorage, root_ dl.BitswapBlockLink, reachable map[dl.BitswapBlockLink]struct{}) fsckRootReport {
+	res := fsckRootReport{Root: codanet.BlockHashToCid(root_).String()}
+	queue := []dl.BitswapBlockLink{root_}
+	visited := map[dl.BitswapBlockLink]struct{}{root_: {}}
+	dataLength := 0
+	expectedLength := -1
+	for len(queue) > 0 {
+		key := queue[0]
+		queue = queue[1:]
+		var links []dl.BitswapBlockLink
+		var data []byte
+		err := storage.ViewBlock(key, func(b []byte) error {
+			if blake2b.Sum256(b) != key {
+				return errors.New("hash mismatch")
+			}
+			links_, data_, err := dl.ReadBitswapBlock(b)
+			links = links_
+			data = make([]byte, len(data_))
+			copy(data, data_)
+			return err
+		})
+		if err == blockstore.ErrNotFound {
+			res.MissingBlocks++
+			continue
+		}
+		reachable[key] = struct{}{}
+		res.blocks = append(res.blocks, key)
+		res.Blocks++
+		if err != nil {
+			res.CorruptedBlocks++
+			if res.Error == "" {
+				res.Error = fmt.Sprintf("block %s: %s", codanet.BlockHashToCid(key), err)
+			}
+			continue
+		}
+		if key == root_ {
+			_, length, maxBlockSize, err := dl.ExtractRootBlockMeta(data)
+			if err != nil {
+				res.CorruptedBlocks++
+				res.Error = fmt.Sprintf("root block: %s", err)
+				continue
+			}
+			// Length prefix (and block size) is a part of the data
+			expectedLength = length + 4
+			if maxBlockSize != 0 {
+				expectedLength += 4
+			}
+		}
+		dataLength += len(data)
+		for _, l := range links {
+			if _, has := visited[l]; !has {
+				visited[l] = struct{}{}
+				queue = append(queue, l)
+			}
+		}
+	}
+	res.Complete = res.MissingBlocks == 0 && res.CorruptedBlocks == 0
+	if res.Complete && dataLength != expectedLength {
+		res.Complete = false
+		res.Error = fmt.Sprintf("data length %d doesn't match length prefix %d", dataLength, expectedLength)
+	}
+	return res
+}
+
+// blockstoreFsck verifies all roots of the storage and repairs
+// their statuses where it's safe to do so: a full root with an incomplete
+// or corrupted tree is reset to partial (so that it gets re-downloaded)
+// and a partial root with a complete tree is marked as full.
+// Roots being deleted are reported, but left to the daemon to delete.
+// Reference counts of blocks are rebuilt from full roots after repairs.
+func blockstoreFsck(storage fsckStorage, blocks, roots [][32]byte, dryRun bool) (fsckReport, error) {
+	report := fsckReport{TotalBlocks: len(blocks), DryRun: dryRun, Roots: []fsckRootReport{}}
+	reachable := make(map[dl.BitswapBlockLink]struct{})
+	refCounts := make(map[[32]byte]int, len(blocks))
+	for _, b := range blocks {
+		refCounts[b] = 0
+	}
+	for _, r := range roots {
+		root_ := dl.BitswapBlockLink(r)
+		status, err := storage.GetStatus(r)
+		if err != nil {
+			return report, err
+		}
+		rootReport := fsckRoot(storage, root_, reachable)
+		rootReport.Status = rootStatusString(status)
+		newStatus := status
+		if status == codanet.Full && !rootReport.Complete {
+			newStatus = codanet.Partial
+		} else if status == codanet.Partial && rootReport.Complete {
+			newStatus = codanet.Full
+		}
+		if newStatus != status {
+			rootReport.RepairedStatus = rootStatusString(newStatus)
+			report.Repaired++
+			if !dryRun {
+				if err := storage.ForceStatus(r, newStatus); err != nil {
+					return report, err
+				}
+			}
+		}
+		if newStatus == codanet.Full {
+			for _, b := range rootReport.blocks {
+				refCounts[b]++
+			}
+		}
+		report.Roots = append(report.Roots, rootReport)
+	}
+	if refCounter, ok := storage.(codanet.BitswapRefCounter); ok && !dryRun {
+		if err := refCounter.SetRefCounts(refCounts); err != nil {
+			return report, err
+		}
+		report.RefCountsRebuilt = true
+	}
+	for _, b := range blocks {
+		if _, has := reachable[dl.BitswapBlockLink(b)]; !has {
+			report.OrphanBlocks++
+		}
+	}
+	return report, nil
+}
+
+const blockstoreUsage = `usage: libp2p_helper blockstore fsck [-dry-run] <statedir>
+       libp2p_helper blockstore migrate [-codec none|snappy|zstd] <statedir>`
+
+var blockCodecNames = map[string]codanet.BlockCodecId{
+	"none":   codanet.BlockCodecNone,
+	"snappy": codanet.BlockCodecSnappy,
+	"zstd":   codanet.BlockCodecZstd,
+}
+
+// blockstoreCmd implements `libp2p_helper blockstore` subcommands
+// used to inspect the block storage of a stopped node
+func blockstoreCmd(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(blockstoreUsage)
+	}
+	switch args[0] {
+	case "fsck":
+		return blockstoreFsckCmd(args[1:], out)
+	case "migrate":
+		return blockstoreMigrateCmd(args[1:], out)
+	}
+	return errors.New(blockstoreUsage)
+}
+
+func blockstoreFsckCmd(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("blockstore fsck", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report problems without repairing statuses and reference counts")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New(blockstoreUsage)
+	}
+	lmdb, err := codanet.OpenBitswapStorageLmdbForScan(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer lmdb.Close()
+	// Blocks are read decompressed, so that their hashes are checked
+	storage, err := codanet.NewBitswapStorageCompressed(context.Background(), lmdb)
+	if err != nil {
+		return err
+	}
+	blocks, roots, err := storage.Scan(context.Background())
+	if err != nil {
+		return err
+	}
+	report, err := blockstoreFsck(storage, blocks, roots, *dryRun)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// blockstoreMigrateCmd rewrites blocks of the storage with the codec,
+// tagging blocks of a storage created before compression was introduced
+func blockstoreMigrateCmd(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("blockstore migrate", flag.ContinueOnError)
+	codecName := flags.String("codec", "none", "codec to rewrite blocks with: none, snappy or zstd")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	codec, has := blockCodecNames[*codecName]
+	if flags.NArg() != 1 || !has {
+		return errors.New(blockstoreUsage)
+	}
+	storage, err := codanet.OpenBitswapStorageLmdbForScan(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	stats, err := storage.MigrateBlockCompression(context.Background(), codec)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(stats)
+}
+
+func runBlockstoreCmd(args []string) {
+	if err := blockstoreCmd(args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	lmdbbs "github.com/georgeee/go-bs-lmdb"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockstoreFsck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	storage, err := codanet.OpenBitswapStorageLmdbForScan(dir)
+	require.NoError(t, err)
+	defer storage.Close()
+
+	putRoot := func(status codanet.RootBlockStatus, holdOut bool) dl.BitswapBlockLink {
+		data := make([]byte, 5000)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+		bs, root := dl.SplitDataToBitswapBlocksLengthPrefixed(256, data)
+		for key, b := range bs {
+			if holdOut && key != root {
+				holdOut = false
+				continue
+			}
+			block, err := blocks.NewBlockWithCid(b, codanet.BlockHashToCid(key))
+			require.NoError(t, err)
+			require.NoError(t, (*lmdbbs.Blockstore)(storage).Put(block))
+		}
+		require.NoError(t, storage.ForceStatus(root, status))
+		return root
+	}
+	fullOk := putRoot(codanet.Full, false)
+	fullBroken := putRoot(codanet.Full, true)
+	partialOk := putRoot(codanet.Partial, false)
+	partialBroken := putRoot(codanet.Partial, true)
+
+	blocks_, roots, err := storage.Scan(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 4, len(roots))
+
+	report, err := blockstoreFsck(storage, blocks_, roots, false)
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Repaired)
+	require.Equal(t, 0, report.OrphanBlocks)
+	require.Equal(t, len(blocks_), report.TotalBlocks)
+
+	expected := map[dl.BitswapBlockLink]codanet.RootBlockStatus{
+		fullOk:        codanet.Full,
+		fullBroken:    codanet.Partial,
+		partialOk:     codanet.Full,
+		partialBroken: codanet.Partial,
+	}
+	for root, status := range expected {
+		actual, err := storage.GetStatus(root)
+		require.NoError(t, err)
+		require.Equal(t, status, actual)
+	}
+
+	// Only blocks of full roots are referenced
+	require.True(t, report.RefCountsRebuilt)
+	initialized, err := storage.RefCountsInitialized()
+	require.NoError(t, err)
+	require.True(t, initialized)
+	for root, status := range expected {
+		count, err := storage.RefCount(root)
+		require.NoError(t, err)
+		if status == codanet.Full {
+			require.Equal(t, 1, count)
+		} else {
+			require.Equal(t, 0, count)
+		}
+	}
+
+	// Second run finds nothing to repair
+	report, err = blockstoreFsck(storage, blocks_, roots, false)
+	require.NoError(t, err)
+	require.Equal(t, 0, report.Repaired)
+}
+
+// Trees of a storage migrated to compressed blocks are found complete
+func TestBlockstoreMigrateCmd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	storage, err := codanet.OpenBitswapStorageLmdbForScan(dir)
+	require.NoError(t, err)
+	// Text-like data that compresses well
+	data := bytes.Repeat([]byte("mina block body "), 1000)
+	bs, root := dl.SplitDataToBitswapBlocksLengthPrefixed(256, data)
+	for key, b := range bs {
+		block, err := blocks.NewBlockWithCid(b, codanet.BlockHashToCid(key))
+		require.NoError(t, err)
+		require.NoError(t, (*lmdbbs.Blockstore)(storage).Put(block))
+	}
+	require.NoError(t, storage.ForceStatus(root, codanet.Full))
+	require.NoError(t, storage.Close())
+
+	var out bytes.Buffer
+	require.NoError(t, blockstoreCmd([]string{"migrate", "-codec", "zstd", dir}, &out))
+	var stats codanet.BlockCompressionStats
+	require.NoError(t, json.Unmarshal(out.Bytes(), &stats))
+	require.Equal(t, len(bs), stats.Tagged)
+	require.Less(t, stats.BytesAfter, stats.BytesBefore)
+
+	out.Reset()
+	require.NoError(t, blockstoreCmd([]string{"fsck", "-dry-run", dir}, &out))
+	var report fsckReport
+	require.NoError(t, json.Unmarshal(out.Bytes(), &report))
+	require.Len(t, report.Roots, 1)
+	require.True(t, report.Roots[0].Complete, report.Roots[0].Error)
+	require.Equal(t, 0, report.Repaired)
+
+	require.Error(t, blockstoreCmd([]string{"migrate", "-codec", "lz4", dir}, &out))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	ipc "libp2p_ipc"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	peerstore "github.com/libp2p/go-libp2p-core/peerstore"
+)
+
+// Tag cache peers are protected from trimming by the connection manager with
+const cachePeerTag = "cache-peer"
+
+func readCachePeers(l ipc.Multiaddr_List) ([]peer.AddrInfo, error) {
+	cachePeers := make([]peer.AddrInfo, 0, l.Len())
+	err := multiaddrListForeach(l, func(v string) error {
+		addr, err := addrInfoOfString(v)
+		if err == nil {
+			cachePeers = append(cachePeers, *addr)
+		}
+		return err
+	})
+	return cachePeers, err
+}
+
+// setCachePeers makes colocated helpers preferred sources of Bitswap
+// blocks. Their addresses are kept permanently and connections to them
+// are protected, so that they stay connected to be asked for blocks.
+func (app *app) setCachePeers(cachePeers []peer.AddrInfo) {
+	for _, p := range app.cachePeers {
+		app.P2p.ConnectionManager.Unprotect(p, cachePeerTag)
+	}
+	app.cachePeers = make([]peer.ID, 0, len(cachePeers))
+	for _, info := range cachePeers {
+		if info.ID == app.P2p.Me {
+			continue
+		}
+		app.P2p.Host.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
+		app.P2p.ConnectionManager.Protect(info.ID, cachePeerTag)
+		app.cachePeers = append(app.cachePeers, info.ID)
+	}
+}
+
+// downloadCandidates lists peers asked for blocks of a download:
+// cache peers come first, followed by peers hinted by the daemon
+// and then by peers that announced the roots over gossip
+func downloadCandidates(cachePeers []peer.ID, hinted []peer.ID, providers []peer.ID) []peer.ID {
+	seen := make(map[peer.ID]bool)
+	candidates := make([]peer.ID, 0, len(cachePeers)+len(hinted)+len(providers))
+	for _, ps := range [][]peer.ID{cachePeers, hinted, providers} {
+		for _, p := range ps {
+			if !seen[p] {
+				seen[p] = true
+				candidates = append(candidates, p)
+			}
+		}
+	}
+	return candidates
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"testing"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadCandidates(t *testing.T) {
+	a, b, c, d := peer.ID("a"), peer.ID("b"), peer.ID("c"), peer.ID("d")
+	require.Equal(t, []peer.ID{a, b, c, d}, downloadCandidates([]peer.ID{a, b}, []peer.ID{c, a}, []peer.ID{b, d}))
+	require.Equal(t, []peer.ID{c, d}, downloadCandidates(nil, []peer.ID{c}, []peer.ID{d, c}))
+	require.Empty(t, downloadCandidates(nil, nil, nil))
+}
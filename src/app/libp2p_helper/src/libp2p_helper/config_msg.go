@@ -1,7 +1,9 @@
 package main
 
 import (
+	dl "codanet/bitswap_downloader"
 	cryptorand "crypto/rand"
+	"fmt"
 	"time"
 
 	"codanet"
@@ -15,9 +17,7 @@ import (
 	peerstore "github.com/libp2p/go-libp2p-core/peerstore"
 	discovery "github.com/libp2p/go-libp2p-discovery"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
-	pb "github.com/libp2p/go-libp2p-pubsub/pb"
 	"github.com/multiformats/go-multiaddr"
-	"golang.org/x/crypto/blake2b"
 )
 
 type BeginAdvertisingReqT = ipc.Libp2pHelperInterface_BeginAdvertising_Request
@@ -32,9 +32,13 @@ func (msg BeginAdvertisingReq) handle(app *app, seqno uint64) *capnp.Message {
 		return mkRpcRespError(seqno, needsConfigure())
 	}
 	app.SetConnectionHandlers()
+	if app.outboundTarget != nil && !app.outboundTargetStarted {
+		go app.maintainOutboundTarget(app.outboundTarget)
+		app.outboundTargetStarted = true
+	}
 	for _, info := range app.AddedPeers {
 		app.P2p.Logger.Debug("Trying to connect to: ", info)
-		err := app.P2p.Host.Connect(app.Ctx, info)
+		_, err := app.dialLadder.Connect(app.Ctx, app.P2p.Host, info)
 		if err != nil {
 			app.P2p.Logger.Error("failed to connect to peer: ", info, err.Error())
 			continue
@@ -62,8 +66,8 @@ func (msg BeginAdvertisingReq) handle(app *app, seqno uint64) *capnp.Message {
 
 				// now connect to the peer we discovered
 				connInfo := app.P2p.ConnectionManager.GetInfo()
-				if connInfo.ConnCount < connInfo.LowWater {
-					err := app.P2p.Host.Connect(app.Ctx, discovery.info)
+				if connInfo.ConnCount < connInfo.LowWater && !app.inMaintenance() {
+					_, err := app.dialLadder.Connect(app.Ctx, app.P2p.Host, discovery.info)
 					if err != nil {
 						app.P2p.Logger.Errorf("failed to connect to peer after discovering it: ", discovery.info, err.Error())
 						continue
@@ -134,21 +138,23 @@ func configurePubsub(app *app, validationQueueSize int, directPeers []peer.AddrI
 	// SOMEDAY:
 	// - stop putting block content on the mesh.
 	// - bigger than 32MiB block size?
+	app.topicPeers.Reset(app.P2p.Me)
+	app.gossipLatency.Reset(app.topicSpecs.MessageId)
+	app.gossipCatchup.Reset(app.topicSpecs.MessageId)
 	ps, err := pubsub.NewGossipSub(app.Ctx, app.P2p.Host,
 		append([]pubsub.Option{
-			pubsub.WithMaxMessageSize(1024 * 1024 * 32),
+			pubsub.WithMaxMessageSize(maxGossipMessageSize),
 			pubsub.WithDirectPeers(directPeers),
 			pubsub.WithValidateQueueSize(validationQueueSize),
-			pubsub.WithMessageIdFn(func(pmsg *pb.Message) string {
-				hash, err := blake2b.New256([]byte(pmsg.GetTopic()))
-				panicOnErr(err)
-				_, err = hash.Write(pmsg.GetData())
-				panicOnErr(err)
-				return string(hash.Sum(nil))
-			}),
+			pubsub.WithEventTracer(&app.gossipTrace),
+			pubsub.WithMessageIdFn(app.topicSpecs.MessageId),
+			pubsub.WithRawTracer(&app.topicPeers),
+			pubsub.WithRawTracer(&app.gossipLatency),
+			pubsub.WithRawTracer(&app.gossipCatchup),
 		}, opts...)...,
 	)
 	app.P2p.Pubsub = ps
+	app.validationQueueSize = validationQueueSize
 	return err
 }
 
@@ -160,6 +166,18 @@ func fromConfigureReq(req ipcRpcRequest) (rpcRequest, error) {
 	return ConfigureReq(i), err
 }
 func (msg ConfigureReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p != nil {
+		notifyReloading()
+	}
+	resp := msg.configure(app, seqno)
+	// Helper keeps serving after a failed reconfiguration
+	if app.P2p != nil {
+		notifyReady("configured")
+	}
+	return resp
+}
+
+func (msg ConfigureReq) configure(app *app, seqno uint64) *capnp.Message {
 	m, err := ConfigureReqT(msg).Config()
 	if err != nil {
 		return mkRpcRespError(seqno, badRPC(err))
@@ -220,6 +238,12 @@ func (msg ConfigureReq) handle(app *app, seqno uint64) *capnp.Message {
 	if err != nil {
 		return mkRpcRespError(seqno, badRPC(err))
 	}
+	// Direct peers are trusted by the gating and connected to like seeds
+	app.AddedPeers = append(app.AddedPeers, directPeers...)
+	directReconnectInterval, err := m.DirectPeerReconnectInterval()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
 
 	externalMa, err := m.ExternalMultiaddr()
 	if err != nil {
@@ -238,7 +262,7 @@ func (msg ConfigureReq) handle(app *app, seqno uint64) *capnp.Message {
 	if err != nil {
 		return mkRpcRespError(seqno, badRPC(err))
 	}
-	gatingConfig, err := readGatingConfig(gc, app.AddedPeers)
+	gatingConfig, err := readGatingConfig(gc, app.AddedPeers, &app.asnTables)
 	if err != nil {
 		return mkRpcRespError(seqno, badRPC(err))
 	}
@@ -261,30 +285,338 @@ func (msg ConfigureReq) handle(app *app, seqno uint64) *capnp.Message {
 		return mkRpcRespError(seqno, badRPC(err))
 	}
 
-	helper, err := codanet.MakeHelper(app.Ctx, listenOn, externalMaddr, stateDir, privk, netId, seeds, gatingConfig, int(m.MinConnections()), int(m.MaxConnections()), m.MinaPeerExchange(), time.Millisecond)
+	aac, err := m.AddrAnnounce()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	announceConfig, err := readAnnounceConfig(aac)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+
+	dlc, err := m.DialLadder()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	dialLadder, err := readDialLadderConfig(dlc)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+
+	dsc, err := m.DownloadScheduler()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	maxConcurrentRoots, downloadPolicy, tagPriorities, err := readDownloadSchedulerConfig(dsc)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	dtc, err := m.BitswapDataTags()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	dataConfigs, err := readBitswapDataConfigs(app.bitswapCtx.maxBlockSize, dtc)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	drc, err := m.DownloadRetry()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	maxDownloadAttempts, initialRetryBackoff, maxRetryBackoff, err := readDownloadRetryConfig(drc)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	rpcAdmission, err := m.RpcAdmission()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	dvc, err := m.DownloadVerification()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	verifiedTags, verificationTimeout, verificationData, err := readDownloadVerificationConfig(dvc)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	resourceUpdateAckTimeout, err := m.ResourceUpdateAckTimeout()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	btc, err := m.BitswapThrottle()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	throttleLimits := readBitswapThrottleConfig(btc)
+	bsc, err := m.BitswapServing()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	maxServedBlocks, deniedPeers, err := readBitswapServingConfig(bsc)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	cpl, err := m.CachePeers()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	cachePeers, err := readCachePeers(cpl)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	srrc, err := m.StaleRootReaper()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	reaperInterval, reaperMaxAge, reaperRedownload, err := readStaleRootReaperConfig(srrc)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	slc, err := m.StakingLedger()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	stakingLedgers, err := readStakingLedgerConfig(slc)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	mbp, err := m.MalformedBlockPenalty()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	banThreshold, penaltyWindow, scorePenalty, err := readMalformedBlockPenaltyConfig(mbp)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	roc, err := m.RelayOnly()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	relayOnly, minConnections, maxConnections := readRelayOnlyConfig(roc, int(m.MinConnections()), int(m.MaxConnections()))
+	bec, err := m.BitswapEngine()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	bitswapEngine, err := readBitswapEngineConfig(bec)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	dbc, err := m.DownloadBackpressure()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	rootsHigh, rootsLow, blocksHigh, blocksLow, err := readDownloadBackpressureConfig(dbc, cap(app.bitswapCtx.blockSink))
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	if err := app.bitswapCtx.backpressure.Configure(rootsHigh, rootsLow, blocksHigh, blocksLow); err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	bpc, err := m.BitswapProtocol()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	vcc, err := m.ValidationCache()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	validationCacheSize, validationCacheTTL, err := readValidationCacheConfig(vcc)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	vbc, err := m.ValidationBatch()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	validationBatchSize, validationBatchDelay, err := readValidationBatchConfig(vbc)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	gcc, err := m.GossipCatchup()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	gossipCatchupSize, gossipCatchupWindow, err := readGossipCatchupConfig(gcc)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	otc, err := m.OutboundTarget()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	outboundTarget, err := readOutboundTargetConfig(otc)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	if outboundTarget.target > maxConnections {
+		return mkRpcRespError(seqno, badRPC(fmt.Errorf("outbound target %d exceeds max connections %d", outboundTarget.target, maxConnections)))
+	}
+	bitswapProtocol, err := readBitswapProtocolConfig(bpc)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	dupc, err := m.DuplicateSuppression()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	if err := app.bitswapCtx.duplicateSuppression.Configure(readDuplicateSuppressionConfig(dupc)); err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	startReaper := reaperInterval > 0 && !app.staleRootReaperStarted && !relayOnly
+	// Roots left partial by a previous run are only
+	// listed before the storage is opened for Bitswap
+	var stalePartialRoots []dl.BitswapBlockLink
+	if startReaper && m.EphemeralBlockstoreSize() == 0 {
+		stalePartialRoots, err = codanet.ScanPartialRoots(app.Ctx, stateDir)
+		if err != nil {
+			return mkRpcRespError(seqno, badHelper(err))
+		}
+	}
+	// Metadata of roots is indexed in memory once, as it's
+	// only listed before the storage is opened for Bitswap
+	var rootMetadata map[dl.BitswapBlockLink][]byte
+	if app.P2p == nil && !relayOnly && m.EphemeralBlockstoreSize() == 0 {
+		rootMetadata, err = codanet.ScanRootMetadata(app.Ctx, stateDir)
+		if err != nil {
+			return mkRpcRespError(seqno, badHelper(err))
+		}
+	}
+	agentVersion := ""
+	if m.HasAgent() {
+		am, err := m.Agent()
+		if err != nil {
+			return mkRpcRespError(seqno, badRPC(err))
+		}
+		agent, err := readAgentInfo(am)
+		if err != nil {
+			return mkRpcRespError(seqno, badRPC(err))
+		}
+		if !agent.isEmpty() {
+			agentVersion = agent.String()
+		}
+	}
+
+	helper, err := codanet.MakeHelper(app.Ctx, listenOn, externalMaddr, stateDir, privk, netId, seeds, gatingConfig, minConnections, maxConnections, m.MinaPeerExchange(), time.Millisecond, codanet.HelperOptions{
+		EnableRelay:             len(dialLadder.relays) > 0,
+		RelayOnly:               relayOnly,
+		EphemeralBlockstoreSize: int(m.EphemeralBlockstoreSize()),
+		BitswapEngine:           bitswapEngine,
+		BitswapProtocol:         bitswapProtocol,
+		AgentVersion:            agentVersion,
+	})
 	if err != nil {
 		return mkRpcRespError(seqno, badHelper(err))
 	}
 
+	helper.SetAnnounceConfig(announceConfig)
+	helper.BitswapThrottle.Configure(throttleLimits)
+	helper.BitswapServing.Configure(maxServedBlocks, deniedPeers)
+	helper.BitswapServing.OnOverLimit(func(p peer.ID, dropped int) {
+		app.peerAudit.Record(p, ipc.Libp2pHelperInterface_PeerAuditEventKind_bitswapOverLimit, fmt.Sprintf("%d wants of blocks dropped", dropped))
+	})
+	// Ephemeral blockstore keeps blocks uncompressed
+	if compressed, ok := helper.BitswapStorage.(*codanet.BitswapStorageCompressed); ok {
+		// Codec ids match values of BlockCompression
+		if err := compressed.SetCodec(codanet.BlockCodecId(m.BlockCompression())); err != nil {
+			helper.Logger.Warnf("blocks are stored uncompressed: %s", err)
+		}
+		compressed.SetCacheSize(int(m.BlockCacheSize()))
+	}
 	app.P2p = helper
+	app.relayOnly = relayOnly
+	app.dialLadder = dialLadder
+	dialLadder.failures = helper.ConnFailures
+	// Outbound target is maintained once advertising begins
+	if outboundTarget.target > 0 && !app.outboundTargetStarted {
+		app.outboundTarget = newOutboundTarget(outboundTarget, helper.ConnFailures)
+	}
+	app.setCachePeers(cachePeers)
+	app.setDirectPeers(directPeers)
 	app.bitswapCtx.engine = helper.Bitswap
+	app.bitswapCtx.providerHints = helper.ProviderHints
+	app.bitswapCtx.senders = helper.BitswapSenders
+	helper.BitswapSenders.OnDuplicate(app.bitswapCtx.onDuplicateBlock)
+	app.bitswapCtx.onMalformedBlock = app.penalizeMalformedBlock
 	app.bitswapCtx.storage = helper.BitswapStorage
+	for root, metadata := range rootMetadata {
+		app.bitswapCtx.rootMetadata[root] = metadata
+	}
+	for tag, dataConfig := range dataConfigs {
+		app.bitswapCtx.dataConfig[tag] = dataConfig
+	}
+	app.bitswapCtx.scheduler.Configure(maxConcurrentRoots, downloadPolicy, tagPriorities)
+	app.bitswapCtx.retries.Configure(maxDownloadAttempts, initialRetryBackoff, maxRetryBackoff)
+	app.bitswapCtx.verifications.Configure(stakingLedgers.verifiedTags(verifiedTags), verificationTimeout, verificationData)
+	app.bitswapCtx.stakingLedgers = stakingLedgers
+	app.malformedBlockPenalties.Configure(banThreshold, penaltyWindow, scorePenalty)
+	// Penalties past the configured window aren't restored
+	if !app.reputationSaveStarted {
+		app.restoreReputation()
+		go app.saveReputationPeriodically()
+		app.reputationSaveStarted = true
+	}
+	app.rpcAdmission.Configure(rpcAdmission.Rate(), int(rpcAdmission.Burst()))
+	app.bitswapCtx.updateLog.SetAckTimeout(time.Duration(resourceUpdateAckTimeout.NanoSec()))
+	app.validationVerdicts.Configure(validationCacheSize, validationCacheTTL)
+	app.validationBatches.Configure(validationBatchSize, validationBatchDelay)
+	app.gossipCatchup.Configure(gossipCatchupSize, gossipCatchupWindow)
 
-	err = configurePubsub(app, int(m.ValidationQueueSize()), directPeers,
-		pubsub.WithFloodPublish(m.Flood()),
-		pubsub.WithPeerExchange(m.PeerExchange()))
+	gossipConfig, err := m.Gossip()
 	if err != nil {
-		return mkRpcRespError(seqno, badHelper(err))
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+
+	if relayOnly {
+		app.P2p.Logger.Infof("running relay-only, gossip and Bitswap are disabled")
+	} else {
+		gossipOpts, err := readGossipConfig(gossipConfig, app.malformedBlockPenalties.Score)
+		if err != nil {
+			return mkRpcRespError(seqno, badRPC(err))
+		}
+		if gossipConfig.OpportunisticGraftThreshold() > 0 {
+			// The inspection needs scoring enabled beforehand
+			gossipOpts = append(gossipOpts, pubsub.WithPeerScoreInspect(pubsub.ExtendedPeerScoreInspectFn(app.gossipScores.Inspect), time.Second))
+		}
+		err = configurePubsub(app, int(m.ValidationQueueSize()), directPeers,
+			append([]pubsub.Option{
+				pubsub.WithFloodPublish(m.Flood()),
+				pubsub.WithPeerExchange(m.PeerExchange()),
+				pubsub.WithDirectConnectTicks(directConnectTicks(time.Duration(directReconnectInterval.NanoSec()))),
+			}, gossipOpts...)...)
+		if err != nil {
+			return mkRpcRespError(seqno, badHelper(err))
+		}
+		app.peerScoring = gossipConfig.OpportunisticGraftThreshold() > 0
+		app.startGossipCatchup()
 	}
 
 	app.P2p.Logger.Infof("here are the seeds: %v", seeds)
 
+	mpc, err := m.MetricsPush()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	metricsPush, err := readMetricsPushConfig(mpc)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	if metricsPush.url != "" && !app.metricsPushStarted {
+		pusher, err := newMetricsPusher(metricsPush, peer.Encode(app.P2p.Me), nil)
+		if err != nil {
+			return mkRpcRespError(seqno, badRPC(err))
+		}
+		go app.pushMetrics(metricsPush.interval, pusher)
+		app.metricsPushStarted = true
+	}
+
 	metricsServer := app.metricsServer
 	if metricsServer != nil && metricsServer.port != m.MetricsPort() {
 		metricsServer.Shutdown()
 	}
 	if m.MetricsPort() > 0 {
 		app.metricsServer = startMetricsServer(m.MetricsPort())
+	}
+	if m.MetricsPort() > 0 || app.metricsPushStarted {
 		if !app.metricsCollectionStarted {
 			go app.checkBandwidth()
 			go app.checkPeerCount()
@@ -294,6 +626,103 @@ func (msg ConfigureReq) handle(app *app, seqno uint64) *capnp.Message {
 		}
 	}
 
+	ledgerInterval, err := m.BitswapLedgerReportInterval()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	if ledgerInterval.NanoSec() > 0 && !app.bitswapLedgerReportStarted && !relayOnly {
+		go app.reportBitswapLedgers(time.Duration(ledgerInterval.NanoSec()))
+		app.bitswapLedgerReportStarted = true
+	}
+
+	scoreInterval, err := m.GossipScoreReportInterval()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	if scoreInterval.NanoSec() > 0 && !app.gossipScoreReportStarted && !relayOnly {
+		if !app.peerScoring {
+			return mkRpcRespError(seqno, badRPC(errors.New("gossip score reports need peer scoring, enabled by gossip.opportunisticGraftThreshold")))
+		}
+		go app.reportGossipScores(time.Duration(scoreInterval.NanoSec()))
+		app.gossipScoreReportStarted = true
+	}
+
+	bgc, err := m.BitswapGc()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	gcInterval, sweepAbove, warnAbove, err := readBitswapGcConfig(bgc)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	if gcInterval > 0 && !app.bitswapGcStarted && !relayOnly {
+		go app.collectBitswapGarbage(gcInterval, sweepAbove, warnAbove)
+		app.bitswapGcStarted = true
+	}
+	if startReaper {
+		go app.reapBitswapStaleRoots(reaperInterval, reaperMaxAge, reaperRedownload, stalePartialRoots)
+		app.staleRootReaperStarted = true
+	}
+
+	tc, err := m.Telemetry()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	if !app.telemetryStarted {
+		sinks, interval, err := readTelemetryConfig(app, tc)
+		if err != nil {
+			return mkRpcRespError(seqno, badRPC(err))
+		}
+		if len(sinks) > 0 {
+			go app.reportTelemetry(interval, sinks)
+			app.telemetryStarted = true
+		}
+	}
+
+	tec, err := m.TopologyExport()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	if !app.topologyExportStarted {
+		sinks, interval, err := readTopologyExportConfig(tec)
+		if err != nil {
+			return mkRpcRespError(seqno, badRPC(err))
+		}
+		if len(sinks) > 0 {
+			go app.exportTopology(interval, sinks, tec.Anonymize())
+			app.topologyExportStarted = true
+		}
+	}
+
+	availabilityTopic, err := m.AvailabilityTopic()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	if availabilityTopic != "" && app.availability == nil && !relayOnly {
+		app.topicSpecs.Register(availabilityTopic, topicSpec{
+			kind:    ipc.MessageKind_availabilityHint,
+			maxSize: maxAnnouncedRoots * dl.BITSWAP_BLOCK_LINK_SIZE,
+		})
+		availability, err := startAvailabilityHints(app.Ctx, app.P2p.Pubsub, app.P2p.Me, availabilityTopic)
+		if err != nil {
+			return mkRpcRespError(seqno, badp2p(err))
+		}
+		app.availability = availability
+		app.bitswapCtx.availability = availability
+	}
+
+	// Ports are bound and the storage is open by now
+	if app.sandbox != nil && app.sandbox.active() && !app.sandboxed {
+		paths := []sandboxPath{{path: stateDir, perms: "rwc"}}
+		if exportPath, err := tec.Path(); err == nil && exportPath != "" {
+			paths = append(paths, sandboxPath{path: exportPath, perms: "wc"})
+		}
+		if err := app.sandbox.enter(paths); err != nil {
+			return mkRpcRespError(seqno, badHelper(err))
+		}
+		app.sandboxed = true
+	}
+
 	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
 		_, err := m.NewConfigure()
 		panicOnErr(err)
@@ -412,7 +841,7 @@ func (m SetGatingConfigReq) handle(app *app, seqno uint64) *capnp.Message {
 	var newState *codanet.CodaGatingState
 	gc, err := SetGatingConfigReqT(m).GatingConfig()
 	if err == nil {
-		newState, err = readGatingConfig(gc, app.AddedPeers)
+		newState, err = readGatingConfig(gc, app.AddedPeers, &app.asnTables)
 	}
 	if err != nil {
 		return mkRpcRespError(seqno, badRPC(err))
@@ -426,6 +855,159 @@ func (m SetGatingConfigReq) handle(app *app, seqno uint64) *capnp.Message {
 	})
 }
 
+type SetAddrAnnounceConfigReqT = ipc.Libp2pHelperInterface_SetAddrAnnounceConfig_Request
+type SetAddrAnnounceConfigReq SetAddrAnnounceConfigReqT
+
+func fromSetAddrAnnounceConfigReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.SetAddrAnnounceConfig()
+	return SetAddrAnnounceConfigReq(i), err
+}
+func (m SetAddrAnnounceConfigReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	var announceConfig *codanet.AnnounceConfig
+	c, err := SetAddrAnnounceConfigReqT(m).Config()
+	if err == nil {
+		announceConfig, err = readAnnounceConfig(c)
+	}
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+
+	app.P2p.SetAnnounceConfig(announceConfig)
+
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewSetAddrAnnounceConfig()
+		panicOnErr(err)
+	})
+}
+
+func readBitswapThrottleConfig(c ipc.BitswapThrottleConfig) codanet.BitswapThrottleLimits {
+	return codanet.BitswapThrottleLimits{
+		BytesPerSec:      int(c.BytesPerSec()),
+		BlocksPerSec:     int(c.BlocksPerSec()),
+		PeerBytesPerSec:  int(c.PeerBytesPerSec()),
+		PeerBlocksPerSec: int(c.PeerBlocksPerSec()),
+	}
+}
+
+func readBitswapEngineConfig(c ipc.BitswapEngineConfig) (codanet.BitswapEngineConfig, error) {
+	providerSearchDelay, err := c.ProviderSearchDelay()
+	if err != nil {
+		return codanet.BitswapEngineConfig{}, err
+	}
+	res := codanet.BitswapEngineConfig{
+		TaskWorkerCount:             int(c.TaskWorkerCount()),
+		EngineTaskWorkerCount:       int(c.EngineTaskWorkerCount()),
+		EngineBlockstoreWorkerCount: int(c.EngineBlockstoreWorkerCount()),
+		ProviderSearchDelay:         time.Duration(providerSearchDelay.NanoSec()),
+		MaxOutstandingBytesPerPeer:  int(c.MaxOutstandingBytesPerPeer()),
+	}
+	return res, res.Validate()
+}
+
+func readBitswapProtocolConfig(c ipc.BitswapProtocolConfig) (codanet.BitswapProtocolConfig, error) {
+	network, err := c.Network()
+	if err != nil {
+		return codanet.BitswapProtocolConfig{}, err
+	}
+	res := codanet.BitswapProtocolConfig{
+		Network: network,
+		Legacy:  c.LegacyFallback(),
+	}
+	return res, res.Validate()
+}
+
+func readBitswapServingConfig(c ipc.BitswapServingConfig) (int, []peer.ID, error) {
+	deniedL, err := c.DeniedPeers()
+	if err != nil {
+		return 0, nil, err
+	}
+	denied := make([]peer.ID, 0, deniedL.Len())
+	err = capnpPeerIdListForeach(deniedL, func(peerID string) error {
+		id, err := peer.Decode(peerID)
+		if err == nil {
+			denied = append(denied, id)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return int(c.MaxBlocksPerPeerPerMinute()), denied, nil
+}
+
+type SetBitswapServingReqT = ipc.Libp2pHelperInterface_SetBitswapServing_Request
+type SetBitswapServingReq SetBitswapServingReqT
+
+func fromSetBitswapServingReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.SetBitswapServing()
+	return SetBitswapServingReq(i), err
+}
+func (m SetBitswapServingReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	c, err := SetBitswapServingReqT(m).Config()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	maxServedBlocks, deniedPeers, err := readBitswapServingConfig(c)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	app.P2p.BitswapServing.Configure(maxServedBlocks, deniedPeers)
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewSetBitswapServing()
+		panicOnErr(err)
+	})
+}
+
+type SetBitswapThrottleReqT = ipc.Libp2pHelperInterface_SetBitswapThrottle_Request
+type SetBitswapThrottleReq SetBitswapThrottleReqT
+
+func fromSetBitswapThrottleReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.SetBitswapThrottle()
+	return SetBitswapThrottleReq(i), err
+}
+func (m SetBitswapThrottleReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	c, err := SetBitswapThrottleReqT(m).Config()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	app.P2p.BitswapThrottle.Configure(readBitswapThrottleConfig(c))
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewSetBitswapThrottle()
+		panicOnErr(err)
+	})
+}
+
+type SetMaintenanceModeReqT = ipc.Libp2pHelperInterface_SetMaintenanceMode_Request
+type SetMaintenanceModeReq SetMaintenanceModeReqT
+
+func fromSetMaintenanceModeReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.SetMaintenanceMode()
+	return SetMaintenanceModeReq(i), err
+}
+func (m SetMaintenanceModeReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	duration, err := SetMaintenanceModeReqT(m).Duration()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	app.setMaintenance(time.Duration(duration.NanoSec()), SetMaintenanceModeReqT(m).RejectInbound())
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewSetMaintenanceMode()
+		panicOnErr(err)
+	})
+}
+
 type SetNodeStatusReqT = ipc.Libp2pHelperInterface_SetNodeStatus_Request
 type SetNodeStatusReq SetNodeStatusReqT
 
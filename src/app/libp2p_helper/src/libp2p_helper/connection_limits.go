@@ -0,0 +1,74 @@
+package main
+
+import (
+	"time"
+
+	"codanet"
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+)
+
+type SetConnectionLimitsReqT = ipc.Libp2pHelperInterface_SetConnectionLimits_Request
+type SetConnectionLimitsReq SetConnectionLimitsReqT
+
+func fromSetConnectionLimitsReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.SetConnectionLimits()
+	return SetConnectionLimitsReq(i), err
+}
+
+// readConnectionLimits returns the limits of the request, zero values of
+// which are replaced with the current limits
+func readConnectionLimits(m SetConnectionLimitsReqT, current codanet.ConnectionLimits) (codanet.ConnectionLimits, error) {
+	limits := current
+	if m.MinConnections() > 0 {
+		limits.LowWater = int(m.MinConnections())
+	}
+	if m.MaxConnections() > 0 {
+		limits.HighWater = int(m.MaxConnections())
+	}
+	grace, err := m.GracePeriod()
+	if err != nil {
+		return limits, err
+	}
+	if grace.NanoSec() > 0 {
+		limits.GracePeriod = time.Duration(grace.NanoSec())
+	}
+	silence, err := m.SilencePeriod()
+	if err != nil {
+		return limits, err
+	}
+	if silence.NanoSec() > 0 {
+		limits.SilencePeriod = time.Duration(silence.NanoSec())
+	}
+	return limits, nil
+}
+
+func (m SetConnectionLimitsReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	cm := app.P2p.ConnectionManager
+	limits, err := readConnectionLimits(SetConnectionLimitsReqT(m), cm.Limits())
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	if err := cm.SetLimits(app.P2p.Host.Network(), limits); err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	app.P2p.Logger.Infof("connection limits set to %d-%d, grace period %s, silence period %s",
+		limits.LowWater, limits.HighWater, limits.GracePeriod, limits.SilencePeriod)
+	limits = cm.Limits()
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		r, err := m.NewSetConnectionLimits()
+		panicOnErr(err)
+		r.SetMinConnections(uint32(limits.LowWater))
+		r.SetMaxConnections(uint32(limits.HighWater))
+		grace, err := r.NewGracePeriod()
+		panicOnErr(err)
+		grace.SetNanoSec(uint64(limits.GracePeriod))
+		silence, err := r.NewSilencePeriod()
+		panicOnErr(err)
+		silence.SetNanoSec(uint64(limits.SilencePeriod))
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func testSetConnectionLimits(t *testing.T, app *app, min, max uint32, grace time.Duration) ipc.Libp2pHelperInterface_SetConnectionLimits_Response {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	m, err := ipc.NewRootLibp2pHelperInterface_SetConnectionLimits_Request(seg)
+	require.NoError(t, err)
+	m.SetMinConnections(min)
+	m.SetMaxConnections(max)
+	d, err := m.NewGracePeriod()
+	require.NoError(t, err)
+	d.SetNanoSec(uint64(grace))
+
+	var mRpcSeqno uint64 = 2200
+	resMsg := SetConnectionLimitsReq(m).handle(app, mRpcSeqno)
+	seqno, respSuccess := checkRpcResponseSuccess(t, resMsg, "setConnectionLimits")
+	require.Equal(t, seqno, mRpcSeqno)
+	require.True(t, respSuccess.HasSetConnectionLimits())
+	resp, err := respSuccess.SetConnectionLimits()
+	require.NoError(t, err)
+	return resp
+}
+
+func TestSetConnectionLimits(t *testing.T) {
+	testApp, _ := newTestApp(t, nil, true)
+	initial := testApp.P2p.ConnectionManager.Limits()
+
+	resp := testSetConnectionLimits(t, testApp, 10, 50, time.Minute)
+	require.Equal(t, uint32(10), resp.MinConnections())
+	require.Equal(t, uint32(50), resp.MaxConnections())
+	grace, err := resp.GracePeriod()
+	require.NoError(t, err)
+	require.Equal(t, uint64(time.Minute), grace.NanoSec())
+	silence, err := resp.SilencePeriod()
+	require.NoError(t, err)
+	require.Equal(t, uint64(initial.SilencePeriod), silence.NanoSec())
+
+	// Zero values keep the current limits
+	resp = testSetConnectionLimits(t, testApp, 0, 60, 0)
+	require.Equal(t, uint32(10), resp.MinConnections())
+	require.Equal(t, uint32(60), resp.MaxConnections())
+	limits := testApp.P2p.ConnectionManager.Limits()
+	require.Equal(t, 10, limits.LowWater)
+	require.Equal(t, 60, limits.HighWater)
+	require.Equal(t, time.Minute, limits.GracePeriod)
+}
@@ -25,6 +25,27 @@ type app struct {
 	Ctx                      context.Context
 	Subs                     map[uint64]subscription
 	Topics                   map[string]*pubsub.Topic
+	TopicDispatchers         map[string]*topicDispatcher
+	TopicDispatchersMutex    sync.Mutex
+	topicSpecs               *topicRegistry
+	rpcAdmission             *rpcAdmission
+	peerAudit                *peerAuditLog
+	schemaMismatches         *schemaMismatches
+	malformedBlockPenalties  *malformedBlockPenalties
+	validationQueues         map[string]*validationQueue
+	validationQueuesMutex    sync.Mutex
+	validationQueueSize      int
+	validationVerdicts       validationCache
+	validationBatches        validationBatcher
+	publishLimiters          map[string]*publishLimiter
+	publishLimitersMutex     sync.Mutex
+	topicPeers               topicPeersTracer
+	gossipScores             gossipScores
+	gossipRecord             gossipRecorder
+	gossipReplay             gossipReplayer
+	gossipLatency            gossipLatencyTracer
+	gossipCatchup            gossipCatchup
+	peerScoring              bool
 	Validators               map[uint64]*validationStatus
 	ValidatorMutex           *sync.Mutex
 	Streams                  map[uint64]net.Stream
@@ -48,8 +69,42 @@ type app struct {
 	// Mutex for id generation
 	counterMutex sync.Mutex
 
-	bitswapCtx                *BitswapCtx
-	setConnectionHandlersOnce sync.Once
+	bitswapCtx                 *BitswapCtx
+	setConnectionHandlersOnce  sync.Once
+	bitswapLedgerReportStarted bool
+	gossipScoreReportStarted   bool
+	telemetryStarted           bool
+	topologyExportStarted      bool
+	bitswapGcStarted           bool
+	staleRootReaperStarted     bool
+	metricsPushStarted         bool
+	reputationSaveStarted      bool
+	outboundTargetStarted      bool
+	availability               *availabilityHints
+	dialLadder                 *dialLadder
+	outboundTarget             *outboundTarget
+	maintenance                maintenanceWindow
+	asnTables                  asnTableCache
+	// colocated helpers asked for Bitswap blocks first
+	cachePeers []peer.ID
+	// gossip is exchanged with outside of meshes
+	directPeers []peer.ID
+	// neither gossip nor Bitswap is run, see RelayOnlyConfig
+	relayOnly bool
+	// entered after the first successful configure
+	sandbox   *sandboxConfig
+	sandboxed bool
+
+	firehose      *firehose
+	firehoseMutex sync.RWMutex
+	// event tracer of gossipsub, see SetGossipTrace
+	gossipTrace gossipTracer
+	// running tuning experiment, nil if none
+	tuning      *tuningExperiment
+	tuningMutex sync.Mutex
+	// set while a blockstore audit is running
+	auditing   bool
+	auditMutex sync.Mutex
 }
 
 type subscription struct {
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"codanet"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	peerstore "github.com/libp2p/go-libp2p-core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	defaultDirectDialTimeout = 10 * time.Second
+	defaultRelayDialTimeout  = 15 * time.Second
+	defaultHolePunchTimeout  = 10 * time.Second
+
+	// Time for which the rung a peer was last reached with is preferred,
+	// after it expires the ladder is climbed from the bottom again
+	dialPreferenceTTL = time.Hour
+
+	holePunchPollInterval = 100 * time.Millisecond
+)
+
+type dialPreference struct {
+	rung ipc.DialRung
+	at   time.Time
+}
+
+// dialLadder connects to peers climbing the fallback ladder:
+// direct dial, then dial through a relay, waiting for the hole punch to
+// upgrade the relayed connection to a direct one. The rung a peer was
+// reached with is remembered and climbing starts from it the next time.
+// Connections opened by climbing are recorded with the rung they were
+// established with, other connections are classified by their addresses
+// and directions.
+// Direct dial is skipped for peers with no addresses of classes reachable
+// from our node, according to the scoreboard.
+type dialLadder struct {
+	directTimeout    time.Duration
+	relayTimeout     time.Duration
+	holePunchTimeout time.Duration
+	relays           []peer.AddrInfo
+	scoreboard       *dialScoreboard
+	// failed connects are recorded to if set
+	failures *codanet.ConnectionFailures
+
+	preferences map[peer.ID]dialPreference
+	// rungs of open connections established by climbing the ladder
+	rungs map[peer.ID]map[network.Conn]ipc.DialRung
+	mutex sync.Mutex
+}
+
+func newDialLadder(directTimeout, relayTimeout, holePunchTimeout time.Duration, relays []peer.AddrInfo) *dialLadder {
+	if directTimeout == 0 {
+		directTimeout = defaultDirectDialTimeout
+	}
+	if relayTimeout == 0 {
+		relayTimeout = defaultRelayDialTimeout
+	}
+	if holePunchTimeout == 0 {
+		holePunchTimeout = defaultHolePunchTimeout
+	}
+	return &dialLadder{
+		directTimeout:    directTimeout,
+		relayTimeout:     relayTimeout,
+		holePunchTimeout: holePunchTimeout,
+		relays:           relays,
+		scoreboard:       newDialScoreboard(),
+		preferences:      make(map[peer.ID]dialPreference),
+		rungs:            make(map[peer.ID]map[network.Conn]ipc.DialRung),
+	}
+}
+
+func readDialLadderConfig(cfg ipc.DialLadderConfig) (*dialLadder, error) {
+	directTimeout, err := cfg.DirectTimeout()
+	if err != nil {
+		return nil, err
+	}
+	relayTimeout, err := cfg.RelayTimeout()
+	if err != nil {
+		return nil, err
+	}
+	holePunchTimeout, err := cfg.HolePunchTimeout()
+	if err != nil {
+		return nil, err
+	}
+	relaysMaList, err := cfg.Relays()
+	if err != nil {
+		return nil, err
+	}
+	relays := make([]peer.AddrInfo, 0, relaysMaList.Len())
+	err = multiaddrListForeach(relaysMaList, func(v string) error {
+		addr, err := addrInfoOfString(v)
+		if err == nil {
+			relays = append(relays, *addr)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newDialLadder(
+		time.Duration(directTimeout.NanoSec()),
+		time.Duration(relayTimeout.NanoSec()),
+		time.Duration(holePunchTimeout.NanoSec()),
+		relays), nil
+}
+
+func isRelayedConn(c network.Conn) bool {
+	_, err := c.RemoteMultiaddr().ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
+
+func hasDirectConn(h host.Host, p peer.ID) bool {
+	for _, c := range h.Network().ConnsToPeer(p) {
+		if !isRelayedConn(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// startRung returns the rung to start climbing the ladder from
+func (l *dialLadder) startRung(p peer.ID) ipc.DialRung {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	pref, has := l.preferences[p]
+	if !has || time.Since(pref.at) > dialPreferenceTTL || len(l.relays) == 0 {
+		return ipc.DialRung_direct
+	}
+	return pref.rung
+}
+
+func (l *dialLadder) learn(p peer.ID, rung ipc.DialRung) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.preferences[p] = dialPreference{rung: rung, at: time.Now()}
+}
+
+// record assigns the rung to connections to the peer opened by climbing,
+// i.e. those not open before it started. Relayed ones are assigned the
+// relay rung, and direct ones opened while climbing reached only the relay
+// rung are hole punched. Connections no longer open are forgotten.
+func (l *dialLadder) record(h host.Host, p peer.ID, before []network.Conn, rung ipc.DialRung) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for id, conns := range l.rungs {
+		open := make(map[network.Conn]ipc.DialRung)
+		for _, c := range h.Network().ConnsToPeer(id) {
+			if r, has := conns[c]; has {
+				open[c] = r
+			}
+		}
+		if len(open) == 0 {
+			delete(l.rungs, id)
+		} else {
+			l.rungs[id] = open
+		}
+	}
+	existing := make(map[network.Conn]bool, len(before))
+	for _, c := range before {
+		existing[c] = true
+	}
+	for _, c := range h.Network().ConnsToPeer(p) {
+		if existing[c] {
+			continue
+		}
+		if _, has := l.rungs[p][c]; has {
+			continue
+		}
+		if l.rungs[p] == nil {
+			l.rungs[p] = make(map[network.Conn]ipc.DialRung)
+		}
+		switch {
+		case isRelayedConn(c):
+			l.rungs[p][c] = ipc.DialRung_relay
+		case rung == ipc.DialRung_relay:
+			l.rungs[p][c] = ipc.DialRung_holePunch
+		default:
+			l.rungs[p][c] = rung
+		}
+	}
+}
+
+// Rung returns the rung of the ladder the connection was established with
+func (l *dialLadder) Rung(c network.Conn) ipc.DialRung {
+	l.mutex.Lock()
+	rung, has := l.rungs[c.RemotePeer()][c]
+	l.mutex.Unlock()
+	if has {
+		return rung
+	}
+	if isRelayedConn(c) {
+		return ipc.DialRung_relay
+	}
+	if c.Stat().Direction == network.DirInbound {
+		return ipc.DialRung_inbound
+	}
+	return ipc.DialRung_direct
+}
+
+func (l *dialLadder) dialDirect(ctx context.Context, h host.Host, info peer.AddrInfo) error {
+	ctx, cancel := context.WithTimeout(ctx, l.directTimeout)
+	defer cancel()
+	addrs := make([]ma.Multiaddr, 0, len(info.Addrs))
+	for _, addr := range info.Addrs {
+		if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err != nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	// Dials are not scored when connection already exists
+	if hasDirectConn(h, info.ID) {
+		return nil
+	}
+	err := h.Connect(ctx, peer.AddrInfo{ID: info.ID, Addrs: addrs})
+	var connected ma.Multiaddr
+	if err == nil {
+		for _, c := range h.Network().ConnsToPeer(info.ID) {
+			if !isRelayedConn(c) {
+				connected = c.RemoteMultiaddr()
+				break
+			}
+		}
+	}
+	l.scoreboard.record(addrs, connected)
+	return err
+}
+
+func (l *dialLadder) dialRelayed(ctx context.Context, h host.Host, p peer.ID) error {
+	ctx, cancel := context.WithTimeout(ctx, l.relayTimeout)
+	defer cancel()
+	var err error
+	for _, relay := range l.relays {
+		if err = h.Connect(ctx, relay); err != nil {
+			continue
+		}
+		var circuit ma.Multiaddr
+		circuit, err = ma.NewMultiaddr(fmt.Sprintf("/p2p/%s/p2p-circuit", relay.ID.Pretty()))
+		if err != nil {
+			continue
+		}
+		if err = h.Connect(ctx, peer.AddrInfo{ID: p, Addrs: []ma.Multiaddr{circuit}}); err == nil {
+			return nil
+		}
+	}
+	if err == nil {
+		err = errors.New("no relays configured")
+	}
+	return err
+}
+
+// awaitHolePunch waits for a direct connection to the peer
+// to appear after a relayed connection was established
+func (l *dialLadder) awaitHolePunch(ctx context.Context, h host.Host, p peer.ID) bool {
+	ctx, cancel := context.WithTimeout(ctx, l.holePunchTimeout)
+	defer cancel()
+	ticker := time.NewTicker(holePunchPollInterval)
+	defer ticker.Stop()
+	for {
+		if hasDirectConn(h, p) {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// Connect connects to the peer climbing the ladder and returns
+// the rung connection was established with
+func (l *dialLadder) Connect(ctx context.Context, h host.Host, info peer.AddrInfo) (ipc.DialRung, error) {
+	before := h.Network().ConnsToPeer(info.ID)
+	rung, err := l.climb(ctx, h, info)
+	if err != nil {
+		if l.failures != nil {
+			l.failures.Record(info.ID)
+		}
+		return rung, err
+	}
+	l.record(h, info.ID, before, rung)
+	return rung, nil
+}
+
+func (l *dialLadder) climb(ctx context.Context, h host.Host, info peer.AddrInfo) (ipc.DialRung, error) {
+	start := l.startRung(info.ID)
+	if start == ipc.DialRung_direct && len(l.relays) > 0 && l.scoreboard.unreachable(info.Addrs) {
+		start = ipc.DialRung_relay
+	}
+	var directErr error
+	if start == ipc.DialRung_direct {
+		directErr = l.dialDirect(ctx, h, info)
+		if directErr == nil {
+			l.learn(info.ID, ipc.DialRung_direct)
+			return ipc.DialRung_direct, nil
+		}
+		if len(l.relays) == 0 {
+			return ipc.DialRung_direct, directErr
+		}
+	}
+	// Addresses of the peer need to be known to perform hole punching
+	h.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.ConnectedAddrTTL)
+	if err := l.dialRelayed(ctx, h, info.ID); err != nil {
+		if directErr == nil {
+			// Learned preference is stale, direct dial wasn't tried yet
+			directErr = l.dialDirect(ctx, h, info)
+			if directErr == nil {
+				l.learn(info.ID, ipc.DialRung_direct)
+				return ipc.DialRung_direct, nil
+			}
+		}
+		return ipc.DialRung_relay, fmt.Errorf("direct dial: %s; relayed dial: %w", directErr, err)
+	}
+	rung := ipc.DialRung_relay
+	if start != ipc.DialRung_relay && l.awaitHolePunch(ctx, h, info.ID) {
+		rung = ipc.DialRung_holePunch
+	}
+	l.learn(info.ID, rung)
+	return rung, nil
+}
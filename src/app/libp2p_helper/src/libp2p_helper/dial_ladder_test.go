@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	peerstore "github.com/libp2p/go-libp2p-core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+type ladderTestConn struct {
+	network.Conn
+	remote peer.ID
+	addr   ma.Multiaddr
+	dir    network.Direction
+}
+
+func (c *ladderTestConn) RemotePeer() peer.ID           { return c.remote }
+func (c *ladderTestConn) RemoteMultiaddr() ma.Multiaddr { return c.addr }
+func (c *ladderTestConn) Stat() network.Stat            { return network.Stat{Direction: c.dir} }
+
+type ladderTestNetwork struct {
+	network.Network
+	conns map[peer.ID][]network.Conn
+}
+
+func (n *ladderTestNetwork) ConnsToPeer(p peer.ID) []network.Conn {
+	return append([]network.Conn{}, n.conns[p]...)
+}
+
+type ladderTestPeerstore struct {
+	peerstore.Peerstore
+	addrs map[peer.ID][]ma.Multiaddr
+}
+
+func (ps *ladderTestPeerstore) AddAddrs(p peer.ID, addrs []ma.Multiaddr, _ time.Duration) {
+	ps.addrs[p] = append(ps.addrs[p], addrs...)
+}
+
+// ladderTestHost opens connections to peers according to their
+// reachability, without any networking. A relayed connection to a peer
+// that can be hole punched is followed by a direct one.
+type ladderTestHost struct {
+	host.Host
+	network   ladderTestNetwork
+	peerstore ladderTestPeerstore
+	relays    map[peer.ID]bool
+	direct    map[peer.ID]bool
+	relayed   map[peer.ID]bool
+	punched   map[peer.ID]bool
+	// kinds of dials attempted, in order
+	dials []string
+}
+
+func newLadderTestHost() *ladderTestHost {
+	return &ladderTestHost{
+		network:   ladderTestNetwork{conns: make(map[peer.ID][]network.Conn)},
+		peerstore: ladderTestPeerstore{addrs: make(map[peer.ID][]ma.Multiaddr)},
+		relays:    make(map[peer.ID]bool),
+		direct:    make(map[peer.ID]bool),
+		relayed:   make(map[peer.ID]bool),
+		punched:   make(map[peer.ID]bool),
+	}
+}
+
+func (h *ladderTestHost) Network() network.Network       { return &h.network }
+func (h *ladderTestHost) Peerstore() peerstore.Peerstore { return &h.peerstore }
+
+func (h *ladderTestHost) open(p peer.ID, addr ma.Multiaddr, dir network.Direction) network.Conn {
+	c := &ladderTestConn{remote: p, addr: addr, dir: dir}
+	h.network.conns[p] = append(h.network.conns[p], c)
+	return c
+}
+
+func (h *ladderTestHost) disconnect(p peer.ID) {
+	delete(h.network.conns, p)
+}
+
+func (h *ladderTestHost) Connect(_ context.Context, info peer.AddrInfo) error {
+	if h.relays[info.ID] {
+		h.open(info.ID, info.Addrs[0], network.DirOutbound)
+		return nil
+	}
+	for _, addr := range info.Addrs {
+		if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err != nil {
+			continue
+		}
+		h.dials = append(h.dials, "relayed")
+		if !h.relayed[info.ID] {
+			return errors.New("relay refused the circuit")
+		}
+		h.open(info.ID, addr, network.DirOutbound)
+		if h.punched[info.ID] {
+			h.open(info.ID, h.peerstore.addrs[info.ID][0], network.DirOutbound)
+		}
+		return nil
+	}
+	h.dials = append(h.dials, "direct")
+	if !h.direct[info.ID] {
+		return errors.New("peer unreachable")
+	}
+	h.open(info.ID, info.Addrs[0], network.DirOutbound)
+	return nil
+}
+
+func newLadderTest(t *testing.T) (*dialLadder, *ladderTestHost, peer.AddrInfo) {
+	relayID, err := peer.Decode("12D3KooWGnQ4vat8EybAeFEK3jk78vmwDu9qMhZzcyQBPb16VCnS")
+	require.NoError(t, err)
+	targetID, err := peer.Decode("12D3KooWJDGPa2hiYCJ2o7XPqEq2tjrWpFJzqa4dy538Gfs7Vn2r")
+	require.NoError(t, err)
+	relay := peer.AddrInfo{ID: relayID, Addrs: testMultiaddrs(t, "/ip4/5.6.7.8/tcp/8302")}
+	h := newLadderTestHost()
+	h.relays[relayID] = true
+	l := newDialLadder(time.Second, time.Second, 10*time.Millisecond, []peer.AddrInfo{relay})
+	return l, h, peer.AddrInfo{ID: targetID, Addrs: testMultiaddrs(t, "/ip4/1.2.3.4/tcp/8302")}
+}
+
+func TestDialLadderClimb(t *testing.T) {
+	t.Run("direct", func(t *testing.T) {
+		l, h, info := newLadderTest(t)
+		h.direct[info.ID] = true
+		rung, err := l.Connect(context.Background(), h, info)
+		require.NoError(t, err)
+		require.Equal(t, ipc.DialRung_direct, rung)
+		require.Equal(t, []string{"direct"}, h.dials)
+		conns := h.network.ConnsToPeer(info.ID)
+		require.Len(t, conns, 1)
+		require.Equal(t, ipc.DialRung_direct, l.Rung(conns[0]))
+	})
+	t.Run("relay", func(t *testing.T) {
+		l, h, info := newLadderTest(t)
+		h.relayed[info.ID] = true
+		rung, err := l.Connect(context.Background(), h, info)
+		require.NoError(t, err)
+		require.Equal(t, ipc.DialRung_relay, rung)
+		require.Equal(t, []string{"direct", "relayed"}, h.dials)
+		conns := h.network.ConnsToPeer(info.ID)
+		require.Len(t, conns, 1)
+		require.Equal(t, ipc.DialRung_relay, l.Rung(conns[0]))
+		// Addresses are known to the peerstore for hole punching
+		require.Equal(t, info.Addrs, h.peerstore.addrs[info.ID])
+	})
+	t.Run("hole punch", func(t *testing.T) {
+		l, h, info := newLadderTest(t)
+		h.relayed[info.ID] = true
+		h.punched[info.ID] = true
+		rung, err := l.Connect(context.Background(), h, info)
+		require.NoError(t, err)
+		require.Equal(t, ipc.DialRung_holePunch, rung)
+		conns := h.network.ConnsToPeer(info.ID)
+		require.Len(t, conns, 2)
+		require.Equal(t, ipc.DialRung_relay, l.Rung(conns[0]))
+		require.Equal(t, ipc.DialRung_holePunch, l.Rung(conns[1]))
+
+		// Connections opened later by other means aren't reported
+		// as hole punched, though the peer prefers that rung
+		inbound := h.open(info.ID, info.Addrs[0], network.DirInbound)
+		outbound := h.open(info.ID, info.Addrs[0], network.DirOutbound)
+		require.Equal(t, ipc.DialRung_inbound, l.Rung(inbound))
+		require.Equal(t, ipc.DialRung_direct, l.Rung(outbound))
+		require.Equal(t, ipc.DialRung_holePunch, l.startRung(info.ID))
+	})
+	t.Run("unreachable", func(t *testing.T) {
+		l, h, info := newLadderTest(t)
+		_, err := l.Connect(context.Background(), h, info)
+		require.Error(t, err)
+		require.Equal(t, []string{"direct", "relayed"}, h.dials)
+		require.Equal(t, ipc.DialRung_direct, l.startRung(info.ID))
+	})
+}
+
+func TestDialLadderStartRung(t *testing.T) {
+	t.Run("learned relay", func(t *testing.T) {
+		l, h, info := newLadderTest(t)
+		h.relayed[info.ID] = true
+		_, err := l.Connect(context.Background(), h, info)
+		require.NoError(t, err)
+		require.Equal(t, ipc.DialRung_relay, l.startRung(info.ID))
+
+		// Direct dial is skipped the next time
+		h.disconnect(info.ID)
+		h.dials = nil
+		rung, err := l.Connect(context.Background(), h, info)
+		require.NoError(t, err)
+		require.Equal(t, ipc.DialRung_relay, rung)
+		require.Equal(t, []string{"relayed"}, h.dials)
+	})
+	t.Run("stale preference", func(t *testing.T) {
+		l, h, info := newLadderTest(t)
+		l.learn(info.ID, ipc.DialRung_relay)
+		h.direct[info.ID] = true
+		rung, err := l.Connect(context.Background(), h, info)
+		require.NoError(t, err)
+		require.Equal(t, ipc.DialRung_direct, rung)
+		require.Equal(t, []string{"relayed", "direct"}, h.dials)
+		require.Equal(t, ipc.DialRung_direct, l.startRung(info.ID))
+	})
+	t.Run("relayed connection upgraded", func(t *testing.T) {
+		l, h, info := newLadderTest(t)
+		h.relayed[info.ID] = true
+		_, err := l.Connect(context.Background(), h, info)
+		require.NoError(t, err)
+
+		// The peer became reachable by hole punching since
+		h.disconnect(info.ID)
+		h.punched[info.ID] = true
+		rung, err := l.Connect(context.Background(), h, info)
+		require.NoError(t, err)
+		require.Equal(t, ipc.DialRung_relay, rung, "hole punch isn't awaited when starting from the relay rung")
+		conns := h.network.ConnsToPeer(info.ID)
+		require.Len(t, conns, 2)
+		require.Equal(t, ipc.DialRung_relay, l.Rung(conns[0]))
+		require.Equal(t, ipc.DialRung_holePunch, l.Rung(conns[1]))
+		l.learn(info.ID, ipc.DialRung_holePunch)
+		h.disconnect(info.ID)
+		rung, err = l.Connect(context.Background(), h, info)
+		require.NoError(t, err)
+		require.Equal(t, ipc.DialRung_holePunch, rung)
+	})
+	t.Run("expiry", func(t *testing.T) {
+		l, _, info := newLadderTest(t)
+		l.learn(info.ID, ipc.DialRung_relay)
+		require.Equal(t, ipc.DialRung_relay, l.startRung(info.ID))
+		l.preferences[info.ID] = dialPreference{rung: ipc.DialRung_relay, at: time.Now().Add(-dialPreferenceTTL - time.Minute)}
+		require.Equal(t, ipc.DialRung_direct, l.startRung(info.ID))
+	})
+	t.Run("no relays", func(t *testing.T) {
+		l, _, info := newLadderTest(t)
+		l.learn(info.ID, ipc.DialRung_relay)
+		l.relays = nil
+		require.Equal(t, ipc.DialRung_direct, l.startRung(info.ID))
+	})
+}
+
+func TestDialLadderForgetsClosedConns(t *testing.T) {
+	l, h, info := newLadderTest(t)
+	h.direct[info.ID] = true
+	_, err := l.Connect(context.Background(), h, info)
+	require.NoError(t, err)
+	require.Len(t, l.rungs[info.ID], 1)
+
+	h.disconnect(info.ID)
+	h.direct[info.ID] = false
+	h.relayed[info.ID] = true
+	_, err = l.Connect(context.Background(), h, info)
+	require.NoError(t, err)
+	conns := h.network.ConnsToPeer(info.ID)
+	require.Len(t, conns, 1)
+	require.Equal(t, map[network.Conn]ipc.DialRung{conns[0]: ipc.DialRung_relay}, l.rungs[info.ID])
+}
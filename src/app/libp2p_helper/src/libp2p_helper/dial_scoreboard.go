@@ -0,0 +1,168 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Number of failed dials after which a class of addresses with no
+	// successful dials is considered unreachable from our node
+	unreachableDialAttempts = 20
+)
+
+var dialOutcomesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "Mina_libp2p_direct_dials",
+	Help: "Number of direct dials by transport and address family of the dialed addresses",
+}, []string{"transport", "family", "outcome"})
+
+// dialClass is a transport and address family pair, e.g. tcp/ip6
+type dialClass struct {
+	transport string
+	family    string
+}
+
+// classifyAddr returns the class of a direct address,
+// false is returned for relayed addresses
+func classifyAddr(addr ma.Multiaddr) (dialClass, bool) {
+	class := dialClass{transport: "other", family: "other"}
+	direct := true
+	ma.ForEach(addr, func(c ma.Component) bool {
+		switch c.Protocol().Code {
+		case ma.P_IP4, ma.P_DNS4:
+			class.family = "ip4"
+		case ma.P_IP6, ma.P_DNS6:
+			class.family = "ip6"
+		case ma.P_DNS, ma.P_DNSADDR:
+			class.family = "dns"
+		case ma.P_TCP:
+			class.transport = "tcp"
+		case ma.P_QUIC:
+			class.transport = "quic"
+		case ma.P_WS, ma.P_WSS:
+			class.transport = "ws"
+		case ma.P_CIRCUIT:
+			direct = false
+			return false
+		}
+		return true
+	})
+	return class, direct
+}
+
+type dialScore struct {
+	attempts    uint64
+	successes   uint64
+	lastAttempt time.Time
+}
+
+type dialClassScore struct {
+	class     dialClass
+	attempts  uint64
+	successes uint64
+}
+
+// dialScoreboard keeps success rates of direct dials per class of
+// addresses. A dial that failed counts as a failure of every class of
+// addresses dialed, a successful one counts as a success of the class of
+// the address connection was established with (remaining dials are
+// cancelled, hence other classes are not scored).
+type dialScoreboard struct {
+	scores map[dialClass]*dialScore
+	mutex  sync.Mutex
+}
+
+func newDialScoreboard() *dialScoreboard {
+	return &dialScoreboard{scores: make(map[dialClass]*dialScore)}
+}
+
+func (sb *dialScoreboard) score(class dialClass) *dialScore {
+	s, has := sb.scores[class]
+	if !has {
+		s = &dialScore{}
+		sb.scores[class] = s
+	}
+	return s
+}
+
+// record scores a dial of the addresses, connected is the address
+// connection was established with, nil if the dial failed
+func (sb *dialScoreboard) record(addrs []ma.Multiaddr, connected ma.Multiaddr) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	now := time.Now()
+	if connected != nil {
+		class, direct := classifyAddr(connected)
+		if !direct {
+			return
+		}
+		s := sb.score(class)
+		s.attempts++
+		s.successes++
+		s.lastAttempt = now
+		dialOutcomesMetric.WithLabelValues(class.transport, class.family, "success").Inc()
+		return
+	}
+	failed := make(map[dialClass]struct{})
+	for _, addr := range addrs {
+		if class, direct := classifyAddr(addr); direct {
+			failed[class] = struct{}{}
+		}
+	}
+	for class := range failed {
+		s := sb.score(class)
+		s.attempts++
+		s.lastAttempt = now
+		dialOutcomesMetric.WithLabelValues(class.transport, class.family, "failure").Inc()
+	}
+}
+
+// unreachable tells whether all direct addresses are of classes no dial
+// ever succeeded with, false if there are no direct addresses. Verdict
+// expires an hour after the last dial of the class, so that changes of
+// our network configuration are picked up.
+func (sb *dialScoreboard) unreachable(addrs []ma.Multiaddr) bool {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	res := false
+	for _, addr := range addrs {
+		class, direct := classifyAddr(addr)
+		if !direct {
+			continue
+		}
+		s, has := sb.scores[class]
+		if !has || s.successes > 0 || s.attempts < unreachableDialAttempts || time.Since(s.lastAttempt) > dialPreferenceTTL {
+			return false
+		}
+		res = true
+	}
+	return res
+}
+
+// Scores returns scores of all classes dialed,
+// ordered by success rate from the highest
+func (sb *dialScoreboard) Scores() []dialClassScore {
+	sb.mutex.Lock()
+	res := make([]dialClassScore, 0, len(sb.scores))
+	for class, s := range sb.scores {
+		res = append(res, dialClassScore{class: class, attempts: s.attempts, successes: s.successes})
+	}
+	sb.mutex.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		// successes_i/attempts_i > successes_j/attempts_j, attempts are non-zero
+		ri := res[i].successes * res[j].attempts
+		rj := res[j].successes * res[i].attempts
+		if ri != rj {
+			return ri > rj
+		}
+		if res[i].class.transport != res[j].class.transport {
+			return res[i].class.transport < res[j].class.transport
+		}
+		return res[i].class.family < res[j].class.family
+	})
+	return res
+}
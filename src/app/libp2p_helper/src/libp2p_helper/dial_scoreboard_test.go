@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func testMultiaddrs(t *testing.T, addrs ...string) []ma.Multiaddr {
+	res := make([]ma.Multiaddr, 0, len(addrs))
+	for _, addr := range addrs {
+		a, err := ma.NewMultiaddr(addr)
+		require.NoError(t, err)
+		res = append(res, a)
+	}
+	return res
+}
+
+func TestClassifyAddr(t *testing.T) {
+	addrs := testMultiaddrs(t,
+		"/ip4/1.2.3.4/tcp/8302",
+		"/ip6/::1/udp/8302/quic",
+		"/dns4/example.com/tcp/443/wss",
+		"/ip4/1.2.3.4/tcp/8302/p2p/QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC/p2p-circuit",
+	)
+	expected := []dialClass{{"tcp", "ip4"}, {"quic", "ip6"}, {"ws", "ip4"}}
+	for i, class := range expected {
+		c, direct := classifyAddr(addrs[i])
+		require.True(t, direct)
+		require.Equal(t, class, c)
+	}
+	_, direct := classifyAddr(addrs[3])
+	require.False(t, direct)
+}
+
+func TestDialScoreboard(t *testing.T) {
+	sb := newDialScoreboard()
+	addrs := testMultiaddrs(t, "/ip4/1.2.3.4/tcp/8302", "/ip6/::1/tcp/8302")
+	ip6Only := addrs[1:]
+
+	for i := 0; i < unreachableDialAttempts; i++ {
+		require.False(t, sb.unreachable(ip6Only))
+		sb.record(addrs, nil)
+	}
+	sb.record(addrs, addrs[0])
+	require.True(t, sb.unreachable(ip6Only))
+	require.False(t, sb.unreachable(addrs))
+	// Peers without direct addresses are dialed as usual
+	require.False(t, sb.unreachable(nil))
+
+	scores := sb.Scores()
+	require.Equal(t, []dialClassScore{
+		{class: dialClass{"tcp", "ip4"}, attempts: unreachableDialAttempts + 1, successes: 1},
+		{class: dialClass{"tcp", "ip6"}, attempts: unreachableDialAttempts},
+	}, scores)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// Tag direct peers are protected from trimming by the connection manager with
+const directPeerTag = "direct-peer"
+
+// setDirectPeers protects connections to direct peers (e.g. a block
+// producer and its sentry nodes), so that they aren't trimmed by the
+// connection manager. The router exchanges gossip with direct peers
+// outside of meshes regardless of their scores and reconnects to them,
+// they're trusted by the gating along with added peers.
+func (app *app) setDirectPeers(directPeers []peer.AddrInfo) {
+	for _, p := range app.directPeers {
+		app.P2p.ConnectionManager.Unprotect(p, directPeerTag)
+	}
+	app.directPeers = make([]peer.ID, 0, len(directPeers))
+	for _, info := range directPeers {
+		if info.ID == app.P2p.Me {
+			continue
+		}
+		app.P2p.ConnectionManager.Protect(info.ID, directPeerTag)
+		app.directPeers = append(app.directPeers, info.ID)
+	}
+}
+
+// directConnectTicks converts the interval of reconnecting to direct
+// peers to heartbeats of the router, zero keeps the default (5 minutes)
+func directConnectTicks(interval time.Duration) uint64 {
+	if interval <= 0 {
+		return pubsub.GossipSubDirectConnectTicks
+	}
+	if ticks := uint64(interval / pubsub.GossipSubHeartbeatInterval); ticks > 0 {
+		return ticks
+	}
+	return 1
+}
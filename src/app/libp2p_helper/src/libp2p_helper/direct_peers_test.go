@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectConnectTicks(t *testing.T) {
+	require.Equal(t, pubsub.GossipSubDirectConnectTicks, directConnectTicks(0))
+	require.Equal(t, uint64(30), directConnectTicks(30*pubsub.GossipSubHeartbeatInterval))
+	// Reconnection is attempted at most once a heartbeat
+	require.Equal(t, uint64(1), directConnectTicks(time.Millisecond))
+}
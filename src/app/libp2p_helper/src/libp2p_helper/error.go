@@ -45,6 +45,18 @@ func needsConfigure() error {
 	return badRPC(errors.New("helper not yet configured"))
 }
 
+func rateLimited(method string) error {
+	return badRPC(fmt.Errorf("%s called more often than the admission rate allows", method))
+}
+
+func unknownRpcMethod(which uint16) error {
+	return badRPC(fmt.Errorf("rpc method %d is unknown to the helper (schema mismatch)", which))
+}
+
+func relayOnlyUnsupported(name string) error {
+	return badRPC(fmt.Errorf("%s is not supported in relay-only mode", name))
+}
+
 func needsDHT() error {
 	return badRPC(errors.New("helper not yet joined to pubsub"))
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	gonet "net"
+	"os"
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	logging "github.com/ipfs/go-log/v2"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var firehoseLogger = logging.Logger("mina.helper.firehose")
+
+// Number of marshaled messages buffered for a single firehose client,
+// messages are dropped for the client once the buffer is full
+const firehoseClientQueueSize = 256
+
+var firehoseDroppedMetric = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "Mina_libp2p_firehose_dropped_messages",
+	Help: "Number of messages not delivered to firehose clients because they were too slow",
+})
+
+// firehose delivers every gossip message received on selected topics,
+// before it's validated, to clients connected to a local unix socket.
+// It's a read-only facility for research tooling: it never blocks the
+// validation path and messages are dropped for clients that can't keep up.
+type firehose struct {
+	topics   map[string]bool
+	listener gonet.Listener
+	clients  map[gonet.Conn]chan []byte
+	mutex    sync.RWMutex
+}
+
+func startFirehose(socketPath string, topics []string) (*firehose, error) {
+	// Remove a stale socket left from the previous run
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := gonet.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	fh := &firehose{
+		topics:   make(map[string]bool),
+		listener: listener,
+		clients:  make(map[gonet.Conn]chan []byte),
+	}
+	for _, topic := range topics {
+		fh.topics[topic] = true
+	}
+	go fh.acceptLoop()
+	return fh, nil
+}
+
+func (fh *firehose) acceptLoop() {
+	for {
+		conn, err := fh.listener.Accept()
+		if err != nil {
+			// listener is closed
+			return
+		}
+		firehoseLogger.Infof("firehose client connected")
+		ch := make(chan []byte, firehoseClientQueueSize)
+		fh.mutex.Lock()
+		fh.clients[conn] = ch
+		fh.mutex.Unlock()
+		go fh.writeLoop(conn, ch)
+	}
+}
+
+func (fh *firehose) writeLoop(conn gonet.Conn, ch <-chan []byte) {
+	defer fh.dropClient(conn)
+	for bytes := range ch {
+		if _, err := conn.Write(bytes); err != nil {
+			firehoseLogger.Infof("firehose client disconnected: %s", err)
+			return
+		}
+	}
+}
+
+func (fh *firehose) dropClient(conn gonet.Conn) {
+	fh.mutex.Lock()
+	defer fh.mutex.Unlock()
+	delete(fh.clients, conn)
+	_ = conn.Close()
+}
+
+func (fh *firehose) Close() error {
+	err := fh.listener.Close()
+	fh.mutex.Lock()
+	defer fh.mutex.Unlock()
+	for conn, ch := range fh.clients {
+		close(ch)
+		delete(fh.clients, conn)
+		_ = conn.Close()
+	}
+	return err
+}
+
+// Dispatch sends message to all connected clients if the topic
+// is one of firehose topics
+func (fh *firehose) Dispatch(topic string, kind ipc.MessageKind, msg *pubsub.Message, seenAt time.Time) {
+	if !fh.topics[topic] {
+		return
+	}
+	fh.mutex.RLock()
+	defer fh.mutex.RUnlock()
+	if len(fh.clients) == 0 {
+		return
+	}
+	bytes, err := mkFirehoseMessage(topic, kind, msg, seenAt).Marshal()
+	if err != nil {
+		firehoseLogger.Errorf("failed to marshal firehose message: %s", err)
+		return
+	}
+	for _, ch := range fh.clients {
+		select {
+		case ch <- bytes:
+		default:
+			firehoseDroppedMetric.Inc()
+		}
+	}
+}
+
+func mkFirehoseMessage(topic string, kind ipc.MessageKind, msg *pubsub.Message, seenAt time.Time) *capnp.Message {
+	return mkMsg(func(seg *capnp.Segment) {
+		m, err := ipc.NewRootFirehoseMessage(seg)
+		panicOnErr(err)
+		panicOnErr(m.SetTopic(topic))
+		m.SetKind(kind)
+		author, err := m.NewAuthor()
+		panicOnErr(err)
+		if authorId, err := peer.IDFromBytes(msg.GetFrom()); err == nil {
+			panicOnErr(author.SetId(peer.Encode(authorId)))
+		}
+		receivedFrom, err := m.NewReceivedFrom()
+		panicOnErr(err)
+		panicOnErr(receivedFrom.SetId(peer.Encode(msg.ReceivedFrom)))
+		sa, err := m.NewSeenAt()
+		panicOnErr(err)
+		setNanoTime(&sa, seenAt)
+		panicOnErr(m.SetData(msg.Data))
+	})
+}
+
+func (app *app) dispatchToFirehose(topic string, kind ipc.MessageKind, msg *pubsub.Message, seenAt time.Time) {
+	app.firehoseMutex.RLock()
+	defer app.firehoseMutex.RUnlock()
+	if app.firehose != nil {
+		app.firehose.Dispatch(topic, kind, msg, seenAt)
+	}
+}
+
+// setFirehose replaces the running firehose (if any) with a new one
+// listening on socketPath, empty topics list stops the firehose
+func (app *app) setFirehose(socketPath string, topics []string) error {
+	app.firehoseMutex.Lock()
+	defer app.firehoseMutex.Unlock()
+	if app.firehose != nil {
+		if err := app.firehose.Close(); err != nil {
+			firehoseLogger.Warnf("failed to close firehose listener: %s", err)
+		}
+		app.firehose = nil
+	}
+	if len(topics) == 0 {
+		return nil
+	}
+	fh, err := startFirehose(socketPath, topics)
+	if err != nil {
+		return err
+	}
+	app.firehose = fh
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	gonet "net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirehose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	socketPath := path.Join(dir, "firehose.sock")
+	fh, err := startFirehose(socketPath, []string{"testtopic"})
+	require.NoError(t, err)
+	defer fh.Close()
+
+	conn, err := gonet.Dial("unix", socketPath)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// wait for the client to be registered
+	require.Eventually(t, func() bool {
+		fh.mutex.RLock()
+		defer fh.mutex.RUnlock()
+		return len(fh.clients) == 1
+	}, testTimeout, 10*time.Millisecond)
+
+	author := newTestKey(t)
+	authorId, err := peer.IDFromPrivateKey(author)
+	require.NoError(t, err)
+	topic := "testtopic"
+	msg := &pubsub.Message{
+		Message: &pb.Message{
+			From:  []byte(authorId),
+			Data:  []byte("testdata"),
+			Topic: &topic,
+		},
+		ReceivedFrom: authorId,
+	}
+	seenAt := time.Now()
+	fh.Dispatch("othertopic", ipc.MessageKind_unknown, msg, seenAt)
+	fh.Dispatch(topic, ipc.MessageKind_consensus, msg, seenAt)
+
+	rawMsg, err := capnp.NewDecoder(conn).Decode()
+	require.NoError(t, err)
+	m, err := ipc.ReadRootFirehoseMessage(rawMsg)
+	require.NoError(t, err)
+	actualTopic, err := m.Topic()
+	require.NoError(t, err)
+	require.Equal(t, topic, actualTopic)
+	require.Equal(t, ipc.MessageKind_consensus, m.Kind())
+	actualAuthor, err := m.Author()
+	require.NoError(t, err)
+	actualAuthorId, err := actualAuthor.Id()
+	require.NoError(t, err)
+	require.Equal(t, authorId.String(), actualAuthorId)
+	sa, err := m.SeenAt()
+	require.NoError(t, err)
+	require.Equal(t, seenAt.UnixNano(), sa.NanoSec())
+	data, err := m.Data()
+	require.NoError(t, err)
+	require.Equal(t, []byte("testdata"), data)
+}
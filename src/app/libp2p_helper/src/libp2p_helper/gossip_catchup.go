@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	logging "github.com/ipfs/go-log/v2"
+	crypto "github.com/libp2p/go-libp2p-core/crypto"
+	net "github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var gossipCatchupLogger = logging.Logger("mina.helper.gossip_catchup")
+
+const (
+	gossipCatchupProtocolID = protocol.ID("/mina/gossip-catchup/1.0.0")
+
+	defaultGossipCatchupWindow = 5 * time.Minute
+	// Time limit of a single exchange, excluding validation
+	gossipCatchupTimeout = time.Minute
+	// Connected peers waiting to be asked for missed
+	// gossip, further peers aren't asked
+	gossipCatchupQueueSize = 16
+	// Requests served concurrently at most, further ones are refused
+	maxConcurrentGossipCatchups = 4
+	// Bound of the list of message IDs sent by the requester
+	maxGossipCatchupRequestSize = 4 << 20
+	// Bound of a message sent back, leaving room for the key and signature
+	maxGossipCatchupMessageSize = maxGossipMessageSize + 1<<12
+)
+
+var gossipCatchupMessagesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "Mina_libp2p_gossip_catchup_messages",
+	Help: "Number of gossip messages served to peers catching up and recovered from them",
+}, []string{"direction"})
+
+type catchupEntry struct {
+	id      string
+	msg     *pb.Message
+	addedAt time.Time
+}
+
+// gossipCatchupCache keeps the most recent messages delivered by the
+// router (validated and our own), at most size of them, each kept for
+// the window
+type gossipCatchupCache struct {
+	size   int
+	window time.Duration
+	// oldest first
+	entries []catchupEntry
+	ids     map[string]bool
+}
+
+func (c *gossipCatchupCache) Configure(size int, window time.Duration, now time.Time) {
+	if window <= 0 {
+		window = defaultGossipCatchupWindow
+	}
+	c.size = size
+	c.window = window
+	if c.ids == nil {
+		c.ids = make(map[string]bool)
+	}
+	c.prune(now)
+}
+
+func (c *gossipCatchupCache) prune(now time.Time) {
+	drop := 0
+	for drop < len(c.entries) && (len(c.entries)-drop > c.size || now.Sub(c.entries[drop].addedAt) > c.window) {
+		delete(c.ids, c.entries[drop].id)
+		drop++
+	}
+	c.entries = c.entries[drop:]
+}
+
+func (c *gossipCatchupCache) Add(id string, msg *pb.Message, now time.Time) {
+	if c.size == 0 || c.ids[id] {
+		return
+	}
+	c.entries = append(c.entries, catchupEntry{id: id, msg: msg, addedAt: now})
+	c.ids[id] = true
+	c.prune(now)
+}
+
+func (c *gossipCatchupCache) Has(id string) bool {
+	return c.ids[id]
+}
+
+// IDs returns IDs of messages of the topics, by topic
+func (c *gossipCatchupCache) IDs(topics []string, now time.Time) map[string][]string {
+	c.prune(now)
+	res := make(map[string][]string, len(topics))
+	for _, topic := range topics {
+		res[topic] = nil
+	}
+	for _, e := range c.entries {
+		if ids, has := res[e.msg.GetTopic()]; has {
+			res[e.msg.GetTopic()] = append(ids, e.id)
+		}
+	}
+	return res
+}
+
+// Missing returns messages of topics of have, oldest
+// first, with IDs not listed for their topic
+func (c *gossipCatchupCache) Missing(have map[string]map[string]bool, now time.Time) []*pb.Message {
+	c.prune(now)
+	var res []*pb.Message
+	for _, e := range c.entries {
+		ids, has := have[e.msg.GetTopic()]
+		if has && !ids[e.id] {
+			res = append(res, e.msg)
+		}
+	}
+	return res
+}
+
+// gossipCatchup lets nodes that were briefly disconnected recover gossip
+// they missed. Upon connecting to a peer, IDs of recent messages of topics
+// subscribed to are sent to it (as IHAVE control messages), and it sends
+// back messages of its cache not listed. Recovered messages are validated
+// as if gossiped by the peer but aren't propagated by the router.
+type gossipCatchup struct {
+	noopRawTracer
+	msgId func(*pb.Message) string
+	cache gossipCatchupCache
+	now   func() time.Time
+	mutex sync.Mutex
+
+	started bool
+	queue   chan peer.ID
+	// peers queued or being asked
+	pending map[peer.ID]bool
+	serving chan struct{}
+}
+
+// Reset forgets messages of a previous router, it's
+// called before the router of the host is created
+func (g *gossipCatchup) Reset(msgId func(*pb.Message) string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.now == nil {
+		g.now = time.Now
+	}
+	g.msgId = msgId
+	g.cache.entries = nil
+	g.cache.ids = nil
+	g.cache.Configure(g.cache.size, g.cache.window, g.now())
+}
+
+// Configure sets the bound and the window of the cache,
+// zero size disables the cache and catch-up requests
+func (g *gossipCatchup) Configure(size int, window time.Duration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.now == nil {
+		g.now = time.Now
+	}
+	g.cache.Configure(size, window, g.now())
+}
+
+func readGossipCatchupConfig(cfg ipc.GossipCatchupConfig) (int, time.Duration, error) {
+	window, err := cfg.Window()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(cfg.CacheSize()), time.Duration(window.NanoSec()), nil
+}
+
+func (g *gossipCatchup) enabled() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.cache.size > 0
+}
+
+func (g *gossipCatchup) DeliverMessage(msg *pubsub.Message) {
+	g.add(msg.Message)
+}
+
+func (g *gossipCatchup) add(msg *pb.Message) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.msgId != nil {
+		g.cache.Add(g.msgId(msg), msg, g.now())
+	}
+}
+
+func (g *gossipCatchup) has(msg *pb.Message) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.msgId != nil && g.cache.Has(g.msgId(msg))
+}
+
+func (g *gossipCatchup) request(topics []string) *pb.RPC {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	rpc := &pb.RPC{Control: &pb.ControlMessage{}}
+	for topic, ids := range g.cache.IDs(topics, g.now()) {
+		topic := topic
+		rpc.Control.Ihave = append(rpc.Control.Ihave, &pb.ControlIHave{TopicID: &topic, MessageIDs: ids})
+	}
+	return rpc
+}
+
+func (g *gossipCatchup) missing(req *pb.RPC) []*pb.Message {
+	have := make(map[string]map[string]bool)
+	for _, ihave := range req.GetControl().GetIhave() {
+		ids := have[ihave.GetTopicID()]
+		if ids == nil {
+			ids = make(map[string]bool, len(ihave.GetMessageIDs()))
+			have[ihave.GetTopicID()] = ids
+		}
+		for _, id := range ihave.GetMessageIDs() {
+			ids[id] = true
+		}
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.cache.Missing(have, g.now())
+}
+
+// startGossipCatchup starts serving catch-up requests and asking
+// connected peers, it's a no-op if the catch-up is disabled
+func (app *app) startGossipCatchup() {
+	g := &app.gossipCatchup
+	if !g.enabled() {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.started {
+		return
+	}
+	g.started = true
+	g.queue = make(chan peer.ID, gossipCatchupQueueSize)
+	g.pending = make(map[peer.ID]bool)
+	g.serving = make(chan struct{}, maxConcurrentGossipCatchups)
+	app.P2p.Host.SetStreamHandler(gossipCatchupProtocolID, app.serveGossipCatchup)
+	go app.runGossipCatchup()
+}
+
+// gossipCatchupConnected queues the peer to be asked for missed gossip
+func (app *app) gossipCatchupConnected(p peer.ID) {
+	g := &app.gossipCatchup
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if !g.started || g.pending[p] {
+		return
+	}
+	select {
+	case g.queue <- p:
+		g.pending[p] = true
+	default:
+		gossipCatchupLogger.Debugf("catch-up queue is full, not asking %s", p)
+	}
+}
+
+// runGossipCatchup asks queued peers one at a time, so that messages
+// recovered from a peer aren't asked for again from the next one
+func (app *app) runGossipCatchup() {
+	g := &app.gossipCatchup
+	for {
+		select {
+		case <-app.Ctx.Done():
+			return
+		case p := <-g.queue:
+			if g.enabled() {
+				if err := app.catchUpFrom(p); err != nil {
+					gossipCatchupLogger.Debugf("gossip catch-up from %s failed: %s", p, err)
+				}
+			}
+			g.mutex.Lock()
+			delete(g.pending, p)
+			g.mutex.Unlock()
+		}
+	}
+}
+
+func (app *app) catchUpFrom(p peer.ID) error {
+	g := &app.gossipCatchup
+	req, err := g.request(app.gossipReplay.Topics()).Marshal()
+	if err != nil {
+		return err
+	}
+	if len(req) > maxGossipCatchupRequestSize {
+		return fmt.Errorf("request of %d bytes is too large", len(req))
+	}
+	msgs, err := app.exchangeGossipCatchup(p, req)
+	if err != nil {
+		return err
+	}
+	recovered := 0
+	for _, msg := range msgs {
+		validator := app.gossipReplay.Validator(msg.GetTopic())
+		if validator == nil || g.has(msg) {
+			continue
+		}
+		if err := verifyGossipSignature(msg); err != nil {
+			app.peerAudit.Record(p, ipc.Libp2pHelperInterface_PeerAuditEventKind_malformedGossip, fmt.Sprintf("%s: catch-up message: %s", msg.GetTopic(), err))
+			return err
+		}
+		res := validator(app.Ctx, p, &pubsub.Message{Message: msg, ReceivedFrom: p})
+		if res == pubsub.ValidationAccept {
+			g.add(msg)
+			recovered++
+		}
+	}
+	if recovered > 0 {
+		gossipCatchupLogger.Infof("recovered %d missed messages from %s", recovered, p)
+		gossipCatchupMessagesMetric.WithLabelValues("recovered").Add(float64(recovered))
+	}
+	return nil
+}
+
+// exchangeGossipCatchup sends the request to the peer and reads messages
+// it sends back, up to the bound of the cache
+func (app *app) exchangeGossipCatchup(p peer.ID, req []byte) ([]*pb.Message, error) {
+	ctx, cancel := context.WithTimeout(app.Ctx, gossipCatchupTimeout)
+	defer cancel()
+	s, err := app.P2p.Host.NewStream(ctx, p, gossipCatchupProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	_ = s.SetDeadline(time.Now().Add(gossipCatchupTimeout))
+	if err := writeDelimited(s, req); err != nil {
+		_ = s.Reset()
+		return nil, err
+	}
+	if err := s.CloseWrite(); err != nil {
+		_ = s.Reset()
+		return nil, err
+	}
+	app.gossipCatchup.mutex.Lock()
+	limit := app.gossipCatchup.cache.size
+	app.gossipCatchup.mutex.Unlock()
+	r := bufio.NewReader(s)
+	var msgs []*pb.Message
+	for len(msgs) < limit {
+		bytes, err := readDelimited(r, maxGossipCatchupMessageSize)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			_ = s.Reset()
+			return nil, err
+		}
+		msg := new(pb.Message)
+		if err := msg.Unmarshal(bytes); err != nil {
+			_ = s.Reset()
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (app *app) serveGossipCatchup(s net.Stream) {
+	defer func() {
+		_ = s.Close()
+	}()
+	g := &app.gossipCatchup
+	select {
+	case g.serving <- struct{}{}:
+		defer func() { <-g.serving }()
+	default:
+		_ = s.Reset()
+		return
+	}
+	_ = s.SetDeadline(time.Now().Add(gossipCatchupTimeout))
+	p := s.Conn().RemotePeer()
+	bytes, err := readDelimited(bufio.NewReader(s), maxGossipCatchupRequestSize)
+	if err != nil {
+		gossipCatchupLogger.Debugf("failed to read catch-up request of %s: %s", p, err)
+		_ = s.Reset()
+		return
+	}
+	req := new(pb.RPC)
+	if err := req.Unmarshal(bytes); err != nil {
+		gossipCatchupLogger.Debugf("malformed catch-up request of %s: %s", p, err)
+		_ = s.Reset()
+		return
+	}
+	w := bufio.NewWriter(s)
+	msgs := g.missing(req)
+	for _, msg := range msgs {
+		bytes, err := msg.Marshal()
+		if err == nil {
+			err = writeDelimited(w, bytes)
+		}
+		if err != nil {
+			gossipCatchupLogger.Debugf("failed to serve catch-up of %s: %s", p, err)
+			_ = s.Reset()
+			return
+		}
+	}
+	if err := w.Flush(); err != nil {
+		gossipCatchupLogger.Debugf("failed to serve catch-up of %s: %s", p, err)
+		_ = s.Reset()
+		return
+	}
+	if len(msgs) > 0 {
+		gossipCatchupLogger.Debugf("served %d missed messages to %s", len(msgs), p)
+		gossipCatchupMessagesMetric.WithLabelValues("served").Add(float64(len(msgs)))
+	}
+}
+
+// Messages of the exchange are prefixed with their length as uvarint
+
+func writeDelimited(w io.Writer, data []byte) error {
+	var prefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(len(data)))
+	if _, err := w.Write(prefix[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readDelimited returns io.EOF only if r ends before a message
+func readDelimited(r *bufio.Reader, maxSize int) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(maxSize) {
+		return nil, fmt.Errorf("message of %d bytes exceeds the limit of %d", size, maxSize)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// verifyGossipSignature checks the signature of the message by its
+// author as the router does for gossip it receives (pubsub's own
+// check isn't exported)
+func verifyGossipSignature(m *pb.Message) error {
+	if len(m.Signature) == 0 {
+		return errors.New("message isn't signed")
+	}
+	author, err := peer.IDFromBytes(m.From)
+	if err != nil {
+		return err
+	}
+	var pubk crypto.PubKey
+	if m.Key == nil {
+		pubk, err = author.ExtractPublicKey()
+	} else {
+		pubk, err = crypto.UnmarshalPublicKey(m.Key)
+		if err == nil && !author.MatchesPublicKey(pubk) {
+			err = errors.New("key doesn't match the author")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if pubk == nil {
+		return errors.New("author's key is unknown")
+	}
+	xm := *m
+	xm.Signature = nil
+	xm.Key = nil
+	bytes, err := xm.Marshal()
+	if err != nil {
+		return err
+	}
+	valid, err := pubk.Verify(append([]byte(pubsub.SignPrefix), bytes...), m.Signature)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
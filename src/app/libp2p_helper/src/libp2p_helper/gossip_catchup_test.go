@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	crypto "github.com/libp2p/go-libp2p-core/crypto"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/stretchr/testify/require"
+)
+
+func mkTestCatchupMessage(topic string, data string) *pb.Message {
+	return &pb.Message{Data: []byte(data), Topic: &topic}
+}
+
+func testCatchupMsgId(m *pb.Message) string {
+	return m.GetTopic() + "/" + string(m.Data)
+}
+
+func TestGossipCatchupCache(t *testing.T) {
+	now := time.Now()
+	var c gossipCatchupCache
+	c.Configure(3, time.Minute, now)
+	for _, data := range []string{"1", "2", "3", "4"} {
+		msg := mkTestCatchupMessage("a", data)
+		c.Add(testCatchupMsgId(msg), msg, now)
+	}
+	c.Add("b/1", mkTestCatchupMessage("b", "1"), now.Add(time.Second))
+	// The oldest messages are dropped beyond the size
+	require.False(t, c.Has("a/1"))
+	require.False(t, c.Has("a/2"))
+	require.Equal(t, map[string][]string{"a": {"a/3", "a/4"}, "c": nil}, c.IDs([]string{"a", "c"}, now))
+
+	// Messages are dropped after the window
+	require.Equal(t, map[string][]string{"a": nil, "b": {"b/1"}}, c.IDs([]string{"a", "b"}, now.Add(time.Minute+time.Millisecond)))
+}
+
+func TestGossipCatchupExchange(t *testing.T) {
+	var requester, server gossipCatchup
+	requester.Configure(10, 0)
+	requester.Reset(testCatchupMsgId)
+	server.Configure(10, 0)
+	server.Reset(testCatchupMsgId)
+
+	for _, m := range []*pb.Message{
+		mkTestCatchupMessage("a", "1"),
+		mkTestCatchupMessage("a", "2"),
+		mkTestCatchupMessage("b", "1"),
+		mkTestCatchupMessage("c", "1"),
+	} {
+		server.DeliverMessage(&pubsub.Message{Message: m})
+	}
+	requester.DeliverMessage(&pubsub.Message{Message: mkTestCatchupMessage("a", "1")})
+
+	// Only messages of topics of the requester it doesn't have are sent back
+	missing := server.missing(requester.request([]string{"a", "b"}))
+	require.Equal(t, []*pb.Message{mkTestCatchupMessage("a", "2"), mkTestCatchupMessage("b", "1")}, missing)
+	require.True(t, requester.has(mkTestCatchupMessage("a", "1")))
+	require.False(t, requester.has(mkTestCatchupMessage("a", "2")))
+
+	// Disabled cache keeps nothing
+	var disabled gossipCatchup
+	disabled.Reset(testCatchupMsgId)
+	disabled.DeliverMessage(&pubsub.Message{Message: mkTestCatchupMessage("a", "1")})
+	require.False(t, disabled.enabled())
+	require.False(t, disabled.has(mkTestCatchupMessage("a", "1")))
+}
+
+func TestDelimitedMessages(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeDelimited(&buf, []byte("first")))
+	require.NoError(t, writeDelimited(&buf, nil))
+	require.NoError(t, writeDelimited(&buf, []byte("too large")))
+	r := bufio.NewReader(&buf)
+	data, err := readDelimited(r, 5)
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), data)
+	data, err = readDelimited(r, 5)
+	require.NoError(t, err)
+	require.Empty(t, data)
+	_, err = readDelimited(r, 5)
+	require.Error(t, err)
+
+	_, err = readDelimited(bufio.NewReader(&buf), 5)
+	require.Equal(t, io.EOF, err)
+	buf.Write([]byte{3, 'a'})
+	_, err = readDelimited(bufio.NewReader(&buf), 5)
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestVerifyGossipSignature(t *testing.T) {
+	key := newTestKey(t)
+	author, err := peer.IDFromPrivateKey(key)
+	require.NoError(t, err)
+	msg := mkTestCatchupMessage("a", "1")
+	msg.From = []byte(author)
+	require.Error(t, verifyGossipSignature(msg))
+
+	data, err := msg.Marshal()
+	require.NoError(t, err)
+	msg.Signature, err = key.Sign(append([]byte(pubsub.SignPrefix), data...))
+	require.NoError(t, err)
+	require.NoError(t, verifyGossipSignature(msg))
+
+	// Keys not matching the author are refused
+	other := newTestKey(t)
+	msg.Key, err = crypto.MarshalPublicKey(other.GetPublic())
+	require.NoError(t, err)
+	require.Error(t, verifyGossipSignature(msg))
+
+	msg.Key = nil
+	msg.Data = []byte("2")
+	require.Error(t, verifyGossipSignature(msg))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Envelope of compressed gossip: the marker followed by a zstd frame of
+// the payload. Payloads without the marker are passed as they are, so
+// peers not compressing their messages are still understood. The last
+// byte of the marker is the version of the envelope.
+var gossipEnvelopeMarker = []byte{0xff, 'm', 'z', 0x01}
+
+var gossipCompressedBytesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "Mina_libp2p_gossip_compressed_bytes",
+	Help: "Bytes of gossip payloads compressed (by the payload size before and after compression), published and received",
+}, []string{"direction", "size"})
+
+var gossipEncoder, gossipDecoder = newGossipCodec()
+
+func newGossipCodec() (*zstd.Encoder, *zstd.Decoder) {
+	enc, err := zstd.NewWriter(nil)
+	panicOnErr(err)
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxGossipMessageSize))
+	panicOnErr(err)
+	return enc, dec
+}
+
+// encodeGossip compresses the payload into the envelope, payloads
+// that don't shrink are left as they are
+func encodeGossip(data []byte) []byte {
+	res := gossipEncoder.EncodeAll(data, append([]byte{}, gossipEnvelopeMarker...))
+	if len(res) >= len(data) {
+		return data
+	}
+	gossipCompressedBytesMetric.WithLabelValues("published", "raw").Add(float64(len(data)))
+	gossipCompressedBytesMetric.WithLabelValues("published", "compressed").Add(float64(len(res)))
+	return res
+}
+
+// decodeGossip returns the payload of the envelope, payloads not in
+// the envelope are returned as they are
+func decodeGossip(data []byte, maxSize int) ([]byte, error) {
+	if !bytes.HasPrefix(data, gossipEnvelopeMarker) {
+		return data, nil
+	}
+	res, err := gossipDecoder.DecodeAll(data[len(gossipEnvelopeMarker):], nil)
+	if err != nil {
+		return nil, fmt.Errorf("malformed compressed payload: %w", err)
+	}
+	if len(res) > maxSize {
+		return nil, fmt.Errorf("payload of %d bytes decompressed to %d bytes, above %d", len(data), len(res), maxSize)
+	}
+	gossipCompressedBytesMetric.WithLabelValues("received", "raw").Add(float64(len(res)))
+	gossipCompressedBytesMetric.WithLabelValues("received", "compressed").Add(float64(len(data)))
+	return res, nil
+}
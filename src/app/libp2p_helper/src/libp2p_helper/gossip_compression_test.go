@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGossipCompression(t *testing.T) {
+	block := bytes.Repeat([]byte("block"), 1000)
+	encoded := encodeGossip(block)
+	require.Less(t, len(encoded), len(block))
+	require.True(t, bytes.HasPrefix(encoded, gossipEnvelopeMarker))
+	decoded, err := decodeGossip(encoded, maxGossipMessageSize)
+	require.NoError(t, err)
+	require.Equal(t, block, decoded)
+
+	// Payloads of peers not compressing are passed as they are
+	decoded, err = decodeGossip(block, maxGossipMessageSize)
+	require.NoError(t, err)
+	require.Equal(t, block, decoded)
+
+	// Payloads that don't shrink are published as they are
+	random := make([]byte, 100)
+	_, err = rand.Read(random)
+	require.NoError(t, err)
+	require.Equal(t, random, encodeGossip(random))
+
+	// Size of the topic bounds decompressed payloads
+	_, err = decodeGossip(encoded, len(block)-1)
+	require.Error(t, err)
+
+	_, err = decodeGossip(append(append([]byte{}, gossipEnvelopeMarker...), "junk"...), maxGossipMessageSize)
+	require.Error(t, err)
+}
+
+func TestTopicCompression(t *testing.T) {
+	r := newTopicRegistry()
+	require.False(t, r.Compressed(consensusTopic))
+	r.SetCompression(consensusTopic, true)
+	require.True(t, r.Compressed(consensusTopic))
+	require.False(t, r.Compressed("othertopic"))
+	r.SetCompression(consensusTopic, false)
+	require.False(t, r.Compressed(consensusTopic))
+}
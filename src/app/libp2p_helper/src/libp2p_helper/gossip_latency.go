@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Latencies range from milliseconds of quick verdicts
+// to the tens of seconds of block validation timeouts
+var gossipLatencyBuckets = prometheus.ExponentialBuckets(0.005, 2, 14)
+
+var gossipVerdictLatencyMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "Mina_libp2p_gossip_verdict_latency_seconds",
+	Help:    "Time from the first receipt of a gossip message to the validation verdict of the daemon",
+	Buckets: gossipLatencyBuckets,
+}, []string{"topic", "result"})
+
+var gossipRebroadcastLatencyMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "Mina_libp2p_gossip_rebroadcast_latency_seconds",
+	Help:    "Time from the first receipt of a gossip message to it being sent on to the first peer",
+	Buckets: gossipLatencyBuckets,
+}, []string{"topic"})
+
+// Accepted messages not sent on within this time (e.g. for
+// lack of peers in the mesh) are no longer waited for
+const gossipRebroadcastTimeout = 2 * time.Minute
+
+type pendingRebroadcast struct {
+	topic  string
+	seenAt time.Time
+}
+
+// gossipLatencyTracer measures how long gossip waits for verdicts of
+// the daemon before it propagates. Messages accepted by the daemon
+// are waited for in RPCs sent by the router, the first one carrying
+// the message marks its rebroadcast.
+type gossipLatencyTracer struct {
+	noopRawTracer
+	msgId   func(*pb.Message) string
+	pending map[string]pendingRebroadcast
+	// timed out messages are swept at most once per timeout
+	lastSweep time.Time
+	now       func() time.Time
+	mutex     sync.Mutex
+}
+
+// Reset forgets messages of a previous router, it's
+// called before the router of the host is created
+func (t *gossipLatencyTracer) Reset(msgId func(*pb.Message) string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.msgId = msgId
+	t.pending = make(map[string]pendingRebroadcast)
+	if t.now == nil {
+		t.now = time.Now
+	}
+	t.lastSweep = t.now()
+}
+
+// Verdict observes the verdict of the daemon on the message first
+// received at seenAt, accepted messages are waited for to be sent on
+func (t *gossipLatencyTracer) Verdict(topic string, msg *pubsub.Message, seenAt time.Time, res pubsub.ValidationResult) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.msgId == nil {
+		return
+	}
+	now := t.now()
+	gossipVerdictLatencyMetric.WithLabelValues(topic, validationResultLabel(res)).Observe(now.Sub(seenAt).Seconds())
+	if res != pubsub.ValidationAccept {
+		return
+	}
+	if now.Sub(t.lastSweep) > gossipRebroadcastTimeout {
+		for id, p := range t.pending {
+			if now.Sub(p.seenAt) > gossipRebroadcastTimeout {
+				delete(t.pending, id)
+			}
+		}
+		t.lastSweep = now
+	}
+	t.pending[t.msgId(msg.Message)] = pendingRebroadcast{topic: topic, seenAt: seenAt}
+}
+
+func (t *gossipLatencyTracer) SendRPC(rpc *pubsub.RPC, _ peer.ID) {
+	msgs := rpc.GetPublish()
+	if len(msgs) == 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.pending) == 0 {
+		return
+	}
+	now := t.now()
+	for _, msg := range msgs {
+		id := t.msgId(msg)
+		if p, has := t.pending[id]; has {
+			gossipRebroadcastLatencyMetric.WithLabelValues(p.topic).Observe(now.Sub(p.seenAt).Seconds())
+			delete(t.pending, id)
+		}
+	}
+}
+
+func validationResultLabel(res pubsub.ValidationResult) string {
+	switch res {
+	case pubsub.ValidationAccept:
+		return "accept"
+	case pubsub.ValidationReject:
+		return "reject"
+	default:
+		return "ignore"
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func histogramSamples(t *testing.T, o prometheus.Observer) (uint64, float64) {
+	var m dto.Metric
+	require.NoError(t, o.(prometheus.Metric).Write(&m))
+	return m.Histogram.GetSampleCount(), m.Histogram.GetSampleSum()
+}
+
+func TestGossipLatencyTracer(t *testing.T) {
+	topic := "gossip-latency-test"
+	var tr gossipLatencyTracer
+	now := time.Now()
+	tr.now = func() time.Time { return now }
+	tr.Reset(func(m *pb.Message) string { return string(m.Data) })
+	mkMsg := func(data string) *pubsub.Message {
+		return &pubsub.Message{Message: &pb.Message{Data: []byte(data), Topic: &topic}}
+	}
+	accepted := gossipVerdictLatencyMetric.WithLabelValues(topic, "accept")
+	rejected := gossipVerdictLatencyMetric.WithLabelValues(topic, "reject")
+	rebroadcast := gossipRebroadcastLatencyMetric.WithLabelValues(topic)
+
+	seenAt := now
+	now = now.Add(2 * time.Second)
+	tr.Verdict(topic, mkMsg("a"), seenAt, pubsub.ValidationAccept)
+	tr.Verdict(topic, mkMsg("b"), seenAt, pubsub.ValidationReject)
+	count, sum := histogramSamples(t, accepted)
+	require.Equal(t, uint64(1), count)
+	require.Equal(t, 2.0, sum)
+	count, _ = histogramSamples(t, rejected)
+	require.Equal(t, uint64(1), count)
+
+	// The first RPC carrying an accepted message marks its rebroadcast
+	now = now.Add(time.Second)
+	rpc := &pubsub.RPC{RPC: pb.RPC{Publish: []*pb.Message{mkMsg("a").Message, mkMsg("b").Message}}}
+	tr.SendRPC(rpc, peer.ID("p1"))
+	now = now.Add(time.Second)
+	tr.SendRPC(rpc, peer.ID("p2"))
+	count, sum = histogramSamples(t, rebroadcast)
+	require.Equal(t, uint64(1), count)
+	require.Equal(t, 3.0, sum)
+
+	// Messages not sent on within the timeout are forgotten
+	tr.Verdict(topic, mkMsg("c"), now, pubsub.ValidationAccept)
+	now = now.Add(gossipRebroadcastTimeout + time.Second)
+	tr.Verdict(topic, mkMsg("d"), now, pubsub.ValidationAccept)
+	require.NotContains(t, tr.pending, "c")
+	require.Contains(t, tr.pending, "d")
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	logging "github.com/ipfs/go-log/v2"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var gossipReplayLogger = logging.Logger("mina.helper.gossip_replay")
+
+// Number of received messages buffered for the record
+// file, messages are dropped once the buffer is full
+const gossipRecordQueueSize = 4096
+
+var gossipRecordDroppedMetric = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "Mina_libp2p_gossip_record_dropped_messages",
+	Help: "Number of received gossip messages not written to the record file because it was too slow",
+})
+
+// gossipValidator is the validator of a topic registered with pubsub
+type gossipValidator = func(context.Context, peer.ID, *pubsub.Message) pubsub.ValidationResult
+
+// gossipRecorder appends gossip received by validators to the record
+// file set by setGossipRecord. Records are FirehoseMessage structs
+// framed as IPC messages, with payloads as received.
+type gossipRecorder struct {
+	file  *gossipRecordFile
+	mutex sync.RWMutex
+}
+
+func (r *gossipRecorder) Record(topic string, kind ipc.MessageKind, msg *pubsub.Message, seenAt time.Time) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.file != nil {
+		r.file.Record(mkFirehoseMessage(topic, kind, msg, seenAt))
+	}
+}
+
+// Set replaces the record file, the previous one is closed
+func (r *gossipRecorder) Set(file *gossipRecordFile) {
+	r.mutex.Lock()
+	old := r.file
+	r.file = file
+	r.mutex.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+type gossipRecordFile struct {
+	path    string
+	records chan *capnp.Message
+	done    chan struct{}
+}
+
+func openGossipRecordFile(path string) (*gossipRecordFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	rf := &gossipRecordFile{
+		path:    path,
+		records: make(chan *capnp.Message, gossipRecordQueueSize),
+		done:    make(chan struct{}),
+	}
+	go rf.writeLoop(f)
+	return rf, nil
+}
+
+func (rf *gossipRecordFile) Record(msg *capnp.Message) {
+	select {
+	case rf.records <- msg:
+	default:
+		gossipRecordDroppedMetric.Inc()
+	}
+}
+
+// Close waits for buffered records to be written
+func (rf *gossipRecordFile) Close() {
+	close(rf.records)
+	<-rf.done
+}
+
+func (rf *gossipRecordFile) writeLoop(f *os.File) {
+	defer close(rf.done)
+	w := bufio.NewWriter(f)
+	for msg := range rf.records {
+		if f == nil {
+			// writing failed, records are discarded until closed
+			continue
+		}
+		bytes, err := msg.Marshal()
+		if err == nil {
+			_, err = w.Write(bytes)
+		}
+		if err != nil {
+			gossipReplayLogger.Errorf("failed to write gossip record %s, recording stopped: %s", rf.path, err)
+			_ = f.Close()
+			f = nil
+			continue
+		}
+		if len(rf.records) == 0 {
+			if err := w.Flush(); err != nil {
+				gossipReplayLogger.Warnf("failed to flush gossip record %s: %s", rf.path, err)
+			}
+		}
+	}
+	if f != nil {
+		if err := w.Flush(); err != nil {
+			gossipReplayLogger.Warnf("failed to flush gossip record %s: %s", rf.path, err)
+		}
+		_ = f.Close()
+	}
+}
+
+// replayedGossip marks messages re-injected by a replay in
+// their ValidatorData, validators neither record them nor
+// answer them from the validation cache
+type replayedGossip struct{}
+
+func isReplayedGossip(msg *pubsub.Message) bool {
+	_, replayed := msg.ValidatorData.(replayedGossip)
+	return replayed
+}
+
+// gossipReplayer keeps validators of topics subscribed to, records
+// are re-injected through them one at a time, in order of the record
+type gossipReplayer struct {
+	validators map[string]gossipValidator
+	running    bool
+	mutex      sync.Mutex
+}
+
+func (r *gossipReplayer) SetValidator(topic string, validator gossipValidator) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.validators == nil {
+		r.validators = make(map[string]gossipValidator)
+	}
+	r.validators[topic] = validator
+}
+
+func (r *gossipReplayer) Validator(topic string) gossipValidator {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.validators[topic]
+}
+
+// Topics returns topics with validators, i.e. subscribed to
+func (r *gossipReplayer) Topics() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	topics := make([]string, 0, len(r.validators))
+	for topic := range r.validators {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// Start returns false if a replay is running already
+func (r *gossipReplayer) Start() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.running {
+		return false
+	}
+	r.running = true
+	return true
+}
+
+func (r *gossipReplayer) Done() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.running = false
+}
+
+type gossipReplayStats struct {
+	// records of topics not subscribed to are skipped
+	replayed, skipped           uint64
+	accepted, rejected, ignored uint64
+}
+
+// readGossipRecord calls f with records of the record
+// file in order, until f fails or the file ends
+func readGossipRecord(r io.Reader, f func(ipc.FirehoseMessage) error) error {
+	decoder := capnp.NewDecoder(bufio.NewReader(r))
+	for {
+		msg, err := decoder.Decode()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rec, err := ipc.ReadRootFirehoseMessage(msg)
+		if err != nil {
+			return err
+		}
+		if err := f(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// replayGossip re-injects records of the file through validators of
+// their topics, waiting for verdicts one at a time. Paced replay keeps
+// the intervals between records, others are replayed at once.
+func (app *app) replayGossip(path string, paced bool) (stats gossipReplayStats, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return stats, err
+	}
+	defer f.Close()
+	var lastSeenAt time.Time
+	err = readGossipRecord(f, func(rec ipc.FirehoseMessage) error {
+		topic, err := rec.Topic()
+		if err != nil {
+			return err
+		}
+		data, err := rec.Data()
+		if err != nil {
+			return err
+		}
+		sa, err := rec.SeenAt()
+		if err != nil {
+			return err
+		}
+		seenAt := time.Unix(0, sa.NanoSec())
+		var author, receivedFrom peer.ID
+		if pid, err := rec.Author(); err == nil {
+			if id, err := pid.Id(); err == nil && id != "" {
+				author, _ = peer.Decode(id)
+			}
+		}
+		if pid, err := rec.ReceivedFrom(); err == nil {
+			if id, err := pid.Id(); err == nil {
+				receivedFrom, _ = peer.Decode(id)
+			}
+		}
+		if paced && !lastSeenAt.IsZero() && seenAt.After(lastSeenAt) {
+			select {
+			case <-app.Ctx.Done():
+			case <-time.After(seenAt.Sub(lastSeenAt)):
+			}
+		}
+		lastSeenAt = seenAt
+		if app.Ctx.Err() != nil {
+			return app.Ctx.Err()
+		}
+		validator := app.gossipReplay.Validator(topic)
+		if validator == nil {
+			stats.skipped++
+			return nil
+		}
+		msg := &pubsub.Message{
+			Message:       &pb.Message{From: []byte(author), Data: data, Topic: &topic},
+			ReceivedFrom:  receivedFrom,
+			ValidatorData: replayedGossip{},
+		}
+		stats.replayed++
+		switch validator(app.Ctx, receivedFrom, msg) {
+		case pubsub.ValidationAccept:
+			stats.accepted++
+		case pubsub.ValidationReject:
+			stats.rejected++
+		default:
+			stats.ignored++
+		}
+		return nil
+	})
+	return stats, err
+}
+
+func mkGossipReplayedUpcall(path string, stats gossipReplayStats, replayErr error) *capnp.Message {
+	return mkPushMsg(func(m ipc.DaemonInterface_PushMessage) {
+		im, err := m.NewGossipReplayed()
+		panicOnErr(err)
+		panicOnErr(im.SetPath(path))
+		im.SetReplayed(stats.replayed)
+		im.SetSkipped(stats.skipped)
+		im.SetAccepted(stats.accepted)
+		im.SetRejected(stats.rejected)
+		im.SetIgnored(stats.ignored)
+		if replayErr != nil {
+			panicOnErr(im.SetError(replayErr.Error()))
+		}
+	})
+}
+
+type SetGossipRecordReqT = ipc.Libp2pHelperInterface_SetGossipRecord_Request
+type SetGossipRecordReq SetGossipRecordReqT
+
+func fromSetGossipRecordReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.SetGossipRecord()
+	return SetGossipRecordReq(i), err
+}
+
+func (m SetGossipRecordReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	path, err := SetGossipRecordReqT(m).Path()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	var file *gossipRecordFile
+	if path != "" {
+		file, err = openGossipRecordFile(path)
+		if err != nil {
+			return mkRpcRespError(seqno, badHelper(err))
+		}
+		gossipReplayLogger.Infof("recording received gossip to %s", path)
+	} else {
+		gossipReplayLogger.Info("recording of received gossip stopped")
+	}
+	app.gossipRecord.Set(file)
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewSetGossipRecord()
+		panicOnErr(err)
+	})
+}
+
+type ReplayGossipReqT = ipc.Libp2pHelperInterface_ReplayGossip_Request
+type ReplayGossipReq ReplayGossipReqT
+
+func fromReplayGossipReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.ReplayGossip()
+	return ReplayGossipReq(i), err
+}
+
+func (m ReplayGossipReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	path, err := ReplayGossipReqT(m).Path()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	if path == "" {
+		return mkRpcRespError(seqno, badRPC(errors.New("empty path")))
+	}
+	if _, err := os.Stat(path); err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	if !app.gossipReplay.Start() {
+		return mkRpcRespError(seqno, badRPC(errors.New("gossip is being replayed already")))
+	}
+	paced := ReplayGossipReqT(m).Paced()
+	go func() {
+		defer app.gossipReplay.Done()
+		stats, err := app.replayGossip(path, paced)
+		if err != nil {
+			gossipReplayLogger.Errorf("replay of %s failed after %d messages: %s", path, stats.replayed, err)
+		} else {
+			gossipReplayLogger.Infof("replayed %d messages of %s (%d skipped): %d accepted, %d rejected, %d ignored",
+				stats.replayed, path, stats.skipped, stats.accepted, stats.rejected, stats.ignored)
+		}
+		app.writeMsg(mkGossipReplayedUpcall(path, stats, err))
+	}()
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewReplayGossip()
+		panicOnErr(err)
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGossipReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	recordPath := path.Join(dir, "gossip.rec")
+
+	testApp, _ := newTestApp(t, nil, true)
+	author, err := peer.IDFromPrivateKey(newTestKey(t))
+	require.NoError(t, err)
+	sender, err := peer.IDFromPrivateKey(newTestKey(t))
+	require.NoError(t, err)
+	record := func(topic string, data string) {
+		msg := &pubsub.Message{
+			Message:      &pb.Message{From: []byte(author), Data: []byte(data), Topic: &topic},
+			ReceivedFrom: sender,
+		}
+		testApp.gossipRecord.Record(topic, ipc.MessageKind_unknown, msg, time.Now())
+	}
+
+	rf, err := openGossipRecordFile(recordPath)
+	require.NoError(t, err)
+	testApp.gossipRecord.Set(rf)
+	record("a", "1")
+	record("b", "2")
+	record("a", "3")
+	testApp.gossipRecord.Set(nil)
+	// Records are appended to an existing file
+	rf, err = openGossipRecordFile(recordPath)
+	require.NoError(t, err)
+	testApp.gossipRecord.Set(rf)
+	record("a", "4")
+	testApp.gossipRecord.Set(nil)
+
+	var replayed []string
+	testApp.gossipReplay.SetValidator("a", func(_ context.Context, id peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		require.Equal(t, sender, id)
+		require.Equal(t, author, peer.ID(msg.GetFrom()))
+		require.True(t, isReplayedGossip(msg))
+		replayed = append(replayed, string(msg.Data))
+		if string(msg.Data) == "3" {
+			return pubsub.ValidationReject
+		}
+		return pubsub.ValidationAccept
+	})
+	stats, err := testApp.replayGossip(recordPath, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "3", "4"}, replayed)
+	require.Equal(t, gossipReplayStats{replayed: 3, skipped: 1, accepted: 2, rejected: 1}, stats)
+
+	// Truncated records fail the replay
+	data, err := ioutil.ReadFile(recordPath)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(recordPath, data[:len(data)-1], 0644))
+	replayed = nil
+	_, err = testApp.replayGossip(recordPath, false)
+	require.Error(t, err)
+	require.Equal(t, []string{"1", "3"}, replayed)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// Counters of topic deliveries decay to about a minute's worth
+var gossipScoreCounterDecay = pubsub.ScoreParameterDecay(time.Minute)
+
+// neutralTopicScoreParams make the router count deliveries of messages
+// of the topic by peers, without weighing them in scores of peers
+func neutralTopicScoreParams() *pubsub.TopicScoreParams {
+	return &pubsub.TopicScoreParams{
+		TimeInMeshQuantum:             time.Second,
+		FirstMessageDeliveriesDecay:   gossipScoreCounterDecay,
+		FirstMessageDeliveriesCap:     math.MaxFloat64,
+		MeshMessageDeliveriesDecay:    gossipScoreCounterDecay,
+		MeshMessageDeliveriesCap:      math.MaxFloat64,
+		InvalidMessageDeliveriesDecay: gossipScoreCounterDecay,
+	}
+}
+
+// gossipScores keeps snapshots of gossipsub scores of peers as of
+// the last inspection by the router, inspected once a second
+type gossipScores struct {
+	snapshots map[peer.ID]*pubsub.PeerScoreSnapshot
+	mutex     sync.RWMutex
+}
+
+// Inspect is the peer score inspector of the router
+func (s *gossipScores) Inspect(snapshots map[peer.ID]*pubsub.PeerScoreSnapshot) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.snapshots = snapshots
+}
+
+// Score returns the score of the peer, zero for peers not scored
+func (s *gossipScores) Score(p peer.ID) float64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if snapshot, has := s.snapshots[p]; has {
+		return snapshot.Score
+	}
+	return 0
+}
+
+// Snapshots returns the snapshots of the last inspection, the router
+// creates them anew on each inspection so they aren't copied
+func (s *gossipScores) Snapshots() map[peer.ID]*pubsub.PeerScoreSnapshot {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.snapshots
+}
+
+// reportGossipScores periodically sends score breakdowns of peers to
+// the daemon, for its trust system to combine them with its own
+func (app *app) reportGossipScores(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-app.Ctx.Done():
+			return
+		case <-ticker.C:
+			if app.inMaintenance() {
+				continue
+			}
+			snapshots := app.gossipScores.Snapshots()
+			if len(snapshots) > 0 {
+				app.writeMsg(mkGossipScoresUpcall(snapshots))
+			}
+		}
+	}
+}
+
+func mkGossipScoresUpcall(snapshots map[peer.ID]*pubsub.PeerScoreSnapshot) *capnp.Message {
+	peers := make([]peer.ID, 0, len(snapshots))
+	for p := range snapshots {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+	return mkPushMsg(func(m ipc.DaemonInterface_PushMessage) {
+		im, err := m.NewGossipScores()
+		panicOnErr(err)
+		mPeers, err := im.NewPeers(int32(len(peers)))
+		panicOnErr(err)
+		for i, p := range peers {
+			snapshot := snapshots[p]
+			mp := mPeers.At(i)
+			pid, err := mp.NewPeerId()
+			panicOnErr(err)
+			panicOnErr(pid.SetId(peer.Encode(p)))
+			mp.SetScore(snapshot.Score)
+			mp.SetAppSpecificScore(snapshot.AppSpecificScore)
+			mp.SetIpColocationFactor(snapshot.IPColocationFactor)
+			mp.SetBehaviourPenalty(snapshot.BehaviourPenalty)
+			topics := make([]string, 0, len(snapshot.Topics))
+			for topic := range snapshot.Topics {
+				topics = append(topics, topic)
+			}
+			sort.Strings(topics)
+			mTopics, err := mp.NewTopics(int32(len(topics)))
+			panicOnErr(err)
+			for j, topic := range topics {
+				ts := snapshot.Topics[topic]
+				mt := mTopics.At(j)
+				panicOnErr(mt.SetTopic(topic))
+				timeInMesh, err := mt.NewTimeInMesh()
+				panicOnErr(err)
+				timeInMesh.SetNanoSec(uint64(ts.TimeInMesh.Nanoseconds()))
+				mt.SetFirstMessageDeliveries(ts.FirstMessageDeliveries)
+				mt.SetMeshMessageDeliveries(ts.MeshMessageDeliveries)
+				mt.SetInvalidMessageDeliveries(ts.InvalidMessageDeliveries)
+			}
+		}
+	})
+}
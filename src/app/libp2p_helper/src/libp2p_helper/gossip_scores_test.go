@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGossipScores(t *testing.T) {
+	var s gossipScores
+	require.Zero(t, s.Score(peer.ID("a")))
+	s.Inspect(map[peer.ID]*pubsub.PeerScoreSnapshot{peer.ID("a"): {Score: -3}})
+	require.Equal(t, -3.0, s.Score(peer.ID("a")))
+	require.Zero(t, s.Score(peer.ID("b")))
+}
+
+func TestGossipScoresUpcall(t *testing.T) {
+	pid, err := peer.IDFromPrivateKey(newTestKey(t))
+	require.NoError(t, err)
+	snapshots := map[peer.ID]*pubsub.PeerScoreSnapshot{
+		pid: {
+			Score:              -10,
+			AppSpecificScore:   -2,
+			IPColocationFactor: 1,
+			BehaviourPenalty:   4,
+			Topics: map[string]*pubsub.TopicScoreSnapshot{
+				consensusTopic: {
+					TimeInMesh:               time.Minute,
+					FirstMessageDeliveries:   5,
+					MeshMessageDeliveries:    7,
+					InvalidMessageDeliveries: 1,
+				},
+			},
+		},
+	}
+
+	imsg, err := ipc.ReadRootDaemonInterface_Message(mkGossipScoresUpcall(snapshots))
+	require.NoError(t, err)
+	pmsg, err := imsg.PushMessage()
+	require.NoError(t, err)
+	require.Equal(t, ipc.DaemonInterface_PushMessage_Which_gossipScores, pmsg.Which())
+	m, err := pmsg.GossipScores()
+	require.NoError(t, err)
+	ms, err := m.Peers()
+	require.NoError(t, err)
+	require.Equal(t, 1, ms.Len())
+
+	p := ms.At(0)
+	ppid, err := p.PeerId()
+	require.NoError(t, err)
+	id, err := ppid.Id()
+	require.NoError(t, err)
+	require.Equal(t, peer.Encode(pid), id)
+	require.Equal(t, -10.0, p.Score())
+	require.Equal(t, -2.0, p.AppSpecificScore())
+	require.Equal(t, 1.0, p.IpColocationFactor())
+	require.Equal(t, 4.0, p.BehaviourPenalty())
+
+	topics, err := p.Topics()
+	require.NoError(t, err)
+	require.Equal(t, 1, topics.Len())
+	topic, err := topics.At(0).Topic()
+	require.NoError(t, err)
+	require.Equal(t, consensusTopic, topic)
+	timeInMesh, err := topics.At(0).TimeInMesh()
+	require.NoError(t, err)
+	require.Equal(t, uint64(time.Minute), timeInMesh.NanoSec())
+	require.Equal(t, 5.0, topics.At(0).FirstMessageDeliveries())
+	require.Equal(t, 7.0, topics.At(0).MeshMessageDeliveries())
+	require.Equal(t, 1.0, topics.At(0).InvalidMessageDeliveries())
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	logging "github.com/ipfs/go-log/v2"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var gossipTraceLogger = logging.Logger("mina.helper.gossip_trace")
+
+const (
+	// Number of trace events buffered for the trace file,
+	// events are dropped once the buffer is full
+	gossipTraceQueueSize   = 4096
+	defaultGossipTraceSize = 64 << 20
+	defaultGossipTraces    = 4
+)
+
+var gossipTraceDroppedMetric = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "Mina_libp2p_gossip_trace_dropped_events",
+	Help: "Number of gossipsub trace events not written to the trace file because it was too slow",
+})
+
+// gossipTraceBackend is an event tracer of go-libp2p-pubsub
+// that is closed once the tracing is replaced
+type gossipTraceBackend interface {
+	pubsub.EventTracer
+	Close()
+}
+
+// gossipTracer is the event tracer of gossipsub. Gossipsub only takes
+// a tracer when it's created, hence the tracer is installed at
+// configuration and passes events to backends set by setGossipTrace.
+// Events are traced from the event loop of gossipsub, backends buffer
+// them and never block.
+type gossipTracer struct {
+	backends []gossipTraceBackend
+	mutex    sync.RWMutex
+}
+
+func (t *gossipTracer) Trace(evt *pb.TraceEvent) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for _, b := range t.backends {
+		b.Trace(evt)
+	}
+}
+
+// Set replaces backends of the tracer, the ones
+// not kept are closed
+func (t *gossipTracer) Set(backends ...gossipTraceBackend) {
+	t.mutex.Lock()
+	old := t.backends
+	t.backends = backends
+	t.mutex.Unlock()
+	kept := make(map[gossipTraceBackend]bool, len(backends))
+	for _, b := range backends {
+		kept[b] = true
+	}
+	for _, b := range old {
+		if !kept[b] {
+			b.Close()
+		}
+	}
+}
+
+// gossipTraceFile writes trace events to a file as delimited protobufs,
+// the format of go-libp2p-pubsub's PBTracer read by its tracer tools.
+// Once the file would exceed maxSize bytes, it's renamed with suffix
+// .1 (older files get their suffixes incremented) and a new one is
+// started, so that at most maxFiles files are kept.
+type gossipTraceFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	events   chan *pb.TraceEvent
+	done     chan struct{}
+}
+
+func openGossipTraceFile(path string, maxSize int64, maxFiles int) (*gossipTraceFile, error) {
+	if maxSize <= 0 {
+		maxSize = defaultGossipTraceSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = defaultGossipTraces
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	tf := &gossipTraceFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		events:   make(chan *pb.TraceEvent, gossipTraceQueueSize),
+		done:     make(chan struct{}),
+	}
+	go tf.writeLoop(f)
+	return tf, nil
+}
+
+func (tf *gossipTraceFile) Trace(evt *pb.TraceEvent) {
+	select {
+	case tf.events <- evt:
+	default:
+		gossipTraceDroppedMetric.Inc()
+	}
+}
+
+// Close waits for buffered events to be written
+func (tf *gossipTraceFile) Close() {
+	close(tf.events)
+	<-tf.done
+}
+
+func (tf *gossipTraceFile) rotate() (*os.File, error) {
+	for i := tf.maxFiles - 1; i > 0; i-- {
+		from := tf.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", tf.path, i-1)
+		}
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", tf.path, i)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return os.OpenFile(tf.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+}
+
+func (tf *gossipTraceFile) writeLoop(f *os.File) {
+	defer close(tf.done)
+	w := bufio.NewWriter(f)
+	var size int64
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	for evt := range tf.events {
+		if f == nil {
+			// writing failed, events are discarded until closed
+			continue
+		}
+		data, err := evt.Marshal()
+		if err != nil {
+			gossipTraceLogger.Warnf("failed to marshal trace event: %s", err)
+			continue
+		}
+		n := binary.PutUvarint(lenBuf, uint64(len(data)))
+		if size > 0 && size+int64(n+len(data)) > tf.maxSize {
+			err := w.Flush()
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err == nil {
+				f, err = tf.rotate()
+			}
+			if err != nil {
+				gossipTraceLogger.Errorf("failed to rotate trace file %s, tracing to the file stopped: %s", tf.path, err)
+				f = nil
+				continue
+			}
+			w.Reset(f)
+			size = 0
+		}
+		_, err = w.Write(lenBuf[:n])
+		if err == nil {
+			_, err = w.Write(data)
+		}
+		if err != nil {
+			gossipTraceLogger.Errorf("failed to write trace file %s, tracing to the file stopped: %s", tf.path, err)
+			_ = f.Close()
+			f = nil
+			continue
+		}
+		size += int64(n + len(data))
+		if len(tf.events) == 0 {
+			if err := w.Flush(); err != nil {
+				gossipTraceLogger.Warnf("failed to flush trace file %s: %s", tf.path, err)
+			}
+		}
+	}
+	if f != nil {
+		if err := w.Flush(); err != nil {
+			gossipTraceLogger.Warnf("failed to flush trace file %s: %s", tf.path, err)
+		}
+		_ = f.Close()
+	}
+}
+
+type SetGossipTraceReqT = ipc.Libp2pHelperInterface_SetGossipTrace_Request
+type SetGossipTraceReq SetGossipTraceReqT
+
+func fromSetGossipTraceReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.SetGossipTrace()
+	return SetGossipTraceReq(i), err
+}
+
+func (m SetGossipTraceReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	path, err := SetGossipTraceReqT(m).Path()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	collector, err := SetGossipTraceReqT(m).Collector()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	collectorRepr, err := collector.Representation()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	maxSize := SetGossipTraceReqT(m).MaxFileSize()
+	if maxSize > 1<<62 {
+		return mkRpcRespError(seqno, badRPC(errors.New("trace file size is too large")))
+	}
+
+	var backends []gossipTraceBackend
+	if collectorRepr != "" {
+		info, err := addrInfoOfString(collectorRepr)
+		if err != nil {
+			return mkRpcRespError(seqno, badRPC(err))
+		}
+		remote, err := pubsub.NewRemoteTracer(app.Ctx, app.P2p.Host, *info)
+		if err != nil {
+			return mkRpcRespError(seqno, badp2p(err))
+		}
+		backends = append(backends, remote)
+	}
+	if path != "" {
+		tf, err := openGossipTraceFile(path, int64(maxSize), int(SetGossipTraceReqT(m).MaxFiles()))
+		if err != nil {
+			for _, b := range backends {
+				b.Close()
+			}
+			return mkRpcRespError(seqno, badHelper(err))
+		}
+		backends = append(backends, tf)
+	}
+	app.gossipTrace.Set(backends...)
+	if len(backends) == 0 {
+		gossipTraceLogger.Info("gossip tracing stopped")
+	} else {
+		gossipTraceLogger.Infof("gossip tracing started (file %q, collector %q)", path, collectorRepr)
+	}
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewSetGossipTrace()
+		panicOnErr(err)
+	})
+}
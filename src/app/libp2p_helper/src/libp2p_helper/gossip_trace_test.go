@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/stretchr/testify/require"
+)
+
+func readGossipTraceFile(t *testing.T, path string) []*pb.TraceEvent {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var res []*pb.TraceEvent
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return res
+		}
+		require.NoError(t, err)
+		data := make([]byte, size)
+		_, err = io.ReadFull(r, data)
+		require.NoError(t, err)
+		evt := new(pb.TraceEvent)
+		require.NoError(t, evt.Unmarshal(data))
+		res = append(res, evt)
+	}
+}
+
+func testTraceEvent(i int64) *pb.TraceEvent {
+	typ := pb.TraceEvent_JOIN
+	topic := fmt.Sprintf("topic%03d", i)
+	return &pb.TraceEvent{
+		Type:      &typ,
+		Timestamp: &i,
+		Join:      &pb.TraceEvent_Join{Topic: &topic},
+	}
+}
+
+func TestGossipTraceFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trace.pb")
+
+	eventSize, err := testTraceEvent(0).Marshal()
+	require.NoError(t, err)
+	// Room for 4 delimited events per file
+	tf, err := openGossipTraceFile(path, int64(4*(len(eventSize)+1)), 3)
+	require.NoError(t, err)
+	for i := int64(0); i < 14; i++ {
+		tf.Trace(testTraceEvent(i))
+	}
+	tf.Close()
+
+	// Oldest events are dropped with the oldest file
+	timestamps := func(events []*pb.TraceEvent) []int64 {
+		res := make([]int64, 0, len(events))
+		for _, evt := range events {
+			require.Equal(t, fmt.Sprintf("topic%03d", evt.GetTimestamp()), evt.GetJoin().GetTopic())
+			res = append(res, evt.GetTimestamp())
+		}
+		return res
+	}
+	require.Equal(t, []int64{4, 5, 6, 7}, timestamps(readGossipTraceFile(t, path+".2")))
+	require.Equal(t, []int64{8, 9, 10, 11}, timestamps(readGossipTraceFile(t, path+".1")))
+	require.Equal(t, []int64{12, 13}, timestamps(readGossipTraceFile(t, path)))
+	_, err = os.Stat(path + ".3")
+	require.True(t, os.IsNotExist(err))
+}
+
+type testTraceBackend struct {
+	events []*pb.TraceEvent
+	closed bool
+}
+
+func (b *testTraceBackend) Trace(evt *pb.TraceEvent) {
+	b.events = append(b.events, evt)
+}
+
+func (b *testTraceBackend) Close() {
+	b.closed = true
+}
+
+func TestGossipTracerSet(t *testing.T) {
+	var tracer gossipTracer
+	// Events are discarded without backends
+	tracer.Trace(testTraceEvent(0))
+
+	a, b := new(testTraceBackend), new(testTraceBackend)
+	tracer.Set(a, b)
+	tracer.Trace(testTraceEvent(1))
+	require.Len(t, a.events, 1)
+	require.Len(t, b.events, 1)
+
+	tracer.Set(b)
+	require.True(t, a.closed)
+	require.False(t, b.closed)
+	tracer.Trace(testTraceEvent(2))
+	require.Len(t, a.events, 1)
+	require.Len(t, b.events, 2)
+
+	tracer.Set()
+	require.True(t, b.closed)
+}
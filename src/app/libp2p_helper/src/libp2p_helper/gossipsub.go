@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+
+	ipc "libp2p_ipc"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Per-topic grafts and prunes of our mesh, their rate (e.g. per minute)
+// shows whether score settings are causing mesh instability
+var meshGraftsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "Mina_libp2p_gossipsub_mesh_grafts",
+	Help: "Number of peers grafted to the gossipsub mesh of a topic",
+}, []string{"topic"})
+
+var meshPrunesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "Mina_libp2p_gossipsub_mesh_prunes",
+	Help: "Number of peers pruned from the gossipsub mesh of a topic",
+}, []string{"topic"})
+
+// noopRawTracer ignores all events, raw tracers embed
+// it to implement only handlers of events they need
+type noopRawTracer struct{}
+
+func (noopRawTracer) AddPeer(peer.ID, protocol.ID)          {}
+func (noopRawTracer) RemovePeer(peer.ID)                    {}
+func (noopRawTracer) Join(string)                           {}
+func (noopRawTracer) Leave(string)                          {}
+func (noopRawTracer) Graft(peer.ID, string)                 {}
+func (noopRawTracer) Prune(peer.ID, string)                 {}
+func (noopRawTracer) ValidateMessage(*pubsub.Message)       {}
+func (noopRawTracer) DeliverMessage(*pubsub.Message)        {}
+func (noopRawTracer) RejectMessage(*pubsub.Message, string) {}
+func (noopRawTracer) DuplicateMessage(*pubsub.Message)      {}
+func (noopRawTracer) ThrottlePeer(peer.ID)                  {}
+func (noopRawTracer) RecvRPC(*pubsub.RPC)                   {}
+func (noopRawTracer) SendRPC(*pubsub.RPC, peer.ID)          {}
+func (noopRawTracer) DropRPC(*pubsub.RPC, peer.ID)          {}
+func (noopRawTracer) UndeliverableMessage(*pubsub.Message)  {}
+
+// meshChurnTracer counts mesh changes, other events are ignored
+type meshChurnTracer struct {
+	noopRawTracer
+}
+
+func (meshChurnTracer) Graft(_ peer.ID, topic string) {
+	meshGraftsMetric.WithLabelValues(topic).Inc()
+}
+
+func (meshChurnTracer) Prune(_ peer.ID, topic string) {
+	meshPrunesMetric.WithLabelValues(topic).Inc()
+}
+
+// readMeshDegree overrides mesh degrees of params with ones set in the
+// config. Degrees derived from them (Dout and Dscore) are lowered to
+// keep them within bounds gossipsub expects.
+func readMeshDegree(cfg ipc.GossipConfig, params *pubsub.GossipSubParams) error {
+	if d := cfg.MeshD(); d > 0 {
+		params.D = int(d)
+	}
+	if dlo := cfg.MeshDlo(); dlo > 0 {
+		params.Dlo = int(dlo)
+	}
+	if dhi := cfg.MeshDhi(); dhi > 0 {
+		params.Dhi = int(dhi)
+	}
+	if dlazy := cfg.MeshDlazy(); dlazy > 0 {
+		params.Dlazy = int(dlazy)
+	}
+	if params.Dlo > params.D || params.D > params.Dhi {
+		return fmt.Errorf("mesh degree %d isn't within bounds [%d, %d]", params.D, params.Dlo, params.Dhi)
+	}
+	// Dout must be below Dlo and not exceed D/2
+	if params.Dout >= params.Dlo {
+		params.Dout = params.Dlo - 1
+	}
+	if params.Dout > params.D/2 {
+		params.Dout = params.D / 2
+	}
+	if params.Dscore > params.D {
+		params.Dscore = params.D
+	}
+	return nil
+}
+
+// readGossipConfig converts mesh degrees, the subscription filter and
+// opportunistic grafting settings to pubsub options. Opportunistic
+// grafting relies on peer scores, hence scoring with neutral parameters
+// is enabled when the threshold is set. Scores of peers are then
+// lowered by the application-specific score (e.g. for malformed
+// Bitswap blocks).
+func readGossipConfig(cfg ipc.GossipConfig, appScore func(peer.ID) float64) ([]pubsub.Option, error) {
+	params := pubsub.DefaultGossipSubParams()
+	if err := readMeshDegree(cfg, &params); err != nil {
+		return nil, err
+	}
+	if ticks := cfg.OpportunisticGraftTicks(); ticks > 0 {
+		params.OpportunisticGraftTicks = uint64(ticks)
+	}
+	if peers := cfg.OpportunisticGraftPeers(); peers > 0 {
+		params.OpportunisticGraftPeers = int(peers)
+	}
+	opts := []pubsub.Option{
+		pubsub.WithGossipSubParams(params),
+		pubsub.WithRawTracer(meshChurnTracer{}),
+	}
+	sfc, err := cfg.SubscriptionFilter()
+	if err != nil {
+		return nil, err
+	}
+	filter, err := readSubscriptionFilterConfig(sfc)
+	if err != nil {
+		return nil, err
+	}
+	if filter != nil {
+		opts = append(opts, pubsub.WithSubscriptionFilter(filter), pubsub.WithRawTracer(filter))
+	}
+	if threshold := cfg.OpportunisticGraftThreshold(); threshold > 0 {
+		// Deliveries on topics of the daemon are counted for score reports
+		topicScoreParams := make(map[string]*pubsub.TopicScoreParams, len(daemonTopics))
+		for topic := range daemonTopics {
+			topicScoreParams[topic] = neutralTopicScoreParams()
+		}
+		opts = append(opts, pubsub.WithPeerScore(
+			&pubsub.PeerScoreParams{
+				Topics:            topicScoreParams,
+				AppSpecificScore:  appScore,
+				AppSpecificWeight: 1,
+				DecayInterval:     pubsub.DefaultDecayInterval,
+				DecayToZero:       pubsub.DefaultDecayToZero,
+			},
+			&pubsub.PeerScoreThresholds{
+				OpportunisticGraftThreshold: threshold,
+			}))
+	}
+	return opts, nil
+}
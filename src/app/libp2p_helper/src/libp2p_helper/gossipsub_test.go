@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeshChurnTracer(t *testing.T) {
+	topic := "mesh-churn-test"
+	tr := meshChurnTracer{}
+	tr.Graft("", topic)
+	tr.Graft("", topic)
+	tr.Prune("", topic)
+	require.Equal(t, 2.0, testutil.ToFloat64(meshGraftsMetric.WithLabelValues(topic)))
+	require.Equal(t, 1.0, testutil.ToFloat64(meshPrunesMetric.WithLabelValues(topic)))
+}
+
+func mkMeshDegreeConfig(t *testing.T, d, dlo, dhi, dlazy uint32) ipc.GossipConfig {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	cfg, err := ipc.NewRootGossipConfig(seg)
+	require.NoError(t, err)
+	cfg.SetMeshD(d)
+	cfg.SetMeshDlo(dlo)
+	cfg.SetMeshDhi(dhi)
+	cfg.SetMeshDlazy(dlazy)
+	return cfg
+}
+
+func TestReadMeshDegree(t *testing.T) {
+	// Defaults are kept
+	params := pubsub.DefaultGossipSubParams()
+	require.NoError(t, readMeshDegree(mkMeshDegreeConfig(t, 0, 0, 0, 0), &params))
+	require.Equal(t, pubsub.DefaultGossipSubParams(), params)
+
+	// Wider mesh for lower propagation latency
+	params = pubsub.DefaultGossipSubParams()
+	require.NoError(t, readMeshDegree(mkMeshDegreeConfig(t, 10, 8, 16, 12), &params))
+	require.Equal(t, 10, params.D)
+	require.Equal(t, 8, params.Dlo)
+	require.Equal(t, 16, params.Dhi)
+	require.Equal(t, 12, params.Dlazy)
+	require.Equal(t, pubsub.GossipSubDout, params.Dout)
+
+	// Narrow mesh lowers derived degrees
+	params = pubsub.DefaultGossipSubParams()
+	require.NoError(t, readMeshDegree(mkMeshDegreeConfig(t, 3, 2, 4, 0), &params))
+	require.Equal(t, 1, params.Dout)
+	require.Equal(t, 3, params.Dscore)
+
+	params = pubsub.DefaultGossipSubParams()
+	require.Error(t, readMeshDegree(mkMeshDegreeConfig(t, 4, 5, 0, 0), &params))
+	params = pubsub.DefaultGossipSubParams()
+	require.Error(t, readMeshDegree(mkMeshDegreeConfig(t, 14, 0, 0, 0), &params))
+}
@@ -1,40 +1,87 @@
 package main
 
 import (
+	"time"
+
 	ipc "libp2p_ipc"
 
 	capnp "capnproto.org/go/capnp/v3"
-	"github.com/go-errors/errors"
 )
 
 var rpcRequestExtractors = map[ipc.Libp2pHelperInterface_RpcRequest_Which]extractRequest{
-	ipc.Libp2pHelperInterface_RpcRequest_Which_configure:           fromConfigureReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_setGatingConfig:     fromSetGatingConfigReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_listen:              fromListenReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_getListeningAddrs:   fromGetListeningAddrsReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_beginAdvertising:    fromBeginAdvertisingReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_addPeer:             fromAddPeerReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_listPeers:           fromListPeersReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_bandwidthInfo:       fromBandwidthInfoReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_generateKeypair:     fromGenerateKeypairReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_publish:             fromPublishReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_subscribe:           fromSubscribeReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_unsubscribe:         fromUnsubscribeReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_addStreamHandler:    fromAddStreamHandlerReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_removeStreamHandler: fromRemoveStreamHandlerReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_openStream:          fromOpenStreamReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_closeStream:         fromCloseStreamReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_resetStream:         fromResetStreamReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_sendStream:          fromSendStreamReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_setNodeStatus:       fromSetNodeStatusReq,
-	ipc.Libp2pHelperInterface_RpcRequest_Which_getPeerNodeStatus:   fromGetPeerNodeStatusReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_configure:              fromConfigureReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_setGatingConfig:        fromSetGatingConfigReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_listen:                 fromListenReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_getListeningAddrs:      fromGetListeningAddrsReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_beginAdvertising:       fromBeginAdvertisingReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_addPeer:                fromAddPeerReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_listPeers:              fromListPeersReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_bandwidthInfo:          fromBandwidthInfoReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_generateKeypair:        fromGenerateKeypairReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_publish:                fromPublishReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_subscribe:              fromSubscribeReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_unsubscribe:            fromUnsubscribeReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_addStreamHandler:       fromAddStreamHandlerReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_removeStreamHandler:    fromRemoveStreamHandlerReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_openStream:             fromOpenStreamReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_closeStream:            fromCloseStreamReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_resetStream:            fromResetStreamReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_sendStream:             fromSendStreamReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_setNodeStatus:          fromSetNodeStatusReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_getPeerNodeStatus:      fromGetPeerNodeStatusReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_setFirehose:            fromSetFirehoseReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_listConnectionRungs:    fromListConnectionRungsReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_listDialScores:         fromListDialScoresReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_revalidateResource:     fromRevalidateResourceReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_setMaintenanceMode:     fromSetMaintenanceModeReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_listPeerAgents:         fromListPeerAgentsReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_setAddrAnnounceConfig:  fromSetAddrAnnounceConfigReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_pinResource:            fromPinResourceReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_unpinResource:          fromUnpinResourceReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_setBitswapThrottle:     fromSetBitswapThrottleReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_applyRolePreset:        fromApplyRolePresetReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_setBitswapServing:      fromSetBitswapServingReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_streamResource:         fromStreamResourceReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_listPeerAuditEvents:    fromListPeerAuditEventsReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_cancelResourceDownload: fromCancelResourceDownloadReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_publishResource:        fromPublishResourceReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_startTuningExperiment:  fromStartTuningExperimentReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_stopTuningExperiment:   fromStopTuningExperimentReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_listBitswapWants:       fromListBitswapWantsReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_mountArchiveBlockstore: fromMountArchiveBlockstoreReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_exportResource:         fromExportResourceReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_importResource:         fromImportResourceReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_auditBlockstore:        fromAuditBlockstoreReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_downloadResources:      fromDownloadResourcesReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_deleteResourcesBefore:  fromDeleteResourcesBeforeReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_setTopicConfig:         fromSetTopicConfigReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_setGossipTrace:         fromSetGossipTraceReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_getTopicPeers:          fromGetTopicPeersReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_setGossipRecord:        fromSetGossipRecordReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_replayGossip:           fromReplayGossipReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_getPeerRecords:         fromGetPeerRecordsReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_addPeerRecords:         fromAddPeerRecordsReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_setConnectionLimits:    fromSetConnectionLimitsReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_protectPeer:            fromProtectPeerReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_unprotectPeer:          fromUnprotectPeerReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_tagPeer:                fromTagPeerReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_banPeer:                fromBanPeerReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_banIp:                  fromBanIpReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_listBans:               fromListBansReq,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_requestPeerRecords:     fromRequestPeerRecordsReq,
 }
 
 var pushMesssageExtractors = map[ipc.Libp2pHelperInterface_PushMessage_Which]extractPushMessage{
-	ipc.Libp2pHelperInterface_PushMessage_Which_addResource:      fromAddResourcePush,
-	ipc.Libp2pHelperInterface_PushMessage_Which_deleteResource:   fromDeleteResourcePush,
-	ipc.Libp2pHelperInterface_PushMessage_Which_downloadResource: fromDownloadResourcePush,
-	ipc.Libp2pHelperInterface_PushMessage_Which_validation:       fromValidationPush,
+	ipc.Libp2pHelperInterface_PushMessage_Which_addResource:        fromAddResourcePush,
+	ipc.Libp2pHelperInterface_PushMessage_Which_deleteResource:     fromDeleteResourcePush,
+	ipc.Libp2pHelperInterface_PushMessage_Which_downloadResource:   fromDownloadResourcePush,
+	ipc.Libp2pHelperInterface_PushMessage_Which_validation:         fromValidationPush,
+	ipc.Libp2pHelperInterface_PushMessage_Which_ackResourceUpdates: fromAckResourceUpdatesPush,
+	ipc.Libp2pHelperInterface_PushMessage_Which_resourceVerified:   fromResourceVerifiedPush,
+	ipc.Libp2pHelperInterface_PushMessage_Which_addResourcePiece:   fromAddResourcePiecePush,
+	ipc.Libp2pHelperInterface_PushMessage_Which_commitResource:     fromCommitResourcePush,
+	ipc.Libp2pHelperInterface_PushMessage_Which_abortResource:      fromAbortResourcePush,
+	ipc.Libp2pHelperInterface_PushMessage_Which_validationBatch:    fromValidationBatchPush,
 }
 
 func (app *app) handleIncomingMsg(msg *ipc.Libp2pHelperInterface_Message) {
@@ -53,15 +100,38 @@ func (app *app) handleIncomingMsg(msg *ipc.Libp2pHelperInterface_Message) {
 				return nil, err
 			}
 			seqno := seqnoO.Seqno()
+			traceId, err := h.TraceId()
+			if err != nil {
+				return nil, err
+			}
 			extractor, foundHandler := rpcRequestExtractors[req.Which()]
 			if !foundHandler {
-				return nil, errors.New("Received rpc message of an unknown type")
+				// Reply with an error, so that the daemon doesn't wait for the response
+				app.schemaMismatches.Report(mismatchRpcRequest, uint16(req.Which()))
+				resp := mkRpcRespError(seqno, unknownRpcMethod(uint16(req.Which())))
+				return resp, setRpcResponseTraceId(resp, traceId)
 			}
 			req2, err := extractor(req)
 			if err != nil {
 				return nil, err
 			}
-			return req2.handle(app, seqno), nil
+			if app.relayOnly && relayOnlyDisabledRpcMethods[req.Which()] {
+				resp := mkRpcRespError(seqno, relayOnlyUnsupported(req.Which().String()))
+				return resp, setRpcResponseTraceId(resp, traceId)
+			}
+			if !app.rpcAdmission.Admit(req.Which()) {
+				resp := mkRpcRespError(seqno, rateLimited(req.Which().String()))
+				return resp, setRpcResponseTraceId(resp, traceId)
+			}
+			start := time.Now()
+			resp := req2.handle(app, seqno)
+			elapsed := time.Since(start)
+			observeRpcHandlingTime(req.Which().String(), elapsed, traceId)
+			if traceId != "" {
+				traceLogger.Debugw("handled rpc request", "method", req.Which().String(),
+					"seqno", seqno, "trace_id", traceId, "elapsed", elapsed)
+			}
+			return resp, setRpcResponseTraceId(resp, traceId)
 		}()
 		if err == nil {
 			app.writeMsg(resp)
@@ -74,25 +144,38 @@ func (app *app) handleIncomingMsg(msg *ipc.Libp2pHelperInterface_Message) {
 			if err != nil {
 				return err
 			}
-			_, err = push.Header()
+			h, err := push.Header()
+			if err != nil {
+				return err
+			}
+			traceId, err := h.TraceId()
 			if err != nil {
 				return err
 			}
 			extractor, foundHandler := pushMesssageExtractors[push.Which()]
 			if !foundHandler {
-				return errors.New("Received push message of an unknown type")
+				app.schemaMismatches.Report(mismatchPushMessage, uint16(push.Which()))
+				return nil
+			}
+			if app.relayOnly && relayOnlyDisabledPushMessages[push.Which()] {
+				return relayOnlyUnsupported(push.Which().String())
 			}
 			push_, err := extractor(push)
 			if err != nil {
 				return err
 			}
-			push_.handle(app)
+			if traced, isTraced := push_.(tracedPushMessage); isTraced && traceId != "" {
+				traceLogger.Debugw("handling push message", "type", push.Which().String(), "trace_id", traceId)
+				traced.handleTraced(app, traceId)
+			} else {
+				push_.handle(app)
+			}
 			return nil
 		}()
 		if err != nil {
 			app.P2p.Logger.Errorf("Failed to process push message: %w", err)
 		}
 	} else {
-		app.P2p.Logger.Error("Received message of an unknown type")
+		app.schemaMismatches.Report(mismatchMessage, uint16(msg.Which()))
 	}
 }
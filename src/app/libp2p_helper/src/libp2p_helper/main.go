@@ -1,12 +1,17 @@
 package main
 
 import (
+	dl "codanet/bitswap_downloader"
 	"context"
+	"flag"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime/debug"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	// importing this automatically registers the pprof api to our metrics server
@@ -34,7 +39,14 @@ func startMetricsServer(port uint16) *codaMetricsServer {
 	go func() {
 		defer done.Done()
 
-		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		var err error
+		// Socket passed by the supervisor takes precedence over the port
+		if l := takeActivatedListener(metricsSocketName); l != nil {
+			err = server.Serve(l)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
 			log.Fatalf("http server error: %v", err)
 		}
 	}()
@@ -78,10 +90,59 @@ func init() {
 	prometheus.MustRegister(connectionCountMetric)
 	prometheus.MustRegister(validationTimeoutMetric)
 	prometheus.MustRegister(validationTimeMetric)
-	http.Handle("/metrics", promhttp.Handler())
+	prometheus.MustRegister(firehoseDroppedMetric)
+	prometheus.MustRegister(gossipTraceDroppedMetric)
+	prometheus.MustRegister(validationCacheHitsMetric)
+	prometheus.MustRegister(validationCacheMissesMetric)
+	prometheus.MustRegister(validationBatchSizeMetric)
+	prometheus.MustRegister(filteredSubscriptionsMetric)
+	prometheus.MustRegister(publishLimitedMetric)
+	prometheus.MustRegister(gossipCompressedBytesMetric)
+	prometheus.MustRegister(gossipRecordDroppedMetric)
+	prometheus.MustRegister(gossipVerdictLatencyMetric)
+	prometheus.MustRegister(gossipRebroadcastLatencyMetric)
+	prometheus.MustRegister(gossipCatchupMessagesMetric)
+	prometheus.MustRegister(outboundPeersMetric)
+	prometheus.MustRegister(rpcHandlingTimeMetric)
+	prometheus.MustRegister(meshGraftsMetric)
+	prometheus.MustRegister(meshPrunesMetric)
+	prometheus.MustRegister(dialOutcomesMetric)
+	prometheus.MustRegister(validationQueueLimitMetric)
+	prometheus.MustRegister(validationQueueDroppedMetric)
+	prometheus.MustRegister(bitswapStorageSizeMetric)
+	prometheus.MustRegister(bitswapDedupSavedMetric)
+	prometheus.MustRegister(bitswapGcSweptMetric)
+	prometheus.MustRegister(bitswapStaleRootsMetric)
+	prometheus.MustRegister(bitswapDownloadDurationMetric)
+	prometheus.MustRegister(bitswapDownloadBlocksMetric)
+	prometheus.MustRegister(bitswapDownloadRetriesMetric)
+	prometheus.MustRegister(dl.MalformedBlocksMetric)
+	prometheus.MustRegister(dl.ActiveDownloadsMetric)
+	prometheus.MustRegister(bitswapDuplicateBlocksMetric)
+	prometheus.MustRegister(bitswapDuplicateBytesMetric)
+	prometheus.MustRegister(bitswapDownloadDuplicateRatioMetric)
+	prometheus.MustRegister(bitswapSessionProviderCapMetric)
+	prometheus.MustRegister(bitswapBackpressureMetric)
+	prometheus.MustRegister(bitswapChecksumRepairsMetric)
+	prometheus.MustRegister(rpcRejectedMetric)
+	prometheus.MustRegister(ipcSchemaMismatchMetric)
+	// OpenMetrics format is needed to expose exemplars
+	http.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "blockstore" {
+		runBlockstoreCmd(os.Args[2:])
+		return
+	}
+	sandbox := registerSandboxFlags(flag.CommandLine)
+	flag.Parse()
+	if err := sandbox.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
 	logging.SetupLogging(logging.Config{
 		Format: logging.JSONOutput,
 		Stderr: true,
@@ -139,6 +200,7 @@ func main() {
 	decoder := capnp.NewDecoder(os.Stdin)
 
 	app := newApp()
+	app.sandbox = sandbox
 
 	go func() {
 		for {
@@ -171,11 +233,22 @@ func main() {
 	}()
 
 	go app.bitswapCtx.Loop()
+	go runWatchdog()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		helperLog.Infof("Received %s, stopping", sig)
+		app.drain()
+		os.Exit(0)
+	}()
 
 	for {
 		rawMsg, err := decoder.Decode()
 		if err != nil {
 			helperLog.Errorf("Error decoding raw message: %w", err)
+			notifyStopping()
 			os.Exit(2)
 			return
 		}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var maintenanceLogger = logging.Logger("mina.helper.maintenance")
+
+// maintenanceWindow is a time-boxed period during which the helper
+// suppresses its non-essential background work, e.g. while the operator
+// upgrades other software on the same host. The window ends by itself,
+// so that a failed upgrade doesn't leave the node degraded.
+type maintenanceWindow struct {
+	until time.Time
+	timer *time.Timer
+	mutex sync.Mutex
+}
+
+func (w *maintenanceWindow) active() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return time.Now().Before(w.until)
+}
+
+// inMaintenance tells whether non-essential background work
+// is to be skipped
+func (app *app) inMaintenance() bool {
+	return app.maintenance.active()
+}
+
+// setMaintenance starts (or replaces) the maintenance window of the duration,
+// zero duration ends the current window. With rejectInbound set, new inbound
+// connections from untrusted addresses are refused until the window ends.
+func (app *app) setMaintenance(duration time.Duration, rejectInbound bool) {
+	w := &app.maintenance
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if duration <= 0 {
+		w.until = time.Time{}
+		app.P2p.GatingState().SetRejectInbound(false)
+		maintenanceLogger.Info("Maintenance window ended")
+		return
+	}
+	w.until = time.Now().Add(duration)
+	app.P2p.GatingState().SetRejectInbound(rejectInbound)
+	w.timer = time.AfterFunc(duration, app.expireMaintenance)
+	maintenanceLogger.Infof("Maintenance window started for %s (rejecting inbound connections: %t)", duration, rejectInbound)
+}
+
+func (app *app) expireMaintenance() {
+	w := &app.maintenance
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	// Timer of a replaced window may fire concurrently with its replacement
+	if time.Now().Before(w.until) {
+		return
+	}
+	w.timer = nil
+	app.P2p.GatingState().SetRejectInbound(false)
+	maintenanceLogger.Info("Maintenance window expired")
+}
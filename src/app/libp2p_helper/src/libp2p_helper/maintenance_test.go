@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func testSetMaintenanceMode(t *testing.T, app *app, duration time.Duration) {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	m, err := ipc.NewRootLibp2pHelperInterface_SetMaintenanceMode_Request(seg)
+	require.NoError(t, err)
+	d, err := m.NewDuration()
+	require.NoError(t, err)
+	d.SetNanoSec(uint64(duration))
+	m.SetRejectInbound(true)
+
+	var mRpcSeqno uint64 = 2100
+	resMsg := SetMaintenanceModeReq(m).handle(app, mRpcSeqno)
+	seqno, respSuccess := checkRpcResponseSuccess(t, resMsg, "setMaintenanceMode")
+	require.Equal(t, seqno, mRpcSeqno)
+	require.True(t, respSuccess.HasSetMaintenanceMode())
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	testApp, _ := newTestApp(t, nil, true)
+	require.False(t, testApp.inMaintenance())
+
+	testSetMaintenanceMode(t, testApp, time.Hour)
+	require.True(t, testApp.inMaintenance())
+	// Zero duration ends the window
+	testSetMaintenanceMode(t, testApp, 0)
+	require.False(t, testApp.inMaintenance())
+
+	// Window ends by itself
+	testSetMaintenanceMode(t, testApp, 100*time.Millisecond)
+	require.True(t, testApp.inMaintenance())
+	require.Eventually(t, func() bool {
+		return !testApp.inMaintenance()
+	}, time.Second, 10*time.Millisecond)
+}
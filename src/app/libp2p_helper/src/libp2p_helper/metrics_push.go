@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	"github.com/go-errors/errors"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+var metricsPushLogger = logging.Logger("mina.helper.metrics_push")
+
+const (
+	defaultMetricsPushInterval = time.Minute
+	defaultMetricsPushJob      = "libp2p_helper"
+	metricsPushTimeout         = 30 * time.Second
+)
+
+// bearerDoer authenticates requests to the push gateway with a bearer token
+type bearerDoer struct {
+	client push.HTTPDoer
+	token  string
+}
+
+func (d *bearerDoer) Do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+d.token)
+	return d.client.Do(req)
+}
+
+type metricsPushConfig struct {
+	url         string
+	interval    time.Duration
+	job         string
+	username    string
+	password    string
+	bearerToken string
+}
+
+// readMetricsPushConfig returns the config of metrics push,
+// empty url is returned if the push is disabled
+func readMetricsPushConfig(c ipc.MetricsPushConfig) (metricsPushConfig, error) {
+	var cfg metricsPushConfig
+	var err error
+	if cfg.url, err = c.Url(); err != nil || cfg.url == "" {
+		return cfg, err
+	}
+	interval, err := c.Interval()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.interval = time.Duration(interval.NanoSec())
+	if cfg.interval == 0 {
+		cfg.interval = defaultMetricsPushInterval
+	}
+	if cfg.job, err = c.Job(); err != nil {
+		return cfg, err
+	}
+	if cfg.job == "" {
+		cfg.job = defaultMetricsPushJob
+	}
+	if cfg.username, err = c.Username(); err != nil {
+		return cfg, err
+	}
+	if cfg.password, err = c.Password(); err != nil {
+		return cfg, err
+	}
+	if cfg.bearerToken, err = c.BearerToken(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// newMetricsPusher creates a pusher of metrics of the default registry,
+// grouped by the instance (peer id of the node), requests are made
+// with a client timing out after metricsPushTimeout if client is nil
+func newMetricsPusher(cfg metricsPushConfig, instance string, client push.HTTPDoer) (*push.Pusher, error) {
+	if client == nil {
+		client = &http.Client{Timeout: metricsPushTimeout}
+	}
+	u, err := url.Parse(cfg.url)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, errors.New("metrics push gateway url must use http or https")
+	}
+	if u.Scheme != "https" && (cfg.username != "" || cfg.bearerToken != "") {
+		return nil, errors.New("metrics push gateway url must use https to send credentials")
+	}
+	if cfg.bearerToken != "" {
+		client = &bearerDoer{client: client, token: cfg.bearerToken}
+	}
+	pusher := push.New(cfg.url, cfg.job).
+		Gatherer(prometheus.DefaultGatherer).
+		Grouping("instance", instance).
+		Client(client)
+	if cfg.username != "" {
+		pusher = pusher.BasicAuth(cfg.username, cfg.password)
+	}
+	return pusher, nil
+}
+
+// pushMetrics periodically pushes metrics to the push gateway,
+// replacing metrics pushed before by the node
+func (app *app) pushMetrics(interval time.Duration, pusher *push.Pusher) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-app.Ctx.Done():
+			return
+		case <-ticker.C:
+			if app.inMaintenance() {
+				continue
+			}
+			if err := pusher.Push(); err != nil {
+				metricsPushLogger.Warnf("Failed to push metrics: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsPusher(t *testing.T) {
+	type request struct {
+		method, path, auth string
+	}
+	received := make(chan request, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- request{method: r.Method, path: r.URL.Path, auth: r.Header.Get("Authorization")}
+	}))
+	defer srv.Close()
+
+	cfg := metricsPushConfig{url: "http://gateway.example", job: defaultMetricsPushJob}
+	_, err := newMetricsPusher(cfg, "peer", srv.Client())
+	require.NoError(t, err)
+	cfg.bearerToken = "token"
+	_, err = newMetricsPusher(cfg, "peer", srv.Client())
+	require.Error(t, err)
+
+	cfg.url = srv.URL
+	pusher, err := newMetricsPusher(cfg, "peer", srv.Client())
+	require.NoError(t, err)
+	require.NoError(t, pusher.Push())
+	require.Equal(t, request{method: http.MethodPut, path: "/metrics/job/libp2p_helper/instance/peer", auth: "Bearer token"}, <-received)
+}
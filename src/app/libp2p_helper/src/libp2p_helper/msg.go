@@ -1,6 +1,7 @@
 package main
 
 import (
+	dl "codanet/bitswap_downloader"
 	"math"
 	gonet "net"
 	"time"
@@ -98,7 +99,7 @@ func capnpTextListForeach(l capnp.TextList, f func(string) error) error {
 	return nil
 }
 
-func readGatingConfig(gc ipc.GatingConfig, addedPeers []peer.AddrInfo) (*codanet.CodaGatingState, error) {
+func readGatingConfig(gc ipc.GatingConfig, addedPeers []peer.AddrInfo, asnTables *asnTableCache) (*codanet.CodaGatingState, error) {
 	_, totalIpNet, err := gonet.ParseCIDR("0.0.0.0/0")
 	if err != nil {
 		return nil, err
@@ -168,7 +169,51 @@ func readGatingConfig(gc ipc.GatingConfig, addedPeers []peer.AddrInfo) (*codanet
 		trustedPeers.Add(peer.ID)
 	}
 
-	return codanet.NewCodaGatingState(bannedAddrFilters, trustedAddrFilters, bannedPeers, trustedPeers), nil
+	subnetCaps, err := readSubnetCaps(gc, asnTables)
+	if err != nil {
+		return nil, err
+	}
+
+	gs := codanet.NewCodaGatingState(bannedAddrFilters, trustedAddrFilters, bannedPeers, trustedPeers)
+	gs.SetSubnetCaps(subnetCaps)
+	return gs, nil
+}
+
+// readAnnounceConfig reads address announcement configuration
+func readAnnounceConfig(c ipc.AddrAnnounceConfig) (*codanet.AnnounceConfig, error) {
+	announceMaList, err := c.Announce()
+	if err != nil {
+		return nil, err
+	}
+	announce := make([]ma.Multiaddr, 0, announceMaList.Len())
+	err = multiaddrListForeach(announceMaList, func(v string) error {
+		addr, err := ma.NewMultiaddr(v)
+		if err == nil {
+			announce = append(announce, addr)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	noAnnounceCIDRs, err := c.NoAnnounce()
+	if err != nil {
+		return nil, err
+	}
+	noAnnounce := ma.NewFilters()
+	err = capnpTextListForeach(noAnnounceCIDRs, func(cidr string) error {
+		_, ipnet, err := gonet.ParseCIDR(cidr)
+		if err == nil {
+			noAnnounce.AddFilter(*ipnet, ma.ActionDeny)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &codanet.AnnounceConfig{Announce: announce, NoAnnounce: noAnnounce, VerifyDialBack: c.VerifyDialBack()}, nil
 }
 
 func panicOnErr(err error) {
@@ -230,6 +275,10 @@ func mkRpcRespSuccess(seqno uint64, f func(*ipc.Libp2pHelperInterface_RpcRespons
 }
 
 func mkPushMsg(f func(ipc.DaemonInterface_PushMessage)) *capnp.Message {
+	return mkTracedPushMsg("", f)
+}
+
+func mkTracedPushMsg(traceId string, f func(ipc.DaemonInterface_PushMessage)) *capnp.Message {
 	return mkMsg(func(seg *capnp.Segment) {
 		m, err := ipc.NewRootDaemonInterface_Message(seg)
 		panicOnErr(err)
@@ -240,6 +289,9 @@ func mkPushMsg(f func(ipc.DaemonInterface_PushMessage)) *capnp.Message {
 		ns, err := h.NewTimeSent()
 		panicOnErr(err)
 		setNanoTime(&ns, time.Now())
+		if traceId != "" {
+			panicOnErr(h.SetTraceId(traceId))
+		}
 		f(pm)
 	})
 }
@@ -301,7 +353,7 @@ func mkIncomingStreamUpcall(peer *codaPeerInfo, streamIdx uint64, protocol strin
 	})
 }
 
-func mkGossipReceivedUpcall(sender *codaPeerInfo, expiration time.Time, seenAt time.Time, data []byte, seqno uint64, subIdx uint64) *capnp.Message {
+func mkGossipReceivedUpcall(sender *codaPeerInfo, expiration time.Time, seenAt time.Time, data []byte, seqno uint64, subIdx uint64, topicSeqno uint64) *capnp.Message {
 	return mkPushMsg(func(m ipc.DaemonInterface_PushMessage) {
 		gr, err := m.NewGossipReceived()
 		panicOnErr(err)
@@ -326,6 +378,7 @@ func mkGossipReceivedUpcall(sender *codaPeerInfo, expiration time.Time, seenAt t
 		panicOnErr(err)
 		sn.SetId(seqno)
 		panicOnErr(gr.SetData(data))
+		gr.SetTopicSeqno(topicSeqno)
 	})
 }
 
@@ -363,14 +416,15 @@ func mkStreamMessageReceivedUpcall(streamIdx uint64, data []byte) *capnp.Message
 	})
 }
 
-func mkResourceUpdatedUpcall(type_ ipc.ResourceUpdateType, rootIds []root) *capnp.Message {
-	return mkPushMsg(func(m ipc.DaemonInterface_PushMessage) {
+func mkResourceUpdatedUpcall(type_ ipc.ResourceUpdateType, traceId string, seqno uint64, rootIds []dl.Root) *capnp.Message {
+	return mkTracedPushMsg(traceId, func(m ipc.DaemonInterface_PushMessage) {
 		im, err := m.NewResourceUpdated()
 		panicOnErr(err)
 		if len(rootIds) > math.MaxInt32 {
 			panic("too many root ids in a single upcall")
 		}
 		im.SetType(type_)
+		im.SetSeqno(seqno)
 		mIds, err := im.NewIds(int32(len(rootIds)))
 		panicOnErr(err)
 		for i, rootId := range rootIds {
@@ -378,3 +432,75 @@ func mkResourceUpdatedUpcall(type_ ipc.ResourceUpdateType, rootIds []root) *capn
 		}
 	})
 }
+
+func mkDownloadProgressUpcall(traceId string, rootId dl.Root, progress dl.DownloadProgress) *capnp.Message {
+	return mkTracedPushMsg(traceId, func(m ipc.DaemonInterface_PushMessage) {
+		im, err := m.NewResourceUpdated()
+		panicOnErr(err)
+		im.SetType(ipc.ResourceUpdateType_progress)
+		mIds, err := im.NewIds(1)
+		panicOnErr(err)
+		panicOnErr(mIds.At(0).SetBlake2bHash(rootId[:]))
+		mProgress, err := im.NewProgress(1)
+		panicOnErr(err)
+		setDownloadProgress(mProgress.At(0), progress)
+	})
+}
+
+func setDownloadProgress(mp ipc.DaemonInterface_DownloadProgress, progress dl.DownloadProgress) {
+	mp.SetDescendantsDiscovered(uint32(progress.DescendantsDiscovered))
+	mp.SetBlocksFetched(uint32(progress.BlocksFetched))
+	mp.SetBytesFetched(uint64(progress.BytesFetched))
+	mp.SetBlocksRemaining(uint32(progress.BlocksRemaining))
+	mp.SetBytesRemaining(uint64(progress.BytesRemaining))
+}
+
+func mkVerifyResourceUpcall(traceId string, rootId dl.Root, tag dl.BitswapDataTag, data []byte) *capnp.Message {
+	return mkTracedPushMsg(traceId, func(m ipc.DaemonInterface_PushMessage) {
+		im, err := m.NewVerifyResource()
+		panicOnErr(err)
+		mId, err := im.NewId()
+		panicOnErr(err)
+		panicOnErr(mId.SetBlake2bHash(rootId[:]))
+		im.SetTag(uint8(tag))
+		if data != nil {
+			panicOnErr(im.SetData(data))
+		}
+	})
+}
+
+func mkResourceChunkUpcall(streamId uint64, offset uint64, data []byte, last bool, errMsg string) *capnp.Message {
+	return mkPushMsg(func(m ipc.DaemonInterface_PushMessage) {
+		im, err := m.NewResourceChunk()
+		panicOnErr(err)
+		im.SetStreamId(streamId)
+		im.SetOffset(offset)
+		panicOnErr(im.SetData(data))
+		im.SetLast(last)
+		if errMsg != "" {
+			panicOnErr(im.SetError(errMsg))
+		}
+	})
+}
+
+func mkBitswapLedgersUpcall(ledgers []bitswapLedger) *capnp.Message {
+	return mkPushMsg(func(m ipc.DaemonInterface_PushMessage) {
+		im, err := m.NewBitswapLedgers()
+		panicOnErr(err)
+		if len(ledgers) > math.MaxInt32 {
+			panic("too many ledgers in a single upcall")
+		}
+		mLedgers, err := im.NewLedgers(int32(len(ledgers)))
+		panicOnErr(err)
+		for i, l := range ledgers {
+			ml := mLedgers.At(i)
+			pid, err := ml.NewPeerId()
+			panicOnErr(err)
+			panicOnErr(pid.SetId(peer.Encode(l.peer)))
+			ml.SetBytesSent(l.sent)
+			ml.SetBytesReceived(l.received)
+			ml.SetBlocksExchanged(l.exchanged)
+			ml.SetGiveTakeRatio(l.GiveTakeRatio())
+		}
+	})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"codanet"
+	"math/rand"
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var outboundTargetLogger = logging.Logger("mina.helper.outbound_target")
+
+var outboundPeersMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "Mina_libp2p_outbound_peers",
+	Help: "Number of peers with outbound connections, as of the last check of the outbound target",
+})
+
+const (
+	defaultOutboundTargetInterval       = 10 * time.Second
+	defaultOutboundTargetInitialBackoff = 30 * time.Second
+	defaultOutboundTargetMaxBackoff     = 10 * time.Minute
+)
+
+type outboundTargetConfig struct {
+	target         int
+	interval       time.Duration
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// readOutboundTargetConfig returns the config of outbound target
+// maintenance, zero target is returned if it's disabled
+func readOutboundTargetConfig(c ipc.OutboundTargetConfig) (outboundTargetConfig, error) {
+	cfg := outboundTargetConfig{target: int(c.Target())}
+	interval, err := c.Interval()
+	if err != nil {
+		return cfg, err
+	}
+	initialBackoff, err := c.InitialBackoff()
+	if err != nil {
+		return cfg, err
+	}
+	maxBackoff, err := c.MaxBackoff()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.interval = time.Duration(interval.NanoSec())
+	if cfg.interval == 0 {
+		cfg.interval = defaultOutboundTargetInterval
+	}
+	cfg.initialBackoff = time.Duration(initialBackoff.NanoSec())
+	if cfg.initialBackoff == 0 {
+		cfg.initialBackoff = defaultOutboundTargetInitialBackoff
+	}
+	cfg.maxBackoff = time.Duration(maxBackoff.NanoSec())
+	if cfg.maxBackoff == 0 {
+		cfg.maxBackoff = defaultOutboundTargetMaxBackoff
+	}
+	return cfg, nil
+}
+
+type outboundRetry struct {
+	// failed dials the retry time was drawn for
+	failures int
+	at       time.Time
+}
+
+// outboundTarget holds a target number of peers with outbound connections,
+// dialing candidates whenever connections fall short of it. Failed dials
+// are taken from the connection failure history of the helper, which is
+// kept across restarts, so that unreachable peers are backed off from
+// rather than dialed on every check.
+//
+// State is only accessed from the maintenance loop.
+type outboundTarget struct {
+	cfg      outboundTargetConfig
+	failures *codanet.ConnectionFailures
+	retries  map[peer.ID]outboundRetry
+	now      func() time.Time
+	// returns a number in [0, 1)
+	jitter func() float64
+}
+
+func newOutboundTarget(cfg outboundTargetConfig, failures *codanet.ConnectionFailures) *outboundTarget {
+	return &outboundTarget{
+		cfg:      cfg,
+		failures: failures,
+		retries:  make(map[peer.ID]outboundRetry),
+		now:      time.Now,
+		jitter:   rand.Float64,
+	}
+}
+
+// backoff returns the delay before the dial following
+// the given number of failed dials
+func (t *outboundTarget) backoff(failures int) time.Duration {
+	d := t.cfg.initialBackoff
+	for i := 1; i < failures && d < t.cfg.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > t.cfg.maxBackoff {
+		d = t.cfg.maxBackoff
+	}
+	return d
+}
+
+// due tells whether the peer may be dialed: it has no failed dials since
+// its last outbound connection or the backoff after the last one elapsed
+func (t *outboundTarget) due(p peer.ID, now time.Time) bool {
+	failure, has := t.failures.Get(p)
+	if !has {
+		delete(t.retries, p)
+		return true
+	}
+	r, has := t.retries[p]
+	if !has || r.failures != failure.Count {
+		// jittered within [1/2, 3/2) of the backoff
+		d := t.backoff(failure.Count)
+		d = d/2 + time.Duration(t.jitter()*float64(d))
+		r = outboundRetry{failures: failure.Count, at: failure.Last.Add(d)}
+		t.retries[p] = r
+	}
+	return !now.Before(r.at)
+}
+
+// prune forgets retries of peers connected to since
+func (t *outboundTarget) prune() {
+	for p := range t.retries {
+		if _, has := t.failures.Get(p); !has {
+			delete(t.retries, p)
+		}
+	}
+}
+
+func countOutboundPeers(net network.Network) int {
+	peers := make(map[peer.ID]bool)
+	for _, c := range net.Conns() {
+		if c.Stat().Direction == network.DirOutbound {
+			peers[c.RemotePeer()] = true
+		}
+	}
+	return len(peers)
+}
+
+// outboundCandidates returns peers of the DHT routing tables and
+// the peerstore that aren't connected to and may be dialed
+func (app *app) outboundCandidates() []peer.ID {
+	h := app.P2p
+	seen := make(map[peer.ID]bool)
+	var res []peer.ID
+	add := func(peers []peer.ID) {
+		for _, p := range peers {
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+			if p == h.Me || h.Host.Network().Connectedness(p) == network.Connected || !h.GatingState().IsPeerAllowed(p) {
+				continue
+			}
+			res = append(res, p)
+		}
+	}
+	if h.Dht != nil {
+		add(h.Dht.WAN.RoutingTable().ListPeers())
+		add(h.Dht.LAN.RoutingTable().ListPeers())
+	}
+	add(h.Host.Peerstore().PeersWithAddrs())
+	return res
+}
+
+// exchangePeerRecords asks a random connected peer for signed records
+// of other peers, returns true if any were added to the peerstore
+func (app *app) exchangePeerRecords() bool {
+	peers := app.P2p.Host.Network().Peers()
+	if len(peers) == 0 {
+		return false
+	}
+	p := peers[rand.Intn(len(peers))]
+	added, err := app.P2p.RequestPeerRecords(app.Ctx, p, codanet.MaxPeerExchangeRecords)
+	if err != nil {
+		outboundTargetLogger.Debugf("failed to request peer records of %s: %s", p, err)
+		return false
+	}
+	return len(added) > 0
+}
+
+// holdOutboundTarget dials candidates that are due, as many as
+// outbound connections fall short of the target
+func (app *app) holdOutboundTarget(t *outboundTarget) {
+	outbound := countOutboundPeers(app.P2p.Host.Network())
+	outboundPeersMetric.Set(float64(outbound))
+	deficit := t.cfg.target - outbound
+	defer t.prune()
+	if deficit <= 0 {
+		return
+	}
+	candidates := app.outboundCandidates()
+	// Connected peers are asked for records of others when
+	// candidates run short, e.g. at bootstrap
+	if len(candidates) < deficit && app.exchangePeerRecords() {
+		candidates = app.outboundCandidates()
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	now := t.now()
+	var wg sync.WaitGroup
+	for _, p := range candidates {
+		if deficit == 0 {
+			break
+		}
+		info := app.P2p.Host.Peerstore().PeerInfo(p)
+		if len(info.Addrs) == 0 || !t.due(p, now) {
+			continue
+		}
+		deficit--
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Failed dials are recorded by the ladder
+			if _, err := app.dialLadder.Connect(app.Ctx, app.P2p.Host, info); err != nil {
+				outboundTargetLogger.Debugf("failed to connect to %s: %s", info.ID, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// maintainOutboundTarget checks the outbound target periodically,
+// checks are skipped during maintenance windows
+func (app *app) maintainOutboundTarget(t *outboundTarget) {
+	ticker := time.NewTicker(t.cfg.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-app.Ctx.Done():
+			return
+		case <-ticker.C:
+			if app.inMaintenance() {
+				continue
+			}
+			app.holdOutboundTarget(t)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"codanet"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/test"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboundTargetBackoff(t *testing.T) {
+	failures := codanet.NewConnectionFailures()
+	target := newOutboundTarget(outboundTargetConfig{target: 1, initialBackoff: time.Minute, maxBackoff: 3 * time.Minute}, failures)
+	jitter := 0.5
+	target.jitter = func() float64 { return jitter }
+	p := test.RandPeerIDFatal(t)
+	require.True(t, target.due(p, time.Now()))
+
+	failures.Record(p)
+	failure, _ := failures.Get(p)
+	require.False(t, target.due(p, failure.Last.Add(time.Minute-time.Second)))
+	require.True(t, target.due(p, failure.Last.Add(time.Minute)))
+
+	// Backoff doubles with each failure up to the max, the retry
+	// time is drawn once per failure
+	failures.Record(p)
+	failure, _ = failures.Get(p)
+	require.False(t, target.due(p, failure.Last.Add(2*time.Minute-time.Second)))
+	jitter = 0
+	require.True(t, target.due(p, failure.Last.Add(2*time.Minute)))
+	failures.Record(p)
+	failures.Record(p)
+	failure, _ = failures.Get(p)
+	require.False(t, target.due(p, failure.Last.Add(time.Minute+time.Second/2)))
+	require.True(t, target.due(p, failure.Last.Add(3*time.Minute/2)))
+
+	target.prune()
+	require.Len(t, target.retries, 1)
+}
+
+func TestHoldOutboundTarget(t *testing.T) {
+	testApp, _ := newTestApp(t, nil, true)
+	alice, _ := newTestApp(t, nil, true)
+	bob, _ := newTestApp(t, nil, true)
+	testApp.dialLadder.failures = testApp.P2p.ConnFailures
+	ps := testApp.P2p.Host.Peerstore()
+	for _, other := range []*app{alice, bob} {
+		infos, err := addrInfos(other.P2p.Host)
+		require.NoError(t, err)
+		ps.AddAddrs(infos[0].ID, infos[0].Addrs, peerstore.PermanentAddrTTL)
+	}
+
+	target := newOutboundTarget(outboundTargetConfig{target: 1, initialBackoff: time.Hour, maxBackoff: time.Hour}, testApp.P2p.ConnFailures)
+	testApp.holdOutboundTarget(target)
+	require.Equal(t, 1, countOutboundPeers(testApp.P2p.Host.Network()))
+
+	// Peers that failed to be dialed are backed off from
+	unreachable := test.RandPeerIDFatal(t)
+	ps.AddAddr(unreachable, ma.StringCast("/ip4/127.0.0.1/tcp/1"), peerstore.PermanentAddrTTL)
+	target.cfg.target = 3
+	testApp.holdOutboundTarget(target)
+	require.Equal(t, 2, countOutboundPeers(testApp.P2p.Host.Network()))
+	_, failed := testApp.P2p.ConnFailures.Get(unreachable)
+	require.True(t, failed)
+	require.False(t, target.due(unreachable, time.Now()))
+	require.NotContains(t, testApp.outboundCandidates(), alice.P2p.Me)
+}
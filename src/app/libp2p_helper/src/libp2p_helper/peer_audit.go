@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// Most recent events kept per peer
+	maxPeerAuditEvents = 32
+	// Peers with events kept at most, the peer with the
+	// least recent event is forgotten to make room for another
+	maxAuditedPeers = 1024
+)
+
+type peerAuditEvent struct {
+	at     time.Time
+	kind   ipc.Libp2pHelperInterface_PeerAuditEventKind
+	detail string
+}
+
+// peerAuditLog keeps a rolling trail of notable events of peers
+// (protocol negotiation failures, rejected and oversized gossip, Bitswap
+// wants over the serving limit), giving the operator evidence for manual
+// bans. Events are kept in memory only, bounded per peer and by the
+// number of peers.
+type peerAuditLog struct {
+	events map[peer.ID][]peerAuditEvent
+	now    func() time.Time
+	mutex  sync.Mutex
+}
+
+func newPeerAuditLog() *peerAuditLog {
+	return &peerAuditLog{
+		events: make(map[peer.ID][]peerAuditEvent),
+		now:    time.Now,
+	}
+}
+
+func (l *peerAuditLog) Record(p peer.ID, kind ipc.Libp2pHelperInterface_PeerAuditEventKind, detail string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	events, has := l.events[p]
+	if !has && len(l.events) >= maxAuditedPeers {
+		l.forgetLeastRecent()
+	}
+	if len(events) >= maxPeerAuditEvents {
+		events = append(events[:0], events[1:]...)
+	}
+	l.events[p] = append(events, peerAuditEvent{at: l.now(), kind: kind, detail: detail})
+}
+
+func (l *peerAuditLog) forgetLeastRecent() {
+	var oldest peer.ID
+	var oldestAt time.Time
+	for p, events := range l.events {
+		at := events[len(events)-1].at
+		if oldest == "" || at.Before(oldestAt) {
+			oldest, oldestAt = p, at
+		}
+	}
+	delete(l.events, oldest)
+}
+
+// Events returns events of the peer, oldest first
+func (l *peerAuditLog) Events(p peer.ID) []peerAuditEvent {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]peerAuditEvent{}, l.events[p]...)
+}
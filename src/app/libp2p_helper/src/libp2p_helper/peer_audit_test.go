@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerAuditLog(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newPeerAuditLog()
+	l.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	for i := 0; i < maxPeerAuditEvents+2; i++ {
+		l.Record(peer.ID("a"), ipc.Libp2pHelperInterface_PeerAuditEventKind_validationRejected, fmt.Sprint(i))
+	}
+	l.Record(peer.ID("b"), ipc.Libp2pHelperInterface_PeerAuditEventKind_oversizedMessage, "topic")
+	// Oldest events of a peer are dropped
+	events := l.Events(peer.ID("a"))
+	require.Len(t, events, maxPeerAuditEvents)
+	require.Equal(t, "2", events[0].detail)
+	require.Equal(t, fmt.Sprint(maxPeerAuditEvents+1), events[len(events)-1].detail)
+	require.Equal(t, []peerAuditEvent{{at: now, kind: ipc.Libp2pHelperInterface_PeerAuditEventKind_oversizedMessage, detail: "topic"}},
+		l.Events(peer.ID("b")))
+	require.Empty(t, l.Events(peer.ID("c")))
+
+	// Peer with the least recent event is forgotten once the log is full
+	for i := 0; i < maxAuditedPeers-2; i++ {
+		l.Record(peer.ID(fmt.Sprint("p", i)), ipc.Libp2pHelperInterface_PeerAuditEventKind_bitswapOverLimit, "")
+	}
+	l.Record(peer.ID("a"), ipc.Libp2pHelperInterface_PeerAuditEventKind_validationRejected, "")
+	l.Record(peer.ID("c"), ipc.Libp2pHelperInterface_PeerAuditEventKind_protocolNegotiationFailed, "bitswap")
+	require.Empty(t, l.Events(peer.ID("b")))
+	require.NotEmpty(t, l.Events(peer.ID("a")))
+	require.Len(t, l.Events(peer.ID("c")), 1)
+}
@@ -11,6 +11,7 @@ import (
 
 	capnp "capnproto.org/go/capnp/v3"
 	"github.com/go-errors/errors"
+	peer "github.com/libp2p/go-libp2p-core/peer"
 	peerstore "github.com/libp2p/go-libp2p-core/peerstore"
 )
 
@@ -52,10 +53,11 @@ func (m AddPeerReq) handle(app *app, seqno uint64) *capnp.Message {
 		app.P2p.Seeds = append(app.P2p.Seeds, *info)
 	}
 
-	err = app.P2p.Host.Connect(app.Ctx, *info)
+	rung, err := app.dialLadder.Connect(app.Ctx, app.P2p.Host, *info)
 	if err != nil {
 		return mkRpcRespError(seqno, badp2p(err))
 	}
+	app.P2p.Logger.Infof("addPeer connected to %s using %s rung", info.ID, rung)
 
 	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
 		_, err := m.NewAddPeer()
@@ -172,3 +174,138 @@ func (msg ListPeersReq) handle(app *app, seqno uint64) *capnp.Message {
 		setPeerInfoList(lst, peerInfos)
 	})
 }
+
+type ListConnectionRungsReqT = ipc.Libp2pHelperInterface_ListConnectionRungs_Request
+type ListConnectionRungsReq ListConnectionRungsReqT
+
+func fromListConnectionRungsReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.ListConnectionRungs()
+	return ListConnectionRungsReq(i), err
+}
+func (msg ListConnectionRungsReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+
+	conns := app.P2p.Host.Network().Conns()
+
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		r, err := m.NewListConnectionRungs()
+		panicOnErr(err)
+		lst, err := r.NewResult(int32(len(conns)))
+		panicOnErr(err)
+		for i, conn := range conns {
+			cr := lst.At(i)
+			pid, err := cr.NewPeerId()
+			panicOnErr(err)
+			panicOnErr(pid.SetId(peer.Encode(conn.RemotePeer())))
+			cr.SetRung(app.dialLadder.Rung(conn))
+		}
+	})
+}
+
+type ListDialScoresReqT = ipc.Libp2pHelperInterface_ListDialScores_Request
+type ListDialScoresReq ListDialScoresReqT
+
+func fromListDialScoresReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.ListDialScores()
+	return ListDialScoresReq(i), err
+}
+func (msg ListDialScoresReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+
+	scores := app.dialLadder.scoreboard.Scores()
+
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		r, err := m.NewListDialScores()
+		panicOnErr(err)
+		lst, err := r.NewResult(int32(len(scores)))
+		panicOnErr(err)
+		for i, score := range scores {
+			s := lst.At(i)
+			panicOnErr(s.SetTransport(score.class.transport))
+			panicOnErr(s.SetFamily(score.class.family))
+			s.SetAttempts(score.attempts)
+			s.SetSuccesses(score.successes)
+		}
+	})
+}
+
+type ListPeerAgentsReqT = ipc.Libp2pHelperInterface_ListPeerAgents_Request
+type ListPeerAgentsReq ListPeerAgentsReqT
+
+func fromListPeerAgentsReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.ListPeerAgents()
+	return ListPeerAgentsReq(i), err
+}
+func (msg ListPeerAgentsReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+
+	peers := app.P2p.Host.Network().Peers()
+
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		r, err := m.NewListPeerAgents()
+		panicOnErr(err)
+		lst, err := r.NewResult(int32(len(peers)))
+		panicOnErr(err)
+		for i, p := range peers {
+			pa := lst.At(i)
+			pid, err := pa.NewPeerId()
+			panicOnErr(err)
+			panicOnErr(pid.SetId(peer.Encode(p)))
+			agentVersion := app.peerAgentVersion(p)
+			panicOnErr(pa.SetAgentVersion(agentVersion))
+			agent, recognized := parseAgentVersion(agentVersion)
+			pa.SetRecognized(recognized)
+			am, err := pa.NewAgent()
+			panicOnErr(err)
+			setAgentInfo(am, agent)
+		}
+	})
+}
+
+type ListPeerAuditEventsReqT = ipc.Libp2pHelperInterface_ListPeerAuditEvents_Request
+type ListPeerAuditEventsReq ListPeerAuditEventsReqT
+
+func fromListPeerAuditEventsReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.ListPeerAuditEvents()
+	return ListPeerAuditEventsReq(i), err
+}
+func (msg ListPeerAuditEventsReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	pid, err := ListPeerAuditEventsReqT(msg).PeerId()
+	var id string
+	if err == nil {
+		id, err = pid.Id()
+	}
+	var p peer.ID
+	if err == nil {
+		p, err = peer.Decode(id)
+	}
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+
+	events := app.peerAudit.Events(p)
+
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		r, err := m.NewListPeerAuditEvents()
+		panicOnErr(err)
+		lst, err := r.NewResult(int32(len(events)))
+		panicOnErr(err)
+		for i, e := range events {
+			em := lst.At(i)
+			at, err := em.NewAt()
+			panicOnErr(err)
+			setNanoTime(&at, e.at)
+			em.SetKind(e.kind)
+			panicOnErr(em.SetDetail(e.detail))
+		}
+	})
+}
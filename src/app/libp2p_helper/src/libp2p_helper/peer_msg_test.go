@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -55,6 +56,142 @@ func TestAddPeer(t *testing.T) {
 	_, _, _ = testAddPeerImpl(t)
 }
 
+func TestListConnectionRungs(t *testing.T) {
+	appA, _, appB := testAddPeerImpl(t)
+
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	m, err := ipc.NewRootLibp2pHelperInterface_ListConnectionRungs_Request(seg)
+	require.NoError(t, err)
+
+	var mRpcSeqno uint64 = 2001
+	resMsg := ListConnectionRungsReq(m).handle(appB, mRpcSeqno)
+	seqno, respSuccess := checkRpcResponseSuccess(t, resMsg, "listConnectionRungs")
+	require.Equal(t, seqno, mRpcSeqno)
+	require.True(t, respSuccess.HasListConnectionRungs())
+	res, err := respSuccess.ListConnectionRungs()
+	require.NoError(t, err)
+	rungs, err := res.Result()
+	require.NoError(t, err)
+	require.Equal(t, 1, rungs.Len())
+	pid, err := rungs.At(0).PeerId()
+	require.NoError(t, err)
+	id, err := pid.Id()
+	require.NoError(t, err)
+	require.Equal(t, peer.Encode(appA.P2p.Host.ID()), id)
+	// Without relays configured the only rung is the direct dial
+	require.Equal(t, ipc.DialRung_direct, rungs.At(0).Rung())
+}
+
+func TestListDialScores(t *testing.T) {
+	codanet.NoDHT = true
+	defer func() {
+		codanet.NoDHT = false
+	}()
+
+	appA, _ := newTestApp(t, nil, true)
+	appAInfos, err := addrInfos(appA.P2p.Host)
+	require.NoError(t, err)
+	appB, _ := newTestApp(t, nil, true)
+	testAddPeerImplDo(t, appB, appAInfos[0], false)
+
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	m, err := ipc.NewRootLibp2pHelperInterface_ListDialScores_Request(seg)
+	require.NoError(t, err)
+
+	var mRpcSeqno uint64 = 2002
+	resMsg := ListDialScoresReq(m).handle(appB, mRpcSeqno)
+	seqno, respSuccess := checkRpcResponseSuccess(t, resMsg, "listDialScores")
+	require.Equal(t, seqno, mRpcSeqno)
+	require.True(t, respSuccess.HasListDialScores())
+	res, err := respSuccess.ListDialScores()
+	require.NoError(t, err)
+	scores, err := res.Result()
+	require.NoError(t, err)
+	require.Equal(t, 1, scores.Len())
+	transport, err := scores.At(0).Transport()
+	require.NoError(t, err)
+	require.Equal(t, "tcp", transport)
+	family, err := scores.At(0).Family()
+	require.NoError(t, err)
+	require.Equal(t, "ip4", family)
+	require.Equal(t, uint64(1), scores.At(0).Attempts())
+	require.Equal(t, uint64(1), scores.At(0).Successes())
+}
+
+func TestListPeerAgents(t *testing.T) {
+	codanet.NoDHT = true
+	defer func() {
+		codanet.NoDHT = false
+	}()
+
+	appA, _ := newTestApp(t, nil, true)
+	appAInfos, err := addrInfos(appA.P2p.Host)
+	require.NoError(t, err)
+	appB, _ := newTestApp(t, nil, true)
+	require.NoError(t, appB.P2p.Host.Connect(appB.Ctx, appAInfos[0]))
+	require.Eventually(t, func() bool {
+		return appB.peerAgentVersion(appA.P2p.Me) != ""
+	}, 10*time.Second, 100*time.Millisecond)
+
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	m, err := ipc.NewRootLibp2pHelperInterface_ListPeerAgents_Request(seg)
+	require.NoError(t, err)
+
+	var mRpcSeqno uint64 = 2003
+	resMsg := ListPeerAgentsReq(m).handle(appB, mRpcSeqno)
+	seqno, respSuccess := checkRpcResponseSuccess(t, resMsg, "listPeerAgents")
+	require.Equal(t, seqno, mRpcSeqno)
+	require.True(t, respSuccess.HasListPeerAgents())
+	res, err := respSuccess.ListPeerAgents()
+	require.NoError(t, err)
+	agents, err := res.Result()
+	require.NoError(t, err)
+	require.Equal(t, 1, agents.Len())
+	pid, err := agents.At(0).PeerId()
+	require.NoError(t, err)
+	id, err := pid.Id()
+	require.NoError(t, err)
+	require.Equal(t, peer.Encode(appA.P2p.Me), id)
+	agentVersion, err := agents.At(0).AgentVersion()
+	require.NoError(t, err)
+	// Test helpers advertise the default agent version
+	require.Equal(t, codanet.DefaultAgentVersion, agentVersion)
+	require.False(t, agents.At(0).Recognized())
+}
+
+func TestListPeerAuditEvents(t *testing.T) {
+	app, _ := newTestApp(t, nil, true)
+	other, err := peer.IDFromPrivateKey(newTestKey(t))
+	require.NoError(t, err)
+	app.peerAudit.Record(other, ipc.Libp2pHelperInterface_PeerAuditEventKind_oversizedMessage, "topic: 100 bytes")
+
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	m, err := ipc.NewRootLibp2pHelperInterface_ListPeerAuditEvents_Request(seg)
+	require.NoError(t, err)
+	pid, err := m.NewPeerId()
+	require.NoError(t, err)
+	require.NoError(t, pid.SetId(peer.Encode(other)))
+
+	var mRpcSeqno uint64 = 2004
+	resMsg := ListPeerAuditEventsReq(m).handle(app, mRpcSeqno)
+	seqno, respSuccess := checkRpcResponseSuccess(t, resMsg, "listPeerAuditEvents")
+	require.Equal(t, seqno, mRpcSeqno)
+	require.True(t, respSuccess.HasListPeerAuditEvents())
+	res, err := respSuccess.ListPeerAuditEvents()
+	require.NoError(t, err)
+	events, err := res.Result()
+	require.NoError(t, err)
+	require.Equal(t, 1, events.Len())
+	require.Equal(t, ipc.Libp2pHelperInterface_PeerAuditEventKind_oversizedMessage, events.At(0).Kind())
+	detail, err := events.At(0).Detail()
+	require.NoError(t, err)
+	require.Equal(t, "topic: 100 bytes", detail)
+}
+
 func TestGetPeerNodeStatus(t *testing.T) {
 	codanet.NoDHT = true
 	defer func() {
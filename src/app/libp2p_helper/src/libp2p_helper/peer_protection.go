@@ -0,0 +1,116 @@
+package main
+
+import (
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Prefix of tags peers are protected and tagged with by the daemon, so
+// that they don't clash with tags of the helper (e.g. directPeerTag)
+const daemonTagPrefix = "daemon:"
+
+type peerTagRequest interface {
+	PeerId() (ipc.PeerId, error)
+	Tag() (string, error)
+}
+
+// readPeerTag returns the peer of the request along with its tag
+// prefixed with daemonTagPrefix, an empty tag is replaced with "default"
+func readPeerTag(m peerTagRequest) (peer.ID, string, error) {
+	pid, err := m.PeerId()
+	var id string
+	if err == nil {
+		id, err = pid.Id()
+	}
+	var p peer.ID
+	if err == nil {
+		p, err = peer.Decode(id)
+	}
+	var tag string
+	if err == nil {
+		tag, err = m.Tag()
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if tag == "" {
+		tag = "default"
+	}
+	return p, daemonTagPrefix + tag, nil
+}
+
+type ProtectPeerReqT = ipc.Libp2pHelperInterface_ProtectPeer_Request
+type ProtectPeerReq ProtectPeerReqT
+
+func fromProtectPeerReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.ProtectPeer()
+	return ProtectPeerReq(i), err
+}
+
+func (m ProtectPeerReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	p, tag, err := readPeerTag(ProtectPeerReqT(m))
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	app.P2p.ConnectionManager.Protect(p, tag)
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewProtectPeer()
+		panicOnErr(err)
+	})
+}
+
+type UnprotectPeerReqT = ipc.Libp2pHelperInterface_UnprotectPeer_Request
+type UnprotectPeerReq UnprotectPeerReqT
+
+func fromUnprotectPeerReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.UnprotectPeer()
+	return UnprotectPeerReq(i), err
+}
+
+func (m UnprotectPeerReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	p, tag, err := readPeerTag(UnprotectPeerReqT(m))
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	protected := app.P2p.ConnectionManager.Unprotect(p, tag)
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		r, err := m.NewUnprotectPeer()
+		panicOnErr(err)
+		r.SetProtected(protected)
+	})
+}
+
+type TagPeerReqT = ipc.Libp2pHelperInterface_TagPeer_Request
+type TagPeerReq TagPeerReqT
+
+func fromTagPeerReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.TagPeer()
+	return TagPeerReq(i), err
+}
+
+func (m TagPeerReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	p, tag, err := readPeerTag(TagPeerReqT(m))
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	if weight := int(TagPeerReqT(m).Weight()); weight == 0 {
+		app.P2p.ConnectionManager.UntagPeer(p, tag)
+	} else {
+		app.P2p.ConnectionManager.TagPeer(p, tag, weight)
+	}
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewTagPeer()
+		panicOnErr(err)
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func testProtectPeer(t *testing.T, app *app, p peer.ID, tag string) {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	m, err := ipc.NewRootLibp2pHelperInterface_ProtectPeer_Request(seg)
+	require.NoError(t, err)
+	pid, err := m.NewPeerId()
+	require.NoError(t, err)
+	require.NoError(t, pid.SetId(peer.Encode(p)))
+	require.NoError(t, m.SetTag(tag))
+
+	var mRpcSeqno uint64 = 2300
+	resMsg := ProtectPeerReq(m).handle(app, mRpcSeqno)
+	seqno, respSuccess := checkRpcResponseSuccess(t, resMsg, "protectPeer")
+	require.Equal(t, seqno, mRpcSeqno)
+	require.True(t, respSuccess.HasProtectPeer())
+}
+
+func testUnprotectPeer(t *testing.T, app *app, p peer.ID, tag string) bool {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	m, err := ipc.NewRootLibp2pHelperInterface_UnprotectPeer_Request(seg)
+	require.NoError(t, err)
+	pid, err := m.NewPeerId()
+	require.NoError(t, err)
+	require.NoError(t, pid.SetId(peer.Encode(p)))
+	require.NoError(t, m.SetTag(tag))
+
+	var mRpcSeqno uint64 = 2301
+	resMsg := UnprotectPeerReq(m).handle(app, mRpcSeqno)
+	seqno, respSuccess := checkRpcResponseSuccess(t, resMsg, "unprotectPeer")
+	require.Equal(t, seqno, mRpcSeqno)
+	require.True(t, respSuccess.HasUnprotectPeer())
+	resp, err := respSuccess.UnprotectPeer()
+	require.NoError(t, err)
+	return resp.Protected()
+}
+
+func testTagPeer(t *testing.T, app *app, p peer.ID, tag string, weight int32) {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	m, err := ipc.NewRootLibp2pHelperInterface_TagPeer_Request(seg)
+	require.NoError(t, err)
+	pid, err := m.NewPeerId()
+	require.NoError(t, err)
+	require.NoError(t, pid.SetId(peer.Encode(p)))
+	require.NoError(t, m.SetTag(tag))
+	m.SetWeight(weight)
+
+	var mRpcSeqno uint64 = 2302
+	resMsg := TagPeerReq(m).handle(app, mRpcSeqno)
+	seqno, respSuccess := checkRpcResponseSuccess(t, resMsg, "tagPeer")
+	require.Equal(t, seqno, mRpcSeqno)
+	require.True(t, respSuccess.HasTagPeer())
+}
+
+func TestPeerProtection(t *testing.T) {
+	testApp, _ := newTestApp(t, nil, true)
+	other, _ := newTestApp(t, nil, true)
+	p := other.P2p.Me
+	cm := testApp.P2p.ConnectionManager
+
+	testProtectPeer(t, testApp, p, "snark-coordinator")
+	testProtectPeer(t, testApp, p, "")
+	require.True(t, cm.IsProtected(p, "daemon:snark-coordinator"))
+	require.True(t, cm.IsProtected(p, "daemon:default"))
+
+	// Tags of the helper can't be removed by the daemon
+	cm.Protect(p, directPeerTag)
+	require.True(t, testUnprotectPeer(t, testApp, p, "snark-coordinator"))
+	require.True(t, testUnprotectPeer(t, testApp, p, "direct-peer"))
+	require.True(t, testUnprotectPeer(t, testApp, p, ""))
+	require.True(t, cm.IsProtected(p, directPeerTag))
+	require.False(t, cm.IsProtected(p, "daemon:snark-coordinator"))
+	require.False(t, cm.Unprotect(p, directPeerTag))
+}
+
+func TestTagPeer(t *testing.T) {
+	testApp, _ := newTestApp(t, nil, true)
+	other, _ := newTestApp(t, nil, true)
+	p := other.P2p.Me
+	cm := testApp.P2p.ConnectionManager
+
+	// Tags of disconnected peers aren't kept by the connection manager
+	otherInfos, err := addrInfos(other.P2p.Host)
+	require.NoError(t, err)
+	require.NoError(t, testApp.P2p.Host.Connect(testApp.Ctx, otherInfos[0]))
+
+	testTagPeer(t, testApp, p, "archive", 50)
+	require.Equal(t, 50, cm.GetTagInfo(p).Tags["daemon:archive"])
+	testTagPeer(t, testApp, p, "archive", -10)
+	require.Equal(t, -10, cm.GetTagInfo(p).Tags["daemon:archive"])
+	testTagPeer(t, testApp, p, "archive", 0)
+	_, has := cm.GetTagInfo(p).Tags["daemon:archive"]
+	require.False(t, has)
+}
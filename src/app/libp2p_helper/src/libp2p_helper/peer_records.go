@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	peerstore "github.com/libp2p/go-libp2p-core/peerstore"
+)
+
+type peerRecord struct {
+	id       peer.ID
+	rec      *peer.PeerRecord
+	envelope []byte
+}
+
+// peerRecords returns signed records of the peers known, of all
+// peers of the peerstore if none are given
+func (app *app) peerRecords(peers []peer.ID) ([]peerRecord, error) {
+	if len(peers) == 0 {
+		peers = app.P2p.Host.Peerstore().PeersWithAddrs()
+	}
+	res := make([]peerRecord, 0, len(peers))
+	for _, p := range peers {
+		envelope := app.P2p.PeerRecord(p)
+		if envelope == nil {
+			continue
+		}
+		r, err := envelope.Record()
+		if err != nil {
+			return nil, err
+		}
+		rec, ok := r.(*peer.PeerRecord)
+		if !ok {
+			return nil, errors.New("envelope doesn't contain a peer record")
+		}
+		data, err := envelope.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, peerRecord{id: p, rec: rec, envelope: data})
+	}
+	return res, nil
+}
+
+type GetPeerRecordsReqT = ipc.Libp2pHelperInterface_GetPeerRecords_Request
+type GetPeerRecordsReq GetPeerRecordsReqT
+
+func fromGetPeerRecordsReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.GetPeerRecords()
+	return GetPeerRecordsReq(i), err
+}
+
+func (m GetPeerRecordsReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	peersL, err := GetPeerRecordsReqT(m).Peers()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	peers := make([]peer.ID, 0, peersL.Len())
+	err = capnpPeerIdListForeach(peersL, func(id string) error {
+		p, err := peer.Decode(id)
+		if err == nil {
+			peers = append(peers, p)
+		}
+		return err
+	})
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	records, err := app.peerRecords(peers)
+	if err != nil {
+		return mkRpcRespError(seqno, badp2p(err))
+	}
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		r, err := m.NewGetPeerRecords()
+		panicOnErr(err)
+		lst, err := r.NewRecords(int32(len(records)))
+		panicOnErr(err)
+		for i, record := range records {
+			mr := lst.At(i)
+			pid, err := mr.NewPeerId()
+			panicOnErr(err)
+			panicOnErr(pid.SetId(peer.Encode(record.id)))
+			mr.SetSeq(record.rec.Seq)
+			addrs, err := mr.NewAddrs(int32(len(record.rec.Addrs)))
+			panicOnErr(err)
+			setMultiaddrList(addrs, record.rec.Addrs)
+			panicOnErr(mr.SetEnvelope(record.envelope))
+		}
+	})
+}
+
+type AddPeerRecordsReqT = ipc.Libp2pHelperInterface_AddPeerRecords_Request
+type AddPeerRecordsReq AddPeerRecordsReqT
+
+func fromAddPeerRecordsReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.AddPeerRecords()
+	return AddPeerRecordsReq(i), err
+}
+
+func (m AddPeerRecordsReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	envelopes, err := AddPeerRecordsReqT(m).Envelopes()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	added := make([]peer.ID, 0, envelopes.Len())
+	for i := 0; i < envelopes.Len(); i++ {
+		data, err := envelopes.At(i)
+		if err != nil {
+			return mkRpcRespError(seqno, badRPC(err))
+		}
+		// Records persisted by the daemon are of trusted peers
+		p, ok, err := app.P2p.ConsumePeerRecord(data, peerstore.PermanentAddrTTL)
+		if err != nil {
+			return mkRpcRespError(seqno, badRPC(err))
+		}
+		if ok {
+			added = append(added, p)
+		}
+	}
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		r, err := m.NewAddPeerRecords()
+		panicOnErr(err)
+		lst, err := r.NewAdded(int32(len(added)))
+		panicOnErr(err)
+		for i, p := range added {
+			panicOnErr(lst.At(i).SetId(peer.Encode(p)))
+		}
+	})
+}
+
+type RequestPeerRecordsReqT = ipc.Libp2pHelperInterface_RequestPeerRecords_Request
+type RequestPeerRecordsReq RequestPeerRecordsReqT
+
+func fromRequestPeerRecordsReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.RequestPeerRecords()
+	return RequestPeerRecordsReq(i), err
+}
+
+func (m RequestPeerRecordsReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	pid, err := RequestPeerRecordsReqT(m).PeerId()
+	var id string
+	if err == nil {
+		id, err = pid.Id()
+	}
+	var p peer.ID
+	if err == nil {
+		p, err = peer.Decode(id)
+	}
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	added, err := app.P2p.RequestPeerRecords(app.Ctx, p, int(RequestPeerRecordsReqT(m).Count()))
+	if err != nil {
+		return mkRpcRespError(seqno, badp2p(err))
+	}
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		r, err := m.NewRequestPeerRecords()
+		panicOnErr(err)
+		lst, err := r.NewAdded(int32(len(added)))
+		panicOnErr(err)
+		for i, p := range added {
+			panicOnErr(lst.At(i).SetId(peer.Encode(p)))
+		}
+	})
+}
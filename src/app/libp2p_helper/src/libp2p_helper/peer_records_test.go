@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	peerstore "github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerRecords(t *testing.T) {
+	alice, _ := newTestApp(t, nil, true)
+	bob, _ := newTestApp(t, nil, true)
+
+	// The host signs a record of its listen addresses
+	var records []peerRecord
+	require.Eventually(t, func() bool {
+		var err error
+		records, err = alice.peerRecords([]peer.ID{alice.P2p.Me})
+		require.NoError(t, err)
+		return len(records) == 1
+	}, 10*time.Second, 100*time.Millisecond)
+	require.Equal(t, alice.P2p.Me, records[0].id)
+	require.NotEmpty(t, records[0].rec.Addrs)
+
+	records, err := bob.peerRecords([]peer.ID{alice.P2p.Me})
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	_, _, err = bob.P2p.ConsumePeerRecord([]byte("not an envelope"), peerstore.PermanentAddrTTL)
+	require.Error(t, err)
+
+	aliceRecords, err := alice.peerRecords([]peer.ID{alice.P2p.Me})
+	require.NoError(t, err)
+	p, added, err := bob.P2p.ConsumePeerRecord(aliceRecords[0].envelope, peerstore.PermanentAddrTTL)
+	require.NoError(t, err)
+	require.True(t, added)
+	require.Equal(t, alice.P2p.Me, p)
+
+	records, err = bob.peerRecords(nil)
+	require.NoError(t, err)
+	var found bool
+	for _, r := range records {
+		if r.id == alice.P2p.Me {
+			found = true
+			require.Equal(t, aliceRecords[0].rec.Seq, r.rec.Seq)
+			require.Equal(t, aliceRecords[0].envelope, r.envelope)
+		}
+	}
+	require.True(t, found)
+}
+
+func TestRequestPeerRecords(t *testing.T) {
+	alice, _ := newTestApp(t, nil, true)
+	bob, _ := newTestApp(t, nil, true)
+	carol, _ := newTestApp(t, nil, true)
+
+	carolInfos, err := addrInfos(carol.P2p.Host)
+	require.NoError(t, err)
+	require.NoError(t, bob.P2p.Host.Connect(bob.Ctx, carolInfos[0]))
+	require.Eventually(t, func() bool {
+		return bob.P2p.PeerRecord(carol.P2p.Me) != nil
+	}, 10*time.Second, 100*time.Millisecond)
+	bobInfos, err := addrInfos(bob.P2p.Host)
+	require.NoError(t, err)
+	require.NoError(t, alice.P2p.Host.Connect(alice.Ctx, bobInfos[0]))
+
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	m, err := ipc.NewRootLibp2pHelperInterface_RequestPeerRecords_Request(seg)
+	require.NoError(t, err)
+	pid, err := m.NewPeerId()
+	require.NoError(t, err)
+	require.NoError(t, pid.SetId(peer.Encode(bob.P2p.Me)))
+	m.SetCount(10)
+
+	var mRpcSeqno uint64 = 2600
+	resMsg := RequestPeerRecordsReq(m).handle(alice, mRpcSeqno)
+	seqno, respSuccess := checkRpcResponseSuccess(t, resMsg, "requestPeerRecords")
+	require.Equal(t, seqno, mRpcSeqno)
+	require.True(t, respSuccess.HasRequestPeerRecords())
+	resp, err := respSuccess.RequestPeerRecords()
+	require.NoError(t, err)
+	added, err := resp.Added()
+	require.NoError(t, err)
+	// Records of the requester and of the responder itself aren't sent
+	require.Equal(t, 1, added.Len())
+	id, err := added.At(0).Id()
+	require.NoError(t, err)
+	require.Equal(t, peer.Encode(carol.P2p.Me), id)
+	require.NotNil(t, alice.P2p.PeerRecord(carol.P2p.Me))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Publish calls of a topic waiting for their turn at most,
+// further calls above the limits fail
+const maxQueuedPublishes = 256
+
+var (
+	errPublishLimited = errors.New("publishing limit of the topic exceeded")
+	// message above the limits is dropped silently
+	errPublishDropped = errors.New("message above publishing limit of the topic dropped")
+)
+
+var publishLimitedMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "Mina_libp2p_publish_limited",
+	Help: "Number of messages published above the publishing limits of their topic, by the action taken",
+}, []string{"topic", "action"})
+
+// publishLimiter keeps token buckets of messages and bytes published to
+// a topic, so that a misbehaving daemon can't flood the network with
+// gossip. Each bucket holds a second's worth of tokens. A message is
+// admitted while the byte bucket isn't empty, taking it into debt if
+// the message is larger, so that messages larger than a second's worth
+// of bytes (e.g. blocks) still get through. Queued messages reserve
+// their tokens in advance, leaving buckets in debt until their turn.
+type publishLimiter struct {
+	topic string
+	// zero means no limit
+	rate, byteRate     float64
+	overflow           ipc.PublishOverflow
+	tokens, byteTokens float64
+	last               time.Time
+	queued             int
+	now                func() time.Time
+	mutex              sync.Mutex
+}
+
+func newPublishLimiter(topic string) *publishLimiter {
+	return &publishLimiter{topic: topic, now: time.Now}
+}
+
+// Configure replaces the limits, buckets start full
+func (l *publishLimiter) Configure(rate float64, byteRate float64, overflow ipc.PublishOverflow) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.rate, l.byteRate, l.overflow = rate, byteRate, overflow
+	l.tokens = math.Max(1, math.Ceil(rate))
+	l.byteTokens = byteRate
+	l.last = l.now()
+}
+
+// Admit takes tokens for a message of the given size, the message is
+// to be published after the returned delay. Depending on the overflow
+// of the topic, errPublishDropped or errPublishLimited is returned
+// instead if the message is above the limits. Done is to be called
+// once the delay of an admitted message passes.
+func (l *publishLimiter) Admit(size int) (time.Duration, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	if now.After(l.last) {
+		elapsed := now.Sub(l.last).Seconds()
+		l.tokens = math.Min(math.Max(1, math.Ceil(l.rate)), l.tokens+elapsed*l.rate)
+		l.byteTokens = math.Min(l.byteRate, l.byteTokens+elapsed*l.byteRate)
+		l.last = now
+	}
+	var delay time.Duration
+	if l.rate > 0 && l.tokens < 1 {
+		delay = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	}
+	if l.byteRate > 0 && l.byteTokens <= 0 {
+		// a byte worth of tokens admits a message
+		if byteDelay := time.Duration((1 - l.byteTokens) / l.byteRate * float64(time.Second)); byteDelay > delay {
+			delay = byteDelay
+		}
+	}
+	if delay > 0 {
+		switch {
+		case l.overflow == ipc.PublishOverflow_drop:
+			publishLimitedMetric.WithLabelValues(l.topic, "dropped").Inc()
+			return 0, errPublishDropped
+		case l.overflow == ipc.PublishOverflow_error || l.queued >= maxQueuedPublishes:
+			publishLimitedMetric.WithLabelValues(l.topic, "rejected").Inc()
+			return 0, errPublishLimited
+		}
+		publishLimitedMetric.WithLabelValues(l.topic, "queued").Inc()
+		l.queued++
+	}
+	if l.rate > 0 {
+		l.tokens--
+	}
+	if l.byteRate > 0 {
+		l.byteTokens -= float64(size)
+	}
+	return delay, nil
+}
+
+// Done ends waiting of a message admitted with a delay
+func (l *publishLimiter) Done(delay time.Duration) {
+	if delay == 0 {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.queued--
+}
+
+func (app *app) publishLimiter(topic string) *publishLimiter {
+	app.publishLimitersMutex.Lock()
+	defer app.publishLimitersMutex.Unlock()
+	if app.publishLimiters == nil {
+		app.publishLimiters = make(map[string]*publishLimiter)
+	}
+	l, has := app.publishLimiters[topic]
+	if !has {
+		l = newPublishLimiter(topic)
+		app.publishLimiters[topic] = l
+	}
+	return l
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishLimiter(t *testing.T) {
+	l := newPublishLimiter("test")
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	// No limit until configured
+	for i := 0; i < 10; i++ {
+		delay, err := l.Admit(1000)
+		require.NoError(t, err)
+		require.Zero(t, delay)
+	}
+
+	l.Configure(2, 0, ipc.PublishOverflow_error)
+	for i := 0; i < 2; i++ {
+		_, err := l.Admit(1000)
+		require.NoError(t, err)
+	}
+	_, err := l.Admit(1000)
+	require.Equal(t, errPublishLimited, err)
+	now = now.Add(500 * time.Millisecond)
+	_, err = l.Admit(1000)
+	require.NoError(t, err)
+
+	l.Configure(2, 0, ipc.PublishOverflow_drop)
+	for i := 0; i < 2; i++ {
+		_, err := l.Admit(1000)
+		require.NoError(t, err)
+	}
+	_, err = l.Admit(1000)
+	require.Equal(t, errPublishDropped, err)
+
+	// Queued messages reserve their turns
+	l.Configure(2, 0, ipc.PublishOverflow_queue)
+	for i := 0; i < 2; i++ {
+		delay, err := l.Admit(1000)
+		require.NoError(t, err)
+		require.Zero(t, delay)
+	}
+	delay1, err := l.Admit(1000)
+	require.NoError(t, err)
+	require.Equal(t, 500*time.Millisecond, delay1)
+	delay2, err := l.Admit(1000)
+	require.NoError(t, err)
+	require.Equal(t, time.Second, delay2)
+	l.Done(delay1)
+	l.Done(delay2)
+	require.Zero(t, l.queued)
+}
+
+func TestPublishLimiterBytes(t *testing.T) {
+	l := newPublishLimiter("test")
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	l.Configure(0, 1000, ipc.PublishOverflow_error)
+
+	// Messages larger than a second's worth of bytes get through
+	_, err := l.Admit(5000)
+	require.NoError(t, err)
+	_, err = l.Admit(1)
+	require.Equal(t, errPublishLimited, err)
+	now = now.Add(4 * time.Second)
+	_, err = l.Admit(1)
+	require.Equal(t, errPublishLimited, err)
+	now = now.Add(time.Second)
+	_, err = l.Admit(1)
+	require.NoError(t, err)
+}
+
+func TestPublishLimiterQueueBound(t *testing.T) {
+	l := newPublishLimiter("test")
+	l.Configure(1, 0, ipc.PublishOverflow_queue)
+	_, err := l.Admit(1)
+	require.NoError(t, err)
+	for i := 0; i < maxQueuedPublishes; i++ {
+		delay, err := l.Admit(1)
+		require.NoError(t, err)
+		require.Positive(t, delay)
+	}
+	_, err = l.Admit(1)
+	require.Equal(t, errPublishLimited, err)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	ipc "libp2p_ipc"
@@ -35,12 +36,17 @@ func (m ValidationPush) handle(app *app) {
 		app.P2p.Logger.Errorf("handleValidation: error %w", err)
 		return
 	}
-	seqno := vid.Id()
+	app.completeValidation(vid.Id(), ValidationPushT(m).Result())
+}
+
+// completeValidation passes the verdict of the daemon to the validator
+// of the message
+func (app *app) completeValidation(seqno uint64, result ipc.ValidationResult) {
 	app.ValidatorMutex.Lock()
 	defer app.ValidatorMutex.Unlock()
 	if st, ok := app.Validators[seqno]; ok {
 		res := ValidationUnknown
-		switch ValidationPushT(m).Result() {
+		switch result {
 		case ipc.ValidationResult_accept:
 			res = pubsub.ValidationAccept
 		case ipc.ValidationResult_reject:
@@ -48,7 +54,7 @@ func (m ValidationPush) handle(app *app) {
 		case ipc.ValidationResult_ignore:
 			res = pubsub.ValidationIgnore
 		default:
-			app.P2p.Logger.Warnf("handleValidation: unknown validation result %d", ValidationPushT(m).Result())
+			app.P2p.Logger.Warnf("handleValidation: unknown validation result %d", result)
 		}
 		st.Completion <- res
 		if st.TimedOutAt != nil {
@@ -75,9 +81,6 @@ func (m PublishReq) handle(app *app, seqno uint64) *capnp.Message {
 		return mkRpcRespError(seqno, needsDHT())
 	}
 
-	var topic *pubsub.Topic
-	var has bool
-
 	topicName, err := PublishReqT(m).Topic()
 	if err != nil {
 		return mkRpcRespError(seqno, badRPC(err))
@@ -87,16 +90,34 @@ func (m PublishReq) handle(app *app, seqno uint64) *capnp.Message {
 		return mkRpcRespError(seqno, badRPC(err))
 	}
 
-	if topic, has = app.Topics[topicName]; !has {
-		topic, err = app.P2p.Pubsub.Join(topicName)
-		if err != nil {
-			return mkRpcRespError(seqno, badp2p(err))
-		}
-		app.Topics[topicName] = topic
+	topic, err := app.joinTopic(topicName)
+	if err != nil {
+		return mkRpcRespError(seqno, err)
 	}
 
-	if err := topic.Publish(app.Ctx, data); err != nil {
-		return mkRpcRespError(seqno, badp2p(err))
+	if app.topicSpecs.Compressed(topicName) {
+		data = encodeGossip(data)
+	}
+
+	limiter := app.publishLimiter(topicName)
+	delay, err := limiter.Admit(len(data))
+	switch err {
+	case errPublishLimited:
+		return mkRpcRespError(seqno, badRPC(err))
+	case errPublishDropped:
+		app.P2p.Logger.Debugf("publishing to %s is limited, message is dropped", topicName)
+	default:
+		if delay > 0 {
+			app.P2p.Logger.Debugf("publishing to %s is limited, message is delayed by %s", topicName, delay)
+			select {
+			case <-app.Ctx.Done():
+			case <-time.After(delay):
+			}
+			limiter.Done(delay)
+		}
+		if err := topic.Publish(app.Ctx, data); err != nil {
+			return mkRpcRespError(seqno, badp2p(err))
+		}
 	}
 
 	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
@@ -105,6 +126,19 @@ func (m PublishReq) handle(app *app, seqno uint64) *capnp.Message {
 	})
 }
 
+// joinTopic returns the topic, joining it unless joined already
+func (app *app) joinTopic(topicName string) (*pubsub.Topic, error) {
+	if topic, has := app.Topics[topicName]; has {
+		return topic, nil
+	}
+	topic, err := app.P2p.Pubsub.Join(topicName)
+	if err != nil {
+		return nil, badp2p(err)
+	}
+	app.Topics[topicName] = topic
+	return topic, nil
+}
+
 type SubscribeReqT = ipc.Libp2pHelperInterface_Subscribe_Request
 type SubscribeReq SubscribeReqT
 
@@ -128,16 +162,29 @@ func (m SubscribeReq) handle(app *app, seqno uint64) *capnp.Message {
 	if err != nil {
 		return mkRpcRespError(seqno, badRPC(err))
 	}
-	subId := subId_.Id()
+	if err := app.subscribe(topicName, subId_.Id()); err != nil {
+		return mkRpcRespError(seqno, err)
+	}
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewSubscribe()
+		panicOnErr(err)
+	})
+}
 
+// subscribe joins the topic and registers the validator passing its
+// messages to the daemon under the subscription id
+func (app *app) subscribe(topicName string, subId uint64) error {
 	topic, err := app.P2p.Pubsub.Join(topicName)
 	if err != nil {
-		return mkRpcRespError(seqno, badp2p(err))
+		return badp2p(err)
 	}
 
 	app.Topics[topicName] = topic
+	dispatcher := app.topicDispatcher(topicName)
+	queue := app.validationQueue(topicName)
+	spec := app.topicSpecs.Lookup(topicName)
 
-	err = app.P2p.Pubsub.RegisterTopicValidator(topicName, func(ctx context.Context, id peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	validator := func(ctx context.Context, id peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
 		if id == app.P2p.Me {
 			// messages from ourself are valid.
 			app.P2p.Logger.Info("would have validated but it's from us!")
@@ -146,6 +193,59 @@ func (m SubscribeReq) handle(app *app, seqno uint64) *capnp.Message {
 
 		seenAt := time.Now()
 
+		// The ticket fixes the position of the message among gossipReceived
+		// upcalls of the topic, it's released unless the upcall is delivered
+		ticket := dispatcher.Reserve()
+		delivered := false
+		defer func() {
+			if !delivered {
+				dispatcher.Skip(ticket)
+			}
+		}()
+
+		// Replayed messages aren't evidence against their peers
+		recordAudit := app.peerAudit.Record
+		replayed := isReplayedGossip(msg)
+		if replayed {
+			recordAudit = func(peer.ID, ipc.Libp2pHelperInterface_PeerAuditEventKind, string) {}
+		} else {
+			app.gossipRecord.Record(topicName, spec.kind, msg, seenAt)
+		}
+
+		if len(msg.Data) > spec.maxSize {
+			app.P2p.Logger.Debugf("rejecting message of %d bytes on %s, above the size of %s messages", len(msg.Data), topicName, spec.kind)
+			recordAudit(id, ipc.Libp2pHelperInterface_PeerAuditEventKind_oversizedMessage, fmt.Sprintf("%s: %d bytes", topicName, len(msg.Data)))
+			return pubsub.ValidationReject
+		}
+
+		data, err := decodeGossip(msg.Data, spec.maxSize)
+		if err != nil {
+			app.P2p.Logger.Debugf("rejecting message of %s: %s", topicName, err)
+			recordAudit(id, ipc.Libp2pHelperInterface_PeerAuditEventKind_malformedGossip, fmt.Sprintf("%s: %s", topicName, err))
+			return pubsub.ValidationReject
+		}
+
+		app.dispatchToFirehose(topicName, spec.kind, msg, seenAt)
+
+		payloadHash := contentHash(topicName, data)
+		if res, cached := app.validationVerdicts.Get(topicName, payloadHash, seenAt); cached && !replayed {
+			app.P2p.Logger.Debugf("answering message of %s with the cached verdict %d", topicName, res)
+			if res == pubsub.ValidationReject {
+				recordAudit(id, ipc.Libp2pHelperInterface_PeerAuditEventKind_validationRejected, topicName)
+			}
+			return res
+		}
+
+		if !queue.TryEnter() {
+			app.P2p.Logger.Debugf("validation queue of %s is full, ignoring message", topicName)
+			return pubsub.ValidationIgnore
+		}
+		defer queue.Leave()
+
+		// Timeout of the topic covers waiting for the turn
+		ctx, cancel := context.WithTimeout(ctx, queue.Timeout())
+		defer cancel()
+
 		seqno := app.NextId()
 		ch := make(chan pubsub.ValidationResult)
 		app.ValidatorMutex.Lock()
@@ -172,7 +272,16 @@ func (m SubscribeReq) handle(app *app, seqno uint64) *capnp.Message {
 			delete(app.Validators, seqno)
 			return pubsub.ValidationIgnore
 		}
-		app.writeMsg(mkGossipReceivedUpcall(sender, deadline, seenAt, msg.Data, seqno, subId))
+		delivered = true
+		turn := dispatcher.Deliver(ctx, ticket, mkGossipReceivedUpcall(sender, deadline, seenAt, data, seqno, subId, ticket))
+		if !<-turn {
+			app.P2p.Logger.Debugf("message of %s wasn't validated within the timeout of the topic, ignoring it", topicName)
+			app.ValidatorMutex.Lock()
+			defer app.ValidatorMutex.Unlock()
+			delete(app.Validators, seqno)
+			return pubsub.ValidationIgnore
+		}
+		defer queue.Release()
 
 		// Wait for the validation response, but be sure to honor any timeout/deadline in ctx
 		select {
@@ -184,6 +293,7 @@ func (m SubscribeReq) handle(app *app, seqno uint64) *capnp.Message {
 			app.P2p.Logger.Error("validation timed out :(")
 
 			validationTimeoutMetric.Inc()
+			queue.Observe(time.Since(seenAt), time.Now())
 
 			app.ValidatorMutex.Lock()
 
@@ -201,9 +311,11 @@ func (m SubscribeReq) handle(app *app, seqno uint64) *capnp.Message {
 		case res := <-ch:
 			validationTime := time.Since(deadline)
 			validationTimeMetric.Set(float64(validationTime.Nanoseconds()))
+			queue.Observe(time.Since(seenAt), time.Now())
 			switch res {
 			case pubsub.ValidationReject:
 				app.P2p.Logger.Info("why u fail to validate :(")
+				recordAudit(id, ipc.Libp2pHelperInterface_PeerAuditEventKind_validationRejected, topicName)
 			case pubsub.ValidationAccept:
 				app.P2p.Logger.Info("validated!")
 			case pubsub.ValidationIgnore:
@@ -212,17 +324,23 @@ func (m SubscribeReq) handle(app *app, seqno uint64) *capnp.Message {
 				app.P2p.Logger.Info("unknown validation result")
 				res = pubsub.ValidationIgnore
 			}
+			app.validationVerdicts.Add(payloadHash, res, time.Now())
+			if !replayed {
+				app.gossipLatency.Verdict(topicName, msg, seenAt, res)
+			}
 			return res
 		}
-	}, pubsub.WithValidatorTimeout(validationTimeout))
+	}
 
+	err = app.P2p.Pubsub.RegisterTopicValidator(topicName, validator)
 	if err != nil {
-		return mkRpcRespError(seqno, badp2p(err))
+		return badp2p(err)
 	}
+	app.gossipReplay.SetValidator(topicName, validator)
 
 	sub, err := topic.Subscribe()
 	if err != nil {
-		return mkRpcRespError(seqno, badp2p(err))
+		return badp2p(err)
 	}
 
 	ctx, cancel := context.WithCancel(app.Ctx)
@@ -244,10 +362,7 @@ func (m SubscribeReq) handle(app *app, seqno uint64) *capnp.Message {
 			}
 		}
 	}()
-	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
-		_, err := m.NewSubscribe()
-		panicOnErr(err)
-	})
+	return nil
 }
 
 type UnsubscribeReqT = ipc.Libp2pHelperInterface_Unsubscribe_Request
@@ -277,3 +392,36 @@ func (m UnsubscribeReq) handle(app *app, seqno uint64) *capnp.Message {
 	}
 	return mkRpcRespError(seqno, badRPC(errors.New("subscription not found")))
 }
+
+type SetFirehoseReqT = ipc.Libp2pHelperInterface_SetFirehose_Request
+type SetFirehoseReq SetFirehoseReqT
+
+func fromSetFirehoseReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.SetFirehose()
+	return SetFirehoseReq(i), err
+}
+func (m SetFirehoseReq) handle(app *app, seqno uint64) *capnp.Message {
+	topicsL, err := SetFirehoseReqT(m).Topics()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	topics := make([]string, 0, topicsL.Len())
+	err = capnpTextListForeach(topicsL, func(topic string) error {
+		topics = append(topics, topic)
+		return nil
+	})
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	socketPath, err := SetFirehoseReqT(m).SocketPath()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	if err := app.setFirehose(socketPath, topics); err != nil {
+		return mkRpcRespError(seqno, badHelper(err))
+	}
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewSetFirehose()
+		panicOnErr(err)
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	ipc "libp2p_ipc"
+)
+
+// Connection limits of relay-only nodes, unless configured. Relays keep
+// connections of many peers open, hence limits are way above the ones
+// of nodes taking part in consensus.
+const (
+	defaultRelayOnlyMinConnections = 1024
+	defaultRelayOnlyMaxConnections = 4096
+)
+
+// RPC methods of gossip and Bitswap, neither of which runs in relay-only mode
+var relayOnlyDisabledRpcMethods = map[ipc.Libp2pHelperInterface_RpcRequest_Which]bool{
+	ipc.Libp2pHelperInterface_RpcRequest_Which_publish:                true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_subscribe:              true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_unsubscribe:            true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_applyRolePreset:        true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_pinResource:            true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_unpinResource:          true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_revalidateResource:     true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_streamResource:         true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_cancelResourceDownload: true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_publishResource:        true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_startTuningExperiment:  true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_stopTuningExperiment:   true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_listBitswapWants:       true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_mountArchiveBlockstore: true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_exportResource:         true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_importResource:         true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_auditBlockstore:        true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_downloadResources:      true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_deleteResourcesBefore:  true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_setTopicConfig:         true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_setGossipTrace:         true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_getTopicPeers:          true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_setGossipRecord:        true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_replayGossip:           true,
+}
+
+// Push messages of gossip and Bitswap, ignored in relay-only mode
+var relayOnlyDisabledPushMessages = map[ipc.Libp2pHelperInterface_PushMessage_Which]bool{
+	ipc.Libp2pHelperInterface_PushMessage_Which_addResource:        true,
+	ipc.Libp2pHelperInterface_PushMessage_Which_deleteResource:     true,
+	ipc.Libp2pHelperInterface_PushMessage_Which_downloadResource:   true,
+	ipc.Libp2pHelperInterface_PushMessage_Which_validation:         true,
+	ipc.Libp2pHelperInterface_PushMessage_Which_ackResourceUpdates: true,
+	ipc.Libp2pHelperInterface_PushMessage_Which_resourceVerified:   true,
+	ipc.Libp2pHelperInterface_PushMessage_Which_addResourcePiece:   true,
+	ipc.Libp2pHelperInterface_PushMessage_Which_commitResource:     true,
+	ipc.Libp2pHelperInterface_PushMessage_Which_abortResource:      true,
+	ipc.Libp2pHelperInterface_PushMessage_Which_validationBatch:    true,
+}
+
+// readRelayOnlyConfig returns whether relay-only mode is enabled and
+// connection limits to use, limits of the config are kept otherwise
+func readRelayOnlyConfig(cfg ipc.RelayOnlyConfig, minConnections, maxConnections int) (bool, int, int) {
+	if !cfg.Enabled() {
+		return false, minConnections, maxConnections
+	}
+	minConnections, maxConnections = int(cfg.MinConnections()), int(cfg.MaxConnections())
+	if minConnections == 0 {
+		minConnections = defaultRelayOnlyMinConnections
+	}
+	if maxConnections == 0 {
+		maxConnections = defaultRelayOnlyMaxConnections
+	}
+	return true, minConnections, maxConnections
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadRelayOnlyConfig(t *testing.T) {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	cfg, err := ipc.NewRootRelayOnlyConfig(seg)
+	require.NoError(t, err)
+
+	// Limits of the config are kept unless enabled
+	cfg.SetMinConnections(10000)
+	enabled, minConns, maxConns := readRelayOnlyConfig(cfg, 20, 50)
+	require.False(t, enabled)
+	require.Equal(t, 20, minConns)
+	require.Equal(t, 50, maxConns)
+
+	cfg.SetEnabled(true)
+	enabled, minConns, maxConns = readRelayOnlyConfig(cfg, 20, 50)
+	require.True(t, enabled)
+	require.Equal(t, 10000, minConns)
+	require.Equal(t, defaultRelayOnlyMaxConnections, maxConns)
+
+	cfg.SetMinConnections(0)
+	_, minConns, _ = readRelayOnlyConfig(cfg, 20, 50)
+	require.Equal(t, defaultRelayOnlyMinConnections, minConns)
+}
+
+func mkRelayOnlyTestSubscribe(t *testing.T, seqno uint64) *ipc.Libp2pHelperInterface_Message {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	msg, err := ipc.NewRootLibp2pHelperInterface_Message(seg)
+	require.NoError(t, err)
+	req, err := msg.NewRpcRequest()
+	require.NoError(t, err)
+	h, err := req.NewHeader()
+	require.NoError(t, err)
+	sn, err := h.NewSequenceNumber()
+	require.NoError(t, err)
+	sn.SetSeqno(seqno)
+	sub, err := req.NewSubscribe()
+	require.NoError(t, err)
+	require.NoError(t, sub.SetTopic("test"))
+	sid, err := sub.NewSubscriptionId()
+	require.NoError(t, err)
+	sid.SetId(1)
+	return &msg
+}
+
+func TestRelayOnlyRejectsGossip(t *testing.T) {
+	testApp, _ := newTestApp(t, nil, false)
+	testApp.relayOnly = true
+
+	testApp.handleIncomingMsg(mkRelayOnlyTestSubscribe(t, 17))
+	require.NotEmpty(t, testApp.OutChan)
+	seqno, errMsg := checkRpcResponseError(t, <-testApp.OutChan)
+	require.Equal(t, uint64(17), seqno)
+	require.Contains(t, errMsg, "relay-only")
+	require.Empty(t, testApp.Subs)
+}
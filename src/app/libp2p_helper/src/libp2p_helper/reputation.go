@@ -0,0 +1,48 @@
+package main
+
+import (
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var reputationLogger = logging.Logger("mina.helper.reputation")
+
+// Interval of saving reputation of peers, it's saved
+// on shutdown as well
+const reputationSaveInterval = time.Minute
+
+// restoreReputation restores bans, failed dials and malformed block
+// penalties of peers saved by the previous run of the helper
+func (app *app) restoreReputation() {
+	r, err := app.P2p.LoadReputation()
+	if err != nil {
+		reputationLogger.Warnf("Failed to load reputation of peers: %s", err)
+		return
+	}
+	app.P2p.RestoreReputation(r)
+	app.malformedBlockPenalties.Restore(r.Penalties)
+	reputationLogger.Infof("Restored reputation of peers: %d penalized peers, %d temporary bans, %d peers with failed dials, %d penalties",
+		len(r.PenalizedPeers), len(r.TemporaryBans), len(r.ConnectionFailures), len(r.Penalties))
+}
+
+func (app *app) saveReputation() {
+	r := app.P2p.Reputation()
+	r.Penalties = app.malformedBlockPenalties.Penalties()
+	if err := app.P2p.SaveReputation(r); err != nil {
+		reputationLogger.Warnf("Failed to save reputation of peers: %s", err)
+	}
+}
+
+func (app *app) saveReputationPeriodically() {
+	ticker := time.NewTicker(reputationSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-app.Ctx.Done():
+			return
+		case <-ticker.C:
+			app.saveReputation()
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"codanet"
+	dl "codanet/bitswap_downloader"
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+)
+
+const (
+	// Unacknowledged updates kept for redelivery at most,
+	// the oldest ones are dropped on overflow
+	maxPendingResourceUpdates = 4096
+	// Interval of checking for updates due for redelivery
+	resourceUpdateRedeliveryCheck = time.Second
+)
+
+type pendingResourceUpdate struct {
+	seqno   uint64
+	type_   ipc.ResourceUpdateType
+	traceId string
+	roots   []dl.Root
+	sentAt  time.Time
+}
+
+func (u *pendingResourceUpdate) upcall() *capnp.Message {
+	return mkResourceUpdatedUpcall(u.type_, u.traceId, u.seqno, u.roots)
+}
+
+// resourceUpdateLog numbers resource updates sent to the daemon and,
+// if acknowledgment is enabled, keeps them until the daemon acknowledges
+// them, so that updates lost on the IPC pipe are redelivered. Daemon
+// acknowledges updates cumulatively and is expected to ignore
+// redelivered updates it has already processed.
+type resourceUpdateLog struct {
+	// zero disables acknowledgment
+	ackTimeout time.Duration
+	lastSeqno  uint64
+	// ordered by sequence number
+	pending []*pendingResourceUpdate
+	mutex   sync.Mutex
+}
+
+// SetAckTimeout enables acknowledgment of updates with the timeout of
+// redelivery, zero timeout disables it and forgets pending updates
+func (l *resourceUpdateLog) SetAckTimeout(timeout time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.ackTimeout = timeout
+	if timeout == 0 {
+		l.pending = nil
+	}
+}
+
+// Record assigns the next sequence number to the update
+// and keeps it for redelivery if acknowledgment is enabled
+func (l *resourceUpdateLog) Record(type_ ipc.ResourceUpdateType, traceId string, roots []dl.Root, now time.Time) *pendingResourceUpdate {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lastSeqno++
+	u := &pendingResourceUpdate{seqno: l.lastSeqno, type_: type_, traceId: traceId, roots: roots, sentAt: now}
+	if l.ackTimeout == 0 {
+		return u
+	}
+	if len(l.pending) >= maxPendingResourceUpdates {
+		dropped := l.pending[0]
+		bitswapLogger.Errorf("Dropping unacknowledged resource update #%d of type %s for %s (too many pending updates)",
+			dropped.seqno, dropped.type_, codanet.BlockHashToCidSuffix(dropped.roots[0]))
+		l.pending = l.pending[1:]
+	}
+	l.pending = append(l.pending, u)
+	return u
+}
+
+// Ack forgets updates with sequence numbers up to seqno
+func (l *resourceUpdateLog) Ack(seqno uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	i := 0
+	for i < len(l.pending) && l.pending[i].seqno <= seqno {
+		i++
+	}
+	l.pending = l.pending[i:]
+}
+
+// Due returns updates to be redelivered: all pending updates if force is
+// set, otherwise those not acknowledged within the timeout since they
+// were last sent. Returned updates are considered sent at now.
+func (l *resourceUpdateLog) Due(now time.Time, force bool) []*pendingResourceUpdate {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	res := []*pendingResourceUpdate{}
+	for _, u := range l.pending {
+		if force || now.Sub(u.sentAt) >= l.ackTimeout {
+			u.sentAt = now
+			res = append(res, u)
+		}
+	}
+	return res
+}
+
+// redeliverResourceUpdates resends updates due for redelivery, updates
+// that don't fit the message queue are retried after the timeout
+func (bs *BitswapCtx) redeliverResourceUpdates(now time.Time, force bool) {
+	for _, u := range bs.updateLog.Due(now, force) {
+		select {
+		case bs.outMsgChan <- u.upcall():
+			bitswapLogger.Debugf("Redelivered resource update #%d", u.seqno)
+		default:
+			bitswapLogger.Warnf("Failed to redeliver resource update #%d (message queue is full)", u.seqno)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"context"
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResourceUpdateLogUnacknowledged(t *testing.T) {
+	var l resourceUpdateLog
+	now := time.Now()
+	u := l.Record(ipc.ResourceUpdateType_added, "", []dl.Root{{1}}, now)
+	require.Equal(t, uint64(1), u.seqno)
+	// Nothing is kept with acknowledgment disabled
+	require.Empty(t, l.Due(now, true))
+}
+
+func TestResourceUpdateLogRedelivery(t *testing.T) {
+	var l resourceUpdateLog
+	l.SetAckTimeout(time.Minute)
+	now := time.Now()
+	for i := byte(1); i <= 3; i++ {
+		u := l.Record(ipc.ResourceUpdateType_added, "", []dl.Root{{i}}, now.Add(time.Duration(i)*time.Second))
+		require.Equal(t, uint64(i), u.seqno)
+	}
+	require.Empty(t, l.Due(now.Add(time.Minute), false))
+	due := l.Due(now.Add(time.Minute+2*time.Second), false)
+	require.Len(t, due, 2)
+	require.Equal(t, uint64(1), due[0].seqno)
+	require.Equal(t, uint64(2), due[1].seqno)
+	// Redelivered updates are due after another timeout
+	require.Len(t, l.Due(now.Add(time.Minute+3*time.Second), false), 1)
+
+	l.Ack(2)
+	due = l.Due(now, true)
+	require.Len(t, due, 1)
+	require.Equal(t, uint64(3), due[0].seqno)
+	l.Ack(3)
+	require.Empty(t, l.Due(now, true))
+}
+
+func TestResourceUpdateLogOverflow(t *testing.T) {
+	var l resourceUpdateLog
+	l.SetAckTimeout(time.Minute)
+	now := time.Now()
+	for i := 0; i < maxPendingResourceUpdates+1; i++ {
+		l.Record(ipc.ResourceUpdateType_added, "", []dl.Root{{}}, now)
+	}
+	due := l.Due(now, true)
+	require.Len(t, due, maxPendingResourceUpdates)
+	require.Equal(t, uint64(2), due[0].seqno)
+}
+
+func TestAckResourceUpdates(t *testing.T) {
+	outChan := make(chan *capnp.Message, 10)
+	bs := NewBitswapCtx(context.Background(), outChan)
+	bs.updateLog.SetAckTimeout(time.Minute)
+	bs.SendResourceUpdates(ipc.ResourceUpdateType_added, dl.Root{1})
+	bs.SendResourceUpdates(ipc.ResourceUpdateType_broken, dl.Root{2})
+	require.Len(t, outChan, 2)
+	<-outChan
+	<-outChan
+
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	m, err := ipc.NewRootLibp2pHelperInterface_AckResourceUpdates(seg)
+	require.NoError(t, err)
+	m.SetSeqno(1)
+	m.SetRedeliver(true)
+	AckResourceUpdatesPush(m).handle(&app{bitswapCtx: bs})
+
+	require.Len(t, outChan, 1)
+	msg, err := ipc.ReadRootDaemonInterface_Message(<-outChan)
+	require.NoError(t, err)
+	pm, err := msg.PushMessage()
+	require.NoError(t, err)
+	ru, err := pm.ResourceUpdated()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), ru.Seqno())
+	require.Equal(t, ipc.ResourceUpdateType_broken, ru.Type())
+}
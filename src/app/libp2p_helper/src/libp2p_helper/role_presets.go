@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+type topicPreset struct {
+	validationQueueSize int
+	topicWeight         float64
+}
+
+// Topics of node roles. Block producers validate gossip on the critical
+// path of producing blocks, hence get the largest queue, seeds mostly
+// relay and get the smallest one.
+var rolePresets = map[string]map[string]topicPreset{
+	"block-producer": {consensusTopic: {validationQueueSize: 256, topicWeight: 1}},
+	"snark-worker":   {consensusTopic: {validationQueueSize: 64, topicWeight: 0.5}},
+	"archive":        {consensusTopic: {validationQueueSize: 128, topicWeight: 0.5}},
+	"seed":           {consensusTopic: {validationQueueSize: 32, topicWeight: 0.25}},
+}
+
+// resolveRolePreset returns topics of the role with overrides applied
+func resolveRolePreset(role string, overrides []ipc.TopicPreset) (map[string]topicPreset, error) {
+	preset, has := rolePresets[role]
+	if !has {
+		return nil, fmt.Errorf("unknown role %q", role)
+	}
+	res := make(map[string]topicPreset, len(preset))
+	for topic, p := range preset {
+		res[topic] = p
+	}
+	for _, o := range overrides {
+		topic, err := o.Topic()
+		if err != nil {
+			return nil, err
+		}
+		if !o.Subscribe() {
+			delete(res, topic)
+			continue
+		}
+		p, has := res[topic]
+		if !has {
+			p = topicPreset{topicWeight: 1}
+		}
+		if size := o.ValidationQueueSize(); size > 0 {
+			p.validationQueueSize = int(size)
+		}
+		if weight := o.TopicWeight(); weight > 0 {
+			p.topicWeight = weight
+		}
+		res[topic] = p
+	}
+	return res, nil
+}
+
+// topicScoreParams rewards time in mesh and first deliveries
+// of messages of the topic and penalizes invalid messages
+func topicScoreParams(weight float64) *pubsub.TopicScoreParams {
+	return &pubsub.TopicScoreParams{
+		TopicWeight:                    weight,
+		TimeInMeshWeight:               0.01,
+		TimeInMeshQuantum:              time.Second,
+		TimeInMeshCap:                  3600,
+		FirstMessageDeliveriesWeight:   1,
+		FirstMessageDeliveriesDecay:    0.5,
+		FirstMessageDeliveriesCap:      100,
+		InvalidMessageDeliveriesWeight: -100,
+		InvalidMessageDeliveriesDecay:  0.3,
+	}
+}
+
+func (app *app) topicSubscription(topic string) (uint64, bool) {
+	for id, sub := range app.Subs {
+		if sub.Sub.Topic() == topic {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+type ApplyRolePresetReqT = ipc.Libp2pHelperInterface_ApplyRolePreset_Request
+type ApplyRolePresetReq ApplyRolePresetReqT
+
+func fromApplyRolePresetReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.ApplyRolePreset()
+	return ApplyRolePresetReq(i), err
+}
+func (m ApplyRolePresetReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	if app.P2p.Dht == nil {
+		return mkRpcRespError(seqno, needsDHT())
+	}
+	role, err := ApplyRolePresetReqT(m).Role()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	overridesL, err := ApplyRolePresetReqT(m).Overrides()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	overrides := make([]ipc.TopicPreset, 0, overridesL.Len())
+	for i := 0; i < overridesL.Len(); i++ {
+		overrides = append(overrides, overridesL.At(i))
+	}
+	firstSubId, err := ApplyRolePresetReqT(m).FirstSubscriptionId()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	preset, err := resolveRolePreset(role, overrides)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+
+	topics := make([]string, 0, len(preset))
+	for topic := range preset {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	nextSubId := firstSubId.Id()
+	subIds := make([]uint64, len(topics))
+	for i, topic := range topics {
+		p := preset[topic]
+		if p.validationQueueSize > 0 {
+			app.validationQueue(topic).SetMaxLimit(p.validationQueueSize)
+		}
+		subId, has := app.topicSubscription(topic)
+		if !has {
+			subId = nextSubId
+			nextSubId++
+			if err := app.subscribe(topic, subId); err != nil {
+				return mkRpcRespError(seqno, err)
+			}
+		}
+		subIds[i] = subId
+		if !app.peerScoring {
+			continue
+		}
+		if err := app.Topics[topic].SetScoreParams(topicScoreParams(p.topicWeight)); err != nil {
+			return mkRpcRespError(seqno, badp2p(err))
+		}
+	}
+	app.P2p.Logger.Infof("applied preset of role %s to topics %v", role, topics)
+
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		r, err := m.NewApplyRolePreset()
+		panicOnErr(err)
+		lst, err := r.NewSubscriptions(int32(len(topics)))
+		panicOnErr(err)
+		for i, topic := range topics {
+			s := lst.At(i)
+			panicOnErr(s.SetTopic(topic))
+			sid, err := s.NewSubscriptionId()
+			panicOnErr(err)
+			sid.SetId(subIds[i])
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func mkTopicPreset(t *testing.T, topic string, subscribe bool, queueSize uint32, weight float64) ipc.TopicPreset {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	p, err := ipc.NewTopicPreset(seg)
+	require.NoError(t, err)
+	require.NoError(t, p.SetTopic(topic))
+	p.SetSubscribe(subscribe)
+	p.SetValidationQueueSize(queueSize)
+	p.SetTopicWeight(weight)
+	return p
+}
+
+func TestResolveRolePreset(t *testing.T) {
+	_, err := resolveRolePreset("miner", nil)
+	require.Error(t, err)
+
+	preset, err := resolveRolePreset("seed", nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]topicPreset{consensusTopic: rolePresets["seed"][consensusTopic]}, preset)
+
+	preset, err = resolveRolePreset("block-producer", []ipc.TopicPreset{
+		mkTopicPreset(t, consensusTopic, true, 512, 0),
+		mkTopicPreset(t, "mina/telemetry", true, 0, 0.1),
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]topicPreset{
+		consensusTopic:   {validationQueueSize: 512, topicWeight: 1},
+		"mina/telemetry": {topicWeight: 0.1},
+	}, preset)
+	// Overrides don't alter presets
+	require.Equal(t, 256, rolePresets["block-producer"][consensusTopic].validationQueueSize)
+
+	preset, err = resolveRolePreset("archive", []ipc.TopicPreset{
+		mkTopicPreset(t, consensusTopic, false, 0, 0),
+	})
+	require.NoError(t, err)
+	require.Empty(t, preset)
+}
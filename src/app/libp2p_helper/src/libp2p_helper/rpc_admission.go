@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var rpcRejectedMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "Mina_libp2p_rpc_rejected_calls",
+	Help: "Number of calls of expensive RPC methods rejected for exceeding the admission rate",
+}, []string{"method"})
+
+// RPC methods that walk large structures (peerstore, connections,
+// blockstore) or sample the system, subject to admission
+var expensiveRpcMethods = map[ipc.Libp2pHelperInterface_RpcRequest_Which]bool{
+	ipc.Libp2pHelperInterface_RpcRequest_Which_listPeers:           true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_listPeerAgents:      true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_listDialScores:      true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_listConnectionRungs: true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_bandwidthInfo:       true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_revalidateResource:  true,
+	ipc.Libp2pHelperInterface_RpcRequest_Which_streamResource:      true,
+}
+
+type admissionBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rpcAdmission keeps a token bucket per expensive RPC method, so that
+// a looping client can't degrade the helper by calling them repeatedly.
+// Calls of other methods are always admitted.
+type rpcAdmission struct {
+	// calls per second of each method, zero means no limit
+	rate    float64
+	burst   float64
+	buckets map[ipc.Libp2pHelperInterface_RpcRequest_Which]*admissionBucket
+	now     func() time.Time
+	mutex   sync.Mutex
+}
+
+func newRpcAdmission() *rpcAdmission {
+	return &rpcAdmission{
+		buckets: make(map[ipc.Libp2pHelperInterface_RpcRequest_Which]*admissionBucket),
+		now:     time.Now,
+	}
+}
+
+// Configure replaces the rate and burst, buckets start full. Zero burst
+// is replaced with calls of a second, but at least a single call.
+func (a *rpcAdmission) Configure(rate float64, burst int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.rate = rate
+	a.burst = float64(burst)
+	if burst <= 0 {
+		a.burst = math.Max(1, math.Ceil(rate))
+	}
+	a.buckets = make(map[ipc.Libp2pHelperInterface_RpcRequest_Which]*admissionBucket)
+}
+
+// Admit takes a token of the method, returning false
+// if the method is expensive and its bucket is empty
+func (a *rpcAdmission) Admit(method ipc.Libp2pHelperInterface_RpcRequest_Which) bool {
+	if !expensiveRpcMethods[method] {
+		return true
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.rate <= 0 {
+		return true
+	}
+	now := a.now()
+	b, has := a.buckets[method]
+	if !has {
+		b = &admissionBucket{tokens: a.burst, last: now}
+		a.buckets[method] = b
+	}
+	if now.After(b.last) {
+		b.tokens = math.Min(a.burst, b.tokens+now.Sub(b.last).Seconds()*a.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		rpcRejectedMetric.WithLabelValues(method.String()).Inc()
+		return false
+	}
+	b.tokens--
+	return true
+}
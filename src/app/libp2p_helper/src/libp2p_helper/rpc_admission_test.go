@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRpcAdmission(t *testing.T) {
+	a := newRpcAdmission()
+	now := time.Now()
+	a.now = func() time.Time { return now }
+	listPeers := ipc.Libp2pHelperInterface_RpcRequest_Which_listPeers
+	publish := ipc.Libp2pHelperInterface_RpcRequest_Which_publish
+
+	// No limit until configured
+	for i := 0; i < 10; i++ {
+		require.True(t, a.Admit(listPeers))
+	}
+	a.Configure(0.5, 2)
+	require.True(t, a.Admit(listPeers))
+	require.True(t, a.Admit(listPeers))
+	require.False(t, a.Admit(listPeers))
+	// Methods have separate buckets, cheap methods aren't limited
+	require.True(t, a.Admit(ipc.Libp2pHelperInterface_RpcRequest_Which_listPeerAgents))
+	for i := 0; i < 10; i++ {
+		require.True(t, a.Admit(publish))
+	}
+
+	now = now.Add(time.Second)
+	require.False(t, a.Admit(listPeers))
+	now = now.Add(time.Second)
+	require.True(t, a.Admit(listPeers))
+	require.False(t, a.Admit(listPeers))
+
+	// Burst defaults to calls of a second
+	a.Configure(3, 0)
+	for i := 0; i < 3; i++ {
+		require.True(t, a.Admit(listPeers))
+	}
+	require.False(t, a.Admit(listPeers))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// Sandboxing of the helper: once the first configure has bound listening
+// sockets and opened the block storage, the helper switches to an
+// unprivileged user and restricts itself to what networking and the
+// storage need, syscalls with seccomp on Linux and promises and paths
+// with pledge and unveil on OpenBSD. This reduces the blast radius of
+// a remote exploit of the networking stack.
+
+var sandboxLogger = logging.Logger("mina.helper.sandbox")
+
+var errSandboxUnsupported = errors.New("sandbox is not supported on this platform")
+
+// What happens to the helper when it attempts something outside of
+// the sandbox
+type sandboxViolation int
+
+const (
+	// Attempt fails with an error
+	sandboxViolationError sandboxViolation = iota
+	// Helper is killed
+	sandboxViolationKill
+	// Attempt is allowed, but logged by the kernel (Linux only,
+	// failing with an error elsewhere)
+	sandboxViolationLog
+)
+
+func parseSandboxViolation(s string) (sandboxViolation, error) {
+	switch s {
+	case "error":
+		return sandboxViolationError, nil
+	case "kill":
+		return sandboxViolationKill, nil
+	case "log":
+		return sandboxViolationLog, nil
+	}
+	return 0, fmt.Errorf("unknown sandbox violation action %q", s)
+}
+
+// sandboxPath is a path made available in the sandbox, with permissions
+// in terms of unveil(2): any of "r", "w", "x" and "c"
+type sandboxPath struct {
+	path  string
+	perms string
+}
+
+// sandboxPathsFlag collects paths given as `path[:perms]`,
+// read-only by default
+type sandboxPathsFlag []sandboxPath
+
+func (f *sandboxPathsFlag) String() string {
+	res := make([]string, len(*f))
+	for i, p := range *f {
+		res[i] = p.path + ":" + p.perms
+	}
+	return strings.Join(res, ",")
+}
+
+func (f *sandboxPathsFlag) Set(v string) error {
+	p := sandboxPath{path: v, perms: "r"}
+	if i := strings.LastIndexByte(v, ':'); i >= 0 {
+		p.path, p.perms = v[:i], v[i+1:]
+	}
+	if p.path == "" || p.perms == "" || strings.Trim(p.perms, "rwxc") != "" {
+		return fmt.Errorf("invalid sandbox path %q", v)
+	}
+	*f = append(*f, p)
+	return nil
+}
+
+type sandboxConfig struct {
+	enabled   bool
+	userName  string
+	violation string
+	paths     sandboxPathsFlag
+
+	// resolved by validate
+	action sandboxViolation
+	// user to switch to, nil to keep the current one
+	uid, gid *int
+}
+
+func registerSandboxFlags(fs *flag.FlagSet) *sandboxConfig {
+	cfg := &sandboxConfig{}
+	fs.BoolVar(&cfg.enabled, "sandbox", false, "restrict the helper to networking and block storage after the first configure")
+	fs.StringVar(&cfg.userName, "sandbox-user", "", "user (name or uid) to switch to after binding ports, requires root, may be used without -sandbox")
+	fs.StringVar(&cfg.violation, "sandbox-violation", "error", "action on sandbox violations: error, kill or log")
+	fs.Var(&cfg.paths, "sandbox-path", "additional `path[:perms]` available in the sandbox on OpenBSD, e.g. of firehose sockets (repeatable)")
+	return cfg
+}
+
+// validate checks the configuration and resolves the user, so that
+// the user database isn't needed once in the sandbox
+func (cfg *sandboxConfig) validate() error {
+	action, err := parseSandboxViolation(cfg.violation)
+	if err != nil {
+		return err
+	}
+	cfg.action = action
+	if cfg.userName == "" {
+		return nil
+	}
+	u, err := user.Lookup(cfg.userName)
+	if err != nil {
+		u, err = user.LookupId(cfg.userName)
+	}
+	if err != nil {
+		return fmt.Errorf("unknown sandbox user %q", cfg.userName)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+	cfg.uid, cfg.gid = &uid, &gid
+	return nil
+}
+
+// active tells whether anything is to be done after the first configure,
+// privileges may be dropped without enabling the sandbox
+func (cfg *sandboxConfig) active() bool {
+	return cfg.enabled || cfg.uid != nil
+}
+
+// enter drops privileges and restricts the helper to the
+// configured paths along with the given ones (OpenBSD only)
+func (cfg *sandboxConfig) enter(paths []sandboxPath) error {
+	if cfg.uid != nil {
+		if err := dropPrivileges(*cfg.uid, *cfg.gid); err != nil {
+			return fmt.Errorf("dropping privileges: %w", err)
+		}
+	}
+	if !cfg.enabled {
+		return nil
+	}
+	if err := restrictProcess(cfg.action, append(paths, cfg.paths...)); err != nil {
+		return err
+	}
+	sandboxLogger.Infof("Entered sandbox (uid %d, violations: %s)", os.Getuid(), cfg.violation)
+	return nil
+}
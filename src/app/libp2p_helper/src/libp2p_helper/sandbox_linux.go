@@ -0,0 +1,119 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetLog         = 0x7ffc0000
+	seccompRetAllow       = 0x7fff0000
+
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+
+	// Offsets of fields of struct seccomp_data
+	seccompDataNrOffset   = 0
+	seccompDataArchOffset = 4
+)
+
+// Syscalls of the Go runtime, networking and LMDB available on all
+// supported architectures, the rest is listed in seccompArchSyscalls
+var seccompSyscalls = []uintptr{
+	// Files and the block storage
+	unix.SYS_READ, unix.SYS_WRITE, unix.SYS_READV, unix.SYS_WRITEV,
+	unix.SYS_PREAD64, unix.SYS_PWRITE64, unix.SYS_OPENAT, unix.SYS_CLOSE,
+	unix.SYS_FSTAT, unix.SYS_STATX, unix.SYS_LSEEK, unix.SYS_FCNTL, unix.SYS_FLOCK,
+	unix.SYS_IOCTL, unix.SYS_FSYNC, unix.SYS_FDATASYNC, unix.SYS_SYNC_FILE_RANGE,
+	unix.SYS_FTRUNCATE, unix.SYS_FALLOCATE, unix.SYS_FADVISE64, unix.SYS_GETDENTS64,
+	unix.SYS_GETCWD, unix.SYS_READLINKAT, unix.SYS_RENAMEAT, unix.SYS_UNLINKAT,
+	unix.SYS_MKDIRAT, unix.SYS_FACCESSAT, unix.SYS_DUP, unix.SYS_DUP3, unix.SYS_PIPE2,
+	// Memory
+	unix.SYS_MMAP, unix.SYS_MUNMAP, unix.SYS_MPROTECT, unix.SYS_MREMAP,
+	unix.SYS_MADVISE, unix.SYS_MSYNC, unix.SYS_MINCORE, unix.SYS_BRK, unix.SYS_MEMBARRIER,
+	// Networking
+	unix.SYS_SOCKET, unix.SYS_SOCKETPAIR, unix.SYS_CONNECT, unix.SYS_ACCEPT,
+	unix.SYS_ACCEPT4, unix.SYS_BIND, unix.SYS_LISTEN, unix.SYS_SHUTDOWN,
+	unix.SYS_SENDTO, unix.SYS_RECVFROM, unix.SYS_SENDMSG, unix.SYS_RECVMSG,
+	unix.SYS_SENDMMSG, unix.SYS_RECVMMSG, unix.SYS_GETSOCKNAME, unix.SYS_GETPEERNAME,
+	unix.SYS_SETSOCKOPT, unix.SYS_GETSOCKOPT,
+	// Polling
+	unix.SYS_EPOLL_CREATE1, unix.SYS_EPOLL_CTL, unix.SYS_EPOLL_PWAIT,
+	unix.SYS_EVENTFD2, unix.SYS_PPOLL, unix.SYS_PSELECT6,
+	// Threads, signals and time
+	unix.SYS_CLONE, unix.SYS_CLONE3, unix.SYS_FUTEX, unix.SYS_SET_ROBUST_LIST,
+	unix.SYS_SET_TID_ADDRESS, unix.SYS_RSEQ, unix.SYS_SCHED_YIELD,
+	unix.SYS_SCHED_GETAFFINITY, unix.SYS_RT_SIGACTION, unix.SYS_RT_SIGPROCMASK,
+	unix.SYS_RT_SIGRETURN, unix.SYS_SIGALTSTACK, unix.SYS_RESTART_SYSCALL,
+	unix.SYS_GETPID, unix.SYS_GETPPID, unix.SYS_GETTID, unix.SYS_KILL, unix.SYS_TKILL,
+	unix.SYS_TGKILL, unix.SYS_NANOSLEEP, unix.SYS_CLOCK_NANOSLEEP,
+	unix.SYS_CLOCK_GETTIME, unix.SYS_CLOCK_GETRES, unix.SYS_GETTIMEOFDAY,
+	unix.SYS_EXIT, unix.SYS_EXIT_GROUP,
+	// System information of metrics
+	unix.SYS_UNAME, unix.SYS_SYSINFO, unix.SYS_GETRLIMIT, unix.SYS_PRLIMIT64,
+	unix.SYS_GETRUSAGE, unix.SYS_GETRANDOM,
+	unix.SYS_GETUID, unix.SYS_GETEUID, unix.SYS_GETGID, unix.SYS_GETEGID,
+}
+
+// seccompFilter builds a BPF program allowing the syscalls, others
+// trigger the violation action. Syscalls of other architectures
+// (e.g. of x32 ABI) kill the helper, as their numbers differ.
+func seccompFilter(syscalls []uintptr, violation uint32) []unix.SockFilter {
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataArchOffset},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: seccompArch},
+		{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetKillProcess},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataNrOffset},
+	}
+	for _, nr := range syscalls {
+		filter = append(filter,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 1, K: uint32(nr)},
+			unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow},
+		)
+	}
+	return append(filter, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: violation})
+}
+
+// installSeccompFilter applies the filter to all threads of the helper
+func installSeccompFilter(filter []unix.SockFilter) error {
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	// No-new-privs must be set on the thread installing the filter,
+	// it's propagated to other threads along with the filter
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("setting no_new_privs: %w", err)
+	}
+	tid, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("installing seccomp filter: %w", errno)
+	}
+	if tid != 0 {
+		return fmt.Errorf("installing seccomp filter: thread %d can't be synchronized", tid)
+	}
+	return nil
+}
+
+// restrictProcess confines the helper to syscalls it needs. Paths are
+// not restricted on Linux. Denied syscalls fail with ENOSYS, so that
+// callers fall back to older syscalls where they can.
+func restrictProcess(action sandboxViolation, paths []sandboxPath) error {
+	violation := uint32(seccompRetErrno | uint32(unix.ENOSYS))
+	switch action {
+	case sandboxViolationKill:
+		violation = seccompRetKillProcess
+	case sandboxViolationLog:
+		violation = seccompRetLog
+	}
+	syscalls := append(append([]uintptr{}, seccompSyscalls...), seccompArchSyscalls...)
+	return installSeccompFilter(seccompFilter(syscalls, violation))
+}
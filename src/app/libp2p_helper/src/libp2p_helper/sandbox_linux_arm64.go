@@ -0,0 +1,9 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+const seccompArch = unix.AUDIT_ARCH_AARCH64
+
+var seccompArchSyscalls = []uintptr{
+	unix.SYS_FSTATAT,
+}
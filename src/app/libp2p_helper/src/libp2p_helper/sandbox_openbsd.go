@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Paths needed for name resolution and TLS of telemetry sinks
+var sandboxSystemPaths = []sandboxPath{
+	{path: "/etc/resolv.conf", perms: "r"},
+	{path: "/etc/hosts", perms: "r"},
+	{path: "/etc/ssl", perms: "r"},
+}
+
+// Promises of networking (including unix sockets of the firehose)
+// and block storage
+const sandboxPromises = "stdio rpath wpath cpath flock inet dns unix"
+
+// restrictProcess unveils the paths and pledges the helper. Violations
+// kill the helper, unless the error action is configured, in which case
+// (as well as for the log action) they fail with ENOSYS.
+func restrictProcess(action sandboxViolation, paths []sandboxPath) error {
+	for _, p := range append(sandboxSystemPaths, paths...) {
+		if err := unix.Unveil(p.path, p.perms); err != nil {
+			return fmt.Errorf("unveiling %s: %w", p.path, err)
+		}
+	}
+	if err := unix.UnveilBlock(); err != nil {
+		return fmt.Errorf("locking unveiled paths: %w", err)
+	}
+	promises := sandboxPromises
+	if action != sandboxViolationKill {
+		promises += " error"
+	}
+	if err := unix.Pledge(promises, ""); err != nil {
+		return fmt.Errorf("pledging: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"os/user"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSandboxFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg := registerSandboxFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-sandbox", "-sandbox-violation", "kill",
+		"-sandbox-path", "/run/firehose.sock:rw", "-sandbox-path", "/etc/mina"}))
+	require.NoError(t, cfg.validate())
+	require.True(t, cfg.enabled)
+	require.Equal(t, sandboxViolationKill, cfg.action)
+	require.Equal(t, sandboxPathsFlag{{path: "/run/firehose.sock", perms: "rw"}, {path: "/etc/mina", perms: "r"}}, cfg.paths)
+	require.Nil(t, cfg.uid)
+
+	require.Error(t, fs.Parse([]string{"-sandbox-path", "/tmp:rwz"}))
+	require.Error(t, fs.Parse([]string{"-sandbox-path", ":r"}))
+}
+
+func TestSandboxConfigValidate(t *testing.T) {
+	cfg := &sandboxConfig{violation: "ignore"}
+	require.Error(t, cfg.validate())
+
+	current, err := user.Current()
+	require.NoError(t, err)
+	// User may be given by name or by uid
+	for _, name := range []string{current.Username, current.Uid} {
+		cfg = &sandboxConfig{violation: "error", userName: name}
+		require.NoError(t, cfg.validate())
+		require.True(t, cfg.active())
+		require.Equal(t, current.Uid, strconv.Itoa(*cfg.uid))
+		require.Equal(t, current.Gid, strconv.Itoa(*cfg.gid))
+	}
+
+	cfg = &sandboxConfig{violation: "error", userName: "no-such-user-of-mina-tests"}
+	require.Error(t, cfg.validate())
+}
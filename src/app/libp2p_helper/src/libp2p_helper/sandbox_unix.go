@@ -0,0 +1,18 @@
+//go:build (linux && amd64) || (linux && arm64) || openbsd
+// +build linux,amd64 linux,arm64 openbsd
+
+package main
+
+import "syscall"
+
+// dropPrivileges switches all threads of the helper to the user and
+// group, supplementary groups are cleared
+func dropPrivileges(uid, gid int) error {
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
@@ -0,0 +1,13 @@
+//go:build !openbsd && (!linux || (!amd64 && !arm64))
+// +build !openbsd
+// +build !linux !amd64,!arm64
+
+package main
+
+func dropPrivileges(uid, gid int) error {
+	return errSandboxUnsupported
+}
+
+func restrictProcess(action sandboxViolation, paths []sandboxPath) error {
+	return errSandboxUnsupported
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var ipcLogger = logging.Logger("mina.helper.ipc")
+
+var ipcSchemaMismatchMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "Mina_libp2p_ipc_schema_mismatches",
+	Help: "Number of messages from the daemon of types unknown to the helper (e.g. of a newer schema)",
+}, []string{"kind"})
+
+// Kinds of messages whose type may be unknown to the helper
+const (
+	mismatchMessage     = "message"
+	mismatchRpcRequest  = "rpc_request"
+	mismatchPushMessage = "push_message"
+)
+
+type schemaMismatchKey struct {
+	kind  string
+	which uint16
+}
+
+// schemaMismatches counts messages of types the helper doesn't know, which
+// a daemon of a newer schema sends when the daemon and the helper are
+// upgraded at different times. Cap'n Proto skips unknown fields of known
+// types by design, hence only unknown types are detected. A warning is
+// logged for the first message of each unknown type and then whenever
+// its count reaches the next power of ten, so that a daemon repeating
+// such messages doesn't flood the log.
+type schemaMismatches struct {
+	counts map[schemaMismatchKey]uint64
+	mutex  sync.Mutex
+}
+
+func newSchemaMismatches() *schemaMismatches {
+	return &schemaMismatches{counts: make(map[schemaMismatchKey]uint64)}
+}
+
+// Report counts a message of the kind with an unknown union tag
+func (s *schemaMismatches) Report(kind string, which uint16) {
+	s.mutex.Lock()
+	key := schemaMismatchKey{kind: kind, which: which}
+	s.counts[key]++
+	count := s.counts[key]
+	s.mutex.Unlock()
+	ipcSchemaMismatchMetric.WithLabelValues(kind).Inc()
+	if isPowerOfTen(count) {
+		ipcLogger.Warnw("received message of a type unknown to the helper, daemon may use a newer schema",
+			"kind", kind, "which", which, "count", count)
+	}
+}
+
+// Counts returns the number of messages of each unknown type of the kind
+func (s *schemaMismatches) Counts(kind string) map[uint16]uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	res := make(map[uint16]uint64)
+	for key, count := range s.counts {
+		if key.kind == kind {
+			res[key.which] = count
+		}
+	}
+	return res
+}
+
+func isPowerOfTen(n uint64) bool {
+	for n >= 10 && n%10 == 0 {
+		n /= 10
+	}
+	return n == 1
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaMismatches(t *testing.T) {
+	s := newSchemaMismatches()
+	for i := 0; i < 12; i++ {
+		s.Report(mismatchRpcRequest, 100)
+	}
+	s.Report(mismatchRpcRequest, 101)
+	s.Report(mismatchPushMessage, 100)
+	require.Equal(t, map[uint16]uint64{100: 12, 101: 1}, s.Counts(mismatchRpcRequest))
+	require.Equal(t, map[uint16]uint64{100: 1}, s.Counts(mismatchPushMessage))
+	require.Empty(t, s.Counts(mismatchMessage))
+}
+
+func TestIsPowerOfTen(t *testing.T) {
+	for _, n := range []uint64{1, 10, 100, 1000000} {
+		require.True(t, isPowerOfTen(n), "%d", n)
+	}
+	for _, n := range []uint64{0, 2, 11, 20, 110, 1001} {
+		require.False(t, isPowerOfTen(n), "%d", n)
+	}
+}
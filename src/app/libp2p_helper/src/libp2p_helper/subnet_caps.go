@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"codanet"
+	ipc "libp2p_ipc"
+)
+
+// asnTableCache keeps the table of autonomous systems last loaded,
+// so that it's not read anew with every gating config
+type asnTableCache struct {
+	path  string
+	table *codanet.ASNTable
+	mutex sync.Mutex
+}
+
+func (c *asnTableCache) load(path string) (*codanet.ASNTable, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.table != nil && c.path == path {
+		return c.table, nil
+	}
+	table, err := codanet.LoadASNTable(path)
+	if err != nil {
+		return nil, err
+	}
+	c.path, c.table = path, table
+	return table, nil
+}
+
+func readSubnetCaps(gc ipc.GatingConfig, asnTables *asnTableCache) (codanet.SubnetCaps, error) {
+	caps := codanet.SubnetCaps{
+		PerSubnet: int(gc.MaxConnectionsPerSubnet()),
+		PerASN:    int(gc.MaxConnectionsPerAsn()),
+	}
+	path, err := gc.AsnTable()
+	if err != nil {
+		return caps, err
+	}
+	if path != "" {
+		caps.ASNs, err = asnTables.load(path)
+		if err != nil {
+			return caps, err
+		}
+	}
+	// Addresses not found in the table aren't capped, so the
+	// cap would silently do nothing without a table
+	if caps.PerASN > 0 && caps.ASNs.Len() == 0 {
+		return caps, errors.New("maxConnectionsPerAsn is set but asnTable lists no autonomous systems")
+	}
+	return caps, nil
+}
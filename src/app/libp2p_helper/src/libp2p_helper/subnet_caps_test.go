@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	gonet "net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestASNTableCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pathA := filepath.Join(dir, "a.tsv")
+	pathB := filepath.Join(dir, "b.tsv")
+	require.NoError(t, ioutil.WriteFile(pathA, []byte("5.0.0.0\t5.0.255.255\t64500\tDE\tEXAMPLE\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(pathB, []byte("5.0.0.0\t5.0.255.255\t64501\tDE\tEXAMPLE\n"), 0644))
+
+	var cache asnTableCache
+	tableA, err := cache.load(pathA)
+	require.NoError(t, err)
+	asn, ok := tableA.Lookup(gonet.ParseIP("5.0.0.1"))
+	require.True(t, ok)
+	require.Equal(t, uint32(64500), asn)
+
+	// The table is read once per path
+	require.NoError(t, os.Remove(pathA))
+	again, err := cache.load(pathA)
+	require.NoError(t, err)
+	require.Same(t, tableA, again)
+
+	tableB, err := cache.load(pathB)
+	require.NoError(t, err)
+	asn, _ = tableB.Lookup(gonet.ParseIP("5.0.0.1"))
+	require.Equal(t, uint32(64501), asn)
+
+	_, err = cache.load(pathA)
+	require.Error(t, err)
+}
+
+func TestReadSubnetCaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tablePath := filepath.Join(dir, "asn.tsv")
+	emptyPath := filepath.Join(dir, "empty.tsv")
+	require.NoError(t, ioutil.WriteFile(tablePath, []byte("5.0.0.0\t5.0.255.255\t64500\tDE\tEXAMPLE\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(emptyPath, nil, 0644))
+
+	mkGatingConfig := func(perAsn uint32, table string) ipc.GatingConfig {
+		_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+		require.NoError(t, err)
+		gc, err := ipc.NewRootGatingConfig(seg)
+		require.NoError(t, err)
+		gc.SetMaxConnectionsPerSubnet(4)
+		gc.SetMaxConnectionsPerAsn(perAsn)
+		require.NoError(t, gc.SetAsnTable(table))
+		return gc
+	}
+
+	var cache asnTableCache
+	caps, err := readSubnetCaps(mkGatingConfig(8, tablePath), &cache)
+	require.NoError(t, err)
+	require.Equal(t, 4, caps.PerSubnet)
+	require.Equal(t, 8, caps.PerASN)
+	require.Equal(t, 1, caps.ASNs.Len())
+
+	// The subnet cap alone needs no table
+	caps, err = readSubnetCaps(mkGatingConfig(0, ""), &cache)
+	require.NoError(t, err)
+	require.Equal(t, 4, caps.PerSubnet)
+
+	// The cap of autonomous systems is rejected without a table to
+	// look them up in, rather than silently not applied
+	_, err = readSubnetCaps(mkGatingConfig(8, ""), &cache)
+	require.Error(t, err)
+	_, err = readSubnetCaps(mkGatingConfig(8, emptyPath), &cache)
+	require.Error(t, err)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	ipc "libp2p_ipc"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var filteredSubscriptionsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "Mina_libp2p_gossip_filtered_subscriptions",
+	Help: "Number of subscription announcements of peers ignored by the subscription filter",
+}, []string{"reason"})
+
+// subscriptionFilter ignores subscription announcements of peers for
+// topics not matching the pattern, and ones of peers subscribed to the
+// maximal number of topics already, so that junk topics and floods of
+// subscriptions aren't tracked by pubsub. Topics joined by the helper
+// have to match the pattern as well. Subscriptions of a peer are
+// forgotten once pubsub removes the peer, which the filter learns of
+// as a raw tracer.
+type subscriptionFilter struct {
+	noopRawTracer
+	// nil allows all topics
+	pattern *regexp.Regexp
+	// zero for no limit
+	maxPerPeer int
+	topics     map[peer.ID]map[string]bool
+	mutex      sync.Mutex
+}
+
+func newSubscriptionFilter(pattern *regexp.Regexp, maxPerPeer int) *subscriptionFilter {
+	return &subscriptionFilter{
+		pattern:    pattern,
+		maxPerPeer: maxPerPeer,
+		topics:     make(map[peer.ID]map[string]bool),
+	}
+}
+
+func (f *subscriptionFilter) CanSubscribe(topic string) bool {
+	return f.pattern == nil || f.pattern.MatchString(topic)
+}
+
+func (f *subscriptionFilter) FilterIncomingSubscriptions(from peer.ID, subs []*pb.RPC_SubOpts) ([]*pb.RPC_SubOpts, error) {
+	allowed := pubsub.FilterSubscriptions(subs, f.CanSubscribe)
+	if n := len(subs) - len(allowed); n > 0 {
+		filteredSubscriptionsMetric.WithLabelValues("topic").Add(float64(n))
+	}
+	if f.maxPerPeer == 0 {
+		return allowed, nil
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	topics, has := f.topics[from]
+	if !has {
+		topics = make(map[string]bool)
+		f.topics[from] = topics
+	}
+	res := allowed[:0]
+	for _, sub := range allowed {
+		topic := sub.GetTopicid()
+		if !sub.GetSubscribe() {
+			delete(topics, topic)
+		} else if !topics[topic] {
+			if len(topics) >= f.maxPerPeer {
+				filteredSubscriptionsMetric.WithLabelValues("limit").Inc()
+				continue
+			}
+			topics[topic] = true
+		}
+		res = append(res, sub)
+	}
+	if len(topics) == 0 {
+		delete(f.topics, from)
+	}
+	return res, nil
+}
+
+func (f *subscriptionFilter) RemovePeer(p peer.ID) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.topics, p)
+}
+
+// readSubscriptionFilterConfig returns nil if neither
+// a pattern nor a limit of subscriptions is set
+func readSubscriptionFilterConfig(cfg ipc.SubscriptionFilterConfig) (*subscriptionFilter, error) {
+	pattern, err := cfg.TopicPattern()
+	if err != nil {
+		return nil, err
+	}
+	maxPerPeer := int(cfg.MaxSubscriptionsPerPeer())
+	if pattern == "" && maxPerPeer == 0 {
+		return nil, nil
+	}
+	var rx *regexp.Regexp
+	if pattern != "" {
+		// Topics have to match the whole pattern
+		rx, err = regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic pattern: %w", err)
+		}
+	}
+	return newSubscriptionFilter(rx, maxPerPeer), nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func mkTestSubOpts(subscribe bool, topics ...string) []*pb.RPC_SubOpts {
+	res := make([]*pb.RPC_SubOpts, 0, len(topics))
+	for _, topic := range topics {
+		topic := topic
+		res = append(res, &pb.RPC_SubOpts{Subscribe: &subscribe, Topicid: &topic})
+	}
+	return res
+}
+
+func subOptsTopics(subs []*pb.RPC_SubOpts) []string {
+	res := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		res = append(res, sub.GetTopicid())
+	}
+	return res
+}
+
+func TestSubscriptionFilterPattern(t *testing.T) {
+	f := newSubscriptionFilter(regexp.MustCompile("^(?:coda/.*|mina/telemetry)$"), 0)
+	require.True(t, f.CanSubscribe(consensusTopic))
+	require.False(t, f.CanSubscribe("junk"))
+
+	before := testutil.ToFloat64(filteredSubscriptionsMetric.WithLabelValues("topic"))
+	subs, err := f.FilterIncomingSubscriptions(peer.ID("a"), mkTestSubOpts(true, consensusTopic, "junk", "mina/telemetry/x", "mina/telemetry"))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{consensusTopic, "mina/telemetry"}, subOptsTopics(subs))
+	require.Equal(t, before+2, testutil.ToFloat64(filteredSubscriptionsMetric.WithLabelValues("topic")))
+}
+
+func TestSubscriptionFilterLimit(t *testing.T) {
+	f := newSubscriptionFilter(nil, 2)
+	a, b := peer.ID("a"), peer.ID("b")
+
+	before := testutil.ToFloat64(filteredSubscriptionsMetric.WithLabelValues("limit"))
+	subs, err := f.FilterIncomingSubscriptions(a, mkTestSubOpts(true, "t1", "t2", "t3"))
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	require.Equal(t, before+1, testutil.ToFloat64(filteredSubscriptionsMetric.WithLabelValues("limit")))
+
+	// Repeated announcements don't count against the limit
+	subs, err = f.FilterIncomingSubscriptions(a, mkTestSubOpts(true, subOptsTopics(subs)...))
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+
+	// Limits are per peer
+	subs, err = f.FilterIncomingSubscriptions(b, mkTestSubOpts(true, "t3"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"t3"}, subOptsTopics(subs))
+
+	// Unsubscribing frees a place
+	subs, err = f.FilterIncomingSubscriptions(a, mkTestSubOpts(false, "t1", "t2"))
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	subs, err = f.FilterIncomingSubscriptions(a, mkTestSubOpts(true, "t4", "t5"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"t4", "t5"}, subOptsTopics(subs))
+
+	// Subscriptions of removed peers are forgotten
+	f.RemovePeer(a)
+	require.NotContains(t, f.topics, a)
+	subs, err = f.FilterIncomingSubscriptions(a, mkTestSubOpts(true, "t6", "t7"))
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+}
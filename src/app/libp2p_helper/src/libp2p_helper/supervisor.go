@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	gonet "net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// Integration with service supervisors following the systemd protocols:
+// readiness and watchdog notifications are sent to $NOTIFY_SOCKET and
+// sockets passed with $LISTEN_FDS are used instead of binding new ones.
+// All of it is a no-op when the helper is not run by a supervisor.
+
+var supervisorLogger = logging.Logger("mina.helper.supervisor")
+
+// First file descriptor passed by socket activation
+const listenFdsStart = 3
+
+// Name of the activated socket to serve metrics on
+const metricsSocketName = "metrics"
+
+// sdNotify sends the state to the supervisor,
+// it's a no-op when $NOTIFY_SOCKET is not set
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+	// Abstract namespace socket
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+	conn, err := gonet.DialUnix("unixgram", nil, &gonet.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+func notifySupervisor(state string) {
+	if err := sdNotify(state); err != nil {
+		supervisorLogger.Warnf("Failed to notify supervisor of %q: %s", state, err)
+	}
+}
+
+func notifyReady(status string) {
+	notifySupervisor(fmt.Sprintf("READY=1\nSTATUS=%s", status))
+}
+
+func notifyReloading() {
+	notifySupervisor("RELOADING=1")
+}
+
+func notifyStopping() {
+	notifySupervisor("STOPPING=1")
+}
+
+// watchdogInterval returns the interval of watchdog notifications
+// requested by the supervisor, zero if the watchdog is disabled
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog pings the supervisor twice per watchdog interval
+func runWatchdog() {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		notifySupervisor("WATCHDOG=1")
+	}
+}
+
+var activatedListeners struct {
+	byName map[string]gonet.Listener
+	once   sync.Once
+	mutex  sync.Mutex
+}
+
+// readActivatedListeners returns listeners passed by socket activation
+// keyed by their names ($LISTEN_FDNAMES). Unnamed sockets are keyed by
+// their position, e.g. "0".
+func readActivatedListeners() (map[string]gonet.Listener, error) {
+	res := make(map[string]gonet.Listener)
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return res, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return res, err
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// Environment is not to be inherited by child processes
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(v)
+	}
+	for i := 0; i < n; i++ {
+		name := strconv.Itoa(i)
+		if i < len(names) && names[i] != "" && names[i] != "unknown" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		l, err := gonet.FileListener(f)
+		// FileListener duplicates the descriptor
+		f.Close()
+		if err != nil {
+			return res, fmt.Errorf("activated socket %s: %w", name, err)
+		}
+		res[name] = l
+	}
+	return res, nil
+}
+
+// takeActivatedListener returns the activated listener with the name,
+// nil if there is none. Each listener is handed out only once.
+func takeActivatedListener(name string) gonet.Listener {
+	activatedListeners.once.Do(func() {
+		ls, err := readActivatedListeners()
+		if err != nil {
+			supervisorLogger.Errorf("Failed to read activated sockets: %s", err)
+		}
+		activatedListeners.byName = ls
+	})
+	activatedListeners.mutex.Lock()
+	defer activatedListeners.mutex.Unlock()
+	l := activatedListeners.byName[name]
+	delete(activatedListeners.byName, name)
+	return l
+}
+
+// drain stops the helper gracefully, supervisor is notified
+// of stopping before connections are closed
+func (app *app) drain() {
+	notifyStopping()
+	if app.metricsServer != nil {
+		app.metricsServer.Shutdown()
+	}
+	if app.P2p != nil {
+		if app.reputationSaveStarted {
+			app.saveReputation()
+		}
+		if err := app.P2p.Host.Close(); err != nil {
+			supervisorLogger.Errorf("Failed to close host: %s", err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	gonet "net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSdNotify(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sd_notify")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socketPath := path.Join(dir, "notify")
+	conn, err := gonet.ListenUnixgram("unixgram", &gonet.UnixAddr{Name: socketPath, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, os.Setenv("NOTIFY_SOCKET", socketPath))
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	notifyReady("configured")
+
+	buf := make([]byte, 256)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "READY=1\nSTATUS=configured", string(buf[:n]))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	require.NoError(t, os.Setenv("WATCHDOG_USEC", "30000000"))
+	defer os.Unsetenv("WATCHDOG_USEC")
+	require.Equal(t, 30*time.Second, watchdogInterval())
+	require.NoError(t, os.Setenv("WATCHDOG_PID", "1"))
+	defer os.Unsetenv("WATCHDOG_PID")
+	require.Equal(t, time.Duration(0), watchdogInterval())
+}
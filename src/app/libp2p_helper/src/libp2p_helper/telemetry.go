@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	"github.com/go-errors/errors"
+	"github.com/ipfs/go-bitswap"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+var telemetryLogger = logging.Logger("mina.helper.telemetry")
+
+const (
+	defaultTelemetryInterval = 5 * time.Minute
+	telemetrySendTimeout     = 30 * time.Second
+)
+
+// telemetryReport is the helper-side telemetry of the node
+type telemetryReport struct {
+	PeerId          string  `json:"peer_id"`
+	Timestamp       int64   `json:"timestamp"`
+	PeerCount       int     `json:"peer_count"`
+	ConnectionCount int     `json:"connection_count"`
+	TotalIn         int64   `json:"total_in"`
+	TotalOut        int64   `json:"total_out"`
+	RateIn          float64 `json:"rate_in"`
+	RateOut         float64 `json:"rate_out"`
+	BlocksReceived  uint64  `json:"blocks_received"`
+	BlocksSent      uint64  `json:"blocks_sent"`
+	DataReceived    uint64  `json:"data_received"`
+	DataSent        uint64  `json:"data_sent"`
+	DupBlocks       uint64  `json:"dup_blocks_received"`
+	WantlistLength  int     `json:"wantlist_length"`
+}
+
+// signedTelemetry is the node-status message broadcast to sinks,
+// payload is the JSON-encoded telemetryReport signed with the key
+// of the peer it was produced by
+type signedTelemetry struct {
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+// telemetrySink is a destination of signed telemetry messages
+type telemetrySink interface {
+	Send(ctx context.Context, msg []byte) error
+}
+
+type topicTelemetrySink struct {
+	topic *pubsub.Topic
+}
+
+func (s *topicTelemetrySink) Send(ctx context.Context, msg []byte) error {
+	return s.topic.Publish(ctx, msg)
+}
+
+type httpTelemetrySink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpTelemetrySink) Send(ctx context.Context, msg []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("telemetry collector responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func newHttpTelemetrySink(collectorUrl string) (*httpTelemetrySink, error) {
+	u, err := url.Parse(collectorUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, errors.New("telemetry collector url must use https")
+	}
+	return &httpTelemetrySink{url: collectorUrl, client: &http.Client{}}, nil
+}
+
+func signTelemetry(pk crypto.PrivKey, report telemetryReport) ([]byte, error) {
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := pk.Sign(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(signedTelemetry{Payload: payload, Signature: sig})
+}
+
+func (app *app) collectTelemetry() (telemetryReport, error) {
+	bw := app.P2p.BandwidthCounter.GetBandwidthTotals()
+	// Bitswap isn't run by relay-only nodes, its counters are zero
+	stat := &bitswap.Stat{}
+	if app.P2p.Bitswap != nil {
+		var err error
+		stat, err = app.P2p.Bitswap.Stat()
+		if err != nil {
+			return telemetryReport{}, err
+		}
+	}
+	return telemetryReport{
+		PeerId:          peer.Encode(app.P2p.Me),
+		Timestamp:       time.Now().Unix(),
+		PeerCount:       len(app.P2p.Host.Peerstore().Peers()),
+		ConnectionCount: app.P2p.ConnectionManager.GetInfo().ConnCount,
+		TotalIn:         bw.TotalIn,
+		TotalOut:        bw.TotalOut,
+		RateIn:          bw.RateIn,
+		RateOut:         bw.RateOut,
+		BlocksReceived:  stat.BlocksReceived,
+		BlocksSent:      stat.BlocksSent,
+		DataReceived:    stat.DataReceived,
+		DataSent:        stat.DataSent,
+		DupBlocks:       stat.DupBlksReceived,
+		WantlistLength:  len(stat.Wantlist),
+	}, nil
+}
+
+// readTelemetryConfig returns sinks telemetry is to be sent to
+// along with the interval of sending, no sinks are returned
+// unless telemetry is enabled
+func readTelemetryConfig(app *app, cfg ipc.TelemetryConfig) ([]telemetrySink, time.Duration, error) {
+	if !cfg.Enabled() {
+		return nil, 0, nil
+	}
+	interval, err := cfg.Interval()
+	if err != nil {
+		return nil, 0, err
+	}
+	topicName, err := cfg.Topic()
+	if err != nil {
+		return nil, 0, err
+	}
+	collectorUrl, err := cfg.CollectorUrl()
+	if err != nil {
+		return nil, 0, err
+	}
+	sinks := []telemetrySink{}
+	if topicName != "" && app.relayOnly {
+		return nil, 0, errors.New("telemetry topic can't be used in relay-only mode")
+	}
+	if topicName != "" {
+		// Topic is dedicated to telemetry, hence it isn't
+		// shared with topics the daemon publishes to
+		app.topicSpecs.Register(topicName, topicSpec{kind: ipc.MessageKind_telemetry, maxSize: maxTelemetryMessageSize})
+		topic, err := app.P2p.Pubsub.Join(topicName)
+		if err != nil {
+			return nil, 0, err
+		}
+		sinks = append(sinks, &topicTelemetrySink{topic: topic})
+	}
+	if collectorUrl != "" {
+		sink, err := newHttpTelemetrySink(collectorUrl)
+		if err != nil {
+			return nil, 0, err
+		}
+		sinks = append(sinks, sink)
+	}
+	d := time.Duration(interval.NanoSec())
+	if d == 0 {
+		d = defaultTelemetryInterval
+	}
+	return sinks, d, nil
+}
+
+func (app *app) sendTelemetry(sinks []telemetrySink) error {
+	report, err := app.collectTelemetry()
+	if err != nil {
+		return err
+	}
+	msg, err := signTelemetry(app.P2p.Host.Peerstore().PrivKey(app.P2p.Me), report)
+	if err != nil {
+		return err
+	}
+	for _, sink := range sinks {
+		ctx, cancel := context.WithTimeout(app.Ctx, telemetrySendTimeout)
+		if err := sink.Send(ctx, msg); err != nil {
+			telemetryLogger.Warnf("Failed to send telemetry: %s", err)
+		}
+		cancel()
+	}
+	return nil
+}
+
+// reportTelemetry periodically broadcasts signed telemetry to sinks
+func (app *app) reportTelemetry(interval time.Duration, sinks []telemetrySink) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-app.Ctx.Done():
+			return
+		case <-ticker.C:
+			if app.inMaintenance() {
+				continue
+			}
+			if err := app.sendTelemetry(sinks); err != nil {
+				telemetryLogger.Errorf("Failed to collect telemetry: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignTelemetry(t *testing.T) {
+	pk := newTestKey(t)
+	report := telemetryReport{PeerId: "peer", PeerCount: 3, BlocksReceived: 10}
+	msg, err := signTelemetry(pk, report)
+	require.NoError(t, err)
+
+	var signed signedTelemetry
+	require.NoError(t, json.Unmarshal(msg, &signed))
+	ok, err := pk.GetPublic().Verify(signed.Payload, signed.Signature)
+	require.NoError(t, err)
+	require.True(t, ok)
+	var decoded telemetryReport
+	require.NoError(t, json.Unmarshal(signed.Payload, &decoded))
+	require.Equal(t, report, decoded)
+}
+
+func TestHttpTelemetrySink(t *testing.T) {
+	received := make(chan []byte, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		received <- body
+	}))
+	defer srv.Close()
+
+	_, err := newHttpTelemetrySink("http://collector.example")
+	require.Error(t, err)
+	sink, err := newHttpTelemetrySink(srv.URL)
+	require.NoError(t, err)
+	sink.client = srv.Client()
+
+	require.NoError(t, sink.Send(context.Background(), []byte("{}")))
+	require.Equal(t, []byte("{}"), <-received)
+}
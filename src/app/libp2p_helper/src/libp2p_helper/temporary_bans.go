@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	gonet "net"
+	"strings"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// parseIPNet parses a CIDR range or a single IP address
+func parseIPNet(s string) (gonet.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := gonet.ParseCIDR(s)
+		if err != nil {
+			return gonet.IPNet{}, err
+		}
+		return *ipNet, nil
+	}
+	ip := gonet.ParseIP(s)
+	if ip == nil {
+		return gonet.IPNet{}, fmt.Errorf("unparsable IP %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return gonet.IPNet{IP: ip4, Mask: gonet.CIDRMask(32, 32)}, nil
+	}
+	return gonet.IPNet{IP: ip, Mask: gonet.CIDRMask(128, 128)}, nil
+}
+
+type BanPeerReqT = ipc.Libp2pHelperInterface_BanPeer_Request
+type BanPeerReq BanPeerReqT
+
+func fromBanPeerReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.BanPeer()
+	return BanPeerReq(i), err
+}
+
+func (m BanPeerReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	pid, err := BanPeerReqT(m).PeerId()
+	var id string
+	if err == nil {
+		id, err = pid.Id()
+	}
+	var p peer.ID
+	if err == nil {
+		p, err = peer.Decode(id)
+	}
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	duration, err := BanPeerReqT(m).Duration()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	app.P2p.BanPeerFor(p, time.Duration(duration.NanoSec()))
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewBanPeer()
+		panicOnErr(err)
+	})
+}
+
+type BanIpReqT = ipc.Libp2pHelperInterface_BanIp_Request
+type BanIpReq BanIpReqT
+
+func fromBanIpReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.BanIp()
+	return BanIpReq(i), err
+}
+
+func (m BanIpReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	ip, err := BanIpReqT(m).Ip()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	ipNet, err := parseIPNet(ip)
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	duration, err := BanIpReqT(m).Duration()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	app.P2p.BanIPNetFor(ipNet, time.Duration(duration.NanoSec()))
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewBanIp()
+		panicOnErr(err)
+	})
+}
+
+type ListBansReqT = ipc.Libp2pHelperInterface_ListBans_Request
+type ListBansReq ListBansReqT
+
+func fromListBansReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.ListBans()
+	return ListBansReq(i), err
+}
+
+func (m ListBansReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	bans := app.P2p.TemporaryBans()
+	now := time.Now()
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		r, err := m.NewListBans()
+		panicOnErr(err)
+		lst, err := r.NewBans(int32(len(bans)))
+		panicOnErr(err)
+		for i, ban := range bans {
+			mb := lst.At(i)
+			if ban.IPNet != nil {
+				panicOnErr(mb.SetIp(ban.IPNet.String()))
+			} else {
+				pid, err := mb.NewPeerId()
+				panicOnErr(err)
+				panicOnErr(pid.SetId(peer.Encode(ban.Peer)))
+			}
+			expiresAt, err := mb.NewExpiresAt()
+			panicOnErr(err)
+			setNanoTime(&expiresAt, ban.ExpiresAt)
+			remaining, err := mb.NewRemaining()
+			panicOnErr(err)
+			if d := ban.ExpiresAt.Sub(now); d > 0 {
+				remaining.SetNanoSec(uint64(d))
+			}
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIPNet(t *testing.T) {
+	for s, expected := range map[string]string{
+		"1.2.3.4":    "1.2.3.4/32",
+		"1.2.3.0/24": "1.2.3.0/24",
+		"1.2.3.4/24": "1.2.3.0/24",
+		"2a01::1":    "2a01::1/128",
+		"2a01::/32":  "2a01::/32",
+	} {
+		ipNet, err := parseIPNet(s)
+		require.NoError(t, err)
+		require.Equal(t, expected, ipNet.String())
+	}
+	_, err := parseIPNet("1.2.3")
+	require.Error(t, err)
+	_, err = parseIPNet("1.2.3.4/33")
+	require.Error(t, err)
+}
+
+func testBanPeer(t *testing.T, app *app, p peer.ID, duration time.Duration) {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	m, err := ipc.NewRootLibp2pHelperInterface_BanPeer_Request(seg)
+	require.NoError(t, err)
+	pid, err := m.NewPeerId()
+	require.NoError(t, err)
+	require.NoError(t, pid.SetId(peer.Encode(p)))
+	d, err := m.NewDuration()
+	require.NoError(t, err)
+	d.SetNanoSec(uint64(duration))
+
+	var mRpcSeqno uint64 = 2500
+	resMsg := BanPeerReq(m).handle(app, mRpcSeqno)
+	seqno, respSuccess := checkRpcResponseSuccess(t, resMsg, "banPeer")
+	require.Equal(t, seqno, mRpcSeqno)
+	require.True(t, respSuccess.HasBanPeer())
+}
+
+func testBanIp(t *testing.T, app *app, ip string, duration time.Duration) {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	m, err := ipc.NewRootLibp2pHelperInterface_BanIp_Request(seg)
+	require.NoError(t, err)
+	require.NoError(t, m.SetIp(ip))
+	d, err := m.NewDuration()
+	require.NoError(t, err)
+	d.SetNanoSec(uint64(duration))
+
+	var mRpcSeqno uint64 = 2501
+	resMsg := BanIpReq(m).handle(app, mRpcSeqno)
+	seqno, respSuccess := checkRpcResponseSuccess(t, resMsg, "banIp")
+	require.Equal(t, seqno, mRpcSeqno)
+	require.True(t, respSuccess.HasBanIp())
+}
+
+func testListBans(t *testing.T, app *app) ipc.Libp2pHelperInterface_TemporaryBan_List {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	m, err := ipc.NewRootLibp2pHelperInterface_ListBans_Request(seg)
+	require.NoError(t, err)
+
+	var mRpcSeqno uint64 = 2502
+	resMsg := ListBansReq(m).handle(app, mRpcSeqno)
+	seqno, respSuccess := checkRpcResponseSuccess(t, resMsg, "listBans")
+	require.Equal(t, seqno, mRpcSeqno)
+	require.True(t, respSuccess.HasListBans())
+	resp, err := respSuccess.ListBans()
+	require.NoError(t, err)
+	bans, err := resp.Bans()
+	require.NoError(t, err)
+	return bans
+}
+
+func TestTemporaryBans(t *testing.T) {
+	testApp, _ := newTestApp(t, nil, true)
+	other, _ := newTestApp(t, nil, true)
+
+	testBanPeer(t, testApp, other.P2p.Me, time.Hour)
+	testBanIp(t, testApp, "1.2.3.0/24", 2*time.Hour)
+
+	bans := testListBans(t, testApp)
+	require.Equal(t, 2, bans.Len())
+	pid, err := bans.At(0).PeerId()
+	require.NoError(t, err)
+	id, err := pid.Id()
+	require.NoError(t, err)
+	require.Equal(t, peer.Encode(other.P2p.Me), id)
+	remaining, err := bans.At(0).Remaining()
+	require.NoError(t, err)
+	require.InDelta(t, float64(time.Hour), float64(remaining.NanoSec()), float64(time.Minute))
+	ip, err := bans.At(1).Ip()
+	require.NoError(t, err)
+	require.Equal(t, "1.2.3.0/24", ip)
+
+	otherInfos, err := addrInfos(other.P2p.Host)
+	require.NoError(t, err)
+	require.Error(t, testApp.P2p.Host.Connect(testApp.Ctx, otherInfos[0]))
+
+	// Zero duration lifts a ban
+	testBanPeer(t, testApp, other.P2p.Me, 0)
+	require.Equal(t, 1, testListBans(t, testApp).Len())
+}
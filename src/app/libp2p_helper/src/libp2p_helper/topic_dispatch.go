@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	capnp "capnproto.org/go/capnp/v3"
+)
+
+// topicDispatcher guarantees per-topic FIFO delivery of gossip to the
+// daemon. Validators of a topic run concurrently, each in its own goroutine,
+// so writing upcalls directly from a validator can reorder messages.
+// Instead each message reserves a ticket (its per-topic sequence number)
+// as soon as pubsub passes it to the validator, before any processing.
+// Upcalls are written by a single goroutine in the order of tickets,
+// an upcall waits for all messages with lower tickets to be either
+// written or dropped.
+//
+// The writer also takes the validation turns of the topic queue on behalf
+// of messages, so that turns are given in the order of tickets too and a
+// message held back by the ordering never holds a turn.
+type topicDispatcher struct {
+	queue *validationQueue
+	// last reserved ticket
+	reserved uint64
+	// upcalls (or dropped tickets) waiting for their turn to be written
+	pending map[uint64]dispatchedUpcall
+	mutex   sync.Mutex
+	// signalled when an entry is added to pending
+	ready chan struct{}
+}
+
+// dispatchedUpcall is an upcall put to the dispatcher, msg is nil for
+// tickets of dropped messages
+type dispatchedUpcall struct {
+	ctx context.Context
+	msg *capnp.Message
+	// receives whether the upcall got a validation turn and was written
+	turn chan bool
+}
+
+func newTopicDispatcher(ctx context.Context, queue *validationQueue, write func(*capnp.Message)) *topicDispatcher {
+	d := &topicDispatcher{
+		queue:   queue,
+		pending: make(map[uint64]dispatchedUpcall),
+		ready:   make(chan struct{}, 1),
+	}
+	go d.run(ctx, write)
+	return d
+}
+
+func (d *topicDispatcher) run(ctx context.Context, write func(*capnp.Message)) {
+	next := uint64(1)
+	for {
+		d.mutex.Lock()
+		u, has := d.pending[next]
+		if has {
+			delete(d.pending, next)
+			next++
+		}
+		d.mutex.Unlock()
+		if !has {
+			select {
+			case <-ctx.Done():
+				return
+			case <-d.ready:
+			}
+			continue
+		}
+		if u.msg == nil {
+			continue
+		}
+		if !d.queue.Acquire(u.ctx) {
+			u.turn <- false
+			continue
+		}
+		write(u.msg)
+		u.turn <- true
+	}
+}
+
+// Reserve returns the next ticket of the topic. Every reserved ticket
+// must be passed either to Deliver or to Skip, otherwise upcalls
+// of all later tickets are held back forever.
+func (d *topicDispatcher) Reserve() uint64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.reserved++
+	return d.reserved
+}
+
+// Deliver puts the upcall of the ticket to be written once all lower
+// tickets are done. The returned channel receives true after the upcall
+// took a validation turn of the topic and was written, or false if ctx
+// was done before the turn came (the upcall isn't written then).
+func (d *topicDispatcher) Deliver(ctx context.Context, ticket uint64, msg *capnp.Message) <-chan bool {
+	turn := make(chan bool, 1)
+	d.put(ticket, dispatchedUpcall{ctx: ctx, msg: msg, turn: turn})
+	return turn
+}
+
+// Skip releases the ticket of a message dropped before its upcall was built
+func (d *topicDispatcher) Skip(ticket uint64) {
+	d.put(ticket, dispatchedUpcall{})
+}
+
+func (d *topicDispatcher) put(ticket uint64, u dispatchedUpcall) {
+	d.mutex.Lock()
+	d.pending[ticket] = u
+	d.mutex.Unlock()
+	select {
+	case d.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (app *app) topicDispatcher(topic string) *topicDispatcher {
+	app.TopicDispatchersMutex.Lock()
+	defer app.TopicDispatchersMutex.Unlock()
+	d, has := app.TopicDispatchers[topic]
+	if !has {
+		d = newTopicDispatcher(app.Ctx, app.validationQueue(topic), app.writeGossip)
+		app.TopicDispatchers[topic] = d
+	}
+	return d
+}
+
+// writeGossip writes gossipReceived upcalls, batched if configured
+func (app *app) writeGossip(msg *capnp.Message) {
+	app.validationBatches.Write(msg, app.writeMsg)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	capnp "capnproto.org/go/capnp/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopicDispatcherOrdering(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mutex sync.Mutex
+	tickets := make(map[*capnp.Message]uint64)
+	written := make([]uint64, 0)
+	d := newTopicDispatcher(ctx, newValidationQueue("test", 0), func(msg *capnp.Message) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		written = append(written, tickets[msg])
+	})
+
+	// Tickets are reserved in order, but delivered in random order,
+	// as validators finish their processing
+	n := 1000
+	reserved := make([]uint64, n)
+	for i := range reserved {
+		reserved[i] = d.Reserve()
+	}
+	rand.Shuffle(n, func(i, j int) { reserved[i], reserved[j] = reserved[j], reserved[i] })
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for _, ticket := range reserved {
+		go func(ticket uint64) {
+			defer wg.Done()
+			if ticket%10 == 0 {
+				d.Skip(ticket)
+				return
+			}
+			msg := mkMsg(func(*capnp.Segment) {})
+			mutex.Lock()
+			tickets[msg] = ticket
+			mutex.Unlock()
+			require.True(t, <-d.Deliver(ctx, ticket, msg))
+		}(ticket)
+	}
+	wg.Wait()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Len(t, written, n-n/10)
+	for i := 1; i < len(written); i++ {
+		require.Less(t, written[i-1], written[i])
+	}
+}
+
+func TestTopicDispatcherTurns(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	queue := newValidationQueue("test", 0)
+	queue.SetConcurrency(1)
+	var mutex sync.Mutex
+	written := 0
+	d := newTopicDispatcher(ctx, queue, func(*capnp.Message) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		written++
+	})
+
+	first, second, third := d.Reserve(), d.Reserve(), d.Reserve()
+	require.True(t, <-d.Deliver(ctx, first, mkMsg(func(*capnp.Segment) {})))
+
+	// The only turn is taken, the second message times out waiting for it
+	// and isn't written
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer timeoutCancel()
+	require.False(t, <-d.Deliver(timeoutCtx, second, mkMsg(func(*capnp.Segment) {})))
+
+	turn := d.Deliver(ctx, third, mkMsg(func(*capnp.Segment) {}))
+	queue.Release()
+	require.True(t, <-turn)
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Equal(t, 2, written)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+type topicPeer struct {
+	id    peer.ID
+	score float64
+}
+
+// topicPeersTracer tracks peers gossip of topics goes to, as pubsub
+// doesn't expose its mesh and fanout. Mesh members are followed with
+// grafts and prunes. Fanout peers are learnt of from messages of ours
+// sent to them while we aren't in the mesh of the topic, they're
+// forgotten after the fanout TTL, as the router forgets them.
+type topicPeersTracer struct {
+	noopRawTracer
+	me     peer.ID
+	joined map[string]bool
+	mesh   map[string]map[peer.ID]bool
+	// time our last message of the topic was sent to the peer
+	fanout map[string]map[peer.ID]time.Time
+	now    func() time.Time
+	mutex  sync.Mutex
+}
+
+// Reset forgets peers of a previous router, it's
+// called before the router of the host is created
+func (t *topicPeersTracer) Reset(me peer.ID) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.me = me
+	t.joined = make(map[string]bool)
+	t.mesh = make(map[string]map[peer.ID]bool)
+	t.fanout = make(map[string]map[peer.ID]time.Time)
+	if t.now == nil {
+		t.now = time.Now
+	}
+}
+
+func (t *topicPeersTracer) Join(topic string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.joined[topic] = true
+	// the router grafts fanout peers to the mesh
+	delete(t.fanout, topic)
+}
+
+func (t *topicPeersTracer) Leave(topic string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.joined, topic)
+	delete(t.mesh, topic)
+}
+
+func (t *topicPeersTracer) Graft(p peer.ID, topic string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	peers, has := t.mesh[topic]
+	if !has {
+		peers = make(map[peer.ID]bool)
+		t.mesh[topic] = peers
+	}
+	peers[p] = true
+}
+
+func (t *topicPeersTracer) Prune(p peer.ID, topic string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.mesh[topic], p)
+}
+
+func (t *topicPeersTracer) RemovePeer(p peer.ID) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, peers := range t.mesh {
+		delete(peers, p)
+	}
+	for _, peers := range t.fanout {
+		delete(peers, p)
+	}
+}
+
+func (t *topicPeersTracer) SendRPC(rpc *pubsub.RPC, p peer.ID) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, msg := range rpc.GetPublish() {
+		topic := msg.GetTopic()
+		if peer.ID(msg.GetFrom()) != t.me || t.joined[topic] {
+			continue
+		}
+		peers, has := t.fanout[topic]
+		if !has {
+			peers = make(map[peer.ID]time.Time)
+			t.fanout[topic] = peers
+		}
+		peers[p] = t.now()
+	}
+}
+
+// Peers returns mesh and fanout peers of the topic,
+// ordered by score, highest first
+func (t *topicPeersTracer) Peers(topic string, score func(peer.ID) float64) (mesh []topicPeer, fanout []topicPeer) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for p := range t.mesh[topic] {
+		mesh = append(mesh, topicPeer{id: p, score: score(p)})
+	}
+	expiry := t.now().Add(-pubsub.GossipSubFanoutTTL)
+	for p, sentAt := range t.fanout[topic] {
+		if sentAt.Before(expiry) {
+			delete(t.fanout[topic], p)
+			continue
+		}
+		fanout = append(fanout, topicPeer{id: p, score: score(p)})
+	}
+	sortTopicPeers(mesh)
+	sortTopicPeers(fanout)
+	return
+}
+
+func sortTopicPeers(peers []topicPeer) {
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].score != peers[j].score {
+			return peers[i].score > peers[j].score
+		}
+		return peers[i].id < peers[j].id
+	})
+}
+
+type GetTopicPeersReqT = ipc.Libp2pHelperInterface_GetTopicPeers_Request
+type GetTopicPeersReq GetTopicPeersReqT
+
+func fromGetTopicPeersReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.GetTopicPeers()
+	return GetTopicPeersReq(i), err
+}
+
+func (m GetTopicPeersReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	topic, err := GetTopicPeersReqT(m).Topic()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	if topic == "" {
+		return mkRpcRespError(seqno, badRPC(errors.New("empty topic")))
+	}
+	mesh, fanout := app.topicPeers.Peers(topic, app.gossipScores.Score)
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		r, err := m.NewGetTopicPeers()
+		panicOnErr(err)
+		lst, err := r.NewMesh(int32(len(mesh)))
+		panicOnErr(err)
+		setTopicPeers(lst, mesh)
+		lst, err = r.NewFanout(int32(len(fanout)))
+		panicOnErr(err)
+		setTopicPeers(lst, fanout)
+		r.SetScored(app.peerScoring)
+	})
+}
+
+func setTopicPeers(lst ipc.Libp2pHelperInterface_TopicPeer_List, peers []topicPeer) {
+	for i, p := range peers {
+		tp := lst.At(i)
+		pid, err := tp.NewPeerId()
+		panicOnErr(err)
+		panicOnErr(pid.SetId(peer.Encode(p.id)))
+		tp.SetScore(p.score)
+	}
+}
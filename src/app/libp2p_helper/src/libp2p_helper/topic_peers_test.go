@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/stretchr/testify/require"
+)
+
+func mkTestPublishRPC(from peer.ID, topic string) *pubsub.RPC {
+	return &pubsub.RPC{RPC: pb.RPC{Publish: []*pb.Message{{From: []byte(from), Topic: &topic}}}}
+}
+
+func TestTopicPeersMesh(t *testing.T) {
+	var tr topicPeersTracer
+	tr.Reset(peer.ID("me"))
+	a, b, c := peer.ID("a"), peer.ID("b"), peer.ID("c")
+
+	tr.Join("t")
+	tr.Graft(a, "t")
+	tr.Graft(b, "t")
+	tr.Graft(c, "t")
+	tr.Graft(a, "other")
+	tr.Prune(b, "t")
+	var scores gossipScores
+	scores.Inspect(map[peer.ID]*pubsub.PeerScoreSnapshot{a: {Score: 1}, c: {Score: 2}})
+	mesh, fanout := tr.Peers("t", scores.Score)
+	require.Equal(t, []topicPeer{{id: c, score: 2}, {id: a, score: 1}}, mesh)
+	require.Empty(t, fanout)
+
+	// Removed peers leave meshes of all topics
+	tr.RemovePeer(a)
+	mesh, _ = tr.Peers("t", scores.Score)
+	require.Equal(t, []topicPeer{{id: c, score: 2}}, mesh)
+	mesh, _ = tr.Peers("other", scores.Score)
+	require.Empty(t, mesh)
+
+	tr.Leave("t")
+	mesh, _ = tr.Peers("t", scores.Score)
+	require.Empty(t, mesh)
+}
+
+func TestTopicPeersFanout(t *testing.T) {
+	var tr topicPeersTracer
+	now := time.Now()
+	tr.now = func() time.Time { return now }
+	me, a, b := peer.ID("me"), peer.ID("a"), peer.ID("b")
+	tr.Reset(me)
+	var scores gossipScores
+
+	tr.SendRPC(mkTestPublishRPC(me, "t"), a)
+	// Messages of others are relayed, not published
+	tr.SendRPC(mkTestPublishRPC(b, "t"), b)
+	_, fanout := tr.Peers("t", scores.Score)
+	require.Equal(t, []topicPeer{{id: a}}, fanout)
+
+	// Fanout peers are forgotten after the fanout TTL
+	now = now.Add(pubsub.GossipSubFanoutTTL / 2)
+	tr.SendRPC(mkTestPublishRPC(me, "t"), b)
+	now = now.Add(pubsub.GossipSubFanoutTTL/2 + time.Second)
+	_, fanout = tr.Peers("t", scores.Score)
+	require.Equal(t, []topicPeer{{id: b}}, fanout)
+
+	// Joining the topic turns fanout peers into mesh members
+	tr.Join("t")
+	tr.Graft(b, "t")
+	tr.SendRPC(mkTestPublishRPC(me, "t"), a)
+	mesh, fanout := tr.Peers("t", scores.Score)
+	require.Equal(t, []topicPeer{{id: b}}, mesh)
+	require.Empty(t, fanout)
+}
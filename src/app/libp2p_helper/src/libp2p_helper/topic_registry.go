@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sync"
+
+	ipc "libp2p_ipc"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	consensusTopic = "coda/consensus-messages/0.0.1"
+	// Size of the largest gossip message, as of blocks
+	maxGossipMessageSize = 1 << 25 // 32 MiB
+	// Signed JSON of telemetryReport
+	maxTelemetryMessageSize = 1 << 16 // 64 KiB
+)
+
+// topicSpec tells the kind of messages gossiped over a topic
+// and their maximal size, larger messages are rejected
+type topicSpec struct {
+	kind    ipc.MessageKind
+	maxSize int
+}
+
+// Topics of the daemon
+var daemonTopics = map[string]topicSpec{
+	consensusTopic: {kind: ipc.MessageKind_consensus, maxSize: maxGossipMessageSize},
+}
+
+// topicRegistry maps topics to specs of their messages, the daemon's
+// topics are known in advance, topics of the helper's own features
+// are registered once their names are configured. Message ID schemes
+// and compression of topics are kept apart, as they're set by the daemon.
+type topicRegistry struct {
+	specs     map[string]topicSpec
+	idSchemes map[string]ipc.MessageIdScheme
+	// topics published to compressed
+	compressed map[string]bool
+	mutex      sync.RWMutex
+}
+
+func newTopicRegistry() *topicRegistry {
+	specs := make(map[string]topicSpec, len(daemonTopics))
+	for topic, spec := range daemonTopics {
+		specs[topic] = spec
+	}
+	return &topicRegistry{
+		specs:      specs,
+		idSchemes:  make(map[string]ipc.MessageIdScheme),
+		compressed: make(map[string]bool),
+	}
+}
+
+func (r *topicRegistry) Register(topic string, spec topicSpec) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.specs[topic] = spec
+}
+
+// Lookup returns the spec of the topic, topics not registered
+// are of unknown kind limited by the size of the largest message
+func (r *topicRegistry) Lookup(topic string) topicSpec {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if spec, has := r.specs[topic]; has {
+		return spec
+	}
+	return topicSpec{kind: ipc.MessageKind_unknown, maxSize: maxGossipMessageSize}
+}
+
+// SetMessageIdScheme sets the scheme of IDs of messages of the topic,
+// messages received afterwards are identified with it
+func (r *topicRegistry) SetMessageIdScheme(topic string, scheme ipc.MessageIdScheme) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if scheme == ipc.MessageIdScheme_contentHash {
+		delete(r.idSchemes, topic)
+	} else {
+		r.idSchemes[topic] = scheme
+	}
+}
+
+// SetCompression sets whether messages published to the topic are
+// compressed, compressed messages are received regardless
+func (r *topicRegistry) SetCompression(topic string, compress bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if compress {
+		r.compressed[topic] = true
+	} else {
+		delete(r.compressed, topic)
+	}
+}
+
+func (r *topicRegistry) Compressed(topic string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.compressed[topic]
+}
+
+// MessageId is the message ID function of gossipsub, messages are
+// identified by a hash of their topic and payload unless another
+// scheme is set for the topic
+func (r *topicRegistry) MessageId(pmsg *pb.Message) string {
+	r.mutex.RLock()
+	scheme := r.idSchemes[pmsg.GetTopic()]
+	r.mutex.RUnlock()
+	if scheme == ipc.MessageIdScheme_authorSeqno {
+		return pubsub.DefaultMsgIdFn(pmsg)
+	}
+	hash := contentHash(pmsg.GetTopic(), pmsg.GetData())
+	return string(hash[:])
+}
+
+// contentHash is the hash of a gossip payload keyed by its topic
+func contentHash(topic string, data []byte) (res [32]byte) {
+	hash, err := blake2b.New256([]byte(topic))
+	panicOnErr(err)
+	_, err = hash.Write(data)
+	panicOnErr(err)
+	copy(res[:], hash.Sum(nil))
+	return
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	ipc "libp2p_ipc"
+
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopicRegistry(t *testing.T) {
+	r := newTopicRegistry()
+	require.Equal(t, ipc.MessageKind_consensus, r.Lookup(consensusTopic).kind)
+	require.Equal(t, topicSpec{kind: ipc.MessageKind_unknown, maxSize: maxGossipMessageSize}, r.Lookup("othertopic"))
+
+	r.Register("telemetry", topicSpec{kind: ipc.MessageKind_telemetry, maxSize: maxTelemetryMessageSize})
+	require.Equal(t, topicSpec{kind: ipc.MessageKind_telemetry, maxSize: maxTelemetryMessageSize}, r.Lookup("telemetry"))
+	// Registries don't share topics of the helper
+	require.Equal(t, ipc.MessageKind_unknown, newTopicRegistry().Lookup("telemetry").kind)
+}
+
+func TestMessageIdScheme(t *testing.T) {
+	r := newTopicRegistry()
+	gossip := func(topic string, from string, seqno byte) *pb.Message {
+		return &pb.Message{
+			Data:  []byte("block"),
+			Topic: &topic,
+			From:  []byte(from),
+			Seqno: []byte{0, 0, 0, 0, 0, 0, 0, seqno},
+		}
+	}
+
+	// Identical payloads of a topic are duplicates by default
+	require.Equal(t, r.MessageId(gossip("a", "alice", 1)), r.MessageId(gossip("a", "bob", 2)))
+	require.NotEqual(t, r.MessageId(gossip("a", "alice", 1)), r.MessageId(gossip("b", "alice", 1)))
+
+	r.SetMessageIdScheme("a", ipc.MessageIdScheme_authorSeqno)
+	require.NotEqual(t, r.MessageId(gossip("a", "alice", 1)), r.MessageId(gossip("a", "bob", 2)))
+	require.NotEqual(t, r.MessageId(gossip("a", "alice", 1)), r.MessageId(gossip("a", "alice", 2)))
+	require.Equal(t, r.MessageId(gossip("a", "alice", 1)), r.MessageId(gossip("a", "alice", 1)))
+	// Other topics keep content hashes
+	require.Equal(t, r.MessageId(gossip("b", "alice", 1)), r.MessageId(gossip("b", "bob", 2)))
+
+	r.SetMessageIdScheme("a", ipc.MessageIdScheme_contentHash)
+	require.Equal(t, r.MessageId(gossip("a", "alice", 1)), r.MessageId(gossip("a", "bob", 2)))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/crypto/blake2b"
+)
+
+var topologyLogger = logging.Logger("mina.helper.topology")
+
+const defaultTopologyExportInterval = 10 * time.Minute
+
+// topologyEdge is a connection of the node to a peer
+type topologyEdge struct {
+	Peer      string `json:"peer"`
+	Direction string `json:"direction"`
+	Transport string `json:"transport"`
+	Family    string `json:"family"`
+	Relayed   bool   `json:"relayed"`
+	// connection age in seconds
+	Age int64 `json:"age"`
+}
+
+// topologySnapshot is a record of connection edges of the node
+// at the moment, snapshots of many nodes make a dataset for studying
+// topology of the network
+type topologySnapshot struct {
+	Node       string         `json:"node"`
+	Timestamp  int64          `json:"timestamp"`
+	Anonymized bool           `json:"anonymized"`
+	Edges      []topologyEdge `json:"edges"`
+}
+
+// anonymizePeer replaces peer id with its hash. Hash is not salted,
+// so that snapshots of different nodes can be joined into a graph.
+func anonymizePeer(id peer.ID) string {
+	h := blake2b.Sum256([]byte(id))
+	return hex.EncodeToString(h[:])
+}
+
+func encodeTopologyPeer(id peer.ID, anonymize bool) string {
+	if anonymize {
+		return anonymizePeer(id)
+	}
+	return peer.Encode(id)
+}
+
+func takeTopologySnapshot(self peer.ID, conns []network.Conn, anonymize bool, now time.Time) topologySnapshot {
+	edges := make([]topologyEdge, 0, len(conns))
+	for _, c := range conns {
+		class, direct := classifyAddr(c.RemoteMultiaddr())
+		stat := c.Stat()
+		direction := "outbound"
+		if stat.Direction == network.DirInbound {
+			direction = "inbound"
+		}
+		edge := topologyEdge{
+			Peer:      encodeTopologyPeer(c.RemotePeer(), anonymize),
+			Direction: direction,
+			Relayed:   !direct,
+		}
+		if direct {
+			edge.Transport = class.transport
+			edge.Family = class.family
+		}
+		if !stat.Opened.IsZero() {
+			edge.Age = int64(now.Sub(stat.Opened) / time.Second)
+		}
+		edges = append(edges, edge)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		return edges[i].Peer < edges[j].Peer
+	})
+	return topologySnapshot{
+		Node:       encodeTopologyPeer(self, anonymize),
+		Timestamp:  now.Unix(),
+		Anonymized: anonymize,
+		Edges:      edges,
+	}
+}
+
+// fileTopologySink appends snapshots to a local file, one per line
+type fileTopologySink struct {
+	path string
+}
+
+func (s *fileTopologySink) Send(_ context.Context, msg []byte) error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(msg, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readTopologyExportConfig returns sinks snapshots are to be sent to
+// along with the interval of sending, no sinks are returned
+// unless export is enabled
+func readTopologyExportConfig(cfg ipc.TopologyExportConfig) ([]telemetrySink, time.Duration, error) {
+	if !cfg.Enabled() {
+		return nil, 0, nil
+	}
+	interval, err := cfg.Interval()
+	if err != nil {
+		return nil, 0, err
+	}
+	path, err := cfg.Path()
+	if err != nil {
+		return nil, 0, err
+	}
+	collectorUrl, err := cfg.CollectorUrl()
+	if err != nil {
+		return nil, 0, err
+	}
+	sinks := []telemetrySink{}
+	if path != "" {
+		sinks = append(sinks, &fileTopologySink{path: path})
+	}
+	if collectorUrl != "" {
+		sink, err := newHttpTelemetrySink(collectorUrl)
+		if err != nil {
+			return nil, 0, err
+		}
+		sinks = append(sinks, sink)
+	}
+	d := time.Duration(interval.NanoSec())
+	if d == 0 {
+		d = defaultTopologyExportInterval
+	}
+	return sinks, d, nil
+}
+
+func (app *app) sendTopologySnapshot(sinks []telemetrySink, anonymize bool) error {
+	snapshot := takeTopologySnapshot(app.P2p.Me, app.P2p.Host.Network().Conns(), anonymize, time.Now())
+	msg, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	for _, sink := range sinks {
+		ctx, cancel := context.WithTimeout(app.Ctx, telemetrySendTimeout)
+		if err := sink.Send(ctx, msg); err != nil {
+			topologyLogger.Warnf("Failed to export topology snapshot: %s", err)
+		}
+		cancel()
+	}
+	return nil
+}
+
+// exportTopology periodically records connection edges of the node to sinks
+func (app *app) exportTopology(interval time.Duration, sinks []telemetrySink, anonymize bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-app.Ctx.Done():
+			return
+		case <-ticker.C:
+			if app.inMaintenance() {
+				continue
+			}
+			if err := app.sendTopologySnapshot(sinks, anonymize); err != nil {
+				topologyLogger.Errorf("Failed to take topology snapshot: %s", err)
+			}
+		}
+	}
+}
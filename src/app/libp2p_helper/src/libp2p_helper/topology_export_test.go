@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"codanet"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopologySnapshot(t *testing.T) {
+	codanet.NoDHT = true
+	defer func() {
+		codanet.NoDHT = false
+	}()
+
+	appA, _ := newTestApp(t, nil, true)
+	appAInfos, err := addrInfos(appA.P2p.Host)
+	require.NoError(t, err)
+	appB, _ := newTestApp(t, nil, true)
+	require.NoError(t, appB.P2p.Host.Connect(appB.Ctx, appAInfos[0]))
+
+	now := time.Now()
+	snapshot := takeTopologySnapshot(appB.P2p.Me, appB.P2p.Host.Network().Conns(), false, now)
+	require.Equal(t, peer.Encode(appB.P2p.Me), snapshot.Node)
+	require.Equal(t, now.Unix(), snapshot.Timestamp)
+	require.Len(t, snapshot.Edges, 1)
+	edge := snapshot.Edges[0]
+	require.Equal(t, peer.Encode(appA.P2p.Me), edge.Peer)
+	require.Equal(t, "outbound", edge.Direction)
+	require.Equal(t, "tcp", edge.Transport)
+	require.False(t, edge.Relayed)
+
+	snapshot = takeTopologySnapshot(appA.P2p.Me, appA.P2p.Host.Network().Conns(), true, now)
+	require.True(t, snapshot.Anonymized)
+	require.Equal(t, anonymizePeer(appA.P2p.Me), snapshot.Node)
+	require.Len(t, snapshot.Edges, 1)
+	require.Equal(t, anonymizePeer(appB.P2p.Me), snapshot.Edges[0].Peer)
+	require.Equal(t, "inbound", snapshot.Edges[0].Direction)
+}
+
+func TestFileTopologySink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sink := &fileTopologySink{path: path.Join(dir, "topology.jsonl")}
+	for i := int64(0); i < 3; i++ {
+		msg, err := json.Marshal(topologySnapshot{Node: "node", Timestamp: i})
+		require.NoError(t, err)
+		require.NoError(t, sink.Send(context.Background(), msg))
+	}
+
+	f, err := os.Open(sink.path)
+	require.NoError(t, err)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var i int64
+	for ; scanner.Scan(); i++ {
+		var snapshot topologySnapshot
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &snapshot))
+		require.Equal(t, i, snapshot.Timestamp)
+	}
+	require.NoError(t, scanner.Err())
+	require.Equal(t, int64(3), i)
+}
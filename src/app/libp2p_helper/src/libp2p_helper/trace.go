@@ -0,0 +1,64 @@
+package main
+
+import (
+	"time"
+	"unicode/utf8"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Trace IDs are optional correlation IDs the daemon sets in headers of
+// RPC requests and push messages. They let a single request (e.g. a block
+// body download) be followed across daemon and helper logs.
+
+var traceLogger = logging.Logger("mina.helper.trace")
+
+const traceIdExemplarLabel = "trace_id"
+
+var rpcHandlingTimeMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "Mina_libp2p_rpc_handling_time_seconds",
+	Help: "Time of handling RPC requests from the daemon, with trace IDs as exemplars",
+}, []string{"method"})
+
+func observeRpcHandlingTime(method string, d time.Duration, traceId string) {
+	o := rpcHandlingTimeMetric.WithLabelValues(method)
+	// Exemplar labels are limited to prometheus.ExemplarMaxRunes runes
+	// in total, longer trace IDs are not attached
+	if traceId != "" && utf8.RuneCountInString(traceIdExemplarLabel+traceId) <= prometheus.ExemplarMaxRunes {
+		if eo, ok := o.(prometheus.ExemplarObserver); ok {
+			eo.ObserveWithExemplar(d.Seconds(), prometheus.Labels{traceIdExemplarLabel: traceId})
+			return
+		}
+	}
+	o.Observe(d.Seconds())
+}
+
+// setRpcResponseTraceId echoes trace ID of the request in the response header
+func setRpcResponseTraceId(msg *capnp.Message, traceId string) error {
+	if traceId == "" {
+		return nil
+	}
+	m, err := ipc.ReadRootDaemonInterface_Message(msg)
+	if err != nil {
+		return err
+	}
+	resp, err := m.RpcResponse()
+	if err != nil {
+		return err
+	}
+	h, err := resp.Header()
+	if err != nil {
+		return err
+	}
+	return h.SetTraceId(traceId)
+}
+
+// tracedPushMessage is implemented by push messages
+// that keep trace ID till their completion
+type tracedPushMessage interface {
+	handleTraced(app *app, traceId string)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	dl "codanet/bitswap_downloader"
+	"context"
+	"testing"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRpcResponseTraceId(t *testing.T) {
+	resp := mkRpcRespSuccess(42, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewAddPeer()
+		panicOnErr(err)
+	})
+	require.NoError(t, setRpcResponseTraceId(resp, "block-3NK"))
+
+	m, err := ipc.ReadRootDaemonInterface_Message(resp)
+	require.NoError(t, err)
+	r, err := m.RpcResponse()
+	require.NoError(t, err)
+	h, err := r.Header()
+	require.NoError(t, err)
+	traceId, err := h.TraceId()
+	require.NoError(t, err)
+	require.Equal(t, "block-3NK", traceId)
+	sn, err := h.SequenceNumber()
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), sn.Seqno())
+}
+
+func TestResourceUpdatesGroupedByTraceId(t *testing.T) {
+	outChan := make(chan *capnp.Message, 4)
+	bs := NewBitswapCtx(context.Background(), outChan)
+	rootA, rootB := dl.Root{1}, dl.Root{2}
+	bs.registerTraceId("trace-a", rootA)
+
+	bs.SendResourceUpdates(ipc.ResourceUpdateType_added, rootA, rootB)
+	require.Equal(t, 2, len(outChan))
+	require.Empty(t, bs.traceIds)
+
+	traceIds := map[string]int{}
+	for i := 0; i < 2; i++ {
+		m, err := ipc.ReadRootDaemonInterface_Message(<-outChan)
+		require.NoError(t, err)
+		pm, err := m.PushMessage()
+		require.NoError(t, err)
+		h, err := pm.Header()
+		require.NoError(t, err)
+		traceId, err := h.TraceId()
+		require.NoError(t, err)
+		ru, err := pm.ResourceUpdated()
+		require.NoError(t, err)
+		ids, err := ru.Ids()
+		require.NoError(t, err)
+		traceIds[traceId] = ids.Len()
+	}
+	require.Equal(t, map[string]int{"trace-a": 1, "": 1}, traceIds)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var tuningLogger = logging.Logger("mina.helper.tuning")
+
+// tuningParams are networking parameters adjustable at runtime,
+// zero values mean no limit as in their configs
+type tuningParams struct {
+	maxConcurrentRoots int
+	bitswapBytesPerSec int
+}
+
+func readTuningParams(p ipc.Libp2pHelperInterface_TuningParams) tuningParams {
+	return tuningParams{
+		maxConcurrentRoots: int(p.MaxConcurrentRoots()),
+		bitswapBytesPerSec: int(p.BitswapBytesPerSec()),
+	}
+}
+
+// tuningTarget applies parameters, returning the ones replaced
+type tuningTarget interface {
+	apply(p tuningParams) tuningParams
+}
+
+type tuningSlice struct {
+	// 0 for arm A, 1 for arm B
+	arm       int
+	startedAt time.Time
+	duration  time.Duration
+	outcomes  downloadTotals
+}
+
+// tuningExperiment alternates two sets of parameters (arms) in time slices,
+// starting with arm A, and records outcomes of downloads that ended within
+// each slice. Parameters in effect before the experiment are restored once
+// it's completed or stopped. Slices are only accessed by the goroutine
+// running the experiment.
+type tuningExperiment struct {
+	id            uint64
+	name          string
+	arms          [2]tuningParams
+	sliceDuration time.Duration
+	slices        int
+	results       []tuningSlice
+	// totals of downloads, snapshotted at slice boundaries
+	totals   func() downloadTotals
+	now      func() time.Time
+	stopOnce sync.Once
+	stopped  chan struct{}
+	done     chan struct{}
+}
+
+func newTuningExperiment(id uint64, name string, sliceDuration time.Duration, slices int, armA, armB tuningParams) *tuningExperiment {
+	return &tuningExperiment{
+		id:            id,
+		name:          name,
+		arms:          [2]tuningParams{armA, armB},
+		sliceDuration: sliceDuration,
+		slices:        slices,
+		totals:        snapshotDownloadTotals,
+		now:           time.Now,
+		stopped:       make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// Stop ends the experiment before its next slice is completed
+func (e *tuningExperiment) Stop() {
+	e.stopOnce.Do(func() { close(e.stopped) })
+}
+
+// armTotals sums outcomes of completed slices of each arm
+func (e *tuningExperiment) armTotals() [2]downloadTotals {
+	var res [2]downloadTotals
+	for _, s := range e.results {
+		res[s.arm] = res[s.arm].add(s.outcomes)
+	}
+	return res
+}
+
+// run runs slices of the experiment, the report is called after each slice
+// and once more if the experiment is stopped, done is set on the last call
+func (e *tuningExperiment) run(ctx context.Context, target tuningTarget, report func(done bool)) {
+	defer close(e.done)
+	var original tuningParams
+	for i := 0; i < e.slices; i++ {
+		arm := i % 2
+		prev := target.apply(e.arms[arm])
+		if i == 0 {
+			original = prev
+		}
+		startedAt, before := e.now(), e.totals()
+		timer := time.NewTimer(e.sliceDuration)
+		select {
+		case <-timer.C:
+		case <-e.stopped:
+			timer.Stop()
+			target.apply(original)
+			report(true)
+			return
+		case <-ctx.Done():
+			timer.Stop()
+			target.apply(original)
+			return
+		}
+		e.results = append(e.results, tuningSlice{
+			arm:       arm,
+			startedAt: startedAt,
+			duration:  e.now().Sub(startedAt),
+			outcomes:  e.totals().sub(before),
+		})
+		last := i == e.slices-1
+		if last {
+			target.apply(original)
+		}
+		report(last)
+	}
+}
+
+// appTuningTarget tunes the download scheduler and the Bitswap throttle
+type appTuningTarget struct {
+	app *app
+}
+
+func (t appTuningTarget) apply(p tuningParams) tuningParams {
+	var prev tuningParams
+	prev.maxConcurrentRoots = t.app.bitswapCtx.scheduler.SetMaxConcurrent(p.maxConcurrentRoots)
+	limits := t.app.P2p.BitswapThrottle.Limits()
+	prev.bitswapBytesPerSec = limits.BytesPerSec
+	limits.BytesPerSec = p.bitswapBytesPerSec
+	t.app.P2p.BitswapThrottle.Configure(limits)
+	return prev
+}
+
+// startTuningExperiment runs the experiment unless another one is running
+func (app *app) startTuningExperiment(e *tuningExperiment) error {
+	app.tuningMutex.Lock()
+	defer app.tuningMutex.Unlock()
+	if app.tuning != nil {
+		return errors.New("a tuning experiment is already running")
+	}
+	app.tuning = e
+	tuningLogger.Infof("Starting tuning experiment %s (%d slices of %s)", e.name, e.slices, e.sliceDuration)
+	go func() {
+		e.run(app.Ctx, appTuningTarget{app: app}, func(done bool) {
+			app.writeMsg(mkTuningReportUpcall(e, done))
+		})
+		tuningLogger.Infof("Tuning experiment %s ended after %d slices", e.name, len(e.results))
+		app.tuningMutex.Lock()
+		defer app.tuningMutex.Unlock()
+		if app.tuning == e {
+			app.tuning = nil
+		}
+	}()
+	return nil
+}
+
+func mkTuningOutcomes(o ipc.DaemonInterface_TuningOutcomes, t downloadTotals) {
+	o.SetDownloadsCompleted(uint32(t.completed))
+	o.SetDownloadsFailed(uint32(t.failed))
+	o.SetBytesFetched(t.fetchedBytes)
+	d, err := o.NewMeanDownloadTime()
+	panicOnErr(err)
+	d.SetNanoSec(uint64(t.meanDownloadTime().Nanoseconds()))
+}
+
+func mkTuningReportUpcall(e *tuningExperiment, done bool) *capnp.Message {
+	return mkPushMsg(func(m ipc.DaemonInterface_PushMessage) {
+		im, err := m.NewTuningReport()
+		panicOnErr(err)
+		im.SetExperimentId(e.id)
+		panicOnErr(im.SetName(e.name))
+		im.SetDone(done)
+		if len(e.results) > math.MaxInt32 {
+			panic("too many slices in a single upcall")
+		}
+		slices, err := im.NewSlices(int32(len(e.results)))
+		panicOnErr(err)
+		for i, s := range e.results {
+			ms := slices.At(i)
+			ms.SetArm(uint8(s.arm))
+			startedAt, err := ms.NewStartedAt()
+			panicOnErr(err)
+			startedAt.SetNanoSec(s.startedAt.UnixNano())
+			duration, err := ms.NewDuration()
+			panicOnErr(err)
+			duration.SetNanoSec(uint64(s.duration.Nanoseconds()))
+			outcomes, err := ms.NewOutcomes()
+			panicOnErr(err)
+			mkTuningOutcomes(outcomes, s.outcomes)
+		}
+		arms, err := im.NewArms(2)
+		panicOnErr(err)
+		for i, t := range e.armTotals() {
+			mkTuningOutcomes(arms.At(i), t)
+		}
+	})
+}
+
+type StartTuningExperimentReqT = ipc.Libp2pHelperInterface_StartTuningExperiment_Request
+type StartTuningExperimentReq StartTuningExperimentReqT
+
+func fromStartTuningExperimentReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.StartTuningExperiment()
+	return StartTuningExperimentReq(i), err
+}
+
+func (m StartTuningExperimentReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	name, err := StartTuningExperimentReqT(m).Name()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	sliceDuration, err := StartTuningExperimentReqT(m).SliceDuration()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	armA, err := StartTuningExperimentReqT(m).ArmA()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	armB, err := StartTuningExperimentReqT(m).ArmB()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	slices := int(StartTuningExperimentReqT(m).Slices())
+	if slices == 0 || sliceDuration.NanoSec() == 0 {
+		return mkRpcRespError(seqno, badRPC(errors.New("tuning experiment needs slices of non-zero duration")))
+	}
+	e := newTuningExperiment(app.NextId(), name, time.Duration(sliceDuration.NanoSec()), slices,
+		readTuningParams(armA), readTuningParams(armB))
+	if err := app.startTuningExperiment(e); err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		resp, err := m.NewStartTuningExperiment()
+		panicOnErr(err)
+		resp.SetExperimentId(e.id)
+	})
+}
+
+type StopTuningExperimentReqT = ipc.Libp2pHelperInterface_StopTuningExperiment_Request
+type StopTuningExperimentReq StopTuningExperimentReqT
+
+func fromStopTuningExperimentReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.StopTuningExperiment()
+	return StopTuningExperimentReq(i), err
+}
+
+func (m StopTuningExperimentReq) handle(app *app, seqno uint64) *capnp.Message {
+	app.tuningMutex.Lock()
+	e := app.tuning
+	app.tuningMutex.Unlock()
+	if e == nil {
+		return mkRpcRespError(seqno, badRPC(errors.New("no tuning experiment is running")))
+	}
+	e.Stop()
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewStopTuningExperiment()
+		panicOnErr(err)
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testTuningTarget struct {
+	params  tuningParams
+	applied []tuningParams
+}
+
+func (t *testTuningTarget) apply(p tuningParams) tuningParams {
+	prev := t.params
+	t.params = p
+	t.applied = append(t.applied, p)
+	return prev
+}
+
+// newTestTuningExperiment makes an experiment whose every slice
+// sees a download completed per arm's maxConcurrentRoots
+func newTestTuningExperiment(slices int, target *testTuningTarget) *tuningExperiment {
+	armA := tuningParams{maxConcurrentRoots: 1, bitswapBytesPerSec: 1000}
+	armB := tuningParams{maxConcurrentRoots: 2, bitswapBytesPerSec: 2000}
+	e := newTuningExperiment(1, "test", time.Millisecond, slices, armA, armB)
+	var totals downloadTotals
+	e.totals = func() downloadTotals {
+		// called at the start and at the end of each slice
+		if len(target.applied) > 0 {
+			p := target.params
+			totals.completed += p.maxConcurrentRoots
+			totals.completedTime += time.Duration(p.maxConcurrentRoots) * time.Second
+			totals.fetchedBytes += uint64(p.bitswapBytesPerSec)
+		}
+		return totals
+	}
+	return e
+}
+
+func TestTuningExperiment(t *testing.T) {
+	original := tuningParams{maxConcurrentRoots: 5}
+	target := &testTuningTarget{params: original}
+	e := newTestTuningExperiment(3, target)
+	var reports []bool
+	e.run(context.Background(), target, func(done bool) {
+		reports = append(reports, done)
+	})
+
+	require.Equal(t, []bool{false, false, true}, reports)
+	require.Equal(t, []tuningParams{e.arms[0], e.arms[1], e.arms[0], original}, target.applied)
+	require.Equal(t, original, target.params)
+	require.Len(t, e.results, 3)
+	for i, s := range e.results {
+		require.Equal(t, i%2, s.arm)
+		require.Equal(t, e.arms[s.arm].maxConcurrentRoots, s.outcomes.completed)
+	}
+	arms := e.armTotals()
+	require.Equal(t, 2, arms[0].completed)
+	require.Equal(t, uint64(2000), arms[0].fetchedBytes)
+	require.Equal(t, 2, arms[1].completed)
+	require.Equal(t, 2*time.Second, arms[1].meanDownloadTime())
+}
+
+func TestTuningExperimentStopped(t *testing.T) {
+	original := tuningParams{bitswapBytesPerSec: 100}
+	target := &testTuningTarget{params: original}
+	e := newTestTuningExperiment(1000, target)
+	e.sliceDuration = time.Hour
+	var reports []bool
+	go e.Stop()
+	e.run(context.Background(), target, func(done bool) {
+		reports = append(reports, done)
+	})
+	<-e.done
+
+	// A final report is sent and parameters are restored
+	require.Equal(t, []bool{true}, reports)
+	require.Empty(t, e.results)
+	require.Equal(t, original, target.params)
+}
@@ -67,6 +67,7 @@ func newTestAppWithMaxConnsAndCtx(t *testing.T, privkey crypto.PrivKey, seeds []
 		maxConns,
 		minaPeerExchange,
 		10*time.Second,
+		codanet.HelperOptions{},
 	)
 	require.NoError(t, err)
 
@@ -80,6 +81,7 @@ func newTestAppWithMaxConnsAndCtx(t *testing.T, privkey crypto.PrivKey, seeds []
 	outChan := make(chan *capnp.Message, 64)
 	bitswapCtx := NewBitswapCtx(ctx, outChan)
 	bitswapCtx.engine = helper.Bitswap
+	bitswapCtx.providerHints = helper.ProviderHints
 	bitswapCtx.storage = helper.BitswapStorage
 
 	return &app{
@@ -87,6 +89,8 @@ func newTestAppWithMaxConnsAndCtx(t *testing.T, privkey crypto.PrivKey, seeds []
 		Ctx:                      ctx,
 		Subs:                     make(map[uint64]subscription),
 		Topics:                   make(map[string]*pubsub.Topic),
+		TopicDispatchers:         make(map[string]*topicDispatcher),
+		validationQueues:         make(map[string]*validationQueue),
 		ValidatorMutex:           &sync.Mutex{},
 		Validators:               make(map[uint64]*validationStatus),
 		Streams:                  make(map[uint64]net.Stream),
@@ -97,6 +101,10 @@ func newTestAppWithMaxConnsAndCtx(t *testing.T, privkey crypto.PrivKey, seeds []
 		metricsServer:            nil,
 		metricsCollectionStarted: false,
 		bitswapCtx:               bitswapCtx,
+		dialLadder:               newDialLadder(0, 0, 0, nil),
+		topicSpecs:               newTopicRegistry(),
+		rpcAdmission:             newRpcAdmission(),
+		peerAudit:                newPeerAuditLog(),
 	}
 }
 
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var validationBatchLogger = logging.Logger("mina.helper.validation_batch")
+
+const defaultValidationBatchDelay = 10 * time.Millisecond
+
+var validationBatchSizeMetric = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "Mina_libp2p_validation_batch_size",
+	Help:    "Number of gossip messages passed to the daemon for validation in a batch",
+	Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+})
+
+// validationBatcher passes gossipReceived upcalls to the daemon in
+// batches, cutting per-message IPC overhead under load (e.g. during
+// transaction floods). Topic dispatchers write upcalls in the order
+// of their topics, batches are written under the mutex so that
+// the order is kept. Batching is disabled by default.
+type validationBatcher struct {
+	maxMessages int
+	maxDelay    time.Duration
+	pending     []ipc.DaemonInterface_GossipReceived
+	// writes upcalls to the daemon, as passed to Write
+	write func(*capnp.Message)
+	// incremented with each batch written,
+	// so that stale timers are told apart
+	batch uint64
+	mutex sync.Mutex
+}
+
+// Configure sets the bounds of batches, messages
+// pending meanwhile are written beforehand
+func (b *validationBatcher) Configure(maxMessages int, maxDelay time.Duration) {
+	if maxDelay <= 0 {
+		maxDelay = defaultValidationBatchDelay
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.flush()
+	b.maxMessages = maxMessages
+	b.maxDelay = maxDelay
+}
+
+func readValidationBatchConfig(cfg ipc.ValidationBatchConfig) (int, time.Duration, error) {
+	maxDelay, err := cfg.MaxDelay()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(cfg.MaxMessages()), time.Duration(maxDelay.NanoSec()), nil
+}
+
+// Write passes the gossipReceived upcall to the daemon with
+// write, either at once or in a batch
+func (b *validationBatcher) Write(msg *capnp.Message, write func(*capnp.Message)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.write = write
+	if b.maxMessages < 2 {
+		write(msg)
+		return
+	}
+	gr, err := readGossipReceivedUpcall(msg)
+	if err != nil {
+		validationBatchLogger.Errorf("failed to batch gossip for validation: %s", err)
+		b.flush()
+		write(msg)
+		return
+	}
+	b.pending = append(b.pending, gr)
+	if len(b.pending) >= b.maxMessages {
+		b.flush()
+		return
+	}
+	if len(b.pending) == 1 {
+		batch := b.batch
+		time.AfterFunc(b.maxDelay, func() {
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+			if b.batch == batch {
+				b.flush()
+			}
+		})
+	}
+}
+
+// flush writes the pending batch, it's called with the mutex held
+func (b *validationBatcher) flush() {
+	if len(b.pending) == 0 {
+		return
+	}
+	b.write(mkGossipReceivedBatchUpcall(b.pending))
+	validationBatchSizeMetric.Observe(float64(len(b.pending)))
+	b.pending = nil
+	b.batch++
+}
+
+func readGossipReceivedUpcall(msg *capnp.Message) (ipc.DaemonInterface_GossipReceived, error) {
+	m, err := ipc.ReadRootDaemonInterface_Message(msg)
+	if err != nil {
+		return ipc.DaemonInterface_GossipReceived{}, err
+	}
+	pm, err := m.PushMessage()
+	if err != nil {
+		return ipc.DaemonInterface_GossipReceived{}, err
+	}
+	return pm.GossipReceived()
+}
+
+func mkGossipReceivedBatchUpcall(messages []ipc.DaemonInterface_GossipReceived) *capnp.Message {
+	return mkPushMsg(func(m ipc.DaemonInterface_PushMessage) {
+		batch, err := m.NewGossipReceivedBatch()
+		panicOnErr(err)
+		l, err := batch.NewMessages(int32(len(messages)))
+		panicOnErr(err)
+		for i, gr := range messages {
+			panicOnErr(l.Set(i, gr))
+		}
+	})
+}
+
+type ValidationBatchPushT = ipc.Libp2pHelperInterface_ValidationBatch
+type ValidationBatchPush ValidationBatchPushT
+
+func fromValidationBatchPush(m ipcPushMessage) (pushMessage, error) {
+	i, err := m.ValidationBatch()
+	return ValidationBatchPush(i), err
+}
+
+func (m ValidationBatchPush) handle(app *app) {
+	if app.P2p == nil {
+		return
+	}
+	validations, err := ValidationBatchPushT(m).Validations()
+	if err != nil {
+		app.P2p.Logger.Errorf("handleValidationBatch: error %s", err)
+		return
+	}
+	for i := 0; i < validations.Len(); i++ {
+		v := validations.At(i)
+		vid, err := v.ValidationId()
+		if err != nil {
+			app.P2p.Logger.Errorf("handleValidationBatch: error %s", err)
+			continue
+		}
+		app.completeValidation(vid.Id(), v.Result())
+	}
+}
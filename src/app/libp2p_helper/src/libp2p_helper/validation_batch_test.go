@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/stretchr/testify/require"
+)
+
+type testBatchWriter struct {
+	msgs  []*capnp.Message
+	mutex sync.Mutex
+}
+
+func (w *testBatchWriter) write(msg *capnp.Message) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.msgs = append(w.msgs, msg)
+}
+
+func (w *testBatchWriter) written() []*capnp.Message {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([]*capnp.Message{}, w.msgs...)
+}
+
+func mkTestGossipReceived(topicSeqno uint64) *capnp.Message {
+	sender := &codaPeerInfo{Libp2pPort: 8302, Host: "127.0.0.1", PeerID: "peer"}
+	now := time.Now()
+	return mkGossipReceivedUpcall(sender, now.Add(time.Minute), now, []byte("tx"), topicSeqno, 1, topicSeqno)
+}
+
+// readTestBatch returns topic sequence numbers of messages of the batch
+func readTestBatch(t *testing.T, msg *capnp.Message) []uint64 {
+	m, err := ipc.ReadRootDaemonInterface_Message(msg)
+	require.NoError(t, err)
+	pm, err := m.PushMessage()
+	require.NoError(t, err)
+	require.True(t, pm.HasGossipReceivedBatch())
+	batch, err := pm.GossipReceivedBatch()
+	require.NoError(t, err)
+	l, err := batch.Messages()
+	require.NoError(t, err)
+	res := make([]uint64, 0, l.Len())
+	for i := 0; i < l.Len(); i++ {
+		data, err := l.At(i).Data()
+		require.NoError(t, err)
+		require.Equal(t, []byte("tx"), data)
+		res = append(res, l.At(i).TopicSeqno())
+	}
+	return res
+}
+
+func TestValidationBatcher(t *testing.T) {
+	var b validationBatcher
+	w := &testBatchWriter{}
+
+	// Upcalls are written at once by default
+	b.Write(mkTestGossipReceived(1), w.write)
+	require.Len(t, w.written(), 1)
+
+	// Full batches are written at once
+	b.Configure(3, time.Hour)
+	for i := uint64(2); i <= 5; i++ {
+		b.Write(mkTestGossipReceived(i), w.write)
+	}
+	require.Len(t, w.written(), 2)
+	require.Equal(t, []uint64{2, 3, 4}, readTestBatch(t, w.written()[1]))
+
+	// Pending messages are written once batching is reconfigured
+	b.Configure(3, 10*time.Millisecond)
+	require.Len(t, w.written(), 3)
+	require.Equal(t, []uint64{5}, readTestBatch(t, w.written()[2]))
+
+	// Batches are written after the delay
+	b.Write(mkTestGossipReceived(6), w.write)
+	b.Write(mkTestGossipReceived(7), w.write)
+	require.Len(t, w.written(), 3)
+	require.Eventually(t, func() bool {
+		return len(w.written()) == 4
+	}, testTimeout, time.Millisecond)
+	require.Equal(t, []uint64{6, 7}, readTestBatch(t, w.written()[3]))
+}
+
+func TestValidationBatchPush(t *testing.T) {
+	testApp, _ := newTestApp(t, nil, true)
+
+	results := []ipc.ValidationResult{
+		ipc.ValidationResult_reject,
+		ipc.ValidationResult_accept,
+	}
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	require.NoError(t, err)
+	m, err := ipc.NewRootLibp2pHelperInterface_ValidationBatch(seg)
+	require.NoError(t, err)
+	validations, err := m.NewValidations(int32(len(results)))
+	require.NoError(t, err)
+	completions := make([]chan pubsub.ValidationResult, len(results))
+	for i, result := range results {
+		seqno := uint64(100 + i)
+		completions[i] = make(chan pubsub.ValidationResult, 1)
+		testApp.Validators[seqno] = &validationStatus{Completion: completions[i]}
+		validationId, err := validations.At(i).NewValidationId()
+		require.NoError(t, err)
+		validationId.SetId(seqno)
+		validations.At(i).SetResult(result)
+	}
+
+	ValidationBatchPush(m).handle(testApp)
+	require.Equal(t, pubsub.ValidationReject, <-completions[0])
+	require.Equal(t, pubsub.ValidationAccept, <-completions[1])
+	require.Empty(t, testApp.Validators)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultValidationCacheTTL = 10 * time.Minute
+
+// Hit rate of a topic is hits / (hits + misses)
+var validationCacheHitsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "Mina_libp2p_validation_cache_hits",
+	Help: "Number of gossip messages answered with a cached verdict of the daemon",
+}, []string{"topic"})
+
+var validationCacheMissesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "Mina_libp2p_validation_cache_misses",
+	Help: "Number of gossip messages passed to the daemon for validation without a cached verdict",
+}, []string{"topic"})
+
+type cachedVerdict struct {
+	key     [32]byte
+	verdict pubsub.ValidationResult
+	expires time.Time
+}
+
+// validationCache is an LRU cache of verdicts of the daemon keyed by
+// content hashes of gossip payloads, so that a payload arriving again
+// (e.g. a transaction relayed by another peer after pubsub forgot it,
+// or published anew by its author) is answered without a round-trip
+// to the daemon. Only accepts and rejects are cached, for at most the
+// TTL, as verdicts may change as the daemon's state moves on. Zero
+// size disables the cache, which is the zero value.
+type validationCache struct {
+	maxSize int
+	ttl     time.Duration
+	// most recently used verdicts are at the front
+	lru      *list.List
+	verdicts map[[32]byte]*list.Element
+	mutex    sync.Mutex
+}
+
+// Configure resizes the cache, zero TTL is replaced with the default
+func (c *validationCache) Configure(maxSize int, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = defaultValidationCacheTTL
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.lru == nil {
+		c.lru = list.New()
+		c.verdicts = make(map[[32]byte]*list.Element)
+	}
+	c.maxSize = maxSize
+	c.ttl = ttl
+	c.evict()
+}
+
+// Get returns the verdict cached for the payload, if not expired
+func (c *validationCache) Get(topic string, key [32]byte, now time.Time) (pubsub.ValidationResult, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.maxSize == 0 {
+		return pubsub.ValidationIgnore, false
+	}
+	el, has := c.verdicts[key]
+	if has && now.After(el.Value.(*cachedVerdict).expires) {
+		c.remove(el)
+		has = false
+	}
+	if !has {
+		validationCacheMissesMetric.WithLabelValues(topic).Inc()
+		return pubsub.ValidationIgnore, false
+	}
+	validationCacheHitsMetric.WithLabelValues(topic).Inc()
+	c.lru.MoveToFront(el)
+	return el.Value.(*cachedVerdict).verdict, true
+}
+
+// Add caches the verdict for the payload, verdicts
+// other than accept or reject aren't cached
+func (c *validationCache) Add(key [32]byte, verdict pubsub.ValidationResult, now time.Time) {
+	if verdict != pubsub.ValidationAccept && verdict != pubsub.ValidationReject {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.maxSize == 0 {
+		return
+	}
+	expires := now.Add(c.ttl)
+	if el, has := c.verdicts[key]; has {
+		el.Value.(*cachedVerdict).verdict = verdict
+		el.Value.(*cachedVerdict).expires = expires
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.verdicts[key] = c.lru.PushFront(&cachedVerdict{key: key, verdict: verdict, expires: expires})
+	c.evict()
+}
+
+// Len returns the number of cached verdicts, expired ones included
+func (c *validationCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.lru == nil {
+		return 0
+	}
+	return c.lru.Len()
+}
+
+func (c *validationCache) remove(el *list.Element) {
+	v := c.lru.Remove(el).(*cachedVerdict)
+	delete(c.verdicts, v.key)
+}
+
+func (c *validationCache) evict() {
+	for c.lru.Len() > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+func readValidationCacheConfig(cfg ipc.ValidationCacheConfig) (int, time.Duration, error) {
+	ttl, err := cfg.Ttl()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(cfg.Size()), time.Duration(ttl.NanoSec()), nil
+}
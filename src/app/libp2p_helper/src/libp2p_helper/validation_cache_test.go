@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidationCache(t *testing.T) {
+	topic := "validation-cache-test"
+	a, b, c := contentHash(topic, []byte("a")), contentHash(topic, []byte("b")), contentHash(topic, []byte("c"))
+	now := time.Now()
+
+	// Disabled by default
+	var cache validationCache
+	cache.Add(a, pubsub.ValidationAccept, now)
+	_, cached := cache.Get(topic, a, now)
+	require.False(t, cached)
+
+	cache.Configure(2, time.Minute)
+	_, cached = cache.Get(topic, a, now)
+	require.False(t, cached)
+	cache.Add(a, pubsub.ValidationAccept, now)
+	cache.Add(b, pubsub.ValidationReject, now)
+	// Ignores aren't cached
+	cache.Add(c, pubsub.ValidationIgnore, now)
+	require.Equal(t, 2, cache.Len())
+	res, cached := cache.Get(topic, a, now)
+	require.True(t, cached)
+	require.Equal(t, pubsub.ValidationAccept, res)
+	res, cached = cache.Get(topic, b, now)
+	require.True(t, cached)
+	require.Equal(t, pubsub.ValidationReject, res)
+	require.Equal(t, 2.0, testutil.ToFloat64(validationCacheHitsMetric.WithLabelValues(topic)))
+	require.Equal(t, 1.0, testutil.ToFloat64(validationCacheMissesMetric.WithLabelValues(topic)))
+
+	// Least recently used verdicts are evicted
+	cache.Add(c, pubsub.ValidationAccept, now)
+	_, cached = cache.Get(topic, a, now)
+	require.False(t, cached)
+	_, cached = cache.Get(topic, b, now)
+	require.True(t, cached)
+
+	// Verdicts expire
+	_, cached = cache.Get(topic, c, now.Add(2*time.Minute))
+	require.False(t, cached)
+	require.Equal(t, 1, cache.Len())
+
+	cache.Configure(0, 0)
+	require.Equal(t, 0, cache.Len())
+	require.Equal(t, defaultValidationCacheTTL, cache.ttl)
+}
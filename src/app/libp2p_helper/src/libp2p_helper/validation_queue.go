@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	ipc "libp2p_ipc"
+
+	capnp "capnproto.org/go/capnp/v3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Bounds of the per-topic validation queue, the upper bound is
+	// the validation queue size from the configuration
+	minValidationQueueSize     = 8
+	defaultValidationQueueSize = 32
+	// Verdict latencies (smoothed) below which the queue grows
+	// and above which it shrinks
+	fastValidationLatency = 500 * time.Millisecond
+	slowValidationLatency = 5 * time.Second
+	// Weight of the latest verdict latency in the smoothed latency
+	validationLatencyAlpha = 0.2
+	// Queue is shrunk at most once per interval, so that a burst of
+	// slow verdicts for messages queued earlier doesn't collapse it
+	validationQueueShrinkInterval = time.Second
+)
+
+var validationQueueLimitMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "Mina_libp2p_validation_queue_limit",
+	Help: "Number of messages of a topic allowed to await validation by the daemon",
+}, []string{"topic"})
+
+var validationQueueDroppedMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "Mina_libp2p_validation_queue_dropped_messages",
+	Help: "Number of messages of a topic ignored because its validation queue was full",
+}, []string{"topic"})
+
+// validationQueue limits the number of messages of a topic awaiting
+// a verdict of the daemon. The limit adapts to the recent verdict latency:
+// it's halved when the daemon is slow, so that excess messages fail fast
+// instead of timing out, and grows by one with each fast verdict.
+// Messages of the queue may be passed to the daemon a few at a time,
+// the rest wait for their turn within the validation timeout of the topic.
+type validationQueue struct {
+	topic    string
+	limit    int
+	maxLimit int
+	inFlight int
+	// messages being validated by the daemon and their
+	// limit, zero for no limit
+	validating  int
+	concurrency int
+	// closed once a message is validated, to wake waiting ones
+	validated chan struct{}
+	timeout   time.Duration
+	// smoothed verdict latency, zero until the first verdict
+	latency    time.Duration
+	lastShrink time.Time
+	mutex      sync.Mutex
+}
+
+func newValidationQueue(topic string, maxLimit int) *validationQueue {
+	if maxLimit <= 0 {
+		maxLimit = defaultValidationQueueSize
+	}
+	if maxLimit < minValidationQueueSize {
+		maxLimit = minValidationQueueSize
+	}
+	limit := maxLimit / 2
+	if limit < minValidationQueueSize {
+		limit = minValidationQueueSize
+	}
+	q := &validationQueue{
+		topic:     topic,
+		limit:     limit,
+		maxLimit:  maxLimit,
+		validated: make(chan struct{}),
+		timeout:   validationTimeout,
+	}
+	validationQueueLimitMetric.WithLabelValues(topic).Set(float64(limit))
+	return q
+}
+
+// TryEnter admits a message for validation, false is returned
+// if the queue is full
+func (q *validationQueue) TryEnter() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.inFlight >= q.limit {
+		validationQueueDroppedMetric.WithLabelValues(q.topic).Inc()
+		return false
+	}
+	q.inFlight++
+	return true
+}
+
+// Leave releases the place of an admitted message
+func (q *validationQueue) Leave() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.inFlight--
+}
+
+// Acquire waits for the turn of an admitted message to be validated,
+// false is returned if the context is done first
+func (q *validationQueue) Acquire(ctx context.Context) bool {
+	for {
+		q.mutex.Lock()
+		if q.concurrency == 0 || q.validating < q.concurrency {
+			q.validating++
+			q.mutex.Unlock()
+			return true
+		}
+		validated := q.validated
+		q.mutex.Unlock()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-validated:
+		}
+	}
+}
+
+// Release ends validation of an acquired message
+func (q *validationQueue) Release() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.validating--
+	q.wake()
+}
+
+// wake lets waiting messages check for their turn again,
+// it's called with the mutex held
+func (q *validationQueue) wake() {
+	close(q.validated)
+	q.validated = make(chan struct{})
+}
+
+// SetConcurrency replaces the limit of messages validated
+// at once, zero means no limit
+func (q *validationQueue) SetConcurrency(concurrency int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.concurrency = concurrency
+	q.wake()
+}
+
+// Timeout returns the validation timeout of messages of the topic
+func (q *validationQueue) Timeout() time.Duration {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.timeout
+}
+
+// SetTimeout replaces the validation timeout, zero
+// restores the default one
+func (q *validationQueue) SetTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = validationTimeout
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.timeout = timeout
+}
+
+// Observe accounts the verdict latency of a message and resizes the queue
+func (q *validationQueue) Observe(latency time.Duration, now time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.latency == 0 {
+		q.latency = latency
+	} else {
+		q.latency = time.Duration(validationLatencyAlpha*float64(latency) + (1-validationLatencyAlpha)*float64(q.latency))
+	}
+	limit := q.limit
+	switch {
+	case q.latency > slowValidationLatency && now.Sub(q.lastShrink) >= validationQueueShrinkInterval:
+		limit = limit / 2
+		if limit < minValidationQueueSize {
+			limit = minValidationQueueSize
+		}
+		q.lastShrink = now
+	case q.latency < fastValidationLatency && limit < q.maxLimit:
+		limit++
+	}
+	if limit != q.limit {
+		q.limit = limit
+		validationQueueLimitMetric.WithLabelValues(q.topic).Set(float64(limit))
+	}
+}
+
+// Limit returns the current size of the queue
+func (q *validationQueue) Limit() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.limit
+}
+
+// SetMaxLimit replaces the upper bound of the queue size,
+// the current size is lowered to the bound if needed
+func (q *validationQueue) SetMaxLimit(maxLimit int) {
+	if maxLimit <= 0 {
+		maxLimit = defaultValidationQueueSize
+	}
+	if maxLimit < minValidationQueueSize {
+		maxLimit = minValidationQueueSize
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.maxLimit = maxLimit
+	if q.limit > maxLimit {
+		q.limit = maxLimit
+		validationQueueLimitMetric.WithLabelValues(q.topic).Set(float64(maxLimit))
+	}
+}
+
+func (app *app) validationQueue(topic string) *validationQueue {
+	app.validationQueuesMutex.Lock()
+	defer app.validationQueuesMutex.Unlock()
+	q, has := app.validationQueues[topic]
+	if !has {
+		q = newValidationQueue(topic, app.validationQueueSize)
+		app.validationQueues[topic] = q
+	}
+	return q
+}
+
+type SetTopicConfigReqT = ipc.Libp2pHelperInterface_SetTopicConfig_Request
+type SetTopicConfigReq SetTopicConfigReqT
+
+func fromSetTopicConfigReq(req ipcRpcRequest) (rpcRequest, error) {
+	i, err := req.SetTopicConfig()
+	return SetTopicConfigReq(i), err
+}
+
+func (m SetTopicConfigReq) handle(app *app, seqno uint64) *capnp.Message {
+	if app.P2p == nil {
+		return mkRpcRespError(seqno, needsConfigure())
+	}
+	topic, err := SetTopicConfigReqT(m).Topic()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	if topic == "" {
+		return mkRpcRespError(seqno, badRPC(errors.New("empty topic")))
+	}
+	timeout, err := SetTopicConfigReqT(m).ValidatorTimeout()
+	if err != nil {
+		return mkRpcRespError(seqno, badRPC(err))
+	}
+	queueSize := int(SetTopicConfigReqT(m).QueueSize())
+	if queueSize == 0 {
+		queueSize = app.validationQueueSize
+	}
+	q := app.validationQueue(topic)
+	q.SetTimeout(time.Duration(timeout.NanoSec()))
+	q.SetConcurrency(int(SetTopicConfigReqT(m).ValidatorConcurrency()))
+	q.SetMaxLimit(queueSize)
+	app.topicSpecs.SetMessageIdScheme(topic, SetTopicConfigReqT(m).MessageId())
+	app.topicSpecs.SetCompression(topic, SetTopicConfigReqT(m).Compress())
+	app.publishLimiter(topic).Configure(SetTopicConfigReqT(m).PublishRate(), float64(SetTopicConfigReqT(m).PublishByteRate()), SetTopicConfigReqT(m).PublishOverflow())
+	app.P2p.Logger.Infof("configured validation of %s: timeout %s, concurrency %d, queue of %d messages, %s message IDs, compression %t; publishing limited to %f messages and %d bytes per second, %s above",
+		topic, q.Timeout(), SetTopicConfigReqT(m).ValidatorConcurrency(), queueSize, SetTopicConfigReqT(m).MessageId(), SetTopicConfigReqT(m).Compress(),
+		SetTopicConfigReqT(m).PublishRate(), SetTopicConfigReqT(m).PublishByteRate(), SetTopicConfigReqT(m).PublishOverflow())
+	return mkRpcRespSuccess(seqno, func(m *ipc.Libp2pHelperInterface_RpcResponseSuccess) {
+		_, err := m.NewSetTopicConfig()
+		panicOnErr(err)
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidationQueueLimit(t *testing.T) {
+	q := newValidationQueue("test", 16)
+	require.Equal(t, 8, q.Limit())
+	for i := 0; i < 8; i++ {
+		require.True(t, q.TryEnter())
+	}
+	require.False(t, q.TryEnter())
+	q.Leave()
+	require.True(t, q.TryEnter())
+}
+
+func TestValidationQueueGrowsWhenFast(t *testing.T) {
+	q := newValidationQueue("test", 16)
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		q.Observe(10*time.Millisecond, now)
+	}
+	require.Equal(t, 16, q.Limit())
+}
+
+func TestValidationQueueShrinksWhenSlow(t *testing.T) {
+	q := newValidationQueue("test", 256)
+	require.Equal(t, 128, q.Limit())
+	now := time.Now()
+	q.Observe(time.Minute, now)
+	require.Equal(t, 64, q.Limit())
+	// Shrinking is rate limited
+	q.Observe(time.Minute, now)
+	require.Equal(t, 64, q.Limit())
+	for i := 1; i < 10; i++ {
+		q.Observe(time.Minute, now.Add(time.Duration(i)*validationQueueShrinkInterval))
+	}
+	require.Equal(t, minValidationQueueSize, q.Limit())
+}
+
+func TestValidationQueueBounds(t *testing.T) {
+	require.Equal(t, minValidationQueueSize, newValidationQueue("test", 1).Limit())
+	q := newValidationQueue("test", 0)
+	require.Equal(t, defaultValidationQueueSize/2, q.Limit())
+}
+
+func TestValidationQueueSetMaxLimit(t *testing.T) {
+	q := newValidationQueue("test", 64)
+	require.Equal(t, 32, q.Limit())
+	q.SetMaxLimit(16)
+	require.Equal(t, 16, q.Limit())
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		q.Observe(10*time.Millisecond, now)
+	}
+	require.Equal(t, 16, q.Limit())
+	q.SetMaxLimit(1)
+	require.Equal(t, minValidationQueueSize, q.Limit())
+	q.SetMaxLimit(0)
+	require.Equal(t, minValidationQueueSize, q.Limit())
+	for i := 0; i < 1000; i++ {
+		q.Observe(10*time.Millisecond, now)
+	}
+	require.Equal(t, defaultValidationQueueSize, q.Limit())
+}
+
+func TestValidationQueueConcurrency(t *testing.T) {
+	q := newValidationQueue("test", 16)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	// No limit by default
+	for i := 0; i < 8; i++ {
+		require.True(t, q.Acquire(ctx))
+	}
+	for i := 0; i < 8; i++ {
+		q.Release()
+	}
+
+	q.SetConcurrency(2)
+	require.True(t, q.Acquire(ctx))
+	require.True(t, q.Acquire(ctx))
+	require.False(t, q.Acquire(ctx))
+
+	// Waiting messages take turns once validation ends
+	acquired := make(chan bool)
+	go func() {
+		acquired <- q.Acquire(context.Background())
+	}()
+	q.Release()
+	require.True(t, <-acquired)
+	q.Release()
+	q.Release()
+}
+
+func TestValidationQueueTimeout(t *testing.T) {
+	q := newValidationQueue("test", 16)
+	require.Equal(t, validationTimeout, q.Timeout())
+	q.SetTimeout(time.Second)
+	require.Equal(t, time.Second, q.Timeout())
+	q.SetTimeout(0)
+	require.Equal(t, validationTimeout, q.Timeout())
+}
@@ -0,0 +1,190 @@
+package codanet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// PeerExchangeProtocolID is the protocol of requesting signed peer records
+// of random peers, /mina/peer-exchange being taken by the exchange pushed
+// to peers disconnected on trimming
+const PeerExchangeProtocolID = protocol.ID("/mina/peer-exchange/records")
+
+const (
+	// Records sent in a response at most
+	MaxPeerExchangeRecords = 32
+	// A peer is served one request per interval, those
+	// coming sooner are reset
+	peerExchangeRequestInterval = 10 * time.Second
+	// Peers with served requests remembered at most,
+	// requests of others are reset while it's full
+	maxPeerExchangeRequesters = 4096
+	peerExchangeTimeout       = 10 * time.Second
+	// Bound of a response, records are of a few hundred bytes
+	maxPeerExchangeResponseSize = 1 << 20
+	maxPeerExchangeRequestSize  = 1 << 10
+)
+
+type peerExchangeRequest struct {
+	Count int
+}
+
+type peerExchangeResponse struct {
+	// marshalled envelopes of signed peer records
+	Records [][]byte
+}
+
+// peerExchangeLimiter admits requests of a peer once per interval
+type peerExchangeLimiter struct {
+	served map[peer.ID]time.Time
+	now    func() time.Time
+	mutex  sync.Mutex
+}
+
+func newPeerExchangeLimiter() *peerExchangeLimiter {
+	return &peerExchangeLimiter{
+		served: make(map[peer.ID]time.Time),
+		now:    time.Now,
+	}
+}
+
+func (l *peerExchangeLimiter) admit(p peer.ID) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	if at, has := l.served[p]; has && now.Sub(at) < peerExchangeRequestInterval {
+		return false
+	}
+	if len(l.served) >= maxPeerExchangeRequesters {
+		for q, at := range l.served {
+			if now.Sub(at) >= peerExchangeRequestInterval {
+				delete(l.served, q)
+			}
+		}
+		if len(l.served) >= maxPeerExchangeRequesters {
+			return false
+		}
+	}
+	l.served[p] = now
+	return true
+}
+
+// exchangedPeerRecords returns marshalled signed records of up to n random
+// peers other than the requester. Only peers allowed by the gating and
+// without failed dials since their last outbound connection are sent.
+func (h *Helper) exchangedPeerRecords(n int, requester peer.ID) [][]byte {
+	cab, ok := peerstore.GetCertifiedAddrBook(h.Host.Peerstore())
+	if !ok {
+		return nil
+	}
+	peers := h.Host.Peerstore().PeersWithAddrs()
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	var res [][]byte
+	for _, p := range peers {
+		if len(res) >= n {
+			break
+		}
+		if p == h.Me || p == requester || !h.gatingState.isAllowedPeer(p) {
+			continue
+		}
+		if _, failed := h.ConnFailures.Get(p); failed {
+			continue
+		}
+		envelope := cab.GetPeerRecord(p)
+		if envelope == nil {
+			continue
+		}
+		b, err := envelope.Marshal()
+		if err != nil {
+			continue
+		}
+		res = append(res, b)
+	}
+	return res
+}
+
+func (h *Helper) handlePeerExchangeStreams(s network.Stream) {
+	requester := s.Conn().RemotePeer()
+	if !h.peerExchange.admit(requester) {
+		logger.Debugf("peer exchange request of %s over the rate limit", requester)
+		_ = s.Reset()
+		return
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+	_ = s.SetDeadline(time.Now().Add(peerExchangeTimeout))
+
+	var req peerExchangeRequest
+	if err := json.NewDecoder(io.LimitReader(s, maxPeerExchangeRequestSize)).Decode(&req); err != nil {
+		logger.Debugf("failed to decode peer exchange request of %s: %s", requester, err)
+		_ = s.Reset()
+		return
+	}
+	n := req.Count
+	if n > MaxPeerExchangeRecords {
+		n = MaxPeerExchangeRecords
+	}
+	resp := peerExchangeResponse{Records: h.exchangedPeerRecords(n, requester)}
+	if err := json.NewEncoder(s).Encode(&resp); err != nil {
+		logger.Debugf("failed to write peer exchange response to %s: %s", requester, err)
+		_ = s.Reset()
+	}
+}
+
+// RequestPeerRecords asks the peer for signed records of up to n random
+// peers (at most MaxPeerExchangeRecords) and adds them to the peerstore.
+// It returns peers whose records were added, records older than those
+// known are ignored.
+func (h *Helper) RequestPeerRecords(ctx context.Context, p peer.ID, n int) ([]peer.ID, error) {
+	ctx, cancel := context.WithTimeout(ctx, peerExchangeTimeout)
+	defer cancel()
+	s, err := h.Host.NewStream(ctx, p, PeerExchangeProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+	if err := json.NewEncoder(s).Encode(&peerExchangeRequest{Count: n}); err != nil {
+		_ = s.Reset()
+		return nil, err
+	}
+	if err := s.CloseWrite(); err != nil {
+		_ = s.Reset()
+		return nil, err
+	}
+	var resp peerExchangeResponse
+	if err := json.NewDecoder(io.LimitReader(s, maxPeerExchangeResponseSize)).Decode(&resp); err != nil {
+		_ = s.Reset()
+		return nil, err
+	}
+	if len(resp.Records) > n || len(resp.Records) > MaxPeerExchangeRecords {
+		return nil, errors.New("more peer records than requested")
+	}
+	var added []peer.ID
+	for _, data := range resp.Records {
+		rp, ok, err := h.ConsumePeerRecord(data, peerstore.AddressTTL)
+		if err != nil {
+			logger.Debugf("invalid peer record received from %s: %s", p, err)
+			continue
+		}
+		if ok && rp != h.Me {
+			added = append(added, rp)
+		}
+	}
+	return added, nil
+}
@@ -0,0 +1,80 @@
+package codanet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/record"
+	"github.com/libp2p/go-libp2p-core/test"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func testPeerRecord(t *testing.T, addr string) (peer.ID, []byte) {
+	sk, _, err := test.RandTestKeyPair(crypto.Ed25519, 256)
+	require.NoError(t, err)
+	p, err := peer.IDFromPrivateKey(sk)
+	require.NoError(t, err)
+	rec := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: p, Addrs: []ma.Multiaddr{ma.StringCast(addr)}})
+	envelope, err := record.Seal(rec, sk)
+	require.NoError(t, err)
+	data, err := envelope.Marshal()
+	require.NoError(t, err)
+	return p, data
+}
+
+func TestPeerExchange(t *testing.T) {
+	initPrivateIpFilter()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn := mocknet.New(ctx)
+	newHelper := func() *Helper {
+		host, err := mn.GenPeer()
+		require.NoError(t, err)
+		return &Helper{
+			Host:         host,
+			Me:           host.ID(),
+			gatingState:  NewCodaGatingState(nil, nil, nil, nil),
+			ConnFailures: NewConnectionFailures(),
+			peerExchange: newPeerExchangeLimiter(),
+		}
+	}
+	server := newHelper()
+	client := newHelper()
+	server.Host.SetStreamHandler(PeerExchangeProtocolID, server.handlePeerExchangeStreams)
+	require.NoError(t, mn.LinkAll())
+	_, err := mn.ConnectPeers(client.Me, server.Me)
+	require.NoError(t, err)
+
+	good, goodRecord := testPeerRecord(t, "/ip4/1.2.3.4/tcp/8302")
+	banned, bannedRecord := testPeerRecord(t, "/ip4/1.2.3.5/tcp/8302")
+	failing, failingRecord := testPeerRecord(t, "/ip4/1.2.3.6/tcp/8302")
+	other, otherRecord := testPeerRecord(t, "/ip4/1.2.3.7/tcp/8302")
+	for _, data := range [][]byte{goodRecord, bannedRecord, failingRecord, otherRecord} {
+		_, added, err := server.ConsumePeerRecord(data, peerstore.PermanentAddrTTL)
+		require.NoError(t, err)
+		require.True(t, added)
+	}
+	server.gatingState.BannedPeers.Add(banned)
+	server.ConnFailures.Record(failing)
+
+	// Banned peers and peers failing to be dialed aren't sent
+	peers, err := client.RequestPeerRecords(ctx, server.Me, MaxPeerExchangeRecords)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []peer.ID{good, other}, peers)
+	require.Equal(t, []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/8302")}, client.Host.Peerstore().Addrs(good))
+
+	// Requests coming sooner than the interval are refused
+	_, err = client.RequestPeerRecords(ctx, server.Me, 1)
+	require.Error(t, err)
+	now := time.Now().Add(peerExchangeRequestInterval)
+	server.peerExchange.now = func() time.Time { return now }
+	peers, err = client.RequestPeerRecords(ctx, server.Me, 1)
+	require.NoError(t, err)
+	require.Len(t, peers, 1)
+}
@@ -0,0 +1,70 @@
+package codanet
+
+import (
+	"errors"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/record"
+)
+
+// Signed peer records are exchanged by identify: the host signs a record
+// of its listen addresses and records of peers are kept in the certified
+// address book of the peerstore. They can't be forged by third parties,
+// unlike addresses learnt of from peer exchange or the DHT.
+
+var errNoCertifiedAddrBook = errors.New("peerstore doesn't keep signed peer records")
+
+// PeerRecord returns the latest signed record of the peer, nil if none
+func (h *Helper) PeerRecord(p peer.ID) *record.Envelope {
+	cab, ok := peerstore.GetCertifiedAddrBook(h.Host.Peerstore())
+	if !ok {
+		return nil
+	}
+	return cab.GetPeerRecord(p)
+}
+
+// ConsumePeerRecord adds addresses of the marshalled signed record to the
+// peerstore, e.g. a record of a trusted peer persisted by the daemon. It
+// returns the peer and whether the record was added, records older than
+// the one known are ignored.
+func (h *Helper) ConsumePeerRecord(data []byte, ttl time.Duration) (peer.ID, bool, error) {
+	cab, ok := peerstore.GetCertifiedAddrBook(h.Host.Peerstore())
+	if !ok {
+		return "", false, errNoCertifiedAddrBook
+	}
+	envelope, r, err := record.ConsumeEnvelope(data, peer.PeerRecordEnvelopeDomain)
+	if err != nil {
+		return "", false, err
+	}
+	rec, ok := r.(*peer.PeerRecord)
+	if !ok {
+		return "", false, errors.New("envelope doesn't contain a peer record")
+	}
+	added, err := cab.ConsumePeerRecord(envelope, ttl)
+	return rec.PeerID, added, err
+}
+
+// certifiedAddrs replaces addresses of the peer with those of its signed
+// record if one is known, so that addresses of peers learnt of from other
+// peers can't be spoofed
+func certifiedAddrs(ps peerstore.Peerstore, info peer.AddrInfo) peer.AddrInfo {
+	cab, ok := peerstore.GetCertifiedAddrBook(ps)
+	if !ok {
+		return info
+	}
+	envelope := cab.GetPeerRecord(info.ID)
+	if envelope == nil {
+		return info
+	}
+	r, err := envelope.Record()
+	if err != nil {
+		return info
+	}
+	rec, ok := r.(*peer.PeerRecord)
+	if !ok || rec.PeerID != info.ID {
+		return info
+	}
+	return peer.AddrInfo{ID: info.ID, Addrs: rec.Addrs}
+}
@@ -0,0 +1,44 @@
+package codanet
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/record"
+	"github.com/libp2p/go-libp2p-peerstore/pstoremem"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertifiedAddrs(t *testing.T) {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(key)
+	require.NoError(t, err)
+	signed := ma.StringCast("/ip4/1.2.3.4/tcp/8302")
+	spoofed := ma.StringCast("/ip4/6.6.6.6/tcp/8302")
+
+	ps := pstoremem.NewPeerstore()
+	defer ps.Close()
+	// Peers without a signed record keep addresses as sent
+	info := certifiedAddrs(ps, peer.AddrInfo{ID: id, Addrs: []ma.Multiaddr{spoofed}})
+	require.Equal(t, []ma.Multiaddr{spoofed}, info.Addrs)
+
+	rec := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: id, Addrs: []ma.Multiaddr{signed}})
+	envelope, err := record.Seal(rec, key)
+	require.NoError(t, err)
+	cab, ok := peerstore.GetCertifiedAddrBook(ps)
+	require.True(t, ok)
+	added, err := cab.ConsumePeerRecord(envelope, time.Hour)
+	require.NoError(t, err)
+	require.True(t, added)
+
+	info = certifiedAddrs(ps, peer.AddrInfo{ID: id, Addrs: []ma.Multiaddr{spoofed}})
+	require.Equal(t, id, info.ID)
+	require.Equal(t, 1, len(info.Addrs))
+	require.True(t, signed.Equal(info.Addrs[0]))
+}
@@ -0,0 +1,148 @@
+package codanet
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+)
+
+// ProviderHints wraps content routing used by Bitswap so that peers
+// hinted to have blocks (e.g. the peer that gossiped a block whose body
+// is being downloaded) are found as their providers at once, ahead of
+// providers found by the wrapped routing. A Bitswap session treats a
+// provider as a peer having the block, hence it asks hinted peers for
+// blocks directly. Hints are counted, so that a block wanted by several
+// sessions keeps hints of each of them until they're removed.
+// Providers found by the wrapped routing may be capped, limiting how
+// many peers a session asks for blocks; hinted peers aren't capped.
+type ProviderHints struct {
+	routing.ContentRouting
+
+	hints map[cid.Cid]map[peer.ID]int
+	// providers found by the wrapped routing passed
+	// per lookup at most, zero for no limit
+	maxProviders int
+	mutex        sync.Mutex
+}
+
+func NewProviderHints(inner routing.ContentRouting) *ProviderHints {
+	return &ProviderHints{
+		ContentRouting: inner,
+		hints:          make(map[cid.Cid]map[peer.ID]int),
+	}
+}
+
+// Add hints peers as providers of the blocks
+func (h *ProviderHints) Add(ids []cid.Cid, peers []peer.ID) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, id := range ids {
+		hints, has := h.hints[id]
+		if !has {
+			hints = make(map[peer.ID]int)
+			h.hints[id] = hints
+		}
+		for _, p := range peers {
+			hints[p]++
+		}
+	}
+}
+
+// Remove drops hints previously added
+func (h *ProviderHints) Remove(ids []cid.Cid, peers []peer.ID) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, id := range ids {
+		hints, has := h.hints[id]
+		if !has {
+			continue
+		}
+		for _, p := range peers {
+			if hints[p] <= 1 {
+				delete(hints, p)
+			} else {
+				hints[p]--
+			}
+		}
+		if len(hints) == 0 {
+			delete(h.hints, id)
+		}
+	}
+}
+
+// SetMaxProviders caps providers found by the wrapped routing
+// per lookup, zero removes the cap. Running lookups keep their cap.
+func (h *ProviderHints) SetMaxProviders(n int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.maxProviders = n
+}
+
+func (h *ProviderHints) MaxProviders() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.maxProviders
+}
+
+// Providers returns peers hinted as providers of the block
+func (h *ProviderHints) Providers(id cid.Cid) []peer.ID {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	res := make([]peer.ID, 0, len(h.hints[id]))
+	for p := range h.hints[id] {
+		res = append(res, p)
+	}
+	return res
+}
+
+func (h *ProviderHints) FindProvidersAsync(ctx context.Context, id cid.Cid, count int) <-chan peer.AddrInfo {
+	hinted := h.Providers(id)
+	limit := h.MaxProviders()
+	if limit > 0 && (count <= 0 || count > limit) {
+		count = limit
+	}
+	var in <-chan peer.AddrInfo
+	if h.ContentRouting != nil {
+		in = h.ContentRouting.FindProvidersAsync(ctx, id, count)
+	}
+	out := make(chan peer.AddrInfo)
+	go func() {
+		defer close(out)
+		send := func(p peer.AddrInfo) bool {
+			select {
+			case out <- p:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		seen := make(map[peer.ID]bool, len(hinted))
+		for _, p := range hinted {
+			seen[p] = true
+			if !send(peer.AddrInfo{ID: p}) {
+				return
+			}
+		}
+		if in == nil {
+			return
+		}
+		routed := 0
+		for p := range in {
+			if seen[p.ID] {
+				continue
+			}
+			if limit > 0 && routed >= limit {
+				// Drained for the wrapped routing to finish
+				continue
+			}
+			routed++
+			if !send(p) {
+				return
+			}
+		}
+	}()
+	return out
+}
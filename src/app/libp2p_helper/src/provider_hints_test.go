@@ -0,0 +1,83 @@
+package codanet
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+	"github.com/stretchr/testify/require"
+)
+
+type testRouting struct {
+	routing.ContentRouting
+	providers []peer.ID
+}
+
+func (r testRouting) FindProvidersAsync(_ context.Context, _ cid.Cid, _ int) <-chan peer.AddrInfo {
+	ch := make(chan peer.AddrInfo, len(r.providers))
+	for _, p := range r.providers {
+		ch <- peer.AddrInfo{ID: p}
+	}
+	close(ch)
+	return ch
+}
+
+func collectProviders(ch <-chan peer.AddrInfo) []peer.ID {
+	res := []peer.ID{}
+	for p := range ch {
+		res = append(res, p.ID)
+	}
+	return res
+}
+
+func TestProviderHints(t *testing.T) {
+	a, b, c := peer.ID("a"), peer.ID("b"), peer.ID("c")
+	x, y := BlockHashToCid([32]byte{1}), BlockHashToCid([32]byte{2})
+	h := NewProviderHints(testRouting{providers: []peer.ID{b, c}})
+
+	h.Add([]cid.Cid{x}, []peer.ID{a, b})
+	h.Add([]cid.Cid{x, y}, []peer.ID{a})
+	// Hinted peers are found first, providers found
+	// by the wrapped routing aren't repeated
+	found := collectProviders(h.FindProvidersAsync(context.Background(), x, 0))
+	require.Len(t, found, 3)
+	require.ElementsMatch(t, []peer.ID{a, b}, found[:2])
+	require.Equal(t, c, found[2])
+	require.Equal(t, []peer.ID{a, b, c}, collectProviders(h.FindProvidersAsync(context.Background(), y, 0)))
+
+	// Hints are removed once removed as many times as added
+	h.Remove([]cid.Cid{x, y}, []peer.ID{a})
+	require.ElementsMatch(t, []peer.ID{a, b}, h.Providers(x))
+	require.Empty(t, h.Providers(y))
+	h.Remove([]cid.Cid{x}, []peer.ID{a, b})
+	require.Empty(t, h.Providers(x))
+	require.Empty(t, h.hints)
+
+	// Hints work without the wrapped routing
+	h = NewProviderHints(nil)
+	h.Add([]cid.Cid{x}, []peer.ID{a})
+	require.Equal(t, []peer.ID{a}, collectProviders(h.FindProvidersAsync(context.Background(), x, 0)))
+}
+
+func TestProviderHintsMaxProviders(t *testing.T) {
+	a, b, c, d := peer.ID("a"), peer.ID("b"), peer.ID("c"), peer.ID("d")
+	x := BlockHashToCid([32]byte{1})
+	h := NewProviderHints(testRouting{providers: []peer.ID{b, c, d}})
+	h.Add([]cid.Cid{x}, []peer.ID{a, b})
+
+	// Hinted peers aren't capped, nor counted against the cap
+	h.SetMaxProviders(1)
+	require.Equal(t, []peer.ID{a, b, c}, sortedProviders(h.FindProvidersAsync(context.Background(), x, 10)))
+
+	h.SetMaxProviders(0)
+	require.Equal(t, []peer.ID{a, b, c, d}, sortedProviders(h.FindProvidersAsync(context.Background(), x, 10)))
+}
+
+func sortedProviders(ch <-chan peer.AddrInfo) []peer.ID {
+	res := collectProviders(ch)
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
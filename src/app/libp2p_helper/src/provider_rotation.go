@@ -0,0 +1,131 @@
+package codanet
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+)
+
+const (
+	// Time for which providers found for a key are collected
+	// before being handed over to Bitswap in the rotated order
+	providerRotationWindow = 500 * time.Millisecond
+
+	// Latency assumed for peers we have no latency measurements of
+	defaultProviderLatency = 100 * time.Millisecond
+
+	// Bound on the number of peers round-robin state is kept for
+	maxRotatedProviders = 4096
+)
+
+type latencyMetrics interface {
+	LatencyEWMA(peer.ID) time.Duration
+}
+
+// providerRotation wraps content routing used by Bitswap so that
+// sessions don't always lean on the same few providers (usually the
+// well-known seed nodes). Providers found for a key are re-ordered with
+// a smooth weighted round-robin, peers with lower observed latency have
+// higher weights. Round-robin state is shared among queries, so that
+// the load of subsequent catch-up downloads is spread among providers.
+type providerRotation struct {
+	routing.ContentRouting
+	metrics latencyMetrics
+	window  time.Duration
+
+	current map[peer.ID]float64
+	mutex   sync.Mutex
+}
+
+func newProviderRotation(inner routing.ContentRouting, metrics latencyMetrics) *providerRotation {
+	return &providerRotation{
+		ContentRouting: inner,
+		metrics:        metrics,
+		window:         providerRotationWindow,
+		current:        make(map[peer.ID]float64),
+	}
+}
+
+func (r *providerRotation) weight(p peer.ID) float64 {
+	l := r.metrics.LatencyEWMA(p)
+	if l <= 0 {
+		l = defaultProviderLatency
+	}
+	return float64(time.Second) / float64(l)
+}
+
+// order returns providers sorted by their current round-robin weights,
+// the leading provider is the one picked by the smooth weighted
+// round-robin and its weight is lowered for subsequent queries
+func (r *providerRotation) order(providers []peer.AddrInfo) []peer.AddrInfo {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(providers) == 0 {
+		return providers
+	}
+	if len(r.current) > maxRotatedProviders {
+		r.current = make(map[peer.ID]float64)
+	}
+	total := 0.0
+	for _, p := range providers {
+		w := r.weight(p.ID)
+		r.current[p.ID] += w
+		total += w
+	}
+	res := append([]peer.AddrInfo{}, providers...)
+	sort.SliceStable(res, func(i, j int) bool {
+		return r.current[res[i].ID] > r.current[res[j].ID]
+	})
+	r.current[res[0].ID] -= total
+	return res
+}
+
+func (r *providerRotation) FindProvidersAsync(ctx context.Context, id cid.Cid, count int) <-chan peer.AddrInfo {
+	in := r.ContentRouting.FindProvidersAsync(ctx, id, count)
+	out := make(chan peer.AddrInfo)
+	go func() {
+		defer close(out)
+		send := func(p peer.AddrInfo) bool {
+			select {
+			case out <- p:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		providers := []peer.AddrInfo{}
+		timer := time.NewTimer(r.window)
+		defer timer.Stop()
+	collect:
+		for {
+			select {
+			case p, ok := <-in:
+				if !ok {
+					break collect
+				}
+				providers = append(providers, p)
+			case <-timer.C:
+				break collect
+			case <-ctx.Done():
+				return
+			}
+		}
+		for _, p := range r.order(providers) {
+			if !send(p) {
+				return
+			}
+		}
+		// Providers found after the window are passed through as is
+		for p := range in {
+			if !send(p) {
+				return
+			}
+		}
+	}()
+	return out
+}
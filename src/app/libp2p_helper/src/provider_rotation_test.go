@@ -0,0 +1,35 @@
+package codanet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+type testLatencies map[peer.ID]time.Duration
+
+func (l testLatencies) LatencyEWMA(p peer.ID) time.Duration { return l[p] }
+
+func TestProviderRotation(t *testing.T) {
+	seed, a, b := peer.ID("seed"), peer.ID("a"), peer.ID("b")
+	r := newProviderRotation(nil, testLatencies{
+		seed: 10 * time.Millisecond,
+		a:    20 * time.Millisecond,
+		b:    20 * time.Millisecond,
+	})
+	providers := []peer.AddrInfo{{ID: seed}, {ID: a}, {ID: b}}
+
+	firsts := map[peer.ID]int{}
+	for i := 0; i < 40; i++ {
+		order := r.order(providers)
+		require.Len(t, order, 3)
+		firsts[order[0].ID]++
+	}
+	// The fastest peer leads most of the queries,
+	// but doesn't get all of the load
+	require.Equal(t, 20, firsts[seed])
+	require.Equal(t, 10, firsts[a])
+	require.Equal(t, 10, firsts[b])
+}
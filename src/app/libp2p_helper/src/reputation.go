@@ -0,0 +1,98 @@
+package codanet
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Key of the reputation record in the peerstore datastore
+var reputationKey = datastore.NewKey("/mina/reputation/v0")
+
+// Peers banned for misbehaviour (see Helper.BanPeer) before a restart
+// remain banned for this long after it, as temporary bans
+const restoredPenaltyBanDuration = 24 * time.Hour
+
+// Penalty is an offence of a peer recorded by the user of the helper,
+// e.g. a malformed block, keyed by what the offence was about
+type Penalty struct {
+	Peer peer.ID
+	Key  []byte
+	At   time.Time
+}
+
+// Reputation is the record of misbehaving peers that is kept across
+// restarts: peers banned by the helper itself, temporary bans, failed
+// dials and penalties of the user. Bans and trust configured by the
+// daemon are left out, the daemon sets them on each start.
+type Reputation struct {
+	PenalizedPeers     []peer.ID
+	TemporaryBans      []TemporaryBan
+	ConnectionFailures map[peer.ID]ConnectionFailure
+	Penalties          []Penalty
+}
+
+// Reputation returns the reputation of peers kept by the helper,
+// penalties are to be filled in by the user
+func (h *Helper) Reputation() *Reputation {
+	return &Reputation{
+		PenalizedPeers:     h.gatingState.penalizedPeers.Peers(),
+		TemporaryBans:      h.gatingState.temporaryBans.list(),
+		ConnectionFailures: h.ConnFailures.All(),
+	}
+}
+
+// RestoreReputation restores bans and failed dials of the reputation
+// saved before a restart. Penalized peers are banned temporarily, expired
+// bans are skipped, trusted peers aren't banned.
+func (h *Helper) RestoreReputation(r *Reputation) {
+	now := h.gatingState.temporaryBans.now()
+	// the longest of bans of a peer applies
+	peerBans := make(map[peer.ID]time.Duration)
+	for _, p := range r.PenalizedPeers {
+		peerBans[p] = restoredPenaltyBanDuration
+	}
+	for _, ban := range r.TemporaryBans {
+		d := ban.ExpiresAt.Sub(now)
+		if d <= 0 {
+			continue
+		}
+		if ban.IPNet != nil {
+			h.BanIPNetFor(*ban.IPNet, d)
+		} else if d > peerBans[ban.Peer] {
+			peerBans[ban.Peer] = d
+		}
+	}
+	for p, d := range peerBans {
+		h.BanPeerFor(p, d)
+	}
+	h.ConnFailures.merge(r.ConnectionFailures)
+}
+
+// SaveReputation writes the reputation to the peerstore datastore
+func (h *Helper) SaveReputation(r *Reputation) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return h.datastore.Put(reputationKey, b)
+}
+
+// LoadReputation reads the reputation saved by SaveReputation,
+// an empty one is returned if none was saved
+func (h *Helper) LoadReputation() (*Reputation, error) {
+	b, err := h.datastore.Get(reputationKey)
+	if err == datastore.ErrNotFound {
+		return &Reputation{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r Reputation
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
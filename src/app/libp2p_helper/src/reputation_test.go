@@ -0,0 +1,110 @@
+package codanet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReputationPersistence(t *testing.T) {
+	initPrivateIpFilter()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn := mocknet.New(ctx)
+	host, err := mn.GenPeer()
+	require.NoError(t, err)
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+
+	newHelper := func() *Helper {
+		trustedAddrFilters := ma.NewFilters()
+		trustedAddrFilters.AddFilter(parseCIDR("0.0.0.0/0"), ma.ActionDeny)
+		return &Helper{
+			Host:         host,
+			gatingState:  NewCodaGatingState(nil, trustedAddrFilters, nil, nil),
+			ConnFailures: NewConnectionFailures(),
+			datastore:    ds,
+		}
+	}
+
+	h := newHelper()
+	r, err := h.LoadReputation()
+	require.NoError(t, err)
+	require.Equal(t, &Reputation{}, r)
+
+	penalized := test.RandPeerIDFatal(t)
+	banned := test.RandPeerIDFatal(t)
+	failing := test.RandPeerIDFatal(t)
+	h.BanPeer(penalized)
+	h.BanPeerFor(banned, time.Hour)
+	h.BanIPNetFor(parseCIDR("1.2.3.0/24"), 2*time.Hour)
+	h.ConnFailures.Record(failing)
+	h.ConnFailures.Record(failing)
+	r = h.Reputation()
+	r.Penalties = []Penalty{{Peer: failing, Key: []byte{1, 2, 3}, At: time.Unix(1600000000, 0).UTC()}}
+	require.NoError(t, h.SaveReputation(r))
+
+	// Reputation is restored by the helper started anew
+	h = newHelper()
+	loaded, err := h.LoadReputation()
+	require.NoError(t, err)
+	require.Equal(t, r.Penalties, loaded.Penalties)
+	h.ConnFailures.Record(failing)
+	h.RestoreReputation(loaded)
+
+	require.False(t, h.gatingState.InterceptPeerDial(penalized))
+	require.False(t, h.gatingState.InterceptPeerDial(banned))
+	require.False(t, h.gatingState.InterceptAddrDial(peer.ID("other"), ma.StringCast("/ip4/1.2.3.4/tcp/8302")))
+	bans := h.TemporaryBans()
+	require.Len(t, bans, 3)
+	require.Equal(t, banned, bans[0].Peer)
+	require.Equal(t, "1.2.3.0/24", bans[1].IPNet.String())
+	// Penalized peers remain banned for a while
+	require.Equal(t, penalized, bans[2].Peer)
+	require.WithinDuration(t, time.Now().Add(restoredPenaltyBanDuration), bans[2].ExpiresAt, time.Minute)
+	failure, has := h.ConnFailures.Get(failing)
+	require.True(t, has)
+	require.Equal(t, 3, failure.Count)
+
+	// Expired bans aren't restored
+	h = newHelper()
+	h.gatingState.temporaryBans.now = func() time.Time { return time.Now().Add(3 * time.Hour) }
+	h.RestoreReputation(loaded)
+	require.Len(t, h.TemporaryBans(), 1)
+}
+
+func TestConnectionFailures(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn := mocknet.New(ctx)
+	a, err := mn.GenPeer()
+	require.NoError(t, err)
+	b, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+
+	f := NewConnectionFailures()
+	a.Network().Notify(f)
+	b.Network().Notify(f)
+	f.Record(a.ID())
+	f.Record(b.ID())
+	require.Len(t, f.All(), 2)
+
+	// Outbound connections clear the history of the dialed peer only
+	_, err = mn.ConnectPeers(a.ID(), b.ID())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, has := f.Get(b.ID())
+		return !has
+	}, 5*time.Second, 10*time.Millisecond)
+	failure, has := f.Get(a.ID())
+	require.True(t, has)
+	require.Equal(t, 1, failure.Count)
+}
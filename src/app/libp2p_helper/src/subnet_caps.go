@@ -0,0 +1,252 @@
+package codanet
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	gonet "net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Prefix lengths of subnets connections are capped per
+const (
+	subnetPrefixIPv4 = 24
+	subnetPrefixIPv6 = 48
+)
+
+type asnRange struct {
+	start gonet.IP
+	end   gonet.IP
+	asn   uint32
+}
+
+// ASNTable maps IP ranges to autonomous systems announcing them
+type ASNTable struct {
+	// sorted by start, non-overlapping
+	ranges []asnRange
+}
+
+// LoadASNTable reads a table of IP ranges of autonomous systems in the
+// tab-separated format of ip2asn (https://iptoasn.com): first and last
+// address of the range, AS number, country code and description per line.
+// Ranges of AS 0 (not routed) are skipped.
+func LoadASNTable(path string) (*ASNTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	table := &ASNTable{}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 3 {
+			continue
+		}
+		start, end := gonet.ParseIP(fields[0]), gonet.ParseIP(fields[1])
+		asn, err := strconv.ParseUint(fields[2], 10, 32)
+		if start == nil || end == nil || err != nil {
+			return nil, fmt.Errorf("malformed range on line %d of %s", line, path)
+		}
+		if asn == 0 {
+			continue
+		}
+		table.ranges = append(table.ranges, asnRange{start: start.To16(), end: end.To16(), asn: uint32(asn)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(table.ranges, func(i, j int) bool {
+		return bytes.Compare(table.ranges[i].start, table.ranges[j].start) < 0
+	})
+	return table, nil
+}
+
+// Len returns the number of IP ranges in the table
+func (t *ASNTable) Len() int {
+	if t == nil {
+		return 0
+	}
+	return len(t.ranges)
+}
+
+// Lookup returns the autonomous system announcing the address,
+// false if it's not found
+func (t *ASNTable) Lookup(ip gonet.IP) (uint32, bool) {
+	ip = ip.To16()
+	if t == nil || ip == nil {
+		return 0, false
+	}
+	// first range starting after the address
+	i := sort.Search(len(t.ranges), func(i int) bool {
+		return bytes.Compare(t.ranges[i].start, ip) > 0
+	})
+	if i == 0 {
+		return 0, false
+	}
+	r := t.ranges[i-1]
+	if bytes.Compare(ip, r.end) > 0 {
+		return 0, false
+	}
+	return r.asn, true
+}
+
+// SubnetCaps cap connections to addresses of a subnet (a /24 for IPv4 and
+// a /48 for IPv6) and of an autonomous system, so that peers of a single
+// hosting provider can't take up all connections of the node. Zero means
+// no cap, autonomous systems are capped only if their table is given.
+type SubnetCaps struct {
+	PerSubnet int
+	PerASN    int
+	ASNs      *ASNTable
+}
+
+// subnetConns counts open connections per subnet and per autonomous
+// system of their remote addresses. Connections over relays and to
+// private addresses aren't counted.
+type subnetConns struct {
+	caps SubnetCaps
+	// connections per remote IP, autonomous systems
+	// are counted anew when their table is replaced
+	ips     map[string]int
+	subnets map[string]int
+	asns    map[uint32]int
+	mutex   sync.Mutex
+}
+
+func newSubnetConns() *subnetConns {
+	return &subnetConns{
+		ips:     make(map[string]int),
+		subnets: make(map[string]int),
+		asns:    make(map[uint32]int),
+	}
+}
+
+func (c *subnetConns) setCaps(caps SubnetCaps) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.caps = caps
+	c.asns = make(map[uint32]int)
+	for ip, n := range c.ips {
+		if asn, ok := caps.ASNs.Lookup(gonet.ParseIP(ip)); ok {
+			c.asns[asn] += n
+		}
+	}
+}
+
+func (c *subnetConns) getCaps() SubnetCaps {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.caps
+}
+
+// subnetOf returns the IP of the address along with its subnet,
+// false if the address isn't subject to caps
+func subnetOf(addr ma.Multiaddr) (gonet.IP, string, bool) {
+	if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+		return nil, "", false
+	}
+	if isPrivateAddr(addr) {
+		return nil, "", false
+	}
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return nil, "", false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, ip4.Mask(gonet.CIDRMask(subnetPrefixIPv4, 32)).String(), true
+	}
+	return ip, ip.Mask(gonet.CIDRMask(subnetPrefixIPv6, 128)).String(), true
+}
+
+// full returns the cap a new connection to the address would exceed,
+// an empty string if none
+func (c *subnetConns) full(addr ma.Multiaddr) string {
+	ip, subnet, ok := subnetOf(addr)
+	if !ok {
+		return ""
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.caps.PerSubnet > 0 && c.subnets[subnet] >= c.caps.PerSubnet {
+		return "subnet " + subnet
+	}
+	if c.caps.PerASN > 0 {
+		if asn, ok := c.caps.ASNs.Lookup(ip); ok && c.asns[asn] >= c.caps.PerASN {
+			return fmt.Sprintf("AS%d", asn)
+		}
+	}
+	return ""
+}
+
+func (c *subnetConns) add(addr ma.Multiaddr, delta int) {
+	ip, subnet, ok := subnetOf(addr)
+	if !ok {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	addCount(c.ips, ip.String(), delta)
+	addCount(c.subnets, subnet, delta)
+	if asn, ok := c.caps.ASNs.Lookup(ip); ok {
+		c.asns[asn] += delta
+		if c.asns[asn] <= 0 {
+			delete(c.asns, asn)
+		}
+	}
+}
+
+func addCount(counts map[string]int, key string, delta int) {
+	counts[key] += delta
+	if counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
+
+func (c *subnetConns) Connected(net network.Network, conn network.Conn) {
+	c.add(conn.RemoteMultiaddr(), 1)
+}
+
+func (c *subnetConns) Disconnected(net network.Network, conn network.Conn) {
+	c.add(conn.RemoteMultiaddr(), -1)
+}
+
+func (c *subnetConns) Listen(net network.Network, addr ma.Multiaddr)           {}
+func (c *subnetConns) ListenClose(net network.Network, addr ma.Multiaddr)      {}
+func (c *subnetConns) OpenedStream(net network.Network, stream network.Stream) {}
+func (c *subnetConns) ClosedStream(net network.Network, stream network.Stream) {}
+
+// SetSubnetCaps replaces caps of connections per subnet and per
+// autonomous system, connections already open are kept
+func (gs *CodaGatingState) SetSubnetCaps(caps SubnetCaps) {
+	gs.subnetConns.setCaps(caps)
+}
+
+func (gs *CodaGatingState) SubnetCaps() SubnetCaps {
+	return gs.subnetConns.getCaps()
+}
+
+// isWithinSubnetCaps checks whether a new connection to the address of
+// the peer keeps connections within caps, trusted peers and addresses
+// are exempt
+func (gs *CodaGatingState) isWithinSubnetCaps(p peer.ID, addr ma.Multiaddr) bool {
+	if (p != "" && gs.isPeerTrusted(p)) || gs.isAddrTrusted(addr) {
+		return true
+	}
+	if full := gs.subnetConns.full(addr); full != "" {
+		gs.logger.Infof("refusing connection to %v: connections to %s are at their cap", addr, full)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package codanet
+
+import (
+	"io/ioutil"
+	gonet "net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+const testASNTable = "1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n" +
+	"1.0.1.0\t1.0.3.255\t0\tNone\tNot routed\n" +
+	"5.0.0.0\t5.0.255.255\t64500\tDE\tEXAMPLE\n" +
+	"2a01::\t2a01:ffff:ffff:ffff:ffff:ffff:ffff:ffff\t64501\tFR\tEXAMPLE6\n"
+
+func loadTestASNTable(t *testing.T) *ASNTable {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ip2asn.tsv")
+	require.NoError(t, ioutil.WriteFile(path, []byte(testASNTable), 0644))
+	table, err := LoadASNTable(path)
+	require.NoError(t, err)
+	return table
+}
+
+func TestASNTable(t *testing.T) {
+	table := loadTestASNTable(t)
+	for ip, asn := range map[string]uint32{
+		"1.0.0.1":    13335,
+		"1.0.0.255":  13335,
+		"5.0.10.1":   64500,
+		"2a01:4f8::": 64501,
+	} {
+		found, ok := table.Lookup(gonet.ParseIP(ip))
+		require.True(t, ok, ip)
+		require.Equal(t, asn, found, ip)
+	}
+	for _, ip := range []string{"0.255.255.255", "1.0.2.1", "5.1.0.0", "2a02::1"} {
+		_, ok := table.Lookup(gonet.ParseIP(ip))
+		require.False(t, ok, ip)
+	}
+}
+
+func TestSubnetCaps(t *testing.T) {
+	initPrivateIpFilter()
+
+	_, totalIpNet, err := gonet.ParseCIDR("0.0.0.0/0")
+	require.NoError(t, err)
+	trustedAddrFilters := ma.NewFilters()
+	trustedAddrFilters.AddFilter(*totalIpNet, ma.ActionDeny)
+	gs := NewCodaGatingState(nil, trustedAddrFilters, nil, nil)
+
+	local := ma.StringCast("/ip4/8.8.8.8/tcp/8302")
+	accept := func(remote string) bool {
+		return gs.InterceptAccept(testConnMultiaddrs{local: local, remote: ma.StringCast(remote)})
+	}
+	open := func(remote string) {
+		gs.subnetConns.add(ma.StringCast(remote), 1)
+	}
+
+	gs.SetSubnetCaps(SubnetCaps{PerSubnet: 2})
+	open("/ip4/5.0.0.1/tcp/8302")
+	require.True(t, accept("/ip4/5.0.0.2/tcp/8302"))
+	open("/ip4/5.0.0.2/tcp/8302")
+	require.False(t, accept("/ip4/5.0.0.3/tcp/8302"))
+	require.False(t, gs.InterceptAddrDial(peer.ID("a"), ma.StringCast("/ip4/5.0.0.3/tcp/8302")))
+	// Other subnets, private addresses and relayed connections aren't capped
+	require.True(t, accept("/ip4/5.0.1.1/tcp/8302"))
+	require.True(t, accept("/ip4/10.0.0.1/tcp/8302"))
+	require.True(t, gs.InterceptAddrDial(peer.ID("a"), ma.StringCast("/ip4/5.0.0.3/tcp/8302/p2p/QmYyQSo1c1Ym7orWxLYvCrM2EmxFTANf8wXmmE7DWjhx5N/p2p-circuit")))
+	// Trusted peers are exempt
+	gs.TrustedPeers.Add(peer.ID("a"))
+	require.True(t, gs.InterceptAddrDial(peer.ID("a"), ma.StringCast("/ip4/5.0.0.3/tcp/8302")))
+
+	gs.subnetConns.add(ma.StringCast("/ip4/5.0.0.2/tcp/8302"), -1)
+	require.True(t, accept("/ip4/5.0.0.3/tcp/8302"))
+
+	// Connections already open are counted per autonomous system once
+	// the table is given
+	gs.SetSubnetCaps(SubnetCaps{PerASN: 2, ASNs: loadTestASNTable(t)})
+	require.True(t, accept("/ip4/5.0.1.1/tcp/8302"))
+	open("/ip4/5.0.1.1/tcp/8302")
+	require.False(t, accept("/ip4/5.0.2.1/tcp/8302"))
+	require.True(t, accept("/ip4/1.0.0.1/tcp/8302"))
+	require.True(t, accept("/ip4/9.9.9.9/tcp/8302"))
+
+	// Replacing caps keeps counts
+	gs.SetSubnetCaps(SubnetCaps{PerASN: 3, ASNs: gs.SubnetCaps().ASNs})
+	require.True(t, accept("/ip4/5.0.2.1/tcp/8302"))
+	open("/ip4/5.0.2.1/tcp/8302")
+	require.False(t, accept("/ip4/5.0.3.1/tcp/8302"))
+}
@@ -0,0 +1,183 @@
+package codanet
+
+import (
+	"context"
+	gonet "net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Interval of removing expired temporary bans
+const temporaryBanSweepInterval = time.Minute
+
+// TemporaryBan is a ban of a peer or of an IP range lifted once it expires
+type TemporaryBan struct {
+	// set for bans of peers
+	Peer peer.ID `json:",omitempty"`
+	// set for bans of IP ranges
+	IPNet     *gonet.IPNet `json:",omitempty"`
+	ExpiresAt time.Time
+}
+
+// temporaryBans are bans of peers and IP ranges with expiry, kept apart
+// from banned peers and IPs of the gating config, which are replaced
+// by the daemon
+type temporaryBans struct {
+	peers map[peer.ID]time.Time
+	// keyed by the string of the range
+	ipNets map[string]TemporaryBan
+	now    func() time.Time
+	mutex  sync.RWMutex
+}
+
+func newTemporaryBans() *temporaryBans {
+	return &temporaryBans{
+		peers:  make(map[peer.ID]time.Time),
+		ipNets: make(map[string]TemporaryBan),
+		now:    time.Now,
+	}
+}
+
+func (b *temporaryBans) banPeer(p peer.ID, d time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if d <= 0 {
+		delete(b.peers, p)
+		return
+	}
+	b.peers[p] = b.now().Add(d)
+}
+
+func (b *temporaryBans) banIPNet(ipNet gonet.IPNet, d time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	key := ipNet.String()
+	if d <= 0 {
+		delete(b.ipNets, key)
+		return
+	}
+	b.ipNets[key] = TemporaryBan{IPNet: &ipNet, ExpiresAt: b.now().Add(d)}
+}
+
+func (b *temporaryBans) isPeerBanned(p peer.ID) bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	expiresAt, has := b.peers[p]
+	return has && b.now().Before(expiresAt)
+}
+
+func (b *temporaryBans) isAddrBanned(addr ma.Multiaddr) bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if len(b.ipNets) == 0 {
+		return false
+	}
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return false
+	}
+	now := b.now()
+	for _, ban := range b.ipNets {
+		if now.Before(ban.ExpiresAt) && ban.IPNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns active bans, those expiring first come first
+func (b *temporaryBans) list() []TemporaryBan {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	now := b.now()
+	res := make([]TemporaryBan, 0, len(b.peers)+len(b.ipNets))
+	for p, expiresAt := range b.peers {
+		if now.Before(expiresAt) {
+			res = append(res, TemporaryBan{Peer: p, ExpiresAt: expiresAt})
+		}
+	}
+	for _, ban := range b.ipNets {
+		if now.Before(ban.ExpiresAt) {
+			res = append(res, ban)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ExpiresAt.Before(res[j].ExpiresAt) })
+	return res
+}
+
+// sweep removes expired bans, they're ignored by checks meanwhile
+func (b *temporaryBans) sweep() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := b.now()
+	for p, expiresAt := range b.peers {
+		if !now.Before(expiresAt) {
+			delete(b.peers, p)
+		}
+	}
+	for key, ban := range b.ipNets {
+		if !now.Before(ban.ExpiresAt) {
+			delete(b.ipNets, key)
+		}
+	}
+}
+
+func (b *temporaryBans) sweepPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(temporaryBanSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.sweep()
+		}
+	}
+}
+
+// BanPeerFor bans the peer for the duration and closes connections to
+// it, zero duration lifts its temporary ban. Trusted peers aren't banned.
+func (h *Helper) BanPeerFor(p peer.ID, d time.Duration) {
+	if d > 0 && h.gatingState.isPeerTrusted(p) {
+		return
+	}
+	h.gatingState.temporaryBans.banPeer(p, d)
+	if d <= 0 {
+		return
+	}
+	go func() {
+		if err := h.Host.Network().ClosePeer(p); err != nil {
+			h.gatingState.logger.Infof("failed to close banned peer %v: %v", p, err)
+		}
+	}()
+}
+
+// BanIPNetFor bans the IP range for the duration and closes connections
+// from its addresses to peers that aren't trusted, zero duration lifts
+// its temporary ban. Trusted addresses aren't banned.
+func (h *Helper) BanIPNetFor(ipNet gonet.IPNet, d time.Duration) {
+	h.gatingState.temporaryBans.banIPNet(ipNet, d)
+	if d <= 0 {
+		return
+	}
+	for _, c := range h.Host.Network().Conns() {
+		if !h.gatingState.isAllowedPeerWithAddr(c.RemotePeer(), c.RemoteMultiaddr()) {
+			go func(c network.Conn) {
+				if err := c.Close(); err != nil {
+					h.gatingState.logger.Infof("failed to close connection to banned addr %v: %v", c.RemoteMultiaddr(), err)
+				}
+			}(c)
+		}
+	}
+}
+
+// TemporaryBans lists active temporary bans, those expiring first come first
+func (h *Helper) TemporaryBans() []TemporaryBan {
+	return h.gatingState.temporaryBans.list()
+}
@@ -0,0 +1,62 @@
+package codanet
+
+import (
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemporaryBans(t *testing.T) {
+	initPrivateIpFilter()
+	trustedAddrFilters := ma.NewFilters()
+	trustedAddrFilters.AddFilter(parseCIDR("0.0.0.0/0"), ma.ActionDeny)
+	gs := NewCodaGatingState(nil, trustedAddrFilters, nil, nil)
+	now := time.Unix(1600000000, 0)
+	gs.temporaryBans.now = func() time.Time { return now }
+
+	p := peer.ID("testid")
+	addr := ma.StringCast("/ip4/1.2.3.4/tcp/8302")
+	local := ma.StringCast("/ip4/5.6.7.8/tcp/8302")
+	require.True(t, gs.InterceptPeerDial(p))
+	require.True(t, gs.InterceptAccept(testConnMultiaddrs{local: local, remote: addr}))
+
+	gs.temporaryBans.banPeer(p, time.Hour)
+	gs.temporaryBans.banIPNet(parseCIDR("1.2.3.0/24"), 2*time.Hour)
+	require.False(t, gs.InterceptPeerDial(p))
+	require.False(t, gs.InterceptAccept(testConnMultiaddrs{local: local, remote: addr}))
+	require.False(t, gs.InterceptAddrDial(peer.ID("other"), addr))
+	require.True(t, gs.InterceptAddrDial(peer.ID("other"), ma.StringCast("/ip4/1.2.4.4/tcp/8302")))
+
+	bans := gs.temporaryBans.list()
+	require.Len(t, bans, 2)
+	require.Equal(t, p, bans[0].Peer)
+	require.Equal(t, now.Add(time.Hour), bans[0].ExpiresAt)
+	require.Equal(t, "1.2.3.0/24", bans[1].IPNet.String())
+
+	// Bans are lifted once they expire, before they're swept
+	now = now.Add(time.Hour)
+	require.True(t, gs.InterceptPeerDial(p))
+	require.False(t, gs.InterceptAccept(testConnMultiaddrs{local: local, remote: addr}))
+	require.Len(t, gs.temporaryBans.list(), 1)
+	gs.temporaryBans.sweep()
+	require.Empty(t, gs.temporaryBans.peers)
+	require.Len(t, gs.temporaryBans.ipNets, 1)
+
+	// Zero duration lifts a ban
+	gs.temporaryBans.banIPNet(parseCIDR("1.2.3.0/24"), 0)
+	require.True(t, gs.InterceptAccept(testConnMultiaddrs{local: local, remote: addr}))
+	require.Empty(t, gs.temporaryBans.list())
+
+	// Trusted peers and addresses are let through
+	gs.temporaryBans.banPeer(p, time.Hour)
+	gs.TrustedPeers.Add(p)
+	require.True(t, gs.InterceptPeerDial(p))
+	gs.temporaryBans.banIPNet(parseCIDR("1.2.3.4/32"), time.Hour)
+	require.True(t, gs.InterceptAddrDial(p, addr))
+	require.False(t, gs.InterceptAccept(testConnMultiaddrs{local: local, remote: addr}))
+	trustedAddrFilters.AddFilter(parseCIDR("1.2.3.0/24"), ma.ActionAccept)
+	require.True(t, gs.InterceptAccept(testConnMultiaddrs{local: local, remote: addr}))
+}